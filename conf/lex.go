@@ -866,10 +866,25 @@ func lexString(lx *lexer) stateFn {
 		lx.next()
 		lx.ignore()
 		return lx.pop()
+	case r == '$' && lx.peek() == mapStart:
+		return lexStringVariableReference
 	}
 	return lexString
 }
 
+// lexStringVariableReference consumes a ${VAR} reference in a raw string up
+// to the closing brace, so that it is not taken as the end of a map.
+func lexStringVariableReference(lx *lexer) stateFn {
+	r := lx.next()
+	switch {
+	case r == mapEnd:
+		return lexString
+	case isNL(r) || r == eof:
+		return lx.errorf("Unterminated variable reference.")
+	}
+	return lexStringVariableReference
+}
+
 // lexBlock consumes the inner contents as a string. It assumes that the
 // beginning '(' has already been consumed and ignored. It will continue
 // processing until it finds a ')' on a new line by itself.
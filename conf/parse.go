@@ -26,9 +26,15 @@ package conf
 // see parse_test.go for more examples.
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -57,6 +63,10 @@ type parser struct {
 
 	// pedantic reports error when configuration is not correct.
 	pedantic bool
+
+	// Sources (files or URLs) being parsed, from the top level one, to
+	// detect include cycles.
+	sources []string
 }
 
 // Parse will return a map of keys to interface{}, although concrete types
@@ -127,14 +137,32 @@ func (t *token) Position() int {
 }
 
 func parse(data, fp string, pedantic bool) (p *parser, err error) {
+	var sources []string
+	if fp != "" {
+		sources = []string{filepath.Clean(fp)}
+	}
+	return parseSource(data, fp, pedantic, sources)
+}
+
+// parseSource parses the data read from the given file or URL, which is
+// the last of the sources being parsed.
+func parseSource(data, fp string, pedantic bool, sources []string) (p *parser, err error) {
+	dir := filepath.Dir(fp)
+	if isURLInclude(fp) {
+		u, _ := url.Parse(fp)
+		u.Path = path.Dir(u.Path) + "/"
+		u.Fragment = ""
+		dir = u.String()
+	}
 	p = &parser{
 		mapping:  make(map[string]interface{}),
 		lx:       lex(data),
 		ctxs:     make([]interface{}, 0, 4),
 		keys:     make([]string, 0, 4),
 		ikeys:    make([]item, 0, 4),
-		fp:       filepath.Dir(fp),
+		fp:       dir,
 		pedantic: pedantic,
+		sources:  sources,
 	}
 	p.pushContext(p.mapping)
 
@@ -227,7 +255,11 @@ func (p *parser) processItem(it item, fp string) error {
 		setValue(it, p.popContext())
 	case itemString:
 		// FIXME(dlc) sanitize string?
-		setValue(it, it.val)
+		v, err := p.expandVariables(it)
+		if err != nil {
+			return err
+		}
+		setValue(it, v)
 	case itemInteger:
 		lastDigit := 0
 		for _, r := range it.val {
@@ -299,7 +331,17 @@ func (p *parser) processItem(it item, fp string) error {
 		p.popContext()
 		setValue(it, array)
 	case itemVariable:
-		value, found, err := p.lookupVariable(it.val)
+		// A raw string starting with a ${VAR} reference.
+		if strings.HasPrefix(it.val, "{") && !isVariableReference(it.val) {
+			it.val = "$" + it.val
+			v, err := p.expandVariables(it)
+			if err != nil {
+				return err
+			}
+			setValue(it, v)
+			break
+		}
+		value, found, err := p.lookupVariable(strings.TrimSuffix(strings.TrimPrefix(it.val, "{"), "}"))
 		if err != nil {
 			return fmt.Errorf("variable reference for '%s' on line %d could not be parsed: %s",
 				it.val, it.line, err)
@@ -324,15 +366,7 @@ func (p *parser) processItem(it item, fp string) error {
 			p.setValue(value)
 		}
 	case itemInclude:
-		var (
-			m   map[string]interface{}
-			err error
-		)
-		if p.pedantic {
-			m, err = ParseFileWithChecks(filepath.Join(p.fp, it.val))
-		} else {
-			m, err = ParseFile(filepath.Join(p.fp, it.val))
-		}
+		m, err := p.parseInclude(it.val)
 		if err != nil {
 			return fmt.Errorf("error parsing include file '%s', %v", it.val, err)
 		}
@@ -352,6 +386,151 @@ func (p *parser) processItem(it item, fp string) error {
 	return nil
 }
 
+// Maximum time to fetch a configuration included from a URL.
+const includeURLTimeout = 10 * time.Second
+
+// Maximum size of a configuration included from a URL.
+const includeURLMaxSize = 10 * 1024 * 1024
+
+// Prefix of the fragment of an include URL carrying the checksum of the content.
+const includeChecksumPrefix = "sha256="
+
+// Returns true if the include is an http(s) URL.
+func isURLInclude(inc string) bool {
+	return strings.HasPrefix(inc, "http://") || strings.HasPrefix(inc, "https://")
+}
+
+// parseInclude parses the included file or URL, resolving a relative
+// reference against the location of the including configuration.
+func (p *parser) parseInclude(inc string) (map[string]interface{}, error) {
+	var src string
+	switch {
+	case isURLInclude(inc):
+		src = inc
+	case isURLInclude(p.fp):
+		base, _ := url.Parse(p.fp)
+		ref, err := url.Parse(inc)
+		if err != nil {
+			return nil, err
+		}
+		src = base.ResolveReference(ref).String()
+	case filepath.IsAbs(inc):
+		src = filepath.Clean(inc)
+	default:
+		src = filepath.Join(p.fp, inc)
+	}
+	// The checksum is not part of the identity of a URL include.
+	id := src
+	if isURLInclude(src) {
+		id = strings.SplitN(src, "#", 2)[0]
+	}
+	for _, s := range p.sources {
+		if s == id {
+			return nil, fmt.Errorf("include cycle detected for '%s'", id)
+		}
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+	if isURLInclude(src) {
+		data, err = fetchInclude(src)
+	} else if data, err = ioutil.ReadFile(src); err != nil {
+		err = fmt.Errorf("error opening config file: %v", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sources := append(p.sources[:len(p.sources):len(p.sources)], id)
+	ip, err := parseSource(string(data), src, p.pedantic, sources)
+	if err != nil {
+		return nil, err
+	}
+	return ip.mapping, nil
+}
+
+// fetchInclude gets the content of an included URL, which must carry the
+// SHA-256 checksum of the content in its fragment, e.g.
+// https://example.com/accounts.conf#sha256=<hex>
+func fetchInclude(src string) ([]byte, error) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(u.Fragment, includeChecksumPrefix) {
+		return nil, fmt.Errorf("include URL requires a '#%s<hex>' checksum", includeChecksumPrefix)
+	}
+	expected := strings.ToLower(strings.TrimPrefix(u.Fragment, includeChecksumPrefix))
+	u.Fragment = ""
+
+	client := &http.Client{Timeout: includeURLTimeout}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("error fetching config: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching config: %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, includeURLMaxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching config: %v", err)
+	}
+	if len(data) > includeURLMaxSize {
+		return nil, fmt.Errorf("config exceeds %d bytes", includeURLMaxSize)
+	}
+	sum := sha256.Sum256(data)
+	if actual := hex.EncodeToString(sum[:]); actual != expected {
+		return nil, fmt.Errorf("checksum mismatch, expected %s, got %s", expected, actual)
+	}
+	return data, nil
+}
+
+// Returns true if the variable is a single {VAR} reference.
+func isVariableReference(v string) bool {
+	return strings.HasPrefix(v, "{") && strings.Index(v, "}") == len(v)-1
+}
+
+// expandVariables replaces the ${VAR} references in a string value with the
+// values of the variables, looked up like $VAR ones.
+func (p *parser) expandVariables(it item) (string, error) {
+	s := it.val
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var sb strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			sb.WriteString(s)
+			break
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated variable reference on line %d", it.line)
+		}
+		name := s[start+2 : start+end]
+		value, found, err := p.lookupVariable(name)
+		if err != nil {
+			return "", fmt.Errorf("variable reference for '%s' on line %d could not be parsed: %s",
+				name, it.line, err)
+		}
+		if !found {
+			return "", fmt.Errorf("variable reference for '%s' on line %d can not be found",
+				name, it.line)
+		}
+		if tk, ok := value.(*token); ok {
+			tk.usedVariable = true
+			value = tk.Value()
+		}
+		sb.WriteString(s[:start])
+		fmt.Fprint(&sb, value)
+		s = s[start+end+1:]
+	}
+	return sb.String(), nil
+}
+
 // Used to map an environment value into a temporary map to pass to secondary Parse call.
 const pkey = "pk"
 
@@ -1,8 +1,14 @@
 package conf
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -132,6 +138,43 @@ func TestEnvVariableStringStartingWithNumberUsingQuotes(t *testing.T) {
 	test(t, fmt.Sprintf("foo = $%s", evar), ex)
 }
 
+func TestEnvVariableExpansion(t *testing.T) {
+	os.Setenv("__UNIQ_HOST__", "example.com")
+	defer os.Unsetenv("__UNIQ_HOST__")
+	os.Setenv("__UNIQ_PORT__", "4222")
+	defer os.Unsetenv("__UNIQ_PORT__")
+
+	ex := map[string]interface{}{
+		"port": int64(4222),
+		"url":  "nats://example.com:4222",
+		"raw":  "example.com:4222",
+		"nest": map[string]interface{}{
+			"host":    "example.com",
+			"account": "acc-4222",
+		},
+		"list": []interface{}{"x.example.com"},
+	}
+	test(t, `
+		port: ${__UNIQ_PORT__}
+		url: "nats://${__UNIQ_HOST__}:${__UNIQ_PORT__}"
+		raw: ${__UNIQ_HOST__}:${__UNIQ_PORT__}
+		nest {
+			host: ${__UNIQ_HOST__}
+			account: 'acc-${port}'
+		}
+		list: [x.${__UNIQ_HOST__}]
+	`, ex)
+
+	for _, conf := range []string{`foo: "${__UNIQ_MISSING__}"`, `foo: x${__UNIQ_MISSING__}`} {
+		if _, err := Parse(conf); err == nil || !strings.HasPrefix(err.Error(), "variable reference") {
+			t.Fatalf("Expected a variable reference error for %q, got %v", conf, err)
+		}
+	}
+	if _, err := Parse("foo: \"${__UNIQ_PORT__\""); err == nil || !strings.Contains(err.Error(), "unterminated") {
+		t.Fatalf("Expected an unterminated reference error, got %v", err)
+	}
+}
+
 func TestBcryptVariable(t *testing.T) {
 	ex := map[string]interface{}{
 		"password": "$2a$11$ooo",
@@ -359,3 +402,84 @@ func TestIncludeVariablesWithChecks(t *testing.T) {
 	expectKeyVal(t, m, "BOB_PASS", "$2a$11$dZM98SpGeI7dCFFGSpt.JObQcix8YHml4TBUZoge9R1uxnMIln5ly", 3, 1)
 	expectKeyVal(t, m, "CAROL_PASS", "foo", 6, 3)
 }
+
+func TestIncludeAbsolutePathAndCycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		t.Helper()
+		fp := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fp, []byte(content), 0644); err != nil {
+			t.Fatalf("Error writing file: %v", err)
+		}
+		return fp
+	}
+	inc := write("inc.conf", "port: 4222")
+	m, err := Parse(fmt.Sprintf("include %q", inc))
+	if err != nil {
+		t.Fatalf("Received err: %v", err)
+	}
+	if m["port"] != int64(4222) {
+		t.Fatalf("Unexpected config: %+v", m)
+	}
+
+	write("a.conf", "include ./b.conf")
+	write("b.conf", "include ./sub/../a.conf")
+	if _, err := ParseFile(filepath.Join(dir, "a.conf")); err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Fatalf("Expected an include cycle error, got %v", err)
+	}
+}
+
+func TestIncludeURL(t *testing.T) {
+	files := map[string]string{
+		"/conf/main.conf": "port: 4222\ninclude ./auth.conf#sha256=%s",
+		"/conf/auth.conf": "authorization { user: foo }",
+	}
+	checksum := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+	files["/conf/main.conf"] = fmt.Sprintf(files["/conf/main.conf"], checksum(files["/conf/auth.conf"]))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer ts.Close()
+
+	main := ts.URL + "/conf/main.conf"
+	m, err := Parse(fmt.Sprintf("include '%s#sha256=%s'", main, checksum(files["/conf/main.conf"])))
+	if err != nil {
+		t.Fatalf("Received err: %v", err)
+	}
+	ex := map[string]interface{}{
+		"port":          int64(4222),
+		"authorization": map[string]interface{}{"user": "foo"},
+	}
+	if !reflect.DeepEqual(m, ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", m, ex)
+	}
+
+	for _, test := range []struct {
+		name string
+		inc  string
+		err  string
+	}{
+		{"no checksum", main, "requires"},
+		{"bad checksum", main + "#sha256=" + checksum("x"), "checksum mismatch"},
+		{"not found", ts.URL + "/conf/none.conf#sha256=" + checksum("x"), "404"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Parse(fmt.Sprintf("include '%s'", test.inc)); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -1,7 +1,8 @@
 module github.com/nats-io/nats-server/v2
 
+go 1.27.1
+
 require (
-	github.com/golang/protobuf v1.3.1 // indirect
 	github.com/nats-io/jwt v0.2.6
 	github.com/nats-io/nats.go v1.8.1
 	github.com/nats-io/nkeys v0.0.2
@@ -9,3 +10,9 @@ require (
 	golang.org/x/crypto v0.0.0-20190530122614-20be4c3c3ed5
 	golang.org/x/sys v0.0.0-20190412213103-97732733099d
 )
+
+require (
+	github.com/golang/protobuf v1.3.1 // indirect
+	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3 // indirect
+	golang.org/x/text v0.3.0 // indirect
+)
@@ -0,0 +1,175 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Socket of the native protocol of the systemd journal.
+var journalSocket = "/run/systemd/journal/socket"
+
+// Syslog priorities of the levels, as expected in the PRIORITY field.
+var journalPriorities = map[Level]int{
+	LevelTrace: 7,
+	LevelDebug: 7,
+	LevelInfo:  5,
+	LevelWarn:  4,
+	LevelError: 3,
+	LevelFatal: 2,
+}
+
+// JournalLogger logs to the systemd journal with its native protocol. The
+// fields of the statements are sent as journal fields, prefixed by NATS_.
+type JournalLogger struct {
+	mu       sync.Mutex
+	conn     *net.UnixConn
+	ident    string
+	serverID string
+	pid      string
+	debug    bool
+	trace    bool
+}
+
+// JournalAvailable returns true if the systemd journal can be logged to.
+func JournalAvailable() bool {
+	_, err := os.Stat(journalSocket)
+	return err == nil
+}
+
+// NewJournalLogger creates a logger writing to the systemd journal.
+func NewJournalLogger(serverID string, debug, trace bool) (*JournalLogger, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the journal: %v", err)
+	}
+	return &JournalLogger{
+		conn:     conn,
+		ident:    GetSysLoggerTag(),
+		serverID: serverID,
+		pid:      strconv.Itoa(os.Getpid()),
+		debug:    debug,
+		trace:    trace,
+	}, nil
+}
+
+// Close implements the io.Closer interface to clean up
+// resources in the server's logger implementation.
+func (l *JournalLogger) Close() error {
+	return l.conn.Close()
+}
+
+// Logf logs a statement with the fields, given as key and value pairs.
+func (l *JournalLogger) Logf(level Level, fields []interface{}, format string, v ...interface{}) {
+	if (level == LevelDebug && !l.debug) || (level == LevelTrace && !l.trace) {
+		return
+	}
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", fmt.Sprintf(format, v...))
+	writeJournalField(&b, "PRIORITY", strconv.Itoa(journalPriorities[level]))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", l.ident)
+	writeJournalField(&b, "SYSLOG_PID", l.pid)
+	writeJournalField(&b, "NATS_LEVEL", level.String())
+	if l.serverID != "" {
+		writeJournalField(&b, "NATS_SERVER_ID", l.serverID)
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		key, ok := fields[i].(string)
+		if !ok {
+			continue
+		}
+		value := fields[i+1]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		writeJournalField(&b, journalFieldName(key), fmt.Sprint(value))
+	}
+
+	l.mu.Lock()
+	l.conn.Write(b.Bytes())
+	l.mu.Unlock()
+	if level == LevelFatal {
+		os.Exit(1)
+	}
+}
+
+// Returns the journal field name of a statement field. Journal field names
+// only have upper case letters, digits and underscores.
+func journalFieldName(key string) string {
+	name := []byte("NATS_" + strings.ToUpper(key))
+	for i, c := range name {
+		if !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') {
+			name[i] = '_'
+		}
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return string(name)
+}
+
+// Writes a field in the journal export format. Values with new lines are
+// written with their size instead of being terminated by a new line.
+func writeJournalField(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	if strings.IndexByte(value, '\n') < 0 {
+		b.WriteByte('=')
+		b.WriteString(value)
+	} else {
+		b.WriteByte('\n')
+		binary.Write(b, binary.LittleEndian, uint64(len(value)))
+		b.WriteString(value)
+	}
+	b.WriteByte('\n')
+}
+
+// Noticef logs a notice statement
+func (l *JournalLogger) Noticef(format string, v ...interface{}) {
+	l.Logf(LevelInfo, nil, format, v...)
+}
+
+// Warnf logs a notice statement
+func (l *JournalLogger) Warnf(format string, v ...interface{}) {
+	l.Logf(LevelWarn, nil, format, v...)
+}
+
+// Errorf logs an error statement
+func (l *JournalLogger) Errorf(format string, v ...interface{}) {
+	l.Logf(LevelError, nil, format, v...)
+}
+
+// Fatalf logs a fatal error
+func (l *JournalLogger) Fatalf(format string, v ...interface{}) {
+	l.Logf(LevelFatal, nil, format, v...)
+}
+
+// Debugf logs a debug statement
+func (l *JournalLogger) Debugf(format string, v ...interface{}) {
+	l.Logf(LevelDebug, nil, format, v...)
+}
+
+// Tracef logs a trace statement
+func (l *JournalLogger) Tracef(format string, v ...interface{}) {
+	l.Logf(LevelTrace, nil, format, v...)
+}
@@ -0,0 +1,36 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package logger
+
+import "errors"
+
+// JournalLogger logs to the systemd journal, only available on Linux. It
+// only has the methods of a logger here.
+type JournalLogger struct {
+	*JSONLogger
+}
+
+// JournalAvailable returns true if the systemd journal can be logged to.
+func JournalAvailable() bool {
+	return false
+}
+
+// NewJournalLogger returns an error since the journal is only available
+// on Linux.
+func NewJournalLogger(serverID string, debug, trace bool) (*JournalLogger, error) {
+	return nil, errors.New("the journal is only available on Linux")
+}
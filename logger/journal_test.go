@@ -0,0 +1,114 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Reads a journal entry from the socket and returns its fields.
+func readJournalEntry(t *testing.T, conn *net.UnixConn) map[string]string {
+	t.Helper()
+	buf := make([]byte, 64*1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Error reading entry: %v", err)
+	}
+	fields := map[string]string{}
+	for b := buf[:n]; len(b) > 0; {
+		i := bytes.IndexAny(b, "=\n")
+		if i < 0 {
+			t.Fatalf("Invalid entry: %q", buf[:n])
+		}
+		name := string(b[:i])
+		if b[i] == '=' {
+			end := bytes.IndexByte(b, '\n')
+			fields[name] = string(b[i+1 : end])
+			b = b[end+1:]
+		} else {
+			size := int(binary.LittleEndian.Uint64(b[i+1 : i+9]))
+			fields[name] = string(b[i+9 : i+9+size])
+			b = b[i+9+size+1:]
+		}
+	}
+	return fields
+}
+
+func TestJournalLogger(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "_nats-server")
+	if err != nil {
+		t.Fatalf("Could not create tmp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	defer func(s string) { journalSocket = s }(journalSocket)
+	journalSocket = filepath.Join(tmpDir, "socket")
+	if JournalAvailable() {
+		t.Fatalf("Expected the journal to not be available")
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer conn.Close()
+	if !JournalAvailable() {
+		t.Fatalf("Expected the journal to be available")
+	}
+
+	SetSyslogName("nats-test")
+	defer SetSyslogName("")
+	l, err := NewJournalLogger("SRV", false, false)
+	if err != nil {
+		t.Fatalf("Error creating logger: %v", err)
+	}
+	defer l.Close()
+
+	l.Logf(LevelWarn, []interface{}{"client_id", 5, "last-error", errors.New("line1\nline2")}, "hello %s", "world")
+	fields := readJournalEntry(t, conn)
+	for name, value := range map[string]string{
+		"MESSAGE":           "hello world",
+		"PRIORITY":          "4",
+		"SYSLOG_IDENTIFIER": "nats-test",
+		"NATS_LEVEL":        "warn",
+		"NATS_SERVER_ID":    "SRV",
+		"NATS_CLIENT_ID":    "5",
+		"NATS_LAST_ERROR":   "line1\nline2",
+	} {
+		if fields[name] != value {
+			t.Fatalf("Expected %s to be %q, got %q", name, value, fields[name])
+		}
+	}
+	if fields["SYSLOG_PID"] == "" {
+		t.Fatalf("Expected the pid, got %v", fields)
+	}
+
+	// Debug statements are skipped unless enabled.
+	l.Debugf("debug")
+	l.Errorf("error")
+	if fields := readJournalEntry(t, conn); fields["MESSAGE"] != "error" || fields["PRIORITY"] != "3" {
+		t.Fatalf("Unexpected entry: %v", fields)
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Level is the level of a log statement.
+type Level int
+
+const (
+	LevelTrace Level = iota
+	LevelDebug
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelFatal
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelTrace:
+		return "trace"
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	case LevelFatal:
+		return "fatal"
+	}
+	return "unknown"
+}
+
+// JSONLogger writes each statement as a JSON object on its own line, with
+// the time, level, server id, pid and message, followed by the fields of
+// the statement, if any.
+type JSONLogger struct {
+	mu       sync.Mutex
+	out      func(level Level, line []byte)
+	serverID string
+	pid      int
+	debug    bool
+	trace    bool
+	logFile  *RotatingFile // file for the file logger.
+	closer   io.Closer     // system logger the output is directed to, if any.
+}
+
+// NewJSONLogger creates a JSON logger with output directed to w.
+func NewJSONLogger(w io.Writer, serverID string, debug, trace bool) *JSONLogger {
+	l := newJSONLogger(serverID, debug, trace)
+	l.out = func(_ Level, line []byte) {
+		w.Write(append(line, '\n'))
+	}
+	return l
+}
+
+// NewJSONStdLogger creates a JSON logger with output directed to Stderr.
+func NewJSONStdLogger(serverID string, debug, trace bool) *JSONLogger {
+	return NewJSONLogger(os.Stderr, serverID, debug, trace)
+}
+
+// NewJSONFileLogger creates a JSON logger with output directed to a file
+// that is rotated according to the options.
+func NewJSONFileLogger(filename, serverID string, debug, trace bool, ro RotateOpts) *JSONLogger {
+	f, err := OpenRotatingFile(filename, ro)
+	if err != nil {
+		log.Fatalf("error opening file: %v", err)
+	}
+	l := NewJSONLogger(f, serverID, debug, trace)
+	l.logFile = f
+	return l
+}
+
+// NewJSONSysLogger creates a JSON logger with output directed to the
+// system logger, keeping the priority of the statements.
+func NewJSONSysLogger(sl *SysLogger, serverID string) *JSONLogger {
+	l := newJSONLogger(serverID, sl.debug, sl.trace)
+	l.out = func(level Level, line []byte) {
+		switch level {
+		case LevelTrace:
+			sl.Tracef("%s", line)
+		case LevelDebug:
+			sl.Debugf("%s", line)
+		case LevelInfo:
+			sl.Noticef("%s", line)
+		case LevelWarn:
+			sl.Warnf("%s", line)
+		case LevelError:
+			sl.Errorf("%s", line)
+		case LevelFatal:
+			sl.Fatalf("%s", line)
+		}
+	}
+	return l
+}
+
+// NewJSONTLSSysLogger creates a JSON logger with output directed to the
+// remote syslog server over TLS, keeping the priority of the statements.
+func NewJSONTLSSysLogger(sl *TLSSysLogger, serverID string) *JSONLogger {
+	l := newJSONLogger(serverID, sl.debug, sl.trace)
+	l.out = func(level Level, line []byte) {
+		sl.log(level, string(line))
+	}
+	l.closer = sl
+	return l
+}
+
+func newJSONLogger(serverID string, debug, trace bool) *JSONLogger {
+	return &JSONLogger{
+		serverID: serverID,
+		pid:      os.Getpid(),
+		debug:    debug,
+		trace:    trace,
+	}
+}
+
+// Close implements the io.Closer interface to clean up
+// resources in the server's logger implementation.
+// Caller must ensure threadsafety.
+func (l *JSONLogger) Close() error {
+	if f := l.logFile; f != nil {
+		l.logFile = nil
+		return f.Close()
+	}
+	if c := l.closer; c != nil {
+		l.closer = nil
+		return c.Close()
+	}
+	return nil
+}
+
+// Rotate rotates the log file of the file logger.
+func (l *JSONLogger) Rotate() error {
+	if l.logFile == nil {
+		return fmt.Errorf("not a file logger")
+	}
+	return l.logFile.Rotate()
+}
+
+// Logf logs a statement with the fields, given as key and value pairs.
+func (l *JSONLogger) Logf(level Level, fields []interface{}, format string, v ...interface{}) {
+	if (level == LevelDebug && !l.debug) || (level == LevelTrace && !l.trace) {
+		return
+	}
+	var b bytes.Buffer
+	b.WriteString(`{"time":`)
+	writeJSONValue(&b, time.Now().UTC().Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeJSONValue(&b, level.String())
+	if l.serverID != "" {
+		b.WriteString(`,"server_id":`)
+		writeJSONValue(&b, l.serverID)
+	}
+	fmt.Fprintf(&b, `,"pid":%d,"msg":`, l.pid)
+	writeJSONValue(&b, fmt.Sprintf(format, v...))
+	for i := 0; i+1 < len(fields); i += 2 {
+		key, ok := fields[i].(string)
+		if !ok {
+			continue
+		}
+		b.WriteByte(',')
+		writeJSONValue(&b, key)
+		b.WriteByte(':')
+		writeJSONValue(&b, fields[i+1])
+	}
+	b.WriteByte('}')
+
+	l.mu.Lock()
+	l.out(level, b.Bytes())
+	l.mu.Unlock()
+	if level == LevelFatal {
+		os.Exit(1)
+	}
+}
+
+func writeJSONValue(b *bytes.Buffer, v interface{}) {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(data)
+}
+
+// Noticef logs a notice statement
+func (l *JSONLogger) Noticef(format string, v ...interface{}) {
+	l.Logf(LevelInfo, nil, format, v...)
+}
+
+// Warnf logs a notice statement
+func (l *JSONLogger) Warnf(format string, v ...interface{}) {
+	l.Logf(LevelWarn, nil, format, v...)
+}
+
+// Errorf logs an error statement
+func (l *JSONLogger) Errorf(format string, v ...interface{}) {
+	l.Logf(LevelError, nil, format, v...)
+}
+
+// Fatalf logs a fatal error
+func (l *JSONLogger) Fatalf(format string, v ...interface{}) {
+	l.Logf(LevelFatal, nil, format, v...)
+}
+
+// Debugf logs a debug statement
+func (l *JSONLogger) Debugf(format string, v ...interface{}) {
+	l.Logf(LevelDebug, nil, format, v...)
+}
+
+// Tracef logs a trace statement
+func (l *JSONLogger) Tracef(format string, v ...interface{}) {
+	l.Logf(LevelTrace, nil, format, v...)
+}
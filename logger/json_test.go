@@ -0,0 +1,94 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewJSONLogger(&buf, "SRV", false, false)
+	logger.Noticef("foo %s", "bar")
+	logger.Debugf("not logged")
+	logger.Tracef("not logged")
+	logger.Logf(LevelError, []interface{}{"client_id", 5, "account", "A", "err", errors.New("boom")}, "failed")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", buf.String())
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &m); err != nil {
+		t.Fatalf("Error decoding %q: %v", lines[0], err)
+	}
+	if m["level"] != "info" || m["msg"] != "foo bar" || m["server_id"] != "SRV" || m["pid"] != float64(os.Getpid()) {
+		t.Fatalf("Unexpected statement: %v", m)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, m["time"].(string)); err != nil {
+		t.Fatalf("Unexpected time: %v", err)
+	}
+	// The fields come after the message, in order.
+	if !strings.HasSuffix(lines[1], `"msg":"failed","client_id":5,"account":"A","err":"boom"}`) {
+		t.Fatalf("Unexpected statement: %q", lines[1])
+	}
+	if !strings.Contains(lines[1], `"level":"error"`) {
+		t.Fatalf("Unexpected level: %q", lines[1])
+	}
+}
+
+func TestJSONLoggerDebugTrace(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewJSONLogger(&buf, "", true, true)
+	logger.Debugf("foo")
+	logger.Tracef("bar")
+	expected := []string{`"level":"debug","pid"`, `"msg":"foo"`, `"level":"trace","pid"`, `"msg":"bar"`}
+	for _, e := range expected {
+		if !strings.Contains(buf.String(), e) {
+			t.Fatalf("Expected %q in %q", e, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "server_id") {
+		t.Fatalf("Unexpected server_id in %q", buf.String())
+	}
+}
+
+func TestJSONFileLogger(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "_nats-server")
+	if err != nil {
+		t.Fatal("Could not create tmp dir")
+	}
+	defer os.RemoveAll(tmpDir)
+	file := tmpDir + "/nats-server.log"
+
+	logger := NewJSONFileLogger(file, "SRV", false, false, RotateOpts{})
+	logger.Noticef("foo")
+	if err := logger.Close(); err != nil {
+		t.Fatalf("Error closing logger: %v", err)
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Could not read logfile: %v", err)
+	}
+	if !strings.Contains(string(buf), `"msg":"foo"`) || !strings.HasSuffix(string(buf), "}\n") {
+		t.Fatalf("Unexpected content: %q", buf)
+	}
+}
@@ -31,7 +31,7 @@ type Logger struct {
 	fatalLabel string
 	debugLabel string
 	traceLabel string
-	logFile    *os.File // file pointer for the file logger.
+	logFile    *RotatingFile // file for the file logger.
 }
 
 // NewStdLogger creates a logger with output directed to Stderr
@@ -63,8 +63,13 @@ func NewStdLogger(time, debug, trace, colors, pid bool) *Logger {
 
 // NewFileLogger creates a logger with output directed to a file
 func NewFileLogger(filename string, time, debug, trace, pid bool) *Logger {
-	fileflags := os.O_WRONLY | os.O_APPEND | os.O_CREATE
-	f, err := os.OpenFile(filename, fileflags, 0660)
+	return NewRotatingFileLogger(filename, time, debug, trace, pid, RotateOpts{})
+}
+
+// NewRotatingFileLogger creates a logger with output directed to a file
+// that is rotated according to the options.
+func NewRotatingFileLogger(filename string, time, debug, trace, pid bool, ro RotateOpts) *Logger {
+	f, err := OpenRotatingFile(filename, ro)
 	if err != nil {
 		log.Fatalf("error opening file: %v", err)
 	}
@@ -117,6 +122,14 @@ func (l *Logger) Close() error {
 	return nil
 }
 
+// Rotate rotates the log file of the file logger.
+func (l *Logger) Rotate() error {
+	if l.logFile == nil {
+		return fmt.Errorf("not a file logger")
+	}
+	return l.logFile.Rotate()
+}
+
 // Generate the pid prefix string
 func pidPrefix() string {
 	return fmt.Sprintf("[%d] ", os.Getpid())
@@ -0,0 +1,272 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Suffix of the backups, which sorts in creation order.
+const backupTimeFormat = "2006-01-02T15-04-05.000000"
+
+// RotateOpts are the options for rotating the log file. The file is
+// never rotated automatically if SizeLimit and MaxAge are not set.
+type RotateOpts struct {
+	// Rotate when the file would exceed this size in bytes.
+	SizeLimit int64
+	// Rotate when the file is older than this.
+	MaxAge time.Duration
+	// Number of backups kept, all if 0.
+	MaxBackups int
+	// Compress the backups with gzip.
+	Compress bool
+	// Called with the errors of the rotations and of the compression of
+	// the backups, from a goroutine of its own so that it can log them.
+	// Only the first error is reported until the operation succeeds again.
+	ErrorHandler func(error)
+}
+
+// RotatingFile is a log file that is renamed to a backup with a
+// timestamp suffix and re-created when it is rotated.
+type RotatingFile struct {
+	mu     sync.Mutex
+	name   string
+	opts   RotateOpts
+	f      *os.File
+	size   int64
+	opened time.Time
+	// Time of the last backup, to keep the backup names unique.
+	lastBackup time.Time
+	// Serializes the compression and removal of the backups.
+	bmu sync.Mutex
+	// Processing of the backups in progress, waited for on close.
+	bwg sync.WaitGroup
+	// Operations that failed since they last succeeded.
+	emu    sync.Mutex
+	failed map[string]bool
+}
+
+// Operations whose errors are reported.
+const (
+	rotateOp   = "rotating log file"
+	compressOp = "compressing log file backup"
+)
+
+// OpenRotatingFile opens, or creates, the log file.
+func OpenRotatingFile(filename string, opts RotateOpts) (*RotatingFile, error) {
+	rf := &RotatingFile{name: filename, opts: opts}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	fileflags := os.O_WRONLY | os.O_APPEND | os.O_CREATE
+	f, err := os.OpenFile(rf.name, fileflags, 0660)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = fi.Size()
+	rf.opened = time.Now()
+	return nil
+}
+
+// Write implements io.Writer, rotating the file first if needed.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.size > 0 && rf.needsRotation(len(p)) {
+		// Keep logging in the current file on failure.
+		if err := rf.rotate(); err != nil {
+			rf.reportError(rotateOp, err)
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) needsRotation(n int) bool {
+	o := &rf.opts
+	return (o.SizeLimit > 0 && rf.size+int64(n) > o.SizeLimit) ||
+		(o.MaxAge > 0 && time.Since(rf.opened) >= o.MaxAge)
+}
+
+// Rotate moves the current file to a backup and starts a new one.
+func (rf *RotatingFile) Rotate() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return os.ErrClosed
+	}
+	return rf.rotate()
+}
+
+// Lock held on entry.
+func (rf *RotatingFile) rotate() error {
+	now := time.Now().Truncate(time.Microsecond)
+	if !now.After(rf.lastBackup) {
+		now = rf.lastBackup.Add(time.Microsecond)
+	}
+	rf.lastBackup = now
+	backup := rf.name + "." + now.Format(backupTimeFormat)
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	rerr := os.Rename(rf.name, backup)
+	// Re-open even if the rename failed so that logging can continue.
+	if err := rf.open(); err != nil {
+		rf.f = nil
+		return err
+	}
+	if rerr != nil {
+		return rerr
+	}
+	rf.clearError(rotateOp)
+	rf.bwg.Add(1)
+	go rf.processBackups(backup)
+	return nil
+}
+
+// Compresses the new backup if needed and removes the oldest ones.
+func (rf *RotatingFile) processBackups(backup string) {
+	defer rf.bwg.Done()
+	rf.bmu.Lock()
+	defer rf.bmu.Unlock()
+	if rf.opts.Compress {
+		if err := compressFile(backup); err != nil {
+			rf.reportError(compressOp, err)
+		} else {
+			rf.clearError(compressOp)
+		}
+	}
+	if rf.opts.MaxBackups <= 0 {
+		return
+	}
+	backups, err := rf.Backups()
+	if err != nil {
+		return
+	}
+	for i := 0; i < len(backups)-rf.opts.MaxBackups; i++ {
+		os.Remove(backups[i])
+	}
+}
+
+// Reports the error of the operation to the handler, unless the operation
+// already failed. The handler is called from another goroutine since it
+// may log with this file.
+func (rf *RotatingFile) reportError(op string, err error) {
+	rf.emu.Lock()
+	defer rf.emu.Unlock()
+	if rf.opts.ErrorHandler == nil || rf.failed[op] {
+		return
+	}
+	if rf.failed == nil {
+		rf.failed = make(map[string]bool)
+	}
+	rf.failed[op] = true
+	go rf.opts.ErrorHandler(fmt.Errorf("error %s: %v", op, err))
+}
+
+// Clears the failure of the operation, its next error is reported.
+func (rf *RotatingFile) clearError(op string) {
+	rf.emu.Lock()
+	delete(rf.failed, op)
+	rf.emu.Unlock()
+}
+
+// Backups returns the paths of the backups, oldest first.
+func (rf *RotatingFile) Backups() ([]string, error) {
+	dir, base := filepath.Split(rf.name)
+	if dir == "" {
+		dir = "."
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, fi := range files {
+		n := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(n, base+".") {
+			continue
+		}
+		ts := strings.TrimSuffix(n[len(base)+1:], ".gz")
+		if _, err := time.Parse(backupTimeFormat, ts); err != nil {
+			continue
+		}
+		backups = append(backups, filepath.Join(dir, n))
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+func compressFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	in.Close()
+	return os.Remove(name)
+}
+
+// Close implements the io.Closer interface. It returns once the backups
+// are processed.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	var err error
+	if rf.f != nil {
+		err = rf.f.Close()
+		rf.f = nil
+	}
+	rf.mu.Unlock()
+	// No more rotation once closed.
+	rf.bwg.Wait()
+	return err
+}
@@ -0,0 +1,233 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func checkBackups(t *testing.T, rf *RotatingFile, check func(backups []string) bool) []string {
+	t.Helper()
+	var backups []string
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var err error
+		backups, err = rf.Backups()
+		if err != nil {
+			t.Fatalf("Error listing backups: %v", err)
+		}
+		if check(backups) {
+			return backups
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Unexpected backups: %q", backups)
+		}
+		time.Sleep(15 * time.Millisecond)
+	}
+}
+
+func TestRotatingFileSizeLimit(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "_nats-server")
+	if err != nil {
+		t.Fatal("Could not create tmp dir")
+	}
+	defer os.RemoveAll(tmpDir)
+	file := filepath.Join(tmpDir, "nats-server.log")
+
+	logger := NewRotatingFileLogger(file, false, false, false, false, RotateOpts{SizeLimit: 100, MaxBackups: 2})
+	defer logger.Close()
+	line := strings.Repeat("x", 40)
+	for i := 0; i < 10; i++ {
+		logger.Noticef(line)
+	}
+	rf := logger.logFile
+	// Each file holds 2 statements, only the 2 most recent backups are kept.
+	checkBackups(t, rf, func(backups []string) bool { return len(backups) == 2 })
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Could not read logfile: %v", err)
+	}
+	if len(buf) > 100 || !strings.Contains(string(buf), line) {
+		t.Fatalf("Unexpected content: %q", buf)
+	}
+
+	// A statement larger than the limit still goes to a file of its own.
+	logger.Noticef(strings.Repeat("y", 200))
+	buf, _ = ioutil.ReadFile(file)
+	if len(buf) <= 200 || strings.Contains(string(buf), line) {
+		t.Fatalf("Unexpected content: %q", buf)
+	}
+}
+
+func TestRotatingFileCompress(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "_nats-server")
+	if err != nil {
+		t.Fatal("Could not create tmp dir")
+	}
+	defer os.RemoveAll(tmpDir)
+	file := filepath.Join(tmpDir, "nats-server.log")
+
+	logger := NewJSONFileLogger(file, "SRV", false, false, RotateOpts{Compress: true})
+	defer logger.Close()
+	logger.Noticef("before rotation")
+	if err := logger.Rotate(); err != nil {
+		t.Fatalf("Error rotating: %v", err)
+	}
+	logger.Noticef("after rotation")
+
+	backups := checkBackups(t, logger.logFile, func(backups []string) bool {
+		return len(backups) == 1 && strings.HasSuffix(backups[0], ".gz")
+	})
+	f, err := os.Open(backups[0])
+	if err != nil {
+		t.Fatalf("Error opening backup: %v", err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Error reading backup: %v", err)
+	}
+	buf, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("Error reading backup: %v", err)
+	}
+	if !strings.Contains(string(buf), "before rotation") || strings.Contains(string(buf), "after rotation") {
+		t.Fatalf("Unexpected backup content: %q", buf)
+	}
+	buf, _ = ioutil.ReadFile(file)
+	if !strings.Contains(string(buf), "after rotation") || strings.Contains(string(buf), "before rotation") {
+		t.Fatalf("Unexpected content: %q", buf)
+	}
+}
+
+func TestRotatingFileMaxAge(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "_nats-server")
+	if err != nil {
+		t.Fatal("Could not create tmp dir")
+	}
+	defer os.RemoveAll(tmpDir)
+	file := filepath.Join(tmpDir, "nats-server.log")
+
+	logger := NewRotatingFileLogger(file, false, false, false, false, RotateOpts{MaxAge: 50 * time.Millisecond})
+	defer logger.Close()
+	logger.Noticef("foo")
+	logger.Noticef("bar")
+	if backups, _ := logger.logFile.Backups(); len(backups) != 0 {
+		t.Fatalf("Unexpected backups: %q", backups)
+	}
+	time.Sleep(60 * time.Millisecond)
+	logger.Noticef("baz")
+	checkBackups(t, logger.logFile, func(backups []string) bool { return len(backups) == 1 })
+	buf, _ := ioutil.ReadFile(file)
+	if string(buf) != "[INF] baz\n" {
+		t.Fatalf("Unexpected content: %q", buf)
+	}
+}
+
+func TestRotatingFileCloseWaitsForBackups(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "_nats-server")
+	if err != nil {
+		t.Fatal("Could not create tmp dir")
+	}
+	defer os.RemoveAll(tmpDir)
+	file := filepath.Join(tmpDir, "nats-server.log")
+
+	rf, err := OpenRotatingFile(file, RotateOpts{Compress: true})
+	if err != nil {
+		t.Fatalf("Error opening file: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		rf.Write([]byte(strings.Repeat("x", 64*1024)))
+		if err := rf.Rotate(); err != nil {
+			t.Fatalf("Error rotating: %v", err)
+		}
+	}
+	if err := rf.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+	// The backups are compressed by the time the file is closed.
+	backups, err := rf.Backups()
+	if err != nil {
+		t.Fatalf("Error listing backups: %v", err)
+	}
+	if len(backups) != 3 {
+		t.Fatalf("Expected 3 backups, got %q", backups)
+	}
+	for _, b := range backups {
+		if !strings.HasSuffix(b, ".gz") {
+			t.Fatalf("Expected the backups to be compressed, got %q", backups)
+		}
+	}
+	if err := rf.Rotate(); err != os.ErrClosed {
+		t.Fatalf("Expected the file to be closed, got %v", err)
+	}
+}
+
+func TestRotatingFileErrorHandler(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "_nats-server")
+	if err != nil {
+		t.Fatal("Could not create tmp dir")
+	}
+	defer os.RemoveAll(tmpDir)
+	file := filepath.Join(tmpDir, "nats-server.log")
+
+	errs := make(chan error, 10)
+	rf, err := OpenRotatingFile(file, RotateOpts{SizeLimit: 10, ErrorHandler: func(err error) { errs <- err }})
+	if err != nil {
+		t.Fatalf("Error opening file: %v", err)
+	}
+	defer rf.Close()
+	checkErrors := func(expected int) {
+		t.Helper()
+		for i := 0; i < expected; i++ {
+			select {
+			case err := <-errs:
+				if !strings.Contains(err.Error(), "error rotating log file") {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Expected an error to be reported")
+			}
+		}
+		select {
+		case err := <-errs:
+			t.Fatalf("Unexpected error: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// The rotations fail since the file is removed, the error is reported
+	// once while logging continues.
+	line := []byte("0123456789\n")
+	for i := 0; i < 4; i++ {
+		if _, err := rf.Write(line); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+		os.Remove(file)
+	}
+	checkErrors(1)
+
+	// Reported again once a rotation succeeded.
+	rf.Write(line)
+	rf.Write(line)
+	os.Remove(file)
+	rf.Write(line)
+	checkErrors(1)
+}
@@ -20,8 +20,6 @@ import (
 	"log"
 	"log/syslog"
 	"net/url"
-	"os"
-	"strings"
 )
 
 // SysLogger provides a system logger facility
@@ -31,23 +29,10 @@ type SysLogger struct {
 	trace  bool
 }
 
-// SetSyslogName sets the name to use for the syslog.
-// Currently used only on Windows.
-func SetSyslogName(name string) {}
-
-// GetSysLoggerTag generates the tag name for use in syslog statements. If
-// the executable is linked, the name of the link will be used as the tag,
-// otherwise, the name of the executable is used.  "nats-server" is the default
-// for the NATS server.
-func GetSysLoggerTag() string {
-	procName := os.Args[0]
-	if strings.ContainsRune(procName, os.PathSeparator) {
-		parts := strings.FieldsFunc(procName, func(c rune) bool {
-			return c == os.PathSeparator
-		})
-		procName = parts[len(parts)-1]
-	}
-	return procName
+// SetSyslogName sets the tag of the syslog statements, also used as the
+// identifier of the journal statements.
+func SetSyslogName(name string) {
+	syslogName = name
 }
 
 // NewSysLogger creates a new system logger
@@ -0,0 +1,303 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tag of the statements, when set with SetSyslogName.
+var syslogName string
+
+// GetSysLoggerTag generates the tag name for use in syslog statements. If
+// the executable is linked, the name of the link will be used as the tag,
+// otherwise, the name of the executable is used.  "nats-server" is the default
+// for the NATS server. The name set with SetSyslogName takes precedence.
+func GetSysLoggerTag() string {
+	if syslogName != "" {
+		return syslogName
+	}
+	procName := os.Args[0]
+	if strings.ContainsRune(procName, os.PathSeparator) {
+		parts := strings.FieldsFunc(procName, func(c rune) bool {
+			return c == os.PathSeparator
+		})
+		procName = parts[len(parts)-1]
+	}
+	return procName
+}
+
+const (
+	// DefaultTLSSysLogBufferSize is the number of statements kept while the
+	// remote syslog server can not be reached, when not set.
+	DefaultTLSSysLogBufferSize = 1024
+
+	tlsSysLogDialTimeout  = 5 * time.Second
+	tlsSysLogWriteTimeout = 5 * time.Second
+	tlsSysLogMinBackoff   = 250 * time.Millisecond
+	tlsSysLogMaxBackoff   = 30 * time.Second
+
+	// Facility of the statements, as for the local syslog.
+	tlsSysLogFacilityDaemon = 3
+)
+
+// Syslog severities of the levels. Traces are notices, as for the local
+// syslog.
+var tlsSysLogSeverities = map[Level]int{
+	LevelTrace: 5,
+	LevelDebug: 7,
+	LevelInfo:  5,
+	LevelWarn:  4,
+	LevelError: 3,
+	LevelFatal: 2,
+}
+
+// TLSSysLogger logs to a remote syslog server over TLS, as per RFC 5425.
+// Statements are kept in a ring buffer and written by a go routine, so
+// that logging never blocks on the remote server. When the server can not
+// be reached and the buffer is full, the oldest statements are dropped.
+type TLSSysLogger struct {
+	mu       sync.Mutex
+	addr     string
+	config   *tls.Config
+	hostname string
+	tag      string
+	pid      int
+	debug    bool
+	trace    bool
+
+	// Ring buffer of the pending statements. first is the sequence of the
+	// oldest one, so that the writer only removes the statements it wrote.
+	buf     [][]byte
+	head    int
+	count   int
+	first   uint64
+	dropped uint64
+
+	conn   net.Conn
+	kick   chan struct{}
+	quit   chan struct{}
+	doneCh chan struct{}
+}
+
+// NewTLSSysLogger creates a logger writing to the syslog server at the
+// given address over TLS, keeping up to size statements while the server
+// can not be reached.
+func NewTLSSysLogger(addr string, config *tls.Config, size int, debug, trace bool) *TLSSysLogger {
+	if config == nil {
+		config = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if size <= 0 {
+		size = DefaultTLSSysLogBufferSize
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	l := &TLSSysLogger{
+		addr:     addr,
+		config:   config,
+		hostname: hostname,
+		tag:      GetSysLoggerTag(),
+		pid:      os.Getpid(),
+		debug:    debug,
+		trace:    trace,
+		buf:      make([][]byte, size),
+		kick:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+	go l.writeLoop()
+	return l
+}
+
+// Close implements the io.Closer interface to clean up
+// resources in the server's logger implementation. Pending
+// statements are written if the server is connected.
+func (l *TLSSysLogger) Close() error {
+	l.mu.Lock()
+	select {
+	case <-l.quit:
+		l.mu.Unlock()
+		return nil
+	default:
+		close(l.quit)
+	}
+	l.mu.Unlock()
+	<-l.doneCh
+	return nil
+}
+
+// Dropped returns the number of statements dropped because the buffer was
+// full.
+func (l *TLSSysLogger) Dropped() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dropped
+}
+
+// Queues the statement, with the RFC 5424 format and the octet counting
+// framing of RFC 5425.
+func (l *TLSSysLogger) log(level Level, msg string) {
+	pri := tlsSysLogFacilityDaemon*8 + tlsSysLogSeverities[level]
+	ts := time.Now().Format("2006-01-02T15:04:05.000000Z07:00")
+	line := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", pri, ts, l.hostname, l.tag, l.pid, msg)
+	frame := []byte(fmt.Sprintf("%d %s", len(line), line))
+
+	l.mu.Lock()
+	size := len(l.buf)
+	if l.count == size {
+		// Drop the oldest statement.
+		l.buf[l.head] = nil
+		l.head = (l.head + 1) % size
+		l.count--
+		l.first++
+		l.dropped++
+	}
+	l.buf[(l.head+l.count)%size] = frame
+	l.count++
+	l.mu.Unlock()
+
+	select {
+	case l.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Returns the oldest pending statement and its sequence, nil if none.
+func (l *TLSSysLogger) peek() ([]byte, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.count == 0 {
+		return nil, 0
+	}
+	return l.buf[l.head], l.first
+}
+
+// Removes the statement with the given sequence, unless it was dropped
+// while being written.
+func (l *TLSSysLogger) remove(seq uint64) {
+	l.mu.Lock()
+	if l.count > 0 && l.first == seq {
+		l.buf[l.head] = nil
+		l.head = (l.head + 1) % len(l.buf)
+		l.count--
+		l.first++
+	}
+	l.mu.Unlock()
+}
+
+// Writes the statement, connecting to the server if needed.
+func (l *TLSSysLogger) write(frame []byte) error {
+	if l.conn == nil {
+		d := &net.Dialer{Timeout: tlsSysLogDialTimeout}
+		conn, err := tls.DialWithDialer(d, "tcp", l.addr, l.config)
+		if err != nil {
+			return err
+		}
+		l.conn = conn
+	}
+	l.conn.SetWriteDeadline(time.Now().Add(tlsSysLogWriteTimeout))
+	if _, err := l.conn.Write(frame); err != nil {
+		l.conn.Close()
+		l.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Writes the pending statements until the logger is closed, backing off
+// while the server can not be reached.
+func (l *TLSSysLogger) writeLoop() {
+	defer close(l.doneCh)
+	backoff := tlsSysLogMinBackoff
+	for {
+		select {
+		case <-l.kick:
+		case <-l.quit:
+			l.flush()
+			return
+		}
+		for frame, seq := l.peek(); frame != nil; frame, seq = l.peek() {
+			if err := l.write(frame); err != nil {
+				select {
+				case <-time.After(backoff):
+				case <-l.quit:
+					return
+				}
+				if backoff *= 2; backoff > tlsSysLogMaxBackoff {
+					backoff = tlsSysLogMaxBackoff
+				}
+				continue
+			}
+			backoff = tlsSysLogMinBackoff
+			l.remove(seq)
+		}
+	}
+}
+
+// Writes the pending statements on close, only if connected, and closes
+// the connection.
+func (l *TLSSysLogger) flush() {
+	for frame, seq := l.peek(); frame != nil && l.conn != nil; frame, seq = l.peek() {
+		if l.write(frame) != nil {
+			break
+		}
+		l.remove(seq)
+	}
+	if l.conn != nil {
+		l.conn.Close()
+		l.conn = nil
+	}
+}
+
+// Noticef logs a notice statement
+func (l *TLSSysLogger) Noticef(format string, v ...interface{}) {
+	l.log(LevelInfo, fmt.Sprintf(format, v...))
+}
+
+// Warnf logs a notice statement
+func (l *TLSSysLogger) Warnf(format string, v ...interface{}) {
+	l.log(LevelWarn, fmt.Sprintf(format, v...))
+}
+
+// Fatalf logs a fatal error
+func (l *TLSSysLogger) Fatalf(format string, v ...interface{}) {
+	l.log(LevelFatal, fmt.Sprintf(format, v...))
+}
+
+// Errorf logs an error statement
+func (l *TLSSysLogger) Errorf(format string, v ...interface{}) {
+	l.log(LevelError, fmt.Sprintf(format, v...))
+}
+
+// Debugf logs a debug statement
+func (l *TLSSysLogger) Debugf(format string, v ...interface{}) {
+	if l.debug {
+		l.log(LevelDebug, fmt.Sprintf(format, v...))
+	}
+}
+
+// Tracef logs a trace statement
+func (l *TLSSysLogger) Tracef(format string, v ...interface{}) {
+	if l.trace {
+		l.log(LevelTrace, fmt.Sprintf(format, v...))
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTLSSysLogListener(t *testing.T, addr string) net.Listener {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair("../test/configs/certs/server-cert.pem", "../test/configs/certs/server-key.pem")
+	if err != nil {
+		t.Fatalf("Error loading certificate: %v", err)
+	}
+	l, err := tls.Listen("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	return l
+}
+
+func testTLSSysLogClientConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	pem, err := ioutil.ReadFile("../test/configs/certs/ca.pem")
+	if err != nil {
+		t.Fatalf("Error reading CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem)
+	// Verify as of a time the test certificates are valid.
+	now := func() time.Time { return time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC) }
+	return &tls.Config{RootCAs: pool, Time: now}
+}
+
+// Reads a statement framed with its size, as per RFC 5425.
+func readTLSSysLogFrame(t *testing.T, br *bufio.Reader) string {
+	t.Helper()
+	size, err := br.ReadString(' ')
+	if err != nil {
+		t.Fatalf("Error reading frame: %v", err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(size))
+	if err != nil {
+		t.Fatalf("Invalid frame size %q", size)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		t.Fatalf("Error reading frame: %v", err)
+	}
+	return string(buf)
+}
+
+func acceptTLSSysLog(t *testing.T, l net.Listener) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Error accepting: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+func TestTLSSysLogger(t *testing.T) {
+	l := testTLSSysLogListener(t, "127.0.0.1:0")
+	defer l.Close()
+
+	SetSyslogName("nats-test")
+	defer SetSyslogName("")
+	logger := NewTLSSysLogger(l.Addr().String(), testTLSSysLogClientConfig(t), 0, false, false)
+	defer logger.Close()
+
+	logger.Noticef("hello %s", "world")
+	logger.Debugf("skipped")
+	logger.Errorf("error")
+
+	conn, br := acceptTLSSysLog(t, l)
+	defer conn.Close()
+	// Daemon facility with the notice and error severities.
+	for _, expected := range []string{"<29>1 ", "<27>1 "} {
+		msg := readTLSSysLogFrame(t, br)
+		if !strings.HasPrefix(msg, expected) || !strings.Contains(msg, " nats-test ") {
+			t.Fatalf("Unexpected statement: %q", msg)
+		}
+	}
+}
+
+func TestTLSSysLoggerBuffer(t *testing.T) {
+	// Get a free port, and close the listener so that the server is down.
+	l := testTLSSysLogListener(t, "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+
+	logger := NewTLSSysLogger(addr, testTLSSysLogClientConfig(t), 2, false, false)
+	defer logger.Close()
+
+	// Logging does not block while the server is down, and only the
+	// newest statements are kept.
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		logger.Noticef("msg%d", i)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Logging blocked while the server was down")
+	}
+	if n := logger.Dropped(); n != 3 {
+		t.Fatalf("Expected 3 dropped statements, got %v", n)
+	}
+
+	l = testTLSSysLogListener(t, addr)
+	defer l.Close()
+	conn, br := acceptTLSSysLog(t, l)
+	defer conn.Close()
+	for i := 3; i < 5; i++ {
+		if msg := readTLSSysLogFrame(t, br); !strings.HasSuffix(msg, fmt.Sprintf(" - - msg%d", i)) {
+			t.Fatalf("Unexpected statement: %q", msg)
+		}
+	}
+}
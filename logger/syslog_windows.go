@@ -24,9 +24,21 @@ import (
 
 var natsEventSource = "NATS-Server"
 
-// SetSyslogName sets the name to use for the system log event source
+// Event IDs of the statements written to the event log, by level.
+const (
+	EventIDNotice = 1
+	EventIDError  = 2
+	EventIDDebug  = 3
+	EventIDTrace  = 4
+	EventIDFatal  = 5
+	EventIDWarn   = 6
+)
+
+// SetSyslogName sets the name to use for the system log event source,
+// also used as the tag of the remote syslog statements.
 func SetSyslogName(name string) {
 	natsEventSource = name
+	syslogName = name
 }
 
 // SysLogger logs to the windows event logger
@@ -77,36 +89,36 @@ func formatMsg(tag, format string, v ...interface{}) string {
 
 // Noticef logs a notice statement
 func (l *SysLogger) Noticef(format string, v ...interface{}) {
-	l.writer.Info(1, formatMsg("NOTICE", format, v...))
+	l.writer.Info(EventIDNotice, formatMsg("NOTICE", format, v...))
 }
 
-// Noticef logs a notice statement
+// Warnf logs a warning statement
 func (l *SysLogger) Warnf(format string, v ...interface{}) {
-	l.writer.Info(1, formatMsg("WARN", format, v...))
+	l.writer.Warning(EventIDWarn, formatMsg("WARN", format, v...))
 }
 
 // Fatalf logs a fatal error
 func (l *SysLogger) Fatalf(format string, v ...interface{}) {
 	msg := formatMsg("FATAL", format, v...)
-	l.writer.Error(5, msg)
+	l.writer.Error(EventIDFatal, msg)
 	panic(msg)
 }
 
 // Errorf logs an error statement
 func (l *SysLogger) Errorf(format string, v ...interface{}) {
-	l.writer.Error(2, formatMsg("ERROR", format, v...))
+	l.writer.Error(EventIDError, formatMsg("ERROR", format, v...))
 }
 
 // Debugf logs a debug statement
 func (l *SysLogger) Debugf(format string, v ...interface{}) {
 	if l.debug {
-		l.writer.Info(3, formatMsg("DEBUG", format, v...))
+		l.writer.Info(EventIDDebug, formatMsg("DEBUG", format, v...))
 	}
 }
 
 // Tracef logs a trace statement
 func (l *SysLogger) Tracef(format string, v ...interface{}) {
 	if l.trace {
-		l.writer.Info(4, formatMsg("TRACE", format, v...))
+		l.writer.Info(EventIDTrace, formatMsg("TRACE", format, v...))
 	}
 }
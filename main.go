@@ -31,10 +31,12 @@ Server Options:
     -m, --http_port <port>           Use port for http monitoring
     -ms,--https_port <port>          Use port for https monitoring
     -c, --config <file>              Configuration file
-    -sl,--signal <signal>[=<pid>]    Send signal to nats-server process (stop, quit, reopen, reload)
-                                     <pid> can be either a PID (e.g. 1) or the path to a PID file (e.g. /var/run/nats-server.pid)
+    -sl,--signal <signal>[=<pid>]    Send signal to nats-server process (stop, quit, reopen, reload, rotate, ldm, term)
+                                     <pid> can be either a PID (e.g. 1), the path to a PID file (e.g. /var/run/nats-server.pid)
+                                     or on Windows a service name
         --client_advertise <string>  Client URL to advertise to other servers
-    -t                               Test configuration and exit
+    -t                               Test and validate configuration and exit
+        --show_config                Print the effective configuration as JSON and exit
 
 Logging Options:
     -l, --log <file>                 File to redirect log output
@@ -57,11 +59,16 @@ TLS Options:
         --tlsverify                  Enable TLS, verify client certificates
         --tlscacert <file>           Client certificate CA for verification
 
+JetStream Options:
+    -js, --jetstream                 Enable JetStream functionality
+    -sd, --store_dir <dir>           Set the storage directory
+
 Cluster Options:
         --routes <rurl-1, rurl-2>    Routes to solicit and connect
         --cluster <cluster-url>      Cluster URL for solicited routes
         --no_advertise <bool>        Advertise known cluster IPs to clients
         --cluster_advertise <string> Cluster URL to advertise to other servers
+        --cluster_name <string>      Cluster name, generated if not set
         --connect_retries <number>   For implicit routes, number of connect retries
 
 
@@ -92,8 +99,26 @@ func main() {
 	if err != nil {
 		server.PrintAndDie(fmt.Sprintf("%s: %s", exe, err))
 	} else if opts.CheckConfig {
+		report := server.CheckConfigFile(opts.ConfigFile)
+		for _, w := range report.Warnings {
+			fmt.Fprintf(os.Stderr, "%s: warning: %v\n", exe, w)
+		}
+		for _, e := range report.Errors {
+			fmt.Fprintf(os.Stderr, "%s: error: %v\n", exe, e)
+		}
+		if !report.Valid() {
+			fmt.Fprintf(os.Stderr, "%s: configuration file %s is invalid\n", exe, opts.ConfigFile)
+			os.Exit(1)
+		}
 		fmt.Fprintf(os.Stderr, "%s: configuration file %s is valid\n", exe, opts.ConfigFile)
 		os.Exit(0)
+	} else if opts.ShowConfig {
+		cfg, err := opts.EffectiveConfig()
+		if err != nil {
+			server.PrintAndDie(fmt.Sprintf("%s: %s", exe, err))
+		}
+		fmt.Printf("%s\n", cfg)
+		os.Exit(0)
 	}
 
 	// Create the server with appropriate options.
@@ -20,8 +20,10 @@ import (
 	"net/url"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nats-io/jwt"
@@ -31,9 +33,16 @@ import (
 // account will be grouped in the default global account.
 const globalAccountName = "$G"
 
+// Tag of a user JWT setting the maximum number of connections of the user,
+// e.g. "max_connections:5", since user claims have no such limit.
+const jwtMaxConnsTag = "max_connections:"
+
 // Account are subject namespace definitions. By default no messages are shared between accounts.
 // You can share via Exports and Imports of Streams and Services.
 type Account struct {
+	// Here first because of use of atomics, and memory alignment.
+	stats
+	errStats
 	Name       string
 	Nkey       string
 	Issuer     string
@@ -57,8 +66,32 @@ type Account struct {
 	nae         int32
 	pruning     bool
 	expired     bool
+	draining    bool
 	signingKeys []string
-	srv         *Server // server this account is registered with (possibly nil)
+	noAdvertise bool // do not advertise the cluster's client URLs to clients
+	queueLocal  bool // deliver to queue subscribers of this server before routed ones
+	// Queue groups delivering messages with the same subject, or subject
+	// token, to the same member, with the index of the token, 0 for the
+	// whole subject.
+	stickyQueues map[string]int
+	// Ping interval and maximum outstanding pings of the clients of this
+	// account, the server wide values are used when not set.
+	pingInterval time.Duration
+	maxPingsOut  int
+	srv          *Server // server this account is registered with (possibly nil)
+	// JetStream limits from the configuration, otherwise taken from the
+	// JWT they were last read from.
+	jsLimits      *JetStreamAccountLimits
+	jwtLimits     JetStreamAccountLimits
+	jwtLimitsFrom string
+}
+
+// Error counters tracked per account, used with atomics.
+type errStats struct {
+	permViolations int64
+	protoErrors    int64
+	errWindow      int64 // start of the current error window in unix nanoseconds
+	errCount       int64 // errors in the current window
 }
 
 // Account based limits.
@@ -134,9 +167,26 @@ func (a *Account) shallowCopy() *Account {
 	na.Issuer = a.Issuer
 	na.imports = a.imports
 	na.exports = a.exports
+	na.noAdvertise = a.noAdvertise
+	na.queueLocal = a.queueLocal
+	na.stickyQueues = a.stickyQueues
+	na.pingInterval = a.pingInterval
+	na.maxPingsOut = a.maxPingsOut
+	na.jsLimits = a.jsLimits
 	return na
 }
 
+// stickyQueue returns whether the queue group is sticky, and the index of
+// the subject token that selects its members. This is set from the
+// configuration and never updated in place, so no lock is needed.
+func (a *Account) stickyQueue(qsubs []*subscription) (int, bool) {
+	if a == nil || len(a.stickyQueues) == 0 || len(qsubs) == 0 || qsubs[0] == nil {
+		return 0, false
+	}
+	tok, ok := a.stickyQueues[string(qsubs[0].queue)]
+	return tok, ok
+}
+
 // NumConnections returns active number of clients for this account for
 // all known servers.
 func (a *Account) NumConnections() int {
@@ -858,6 +908,30 @@ func (a *Account) IsExpired() bool {
 	return exp
 }
 
+// IsDraining returns if the account is being or was drained, its new clients
+// are then refused.
+func (a *Account) IsDraining() bool {
+	a.mu.RLock()
+	draining := a.draining
+	a.mu.RUnlock()
+	return draining
+}
+
+// trackError counts an error in the current error window and returns
+// true when the number of errors in the window reaches the threshold.
+// A threshold of zero or less disables the tracking.
+func (a *Account) trackError(threshold int, window time.Duration) bool {
+	if threshold <= 0 {
+		return false
+	}
+	now := time.Now().UnixNano()
+	start := atomic.LoadInt64(&a.errWindow)
+	if now-start > int64(window) && atomic.CompareAndSwapInt64(&a.errWindow, start, now) {
+		atomic.StoreInt64(&a.errCount, 0)
+	}
+	return atomic.AddInt64(&a.errCount, 1) == int64(threshold)
+}
+
 // Called when an account has expired.
 func (a *Account) expiredTimeout() {
 	// Mark expired first.
@@ -1102,6 +1176,24 @@ func (s *Server) updateAccountClaims(a *Account, ac *jwt.AccountClaims) {
 	a.mu.Unlock()
 
 	clients := gatherClients()
+	a.enforceLimits(clients)
+
+	// Check if the signing keys changed, might have to evict
+	if signersChanged {
+		for _, c := range clients {
+			c.mu.Lock()
+			sk := c.user.SigningKey
+			c.mu.Unlock()
+			if sk != "" && !a.hasIssuer(sk) {
+				c.closeConnection(AuthenticationViolation)
+			}
+		}
+	}
+}
+
+// enforceLimits applies the account limits to the given clients. If the
+// account is over its connection limit the most recent connections are closed.
+func (a *Account) enforceLimits(clients []*client) {
 	// Sort if we are over the limit.
 	if a.maxTotalConnectionsReached() {
 		sort.Slice(clients, func(i, j int) bool {
@@ -1117,18 +1209,6 @@ func (s *Server) updateAccountClaims(a *Account, ac *jwt.AccountClaims) {
 		c.applyAccountLimits()
 		c.mu.Unlock()
 	}
-
-	// Check if the signing keys changed, might have to evict
-	if signersChanged {
-		for _, c := range clients {
-			c.mu.Lock()
-			sk := c.user.SigningKey
-			c.mu.Unlock()
-			if sk != "" && !a.hasIssuer(sk) {
-				c.closeConnection(AuthenticationViolation)
-			}
-		}
-	}
 }
 
 // Helper to build an internal account structure from a jwt.AccountClaims.
@@ -1145,6 +1225,20 @@ func buildInternalNkeyUser(uc *jwt.UserClaims, acc *Account) *NkeyUser {
 	if uc.IssuerAccount != "" {
 		nu.SigningKey = uc.Issuer
 	}
+	// The user JWT has no connection limit, it is set with a tag, while the
+	// other "name:value" tags can be referenced by the permissions.
+	for _, tag := range uc.Tags {
+		if strings.HasPrefix(tag, jwtMaxConnsTag) {
+			if n, err := strconv.Atoi(tag[len(jwtMaxConnsTag):]); err == nil {
+				nu.MaxConnections = n
+			}
+		} else if i := strings.IndexByte(tag, ':'); i > 0 {
+			if nu.Tags == nil {
+				nu.Tags = make(map[string]string)
+			}
+			nu.Tags[tag[:i]] = tag[i+1:]
+		}
+	}
 
 	// Now check for permissions.
 	var p *Permissions
@@ -1227,6 +1321,8 @@ func (ur *URLAccResolver) Fetch(name string) (string, error) {
 		return _EMPTY_, fmt.Errorf("could not fetch <%q>: %v", url, err)
 	} else if resp == nil {
 		return _EMPTY_, fmt.Errorf("could not fetch <%q>: no response", url)
+	} else if resp.StatusCode == http.StatusNotFound {
+		return _EMPTY_, ErrMissingAccount
 	} else if resp.StatusCode != http.StatusOK {
 		return _EMPTY_, fmt.Errorf("could not fetch <%q>: %v", url, resp.Status)
 	}
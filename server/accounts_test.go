@@ -22,6 +22,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nkeys"
 )
 
@@ -48,6 +49,132 @@ func TestRegisterDuplicateAccounts(t *testing.T) {
 	}
 }
 
+func TestAccountRegisterUpdateDelete(t *testing.T) {
+	opts := DefaultOptions()
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	acc, err := s.RegisterAccount("ACME", &AccountOptions{
+		MaxConnections: 2,
+		Users:          []*User{{Username: "bob", Password: "pwd"}},
+	})
+	if err != nil {
+		t.Fatalf("Error registering account: %v", err)
+	}
+	if _, err := s.RegisterAccount("OTHER", &AccountOptions{
+		Users: []*User{{Username: "bob", Password: "pwd"}},
+	}); err == nil {
+		t.Fatal("Expected error registering a user that already exists")
+	}
+	if _, err := s.LookupAccount("OTHER"); err == nil {
+		t.Fatal("Account should not have been registered")
+	}
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	connect := func(user string) (*nats.Conn, error) {
+		return nats.Connect(url, nats.UserInfo(user, "pwd"), nats.NoReconnect())
+	}
+	nc1, err := connect("bob")
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc1.Close()
+	if c := acc.NumLocalConnections(); c != 1 {
+		t.Fatalf("Expected 1 connection in account, got %d", c)
+	}
+	nc2, err := connect("bob")
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc2.Close()
+	if nc, err := connect("bob"); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection limit to be enforced")
+	}
+
+	// Replace bob by alice and lower the connection limit.
+	if err := s.UpdateAccount("ACME", &AccountOptions{
+		MaxConnections: 1,
+		Users:          []*User{{Username: "alice", Password: "pwd"}},
+	}); err != nil {
+		t.Fatalf("Error updating account: %v", err)
+	}
+	if err := s.UpdateAccount("MISSING", &AccountOptions{}); err != ErrMissingAccount {
+		t.Fatalf("Expected error %v, got %v", ErrMissingAccount, err)
+	}
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if c := acc.NumLocalConnections(); c != 0 {
+			return fmt.Errorf("Expected removed user connections to be closed, got %d", c)
+		}
+		return nil
+	})
+	if nc, err := connect("bob"); err == nil {
+		nc.Close()
+		t.Fatal("Expected removed user to fail to connect")
+	}
+	nc3, err := connect("alice")
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc3.Close()
+	if acc.MaxActiveConnections() != 1 {
+		t.Fatalf("Expected max connections of 1, got %d", acc.MaxActiveConnections())
+	}
+
+	// Users whose password changed are disconnected, the others are not.
+	if err := s.UpdateAccount("ACME", &AccountOptions{
+		Users: []*User{{Username: "alice", Password: "pwd"}, {Username: "carol", Password: "pwd"}},
+	}); err != nil {
+		t.Fatalf("Error updating account: %v", err)
+	}
+	nc4, err := connect("carol")
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc4.Close()
+	if err := s.UpdateAccount("ACME", &AccountOptions{
+		Users: []*User{{Username: "alice", Password: "pwd"}, {Username: "carol", Password: "new"}},
+	}); err != nil {
+		t.Fatalf("Error updating account: %v", err)
+	}
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if !nc4.IsClosed() {
+			return fmt.Errorf("Expected user with a new password to be disconnected")
+		}
+		return nil
+	})
+	if !nc3.IsConnected() || acc.NumLocalConnections() != 1 {
+		t.Fatalf("Expected unchanged user to stay connected")
+	}
+	if nc, err := connect("carol"); err == nil {
+		nc.Close()
+		t.Fatal("Expected old password to fail")
+	}
+
+	if err := s.DeleteAccount(globalAccountName); err != ErrReservedAccount {
+		t.Fatalf("Expected error %v, got %v", ErrReservedAccount, err)
+	}
+	if err := s.DeleteAccount("ACME"); err != nil {
+		t.Fatalf("Error deleting account: %v", err)
+	}
+	if err := s.DeleteAccount("ACME"); err != ErrMissingAccount {
+		t.Fatalf("Expected error %v, got %v", ErrMissingAccount, err)
+	}
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if !nc3.IsClosed() {
+			return fmt.Errorf("Connection should have been closed")
+		}
+		return nil
+	})
+	if _, err := s.LookupAccount("ACME"); err != ErrMissingAccount {
+		t.Fatalf("Expected account to be removed, got %v", err)
+	}
+	if nc, err := connect("alice"); err == nil {
+		nc.Close()
+		t.Fatal("Expected user of deleted account to fail to connect")
+	}
+}
+
 func TestAccountIsolation(t *testing.T) {
 	s, fooAcc, barAcc := simpleAccountServer(t)
 	cfoo, crFoo, _ := newClientForServer(s)
@@ -353,6 +480,57 @@ func TestAccountParseConfig(t *testing.T) {
 	}
 }
 
+func TestAccountParseConfigDefaultPermissions(t *testing.T) {
+	confFileName := createConfFile(t, []byte(`
+    accounts {
+      synadia {
+        default_permissions {
+          publish: "foo.>"
+          subscribe: "bar.>"
+        }
+        users = [
+          {user: alice, password: foo}
+          {user: bob, password: bar, permissions: {publish: "baz"}}
+          {nkey: UC6NLCN7AS34YOJVCYD4PJ3QB7QGLYG5B5IMBT25VW5K4TNUJODM7BOX}
+        ]
+      }
+      nats.io {
+        users = [
+          {user: derek, password: foo}
+        ]
+      }
+    }
+    `))
+	defer os.Remove(confFileName)
+	opts, err := ProcessConfigFile(confFileName)
+	if err != nil {
+		t.Fatalf("Received an error processing config file: %v", err)
+	}
+
+	for _, u := range opts.Users {
+		switch u.Username {
+		case "alice":
+			if u.Permissions == nil || u.Permissions.Publish.Allow[0] != "foo.>" || u.Permissions.Subscribe.Allow[0] != "bar.>" {
+				t.Fatalf("Expected default permissions for %q, got %+v", u.Username, u.Permissions)
+			}
+		case "bob":
+			if u.Permissions == nil || u.Permissions.Publish.Allow[0] != "baz" || u.Permissions.Subscribe != nil {
+				t.Fatalf("Expected explicit permissions for %q, got %+v", u.Username, u.Permissions)
+			}
+		case "derek":
+			if u.Permissions != nil {
+				t.Fatalf("Expected no permissions for %q, got %+v", u.Username, u.Permissions)
+			}
+		}
+	}
+	if ln := len(opts.Nkeys); ln != 1 {
+		t.Fatalf("Expected 1 nkey user, got %d", ln)
+	}
+	if p := opts.Nkeys[0].Permissions; p == nil || p.Publish.Allow[0] != "foo.>" {
+		t.Fatalf("Expected default permissions for nkey user, got %+v", p)
+	}
+}
+
 func TestAccountParseConfigDuplicateUsers(t *testing.T) {
 	confFileName := createConfFile(t, []byte(`
     accounts {
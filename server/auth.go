@@ -16,6 +16,7 @@ package server
 import (
 	"crypto/tls"
 	"encoding/base64"
+	"fmt"
 	"net"
 	"strings"
 
@@ -48,6 +49,11 @@ type NkeyUser struct {
 	Permissions *Permissions `json:"permissions,omitempty"`
 	Account     *Account     `json:"account,omitempty"`
 	SigningKey  string       `json:"signing_key,omitempty"`
+	// Maximum simultaneous connections, 0 for the server's default and -1
+	// for no limit.
+	MaxConnections int `json:"max_connections,omitempty"`
+	// Tags of the user, that its permissions can reference with {{tag(name)}}.
+	Tags map[string]string `json:"tags,omitempty"`
 }
 
 // User is for multiple accounts/users.
@@ -56,6 +62,11 @@ type User struct {
 	Password    string       `json:"password"`
 	Permissions *Permissions `json:"permissions,omitempty"`
 	Account     *Account     `json:"account,omitempty"`
+	// Maximum simultaneous connections, 0 for the server's default and -1
+	// for no limit.
+	MaxConnections int `json:"max_connections,omitempty"`
+	// Tags of the user, that its permissions can reference with {{tag(name)}}.
+	Tags map[string]string `json:"tags,omitempty"`
 }
 
 // clone performs a deep copy of the User struct, returning a new clone with
@@ -67,6 +78,7 @@ func (u *User) clone() *User {
 	clone := &User{}
 	*clone = *u
 	clone.Permissions = u.Permissions.clone()
+	clone.Tags = cloneTags(u.Tags)
 	return clone
 }
 
@@ -79,6 +91,18 @@ func (n *NkeyUser) clone() *NkeyUser {
 	clone := &NkeyUser{}
 	*clone = *n
 	clone.Permissions = n.Permissions.clone()
+	clone.Tags = cloneTags(n.Tags)
+	return clone
+}
+
+func cloneTags(tags map[string]string) map[string]string {
+	if tags == nil {
+		return nil
+	}
+	clone := make(map[string]string, len(tags))
+	for k, v := range tags {
+		clone[k] = v
+	}
 	return clone
 }
 
@@ -160,6 +184,20 @@ func (s *Server) checkAuthforWarnings() {
 		// Warning about using plaintext passwords.
 		s.Warnf("Plaintext passwords detected, use nkeys or bcrypt.")
 	}
+	// Users of the system account can publish system events and requests,
+	// so they should be restricted.
+	if sa := s.opts.SystemAccount; sa != "" {
+		for _, u := range s.users {
+			if u.Account != nil && u.Account.Name == sa && u.Permissions == nil {
+				s.Warnf("System account user %q has no permissions defined, consider restricting it.", u.Username)
+			}
+		}
+		for _, u := range s.nkeys {
+			if u.Account != nil && u.Account.Name == sa && u.Permissions == nil {
+				s.Warnf("System account user %q has no permissions defined, consider restricting it.", u.Nkey)
+			}
+		}
+	}
 }
 
 // If opts.Users or opts.Nkeys have definitions without an account
@@ -257,6 +295,7 @@ func (s *Server) isClientAuthorized(c *client) bool {
 	username := s.opts.Username
 	password := s.opts.Password
 	tlsMap := s.opts.TLSMap
+	noAuthUser := s.opts.NoAuthUser
 	s.optsMu.RUnlock()
 
 	// Check custom auth first, then jwts, then nkeys, then
@@ -346,6 +385,13 @@ func (s *Server) isClientAuthorized(c *client) bool {
 				s.mu.Unlock()
 				return false
 			}
+		} else if noAuthUser != "" && c.hasNoCredentials() {
+			// Map connections without any credentials to the no auth user.
+			if u, ok := s.users[noAuthUser]; ok {
+				s.mu.Unlock()
+				c.RegisterUser(u)
+				return true
+			}
 		}
 	}
 	s.mu.Unlock()
@@ -399,9 +445,6 @@ func (s *Server) isClientAuthorized(c *client) bool {
 		nkey = buildInternalNkeyUser(juc, acc)
 		c.RegisterNkeyUser(nkey)
 
-		// Generate an event if we have a system account.
-		s.accountConnectEvent(c)
-
 		// Check if we need to set an auth timer if the user jwt expires.
 		c.checkExpiration(juc.Claims())
 		return true
@@ -456,6 +499,30 @@ func (s *Server) isClientAuthorized(c *client) bool {
 	return false
 }
 
+// hasNoCredentials returns true if the client did not present
+// any form of credentials in its CONNECT.
+func (c *client) hasNoCredentials() bool {
+	return c.opts.Username == "" && c.opts.Password == "" && c.opts.Authorization == "" &&
+		c.opts.Nkey == "" && c.opts.JWT == ""
+}
+
+// validateNoAuthUser checks that the no_auth_user, if set, refers to a user
+// defined in the authorization block or in an account.
+func validateNoAuthUser(o *Options) error {
+	if o.NoAuthUser == "" {
+		return nil
+	}
+	if len(o.TrustedOperators) > 0 || len(o.TrustedKeys) > 0 {
+		return fmt.Errorf("no_auth_user not compatible with trusted operators")
+	}
+	for _, u := range o.Users {
+		if u.Username == o.NoAuthUser {
+			return nil
+		}
+	}
+	return fmt.Errorf("no_auth_user %q not present as user in authorization block or account configuration", o.NoAuthUser)
+}
+
 func checkClientTLSCertSubject(c *client, fn func(string) bool) bool {
 	tlsState := c.GetTLSConnectionState()
 	if tlsState == nil {
@@ -595,7 +662,11 @@ func (s *Server) isLeafNodeAuthorized(c *client) bool {
 	// If we have a jwt and a userClaim, make sure we have the Account, etc associated.
 	// We need to look up the account. This will use an account resolver if one is present.
 	if juc != nil {
-		if acc, _ = s.LookupAccount(juc.Issuer); acc == nil {
+		issuer := juc.Issuer
+		if juc.IssuerAccount != "" {
+			issuer = juc.IssuerAccount
+		}
+		if acc, _ = s.LookupAccount(issuer); acc == nil {
 			c.Debugf("Account JWT can not be found")
 			return false
 		}
@@ -603,6 +674,10 @@ func (s *Server) isLeafNodeAuthorized(c *client) bool {
 			c.Debugf("Account JWT not signed by trusted operator")
 			return false
 		}
+		if juc.IssuerAccount != "" && !acc.hasIssuer(juc.Issuer) {
+			c.Debugf("User JWT issuer is not known")
+			return false
+		}
 		if acc.IsExpired() {
 			c.Debugf("Account JWT has expired")
 			return false
@@ -653,13 +728,20 @@ func (s *Server) isLeafNodeAuthorized(c *client) bool {
 	// Snapshot server options.
 	opts := s.getOpts()
 
-	if opts.LeafNode.Username == "" {
-		return true
+	if opts.LeafNode.Username != "" {
+		if opts.LeafNode.Username != c.opts.Username {
+			return false
+		}
+		if !comparePasswords(opts.LeafNode.Password, c.opts.Password) {
+			return false
+		}
 	}
-	if opts.LeafNode.Username != c.opts.Username {
-		return false
+	if opts.LeafNode.Permissions != nil {
+		c.mu.Lock()
+		c.setRoutePermissions(opts.LeafNode.Permissions)
+		c.mu.Unlock()
 	}
-	return comparePasswords(opts.LeafNode.Password, c.opts.Password)
+	return true
 }
 
 // Support for bcrypt stored passwords and tokens.
@@ -14,8 +14,13 @@
 package server
 
 import (
+	"fmt"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/nats-io/nats.go"
 )
 
 func TestUserCloneNilPermissions(t *testing.T) {
@@ -101,3 +106,81 @@ func TestUserCloneNil(t *testing.T) {
 		t.Fatalf("Expected nil, got: %+v", clone)
 	}
 }
+
+func TestNoAuthUser(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			FOO { users [{user: foo, password: pwd1}] }
+			BAR { users [{user: bar, password: pwd2}] }
+		}
+		no_auth_user: bar
+	`))
+	defer os.Remove(conf)
+
+	s, o := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	for _, test := range []struct {
+		name    string
+		url     string
+		account string
+		err     bool
+	}{
+		{"no credentials", fmt.Sprintf("nats://%s:%d", o.Host, o.Port), "BAR", false},
+		{"valid user", fmt.Sprintf("nats://foo:pwd1@%s:%d", o.Host, o.Port), "FOO", false},
+		{"bad password", fmt.Sprintf("nats://foo:wrong@%s:%d", o.Host, o.Port), "", true},
+		{"password only", fmt.Sprintf("nats://:pwd2@%s:%d", o.Host, o.Port), "", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			nc, err := nats.Connect(test.url)
+			if test.err {
+				if err == nil {
+					nc.Close()
+					t.Fatal("Expected error on connect")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error on connect: %v", err)
+			}
+			defer nc.Close()
+			cid, _ := nc.GetClientID()
+			c := s.getClient(cid)
+			if c == nil {
+				t.Fatalf("Unable to find client %d", cid)
+			}
+			c.mu.Lock()
+			acc := c.acc.Name
+			c.mu.Unlock()
+			if acc != test.account {
+				t.Fatalf("Expected account %q, got %q", test.account, acc)
+			}
+		})
+	}
+}
+
+func TestNoAuthUserNotConfigured(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		cfg  string
+	}{
+		{"no users", `no_auth_user: foo`},
+		{"unknown user", `
+			authorization { users [{user: bar, password: pwd}] }
+			no_auth_user: foo
+		`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(test.cfg))
+			defer os.Remove(conf)
+			opts, err := ProcessConfigFile(conf)
+			if err != nil {
+				t.Fatalf("Error processing config file: %v", err)
+			}
+			if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "no_auth_user") {
+				t.Fatalf("Expected error about no_auth_user, got %v", err)
+			}
+		})
+	}
+}
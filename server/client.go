@@ -14,6 +14,7 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/tls"
 	"encoding/json"
@@ -23,12 +24,16 @@ import (
 	"net"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/nats-io/jwt"
+
+	srvlog "github.com/nats-io/nats-server/v2/logger"
 )
 
 // Type of client connection.
@@ -71,12 +76,21 @@ const (
 	shortsToShrink  = 2     // Trigger to shrink dynamic buffers
 	maxFlushPending = 10    // Max fsps to have in order to wait for writeLoop
 	readLoopReport  = 2 * time.Second
+
+	// For sharing the payload of messages with a large fan-out, the payload
+	// being copied once and queued by reference to all subscribers.
+	fanoutShareMin   = 16  // Min number of subscriptions to share the payload.
+	sharedPayloadMin = 512 // Min payload size to share, smaller ones are copied.
+
+	// Max pause of a publisher per read while the pending bytes of all
+	// connections are above the limit.
+	maxPendingPause = time.Second
 )
 
 var readLoopReportThreshold = readLoopReport
 
 // Represent client booleans with a bitmask
-type clientFlag byte
+type clientFlag uint16
 
 // Some client state represented as flags
 const (
@@ -87,6 +101,11 @@ const (
 	clearConnection                          // Marks that clearConnection has already been called.
 	flushOutbound                            // Marks client as having a flushOutbound call in progress.
 	noReconnect                              // Indicate that on close, this connection should not attempt a reconnect
+	connectEventSent                         // Marks that an account connect event has been sent for this connection.
+	remoteEventSent                          // Marks that a route or leafnode connect event has been sent for this connection.
+	drainRequested                           // The client sent DRAIN, no new messages are delivered to it.
+	maxSubsReported                          // An advisory was sent for reaching the maximum subscriptions.
+	readPolled                               // The reads of the connection are driven by the poller.
 )
 
 // set the flag (would be equivalent to set the boolean to true)
@@ -145,6 +164,23 @@ const (
 	AuthenticationExpired
 	WrongGateway
 	MissingAccount
+	AccountDrained
+	AccountDeleted
+	LeafNodeLoopDetected
+	ClusterNameConflict
+	DuplicateClientID
+	Kicked
+	SlowConsumerStalled
+	MaxIPConnectionsExceeded
+	MaxUserConnectionsExceeded
+	IdleTimeout
+)
+
+// Kinds of errors tracked per account.
+const (
+	accErrSlowConsumer = iota
+	accErrPermViolation
+	accErrProtocol
 )
 
 // Some flags passed to processMsgResultsEx
@@ -157,21 +193,30 @@ const (
 type client struct {
 	// Here first because of use of atomics, and memory alignment.
 	stats
+	rhits   uint64 // Reply subject lookups served by the reply cache.
+	rmisses uint64 // Reply subject lookups that missed the reply cache.
+
 	mpay   int32
 	msubs  int32
 	mcl    int32
 	mu     sync.Mutex
+	pmu    sync.Mutex // Serializes the publications of internal clients.
 	kind   int
 	cid    uint64
+	accn   atomic.Value // Name of the account, for logging.
 	opts   clientOpts
 	start  time.Time
 	nonce  []byte
 	nc     net.Conn
-	ncs    string
+	pfd    int          // Socket of the connection when read by the poller.
+	ncs    atomic.Value // Connection string for logs, with the name from CONNECT once known.
 	out    outbound
 	srv    *Server
 	acc    *Account
 	user   *NkeyUser
+	umc    int               // Max connections of the user, 0 for the server default.
+	utags  map[string]string // Tags of the user, referenced by its permissions.
+	ukey   string            // User the connection is counted for, if any.
 	host   string
 	port   uint16
 	subs   map[string]*subscription
@@ -181,6 +226,7 @@ type client struct {
 	in     readCache
 	pcd    map[*client]struct{}
 	atmr   *time.Timer
+	itmr   *time.Timer
 	ping   pinfo
 	msgb   [msgScratchSize]byte
 	last   time.Time
@@ -192,10 +238,19 @@ type client struct {
 	route *route
 	gw    *gateway
 	leaf  *leaf
+	mqtt  *mqtt
+	stomp *stomp
 
 	debug bool
 	trace bool
 	echo  bool
+	// Messages with headers are sent with HMSG, otherwise the header
+	// block is part of the payload.
+	headers bool
+
+	// Cause of the close of the connection, if known, reported in the
+	// disconnect events of routes and leafnodes.
+	closeErr string
 
 	flags clientFlag // Compact booleans into a single field. Size will be increased when needed.
 }
@@ -217,12 +272,65 @@ type outbound struct {
 	pm  int32         // Total pending/queued messages.
 	sg  *sync.Cond    // Flusher conditional for signaling to writeLoop.
 	wdl time.Duration // Snapshot of write deadline.
+	stl time.Duration // Snapshot of stall timeout, replaces the write deadline when set.
+	sst time.Time     // Start of the current stall.
+	spb int32         // Pending bytes at the start of the current stall.
 	mp  int32         // Snapshot of max pending for client.
 	fsp int32         // Flush signals that are pending per producer from readLoop's pcd.
 	lft time.Duration // Last flush time for Write.
 	lwb int32         // Last byte size of Write.
 	stc chan struct{} // Stall chan we create to slow down producers on overrun, e.g. fan-in.
+	gpb int32         // Pending bytes accounted in the pending bytes of all connections.
 	sgw bool          // Indicate flusher is waiting on condition wait.
+	mxv int           // Snapshot of max buffers per vectored write, 0 for no limit.
+	cwd time.Duration // Snapshot of coalescing delay of the writeLoop.
+	mnb int32         // Snapshot of minimum buffer size.
+	mxb int32         // Snapshot of maximum buffer size.
+	bgp bufGrowth     // Snapshot of buffer growth policy.
+	rfs bool          // Indicate that buffers not owned by the client are queued.
+}
+
+// bufGrowth is the policy to resize the outbound buffers.
+type bufGrowth uint8
+
+const (
+	bufGrowthDynamic bufGrowth = iota // Grow and shrink with the traffic.
+	bufGrowthGrow                     // Grow only.
+	bufGrowthFixed                    // Always use the maximum size.
+)
+
+// parseBufGrowth returns the buffer growth policy of the given name.
+func parseBufGrowth(name string) (bufGrowth, error) {
+	switch name {
+	case _EMPTY_, "dynamic":
+		return bufGrowthDynamic, nil
+	case "grow":
+		return bufGrowthGrow, nil
+	case "fixed":
+		return bufGrowthFixed, nil
+	}
+	return 0, fmt.Errorf("unknown outbound buffer growth %q", name)
+}
+
+// setOutboundOpts snapshots the outbound options.
+// Lock should be held.
+func (o *outbound) setOutboundOpts(opts *OutboundOpts) {
+	o.mxv = opts.MaxVectors
+	o.cwd = opts.CoalesceDelay
+	o.mnb, o.mxb = minBufSize, maxBufSize
+	if opts.MinBufferSize > 0 {
+		o.mnb = int32(opts.MinBufferSize)
+	}
+	if opts.MaxBufferSize > 0 {
+		o.mxb = int32(opts.MaxBufferSize)
+	}
+	// Validated with the options.
+	o.bgp, _ = parseBufGrowth(opts.BufferGrowth)
+	if o.bgp == bufGrowthFixed || o.sz > o.mxb {
+		o.sz = o.mxb
+	} else if o.sz > 0 && o.sz < o.mnb {
+		o.sz = o.mnb
+	}
 }
 
 type perm struct {
@@ -266,6 +374,9 @@ type readCache struct {
 	genid   uint64
 	results map[string]*SublistResult
 
+	// Results for reply subjects, keyed by their inbox prefix.
+	replies map[string]*SublistResult
+
 	// This is for routes and gateways to have their own L1 as well that is account aware.
 	pacache map[string]*perAccountCache
 
@@ -275,6 +386,10 @@ type readCache struct {
 
 	prand *rand.Rand
 
+	// Copy of the payload of the message being delivered, shared by
+	// reference by the outbound queues of the subscribers.
+	shm []byte
+
 	// These are all temporary totals for an invocation of a read in readloop.
 	msgs  int32
 	bytes int32
@@ -282,6 +397,7 @@ type readCache struct {
 
 	rsz int32 // Read buffer size
 	srs int32 // Short reads, used for dynamic buffer resizing.
+	rbl int   // Bytes of the route batch being read still to be read.
 }
 
 const (
@@ -297,7 +413,10 @@ type perAccountCache struct {
 }
 
 func (c *client) String() (id string) {
-	return c.ncs
+	if ncs, ok := c.ncs.Load().(string); ok {
+		return ncs
+	}
+	return _EMPTY_
 }
 
 func (c *client) GetOpts() *clientOpts {
@@ -321,7 +440,7 @@ func (c *client) GetTLSConnectionState() *tls.ConnectionState {
 // to optionally have an opts section for non-normal stuff.
 type subscription struct {
 	client  *client
-	im      *streamImport   // This is for import stream support.
+	ext     *subExtra       // Rarely set fields, kept out to save memory.
 	shadow  []*subscription // This is to track shadowed accounts.
 	subject []byte
 	queue   []byte
@@ -331,6 +450,38 @@ type subscription struct {
 	qw      int32
 }
 
+// subExtra holds the fields that few subscriptions have. They are set before
+// the subscription is registered, and not changed after.
+type subExtra struct {
+	im  *streamImport // This is for import stream support.
+	icb msgHandler    // Callback for internal subscriptions.
+	rl  *subRateLimit // Delivery rate requested by the client, if any.
+}
+
+// streamImport returns the stream import of a shadow subscription.
+func (sub *subscription) streamImport() *streamImport {
+	if sub.ext == nil {
+		return nil
+	}
+	return sub.ext.im
+}
+
+// callback returns the callback of an internal subscription.
+func (sub *subscription) callback() msgHandler {
+	if sub.ext == nil {
+		return nil
+	}
+	return sub.ext.icb
+}
+
+// rateLimit returns the delivery rate requested for the subscription.
+func (sub *subscription) rateLimit() *subRateLimit {
+	if sub.ext == nil {
+		return nil
+	}
+	return sub.ext.rl
+}
+
 type clientOpts struct {
 	Echo          bool   `json:"echo"`
 	Verbose       bool   `json:"verbose"`
@@ -348,6 +499,10 @@ type clientOpts struct {
 	Protocol      int    `json:"protocol"`
 	Account       string `json:"account,omitempty"`
 	AccountNew    bool   `json:"new_account,omitempty"`
+	Headers       bool   `json:"headers,omitempty"`
+	// Arbitrary metadata, reported in monitoring, events and logs. It is
+	// sent by the client, so never used for permissions.
+	Tags map[string]string `json:"tags,omitempty"`
 
 	// Routes only
 	Import *SubjectPermission `json:"import,omitempty"`
@@ -372,7 +527,9 @@ func (c *client) initClient() {
 	opts := s.getOpts()
 	// Snapshots to avoid mutex access in fast paths.
 	c.out.wdl = opts.WriteDeadline
+	c.out.stl = stallTimeout(c.kind, opts)
 	c.out.mp = int32(opts.MaxPending)
+	c.out.setOutboundOpts(&opts.Outbound)
 
 	c.subs = make(map[string]*subscription)
 	c.echo = true
@@ -401,15 +558,15 @@ func (c *client) initClient() {
 
 	switch c.kind {
 	case CLIENT:
-		c.ncs = fmt.Sprintf("%s - cid:%d", conn, c.cid)
+		c.ncs.Store(fmt.Sprintf("%s - cid:%d", conn, c.cid))
 	case ROUTER:
-		c.ncs = fmt.Sprintf("%s - rid:%d", conn, c.cid)
+		c.ncs.Store(fmt.Sprintf("%s - rid:%d", conn, c.cid))
 	case GATEWAY:
-		c.ncs = fmt.Sprintf("%s - gid:%d", conn, c.cid)
+		c.ncs.Store(fmt.Sprintf("%s - gid:%d", conn, c.cid))
 	case LEAF:
-		c.ncs = fmt.Sprintf("%s - lid:%d", conn, c.cid)
+		c.ncs.Store(fmt.Sprintf("%s - lid:%d", conn, c.cid))
 	case SYSTEM:
-		c.ncs = "SYSTEM"
+		c.ncs.Store("SYSTEM")
 	}
 }
 
@@ -453,6 +610,7 @@ func (c *client) registerWithAccount(acc *Account) error {
 	kind := c.kind
 	srv := c.srv
 	c.acc = acc
+	c.accn.Store(acc.Name)
 	c.applyAccountLimits()
 	c.mu.Unlock()
 
@@ -506,12 +664,13 @@ func (c *client) applyAccountLimits() {
 		c.msubs = int32(opts.MaxSubs)
 	}
 
-	if c.subsAtLimit() {
-		go func() {
-			c.maxSubsExceeded()
-			time.Sleep(20 * time.Millisecond)
-			c.closeConnection(MaxSubscriptionsExceeded)
-		}()
+	// The existing subscriptions are kept, but no new one is accepted until
+	// the connection is back under the limit.
+	if c.msubs != jwt.NoLimit && len(c.subs) > int(c.msubs) {
+		c.reportMaxSubs(nil)
+		c.traceOutOp("-ERR", []byte(ErrTooManySubs.Error()))
+		c.sendProto([]byte(fmt.Sprintf("-ERR '%s'\r\n", ErrTooManySubs.Error())), false)
+		c.Errorf(ErrTooManySubs.Error())
 	}
 }
 
@@ -530,6 +689,8 @@ func (c *client) RegisterUser(user *User) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	c.umc = user.MaxConnections
+	c.utags = user.Tags
 	// Assign permissions.
 	if user.Permissions == nil {
 		// Reset perms to nil in case client previously had them.
@@ -554,6 +715,8 @@ func (c *client) RegisterNkeyUser(user *NkeyUser) error {
 
 	c.mu.Lock()
 	c.user = user
+	c.umc = user.MaxConnections
+	c.utags = user.Tags
 	// Assign permissions.
 	if user.Permissions == nil {
 		// Reset perms to nil in case client previously had them.
@@ -580,14 +743,14 @@ func (c *client) setPermissions(perms *Permissions) {
 		if len(perms.Publish.Allow) > 0 {
 			c.perms.pub.allow = NewSublist()
 		}
-		for _, pubSubject := range perms.Publish.Allow {
+		for _, pubSubject := range c.expandPermSubjects(perms.Publish.Allow, true) {
 			sub := &subscription{subject: []byte(pubSubject)}
 			c.perms.pub.allow.Insert(sub)
 		}
 		if len(perms.Publish.Deny) > 0 {
 			c.perms.pub.deny = NewSublist()
 		}
-		for _, pubSubject := range perms.Publish.Deny {
+		for _, pubSubject := range c.expandPermSubjects(perms.Publish.Deny, false) {
 			sub := &subscription{subject: []byte(pubSubject)}
 			c.perms.pub.deny.Insert(sub)
 		}
@@ -598,22 +761,95 @@ func (c *client) setPermissions(perms *Permissions) {
 		if len(perms.Subscribe.Allow) > 0 {
 			c.perms.sub.allow = NewSublist()
 		}
-		for _, subSubject := range perms.Subscribe.Allow {
+		for _, subSubject := range c.expandPermSubjects(perms.Subscribe.Allow, true) {
 			sub := &subscription{subject: []byte(subSubject)}
 			c.perms.sub.allow.Insert(sub)
 		}
-		if len(perms.Subscribe.Deny) > 0 {
+		deny := c.expandPermSubjects(perms.Subscribe.Deny, false)
+		if len(deny) > 0 {
 			c.perms.sub.deny = NewSublist()
 			// Also hold onto this array for later.
-			c.darray = perms.Subscribe.Deny
+			c.darray = deny
 		}
-		for _, subSubject := range perms.Subscribe.Deny {
+		for _, subSubject := range deny {
 			sub := &subscription{subject: []byte(subSubject)}
 			c.perms.sub.deny.Insert(sub)
 		}
 	}
 }
 
+// Template referencing a tag of the connection in a permission subject,
+// e.g. "orders.{{tag(region)}}.>".
+const (
+	permTagPrefix = "{{tag("
+	permTagSuffix = ")}}"
+)
+
+// expandPermSubjects replaces the references to the tags of the user in the
+// permission subjects. These tags come from the configuration or the user
+// JWT, never from the client. An allowed subject referencing a tag that the
+// user does not have, or whose value is not a valid token, is removed,
+// while such a token in a denied subject is replaced by a wildcard, so that
+// the connection is never granted more than intended.
+// Lock is held on entry.
+func (c *client) expandPermSubjects(subjects []string, allow bool) []string {
+	var expanded []string
+	for i, subject := range subjects {
+		if !strings.Contains(subject, permTagPrefix) {
+			if expanded != nil {
+				expanded = append(expanded, subject)
+			}
+			continue
+		}
+		if expanded == nil {
+			expanded = append(make([]string, 0, len(subjects)), subjects[:i]...)
+		}
+		tokens := strings.Split(subject, tsep)
+		valid := true
+		for j, tok := range tokens {
+			if t, ok := c.expandPermToken(tok); ok {
+				tokens[j] = t
+			} else if allow {
+				valid = false
+				break
+			} else {
+				tokens[j] = string(pwc)
+			}
+		}
+		if valid {
+			expanded = append(expanded, strings.Join(tokens, tsep))
+		}
+	}
+	if expanded == nil {
+		return subjects
+	}
+	return expanded
+}
+
+// expandPermToken replaces the tag references in a token of a permission
+// subject, and returns false if a tag can not be used.
+// Lock is held on entry.
+func (c *client) expandPermToken(tok string) (string, bool) {
+	for i := 0; ; {
+		start := strings.Index(tok[i:], permTagPrefix)
+		if start < 0 {
+			return tok, true
+		}
+		start += i
+		end := strings.Index(tok[start:], permTagSuffix)
+		if end < 0 {
+			return _EMPTY_, false
+		}
+		end += start
+		value, ok := c.utags[tok[start+len(permTagPrefix):end]]
+		if !ok || value == _EMPTY_ || strings.ContainsAny(value, ".*> \t\r\n") {
+			return _EMPTY_, false
+		}
+		tok = tok[:start] + value + tok[end+len(permTagSuffix):]
+		i = start + len(value)
+	}
+}
+
 // Check to see if we have an expiration for the user JWT via base claims.
 // FIXME(dlc) - Clear on connect with new JWT.
 func (c *client) checkExpiration(claims *jwt.ClaimsData) {
@@ -656,6 +892,17 @@ func (c *client) writeLoop() {
 			c.out.sgw = true
 			c.out.sg.Wait()
 			c.out.sgw = false
+			// Give producers a chance to queue more data before writing,
+			// unless there is already enough to fill a buffer.
+			cwd := c.out.cwd
+			if c.route != nil && c.route.batch && c.route.bdelay > 0 {
+				cwd = c.route.bdelay
+			}
+			if cwd > 0 && c.out.pb < c.out.mxb && !c.flags.isSet(clearConnection) {
+				c.mu.Unlock()
+				time.Sleep(cwd)
+				c.mu.Lock()
+			}
 		}
 		// Flush data
 		// TODO(dlc) - This could spin if another go routine in flushOutbound waiting on a slow IO.
@@ -694,7 +941,8 @@ func (c *client) flushClients(budget time.Duration) time.Time {
 			continue
 		}
 
-		if budget > 0 && cp.flushOutbound() {
+		// Connections coalescing writes are left to their writeLoop.
+		if budget > 0 && cp.out.cwd == 0 && cp.flushOutbound() {
 			budget -= cp.out.lft
 		} else {
 			cp.flushSignal()
@@ -734,100 +982,164 @@ func (c *client) readLoop() {
 
 	b := make([]byte, c.in.rsz)
 
+	// Switched to a decompressing reader if the remote route
+	// starts compression.
+	var r io.Reader = nc
+
 	for {
-		n, err := nc.Read(b)
+		n, err := r.Read(b)
 		if err != nil {
 			if err == io.EOF {
 				c.closeConnection(ClientClosed)
 			} else {
+				c.setCloseErr(err.Error())
 				c.closeConnection(ReadError)
 			}
 			return
 		}
-		start := time.Now()
-
-		// Clear inbound stats cache
-		c.in.msgs = 0
-		c.in.bytes = 0
-		c.in.subs = 0
-
-		// Main call into parser for inbound data. This will generate callouts
-		// to process messages, etc.
-		if err := c.parse(b[:n]); err != nil {
-			if dur := time.Since(start); dur >= readLoopReportThreshold {
-				c.Warnf("Readloop processing time: %v", dur)
-			}
-			// handled inline
-			if err != ErrMaxPayload && err != ErrAuthentication {
-				c.Errorf("%s", err.Error())
-				c.closeConnection(ProtocolViolation)
-			}
+		ok, dstart := c.processRead(b, n)
+		if dstart {
+			r = c.routeDecompressReader(nc)
+		}
+		if !ok {
 			return
 		}
-
-		// Updates stats for client and server that were collected
-		// from parsing through the buffer.
-		if c.in.msgs > 0 {
-			atomic.AddInt64(&c.inMsgs, int64(c.in.msgs))
-			atomic.AddInt64(&c.inBytes, int64(c.in.bytes))
-			atomic.AddInt64(&s.inMsgs, int64(c.in.msgs))
-			atomic.AddInt64(&s.inBytes, int64(c.in.bytes))
+		// Pause a publisher while the pending bytes of all connections are
+		// above the limit, instead of reading more messages to queue.
+		if c.pausePublisher() {
+			s.waitOutPending(c)
 		}
-
-		// Budget to spend in place flushing outbound data.
-		// Client will be checked on several fronts to see
-		// if applicable. Routes and Gateways will never
-		// spend time flushing outbound in place.
-		var budget time.Duration
-		if c.kind == CLIENT {
-			budget = time.Millisecond
+		// Resize the read buffer as decided when processing.
+		if int(c.in.rsz) != cap(b) {
+			b = make([]byte, c.in.rsz)
 		}
+	}
+}
 
-		// Flush, or signal to writeLoop to flush to socket.
-		last := c.flushClients(budget)
-
-		// Update activity, check read buffer size.
-		c.mu.Lock()
-		nc := c.nc
-
-		// Activity based on interest changes or data/msgs.
-		if c.in.msgs > 0 || c.in.subs > 0 {
-			c.last = last
-		}
+// processRead processes the n bytes read in b, by the readLoop or the
+// poller. It returns false once the connection is closed, and true as the
+// second value if the remote route starts compression after these bytes.
+func (c *client) processRead(b []byte, n int) (bool, bool) {
+	s := c.srv
+	start := time.Now()
 
-		if n >= cap(b) {
-			c.in.srs = 0
-		} else if n < cap(b)/2 { // divide by 2 b/c we want less than what we would shrink to.
-			c.in.srs++
-		}
+	// Clear inbound stats cache
+	c.in.msgs = 0
+	c.in.bytes = 0
+	c.in.subs = 0
 
-		// Update read buffer size as/if needed.
-		if n >= cap(b) && cap(b) < maxBufSize {
-			// Grow
-			c.in.rsz = int32(cap(b) * 2)
-			b = make([]byte, c.in.rsz)
-		} else if n < cap(b) && cap(b) > minBufSize && c.in.srs > shortsToShrink {
-			// Shrink, for now don't accelerate, ping/pong will eventually sort it out.
-			c.in.rsz = int32(cap(b) / 2)
-			b = make([]byte, c.in.rsz)
+	// Account for the bytes of a route batch started in a previous read.
+	if c.in.rbl > 0 {
+		if c.in.rbl -= n; c.in.rbl < 0 {
+			c.in.rbl = 0
 		}
-		c.mu.Unlock()
+	}
 
+	// Main call into parser for inbound data. This will generate callouts
+	// to process messages, etc.
+	var err error
+	if c.mqtt != nil {
+		err = c.mqttParse(b[:n])
+	} else if c.stomp != nil {
+		err = c.stompParse(b[:n])
+	} else {
+		err = c.parse(b[:n])
+	}
+	var dstart bool
+	if err == errRouteCompressionStarted {
+		dstart, err = true, nil
+	}
+	if err != nil {
 		if dur := time.Since(start); dur >= readLoopReportThreshold {
 			c.Warnf("Readloop processing time: %v", dur)
 		}
-
-		// Check to see if we got closed, e.g. slow consumer
-		if nc == nil {
-			return
+		// handled inline
+		if err != ErrMaxPayload && err != ErrAuthentication {
+			c.Errorf("%s", err.Error())
+			c.accountError(accErrProtocol)
+			c.setCloseErr(err.Error())
+			c.closeConnection(ProtocolViolation)
+		}
+		return false, false
+	}
+
+	// Updates stats for client, server and account that were collected
+	// from parsing through the buffer.
+	if c.in.msgs > 0 {
+		atomic.AddInt64(&c.inMsgs, int64(c.in.msgs))
+		atomic.AddInt64(&c.inBytes, int64(c.in.bytes))
+		atomic.AddInt64(&s.inMsgs, int64(c.in.msgs))
+		atomic.AddInt64(&s.inBytes, int64(c.in.bytes))
+		if acc := c.acc; acc != nil && (c.kind == CLIENT || c.kind == LEAF) {
+			atomic.AddInt64(&acc.inMsgs, int64(c.in.msgs))
+			atomic.AddInt64(&acc.inBytes, int64(c.in.bytes))
 		}
 	}
+
+	// Budget to spend in place flushing outbound data.
+	// Client will be checked on several fronts to see
+	// if applicable. Routes and Gateways will never
+	// spend time flushing outbound in place.
+	var budget time.Duration
+	if c.kind == CLIENT {
+		budget = time.Millisecond
+	}
+
+	// Flush, or signal to writeLoop to flush to socket. The messages
+	// of a route batch that continues in the next read are flushed
+	// with the rest of the batch.
+	last := start
+	if c.in.rbl == 0 {
+		last = c.flushClients(budget)
+	}
+
+	// Update activity, check read buffer size.
+	c.mu.Lock()
+	nc := c.nc
+
+	// Activity based on interest changes or data/msgs.
+	if c.in.msgs > 0 || c.in.subs > 0 {
+		c.last = last
+	}
+
+	if n >= cap(b) {
+		c.in.srs = 0
+	} else if n < cap(b)/2 { // divide by 2 b/c we want less than what we would shrink to.
+		c.in.srs++
+	}
+
+	// Update read buffer size as/if needed.
+	if n >= cap(b) && cap(b) < maxBufSize {
+		// Grow
+		c.in.rsz = int32(cap(b) * 2)
+	} else if n < cap(b) && cap(b) > minBufSize && c.in.srs > shortsToShrink {
+		// Shrink, for now don't accelerate, ping/pong will eventually sort it out.
+		c.in.rsz = int32(cap(b) / 2)
+	}
+	c.mu.Unlock()
+
+	if dur := time.Since(start); dur >= readLoopReportThreshold {
+		c.Warnf("Readloop processing time: %v", dur)
+	}
+
+	// Check to see if we got closed, e.g. slow consumer
+	if nc == nil {
+		return false, dstart
+	}
+	return true, dstart
+}
+
+// Returns true if the client published messages in the last read while
+// the pending bytes of all connections are above the limit, in which case
+// it should not be read again until they drop.
+func (c *client) pausePublisher() bool {
+	return c.kind == CLIENT && c.in.msgs > 0 && c.srv.outPendingGate() != nil
 }
 
 // collapsePtoNB will place primary onto nb buffer as needed in prep for WriteTo.
 // This will return a copy on purpose.
 func (c *client) collapsePtoNB() net.Buffers {
-	if c.out.p != nil {
+	if len(c.out.p) > 0 {
 		p := c.out.p
 		c.out.p = nil
 		return append(c.out.nb, p)
@@ -872,25 +1184,57 @@ func (c *client) flushOutbound() bool {
 	nb := c.collapsePtoNB()
 	c.out.p, c.out.nb, c.out.s = c.out.s, nil, nil
 
+	attempted := c.out.pb
+	apm := c.out.pm
+	// Buffers referenced from other connections or from the producers can
+	// not be reused once written.
+	refs := c.out.rfs
+	// Leave the buffers past the vectors limit for the next flush. Pending
+	// messages are only accounted for once all of them are written.
+	limited := c.out.mxv > 0 && len(nb) > c.out.mxv
+	if !limited {
+		c.out.rfs = false
+	}
+	if limited {
+		nb, c.out.nb = nb[:c.out.mxv:c.out.mxv], nb[c.out.mxv:]
+		attempted, apm = 0, 0
+		for _, b := range nb {
+			attempted += int32(len(b))
+		}
+	}
+	vecs := len(nb)
+
 	// For selecting primary replacement.
 	cnb := nb
 
+	// Frame what is written to a route as a batch when negotiated.
+	batch := c.kind == ROUTER && c.route != nil && c.route.batch
+	if batch && !limited {
+		nb, attempted = c.frameRouteBatch(nb, attempted)
+	}
+
 	// In case it goes away after releasing the lock.
 	nc := c.nc
-	attempted := c.out.pb
-	apm := c.out.pm
+	var w io.Writer = nc
+	if c.kind == ROUTER && c.route != nil && c.route.cw != nil {
+		w = c.route.cw
+	}
 
 	// Do NOT hold lock during actual IO.
 	c.mu.Unlock()
 
 	// flush here
 	now := time.Now()
+	wdl := c.out.wdl
+	if c.out.stl > 0 {
+		wdl = c.out.stl
+	}
 	// FIXME(dlc) - writev will do multiple IOs past 1024 on
 	// most platforms, need to account for that with deadline?
-	nc.SetWriteDeadline(now.Add(c.out.wdl))
+	nc.SetWriteDeadline(now.Add(wdl))
 
 	// Actual write to the socket.
-	n, err := nb.WriteTo(nc)
+	n, err := nb.WriteTo(w)
 	nc.SetWriteDeadline(time.Time{})
 	lft := time.Since(now)
 
@@ -900,22 +1244,42 @@ func (c *client) flushOutbound() bool {
 	// Update flush time statistics.
 	c.out.lft = lft
 	c.out.lwb = int32(n)
+	if n > 0 {
+		srv.recordFlush(n, vecs)
+	}
 
 	// Subtract from pending bytes and messages.
 	c.out.pb -= c.out.lwb
+	c.accountPending(-c.out.lwb)
 	c.out.pm -= apm // FIXME(dlc) - this will not be totally accurate on partials.
 
 	// Check for partial writes
 	// TODO(dlc) - zero write with no error will cause lost message and the writeloop to spin.
 	if c.out.lwb != attempted && n > 0 {
 		c.handlePartialWrite(nb)
+		c.out.rfs = c.out.rfs || refs
 	} else if c.out.lwb >= c.out.sz {
 		c.out.sws = 0
 	}
+	// Everything queued is made of complete protocols, so the stream is on
+	// a protocol boundary when all that was attempted has been written.
+	if batch {
+		c.route.bsync = !limited && c.out.lwb == attempted
+	}
+
+	// With the stall detection, a write that times out after some progress
+	// is not an error, the rest is written with the next flush. This is not
+	// possible with TLS since the connection is unusable after a timeout.
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && c.out.stl > 0 && n > 0 {
+		if _, isTLS := nc.(*tls.Conn); !isTLS {
+			err = nil
+		}
+	}
 
 	if err != nil {
 		if n == 0 {
 			c.out.pb -= attempted
+			c.accountPending(-attempted)
 		}
 		if ne, ok := err.(net.Error); ok && ne.Timeout() {
 			// report slow consumer error
@@ -937,13 +1301,27 @@ func (c *client) flushOutbound() bool {
 				c.clearConnection(SlowConsumerWriteDeadline)
 				sce = false
 			}
-			if sce {
+			if sce && c.out.stl > 0 {
+				pending := append(append([][]byte(nil), nb...), c.out.nb...)
+				c.reportSlowConsumer(SlowConsumerStalled, append(pending, c.out.p))
+				atomic.AddInt64(&srv.slowConsumers, 1)
+				c.accountError(accErrSlowConsumer)
+				c.clearConnection(SlowConsumerStalled)
+				c.Noticef("Slow Consumer Detected: stalled for %v with %d chunks of %d total bytes.",
+					wdl, len(cnb), attempted)
+			} else if sce {
+				pending := append(append([][]byte(nil), nb...), c.out.nb...)
+				c.reportSlowConsumer(SlowConsumerWriteDeadline, append(pending, c.out.p))
 				atomic.AddInt64(&srv.slowConsumers, 1)
+				c.accountError(accErrSlowConsumer)
 				c.clearConnection(SlowConsumerWriteDeadline)
 				c.Noticef("Slow Consumer Detected: WriteDeadline of %v exceeded with %d chunks of %d total bytes.",
 					c.out.wdl, len(cnb), attempted)
 			}
 		} else {
+			if c.closeErr == _EMPTY_ {
+				c.closeErr = err.Error()
+			}
 			c.clearConnection(WriteError)
 			c.Debugf("Error flushing: %v", err)
 		}
@@ -955,19 +1333,19 @@ func (c *client) flushOutbound() bool {
 
 	// Adjust sz as needed downward, keeping power of 2.
 	// We do this at a slower rate.
-	if pt < c.out.sz && c.out.sz > minBufSize {
+	if pt < c.out.sz && c.out.sz > c.out.mnb && c.out.bgp == bufGrowthDynamic {
 		c.out.sws++
 		if c.out.sws > shortsToShrink {
 			c.out.sz >>= 1
 		}
 	}
 	// Adjust sz as needed upward, keeping power of 2.
-	if pt > c.out.sz && c.out.sz < maxBufSize {
+	if pt > c.out.sz && c.out.sz < c.out.mxb {
 		c.out.sz <<= 1
 	}
 
 	// Check to see if we can reuse buffers.
-	if len(cnb) > 0 {
+	if len(cnb) > 0 && !refs {
 		oldp := cnb[0][:0]
 		if cap(oldp) >= int(c.out.sz) {
 			// Replace primary or secondary if they are nil, reusing same buffer.
@@ -979,15 +1357,27 @@ func (c *client) flushOutbound() bool {
 		}
 	}
 
+	if c.out.stl > 0 && c.isStalled(now) {
+		pending := append(append([][]byte(nil), c.out.nb...), c.out.p)
+		c.reportSlowConsumer(SlowConsumerStalled, pending)
+		atomic.AddInt64(&srv.slowConsumers, 1)
+		c.accountError(accErrSlowConsumer)
+		c.clearConnection(SlowConsumerStalled)
+		c.Noticef("Slow Consumer Detected: stalled for %v with %d pending bytes",
+			now.Sub(c.out.sst), c.out.pb)
+		return true
+	}
+
 	// Check that if there is still data to send and writeLoop is in wait,
-	// then we need to signal.
+	// then we need to signal. This includes the buffers left past the
+	// vectors limit.
 	if c.out.pb > 0 {
 		c.flushSignal()
 	}
 
 	// Check if we have a stalled gate and if so and we are recovering release
 	// any stalled producers. Only kind==CLIENT will stall.
-	if c.out.stc != nil && (c.out.lwb == attempted || c.out.pb < c.out.mp/2) {
+	if c.out.stc != nil && ((c.out.lwb == attempted && !limited) || c.out.pb < c.out.mp/2) {
 		close(c.out.stc)
 		c.out.stc = nil
 	}
@@ -995,6 +1385,41 @@ func (c *client) flushOutbound() bool {
 	return true
 }
 
+// isStalled returns true if the pending data has not been drained below
+// its level at the start of the current stall for longer than the stall
+// timeout. A stall starts when a flush leaves pending data.
+// Lock must be held.
+func (c *client) isStalled(now time.Time) bool {
+	if c.out.pb == 0 || (!c.out.sst.IsZero() && c.out.pb < c.out.spb) {
+		c.out.sst = time.Time{}
+		return false
+	}
+	if c.out.sst.IsZero() {
+		c.out.sst, c.out.spb = now, c.out.pb
+		return false
+	}
+	return now.Sub(c.out.sst) > c.out.stl
+}
+
+// stallTimeout returns the stall timeout of the given kind of connection,
+// which can be set per connection type, otherwise the server wide value is
+// used.
+func stallTimeout(kind int, opts *Options) time.Duration {
+	var d time.Duration
+	switch kind {
+	case ROUTER:
+		d = opts.Cluster.StallTimeout
+	case GATEWAY:
+		d = opts.Gateway.StallTimeout
+	case LEAF:
+		d = opts.LeafNode.StallTimeout
+	}
+	if d == 0 {
+		d = opts.StallTimeout
+	}
+	return d
+}
+
 // flushSignal will use server to queue the flush IO operation to a pool of flushers.
 // Lock must be held.
 func (c *client) flushSignal() bool {
@@ -1054,6 +1479,7 @@ func (c *client) processInfo(arg []byte) error {
 }
 
 func (c *client) processErr(errStr string) {
+	c.setCloseErr(errStr)
 	switch c.kind {
 	case CLIENT:
 		c.Errorf("Client Error %s", errStr)
@@ -1061,10 +1487,27 @@ func (c *client) processErr(errStr string) {
 		c.Errorf("Route Error %s", errStr)
 	case GATEWAY:
 		c.Errorf("Gateway Error %s", errStr)
+	case LEAF:
+		c.Errorf("Leafnode Error %s", errStr)
+		// The remote detected a loop, delay our reconnect attempts.
+		if c.isSolicitedLeafNode() && strings.Contains(errStr, ErrLeafNodeLoop.Error()) {
+			c.leaf.remote.setLoopDetected()
+			c.closeConnection(LeafNodeLoopDetected)
+			return
+		}
 	}
 	c.closeConnection(ParseError)
 }
 
+// Records the cause of the close of the connection, unless already known.
+func (c *client) setCloseErr(err string) {
+	c.mu.Lock()
+	if c.closeErr == _EMPTY_ {
+		c.closeErr = err
+	}
+	c.mu.Unlock()
+}
+
 // Password pattern matcher.
 var passPat = regexp.MustCompile(`"?\s*pass\S*?"?\s*[:=]\s*"?(([^",\r\n}])*)`)
 
@@ -1126,15 +1569,28 @@ func (c *client) processConnect(arg []byte) error {
 	// that other routines lookup the client, and access its options under
 	// the client's lock, so unmarshalling the options outside of the lock
 	// would cause data RACEs.
+	// The tags are shared with monitoring and events, so they are never
+	// updated in place.
+	c.opts.Tags = nil
 	if err := json.Unmarshal(arg, &c.opts); err != nil {
 		c.mu.Unlock()
 		return err
 	}
 	// Indicate that the CONNECT protocol has been received, and that the
 	// server now knows which protocol this client supports.
-	c.flags.set(connectReceived)
+	if c.flags.setIfNotSet(connectReceived) && kind == CLIENT && c.opts.Name != _EMPTY_ {
+		// Identify the connection by its name in the logs.
+		c.ncs.Store(fmt.Sprintf("%s - %q", c, c.opts.Name))
+	}
 	// Capture these under lock
 	c.echo = c.opts.Echo
+	if kind == CLIENT || kind == LEAF {
+		c.headers = c.opts.Headers
+	}
+	// Websocket clients may have their JWT in a cookie.
+	if ws, ok := c.nc.(*wsConn); ok && kind == CLIENT && c.opts.JWT == "" {
+		c.opts.JWT = ws.cookieJWT
+	}
 	proto := c.opts.Protocol
 	verbose := c.opts.Verbose
 	lang := c.opts.Lang
@@ -1203,6 +1659,18 @@ func (c *client) processConnect(arg []byte) error {
 			c.registerWithAccount(srv.gacc)
 		}
 
+		// Refuse new clients of an account that is being or was drained.
+		if kind == CLIENT && c.acc != nil && c.acc.IsDraining() {
+			c.sendErrAndErr(ErrAccountDraining.Error())
+			c.closeConnection(AccountDrained)
+			return ErrAccountDraining
+		}
+
+		// Check the maximum number of connections of the user.
+		if kind == CLIENT && !srv.registerUserConn(c) {
+			c.maxUserConnExceeded()
+			return ErrTooManyUserConnections
+		}
 	}
 
 	switch kind {
@@ -1213,6 +1681,11 @@ func (c *client) processConnect(arg []byte) error {
 			c.closeConnection(BadClientProtocolVersion)
 			return ErrBadClientProtocol
 		}
+		// Generate an event, if we have a system account, once all the
+		// checks passed.
+		if srv != nil {
+			srv.accountConnectEvent(c)
+		}
 		if verbose {
 			c.sendOK()
 		}
@@ -1294,16 +1767,191 @@ func (c *client) maxConnExceeded() {
 	c.closeConnection(MaxConnectionsExceeded)
 }
 
-func (c *client) maxSubsExceeded() {
+func (c *client) maxIPConnExceeded() {
+	c.sendErrAndErr(ErrTooManyIPConnections.Error())
+	c.closeConnection(MaxIPConnectionsExceeded)
+}
+
+func (c *client) maxUserConnExceeded() {
+	c.sendErrAndErr(ErrTooManyUserConnections.Error())
+	c.closeConnection(MaxUserConnectionsExceeded)
+}
+
+// maxSubsExceeded sends the error to the connection and the advisory that
+// identifies it, for the subscription on the given subject if any.
+// Lock should not be held.
+func (c *client) maxSubsExceeded(subject []byte) {
+	c.mu.Lock()
+	c.reportMaxSubs(subject)
+	c.mu.Unlock()
 	c.sendErrAndErr(ErrTooManySubs.Error())
 }
 
+// reportMaxSubs sends an advisory the first time the connection reaches its
+// maximum number of subscriptions, so that repeated attempts do not flood
+// the system account.
+// Lock should be held.
+func (c *client) reportMaxSubs(subject []byte) {
+	srv := c.srv
+	if srv == nil || c.flags.isSet(maxSubsReported) {
+		return
+	}
+	c.flags.set(maxSubsReported)
+	m := &MaxSubscriptionsEventMsg{
+		Kind: c.typeString(),
+		Client: ClientInfo{
+			Start:   c.start,
+			Host:    c.host,
+			ID:      c.cid,
+			Account: accForClient(c),
+			User:    nameForClient(c),
+			Name:    c.opts.Name,
+			Lang:    c.opts.Lang,
+			Version: c.opts.Version,
+			Tags:    c.opts.Tags,
+		},
+		Subject:       string(subject),
+		Subscriptions: len(c.subs),
+		Max:           int(c.msubs),
+	}
+	// Lock is held here, so send the event from a go routine.
+	go srv.maxSubsEvent(m)
+}
+
 func (c *client) maxPayloadViolation(sz int, max int32) {
 	c.Errorf("%s: %d vs %d", ErrMaxPayload.Error(), sz, max)
+	c.accountError(accErrProtocol)
 	c.sendErr("Maximum Payload Violation")
 	c.closeConnection(MaxPayloadExceeded)
 }
 
+// accountError tracks an error of the given kind for the client's account
+// and sends an event if the account crossed its error threshold.
+func (c *client) accountError(kind int) {
+	acc, srv := c.acc, c.srv
+	if acc == nil || srv == nil || (c.kind != CLIENT && c.kind != LEAF) {
+		return
+	}
+	switch kind {
+	case accErrSlowConsumer:
+		atomic.AddInt64(&acc.slowConsumers, 1)
+	case accErrPermViolation:
+		atomic.AddInt64(&acc.permViolations, 1)
+	case accErrProtocol:
+		atomic.AddInt64(&acc.protoErrors, 1)
+	}
+	opts := srv.getOpts()
+	if acc.trackError(opts.AccountErrorThreshold, opts.AccountErrorWindow) {
+		// Lock may be held here, so send the event from a go routine.
+		go srv.accountErrorsEvent(acc, opts.AccountErrorThreshold, opts.AccountErrorWindow)
+	}
+}
+
+// reportSlowConsumer sends an event for the slow consumer with the subjects
+// of the messages pending in the given buffers.
+// Lock should be held.
+func (c *client) reportSlowConsumer(reason ClosedState, bufs [][]byte) {
+	srv := c.srv
+	if srv == nil {
+		return
+	}
+	m := &SlowConsumerEventMsg{
+		Kind:     c.typeString(),
+		CID:      c.cid,
+		Name:     c.connName(),
+		Reason:   reason.String(),
+		Pending:  int64(c.out.pb),
+		Subjects: c.pendingSubjects(bufs, slowConsumerMaxSubjects),
+	}
+	if c.acc != nil && (c.kind == CLIENT || c.kind == LEAF) {
+		m.Account = c.acc.Name
+	}
+	// Lock is held here, so send the event from a go routine.
+	go srv.slowConsumerEvent(m)
+}
+
+// pendingSubjects returns the subjects of the messages in the outbound
+// buffers, with the most pending bytes first and limited to max. The first
+// buffer may start in the middle of a message after a partial write.
+// Lock should be held.
+func (c *client) pendingSubjects(bufs [][]byte, max int) []*SlowConsumerSubject {
+	readers := make([]io.Reader, 0, len(bufs))
+	for _, b := range bufs {
+		if len(b) > 0 {
+			readers = append(readers, bytes.NewReader(b))
+		}
+	}
+	// Routes and gateways send the account before the subject.
+	withAcc := c.kind == ROUTER || c.kind == GATEWAY
+	stats := make(map[string]*SlowConsumerSubject)
+	br := bufio.NewReader(io.MultiReader(readers...))
+	for {
+		line, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Not a protocol line, skip it.
+			for err == bufio.ErrBufferFull {
+				_, err = br.ReadSlice('\n')
+			}
+			continue
+		}
+		if err != nil {
+			break
+		}
+		toks := bytes.Fields(line)
+		if len(toks) == 0 {
+			continue
+		}
+		si := 1
+		switch string(toks[0]) {
+		case "MSG", "LMSG":
+		case "RMSG":
+			si = 2
+		case "HMSG":
+			if withAcc {
+				si = 2
+			}
+		default:
+			continue
+		}
+		if len(toks) < si+2 {
+			continue
+		}
+		size, err := strconv.Atoi(string(toks[len(toks)-1]))
+		if err != nil || size < 0 {
+			continue
+		}
+		var acc string
+		if si == 2 {
+			acc = string(toks[1])
+		}
+		key := acc + " " + string(toks[si])
+		st := stats[key]
+		if st == nil {
+			st = &SlowConsumerSubject{Account: acc, Subject: string(toks[si])}
+			stats[key] = st
+		}
+		st.Msgs++
+		st.Bytes += int64(len(line) + size + LEN_CR_LF)
+		if _, err := br.Discard(size + LEN_CR_LF); err != nil {
+			break
+		}
+	}
+	subjects := make([]*SlowConsumerSubject, 0, len(stats))
+	for _, st := range stats {
+		subjects = append(subjects, st)
+	}
+	sort.Slice(subjects, func(i, j int) bool {
+		if subjects[i].Bytes != subjects[j].Bytes {
+			return subjects[i].Bytes > subjects[j].Bytes
+		}
+		return subjects[i].Subject < subjects[j].Subject
+	})
+	if len(subjects) > max {
+		subjects = subjects[:max]
+	}
+	return subjects
+}
+
 // queueOutbound queues data for a clientconnection.
 // Return if the data is referenced or not. If referenced, the caller
 // should not reuse the `data` array.
@@ -1316,19 +1964,15 @@ func (c *client) queueOutbound(data []byte) bool {
 
 	// Assume data will not be referenced
 	referenced := false
-	// Add to pending bytes total.
-	c.out.pb += int32(len(data))
-
-	// Check for slow consumer via pending bytes limit.
-	// ok to return here, client is going away.
-	if c.out.pb > c.out.mp {
-		c.clearConnection(SlowConsumerPendingBytes)
-		atomic.AddInt64(&c.srv.slowConsumers, 1)
-		c.Noticef("Slow Consumer Detected: MaxPending of %d Exceeded", c.out.mp)
+	if !c.addPending(data) {
 		return referenced
 	}
 
-	if c.out.p == nil && len(data) < maxBufSize {
+	// Connections not initialized by initClient use the defaults.
+	if c.out.mxb == 0 {
+		c.out.setOutboundOpts(&OutboundOpts{})
+	}
+	if c.out.p == nil && len(data) < int(c.out.mxb) {
 		if c.out.sz == 0 {
 			c.out.sz = startBufSize
 		}
@@ -1356,15 +2000,15 @@ func (c *client) queueOutbound(data []byte) bool {
 			c.out.p = nil
 		}
 		// Check for a big message, and if found place directly on nb
-		// FIXME(dlc) - do we need signaling of ownership here if we want len(data) < maxBufSize
-		if len(data) > maxBufSize {
+		if len(data) > int(c.out.mxb) {
 			c.out.nb = append(c.out.nb, data)
+			c.out.rfs = true
 			referenced = true
 		} else {
 			// We will copy to primary.
 			if c.out.p == nil {
 				// Grow here
-				if (c.out.sz << 1) <= maxBufSize {
+				if (c.out.sz << 1) <= c.out.mxb {
 					c.out.sz <<= 1
 				}
 				if len(data) > int(c.out.sz) {
@@ -1384,19 +2028,86 @@ func (c *client) queueOutbound(data []byte) bool {
 		c.out.p = append(c.out.p, data...)
 	}
 
-	// Check here if we should create a stall channel if we are falling behind.
-	// We do this here since if we wait for consumer's writeLoop it could be
-	// too late with large number of fan in producers.
+	c.checkStall()
+
+	return referenced
+}
+
+// queueOutboundShared queues data shared with other connections, which is
+// placed on the vectored write by reference instead of being copied. The
+// data must not be modified afterwards.
+// Lock should be held.
+func (c *client) queueOutboundShared(data []byte) {
+	if c.flags.isSet(clearConnection) || !c.addPending(data) {
+		return
+	}
+	// Queue what is in the primary, and keep appending to the rest of it.
+	if len(c.out.p) > 0 {
+		c.out.nb = append(c.out.nb, c.out.p)
+		c.out.p = c.out.p[len(c.out.p):]
+	}
+	c.out.nb = append(c.out.nb, data)
+	c.out.rfs = true
+	c.checkStall()
+}
+
+// addPending adds data to the pending bytes, returning false if this
+// exceeds the limit, in which case the client is closed as slow consumer.
+// Lock should be held.
+func (c *client) addPending(data []byte) bool {
+	// Add to pending bytes total.
+	c.out.pb += int32(len(data))
+	c.accountPending(int32(len(data)))
+
+	// Check for slow consumer via pending bytes limit.
+	// ok to return here, client is going away.
+	if c.out.pb > c.out.mp {
+		pending := append(append([][]byte(nil), c.out.nb...), c.out.p, data)
+		c.reportSlowConsumer(SlowConsumerPendingBytes, pending)
+		c.clearConnection(SlowConsumerPendingBytes)
+		atomic.AddInt64(&c.srv.slowConsumers, 1)
+		c.accountError(accErrSlowConsumer)
+		c.Noticef("Slow Consumer Detected: MaxPending of %d Exceeded", c.out.mp)
+		return false
+	}
+	return true
+}
+
+// accountPending adds n, which can be negative, to the pending bytes of all
+// connections while there is a limit and the connection is open, never
+// removing more than added for this connection.
+// Lock should be held.
+func (c *client) accountPending(n int32) {
+	srv := c.srv
+	if srv == nil {
+		return
+	}
+	if n > 0 && (c.nc == nil || atomic.LoadInt64(&srv.maxOutPending) == 0) {
+		return
+	}
+	if n < 0 && -n > c.out.gpb {
+		n = -c.out.gpb
+	}
+	if n != 0 {
+		c.out.gpb += n
+		srv.addOutPending(int64(n))
+	}
+}
+
+// checkStall creates a stall channel if we are falling behind.
+// We do this here since if we wait for consumer's writeLoop it could be
+// too late with large number of fan in producers.
+// Lock should be held.
+func (c *client) checkStall() {
 	if c.out.pb > c.out.mp/2 && c.out.stc == nil {
 		c.out.stc = make(chan struct{})
 	}
-
-	return referenced
 }
 
 // Assume the lock is held upon entry.
 func (c *client) sendProto(info []byte, doFlush bool) {
-	if c.nc == nil {
+	// MQTT and STOMP clients do not speak the NATS protocol.
+	if c.nc == nil || c.mqtt != nil || c.stomp != nil {
 		return
 	}
 	c.queueOutbound(info)
@@ -1411,6 +2122,12 @@ func (c *client) sendPong() {
 	c.sendProto([]byte("PONG\r\n"), true)
 }
 
+// Assume the lock is held upon entry.
+func (c *client) sendDrained() {
+	c.traceOutOp("DRAINED", nil)
+	c.sendProto([]byte("DRAINED\r\n"), true)
+}
+
 // Assume the lock is held upon entry.
 func (c *client) sendPing() {
 	c.rttStart = time.Now()
@@ -1499,15 +2216,59 @@ func (c *client) processPing() {
 		// to send a double INFO protocol.
 		c.flags.set(firstPongSent)
 		// If there was a cluster update since this client was created,
-		// send an updated INFO protocol now.
-		if srv.lastCURLsUpdate >= c.start.UnixNano() {
-			c.sendInfo(c.generateClientInfoJSON(srv.copyInfo()))
+		// send an updated INFO protocol now. Clients of accounts that do
+		// not advertise the cluster need it to replace the URLs that were
+		// sent in the initial INFO, before the account was known.
+		noAdvertise := c.acc != nil && c.acc.noAdvertise && len(srv.clientConnectURLsMap) > 0
+		if srv.lastCURLsUpdate >= c.start.UnixNano() || noAdvertise {
+			c.sendInfo(c.generateClientInfoJSON(srv.copyInfoForClient(c)))
 		}
 		c.mu.Unlock()
 		srv.mu.Unlock()
 	}
 }
 
+// processDrain handles the DRAIN protocol, sent by a client that intends to
+// disconnect. Its subscriptions are removed, so that no new message is
+// delivered to it and queue group members pick up the messages instead, and
+// DRAINED is sent once the messages already queued for the client, which are
+// still delivered, have been flushed.
+func (c *client) processDrain() {
+	c.mu.Lock()
+	c.traceInOp("DRAIN", nil)
+	if c.nc == nil || c.flags.isSet(drainRequested) {
+		c.mu.Unlock()
+		return
+	}
+	// Checked under the client lock on delivery, so no message can be
+	// queued after DRAINED.
+	c.flags.set(drainRequested)
+	acc, srv := c.acc, c.srv
+	subs := make([]*subscription, 0, len(c.subs))
+	for _, sub := range c.subs {
+		subs = append(subs, sub)
+	}
+	updateGWs := srv != nil && srv.gateway.enabled
+	c.mu.Unlock()
+
+	for _, sub := range subs {
+		c.unsubscribe(acc, sub, true)
+		if srv == nil || acc == nil {
+			continue
+		}
+		srv.updateRouteSubscriptionMap(acc, sub, -1)
+		if updateGWs {
+			srv.gatewayUpdateSubInterest(acc.Name, sub, -1)
+		}
+		srv.updateLeafNodes(acc, sub, -1)
+	}
+	c.Debugf("Client drain requested, removed %d subscriptions", len(subs))
+
+	c.mu.Lock()
+	c.sendDrained()
+	c.mu.Unlock()
+}
+
 func (c *client) processPong() {
 	c.traceInOp("PONG", nil)
 	c.mu.Lock()
@@ -1577,6 +2338,48 @@ func (c *client) processPub(trace bool, arg []byte) error {
 	return nil
 }
 
+// processHeaderPub processes the arguments of HPUB, which are those of PUB
+// with the size of the header block before the total size.
+func (c *client) processHeaderPub(trace bool, arg []byte) error {
+	if !c.headers {
+		c.sendErr(ErrMsgHeadersNotSupported.Error())
+		return ErrMsgHeadersNotSupported
+	}
+	if trace {
+		c.traceInOp("HPUB", arg)
+	}
+	return c.processHeaderMsgArgs(arg, func(arg []byte) error { return c.processPub(false, arg) })
+}
+
+// processHeaderMsgArgs processes the arguments of a message with headers
+// with the function processing the arguments of the message without them.
+func (c *client) processHeaderMsgArgs(arg []byte, process func([]byte) error) error {
+	targ := bytes.TrimRight(arg, " \t")
+	si := bytes.LastIndexAny(targ, " \t")
+	if si < 0 {
+		return fmt.Errorf("processHeaderMsgArgs Parse Error: '%s'", arg)
+	}
+	pre := bytes.TrimRight(targ[:si], " \t")
+	hi := bytes.LastIndexAny(pre, " \t")
+	if hi < 0 {
+		return fmt.Errorf("processHeaderMsgArgs Parse Error: '%s'", arg)
+	}
+	hdb := pre[hi+1:]
+	noHdr := append(c.noHdrBuf[:0], pre[:hi+1]...)
+	noHdr = append(noHdr, targ[si+1:]...)
+	c.noHdrBuf = noHdr
+	if err := process(noHdr); err != nil {
+		return err
+	}
+	c.pa.arg = arg
+	c.pa.hdb = hdb
+	c.pa.hdr = parseSize(hdb)
+	if c.pa.hdr <= 0 || c.pa.hdr > c.pa.size {
+		return fmt.Errorf("processHeaderMsgArgs Bad or Missing Header Size: '%s'", arg)
+	}
+	return nil
+}
+
 func splitArg(arg []byte) [][]byte {
 	a := [MAX_MSG_ARGS][]byte{}
 	args := a[:0]
@@ -1600,7 +2403,16 @@ func splitArg(arg []byte) [][]byte {
 	return args
 }
 
-func (c *client) processSub(argo []byte) (err error) {
+func (c *client) processSub(argo []byte) error {
+	_, err := c.processSubEx(argo, nil)
+	return err
+}
+
+// processSubEx is processSub with an optional callback, used by internal
+// clients to have messages handed to them instead of being queued. The
+// callback is set before the subscription is registered. Returns the
+// subscription.
+func (c *client) processSubEx(argo []byte, icb msgHandler) (_ *subscription, err error) {
 	c.traceInOp("SUB", argo)
 
 	// Indicate activity.
@@ -1612,6 +2424,22 @@ func (c *client) processSub(argo []byte) (err error) {
 	copy(arg, argo)
 	args := splitArg(arg)
 	sub := &subscription{client: c}
+	var rl *subRateLimit
+	// Clients can request a maximum delivery rate, or the weight of a queue
+	// subscription, after the sid.
+	if c.kind == CLIENT {
+		if args, rl, sub.qw, err = parseSubOptions(args); err != nil {
+			c.sendErr("Invalid Subscription Option")
+			return nil, nil
+		}
+		if sub.qw > 0 && len(args) != 3 {
+			c.sendErr("Invalid Subscription Weight Without Queue")
+			return nil, nil
+		}
+	}
+	if icb != nil || rl != nil {
+		sub.ext = &subExtra{icb: icb, rl: rl}
+	}
 	switch len(args) {
 	case 2:
 		sub.subject = args[0]
@@ -1622,7 +2450,7 @@ func (c *client) processSub(argo []byte) (err error) {
 		sub.queue = args[1]
 		sub.sid = args[2]
 	default:
-		return fmt.Errorf("processSub Parse Error: '%s'", arg)
+		return nil, fmt.Errorf("processSub Parse Error: '%s'", arg)
 	}
 
 	c.mu.Lock()
@@ -1636,23 +2464,45 @@ func (c *client) processSub(argo []byte) (err error) {
 
 	if c.nc == nil && kind != SYSTEM {
 		c.mu.Unlock()
-		return nil
+		return nil, nil
+	}
+
+	// A draining client does not get new messages.
+	if c.flags.isSet(drainRequested) {
+		c.mu.Unlock()
+		c.sendErr("Invalid Subscription While Draining")
+		return nil, nil
 	}
 
 	// Check permissions if applicable.
 	if kind == CLIENT && !c.canSubscribe(string(sub.subject)) {
 		c.mu.Unlock()
+		c.accountError(accErrPermViolation)
 		c.sendErr(fmt.Sprintf("Permissions Violation for Subscription to %q", sub.subject))
-		c.Errorf("Subscription Violation - %s, Subject %q, SID %s",
-			c.getAuthUser(), sub.subject, sub.sid)
-		return nil
+		c.logf(srvlog.LevelError, []interface{}{"subject", string(sub.subject)},
+			"Subscription Violation - %s, Subject %q, SID %s", c.getAuthUser(), sub.subject, sub.sid)
+		return nil, nil
 	}
 
 	// Check if we have a maximum on the number of subscriptions.
 	if c.subsAtLimit() {
 		c.mu.Unlock()
-		c.maxSubsExceeded()
-		return nil
+		c.maxSubsExceeded(sub.subject)
+		return nil, nil
+	}
+
+	// Share the subject with the subscriptions already on it, the queue and
+	// sid being copied so that the copy of the arguments is not held.
+	if acc != nil && acc.sl != nil && c.subs[sid] == nil {
+		if subject := acc.sl.sharedSubject(sub.subject); subject != nil {
+			buf := make([]byte, 0, len(sub.queue)+len(sub.sid))
+			buf = append(append(buf, sub.queue...), sub.sid...)
+			if sub.queue != nil {
+				sub.queue = buf[:len(sub.queue):len(sub.queue)]
+			}
+			sub.sid = buf[len(sub.queue):]
+			sub.subject = subject
+		}
 	}
 
 	updateGWs := false
@@ -1674,14 +2524,14 @@ func (c *client) processSub(argo []byte) (err error) {
 
 	if err != nil {
 		c.sendErr("Invalid Subject")
-		return nil
+		return nil, nil
 	} else if c.opts.Verbose && kind != SYSTEM {
 		c.sendOK()
 	}
 
 	// No account just return.
 	if acc == nil {
-		return nil
+		return sub, nil
 	}
 
 	if err := c.addShadowSubscriptions(acc, sub); err != nil {
@@ -1696,7 +2546,7 @@ func (c *client) processSub(argo []byte) (err error) {
 	}
 	// Now check on leafnode updates.
 	srv.updateLeafNodes(acc, sub, 1)
-	return nil
+	return sub, nil
 }
 
 // If the client's account has stream imports and there are matches for
@@ -1797,7 +2647,10 @@ func (c *client) addShadowSubscriptions(acc *Account, sub *subscription) error {
 // Add in the shadow subscription.
 func (c *client) addShadowSub(sub *subscription, im *streamImport, useFrom bool) (*subscription, error) {
 	nsub := *sub // copy
-	nsub.im = im
+	nsub.ext = &subExtra{im: im}
+	if sub.ext != nil {
+		nsub.ext.icb, nsub.ext.rl = sub.ext.icb, sub.ext.rl
+	}
 	if useFrom {
 		nsub.subject = []byte(im.from)
 	} else if im.prefix != "" {
@@ -1887,13 +2740,14 @@ func (c *client) unsubscribe(acc *Account, sub *subscription, force bool) {
 	c.mu.Unlock()
 
 	for _, nsub := range shadowSubs {
-		if err := nsub.im.acc.sl.Remove(nsub); err != nil {
-			c.Debugf("Could not remove shadow import subscription for account %q", nsub.im.acc.Name)
+		im := nsub.streamImport()
+		if err := im.acc.sl.Remove(nsub); err != nil {
+			c.Debugf("Could not remove shadow import subscription for account %q", im.acc.Name)
 		} else if updateRoute {
-			c.srv.updateRouteSubscriptionMap(nsub.im.acc, nsub, -1)
+			c.srv.updateRouteSubscriptionMap(im.acc, nsub, -1)
 		}
 		// Now check on leafnode updates.
-		c.srv.updateLeafNodes(nsub.im.acc, nsub, -1)
+		c.srv.updateLeafNodes(im.acc, nsub, -1)
 	}
 }
 
@@ -1977,7 +2831,18 @@ func (c *client) checkDenySub(subject string) bool {
 	return false
 }
 
+// msgHeader builds the protocol line for delivering a message to sub. The
+// header in mh starts with a spare byte ahead of "MSG " that is set to 'H'
+// for clients receiving headers and skipped otherwise, so the line is built
+// in place without allocating.
 func (c *client) msgHeader(mh []byte, sub *subscription, reply []byte) []byte {
+	// Clients that support headers get them apart from the payload.
+	hdr := c.pa.hdr > 0 && sub.client != nil && sub.client.headers
+	if hdr {
+		mh[0] = 'H'
+	} else {
+		mh = mh[1:]
+	}
 	if len(sub.sid) > 0 {
 		mh = append(mh, sub.sid...)
 		mh = append(mh, ' ')
@@ -1986,11 +2851,26 @@ func (c *client) msgHeader(mh []byte, sub *subscription, reply []byte) []byte {
 		mh = append(mh, reply...)
 		mh = append(mh, ' ')
 	}
-	mh = append(mh, c.pa.szb...)
+	if hdr {
+		mh = append(mh, c.pa.hdb...)
+		mh = append(mh, ' ')
+		mh = append(mh, c.pa.szb...)
+	} else {
+		mh = c.appendPayloadSize(mh)
+	}
 	mh = append(mh, _CRLF_...)
 	return mh
 }
 
+// Appends the size of the message without its header block, which is
+// what the connections that do not support headers get.
+func (c *client) appendPayloadSize(mh []byte) []byte {
+	if c.pa.hdr > 0 {
+		return strconv.AppendInt(mh, int64(c.pa.size-c.pa.hdr), 10)
+	}
+	return append(mh, c.pa.szb...)
+}
+
 func (c *client) stalledWait(producer *client) {
 	stall := c.out.stc
 	c.mu.Unlock()
@@ -2022,6 +2902,12 @@ func (c *client) deliverMsg(sub *subscription, mh, msg []byte) bool {
 		return false
 	}
 
+	// The client asked to be drained, queue subscribers pick another member.
+	if client.flags.isSet(drainRequested) {
+		client.mu.Unlock()
+		return false
+	}
+
 	// Check if we have a subscribe deny clause. This will trigger us to check the subject
 	// for a match against the denied subjects.
 	if client.mperms != nil && client.checkDenySub(string(c.pa.subject)) {
@@ -2031,6 +2917,13 @@ func (c *client) deliverMsg(sub *subscription, mh, msg []byte) bool {
 
 	srv := client.srv
 
+	// Connections that do not support headers only get the payload, the
+	// header block is given apart to the internal subscriptions.
+	var hdr []byte
+	if c.pa.hdr > 0 && !client.headers {
+		hdr, msg = msg[:c.pa.hdr], msg[c.pa.hdr:]
+	}
+
 	sub.nm++
 	// Check if we should auto-unsubscribe.
 	if sub.max > 0 {
@@ -2064,6 +2957,15 @@ func (c *client) deliverMsg(sub *subscription, mh, msg []byte) bool {
 		}
 	}
 
+	// Check the rate requested for the subscription, the message may be
+	// held to be delivered later, or dropped.
+	if sub.ext != nil && sub.ext.rl != nil {
+		if deliver, held := client.paceMsg(sub, mh, msg); !deliver {
+			client.mu.Unlock()
+			return held
+		}
+	}
+
 	// Update statistics
 
 	// The msg includes the CR_LF, so pull back out for accounting.
@@ -2076,15 +2978,39 @@ func (c *client) deliverMsg(sub *subscription, mh, msg []byte) bool {
 
 	atomic.AddInt64(&srv.outMsgs, 1)
 	atomic.AddInt64(&srv.outBytes, msgSize)
+	if acc := client.acc; acc != nil && (client.kind == CLIENT || client.kind == LEAF) {
+		atomic.AddInt64(&acc.outMsgs, 1)
+		atomic.AddInt64(&acc.outBytes, msgSize)
+	}
+
+	if c.pa.mt != nil {
+		c.pa.mt.delivered(client, sub, c.pa.deliver)
+	}
 
 	// Check for internal subscription.
 	if client.kind == SYSTEM {
 		s := client.srv
 		client.mu.Unlock()
-		s.deliverInternalMsg(sub, c.pa.subject, c.pa.reply, msg[:msgSize])
+		if icb := sub.callback(); icb != nil {
+			subject := c.pa.subject
+			if len(c.pa.deliver) > 0 {
+				subject = c.pa.deliver
+			}
+			icb(sub, string(subject), string(c.pa.reply), hdr, msg[:msgSize])
+		} else {
+			s.deliverInternalMsg(sub, c.pa.subject, c.pa.reply, hdr, msg[:msgSize])
+		}
 		return true
 	}
 
+	if c.pa.trace != nil && client.kind == CLIENT {
+		subject := c.pa.subject
+		if len(c.pa.deliver) > 0 {
+			subject = c.pa.deliver
+		}
+		srv.otel.delivered(c.pa.trace, client, subject)
+	}
+
 	// If we are a client and we detect that the consumer we are
 	// sending to is in a stalled state, go ahead and wait here
 	// with a limit.
@@ -2099,8 +3025,21 @@ func (c *client) deliverMsg(sub *subscription, mh, msg []byte) bool {
 	}
 
 	// Queue to outbound buffer
-	client.queueOutbound(mh)
-	client.queueOutbound(msg)
+	if client.stomp != nil {
+		// STOMP clients get the message in a MESSAGE frame.
+		subject := c.pa.subject
+		if len(c.pa.deliver) > 0 {
+			subject = c.pa.deliver
+		}
+		client.stompQueueMessage(sub, subject, c.pa.reply, msg[:msgSize])
+	} else if shm := c.in.shm; len(shm) > 0 && len(msg) > 0 && len(msg) <= len(shm) && &msg[len(msg)-1] == &shm[len(shm)-1] {
+		// The payload may be shared without its header block.
+		client.queueOutbound(mh)
+		client.queueOutboundShared(msg)
+	} else {
+		client.queueOutbound(mh)
+		client.queueOutbound(msg)
+	}
 
 	client.out.pm++
 
@@ -2213,6 +3152,51 @@ func (c *client) newServiceReply() []byte {
 	return b[:]
 }
 
+// Prefix of the reply subjects used by the client libraries for requests.
+const replyCacheInbox = "_INBOX."
+
+// replyCachePrefix returns the subject up to and including its last token
+// separator if this is an inbox subject, nil otherwise.
+func replyCachePrefix(subject []byte) []byte {
+	if len(subject) <= len(replyCacheInbox) || string(subject[:len(replyCacheInbox)]) != replyCacheInbox {
+		return nil
+	}
+	return subject[:bytes.LastIndexByte(subject, btsep)+1]
+}
+
+// matchReply returns the subscriptions matching the inbox subject being
+// processed. The result is cached for the inbox prefix, and so shared by
+// all the replies to this inbox, when it does not depend on the last token
+// of the subject, which is the case unless there are literal subscriptions
+// at that level, e.g. from the old style requests.
+// Lock should not be held.
+func (c *client) matchReply(prefix []byte) *SublistResult {
+	if r, ok := c.in.replies[string(prefix)]; ok {
+		atomic.AddUint64(&c.rhits, 1)
+		return r
+	}
+	atomic.AddUint64(&c.rmisses, 1)
+	subject := string(c.pa.subject)
+	r, shared := c.acc.sl.matchReply(subject)
+	if !shared {
+		return r
+	}
+	if c.in.replies == nil {
+		c.in.replies = make(map[string]*SublistResult)
+	} else if len(c.in.replies) >= maxResultCacheSize {
+		// Prune the cache. Random delete.
+		n := 0
+		for prefix := range c.in.replies {
+			delete(c.in.replies, prefix)
+			if n++; n > pruneSize {
+				break
+			}
+		}
+	}
+	c.in.replies[string(prefix)] = r
+	return r
+}
+
 // Test whether a reply subject is a service import reply.
 func isServiceReply(reply []byte) bool {
 	return len(reply) > 3 && string(reply[:4]) == replyPrefix
@@ -2220,6 +3204,14 @@ func isServiceReply(reply []byte) bool {
 
 // This will decide to call the client code or router code.
 func (c *client) processInboundMsg(msg []byte) {
+	var ot *otelExporter
+	if c.pa.hdr > 0 && c.srv != nil && c.srv.otel != nil {
+		ot = c.srv.otel
+		c.pa.trace = ot.startSpan(c, msg[:c.pa.hdr])
+	}
+	if c.pa.hdr > 0 && c.srv != nil && c.srv.mtrace != nil {
+		c.pa.mt = c.srv.startMsgTrace(c, msg[:c.pa.hdr])
+	}
 	switch c.kind {
 	case CLIENT:
 		c.processInboundClientMsg(msg)
@@ -2230,6 +3222,51 @@ func (c *client) processInboundMsg(msg []byte) {
 	case LEAF:
 		c.processInboundLeafMsg(msg)
 	}
+	if c.pa.trace != nil {
+		ot.endSpan(c.pa.trace)
+		c.pa.trace = nil
+	}
+	if c.pa.mt != nil {
+		c.srv.sendMsgTrace(c.pa.mt)
+		c.pa.mt = nil
+	}
+}
+
+// publishInternal publishes a message, with the headers if any, from an
+// internal client, e.g. of a bridge, and flushes the clients it was
+// delivered to. Lock should not be held.
+func (c *client) publishInternal(subject, reply string, hdr, msg []byte) {
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+	c.processPublish(subject, _EMPTY_, reply, hdr, msg)
+	c.flushClients(0)
+}
+
+// processPublish sets up the arguments of a message not received through
+// the protocol parser and processes it. The clients it was delivered to
+// are not flushed.
+func (c *client) processPublish(subject, deliver, reply string, hdr, msg []byte) {
+	c.pa.subject = []byte(subject)
+	c.pa.deliver, c.pa.reply = nil, nil
+	if deliver != _EMPTY_ {
+		c.pa.deliver = []byte(deliver)
+	}
+	if reply != _EMPTY_ {
+		c.pa.reply = []byte(reply)
+	}
+	c.pa.size = len(hdr) + len(msg)
+	c.pa.szb = []byte(strconv.Itoa(c.pa.size))
+	c.pa.hdr, c.pa.hdb = 0, nil
+	if len(hdr) > 0 {
+		c.pa.hdr = len(hdr)
+		c.pa.hdb = []byte(strconv.Itoa(c.pa.hdr))
+	}
+	m := make([]byte, 0, c.pa.size+LEN_CR_LF)
+	m = append(m, hdr...)
+	m = append(m, msg...)
+	m = append(m, _CRLF_...)
+	c.processInboundClientMsg(m)
+	c.pa.subject, c.pa.deliver, c.pa.reply, c.pa.szb, c.pa.hdb = nil, nil, nil, nil, nil
 }
 
 // processInboundClientMsg is called to process an inbound msg from a client.
@@ -2275,9 +3312,18 @@ func (c *client) processInboundClientMsg(msg []byte) {
 	} else {
 		// Reset our L1 completely.
 		c.in.results = make(map[string]*SublistResult)
+		c.in.replies = nil
 		c.in.genid = genid
 	}
 
+	// Reply subjects are unique per request, so rather than filling the L1
+	// with them, look them up by their inbox prefix.
+	if !ok {
+		if prefix := replyCachePrefix(c.pa.subject); prefix != nil {
+			r, ok = c.matchReply(prefix), true
+		}
+	}
+
 	// Go back to the sublist data structure.
 	if !ok {
 		r = c.acc.sl.Match(string(c.pa.subject))
@@ -2354,6 +3400,9 @@ func (c *client) checkForImportServices(acc *Account, msg []byte) {
 		}
 		// FIXME(dlc) - Do L1 cache trick from above.
 		rr := rm.acc.sl.Match(rm.to)
+		if c.pa.mt != nil {
+			defer c.pa.mt.serviceImport(rm.acc, rm.from, rm.to)()
+		}
 
 		// If we are a route or gateway or leafnode and this message is flipped to a queue subscriber we
 		// need to handle that since the processMsgResults will want a queue filter.
@@ -2372,6 +3421,68 @@ func (c *client) checkForImportServices(acc *Account, msg []byte) {
 	}
 }
 
+// stickyKey returns the part of the subject that selects the member of a
+// sticky queue group, the given token, starting at 1, or the whole subject
+// for 0 or if the subject does not have that many tokens.
+func stickyKey(subject []byte, tok int) []byte {
+	if tok <= 0 {
+		return subject
+	}
+	start := 0
+	for i := 0; i < len(subject); i++ {
+		if subject[i] == btsep {
+			if tok--; tok == 0 {
+				return subject[start:i]
+			}
+			start = i + 1
+		}
+	}
+	if tok == 1 {
+		return subject[start:]
+	}
+	return subject
+}
+
+// stickyQSubIndex returns the index of the member of the queue group the
+// key maps to. This uses rendezvous hashing, so that the same member is
+// selected regardless of the order of the members, and that only the keys
+// of a member that goes away are moved to other members. When the message
+// comes from a route or leaf node, only local members are considered.
+func stickyQSubIndex(qsubs []*subscription, key []byte, localOnly bool) int {
+	const prime64 = 1099511628211
+	kh := uint64(14695981039346656037)
+	for _, b := range key {
+		kh ^= uint64(b)
+		kh *= prime64
+	}
+	index, max := 0, uint64(0)
+	for i, sub := range qsubs {
+		if sub == nil {
+			continue
+		}
+		if localOnly && (sub.client.kind == ROUTER || sub.client.kind == LEAF) {
+			continue
+		}
+		h := kh
+		for cid := sub.client.cid; cid > 0; cid >>= 8 {
+			h ^= cid & 0xff
+			h *= prime64
+		}
+		for _, b := range sub.sid {
+			h ^= uint64(b)
+			h *= prime64
+		}
+		// Final mix so that the highest hash is evenly distributed.
+		h ^= h >> 33
+		h *= 0xff51afd7ed558ccd
+		h ^= h >> 33
+		if h >= max {
+			index, max = i, h
+		}
+	}
+	return index
+}
+
 func (c *client) addSubToRouteTargets(sub *subscription) {
 	if c.in.rts == nil {
 		c.in.rts = make([]routeTarget, 0, routeTargetInit)
@@ -2410,9 +3521,16 @@ func (c *client) addSubToRouteTargets(sub *subscription) {
 // This processes the sublist results for a given message.
 func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, subject, reply []byte, flags int) [][]byte {
 	var queues [][]byte
-	// msg header for clients.
-	msgh := c.msgb[1:msgHeadProtoLen]
-	msgh = append(msgh, subject...)
+	var preferLocal bool
+	// msg header for clients, see msgHeader for the use of the first byte.
+	msgh := c.msgb[:msgHeadProtoLen]
+	if len(c.pa.deliver) > 0 {
+		// Messages delivered from streams are presented to local
+		// subscribers with the subject they were stored under.
+		msgh = append(msgh, c.pa.deliver...)
+	} else {
+		msgh = append(msgh, subject...)
+	}
 	msgh = append(msgh, ' ')
 	si := len(msgh)
 
@@ -2422,6 +3540,17 @@ func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, subject,
 		c.in.rts = c.in.rts[:0]
 	}
 
+	// With a large fan-out, the payload is copied once for the subscribers
+	// to share it.
+	pmsg := msg
+	if len(r.psubs) >= fanoutShareMin && len(msg) >= sharedPayloadMin {
+		pmsg = append([]byte(nil), msg...)
+		c.in.shm = pmsg
+	}
+	// The header is only built again for a different sid or format.
+	var mh, lsid []byte
+	var lhdr bool
+
 	// Loop over all normal subscriptions that match.
 	for _, sub := range r.psubs {
 		// Check if this is a send to a ROUTER. We now process
@@ -2447,18 +3576,24 @@ func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, subject,
 			continue
 		}
 		// Check for stream import mapped subs. These apply to local subs only.
-		if sub.im != nil && sub.im.prefix != "" {
+		if im := sub.streamImport(); im != nil && im.prefix != "" {
 			// Redo the subject here on the fly.
-			msgh = c.msgb[1:msgHeadProtoLen]
-			msgh = append(msgh, sub.im.prefix...)
+			msgh = c.msgb[:msgHeadProtoLen]
+			msgh = append(msgh, im.prefix...)
 			msgh = append(msgh, subject...)
 			msgh = append(msgh, ' ')
 			si = len(msgh)
+			mh = nil
 		}
 		// Normal delivery
-		mh := c.msgHeader(msgh[:si], sub, reply)
-		c.deliverMsg(sub, mh, msg)
+		hdr := c.pa.hdr > 0 && sub.client.headers
+		if mh == nil || hdr != lhdr || !bytes.Equal(sub.sid, lsid) {
+			mh = c.msgHeader(msgh[:si], sub, reply)
+			lsid, lhdr = sub.sid, hdr
+		}
+		c.deliverMsg(sub, mh, pmsg)
 	}
+	c.in.shm = nil
 
 	// Set these up to optionally filter based on the queue lists.
 	// This is for messages received from routes which will have directed
@@ -2483,6 +3618,11 @@ func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, subject,
 		c.in.prand = rand.New(rand.NewSource(time.Now().UnixNano()))
 	}
 
+	// The account may prefer queue subscribers of this server, in which
+	// case remote ones are only used when no local one can take the message.
+	// This is set from the configuration and never updated in place.
+	preferLocal = acc != nil && acc.queueLocal
+
 	// Process queue subs
 	for i := 0; i < len(r.qsubs); i++ {
 		qsubs := r.qsubs[i]
@@ -2506,8 +3646,15 @@ func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, subject,
 		var rsub *subscription
 
 		// Find a subscription that is able to deliver this message
-		// starting at a random index.
-		startIndex := c.in.prand.Intn(len(qsubs))
+		// starting at a random index, or for sticky groups at the member
+		// the subject maps to.
+		var startIndex int
+		tok, sticky := acc.stickyQueue(qsubs)
+		if sticky {
+			startIndex = stickyQSubIndex(qsubs, stickyKey(subject, tok), c.kind == ROUTER || c.kind == LEAF)
+		} else {
+			startIndex = c.in.prand.Intn(len(qsubs))
+		}
 		for i := 0; i < len(qsubs); i++ {
 			index := (startIndex + i) % len(qsubs)
 			sub := qsubs[index]
@@ -2517,7 +3664,7 @@ func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, subject,
 			kind := sub.client.kind
 			// Potentially sending to a remote sub across a route or leaf node.
 			if kind == ROUTER || kind == LEAF {
-				if c.kind == ROUTER || c.kind == LEAF || (c.kind == CLIENT && kind == LEAF) {
+				if (preferLocal && !sticky) || c.kind == ROUTER || c.kind == LEAF || (c.kind == CLIENT && kind == LEAF) {
 					// We just came from a route/leaf, so skip and prefer local subs.
 					// Keep our first rsub in case all else fails.
 					if rsub == nil {
@@ -2534,10 +3681,10 @@ func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, subject,
 			}
 
 			// Check for mapped subs
-			if sub.im != nil && sub.im.prefix != "" {
+			if im := sub.streamImport(); im != nil && im.prefix != "" {
 				// Redo the subject here on the fly.
-				msgh = c.msgb[1:msgHeadProtoLen]
-				msgh = append(msgh, sub.im.prefix...)
+				msgh = c.msgb[:msgHeadProtoLen]
+				msgh = append(msgh, im.prefix...)
 				msgh = append(msgh, subject...)
 				msgh = append(msgh, ' ')
 				si = len(msgh)
@@ -2576,6 +3723,7 @@ sendToRoutesOrLeafs:
 	for i := range c.in.rts {
 		rt := &c.in.rts[i]
 		kind := rt.sub.client.kind
+		hdr := c.pa.hdr > 0 && rt.sub.client.headers
 		mh := c.msgb[:msgHeadProtoLen]
 		if kind == ROUTER {
 			// Router (and Gateway) nodes are RMSG. Set here since leafnodes may rewrite.
@@ -2586,8 +3734,8 @@ sendToRoutesOrLeafs:
 			// Leaf nodes are LMSG
 			mh[0] = 'L'
 			// Remap subject if its a shadow subscription, treat like a normal client.
-			if rt.sub.im != nil && rt.sub.im.prefix != "" {
-				mh = append(mh, rt.sub.im.prefix...)
+			if im := rt.sub.streamImport(); im != nil && im.prefix != "" {
+				mh = append(mh, im.prefix...)
 			}
 		}
 		mh = append(mh, subject...)
@@ -2606,7 +3754,15 @@ sendToRoutesOrLeafs:
 			mh = append(mh, reply...)
 			mh = append(mh, ' ')
 		}
-		mh = append(mh, c.pa.szb...)
+		if hdr {
+			// Routes and leaf nodes that support headers get HMSG.
+			mh[0] = 'H'
+			mh = append(mh, c.pa.hdb...)
+			mh = append(mh, ' ')
+			mh = append(mh, c.pa.szb...)
+		} else {
+			mh = c.appendPayloadSize(mh)
+		}
 		mh = append(mh, _CRLF_...)
 		c.deliverMsg(rt.sub, mh, msg)
 	}
@@ -2614,13 +3770,17 @@ sendToRoutesOrLeafs:
 }
 
 func (c *client) pubPermissionViolation(subject []byte) {
+	c.accountError(accErrPermViolation)
 	c.sendErr(fmt.Sprintf("Permissions Violation for Publish to %q", subject))
-	c.Errorf("Publish Violation - %s, Subject %q", c.getAuthUser(), subject)
+	c.logf(srvlog.LevelError, []interface{}{"subject", string(subject)},
+		"Publish Violation - %s, Subject %q", c.getAuthUser(), subject)
 }
 
 func (c *client) replySubjectViolation(reply []byte) {
+	c.accountError(accErrPermViolation)
 	c.sendErr(fmt.Sprintf("Permissions Violation for Publish with Reply of %q", reply))
-	c.Errorf("Publish Violation - %s, Reply %q", c.getAuthUser(), reply)
+	c.logf(srvlog.LevelError, []interface{}{"reply", string(reply)},
+		"Publish Violation - %s, Reply %q", c.getAuthUser(), reply)
 }
 
 func (c *client) processPingTimer() {
@@ -2636,11 +3796,12 @@ func (c *client) processPingTimer() {
 
 	// If we have had activity within the PingInterval no
 	// need to send a ping.
-	if delta := time.Since(c.last); delta < c.srv.getOpts().PingInterval {
+	pingInterval, maxPingsOut := c.pingSettings()
+	if delta := time.Since(c.last); delta < pingInterval {
 		c.Debugf("Delaying PING due to activity %v ago", delta.Round(time.Second))
 	} else {
 		// Check for violation
-		if c.ping.out+1 > c.srv.getOpts().MaxPingsOut {
+		if c.ping.out+1 > maxPingsOut {
 			c.Debugf("Stale Client Connection - Closing")
 			c.sendProto([]byte(fmt.Sprintf("-ERR '%s'\r\n", "Stale Connection")), true)
 			c.clearConnection(StaleConnection)
@@ -2659,10 +3820,40 @@ func (c *client) setPingTimer() {
 	if c.srv == nil {
 		return
 	}
-	d := c.srv.getOpts().PingInterval
+	d, _ := c.pingSettings()
 	c.ping.tmr = time.AfterFunc(d, c.processPingTimer)
 }
 
+// Returns the ping interval and maximum outstanding pings for this
+// connection, which can be set per connection type, and per account for
+// clients, otherwise the server wide values are used.
+// Lock should be held
+func (c *client) pingSettings() (time.Duration, int) {
+	opts := c.srv.getOpts()
+	d, max := opts.PingInterval, opts.MaxPingsOut
+	var od time.Duration
+	var omax int
+	switch c.kind {
+	case CLIENT:
+		if acc := c.acc; acc != nil {
+			acc.mu.RLock()
+			od, omax = acc.pingInterval, acc.maxPingsOut
+			acc.mu.RUnlock()
+		}
+	case ROUTER:
+		od, omax = opts.Cluster.PingInterval, opts.Cluster.MaxPingsOut
+	case LEAF:
+		od, omax = opts.LeafNode.PingInterval, opts.LeafNode.MaxPingsOut
+	}
+	if od > 0 {
+		d = od
+	}
+	if omax > 0 {
+		max = omax
+	}
+	return d, max
+}
+
 // Lock should be held
 func (c *client) clearPingTimer() {
 	if c.ping.tmr == nil {
@@ -2672,6 +3863,52 @@ func (c *client) clearPingTimer() {
 	c.ping.tmr = nil
 }
 
+func (c *client) processIdleTimer() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.itmr = nil
+	// Check if connection is still opened
+	if c.nc == nil {
+		return
+	}
+	d := c.srv.getOpts().IdleTimeout
+	if d <= 0 {
+		return
+	}
+	if time.Since(c.last) < d {
+		c.setIdleTimer(d)
+		return
+	}
+	c.Debugf("Idle Client Connection - Closing")
+	c.sendProto([]byte(fmt.Sprintf("-ERR '%s'\r\n", "Idle Timeout")), true)
+	c.clearConnection(IdleTimeout)
+}
+
+// setIdleTimer sets the timer to fire when the connection will have been
+// idle for the given duration, unless there is activity in the meantime.
+// Lock should be held
+func (c *client) setIdleTimer(d time.Duration) {
+	c.clearIdleTimer()
+	if d <= 0 {
+		return
+	}
+	if delta := time.Since(c.last); delta < d {
+		d -= delta
+	} else {
+		d = 0
+	}
+	c.itmr = time.AfterFunc(d, c.processIdleTimer)
+}
+
+// Lock should be held
+func (c *client) clearIdleTimer() {
+	if c.itmr == nil {
+		return
+	}
+	c.itmr.Stop()
+	c.itmr = nil
+}
+
 // Lock should be held
 func (c *client) setAuthTimer(d time.Duration) {
 	c.atmr = time.AfterFunc(d, c.authTimeout)
@@ -2735,16 +3972,46 @@ func (c *client) clearConnection(reason ClosedState) {
 	if c.flags.isSet(handshakeComplete) {
 		nc.SetWriteDeadline(time.Now().Add(c.out.wdl))
 	}
+	// The socket can be reused by another connection once closed.
+	polled := c.flags.isSet(readPolled) && srv.poller.remove(c)
 	nc.Close()
 	// Do this always to also kick out any IO writes.
 	nc.SetWriteDeadline(time.Time{})
 
+	// There is no readLoop to notice that the connection is closed, so
+	// finish closing it from here, which does nothing when already closing.
+	if polled {
+		go c.closeConnection(reason)
+	}
+
 	// Save off the connection if its a client or leafnode.
 	if c.kind == CLIENT || c.kind == LEAF {
 		go srv.saveClosedClient(c, nc, reason)
 	}
 }
 
+// Returns the name of the client, or of the remote server or gateway.
+// Lock should be held.
+func (c *client) connName() string {
+	switch c.kind {
+	case CLIENT:
+		return c.opts.Name
+	case ROUTER:
+		if c.route != nil {
+			return c.route.remoteID
+		}
+	case GATEWAY:
+		if c.gw != nil {
+			return c.gw.name
+		}
+	case LEAF:
+		if c.leaf != nil {
+			return c.leaf.remoteServer
+		}
+	}
+	return _EMPTY_
+}
+
 func (c *client) typeString() string {
 	switch c.kind {
 	case CLIENT:
@@ -2808,7 +4075,7 @@ func (c *client) processSubsOnConfigReload(awcsti map[string]struct{}) {
 		c.mu.Unlock()
 		c.addShadowSubscriptions(acc, sub)
 		for _, nsub := range oldShadows {
-			nsub.im.acc.sl.Remove(nsub)
+			nsub.streamImport().acc.sl.Remove(nsub)
 		}
 	}
 
@@ -2845,8 +4112,12 @@ func (c *client) closeConnection(reason ClosedState) {
 
 	c.clearAuthTimer()
 	c.clearPingTimer()
+	c.clearIdleTimer()
+	c.clearLeafCredsTimer()
 	c.clearConnection(reason)
 	c.nc = nil
+	// What is left will not be written.
+	c.accountPending(-c.out.gpb)
 
 	var (
 		retryImplicit bool
@@ -2907,6 +4178,14 @@ func (c *client) closeConnection(reason ClosedState) {
 		// Unregister
 		srv.removeClient(c)
 
+		if kind == ROUTER || kind == LEAF {
+			srv.remoteDisconnectEvent(c, reason)
+		}
+
+		if c.mqtt != nil {
+			srv.mqttClosed(c)
+		}
+
 		// Update remote subscriptions.
 		if acc != nil && (kind == CLIENT || kind == LEAF) {
 			qsubs := map[string]*qsub{}
@@ -2947,6 +4226,22 @@ func (c *client) closeConnection(reason ClosedState) {
 		return
 	}
 
+	// Pooled route connections are reconnected as long as the
+	// primary connection to that server is up.
+	if c.isSolicitedPooledRoute() {
+		c.mu.Lock()
+		rid, rurl := c.route.remoteID, c.route.url
+		poolIdx, accName := c.route.poolIdx, c.route.accName
+		c.mu.Unlock()
+		srv.mu.Lock()
+		if srv.running && srv.remotes[rid] != nil {
+			delay := DEFAULT_ROUTE_RECONNECT + time.Duration(rand.Intn(100))*time.Millisecond
+			srv.startGoRoutine(func() { srv.connectToPooledRoute(rurl, rid, poolIdx, accName, delay) })
+		}
+		srv.mu.Unlock()
+		return
+	}
+
 	// Check for a solicited route. If it was, start up a reconnect unless
 	// we are already connected to the other end.
 	if c.isSolicitedRoute() || retryImplicit {
@@ -3091,26 +4386,47 @@ func (c *client) getAuthUser() string {
 // Logging functionality scoped to a client or route.
 
 func (c *client) Errorf(format string, v ...interface{}) {
-	format = fmt.Sprintf("%s - %s", c, format)
-	c.srv.Errorf(format, v...)
+	c.logf(srvlog.LevelError, nil, format, v...)
 }
 
 func (c *client) Debugf(format string, v ...interface{}) {
-	format = fmt.Sprintf("%s - %s", c, format)
-	c.srv.Debugf(format, v...)
+	c.logf(srvlog.LevelDebug, nil, format, v...)
 }
 
 func (c *client) Noticef(format string, v ...interface{}) {
-	format = fmt.Sprintf("%s - %s", c, format)
-	c.srv.Noticef(format, v...)
+	c.logf(srvlog.LevelInfo, nil, format, v...)
 }
 
 func (c *client) Tracef(format string, v ...interface{}) {
-	format = fmt.Sprintf("%s - %s", c, format)
-	c.srv.Tracef(format, v...)
+	c.logf(srvlog.LevelTrace, nil, format, v...)
 }
 
 func (c *client) Warnf(format string, v ...interface{}) {
-	format = fmt.Sprintf("%s - %s", c, format)
-	c.srv.Warnf(format, v...)
+	c.logf(srvlog.LevelWarn, nil, format, v...)
+}
+
+// Logs the statement prefixed with the connection, or with the connection
+// and the given fields if the logger supports structured fields.
+func (c *client) logf(level srvlog.Level, fields []interface{}, format string, v ...interface{}) {
+	cf := []interface{}{"client_id", c.cid, "conn_type", c.kindName()}
+	if accn, _ := c.accn.Load().(string); accn != _EMPTY_ {
+		cf = append(cf, "account", accn)
+	}
+	c.srv.logWithFields(level, append(cf, fields...), fmt.Sprintf("%s - ", c), format, v...)
+}
+
+func (c *client) kindName() string {
+	switch c.kind {
+	case CLIENT:
+		return "client"
+	case ROUTER:
+		return "router"
+	case GATEWAY:
+		return "gateway"
+	case SYSTEM:
+		return "system"
+	case LEAF:
+		return "leafnode"
+	}
+	return "unknown"
 }
@@ -18,9 +18,13 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"os"
 	"reflect"
 	"regexp"
+	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -344,6 +348,171 @@ func TestClientSimplePubSub(t *testing.T) {
 	checkPayload(cr, []byte("hello\r\n"), t)
 }
 
+func TestClientExpandPermSubjects(t *testing.T) {
+	c := &client{utags: map[string]string{"region": "eu", "team": "a", "bad": "x.y"}}
+	for _, test := range []struct {
+		name     string
+		subjects []string
+		allow    bool
+		expected []string
+	}{
+		{"no template", []string{"foo", "bar.>"}, true, []string{"foo", "bar.>"}},
+		{"allow", []string{"foo", "orders.{{tag(region)}}.>"}, true, []string{"foo", "orders.eu.>"}},
+		{"partial token", []string{"team-{{tag(team)}}-{{tag(region)}}"}, true, []string{"team-a-eu"}},
+		{"allow missing tag", []string{"orders.{{tag(zone)}}", "foo"}, true, []string{"foo"}},
+		{"allow invalid value", []string{"orders.{{tag(bad)}}"}, true, []string{}},
+		{"deny missing tag", []string{"secret.{{tag(zone)}}.x"}, false, []string{"secret.*.x"}},
+		{"deny", []string{"secret.{{tag(team)}}"}, false, []string{"secret.a"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := c.expandPermSubjects(test.subjects, test.allow); !reflect.DeepEqual(got, test.expected) {
+				t.Fatalf("Expected %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestClientConnectNameAndTags(t *testing.T) {
+	opts := DefaultOptions()
+	perms := &Permissions{
+		Publish:   &SubjectPermission{Allow: []string{"orders.{{tag(region)}}.>"}},
+		Subscribe: &SubjectPermission{Deny: []string{"secret.{{tag(team)}}"}},
+	}
+	opts.Users = []*User{{
+		Username:    "worker",
+		Password:    "pwd",
+		Permissions: perms,
+		Tags:        map[string]string{"region": "eu", "team": "a"},
+	}, {
+		Username:    "untagged",
+		Password:    "pwd",
+		Permissions: perms,
+	}}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	c, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	cr := bufio.NewReader(c)
+	cr.ReadString('\n')
+	c.Write([]byte("CONNECT {\"verbose\":false,\"user\":\"worker\",\"pass\":\"pwd\",\"name\":\"w1\"," +
+		"\"lang\":\"go\",\"version\":\"1.0\",\"tags\":{\"region\":\"eu\",\"team\":\"a\"}}\r\n" +
+		"PUB orders.eu.1 2\r\nok\r\nPING\r\n"))
+	if l, _ := cr.ReadString('\n'); l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q", l)
+	}
+	for _, proto := range []string{"PUB orders.us.1 2\r\nok\r\n", "SUB secret.a 1\r\n"} {
+		c.Write([]byte(proto))
+		if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, "-ERR 'Permissions Violation") {
+			t.Fatalf("Expected a permissions violation for %q, got %q", proto, l)
+		}
+	}
+
+	cz, err := s.Connz(nil)
+	if err != nil {
+		t.Fatalf("Error getting connz: %v", err)
+	}
+	if len(cz.Conns) != 1 {
+		t.Fatalf("Expected 1 connection, got %d", len(cz.Conns))
+	}
+	ci := cz.Conns[0]
+	if ci.Name != "w1" || ci.Lang != "go" || ci.Version != "1.0" ||
+		!reflect.DeepEqual(ci.Tags, map[string]string{"region": "eu", "team": "a"}) {
+		t.Fatalf("Unexpected connection info: %+v", ci)
+	}
+	// The name identifies the connection in the logs.
+	if cl := s.getClient(ci.Cid); cl == nil || !strings.Contains(cl.String(), `"w1"`) {
+		t.Fatalf("Expected the name in the connection string, got %v", cl)
+	}
+
+	// The permissions only use the tags of the user, not those sent by the
+	// client, whether the user has tags or not.
+	for _, user := range []string{"worker", "untagged"} {
+		c, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		cr := bufio.NewReader(c)
+		cr.ReadString('\n')
+		c.Write([]byte(fmt.Sprintf("CONNECT {\"verbose\":false,\"user\":%q,\"pass\":\"pwd\","+
+			"\"tags\":{\"region\":\"us\"}}\r\nPUB orders.us.1 2\r\nok\r\n", user)))
+		if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, "-ERR 'Permissions Violation") {
+			t.Fatalf("Expected a permissions violation for %q with a client tag, got %q", user, l)
+		}
+	}
+}
+
+func TestClientReplyCache(t *testing.T) {
+	opts := DefaultOptions()
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	addr := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	requester, err := nats.Connect(addr)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer requester.Close()
+	replies, err := requester.SubscribeSync("_INBOX.abc.*")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	requester.Flush()
+
+	responder, err := nats.Connect(addr)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer responder.Close()
+
+	cid, _ := responder.GetClientID()
+
+	checkReplies := func(n int, hits, misses uint64) {
+		t.Helper()
+		responder.Flush()
+		for i := 0; i < n; i++ {
+			if _, err := replies.NextMsg(time.Second); err != nil {
+				t.Fatalf("Error receiving reply %d: %v", i, err)
+			}
+		}
+		cz, err := s.Connz(&ConnzOptions{CID: cid})
+		if err != nil {
+			t.Fatalf("Error getting connz: %v", err)
+		}
+		if ci := cz.Conns[0]; ci.ReplyHits != hits || ci.ReplyMisses != misses {
+			t.Fatalf("Expected %d hits and %d misses, got %d and %d",
+				hits, misses, ci.ReplyHits, ci.ReplyMisses)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		responder.Publish(fmt.Sprintf("_INBOX.abc.%d", i), []byte("ok"))
+	}
+	checkReplies(10, 9, 1)
+
+	// A subscription on a single reply invalidates the cache, and the
+	// results for this inbox are no longer shared.
+	single, err := requester.SubscribeSync("_INBOX.abc.5")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	requester.Flush()
+	responder.Publish("_INBOX.abc.5", []byte("ok"))
+	responder.Publish("_INBOX.abc.6", []byte("ok"))
+	checkReplies(2, 9, 3)
+	if _, err := single.NextMsg(time.Second); err != nil {
+		t.Fatalf("Error receiving reply: %v", err)
+	}
+	if _, err := single.NextMsg(50 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected reply")
+	}
+}
+
 func TestClientPubSubNoEcho(t *testing.T) {
 	_, c, cr := setupClient()
 	// Specify no echo
@@ -418,6 +587,63 @@ func TestClientNoBodyPubSubWithReply(t *testing.T) {
 	}
 }
 
+func TestClientHeaderPubSub(t *testing.T) {
+	s, c, cr := setupClient()
+	defer s.Shutdown()
+	c2, cr2, _ := newClientForServer(s)
+
+	// The second client does not support headers and gets them in the payload.
+	done := make(chan struct{})
+	go func() {
+		c2.parseAndFlush([]byte("SUB foo 1\r\nPING\r\n"))
+		close(done)
+	}()
+	if l, _ := cr2.ReadString('\n'); !strings.HasPrefix(l, "PONG") {
+		t.Fatalf("Expected a PONG, got %q", l)
+	}
+	<-done
+	ch := make(chan string, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			l, _ := cr2.ReadString('\n')
+			ch <- l
+		}
+	}()
+
+	hdr := "NATS/1.0\r\nA: B\r\n\r\n"
+	go c.parseAndFlush([]byte("CONNECT {\"verbose\":false,\"headers\":true}\r\nSUB foo 1\r\n" +
+		fmt.Sprintf("HPUB foo %d %d\r\n%shello\r\n", len(hdr), len(hdr)+5, hdr)))
+
+	expected := fmt.Sprintf("HMSG foo 1 %d %d\r\n", len(hdr), len(hdr)+5)
+	if l, _ := cr.ReadString('\n'); l != expected {
+		t.Fatalf("Expected %q, got %q", expected, l)
+	}
+	buf := make([]byte, len(hdr)+5+2)
+	if _, err := io.ReadFull(cr, buf); err != nil || string(buf) != hdr+"hello\r\n" {
+		t.Fatalf("Unexpected message %q: %v", buf, err)
+	}
+
+	// Subscribers that do not support headers only get the payload.
+	if l := <-ch; l != "MSG foo 1 5\r\n" {
+		t.Fatalf("Expected %q, got %q", "MSG foo 1 5\r\n", l)
+	}
+	if l := <-ch; l != "hello\r\n" {
+		t.Fatalf("Expected the headers to be stripped, got %q", l)
+	}
+
+	// Without headers negotiated, HPUB is refused.
+	go c2.parseAndFlush([]byte(fmt.Sprintf("HPUB foo %d %d\r\n%shello\r\n", len(hdr), len(hdr)+5, hdr)))
+	for {
+		l, _ := cr2.ReadString('\n')
+		if strings.HasPrefix(l, "-ERR") {
+			if !strings.Contains(l, ErrMsgHeadersNotSupported.Error()) {
+				t.Fatalf("Unexpected error: %q", l)
+			}
+			break
+		}
+	}
+}
+
 // This needs to clear any flushOutbound flags since writeLoop not running.
 func (c *client) parseAndFlush(op []byte) {
 	c.parse(op)
@@ -1288,3 +1514,841 @@ func TestReadloopWarning(t *testing.T) {
 		t.Fatalf("No warning printed")
 	}
 }
+
+func TestClientPendingSubjects(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		kind     int
+		bufs     []string
+		max      int
+		expected []SlowConsumerSubject
+	}{
+		{
+			"client",
+			CLIENT,
+			[]string{"MSG foo 1 5\r\nhello\r\nPING\r\nMSG bar 1 _INBOX.1 2\r\nhi\r\n", "HMSG foo 2 12 14\r\nNATS/1.0\r\n\r\nhi\r\n"},
+			10,
+			[]SlowConsumerSubject{{Subject: "foo", Msgs: 2, Bytes: 54}, {Subject: "bar", Msgs: 1, Bytes: 26}},
+		},
+		{
+			"partial write and split message",
+			CLIENT,
+			[]string{"llo\r\nMSG foo 1 5\r\nhel", "lo\r\nMSG bar 1 5\r\nhello\r\n"},
+			1,
+			[]SlowConsumerSubject{{Subject: "bar", Msgs: 1, Bytes: 20}},
+		},
+		{
+			"route",
+			ROUTER,
+			[]string{"RMSG A foo + reply q1 5\r\nhello\r\nHMSG B foo 12 14\r\nNATS/1.0\r\n\r\nhi\r\n"},
+			10,
+			[]SlowConsumerSubject{{Account: "B", Subject: "foo", Msgs: 1, Bytes: 34}, {Account: "A", Subject: "foo", Msgs: 1, Bytes: 32}},
+		},
+		{
+			"leaf",
+			LEAF,
+			[]string{"LMSG foo 5\r\nhello\r\nHMSG bar 12 14\r\nNATS/1.0\r\n\r\nhi\r\n"},
+			10,
+			[]SlowConsumerSubject{{Subject: "bar", Msgs: 1, Bytes: 32}, {Subject: "foo", Msgs: 1, Bytes: 19}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := &client{kind: test.kind}
+			var bufs [][]byte
+			for _, b := range test.bufs {
+				bufs = append(bufs, []byte(b))
+			}
+			subjects := c.pendingSubjects(bufs, test.max)
+			if len(subjects) != len(test.expected) {
+				t.Fatalf("Expected %d subjects, got %d", len(test.expected), len(subjects))
+			}
+			for i, exp := range test.expected {
+				if *subjects[i] != exp {
+					t.Fatalf("Expected %+v, got %+v", exp, *subjects[i])
+				}
+			}
+		})
+	}
+}
+
+func TestClientPingSettingsPerConnectionType(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		ping_interval: 120
+		ping_max: 2
+		cluster {
+			listen: "127.0.0.1:-1"
+			ping_interval: 30
+		}
+		leafnodes {
+			listen: "127.0.0.1:-1"
+			ping_interval: 60
+			ping_max: 5
+		}
+		accounts {
+			A { users [{user: a, password: pwd}], ping_interval: 5, ping_max: 10 }
+			B { users [{user: b, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	accA, _ := s.LookupAccount("A")
+	accB, _ := s.LookupAccount("B")
+	for _, test := range []struct {
+		name     string
+		c        *client
+		interval time.Duration
+		max      int
+	}{
+		{"client account override", &client{srv: s, kind: CLIENT, acc: accA}, 5 * time.Second, 10},
+		{"client server wide", &client{srv: s, kind: CLIENT, acc: accB}, 120 * time.Second, 2},
+		{"route", &client{srv: s, kind: ROUTER}, 30 * time.Second, 2},
+		{"leafnode", &client{srv: s, kind: LEAF}, 60 * time.Second, 5},
+		{"gateway", &client{srv: s, kind: GATEWAY}, 120 * time.Second, 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			interval, max := test.c.pingSettings()
+			if interval != test.interval || max != test.max {
+				t.Fatalf("Expected %v/%v, got %v/%v", test.interval, test.max, interval, max)
+			}
+		})
+	}
+}
+
+func TestClientQueueSubWeight(t *testing.T) {
+	opts := DefaultOptions()
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	c, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	cr := bufio.NewReader(c)
+	cr.ReadString('\n')
+	c.Write([]byte("CONNECT {\"verbose\":false}\r\nSUB foo bar 1 weight=9\r\nPING\r\n"))
+	if l, _ := cr.ReadString('\n'); l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q", l)
+	}
+	// A weight requires a queue group.
+	c.Write([]byte("SUB foo 2 weight=9\r\n"))
+	if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, "-ERR") {
+		t.Fatalf("Expected an error, got %q", l)
+	}
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	sub, err := nc.QueueSubscribeSync("foo", "bar")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	const total = 1000
+	for i := 0; i < total; i++ {
+		nc.Publish("foo", []byte("ok"))
+	}
+	nc.Flush()
+
+	var weighted int
+	for n, _, _ := sub.Pending(); weighted+n < total; n, _, _ = sub.Pending() {
+		l, err := cr.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading: %v", err)
+		}
+		if strings.HasPrefix(l, "MSG ") {
+			weighted++
+		}
+	}
+	// The weighted member should get about 90% of the messages.
+	if weighted < 800 || weighted > 970 {
+		t.Fatalf("Expected about 900 messages for the weighted member, got %d", weighted)
+	}
+}
+
+func TestClientStickyKey(t *testing.T) {
+	for _, test := range []struct {
+		subject string
+		tok     int
+		key     string
+	}{
+		{"orders.42.created", 0, "orders.42.created"},
+		{"orders.42.created", 1, "orders"},
+		{"orders.42.created", 2, "42"},
+		{"orders.42.created", 3, "created"},
+		{"orders.42.created", 4, "orders.42.created"},
+		{"orders", 1, "orders"},
+	} {
+		if key := string(stickyKey([]byte(test.subject), test.tok)); key != test.key {
+			t.Fatalf("Expected key %q for token %d of %q, got %q", test.key, test.tok, test.subject, key)
+		}
+	}
+}
+
+func TestClientStickyQueue(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				users: [{user: a, password: pwd}]
+				sticky_queues: {workers: 2}
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	s, o := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://a:pwd@%s:%d", o.Host, o.Port)
+	conns := make([]*nats.Conn, 3)
+	members := make([]*nats.Subscription, 3)
+	for i := range members {
+		conns[i] = natsConnect(t, url)
+		defer conns[i].Close()
+		members[i] = natsQueueSubSync(t, conns[i], "orders.>", "workers")
+		natsFlush(t, conns[i])
+	}
+	nc := natsConnect(t, url)
+	defer nc.Close()
+
+	// Returns the member each order was delivered to.
+	deliver := func(orders int) map[string]int {
+		t.Helper()
+		for i := 0; i < orders; i++ {
+			for _, event := range []string{"created", "paid", "shipped"} {
+				natsPub(t, nc, fmt.Sprintf("orders.%d.%s", i, event), nil)
+			}
+		}
+		natsFlush(t, nc)
+		owners := make(map[string]int)
+		for received := 0; received < 3*orders; {
+			var got bool
+			for i, sub := range members {
+				if sub == nil {
+					continue
+				}
+				m, err := sub.NextMsg(10 * time.Millisecond)
+				if err != nil {
+					continue
+				}
+				got = true
+				received++
+				order := strings.Split(m.Subject, ".")[1]
+				if owner, ok := owners[order]; ok && owner != i {
+					t.Fatalf("Order %s delivered to members %d and %d", order, owner, i)
+				}
+				owners[order] = i
+			}
+			if !got {
+				t.Fatalf("Received only %d messages", received)
+			}
+		}
+		return owners
+	}
+	owners := deliver(30)
+	counts := make(map[int]int)
+	for _, owner := range owners {
+		counts[owner]++
+	}
+	if len(counts) != 3 {
+		t.Fatalf("Expected orders to be spread over the 3 members, got %v", counts)
+	}
+
+	// When a member goes away, only its orders move to other members.
+	natsUnsub(t, members[0])
+	natsFlush(t, conns[0])
+	members[0] = nil
+	for order, owner := range deliver(30) {
+		if prev := owners[order]; prev != 0 && prev != owner {
+			t.Fatalf("Order %s moved from member %d to %d", order, prev, owner)
+		}
+	}
+}
+
+func TestClientIdleTimeout(t *testing.T) {
+	opts := DefaultOptions()
+	opts.IdleTimeout = 250 * time.Millisecond
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	connect := func(proto string) (net.Conn, *bufio.Reader) {
+		t.Helper()
+		c, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		cr := bufio.NewReader(c)
+		cr.ReadString('\n')
+		c.Write([]byte("CONNECT {\"verbose\":false}\r\n" + proto + "PING\r\n"))
+		if l, _ := cr.ReadString('\n'); l != "PONG\r\n" {
+			t.Fatalf("Expected PONG, got %q", l)
+		}
+		return c, cr
+	}
+	idle, idler := connect("")
+	defer idle.Close()
+	pinger, _ := connect("")
+	defer pinger.Close()
+	publisher, _ := connect("")
+	defer publisher.Close()
+	subscriber, _ := connect("SUB foo 1\r\n")
+	defer subscriber.Close()
+
+	// The publisher and subscriber remain active, while PINGs do not count.
+	for i := 0; i < 10; i++ {
+		pinger.Write([]byte("PING\r\n"))
+		publisher.Write([]byte("PUB foo 2\r\nok\r\n"))
+		time.Sleep(50 * time.Millisecond)
+	}
+	checkClosedConns(t, s, 2, time.Second)
+	if n := s.NumClients(); n != 2 {
+		t.Fatalf("Expected the publisher and subscriber to be connected, got %d clients", n)
+	}
+	for _, cc := range s.closedClients() {
+		if cc.Reason != IdleTimeout.String() {
+			t.Fatalf("Unexpected closed reason: %v", cc.Reason)
+		}
+	}
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	if l, _ := idler.ReadString('\n'); l != "-ERR 'Idle Timeout'\r\n" {
+		t.Fatalf("Expected idle timeout error, got %q", l)
+	}
+}
+
+func TestClientDeliverMsgNoAllocs(t *testing.T) {
+	s := New(&defaultServerOptions)
+	defer s.Shutdown()
+
+	pub, pr, _ := newClientForServer(s)
+	go io.Copy(ioutil.Discard, pr)
+	sub, sr, _ := newClientForServer(s)
+	sub.parse([]byte("CONNECT {\"verbose\":false,\"pedantic\":false,\"headers\":true}\r\nSUB foo 1\r\n"))
+	pub.parse([]byte("CONNECT {\"verbose\":false,\"pedantic\":false,\"headers\":true}\r\n"))
+
+	msgs := [][]byte{
+		[]byte("PUB foo bar 2\r\nok\r\n"),
+		[]byte("HPUB foo bar 12 14\r\nNATS/1.0\r\n\r\nok\r\n"),
+	}
+	for i, expected := range []string{"MSG foo 1 bar 2\r\n", "HMSG foo 1 bar 12 14\r\n"} {
+		done := make(chan struct{})
+		go func() {
+			pub.parseAndFlush(msgs[i])
+			close(done)
+		}()
+		if l, _ := sr.ReadString('\n'); l != expected {
+			t.Fatalf("Expected %q, got %q", expected, l)
+		}
+		if l, _ := sr.ReadString('\n'); l != "ok\r\n" && l != "NATS/1.0\r\n" {
+			t.Fatalf("Unexpected payload %q", l)
+		}
+		if i == 1 {
+			sr.ReadString('\n')
+			sr.ReadString('\n')
+		}
+		<-done
+	}
+	go io.Copy(ioutil.Discard, sr)
+
+	// Once the buffers are allocated, delivering small messages with or
+	// without headers should not allocate.
+	for _, msg := range msgs {
+		if n := testing.AllocsPerRun(1000, func() {
+			pub.parse(msg)
+			pub.flushClients(0)
+		}); n != 0 {
+			t.Fatalf("Expected no allocations delivering %q, got %v", msg, n)
+		}
+	}
+}
+
+func TestClientOutboundOptions(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		outbound {
+			max_vectors: 2
+			coalesce_delay: "5ms"
+			min_buffer_size: 1024
+			max_buffer_size: 4096
+			buffer_growth: fixed
+		}
+	`))
+	defer os.Remove(conf)
+	s, o := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	expected := OutboundOpts{MaxVectors: 2, CoalesceDelay: 5 * time.Millisecond,
+		MinBufferSize: 1024, MaxBufferSize: 4096, BufferGrowth: "fixed"}
+	if o.Outbound != expected {
+		t.Fatalf("Unexpected options: %+v", o.Outbound)
+	}
+
+	c, cr, _ := newClientForServer(s)
+	defer c.closeConnection(ClientClosed)
+	go io.Copy(ioutil.Discard, cr)
+
+	// Messages larger than the maximum buffer size are referenced, each one
+	// being a buffer of the vectored writes, so 2 are written per flush.
+	msg := make([]byte, 5000)
+	c.mu.Lock()
+	if c.out.sz != 4096 {
+		c.mu.Unlock()
+		t.Fatalf("Expected fixed buffer size of 4096, got %d", c.out.sz)
+	}
+	for i := 0; i < 5; i++ {
+		c.queueOutbound(msg)
+	}
+	for _, pending := range []int32{3 * 5000, 5000, 0} {
+		c.flushOutbound()
+		if c.out.pb != pending {
+			c.mu.Unlock()
+			t.Fatalf("Expected %d pending bytes, got %d", pending, c.out.pb)
+		}
+	}
+	c.mu.Unlock()
+
+	// Messages are delivered when writes are coalesced.
+	nc, err := nats.Connect(fmt.Sprintf("nats://%s:%d", o.Host, o.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	sub, _ := nc.SubscribeSync("foo")
+	for i := 0; i < 100; i++ {
+		nc.Publish("foo", []byte("hello"))
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := sub.NextMsg(time.Second); err != nil {
+			t.Fatalf("Error receiving message %d: %v", i, err)
+		}
+	}
+
+	v, _ := s.Varz(nil)
+	var counted int64
+	for _, b := range v.Flushes.Sizes {
+		counted += b.Count
+	}
+	if v.Flushes.Count < 3 || counted != v.Flushes.Count || v.Flushes.Vectors < 5 {
+		t.Fatalf("Unexpected flush statistics: %+v", v.Flushes)
+	}
+	// The flushes of 2 messages are in the bucket up to 32KB.
+	if b := v.Flushes.Sizes[2]; b.Max != 32*1024 || b.Count < 2 {
+		t.Fatalf("Unexpected flush sizes: %+v", v.Flushes.Sizes)
+	}
+
+	// Existing connections get the reloaded options.
+	reloadUpdateConfig(t, s, conf, `
+		listen: "127.0.0.1:-1"
+		outbound {
+			max_buffer_size: 2048
+			buffer_growth: grow
+		}
+	`)
+	c.mu.Lock()
+	mxv, cwd, mxb, bgp := c.out.mxv, c.out.cwd, c.out.mxb, c.out.bgp
+	c.mu.Unlock()
+	if mxv != 0 || cwd != 0 || mxb != 2048 || bgp != bufGrowthGrow {
+		t.Fatalf("Unexpected reloaded options: %v %v %v %v", mxv, cwd, mxb, bgp)
+	}
+
+	for _, oo := range []OutboundOpts{
+		{MaxVectors: -1},
+		{CoalesceDelay: -time.Second},
+		{MinBufferSize: 1000},
+		{MinBufferSize: 8192, MaxBufferSize: 4096},
+		{BufferGrowth: "shrink"},
+	} {
+		o := DefaultOptions()
+		o.Outbound = oo
+		if err := validateOptions(o); err == nil {
+			t.Fatalf("Expected error validating %+v", oo)
+		}
+	}
+}
+
+func TestClientSubSharedSubject(t *testing.T) {
+	s := RunServer(DefaultOptions())
+	defer s.Shutdown()
+
+	c1, _, _ := newClientForServer(s)
+	defer c1.closeConnection(ClientClosed)
+	c2, _, _ := newClientForServer(s)
+	defer c2.closeConnection(ClientClosed)
+
+	sub := func(c *client, arg, sid string) *subscription {
+		t.Helper()
+		if err := c.processSub([]byte(arg)); err != nil {
+			t.Fatalf("Error subscribing: %v", err)
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		sub := c.subs[sid]
+		if sub == nil {
+			t.Fatalf("Subscription %q not found", sid)
+		}
+		return sub
+	}
+	sub1 := sub(c1, "foo.bar 1", "1")
+	sub2 := sub(c2, "foo.bar workers 22", "22")
+	sub3 := sub(c2, "foo.baz 3", "3")
+	if &sub2.subject[0] != &sub1.subject[0] || &sub3.subject[0] == &sub1.subject[0] {
+		t.Fatal("Expected the subject to be shared by the subscriptions on it only")
+	}
+	if string(sub2.subject) != "foo.bar" || string(sub2.queue) != "workers" || string(sub2.sid) != "22" {
+		t.Fatalf("Unexpected subscription: %q %q %q", sub2.subject, sub2.queue, sub2.sid)
+	}
+	r := s.gacc.sl.Match("foo.bar")
+	if len(r.psubs) != 1 || len(r.qsubs) != 1 {
+		t.Fatalf("Unexpected match: %+v", r)
+	}
+
+	// The subject is still shared once the first subscription is gone.
+	c1.processUnsub([]byte("1"))
+	sub4 := sub(c1, "foo.bar 4", "4")
+	if &sub4.subject[0] != &sub2.subject[0] {
+		t.Fatal("Expected the subject to be shared")
+	}
+	if r := s.gacc.sl.Match("foo.bar"); len(r.psubs) != 1 || r.psubs[0] != sub4 {
+		t.Fatalf("Unexpected match: %+v", r)
+	}
+}
+
+func TestClientMaxTotalPending(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		max_total_pending: 10KB
+	`))
+	defer os.Remove(conf)
+	s, o := RunServerWithConfig(conf)
+	defer s.Shutdown()
+	if o.MaxTotalPending != 10*1024 {
+		t.Fatalf("Unexpected max_total_pending: %v", o.MaxTotalPending)
+	}
+
+	// A consumer that is not read holds the pending bytes.
+	c, cr, _ := newClientForServer(s)
+	defer c.closeConnection(ClientClosed)
+	queue := func(c *client, n int) {
+		c.mu.Lock()
+		c.queueOutbound(make([]byte, n))
+		c.flushSignal()
+		c.mu.Unlock()
+	}
+	checkPending := func(pending, pauses int64) {
+		t.Helper()
+		v, _ := s.Varz(nil)
+		if v.TotalPending != pending || v.PendingPauses != pauses {
+			t.Fatalf("Expected %d pending bytes and %d pauses, got %d and %d",
+				pending, pauses, v.TotalPending, v.PendingPauses)
+		}
+	}
+	queue(c, 6*1024)
+	checkPending(6*1024, 0)
+	queue(c, 6*1024)
+	checkPending(12*1024, 1)
+
+	// The reads of a publisher are paused until back below the limit.
+	nc, err := nats.Connect(fmt.Sprintf("nats://%s:%d", o.Host, o.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	nc.Publish("foo", []byte("hello"))
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("Error on flush: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		nc.Publish("foo", []byte("hello"))
+		done <- nc.FlushTimeout(5 * time.Second)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Expected the publisher to be paused, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	go io.Copy(ioutil.Discard, cr)
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		if v, _ := s.Varz(nil); v.TotalPending != 0 {
+			return fmt.Errorf("Still %d pending bytes", v.TotalPending)
+		}
+		return nil
+	})
+	checkPending(0, 1)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Error on flush: %v", err)
+		}
+	case <-time.After(maxPendingPause / 2):
+		t.Fatal("Expected the publisher to be resumed")
+	}
+
+	// The pending bytes of a closed connection are removed, and removing the
+	// limit resumes the publishers.
+	c2, _, _ := newClientForServer(s)
+	defer c2.closeConnection(ClientClosed)
+	queue(c2, 12*1024)
+	checkPending(12*1024, 2)
+	reloadUpdateConfig(t, s, conf, `
+		listen: "127.0.0.1:-1"
+	`)
+	s.pendMu.Lock()
+	gate := s.pendGate
+	s.pendMu.Unlock()
+	if gate != nil {
+		t.Fatal("Expected the publishers to be resumed")
+	}
+	c2.closeConnection(ClientClosed)
+	checkPending(0, 2)
+
+	o = DefaultOptions()
+	o.MaxTotalPending = -1
+	if err := validateOptions(o); err == nil {
+		t.Fatal("Expected an error for a negative max_total_pending")
+	}
+}
+
+func TestClientFanOutSharedPayload(t *testing.T) {
+	s := New(&defaultServerOptions)
+	defer s.Shutdown()
+
+	pub, _, _ := newClientForServer(s)
+	pub.parse([]byte("CONNECT {\"verbose\":false,\"pedantic\":false,\"headers\":true}\r\n"))
+
+	// Subscribers mostly using the same sid, one with another sid and some
+	// receiving the message headers apart.
+	type subscriber struct {
+		c   *client
+		r   *bufio.Reader
+		sid string
+		hdr bool
+	}
+	var subs []*subscriber
+	for i := 0; i < fanoutShareMin+4; i++ {
+		sub := &subscriber{sid: "1", hdr: i%3 == 0}
+		if i == 5 {
+			sub.sid = "22"
+		}
+		sub.c, sub.r, _ = newClientForServer(s)
+		sub.c.parse([]byte(fmt.Sprintf("CONNECT {\"verbose\":false,\"pedantic\":false,\"headers\":%v}\r\nSUB foo %s\r\n",
+			sub.hdr, sub.sid)))
+		subs = append(subs, sub)
+	}
+
+	payloads := [][]byte{
+		bytes.Repeat([]byte("a"), sharedPayloadMin),
+		bytes.Repeat([]byte("b"), 2*sharedPayloadMin),
+	}
+	for _, p := range payloads {
+		pub.parse([]byte(fmt.Sprintf("HPUB foo 12 %d\r\nNATS/1.0\r\n\r\n%s\r\n", len(p)+12, p)))
+	}
+
+	// The payloads are queued by reference, the same buffers for all.
+	var shared [][]byte
+	for _, sub := range subs {
+		sub.c.mu.Lock()
+		var refs [][]byte
+		for _, b := range sub.c.out.nb {
+			if len(b) > sharedPayloadMin {
+				refs = append(refs, b)
+			}
+		}
+		sub.c.mu.Unlock()
+		if len(refs) != 2 {
+			t.Fatalf("Expected the 2 payloads referenced, got %d", len(refs))
+		}
+		if shared == nil {
+			shared = refs
+		} else if !sameBufferEnd(refs[0], shared[0]) || !sameBufferEnd(refs[1], shared[1]) {
+			t.Fatalf("Expected the payloads to be shared")
+		}
+	}
+
+	for _, sub := range subs {
+		done := make(chan struct{})
+		go func(c *client) {
+			c.mu.Lock()
+			c.flushOutbound()
+			c.mu.Unlock()
+			close(done)
+		}(sub.c)
+		for _, p := range payloads {
+			expected, payload := fmt.Sprintf("MSG foo %s %d\r\n", sub.sid, len(p)), fmt.Sprintf("%s\r\n", p)
+			if sub.hdr {
+				expected = fmt.Sprintf("HMSG foo %s 12 %d\r\n", sub.sid, len(p)+12)
+				payload = "NATS/1.0\r\n\r\n" + payload
+			}
+			if l, _ := sub.r.ReadString('\n'); l != expected {
+				t.Fatalf("Expected %q, got %q", expected, l)
+			}
+			buf := make([]byte, len(payload))
+			if _, err := io.ReadFull(sub.r, buf); err != nil {
+				t.Fatalf("Error reading payload: %v", err)
+			}
+			if string(buf) != payload {
+				t.Fatalf("Unexpected payload %q", buf)
+			}
+		}
+		<-done
+	}
+}
+
+// Returns true if the buffers end with the same bytes in memory, which is
+// how the payloads are shared with or without their header block.
+func sameBufferEnd(a, b []byte) bool {
+	return &a[len(a)-1] == &b[len(b)-1]
+}
+
+func TestClientPoller(t *testing.T) {
+	if !pollerSupported {
+		t.Skip("The poller is not supported on this platform")
+	}
+	opts := DefaultOptions()
+	opts.Poller = true
+	opts.PollerWorkers = 2
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	checkPolled := func(expected int) {
+		t.Helper()
+		checkFor(t, time.Second, 15*time.Millisecond, func() error {
+			v, _ := s.Varz(nil)
+			if v.PolledConnections != expected {
+				return fmt.Errorf("Expected %d polled connections, got %d", expected, v.PolledConnections)
+			}
+			return nil
+		})
+	}
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	nc1 := natsConnect(t, url)
+	defer nc1.Close()
+	sub := natsSubSync(t, nc1, "foo")
+	natsFlush(t, nc1)
+	nc2 := natsConnect(t, url)
+	defer nc2.Close()
+	checkPolled(2)
+
+	// Small messages, and large ones read in several times.
+	large := bytes.Repeat([]byte("x"), 300*1024)
+	for i := 0; i < 500; i++ {
+		natsPub(t, nc2, "foo", []byte(fmt.Sprintf("%d", i)))
+	}
+	natsPub(t, nc2, "foo", large)
+	for i := 0; i < 500; i++ {
+		if msg := natsNexMsg(t, sub, time.Second); string(msg.Data) != fmt.Sprintf("%d", i) {
+			t.Fatalf("Expected message %d, got %q", i, msg.Data)
+		}
+	}
+	if msg := natsNexMsg(t, sub, time.Second); !bytes.Equal(msg.Data, large) {
+		t.Fatalf("Unexpected large message of %d bytes", len(msg.Data))
+	}
+
+	nc2.Close()
+	checkPolled(1)
+
+	// A protocol error closes the connection.
+	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	cr := bufio.NewReader(conn)
+	if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, "INFO ") {
+		t.Fatalf("Expected INFO, got %q", l)
+	}
+	conn.Write([]byte("CONNECT {\"verbose\":false}\r\nBOGUS\r\n"))
+	if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, "-ERR 'Unknown Protocol Operation'") {
+		t.Fatalf("Expected an error, got %q", l)
+	}
+	if _, err := cr.ReadString('\n'); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed, got %v", err)
+	}
+	checkPolled(1)
+
+	// Idle connections only have their write loop.
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+		if err != nil {
+			t.Fatalf("Error on dial: %v", err)
+		}
+		defer conn.Close()
+	}
+	checkPolled(51)
+	if n := runtime.NumGoroutine() - before; n > 60 {
+		t.Fatalf("Expected about 50 more go routines, got %d", n)
+	}
+}
+
+func TestClientPollerPausedPublisher(t *testing.T) {
+	if !pollerSupported {
+		t.Skip("The poller is not supported on this platform")
+	}
+	opts := DefaultOptions()
+	opts.Poller = true
+	opts.PollerWorkers = 1
+	opts.MaxTotalPending = 10 * 1024
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	// A consumer that is not read holds the pending bytes.
+	c, cr, _ := newClientForServer(s)
+	defer c.closeConnection(ClientClosed)
+	c.mu.Lock()
+	c.queueOutbound(make([]byte, 12*1024))
+	c.flushSignal()
+	c.mu.Unlock()
+	if s.outPendingGate() == nil {
+		t.Fatal("Expected the publishers to be paused")
+	}
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	pub := natsConnect(t, url)
+	defer pub.Close()
+	other := natsConnect(t, url)
+	defer other.Close()
+
+	// The read with the first message is processed, the next one waits.
+	pub.Publish("foo", []byte("hello"))
+	if err := pub.Flush(); err != nil {
+		t.Fatalf("Error on flush: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		pub.Publish("foo", []byte("hello"))
+		done <- pub.FlushTimeout(5 * time.Second)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Expected the publisher to be paused, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The paused publisher does not hold the only worker.
+	start := time.Now()
+	if err := other.FlushTimeout(time.Second); err != nil {
+		t.Fatalf("Error on flush: %v", err)
+	}
+	if dur := time.Since(start); dur > maxPendingPause/2 {
+		t.Fatalf("Expected the other connection to be read, took %v", dur)
+	}
+
+	// The publisher is read again once the pending bytes drop.
+	go io.Copy(ioutil.Discard, cr)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Error on flush: %v", err)
+		}
+	case <-time.After(maxPendingPause / 2):
+		t.Fatal("Expected the publisher to be resumed")
+	}
+}
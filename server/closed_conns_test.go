@@ -16,6 +16,7 @@ package server
 import (
 	"fmt"
 	"net"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -265,3 +266,66 @@ func TestClosedTLSHandshake(t *testing.T) {
 	}
 	checkReason(t, conns[0].Reason, TLSHandshakeError)
 }
+
+func TestClosedConnsHistory(t *testing.T) {
+	s, opts, conf := runReloadServerWithContent(t, []byte(`
+		listen: "127.0.0.1:-1"
+		max_closed_clients: 3
+		authorization { user: u, password: pwd }
+	`))
+	defer os.Remove(conf)
+	defer s.Shutdown()
+
+	if opts.MaxClosedClients != 3 {
+		t.Fatalf("Expected max closed clients of 3, got %v", opts.MaxClosedClients)
+	}
+	for i := 0; i < 5; i++ {
+		nc, err := nats.Connect(fmt.Sprintf("nats://u:pwd@%s:%d", opts.Host, opts.Port))
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		nc.SubscribeSync(fmt.Sprintf("foo.%d", i))
+		nc.Publish("bar", []byte("hello"))
+		nc.Flush()
+		nc.Close()
+		checkTotalClosedConns(t, s, uint64(i+1), time.Second)
+	}
+
+	conns := s.ClosedConnections()
+	if len(conns) != 3 {
+		t.Fatalf("Expected 3 closed connections, got %v", len(conns))
+	}
+	for i, ci := range conns {
+		if ci.Cid != uint64(i+3) || ci.Reason != ClientClosed.String() || ci.Stop == nil ||
+			ci.AuthorizedUser != "u" || ci.InMsgs != 1 || ci.Uptime == "" ||
+			len(ci.Subs) != 1 || ci.Subs[0] != fmt.Sprintf("foo.%d", i+2) {
+			t.Fatalf("Unexpected closed connection: %+v", ci)
+		}
+	}
+	// The history is not changed by the caller.
+	conns[0].Subs = nil
+	if conns = s.ClosedConnections(); len(conns[0].Subs) != 1 {
+		t.Fatalf("Unexpected closed connection: %+v", conns[0])
+	}
+
+	// Shrinking the history keeps the most recent ones.
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(`
+		listen: "127.0.0.1:-1"
+		max_closed_clients: 2
+		authorization { user: u, password: pwd }
+	`))
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	conns = s.ClosedConnections()
+	if len(conns) != 2 || conns[0].Cid != 4 || conns[1].Cid != 5 {
+		t.Fatalf("Unexpected closed connections: %+v", conns)
+	}
+	checkTotalClosedConns(t, s, 5, time.Second)
+
+	o := DefaultOptions()
+	o.MaxClosedClients = -1
+	if err := validateOptions(o); err == nil || !strings.Contains(err.Error(), "max_closed_clients") {
+		t.Fatalf("Expected an error about max_closed_clients, got %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync/atomic"
+)
+
+// Route compression modes.
+const (
+	// CompressionOff disables compression.
+	CompressionOff = "off"
+	// CompressionFast favors speed over compression ratio.
+	CompressionFast = "fast"
+	// CompressionBest favors compression ratio over speed.
+	CompressionBest = "best"
+)
+
+// Returned by the parser when the remote signals that everything that
+// follows in the stream is compressed.
+var errRouteCompressionStarted = errors.New("route compression started")
+
+// Returns the normalized compression mode or an error if invalid.
+// An empty mode is the same as CompressionOff.
+func validateCompressionMode(mode string) (string, error) {
+	switch m := strings.ToLower(mode); m {
+	case _EMPTY_, CompressionOff, "disabled", "none":
+		return CompressionOff, nil
+	case CompressionFast, CompressionBest:
+		return m, nil
+	default:
+		return _EMPTY_, fmt.Errorf("invalid compression mode %q, should be one of %q, %q or %q",
+			mode, CompressionOff, CompressionFast, CompressionBest)
+	}
+}
+
+// Returns true if both the local and remote compression modes allow
+// compression to be used.
+func compressionNegotiated(local, remote string) bool {
+	return local != _EMPTY_ && local != CompressionOff &&
+		remote != _EMPTY_ && remote != CompressionOff
+}
+
+func compressionLevel(mode string) int {
+	if strings.EqualFold(mode, CompressionBest) {
+		return flate.BestCompression
+	}
+	return flate.BestSpeed
+}
+
+// compressionStats holds the number of bytes before and after
+// compression in each direction. Access is atomic.
+type compressionStats struct {
+	inRaw   int64
+	inWire  int64
+	outRaw  int64
+	outWire int64
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddInt64(cr.n, int64(n))
+	return n, err
+}
+
+// compressWriter is used in place of the connection by flushOutbound
+// once compression has been started. The first `plain` bytes are the
+// ones that were queued before and including the compression start
+// INFO and are written as-is, everything after that is compressed.
+// Writes are serialized by flushOutbound.
+type compressWriter struct {
+	nc    net.Conn
+	plain int64
+	fw    *flate.Writer
+	stats *compressionStats
+}
+
+func newCompressWriter(nc net.Conn, plain int64, mode string, stats *compressionStats) *compressWriter {
+	fw, _ := flate.NewWriter(&countingWriter{w: nc, n: &stats.outWire}, compressionLevel(mode))
+	return &compressWriter{nc: nc, plain: plain, fw: fw, stats: stats}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	var n int
+	if cw.plain > 0 {
+		k := len(p)
+		if int64(k) > cw.plain {
+			k = int(cw.plain)
+		}
+		wn, err := cw.nc.Write(p[:k])
+		cw.plain -= int64(wn)
+		n += wn
+		if err != nil {
+			return n, err
+		}
+		p = p[k:]
+	}
+	if len(p) == 0 {
+		return n, nil
+	}
+	if _, err := cw.fw.Write(p); err != nil {
+		return n, err
+	}
+	if err := cw.fw.Flush(); err != nil {
+		return n, err
+	}
+	atomic.AddInt64(&cw.stats.outRaw, int64(len(p)))
+	return n + len(p), nil
+}
+
+// decompressReader is used by the readLoop in place of the connection
+// once the remote has started compression. The pending bytes are the
+// ones that were read from the connection past the compression start
+// INFO and are therefore already compressed.
+type decompressReader struct {
+	fr    io.ReadCloser
+	stats *compressionStats
+}
+
+func newDecompressReader(nc net.Conn, pending []byte, stats *compressionStats) *decompressReader {
+	atomic.AddInt64(&stats.inWire, int64(len(pending)))
+	src := io.MultiReader(bytes.NewReader(pending), &countingReader{r: nc, n: &stats.inWire})
+	return &decompressReader{fr: flate.NewReader(src), stats: stats}
+}
+
+func (dr *decompressReader) Read(p []byte) (int, error) {
+	n, err := dr.fr.Read(p)
+	atomic.AddInt64(&dr.stats.inRaw, int64(n))
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Starts compressing the outbound traffic of this route. An INFO signaling
+// the start of compression is queued and all data queued after it will be
+// compressed. Lock is held on entry.
+func (c *client) startRouteCompression() {
+	// Wait for any flush in progress to complete so that the number of
+	// pending bytes matches what the compress writer will be handed.
+	for c.flags.isSet(flushOutbound) {
+		c.mu.Unlock()
+		runtime.Gosched()
+		c.mu.Lock()
+	}
+	if c.nc == nil || c.route == nil || c.route.cw != nil {
+		return
+	}
+	info := Info{ID: c.srv.info.ID, CompressionStart: true}
+	b, _ := json.Marshal(&info)
+	c.queueOutbound([]byte(fmt.Sprintf(InfoProto, b)))
+	c.route.cw = newCompressWriter(c.nc, int64(c.out.pb), c.route.compression, &c.route.cstats)
+	c.Debugf("Route compression %q started", c.route.compression)
+	c.flushSignal()
+}
+
+// Invoked by the parser after processing a route INFO. If this INFO was
+// signaling the start of compression, a copy of the remaining bytes, which
+// are compressed, is saved and true is returned.
+func (c *client) checkRouteDecompress(rem []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.route == nil || !c.route.dstart {
+		return false
+	}
+	c.route.dstart = false
+	c.route.dpending = append([]byte(nil), rem...)
+	return true
+}
+
+// Returns the reader the readLoop should use once the remote has
+// started compression.
+func (c *client) routeDecompressReader(nc net.Conn) io.Reader {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dr := newDecompressReader(nc, c.route.dpending, &c.route.cstats)
+	c.route.dpending = nil
+	return dr
+}
@@ -0,0 +1,180 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Certificates expiring within this period are reported with a warning.
+const configCheckCertExpiryWarning = 30 * 24 * time.Hour
+
+// ConfigCheckReport is the result of the validation of a configuration file.
+type ConfigCheckReport struct {
+	Warnings []error
+	Errors   []error
+}
+
+// Valid returns true if no error was reported.
+func (r *ConfigCheckReport) Valid() bool {
+	return len(r.Errors) == 0
+}
+
+func (r *ConfigCheckReport) warnf(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Errorf(format, args...))
+}
+
+func (r *ConfigCheckReport) errorf(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Errorf(format, args...))
+}
+
+// CheckConfigFile parses the configuration file and validates the resulting
+// options as the server would when starting, without starting any listener.
+// It also checks that the certificates and the operator JWTs are not expired.
+// An account resolver URL that can not be reached is reported when parsing.
+func CheckConfigFile(configFile string) *ConfigCheckReport {
+	r := &ConfigCheckReport{}
+	opts := &Options{CheckConfig: true}
+	if err := opts.ProcessConfigFile(configFile); err != nil {
+		cerr, ok := err.(*processConfigErr)
+		if !ok {
+			r.Errors = append(r.Errors, err)
+			return r
+		}
+		r.Warnings = append(r.Warnings, cerr.Warnings()...)
+		r.Errors = append(r.Errors, cerr.Errors()...)
+		// The options are incomplete, no point checking further.
+		if len(r.Errors) > 0 {
+			return r
+		}
+	}
+	setBaselineOptions(opts)
+	if err := validateOptions(opts); err != nil {
+		r.Errors = append(r.Errors, err)
+	}
+	r.checkListeners(opts)
+	r.checkLimits(opts)
+	r.checkCertificates(opts, time.Now())
+	r.checkOperators(opts, time.Now())
+	return r
+}
+
+// Reports listeners configured on the same address.
+func (r *ConfigCheckReport) checkListeners(o *Options) {
+	type listener struct {
+		name string
+		host string
+		port int
+	}
+	listeners := []listener{
+		{"client", o.Host, o.Port},
+		{"monitoring", o.HTTPHost, o.HTTPPort},
+		{"monitoring (https)", o.HTTPHost, o.HTTPSPort},
+		{"cluster", o.Cluster.Host, o.Cluster.Port},
+		{"gateway", o.Gateway.Host, o.Gateway.Port},
+		{"leafnode", o.LeafNode.Host, o.LeafNode.Port},
+		{"leafnode websocket", o.LeafNode.Websocket.Host, o.LeafNode.Websocket.Port},
+		{"websocket", o.Websocket.Host, o.Websocket.Port},
+		{"mqtt", o.MQTT.Host, o.MQTT.Port},
+		{"stomp", o.STOMP.Host, o.STOMP.Port},
+		{"http bridge", o.HTTPBridge.Host, o.HTTPBridge.Port},
+	}
+	isAny := func(host string) bool {
+		return host == _EMPTY_ || host == "0.0.0.0" || host == "::"
+	}
+	for i, l1 := range listeners {
+		// Random ports can not conflict.
+		if l1.port <= 0 {
+			continue
+		}
+		for _, l2 := range listeners[i+1:] {
+			if l2.port != l1.port || (l1.host != l2.host && !isAny(l1.host) && !isAny(l2.host)) {
+				continue
+			}
+			r.errorf("%s and %s listeners both use %s", l1.name, l2.name,
+				net.JoinHostPort(l2.host, strconv.Itoa(l2.port)))
+		}
+	}
+}
+
+// Reports limits that conflict with each other.
+func (r *ConfigCheckReport) checkLimits(o *Options) {
+	if o.MaxPending > 0 && int64(o.MaxPayload) > o.MaxPending {
+		r.warnf("max_payload (%d) is larger than max_pending (%d)", o.MaxPayload, o.MaxPending)
+	}
+	if o.MaxControlLine > 0 && o.MaxControlLine > o.MaxPayload {
+		r.warnf("max_control_line (%d) is larger than max_payload (%d)", o.MaxControlLine, o.MaxPayload)
+	}
+}
+
+// Reports certificates that are expired, not yet valid, or expiring soon.
+func (r *ConfigCheckReport) checkCertificates(o *Options, now time.Time) {
+	configs := []struct {
+		name string
+		tc   *tls.Config
+	}{
+		{"tls", o.TLSConfig},
+		{"cluster tls", o.Cluster.TLSConfig},
+		{"gateway tls", o.Gateway.TLSConfig},
+		{"leafnode tls", o.LeafNode.TLSConfig},
+		{"leafnode websocket tls", o.LeafNode.Websocket.TLSConfig},
+		{"websocket tls", o.Websocket.TLSConfig},
+		{"mqtt tls", o.MQTT.TLSConfig},
+		{"stomp tls", o.STOMP.TLSConfig},
+		{"http bridge tls", o.HTTPBridge.TLSConfig},
+	}
+	for _, rl := range o.LeafNode.Remotes {
+		configs = append(configs, struct {
+			name string
+			tc   *tls.Config
+		}{fmt.Sprintf("leafnode remote %q tls", rl.LocalAccount), rl.TLSConfig})
+	}
+	for _, c := range configs {
+		if c.tc == nil {
+			continue
+		}
+		for _, cert := range c.tc.Certificates {
+			if len(cert.Certificate) == 0 {
+				continue
+			}
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				r.errorf("%s: error parsing certificate: %v", c.name, err)
+				continue
+			}
+			switch {
+			case now.After(leaf.NotAfter):
+				r.errorf("%s: certificate %q expired on %v", c.name, leaf.Subject.CommonName, leaf.NotAfter)
+			case now.Before(leaf.NotBefore):
+				r.errorf("%s: certificate %q not valid before %v", c.name, leaf.Subject.CommonName, leaf.NotBefore)
+			case leaf.NotAfter.Sub(now) < configCheckCertExpiryWarning:
+				r.warnf("%s: certificate %q expires on %v", c.name, leaf.Subject.CommonName, leaf.NotAfter)
+			}
+		}
+	}
+}
+
+// Reports trusted operators whose JWT is expired.
+func (r *ConfigCheckReport) checkOperators(o *Options, now time.Time) {
+	for _, opc := range o.TrustedOperators {
+		if opc.Expires > 0 && now.Unix() > opc.Expires {
+			r.errorf("operator %q JWT expired on %v", opc.Name, time.Unix(opc.Expires, 0))
+		}
+	}
+}
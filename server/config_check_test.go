@@ -16,9 +16,17 @@ package server
 import (
 	"errors"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	gotoken "go/token"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nkeys"
 )
 
 func TestConfigCheck(t *testing.T) {
@@ -1211,3 +1219,181 @@ func TestConfigCheckMultipleErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestConfigCheckFile(t *testing.T) {
+	okp, _ := nkeys.CreateOperator()
+	opub, _ := okp.PublicKey()
+	oc := jwt.NewOperatorClaims(opub)
+	oc.Name = "O"
+	oc.Expires = time.Now().Add(-time.Hour).Unix()
+	ojwt, err := oc.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error encoding operator: %v", err)
+	}
+	operator := createConfFile(t, []byte(ojwt))
+	defer os.Remove(operator)
+
+	for _, test := range []struct {
+		name     string
+		config   string
+		warnings []string
+		errors   []string
+	}{
+		{"valid", `
+			listen: 127.0.0.1:-1
+			max_payload: 1MB
+		`, nil, nil},
+		{"parse errors", `
+			listen: 127.0.0.1:-1
+			monitoring_port: 8222
+		`, nil, []string{`unknown field "monitoring_port"`}},
+		{"conflicts", `
+			listen: 127.0.0.1:4555
+			http: 0.0.0.0:4555
+			max_payload: 2MB
+			max_pending: 1MB
+		`, []string{"max_payload (2097152) is larger than max_pending (1048576)"},
+			[]string{"client and monitoring listeners both use 0.0.0.0:4555"}},
+		{"expired certificate", `
+			listen: 127.0.0.1:-1
+			tls {
+				cert_file: "./configs/certs/cert.new.pem"
+				key_file: "./configs/certs/key.new.pem"
+			}
+		`, nil, []string{`tls: certificate "nats.io/emailAddress=derek@nats.io" expired`}},
+		{"expired operator", fmt.Sprintf(`
+			listen: 127.0.0.1:-1
+			operator: %q
+			resolver: MEMORY
+		`, operator), nil, []string{`operator "O" JWT expired`}},
+		{"unreachable resolver", fmt.Sprintf(`
+			listen: 127.0.0.1:-1
+			operator: %q
+			resolver: URL("http://127.0.0.1:1/jwt/v1/accounts/")
+		`, operator), nil, []string{"could not fetch"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(test.config))
+			defer os.Remove(conf)
+
+			check := func(kind string, errs []error, expected []string) {
+				t.Helper()
+				if len(errs) != len(expected) {
+					t.Fatalf("Expected %d %s, got %v", len(expected), kind, errs)
+				}
+				for i, err := range errs {
+					if !strings.Contains(err.Error(), expected[i]) {
+						t.Fatalf("Expected %s %q, got %q", kind, expected[i], err)
+					}
+				}
+			}
+			r := CheckConfigFile(conf)
+			check("warnings", r.Warnings, test.warnings)
+			check("errors", r.Errors, test.errors)
+			if r.Valid() != (len(test.errors) == 0) {
+				t.Fatalf("Unexpected validity of the report: %+v", r)
+			}
+		})
+	}
+}
+
+func TestConfigCheckUnknownFieldSuggestion(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: 127.0.0.1:-1
+		autorization {
+			user: foo
+		}
+		cluster {
+			listen: 127.0.0.1:-1
+			routs: []
+		}
+		peers: 1
+	`))
+	defer os.Remove(conf)
+
+	opts := &Options{}
+	err := opts.ProcessConfigFile(conf)
+	cerr, ok := err.(*processConfigErr)
+	if !ok {
+		t.Fatalf("Expected a configuration process error, got %v", err)
+	}
+	if len(cerr.Errors()) != 3 || len(cerr.Warnings()) != 0 {
+		t.Fatalf("Expected 3 errors and no warning, got %q", err)
+	}
+	for _, expected := range []string{
+		fmt.Sprintf(`%s:3:3: unknown field "autorization", did you mean "authorization"?`, conf),
+		fmt.Sprintf(`%s:8:4: unknown field "routs", did you mean "routes"?`, conf),
+		fmt.Sprintf(`%s:10:3: unknown field "peers"`+"\n", conf),
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("Expected %q in %q", expected, err)
+		}
+	}
+
+	// Unknown fields can be reported as warnings.
+	conf2 := createConfFile(t, []byte(`
+		listen: 127.0.0.1:-1
+		unknown_fields: warn
+		autorization {
+			user: foo
+		}
+		lame_duck_duration: abc
+	`))
+	defer os.Remove(conf2)
+	err = (&Options{}).ProcessConfigFile(conf2)
+	cerr, ok = err.(*processConfigErr)
+	if !ok {
+		t.Fatalf("Expected a configuration process error, got %v", err)
+	}
+	if len(cerr.Errors()) != 1 || len(cerr.Warnings()) != 1 {
+		t.Fatalf("Expected 1 error and 1 warning, got %q", err)
+	}
+	if _, ok := cerr.Warnings()[0].(*unknownConfigFieldErr); !ok {
+		t.Fatalf("Expected unknown field warning, got %v", cerr.Warnings()[0])
+	}
+}
+
+// The names of the fields used for suggestions need to match the ones
+// handled when processing the configuration.
+func TestConfigFieldNamesInSync(t *testing.T) {
+	f, err := parser.ParseFile(gotoken.NewFileSet(), "opts.go", nil, 0)
+	if err != nil {
+		t.Fatalf("Error parsing opts.go: %v", err)
+	}
+	handled := make(map[string]struct{})
+	ast.Inspect(f, func(n ast.Node) bool {
+		sw, ok := n.(*ast.SwitchStmt)
+		if !ok {
+			return true
+		}
+		// Fields are matched with switch strings.ToLower(k) or (mk).
+		call, ok := sw.Tag.(*ast.CallExpr)
+		if !ok || len(call.Args) != 1 {
+			return true
+		}
+		if id, ok := call.Args[0].(*ast.Ident); !ok || (id.Name != "k" && id.Name != "mk") {
+			return true
+		}
+		for _, s := range sw.Body.List {
+			for _, e := range s.(*ast.CaseClause).List {
+				if bl, ok := e.(*ast.BasicLit); ok {
+					name, _ := strconv.Unquote(bl.Value)
+					handled[name] = struct{}{}
+				}
+			}
+		}
+		return true
+	})
+	known := make(map[string]struct{}, len(configFieldNames))
+	for _, name := range configFieldNames {
+		known[name] = struct{}{}
+		if _, ok := handled[name]; !ok {
+			t.Errorf("Field %q is not handled in opts.go", name)
+		}
+	}
+	for name := range handled {
+		if _, ok := known[name]; !ok {
+			t.Errorf("Field %q is missing from configFieldNames", name)
+		}
+	}
+}
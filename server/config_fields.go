@@ -0,0 +1,144 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "fmt"
+
+// configFieldNames are the names of the fields of all the blocks of the
+// configuration, used to suggest a name for an unknown field. It has to be
+// kept in sync with the fields handled when processing the configuration.
+var configFieldNames = []string{
+	"accept_loops", "access_key", "access_key_id", "account",
+	"account_error_threshold",
+	"account_error_window", "account_rate_limits", "account_resolver",
+	"account_template", "accounts", "accounts_resolver", "advertise", "allow",
+	"allow_origin", "allow_origins", "allowed_origin", "allowed_origins",
+	"authorization", "auto_max_procs", "batch_delay", "batch_size",
+	"batching", "bucket", "buffer_growth", "burst", "ca_file",
+	"cert_file", "cipher", "cipher_suites", "client_advertise", "cluster",
+	"cluster_advertise", "coalesce", "coalesce_delay", "compression",
+	"connect_error_reports",
+	"connect_retries", "connect_urls_order", "cpu_affinity", "credentials",
+	"creds",
+	"curve_preferences", "debug",
+	"default_permission", "default_permissions", "deny", "dns_refresh",
+	"dns_routes", "ek", "enable", "enabled", "encryption_key", "endpoint",
+	"expected_ou", "expected_ous", "expected_san", "expected_sans", "export",
+	"exports", "flush_interval", "gateway", "gateways", "handshake_timeout",
+	"headers", "host", "http", "http_bridge", "http_port", "https",
+	"https_port", "idle_timeout", "import", "imports", "insecure",
+	"jetstream", "jwt_cookie", "keep_alive", "keep_alive_count",
+	"keep_alive_interval", "keepalive", "key", "key_file",
+	"lame_duck_duration", "leaf", "leafnode_advertise",
+	"leafnodes", "listen", "load_hints", "load_hints_interval", "local",
+	"log_compress", "log_file",
+	"log_file_format", "log_format", "log_max_age", "log_max_backups",
+	"log_size_limit", "logfile", "logfile_compress", "logfile_format",
+	"logfile_max_age", "logfile_max_backups", "logfile_max_num",
+	"logfile_size_limit", "logtime", "max_ack_pending", "max_buffer_size",
+	"max_closed_clients",
+	"max_closed_connections", "max_conn", "max_connections",
+	"max_connections_per_ip", "max_connections_per_user", "max_consumers",
+	"max_control_line", "max_file", "max_file_store", "max_mem",
+	"max_mem_store", "max_memory_store", "max_payload", "max_pending",
+	"max_procs", "max_streams", "max_total_pending", "max_subs", "max_subscriptions", "max_vectors",
+	"min_buffer_size", "monitor_port", "mqtt",
+	"name", "net", "nkey", "no_advertise", "no_auth_user", "no_delay",
+	"no_tls", "nodelay", "operator",
+	"operators", "origin", "origins", "otel", "outbound", "pass", "password",
+	"permission",
+	"permissions", "pid_file", "pidfile", "ping_interval", "ping_max",
+	"poller", "poller_workers",
+	"pool_size", "port", "ports_file", "ports_file_dir", "prefix", "prev_encryption_key",
+	"prev_key", "prof", "prof_port", "proxy", "pub", "publish",
+	"queue_local_preference", "rate", "read_buffer",
+	"rate_limit", "reconnect", "reconnect_error_reports", "reconnect_interval",
+	"reconnect_jitter", "reconnect_max_backoff", "region", "reject_unknown",
+	"remote_syslog", "remote_syslog_buffer", "remote_syslog_tls", "remotes",
+	"request_timeout", "resolver", "resolver_preload", "root", "root_operator",
+	"root_operators", "roots", "routes", "same_origin", "secret_access_key",
+	"secret_key", "server_tags", "service", "service_name", "stall_timeout",
+	"statsz_interval", "sticky_queues", "stomp", "store", "store_dir",
+	"storedir", "stream",
+	"sub", "subject", "subscribe", "syslog", "syslog_backend", "syslog_format",
+	"syslog_name", "system", "system_account", "tags", "tcp", "tier", "tiered_storage",
+	"timeout", "tls", "to", "token", "trace", "trusted", "trusted_keys",
+	"unknown_fields", "url", "urls", "user", "username", "users", "verify",
+	"verify_and_map", "websocket", "write_buffer", "write_deadline", "ws",
+}
+
+// Returns a suggestion for an unknown configuration field, in the form
+// `, did you mean "field"?`, or an empty string if no field is close enough.
+func configFieldSuggestion(field string) string {
+	best, bestDist, bestPrefix := _EMPTY_, 0, 0
+	for _, name := range configFieldNames {
+		d := levenshtein(field, name)
+		// On a tie, prefer the name sharing the longest prefix.
+		p := commonPrefixLen(field, name)
+		if best == _EMPTY_ || d < bestDist || (d == bestDist && p > bestPrefix) {
+			best, bestDist, bestPrefix = name, d, p
+		}
+	}
+	// Allow one typo every four characters, at least one and no more than two.
+	allowed := len(field) / 4
+	if allowed < 1 {
+		allowed = 1
+	} else if allowed > 2 {
+		allowed = 2
+	}
+	if best == _EMPTY_ || bestDist == 0 || bestDist > allowed {
+		return _EMPTY_
+	}
+	return fmt.Sprintf(", did you mean %q?", best)
+}
+
+// Returns the edit distance between the two strings.
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// Returns the length of the common prefix of the two strings.
+func commonPrefixLen(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
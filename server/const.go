@@ -26,9 +26,9 @@ const (
 	CommandQuit   = Command("quit")
 	CommandReopen = Command("reopen")
 	CommandReload = Command("reload")
-
-	// private for now
-	commandLDMode = Command("ldm")
+	CommandRotate = Command("rotate")
+	CommandLDMode = Command("ldm")
+	CommandTerm   = Command("term")
 )
 
 var (
@@ -112,6 +112,15 @@ const (
 	// DEFAULT_ROUTE_DIAL Route dial timeout.
 	DEFAULT_ROUTE_DIAL = 1 * time.Second
 
+	// DEFAULT_ROUTE_RECONNECT_JITTER Maximum random delay added to route reconnects.
+	DEFAULT_ROUTE_RECONNECT_JITTER = 100 * time.Millisecond
+
+	// DEFAULT_ROUTE_DNS_REFRESH Interval at which DNS routes are resolved again.
+	DEFAULT_ROUTE_DNS_REFRESH = 30 * time.Second
+
+	// DEFAULT_LOAD_HINTS_INTERVAL Interval at which the servers of a cluster exchange their load.
+	DEFAULT_LOAD_HINTS_INTERVAL = 5 * time.Second
+
 	// DEFAULT_LEAF_NODE_RECONNECT LeafNode reconnect interval.
 	DEFAULT_LEAF_NODE_RECONNECT = time.Second
 
@@ -137,6 +146,10 @@ const (
 	// the closing of clients when signaled to go in lame duck mode.
 	DEFAULT_LAME_DUCK_DURATION = 2 * time.Minute
 
+	// DEFAULT_ACCOUNT_ERROR_WINDOW is the default window in which account
+	// errors are counted against the account error threshold.
+	DEFAULT_ACCOUNT_ERROR_WINDOW = time.Minute
+
 	// DEFAULT_LEAFNODE_INFO_WAIT Route dial timeout.
 	DEFAULT_LEAFNODE_INFO_WAIT = 1 * time.Second
 
@@ -149,6 +162,10 @@ const (
 	// The default is to report every 3600 attempts (roughly every hour).
 	DEFAULT_CONNECT_ERROR_REPORTS = 3600
 
+	// DEFAULT_SYSTEM_ACCOUNT is the name of the account that is used as the
+	// system account in config mode when none is explicitly configured.
+	DEFAULT_SYSTEM_ACCOUNT = "$SYS"
+
 	// DEFAULT_RECONNECT_ERROR_REPORTS is the default number of failed
 	// attempt to reconnect a route, gateway or leaf node connection.
 	// The default is to report every attempt.
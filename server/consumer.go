@@ -0,0 +1,1405 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+// ConsumerConfig determines how messages of a stream are delivered to
+// a consumer. Consumers with a deliver subject are push based, the
+// others are pull based and require a durable name.
+type ConsumerConfig struct {
+	Durable        string        `json:"durable_name,omitempty"`
+	DeliverSubject string        `json:"deliver_subject,omitempty"`
+	DeliverPolicy  DeliverPolicy `json:"deliver_policy"`
+	OptStartSeq    uint64        `json:"opt_start_seq,omitempty"`
+	OptStartTime   *time.Time    `json:"opt_start_time,omitempty"`
+	AckPolicy      AckPolicy     `json:"ack_policy"`
+	AckWait        time.Duration `json:"ack_wait,omitempty"`
+	MaxDeliver     int           `json:"max_deliver,omitempty"`
+	FilterSubject  string        `json:"filter_subject,omitempty"`
+	// Stream the messages reaching the maximum deliveries are moved to.
+	DeadLetterStream string `json:"dead_letter_stream,omitempty"`
+	// Push consumers only. With flow control the delivery stalls until
+	// the client answers the flow control requests, and idle heartbeats
+	// are sent when there are no messages to deliver.
+	FlowControl bool          `json:"flow_control,omitempty"`
+	Heartbeat   time.Duration `json:"idle_heartbeat,omitempty"`
+}
+
+// ConsumerInfo shows the config and delivery state of a consumer.
+type ConsumerInfo struct {
+	Stream         string         `json:"stream_name"`
+	Name           string         `json:"name"`
+	Created        time.Time      `json:"created"`
+	Config         ConsumerConfig `json:"config"`
+	Delivered      SequencePair   `json:"delivered"`
+	AckFloor       SequencePair   `json:"ack_floor"`
+	NumAckPending  int            `json:"num_ack_pending"`
+	NumScheduled   int            `json:"num_scheduled,omitempty"`
+	NumRedelivered int            `json:"num_redelivered"`
+	NumWaiting     int            `json:"num_waiting"`
+	NumPending     uint64         `json:"num_pending"`
+	// The delivery is stalled waiting for a flow control response.
+	Stalled bool `json:"stalled,omitempty"`
+}
+
+// CreateConsumerRequest is the request to create a consumer.
+type CreateConsumerRequest struct {
+	Stream string         `json:"stream_name"`
+	Config ConsumerConfig `json:"config"`
+}
+
+// AckPolicy determines how the consumer should acknowledge delivered messages.
+type AckPolicy int
+
+const (
+	// AckNone requires no acks for delivered messages.
+	AckNone AckPolicy = iota
+	// AckAll when acking a sequence number, this implicitly acks all
+	// sequences below this one as well.
+	AckAll
+	// AckExplicit requires ack or nack for all messages.
+	AckExplicit
+)
+
+// DeliverPolicy determines where in the stream a consumer starts.
+type DeliverPolicy int
+
+const (
+	// DeliverAll will be the default so can be omitted from the request.
+	DeliverAll DeliverPolicy = iota
+	// DeliverLast will start the consumer with the last message.
+	DeliverLast
+	// DeliverNew will only deliver new messages that are sent
+	// after the consumer is created.
+	DeliverNew
+	// DeliverByStartSequence will look for a defined starting sequence.
+	DeliverByStartSequence
+	// DeliverByStartTime will select the first message at or after
+	// the defined start time.
+	DeliverByStartTime
+	// DeliverLastPerSubject will start with the last message of each
+	// subject, followed by new messages.
+	DeliverLastPerSubject
+)
+
+// Acknowledgement bodies. An empty body is the same as AckAck.
+var (
+	// AckAck acknowledges the message.
+	AckAck = []byte("+ACK")
+	// AckNak asks for the message to be redelivered right away.
+	AckNak = []byte("-NAK")
+	// AckProgress signals that the message is being worked on and
+	// resets the ack wait timer.
+	AckProgress = []byte("+WPI")
+	// AckNext acknowledges the message and requests the next one to be
+	// delivered to the reply subject. Pull consumers only.
+	AckNext = []byte("+NXT")
+	// AckTerm stops the redelivery of the message without acking it.
+	AckTerm = []byte("+TERM")
+)
+
+const (
+	// JsAckWaitDefault is the default ack wait.
+	JsAckWaitDefault = 30 * time.Second
+
+	// Reply subject of delivered messages: stream, consumer, delivery
+	// count, stream sequence, consumer sequence and timestamp.
+	jsAckT   = "$JS.ACK.%s.%s.%d.%d.%d.%d"
+	jsAckPre = "$JS.ACK"
+
+	// Maximum number of waiting pull requests. The oldest are
+	// dropped after that.
+	jsMaxWaitingRequests = 512
+
+	// Ephemeral consumers are removed once their deliver subject has
+	// had no interest for this long.
+	jsEphemeralInactiveThreshold = 5 * time.Second
+
+	// File holding the configuration of a durable consumer.
+	consumerMetaFile = "meta.json"
+)
+
+var (
+	// ErrJetStreamConsumerNotFound is returned when a consumer does not exist.
+	ErrJetStreamConsumerNotFound = errors.New("consumer not found")
+	// ErrJetStreamConsumerExists is returned when creating a durable
+	// consumer that exists with a different configuration.
+	ErrJetStreamConsumerExists = errors.New("consumer already exists")
+	// ErrJetStreamMaxConsumers is returned when the maximum number of
+	// consumers of the stream is reached.
+	ErrJetStreamMaxConsumers = errors.New("maximum consumers limit reached")
+)
+
+// Stored in the consumer directory for durable consumers of file
+// based streams.
+type consumerMeta struct {
+	Config  ConsumerConfig `json:"config"`
+	Created time.Time      `json:"created"`
+}
+
+// A pull request waiting for messages.
+type waitingRequest struct {
+	reply string
+	n     int
+}
+
+// Consumer delivers the messages of a stream and tracks their
+// acknowledgements.
+type Consumer struct {
+	mu      sync.Mutex
+	mset    *Stream
+	mstore  StreamStore
+	jsa     *jsAccount
+	stream  string
+	name    string
+	cfg     ConsumerConfig
+	created time.Time
+	store   ConsumerStore
+	// Next consumer and stream sequences to deliver.
+	dseq uint64
+	sseq uint64
+	// Ack floors.
+	adflr   uint64
+	asflr   uint64
+	pending map[uint64]*Pending
+	rdc     map[uint64]uint64
+	rdq     []uint64
+	// Last message of each subject, delivered first with the last per
+	// subject policy.
+	lps  []uint64
+	ptmr *time.Timer
+	// Delayed messages are pending with no delivery sequence until
+	// due, the timer fires at dnext.
+	dtmr    *time.Timer
+	dnext   int64
+	waiting []*waitingRequest
+	ackSub  *subscription
+	reqSub  *subscription
+	itmr    *time.Timer
+	mch     chan struct{}
+	qch     chan struct{}
+	closed  bool
+	// Messages are delivered while active, which for replicated streams
+	// is only on the leader. The channel is closed when deactivated.
+	active bool
+	lch    chan struct{}
+	// The state changed since it was last replicated.
+	sdirty bool
+	// Flow control: bytes delivered not covered by a flow control
+	// response, and the outstanding request with the bytes it covers.
+	pbytes int
+	fcid   string
+	fcsz   int
+	fcn    uint64
+	fcSub  *subscription
+	// Idle heartbeats and stall checks, ldt is the last delivery time.
+	hbtmr *time.Timer
+	ldt   int64
+}
+
+// Checks the configuration against the stream and fills in defaults.
+// Stream lock should be held.
+func (mset *Stream) checkConsumerCfg(config *ConsumerConfig) (ConsumerConfig, error) {
+	if config == nil {
+		return ConsumerConfig{}, fmt.Errorf("consumer config required")
+	}
+	cfg := *config
+	if cfg.Durable != _EMPTY_ && !isValidName(cfg.Durable) {
+		return cfg, fmt.Errorf("consumer durable name can not contain '.', '*', '>'")
+	}
+	if cfg.DeliverSubject == _EMPTY_ {
+		if cfg.Durable == _EMPTY_ {
+			return cfg, fmt.Errorf("consumer in pull mode requires a durable name")
+		}
+		if cfg.AckPolicy != AckExplicit {
+			return cfg, fmt.Errorf("consumer in pull mode requires explicit ack policy")
+		}
+		if cfg.FlowControl || cfg.Heartbeat != 0 {
+			return cfg, fmt.Errorf("consumer in pull mode can not have flow control or idle heartbeats")
+		}
+	} else {
+		if !IsValidLiteralSubject(cfg.DeliverSubject) {
+			return cfg, fmt.Errorf("consumer deliver subject is not a valid subject")
+		}
+		for _, subj := range mset.config.Subjects {
+			if subjectsCollide(cfg.DeliverSubject, subj) {
+				return cfg, fmt.Errorf("consumer deliver subject forms a cycle")
+			}
+		}
+	}
+	if cfg.AckWait < 0 {
+		return cfg, fmt.Errorf("consumer ack wait can not be negative")
+	} else if cfg.AckWait == 0 {
+		cfg.AckWait = JsAckWaitDefault
+	}
+	if cfg.MaxDeliver == 0 {
+		cfg.MaxDeliver = -1
+	}
+	if cfg.Heartbeat < 0 {
+		return cfg, fmt.Errorf("consumer idle heartbeat can not be negative")
+	}
+	if cfg.DeadLetterStream != _EMPTY_ {
+		if !isValidName(cfg.DeadLetterStream) {
+			return cfg, fmt.Errorf("consumer dead letter stream name can not contain '.', '*', '>'")
+		}
+		if cfg.DeadLetterStream == mset.config.Name {
+			return cfg, fmt.Errorf("consumer dead letter stream can not be its own stream")
+		}
+		if cfg.MaxDeliver < 0 {
+			return cfg, fmt.Errorf("consumer dead letter stream requires max deliver")
+		}
+	}
+	switch cfg.DeliverPolicy {
+	case DeliverAll, DeliverLast, DeliverNew, DeliverLastPerSubject:
+		if cfg.OptStartSeq > 0 || cfg.OptStartTime != nil {
+			return cfg, fmt.Errorf("consumer deliver policy %v does not take a start sequence or time", cfg.DeliverPolicy)
+		}
+	case DeliverByStartSequence:
+		if cfg.OptStartSeq == 0 || cfg.OptStartTime != nil {
+			return cfg, fmt.Errorf("consumer deliver policy requires a start sequence only")
+		}
+	case DeliverByStartTime:
+		if cfg.OptStartTime == nil || cfg.OptStartSeq > 0 {
+			return cfg, fmt.Errorf("consumer deliver policy requires a start time only")
+		}
+	default:
+		return cfg, fmt.Errorf("consumer deliver policy invalid")
+	}
+	if cfg.FilterSubject != _EMPTY_ {
+		match := false
+		for _, subj := range mset.config.Subjects {
+			if subjectIsSubsetMatch(cfg.FilterSubject, subj) {
+				match = true
+				break
+			}
+		}
+		// Or the subjects the messages are stored with.
+		if tr := mset.sxform; !match && tr != nil {
+			match = subjectIsSubsetMatch(cfg.FilterSubject, tr.pattern())
+		}
+		if !match {
+			return cfg, fmt.Errorf("consumer filter subject is not a valid subset of the interest subjects")
+		}
+	}
+	if mset.config.Retention == WorkQueuePolicy {
+		if cfg.AckPolicy != AckExplicit {
+			return cfg, fmt.Errorf("workqueue stream requires explicit ack")
+		}
+		for _, o := range mset.consumers {
+			if o.name == cfg.Durable {
+				continue
+			}
+			ofilter := o.cfg.FilterSubject
+			if cfg.FilterSubject == _EMPTY_ || ofilter == _EMPTY_ || subjectsCollide(cfg.FilterSubject, ofilter) {
+				return cfg, fmt.Errorf("multiple consumers with overlapping filters not allowed on workqueue stream")
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// AddConsumer adds a consumer to the stream. Creating a durable consumer
+// that exists with the same configuration returns the existing one.
+func (mset *Stream) AddConsumer(config *ConsumerConfig) (*Consumer, error) {
+	return mset.addConsumer(config, _EMPTY_, time.Now().UTC())
+}
+
+// Adds the consumer. Ephemeral consumers are given a unique name, unless
+// one is provided as is the case for replicated streams.
+func (mset *Stream) addConsumer(config *ConsumerConfig, name string, created time.Time) (*Consumer, error) {
+	mset.mu.Lock()
+	if mset.closed {
+		mset.mu.Unlock()
+		return nil, ErrStoreClosed
+	}
+	cfg, err := mset.checkConsumerCfg(config)
+	if err != nil {
+		mset.mu.Unlock()
+		return nil, err
+	}
+	if cfg.Durable != _EMPTY_ {
+		if o, ok := mset.consumers[cfg.Durable]; ok {
+			mset.mu.Unlock()
+			if o.Config() == cfg {
+				return o, nil
+			}
+			return nil, ErrJetStreamConsumerExists
+		}
+	}
+	if mset.config.MaxConsumers > 0 && len(mset.consumers) >= mset.config.MaxConsumers {
+		mset.mu.Unlock()
+		return nil, ErrJetStreamMaxConsumers
+	}
+	if cfg.Durable != _EMPTY_ {
+		name = cfg.Durable
+	} else if name == _EMPTY_ {
+		name = nuid.Next()
+	}
+	o := &Consumer{
+		mset:    mset,
+		mstore:  mset.store,
+		jsa:     mset.jsa,
+		stream:  mset.config.Name,
+		name:    name,
+		cfg:     cfg,
+		created: created,
+		dseq:    1,
+		pending: make(map[uint64]*Pending),
+		rdc:     make(map[uint64]uint64),
+		mch:     make(chan struct{}, 1),
+		qch:     make(chan struct{}),
+	}
+	// Only durable consumers have their state persisted.
+	if cfg.Durable != _EMPTY_ {
+		o.store, err = mset.store.ConsumerStore(name)
+	} else {
+		o.store = &consumerMemStore{}
+	}
+	if err == nil && cfg.Durable != _EMPTY_ && mset.config.Storage == FileStorage {
+		err = o.writeMeta(mset.storeDir())
+	}
+	if err != nil {
+		mset.mu.Unlock()
+		return nil, err
+	}
+	mset.consumers[name] = o
+	mset.mu.Unlock()
+
+	if err := o.setup(); err != nil {
+		o.Delete()
+		return nil, err
+	}
+	return o, nil
+}
+
+// Writes the configuration of a durable consumer.
+func (o *Consumer) writeMeta(sdir string) error {
+	b, err := json.MarshalIndent(&consumerMeta{Config: o.cfg, Created: o.created}, _EMPTY_, "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(sdir, consumerDir, o.name)
+	tmp := filepath.Join(dir, consumerMetaFile+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, consumerMetaFile))
+}
+
+// Recreates the durable consumers of a file based stream.
+func (mset *Stream) recoverConsumers() {
+	s := mset.jsa.js.srv
+	odir := filepath.Join(mset.storeDir(), consumerDir)
+	fis, _ := ioutil.ReadDir(odir)
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(odir, fi.Name(), consumerMetaFile))
+		if err != nil {
+			s.Warnf("  Error reading consumer metadata for %q: %v", fi.Name(), err)
+			continue
+		}
+		var meta consumerMeta
+		if err := json.Unmarshal(buf, &meta); err != nil {
+			s.Warnf("  Error unmarshalling consumer metadata for %q: %v", fi.Name(), err)
+			continue
+		}
+		if _, err := mset.addConsumer(&meta.Config, _EMPTY_, meta.Created); err != nil {
+			s.Warnf("  Error recreating consumer %q: %v", fi.Name(), err)
+		}
+	}
+}
+
+// Sets the starting position and restores any stored state. Messages
+// are delivered unless this is a follower of a replicated stream.
+func (o *Consumer) setup() error {
+	state, err := o.store.State()
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	if state.Delivered.Consumer > 0 || state.Delivered.Stream > 0 {
+		o.restoreState(state)
+	} else {
+		o.selectStartingSeq()
+		o.adflr, o.asflr = o.dseq-1, o.sseq-1
+	}
+	o.mu.Unlock()
+
+	if o.mset.isLeader() {
+		return o.setLeader(true)
+	}
+	return nil
+}
+
+// Restores the delivery state. Lock should be held.
+func (o *Consumer) restoreState(state *ConsumerState) {
+	o.dseq = state.Delivered.Consumer + 1
+	o.sseq = state.Delivered.Stream + 1
+	o.adflr, o.asflr = state.AckFloor.Consumer, state.AckFloor.Stream
+	o.pending = make(map[uint64]*Pending, len(state.Pending))
+	for seq, p := range state.Pending {
+		pc := *p
+		o.pending[seq] = &pc
+	}
+	o.rdc = make(map[uint64]uint64, len(state.Redelivered))
+	for seq, dc := range state.Redelivered {
+		o.rdc[seq] = dc
+	}
+}
+
+// Applies the state replicated by the leader of the stream.
+func (o *Consumer) applyState(state *ConsumerState) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed || o.active {
+		return
+	}
+	o.restoreState(state)
+	o.store.Update(state)
+}
+
+// Starts or stops the delivery of messages. Only the leader of a
+// replicated stream delivers, the followers keep the state.
+func (o *Consumer) setLeader(isLeader bool) error {
+	o.mu.Lock()
+	if o.closed || o.active == isLeader {
+		o.mu.Unlock()
+		return nil
+	}
+	o.active = isLeader
+	if !isLeader {
+		close(o.lch)
+		o.lch = nil
+		if o.ptmr != nil {
+			o.ptmr.Stop()
+			o.ptmr = nil
+		}
+		if o.dtmr != nil {
+			o.dtmr.Stop()
+			o.dtmr = nil
+		}
+		if o.itmr != nil {
+			o.itmr.Stop()
+			o.itmr = nil
+		}
+		if o.hbtmr != nil {
+			o.hbtmr.Stop()
+			o.hbtmr = nil
+		}
+		o.waiting, o.rdq = nil, nil
+		o.pbytes, o.fcid, o.fcsz = 0, _EMPTY_, 0
+		subs := []*subscription{o.ackSub, o.reqSub, o.fcSub}
+		o.ackSub, o.reqSub, o.fcSub = nil, nil, nil
+		o.mu.Unlock()
+		o.unsubscribe(subs)
+		return nil
+	}
+	o.lch = make(chan struct{})
+	lch := o.lch
+	if len(o.pending) > 0 {
+		// Anything pending from before is checked for redelivery, and
+		// the delayed messages for delivery.
+		o.ptmr = time.AfterFunc(time.Millisecond, o.checkPending)
+		o.scheduleCheck(time.Now().UnixNano())
+	}
+	o.mu.Unlock()
+
+	ackSubj := fmt.Sprintf("%s.%s.%s.>", jsAckPre, o.stream, o.name)
+	ackSub, err := o.subscribeInternal(ackSubj, o.processAck)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	o.ackSub = ackSub
+	o.mu.Unlock()
+	if o.isPull() {
+		reqSubj := fmt.Sprintf(JSApiRequestNextT, o.stream, o.name)
+		reqSub, err := o.subscribeInternal(reqSubj, o.processNextMsgReq)
+		if err != nil {
+			return err
+		}
+		o.mu.Lock()
+		o.reqSub = reqSub
+		o.mu.Unlock()
+	} else {
+		if o.cfg.FlowControl {
+			fcSub, err := o.subscribeInternal(fmt.Sprintf(jsFlowControlT, o.stream, o.name, "*"), o.processFlowControl)
+			if err != nil {
+				return err
+			}
+			o.mu.Lock()
+			o.fcSub = fcSub
+			o.mu.Unlock()
+		}
+		o.mu.Lock()
+		if o.cfg.Durable == _EMPTY_ {
+			o.itmr = time.AfterFunc(jsEphemeralInactiveThreshold, o.checkInterest)
+		}
+		if o.cfg.FlowControl || o.cfg.Heartbeat > 0 {
+			o.ldt = time.Now().UnixNano()
+			o.hbtmr = time.AfterFunc(o.hbInterval(), o.checkIdle)
+		}
+		o.mu.Unlock()
+	}
+	s := o.jsa.js.srv
+	s.startGoRoutine(func() { o.loopAndDeliverMsgs(lch) })
+	return nil
+}
+
+// Subscribes the internal client of the account.
+func (o *Consumer) subscribeInternal(subject string, cb msgHandler) (*subscription, error) {
+	jsa := o.jsa
+	jsa.mu.Lock()
+	sid := jsa.nextSid()
+	c := jsa.client
+	jsa.mu.Unlock()
+	return c.subscribeInternal(subject, sid, cb)
+}
+
+// Removes the subscriptions of the internal client.
+func (o *Consumer) unsubscribe(subs []*subscription) {
+	c := o.jsa.client
+	for _, sub := range subs {
+		if sub != nil {
+			c.unsubscribe(c.acc, sub, true)
+		}
+	}
+}
+
+// Sets the first stream sequence to deliver. Lock should be held.
+func (o *Consumer) selectStartingSeq() {
+	state := o.mstore.State()
+	switch o.cfg.DeliverPolicy {
+	case DeliverAll:
+		o.sseq = state.FirstSeq
+	case DeliverLast:
+		o.sseq = state.LastSeq
+		if sm, err := o.mstore.LoadLastMsg(o.cfg.FilterSubject); err == nil {
+			o.sseq = sm.Sequence
+		}
+	case DeliverNew:
+		o.sseq = state.LastSeq + 1
+	case DeliverByStartSequence:
+		o.sseq = o.cfg.OptStartSeq
+	case DeliverByStartTime:
+		o.sseq = o.mstore.GetSeqFromTime(*o.cfg.OptStartTime)
+	case DeliverLastPerSubject:
+		o.lps = o.mstore.LastSeqs(o.cfg.FilterSubject)
+		o.sseq = state.LastSeq + 1
+	}
+	if o.sseq == 0 {
+		o.sseq = 1
+	}
+}
+
+func (o *Consumer) isPull() bool {
+	return o.cfg.DeliverSubject == _EMPTY_
+}
+
+// Name returns the name of the consumer.
+func (o *Consumer) Name() string {
+	return o.name
+}
+
+// Config returns the configuration of the consumer.
+func (o *Consumer) Config() ConsumerConfig {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.cfg
+}
+
+// Info returns the configuration and delivery state of the consumer.
+func (o *Consumer) Info() *ConsumerInfo {
+	o.mu.Lock()
+	info := &ConsumerInfo{
+		Stream:         o.stream,
+		Name:           o.name,
+		Created:        o.created,
+		Config:         o.cfg,
+		Delivered:      SequencePair{Consumer: o.dseq - 1, Stream: o.sseq - 1},
+		AckFloor:       SequencePair{Consumer: o.adflr, Stream: o.asflr},
+		NumRedelivered: len(o.rdc),
+		NumWaiting:     len(o.waiting),
+		Stalled:        o.isStalled(),
+	}
+	for _, p := range o.pending {
+		if p.Sequence == 0 {
+			info.NumScheduled++
+		} else {
+			info.NumAckPending++
+		}
+	}
+	sseq, filter := o.sseq, o.cfg.FilterSubject
+	o.mu.Unlock()
+	info.NumPending, _ = o.mstore.NumPending(sseq, filter)
+	return info
+}
+
+// Delete deletes the consumer and its state.
+func (o *Consumer) Delete() error {
+	mset := o.mset
+	mset.mu.Lock()
+	if mset.consumers[o.name] == o {
+		delete(mset.consumers, o.name)
+	}
+	mset.mu.Unlock()
+	return o.stop(true)
+}
+
+// Stops the consumer, removing its state if requested.
+func (o *Consumer) stop(deleteState bool) error {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return nil
+	}
+	o.closed = true
+	close(o.qch)
+	if o.ptmr != nil {
+		o.ptmr.Stop()
+		o.ptmr = nil
+	}
+	if o.dtmr != nil {
+		o.dtmr.Stop()
+		o.dtmr = nil
+	}
+	if o.itmr != nil {
+		o.itmr.Stop()
+		o.itmr = nil
+	}
+	if o.hbtmr != nil {
+		o.hbtmr.Stop()
+		o.hbtmr = nil
+	}
+	subs := []*subscription{o.ackSub, o.reqSub, o.fcSub}
+	o.ackSub, o.reqSub, o.fcSub = nil, nil, nil
+	store := o.store
+	o.mu.Unlock()
+
+	o.unsubscribe(subs)
+	if deleteState {
+		return store.Delete()
+	}
+	return store.Stop()
+}
+
+// Signals the delivery loop that there may be messages to deliver.
+func (o *Consumer) signal() {
+	select {
+	case o.mch <- struct{}{}:
+	default:
+	}
+}
+
+// Delivers the messages of the stream, to the deliver subject for push
+// consumers, or to the waiting requests for pull consumers. Returns once
+// the consumer is no longer active.
+func (o *Consumer) loopAndDeliverMsgs(lch chan struct{}) {
+	s := o.jsa.js.srv
+	defer s.grWG.Done()
+
+	for {
+		o.mu.Lock()
+		if o.closed || o.lch != lch {
+			o.mu.Unlock()
+			return
+		}
+		var sm *StoredMsg
+		var dc uint64
+		dsubj := o.cfg.DeliverSubject
+		if o.isPull() && len(o.waiting) > 0 {
+			dsubj = o.waiting[0].reply
+		}
+		if dsubj != _EMPTY_ && !o.isStalled() {
+			sm, dc = o.getNextMsg()
+		}
+		if sm == nil {
+			o.mu.Unlock()
+			select {
+			case <-o.mch:
+			case <-o.qch:
+				return
+			case <-lch:
+				return
+			case <-s.quitCh:
+				return
+			}
+			continue
+		}
+		ackNone := o.deliverMsg(dsubj, sm, dc)
+		mset := o.mset
+		o.mu.Unlock()
+
+		if ackNone {
+			mset.ackMsg(o, sm.Sequence)
+		}
+	}
+}
+
+// Returns the next message to deliver and its delivery count, messages
+// to redeliver first. Lock should be held.
+func (o *Consumer) getNextMsg() (*StoredMsg, uint64) {
+	for len(o.rdq) > 0 {
+		seq := o.rdq[0]
+		o.rdq = o.rdq[1:]
+		p, ok := o.pending[seq]
+		if !ok {
+			continue
+		}
+		sm, err := o.mstore.LoadMsg(seq)
+		if err != nil {
+			// The message is gone, stop tracking it.
+			delete(o.pending, seq)
+			delete(o.rdc, seq)
+			o.updateAckFloor()
+			continue
+		}
+		// Delayed messages that are due are delivered for the first time.
+		if p.Sequence == 0 {
+			return sm, 1
+		}
+		dc := o.rdc[seq]
+		if dc == 0 {
+			dc = 1
+		}
+		dc++
+		o.rdc[seq] = dc
+		return sm, dc
+	}
+	now := time.Now().UnixNano()
+	for len(o.lps) > 0 {
+		seq := o.lps[0]
+		o.lps = o.lps[1:]
+		if sm, err := o.mstore.LoadMsg(seq); err == nil && !o.delayMsg(sm, now) {
+			return sm, 1
+		}
+	}
+	state := o.mstore.State()
+	if o.sseq < state.FirstSeq {
+		o.sseq = state.FirstSeq
+	}
+	for o.sseq <= state.LastSeq {
+		seq := o.sseq
+		o.sseq++
+		sm, err := o.mstore.LoadMsg(seq)
+		if err != nil {
+			continue
+		}
+		if o.cfg.FilterSubject != _EMPTY_ && !matchLiteral(sm.Subject, o.cfg.FilterSubject) {
+			continue
+		}
+		if o.delayMsg(sm, now) {
+			continue
+		}
+		return sm, 1
+	}
+	return nil, 0
+}
+
+// Returns true if the message is not yet due, in which case it is
+// tracked as pending until it is. Lock should be held.
+func (o *Consumer) delayMsg(sm *StoredMsg, now int64) bool {
+	due, _ := getMsgDeliverAt(sm.Header, sm.Time, time.Duration(atomic.LoadInt64(&o.mset.ddelay)))
+	if due <= now {
+		return false
+	}
+	o.pending[sm.Sequence] = &Pending{Timestamp: due}
+	o.scheduleCheck(due)
+	o.updateStore()
+	return true
+}
+
+// Makes sure the delayed messages are checked at the given time, in
+// unix nanoseconds. Lock should be held.
+func (o *Consumer) scheduleCheck(at int64) {
+	if o.dtmr != nil && o.dnext <= at {
+		return
+	}
+	d := time.Duration(at - time.Now().UnixNano())
+	if o.dtmr == nil {
+		o.dtmr = time.AfterFunc(d, o.checkScheduled)
+	} else {
+		o.dtmr.Reset(d)
+	}
+	o.dnext = at
+}
+
+// Queues the delayed messages that are due for delivery.
+func (o *Consumer) checkScheduled() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed || !o.active {
+		return
+	}
+	o.dtmr, o.dnext = nil, 0
+	queued := make(map[uint64]bool, len(o.rdq))
+	for _, seq := range o.rdq {
+		queued[seq] = true
+	}
+	now := time.Now().UnixNano()
+	var due []uint64
+	var next int64
+	for seq, p := range o.pending {
+		if p.Sequence != 0 || queued[seq] {
+			continue
+		}
+		if p.Timestamp <= now {
+			due = append(due, seq)
+		} else if next == 0 || p.Timestamp < next {
+			next = p.Timestamp
+		}
+	}
+	if len(due) > 0 {
+		sort.Slice(due, func(i, j int) bool { return due[i] < due[j] })
+		o.rdq = append(o.rdq, due...)
+		o.signal()
+	}
+	if next > 0 {
+		o.scheduleCheck(next)
+	}
+}
+
+// Sends the message and tracks it until acked. Returns true if the
+// consumer does not require acks. Lock should be held.
+func (o *Consumer) deliverMsg(dsubj string, sm *StoredMsg, dc uint64) bool {
+	dseq := o.dseq
+	o.dseq++
+	ts := sm.Time.UnixNano()
+	reply := fmt.Sprintf(jsAckT, o.stream, o.name, dc, sm.Sequence, dseq, ts)
+	o.jsa.outq.send(&jsPubMsg{subj: dsubj, dsubj: sm.Subject, reply: reply, hdr: sm.Header, msg: sm.Data})
+	o.ldt = time.Now().UnixNano()
+	if o.cfg.FlowControl {
+		o.pbytes += len(sm.Header) + len(sm.Data)
+		if o.fcid == _EMPTY_ && o.pbytes >= consumerFlowControlWindow/2 {
+			o.sendFlowControl()
+		}
+	}
+
+	if o.isPull() {
+		if wr := o.waiting[0]; wr.n <= 1 {
+			o.waiting = o.waiting[1:]
+		} else {
+			wr.n--
+		}
+	}
+	ackNone := o.cfg.AckPolicy == AckNone
+	if ackNone {
+		delete(o.pending, sm.Sequence)
+		o.adflr, o.asflr = dseq, sm.Sequence
+	} else {
+		o.pending[sm.Sequence] = &Pending{Sequence: dseq, Timestamp: time.Now().UnixNano()}
+		if o.ptmr == nil {
+			o.ptmr = time.AfterFunc(o.cfg.AckWait, o.checkPending)
+		}
+	}
+	o.updateStore()
+	return ackNone
+}
+
+// Records the current state. Lock should be held.
+func (o *Consumer) updateStore() {
+	o.store.Update(o.currentState())
+	o.sdirty = true
+}
+
+// Returns the current state, which references the pending and
+// redelivered messages. Lock should be held.
+func (o *Consumer) currentState() *ConsumerState {
+	state := &ConsumerState{
+		Delivered: SequencePair{Consumer: o.dseq - 1, Stream: o.sseq - 1},
+		AckFloor:  SequencePair{Consumer: o.adflr, Stream: o.asflr},
+	}
+	if len(o.pending) > 0 {
+		state.Pending = o.pending
+	}
+	if len(o.rdc) > 0 {
+		state.Redelivered = o.rdc
+	}
+	return state
+}
+
+// Returns a copy of the state if it changed since the last call, for
+// the leader of a replicated stream.
+func (o *Consumer) stateChanged() *ConsumerState {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.sdirty || !o.active {
+		return nil
+	}
+	o.sdirty = false
+	return o.currentState().copy()
+}
+
+// Updates the ack floors from the pending messages. Lock should be held.
+func (o *Consumer) updateAckFloor() {
+	if len(o.pending) == 0 {
+		o.adflr, o.asflr = o.dseq-1, o.sseq-1
+		return
+	}
+	var first uint64
+	for seq := range o.pending {
+		if first == 0 || seq < first {
+			first = seq
+		}
+	}
+	o.asflr = first - 1
+	if dseq := o.pending[first].Sequence; dseq > 0 {
+		o.adflr = dseq - 1
+	}
+}
+
+// Invoked when the ack wait of the oldest pending message expires.
+// Expired messages are queued for redelivery, unless they have reached
+// the maximum number of deliveries in which case they are dropped.
+func (o *Consumer) checkPending() {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return
+	}
+	now := time.Now().UnixNano()
+	aw := int64(o.cfg.AckWait)
+	next := aw
+	var expired []uint64
+	var exceeded map[uint64]uint64
+	for seq, p := range o.pending {
+		// Delayed messages are not delivered yet.
+		if p.Sequence == 0 {
+			continue
+		}
+		elapsed := now - p.Timestamp
+		if elapsed < aw {
+			if rem := aw - elapsed; rem < next {
+				next = rem
+			}
+			continue
+		}
+		if dc := o.rdc[seq]; o.cfg.MaxDeliver > 0 && (dc >= uint64(o.cfg.MaxDeliver) || (dc == 0 && o.cfg.MaxDeliver == 1)) {
+			if exceeded == nil {
+				exceeded = make(map[uint64]uint64)
+			}
+			// The first delivery is not counted in rdc.
+			if dc == 0 {
+				dc = 1
+			}
+			exceeded[seq] = dc
+			delete(o.pending, seq)
+			delete(o.rdc, seq)
+			continue
+		}
+		p.Timestamp = now
+		expired = append(expired, seq)
+	}
+	if len(expired) > 0 {
+		sort.Slice(expired, func(i, j int) bool { return expired[i] < expired[j] })
+		o.rdq = append(o.rdq, expired...)
+		o.signal()
+	}
+	o.updateAckFloor()
+	if len(o.pending) > 0 {
+		o.ptmr.Reset(time.Duration(next))
+	} else {
+		o.ptmr = nil
+	}
+	mset, jsa, stream, name, dlq := o.mset, o.jsa, o.stream, o.name, o.cfg.DeadLetterStream
+	o.mu.Unlock()
+
+	// Done without the lock since storing in the dead letter stream
+	// signals its consumers.
+	for seq, dc := range exceeded {
+		adv := &JSConsumerDeliveryExceededAdvisory{
+			Type:       JSConsumerDeliveryExceededAdvisoryType,
+			ID:         nuid.Next(),
+			Time:       time.Now().UTC(),
+			Stream:     stream,
+			Consumer:   name,
+			StreamSeq:  seq,
+			Deliveries: dc,
+		}
+		if dlq != _EMPTY_ && o.deadLetter(mset, dlq, seq) {
+			adv.DeadLetterStream = dlq
+		}
+		jsa.sendAdvisory(fmt.Sprintf("%s.%s.%s", JSAdvisoryConsumerMaxDeliveryExceedPre, stream, name), adv)
+	}
+}
+
+// Moves the message to the dead letter stream, returns false if the
+// message or the stream no longer exist.
+func (o *Consumer) deadLetter(mset *Stream, dlq string, seq uint64) bool {
+	sm, err := o.mstore.LoadMsg(seq)
+	if err != nil {
+		return false
+	}
+	dset, err := o.jsa.account.LookupStream(dlq)
+	if err != nil {
+		o.jsa.js.srv.Warnf("JetStream dead letter stream %q of consumer %q on stream %q not found",
+			dlq, o.name, o.stream)
+		return false
+	}
+	hdr := fmt.Sprintf("%s %s %d", o.stream, o.name, seq)
+	dset.processInboundMsg(nil, sm.Subject, _EMPTY_, setHeader(sm.Header, JSDeadLetter, hdr), sm.Data)
+	// The message is done with as far as this consumer is concerned.
+	mset.ackMsg(o, seq)
+	return true
+}
+
+// Removes an ephemeral consumer once its deliver subject has no interest.
+func (o *Consumer) checkInterest() {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return
+	}
+	acc := o.jsa.account
+	r := acc.sl.Match(o.cfg.DeliverSubject)
+	if len(r.psubs)+len(r.qsubs) > 0 {
+		o.itmr.Reset(jsEphemeralInactiveThreshold)
+		o.mu.Unlock()
+		return
+	}
+	o.mu.Unlock()
+	// Replicated consumers are removed on all members of the stream.
+	if mset := o.mset; mset.isClustered() {
+		mset.proposeConsumerDelete(o.name, _EMPTY_)
+		return
+	}
+	o.Delete()
+}
+
+// Returns the stream sequence, consumer sequence and delivery count
+// from the reply subject of a delivered message.
+func ackReplyInfo(subject string) (sseq, dseq, dc uint64) {
+	tsa := [10]string{}
+	tokens := tsa[:0]
+	start := 0
+	for i := 0; i < len(subject); i++ {
+		if subject[i] == btsep {
+			tokens = append(tokens, subject[start:i])
+			start = i + 1
+		}
+	}
+	tokens = append(tokens, subject[start:])
+	if len(tokens) != 8 {
+		return 0, 0, 0
+	}
+	dc, _ = strconv.ParseUint(tokens[4], 10, 64)
+	sseq, _ = strconv.ParseUint(tokens[5], 10, 64)
+	dseq, _ = strconv.ParseUint(tokens[6], 10, 64)
+	return sseq, dseq, dc
+}
+
+// Processes an acknowledgement.
+func (o *Consumer) processAck(_ *subscription, subject, reply string, _, msg []byte) {
+	sseq, dseq, _ := ackReplyInfo(subject)
+	if sseq == 0 {
+		return
+	}
+	msg = bytes.TrimSpace(msg)
+	switch {
+	case len(msg) == 0, bytes.Equal(msg, AckAck):
+		o.ackMsg(sseq, dseq)
+	case bytes.Equal(msg, AckNext):
+		o.ackMsg(sseq, dseq)
+		if reply != _EMPTY_ && o.isPull() {
+			o.addWaiting(reply, 1)
+		}
+		return
+	case bytes.Equal(msg, AckNak):
+		o.processNak(sseq)
+	case bytes.Equal(msg, AckProgress):
+		o.processProgress(sseq)
+	case bytes.Equal(msg, AckTerm):
+		o.processTerm(sseq)
+	}
+	// Respond to synchronous acks.
+	if reply != _EMPTY_ {
+		o.jsa.outq.send(&jsPubMsg{subj: reply})
+	}
+}
+
+// Acks the message, and all messages below it with the ack all policy.
+func (o *Consumer) ackMsg(sseq, dseq uint64) {
+	var acked []uint64
+	o.mu.Lock()
+	switch o.cfg.AckPolicy {
+	case AckExplicit:
+		if _, ok := o.pending[sseq]; ok {
+			delete(o.pending, sseq)
+			delete(o.rdc, sseq)
+			acked = append(acked, sseq)
+		}
+	case AckAll:
+		for seq := range o.pending {
+			if seq <= sseq {
+				delete(o.pending, seq)
+				delete(o.rdc, seq)
+				acked = append(acked, seq)
+			}
+		}
+	}
+	if len(acked) == 0 {
+		o.mu.Unlock()
+		return
+	}
+	o.updateAckFloor()
+	o.updateStore()
+	mset := o.mset
+	o.mu.Unlock()
+
+	for _, seq := range acked {
+		mset.ackMsg(o, seq)
+	}
+}
+
+// Queues the message for redelivery right away.
+func (o *Consumer) processNak(sseq uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if p, ok := o.pending[sseq]; ok {
+		p.Timestamp = time.Now().UnixNano()
+		o.rdq = append(o.rdq, sseq)
+		o.signal()
+	}
+}
+
+// Resets the ack wait of the message.
+func (o *Consumer) processProgress(sseq uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if p, ok := o.pending[sseq]; ok {
+		p.Timestamp = time.Now().UnixNano()
+	}
+}
+
+// Stops the redelivery of the message, which is not acked in the stream.
+func (o *Consumer) processTerm(sseq uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.pending[sseq]; ok {
+		delete(o.pending, sseq)
+		delete(o.rdc, sseq)
+		o.updateAckFloor()
+		o.updateStore()
+	}
+}
+
+// Returns true if the consumer has not acked, or not yet received, the
+// message with the given sequence and subject.
+func (o *Consumer) needAck(sseq uint64, subj string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.cfg.FilterSubject != _EMPTY_ && !matchLiteral(subj, o.cfg.FilterSubject) {
+		return false
+	}
+	if sseq >= o.sseq {
+		return true
+	}
+	if o.cfg.AckPolicy == AckNone {
+		return false
+	}
+	_, ok := o.pending[sseq]
+	return ok
+}
+
+// Processes a request for the next messages of a pull consumer. The
+// request body is the number of messages, or a JSON object with a
+// batch field, and defaults to one.
+func (o *Consumer) processNextMsgReq(_ *subscription, _, reply string, _, msg []byte) {
+	if reply == _EMPTY_ {
+		return
+	}
+	batch := 1
+	if msg = bytes.TrimSpace(msg); len(msg) > 0 {
+		if n, err := strconv.Atoi(string(msg)); err == nil {
+			batch = n
+		} else {
+			var req struct {
+				Batch int `json:"batch"`
+			}
+			if json.Unmarshal(msg, &req) == nil {
+				batch = req.Batch
+			}
+		}
+	}
+	if batch <= 0 {
+		batch = 1
+	}
+	o.addWaiting(reply, batch)
+}
+
+func (o *Consumer) addWaiting(reply string, n int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	if len(o.waiting) >= jsMaxWaitingRequests {
+		o.waiting = o.waiting[1:]
+	}
+	o.waiting = append(o.waiting, &waitingRequest{reply: reply, n: n})
+	o.signal()
+}
+
+// Drops the pending messages below the first sequence of the stream
+// after a purge.
+func (o *Consumer) purge(firstSeq uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.sseq < firstSeq {
+		o.sseq = firstSeq
+	}
+	for seq := range o.pending {
+		if seq < firstSeq {
+			delete(o.pending, seq)
+			delete(o.rdc, seq)
+		}
+	}
+	o.updateAckFloor()
+	o.updateStore()
+}
+
+const (
+	ackNoneString  = "none"
+	ackAllString   = "all"
+	ackExplicitStr = "explicit"
+)
+
+func (ap AckPolicy) String() string {
+	switch ap {
+	case AckNone:
+		return "None"
+	case AckAll:
+		return "All"
+	case AckExplicit:
+		return "Explicit"
+	default:
+		return "Unknown Ack Policy"
+	}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (ap AckPolicy) MarshalJSON() ([]byte, error) {
+	switch ap {
+	case AckNone:
+		return json.Marshal(ackNoneString)
+	case AckAll:
+		return json.Marshal(ackAllString)
+	case AckExplicit:
+		return json.Marshal(ackExplicitStr)
+	default:
+		return nil, fmt.Errorf("can not marshal %v", ap)
+	}
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (ap *AckPolicy) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case jsonString(ackNoneString):
+		*ap = AckNone
+	case jsonString(ackAllString):
+		*ap = AckAll
+	case jsonString(ackExplicitStr):
+		*ap = AckExplicit
+	default:
+		return fmt.Errorf("can not unmarshal %q", data)
+	}
+	return nil
+}
+
+const (
+	deliverAllString      = "all"
+	deliverLastString     = "last"
+	deliverNewString      = "new"
+	deliverByStartSeqStr  = "by_start_sequence"
+	deliverByStartTimeSt  = "by_start_time"
+	deliverLastPerSubjStr = "last_per_subject"
+)
+
+func (dp DeliverPolicy) String() string {
+	switch dp {
+	case DeliverAll:
+		return "all"
+	case DeliverLast:
+		return "last"
+	case DeliverNew:
+		return "new"
+	case DeliverByStartSequence:
+		return "by_start_sequence"
+	case DeliverByStartTime:
+		return "by_start_time"
+	case DeliverLastPerSubject:
+		return "last_per_subject"
+	default:
+		return "undefined"
+	}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (dp DeliverPolicy) MarshalJSON() ([]byte, error) {
+	switch dp {
+	case DeliverAll:
+		return json.Marshal(deliverAllString)
+	case DeliverLast:
+		return json.Marshal(deliverLastString)
+	case DeliverNew:
+		return json.Marshal(deliverNewString)
+	case DeliverByStartSequence:
+		return json.Marshal(deliverByStartSeqStr)
+	case DeliverByStartTime:
+		return json.Marshal(deliverByStartTimeSt)
+	case DeliverLastPerSubject:
+		return json.Marshal(deliverLastPerSubjStr)
+	default:
+		return nil, fmt.Errorf("can not marshal %v", dp)
+	}
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (dp *DeliverPolicy) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case jsonString(deliverAllString), jsonString(_EMPTY_):
+		*dp = DeliverAll
+	case jsonString(deliverLastString):
+		*dp = DeliverLast
+	case jsonString(deliverNewString):
+		*dp = DeliverNew
+	case jsonString(deliverByStartSeqStr):
+		*dp = DeliverByStartSequence
+	case jsonString(deliverByStartTimeSt):
+		*dp = DeliverByStartTime
+	case jsonString(deliverLastPerSubjStr):
+		*dp = DeliverLastPerSubject
+	default:
+		return fmt.Errorf("can not unmarshal %q", data)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// Reply subject of the flow control requests: stream, consumer and
+	// request number.
+	jsFlowControlT = "$JS.FC.%s.%s.%s"
+
+	// Status messages sent to the deliver subject of push consumers.
+	jsFlowControlMsg = "NATS/1.0 100 FlowControl Request\r\n\r\n"
+	jsHeartbeatMsg   = "NATS/1.0 100 Idle Heartbeat\r\n"
+
+	// JSLastConsumerSeq and JSLastStreamSeq are the headers of the idle
+	// heartbeats with the last delivered sequences.
+	JSLastConsumerSeq = "Nats-Last-Consumer"
+	JSLastStreamSeq   = "Nats-Last-Stream"
+	// JSConsumerStalled is the header of the idle heartbeats of a stalled
+	// consumer, with the subject to answer to resume the delivery.
+	JSConsumerStalled = "Nats-Consumer-Stalled"
+)
+
+var (
+	// Bytes delivered without a flow control response after which the
+	// delivery stalls. Requests are sent at half of it.
+	consumerFlowControlWindow = 8 * 1024 * 1024
+	// Interval at which the flow control requests of a stalled consumer
+	// without idle heartbeats are sent again.
+	consumerStallCheckInterval = 5 * time.Second
+)
+
+// Returns true if the delivery waits for a flow control response.
+// Lock should be held.
+func (o *Consumer) isStalled() bool {
+	return o.cfg.FlowControl && o.pbytes >= consumerFlowControlWindow
+}
+
+// Asks the client to answer once it has processed the messages delivered
+// so far. Lock should be held.
+func (o *Consumer) sendFlowControl() {
+	o.fcn++
+	o.fcid = fmt.Sprintf(jsFlowControlT, o.stream, o.name, strconv.FormatUint(o.fcn, 10))
+	o.fcsz = o.pbytes
+	o.jsa.outq.send(&jsPubMsg{subj: o.cfg.DeliverSubject, reply: o.fcid, hdr: []byte(jsFlowControlMsg)})
+}
+
+// Processes a flow control response, resuming the delivery.
+func (o *Consumer) processFlowControl(_ *subscription, subject, _ string, _, _ []byte) {
+	o.mu.Lock()
+	if o.closed || subject != o.fcid {
+		o.mu.Unlock()
+		return
+	}
+	o.pbytes -= o.fcsz
+	o.fcid, o.fcsz = _EMPTY_, 0
+	// A single large message may leave more than covered by a request.
+	if o.pbytes >= consumerFlowControlWindow/2 {
+		o.sendFlowControl()
+	}
+	o.mu.Unlock()
+	o.signal()
+}
+
+// Returns the interval of the idle checks. Lock should be held.
+func (o *Consumer) hbInterval() time.Duration {
+	if o.cfg.Heartbeat > 0 {
+		return o.cfg.Heartbeat
+	}
+	return consumerStallCheckInterval
+}
+
+// Sends an idle heartbeat when nothing was delivered for the heartbeat
+// interval. The heartbeats of a stalled consumer carry the subject of
+// the flow control request, which is sent again without heartbeats, in
+// case the client missed it.
+func (o *Consumer) checkIdle() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed || o.hbtmr == nil {
+		return
+	}
+	iv := o.hbInterval()
+	if elapsed := time.Duration(time.Now().UnixNano() - o.ldt); elapsed < iv {
+		o.hbtmr.Reset(iv - elapsed)
+		return
+	}
+	if o.cfg.Heartbeat > 0 {
+		hdr := fmt.Sprintf("%s%s: %d\r\n%s: %d\r\n", jsHeartbeatMsg, JSLastConsumerSeq, o.dseq-1, JSLastStreamSeq, o.sseq-1)
+		if o.isStalled() {
+			hdr += fmt.Sprintf("%s: %s\r\n", JSConsumerStalled, o.fcid)
+		}
+		o.jsa.outq.send(&jsPubMsg{subj: o.cfg.DeliverSubject, hdr: []byte(hdr + "\r\n")})
+	} else if o.isStalled() {
+		o.jsa.outq.send(&jsPubMsg{subj: o.cfg.DeliverSubject, reply: o.fcid, hdr: []byte(jsFlowControlMsg)})
+	}
+	o.ldt = time.Now().UnixNano()
+	o.hbtmr.Reset(iv)
+}
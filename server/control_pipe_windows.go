@@ -0,0 +1,201 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	pipeAccessDuplex          = 0x3
+	pipeTypeMessage           = 0x4
+	pipeReadModeMessage       = 0x2
+	pipeRejectRemoteClients   = 0x8
+	fileFlagFirstPipeInstance = 0x80000
+	errorPipeConnected        = syscall.Errno(535)
+
+	// Maximum size of a command or a reply on the control pipe.
+	controlPipeBufSize = 256
+	controlPipeOK      = "ok"
+)
+
+var (
+	modkernel32             = windows.NewLazySystemDLL("kernel32.dll")
+	procCreateNamedPipeW    = modkernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe    = modkernel32.NewProc("ConnectNamedPipe")
+	procDisconnectNamedPipe = modkernel32.NewProc("DisconnectNamedPipe")
+)
+
+// controlPipeName returns the name of the pipe the process with the given
+// pid receives its commands from.
+func controlPipeName(pid int) string {
+	return fmt.Sprintf(`\\.\pipe\%s-%d`, serviceName, pid)
+}
+
+func createNamedPipe(name string, first bool) (windows.Handle, error) {
+	n, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return windows.InvalidHandle, err
+	}
+	mode := uint32(pipeAccessDuplex)
+	if first {
+		mode |= fileFlagFirstPipeInstance
+	}
+	// With the default security descriptor only the owner of the process,
+	// administrators and the system can write to the pipe.
+	r, _, err := procCreateNamedPipeW.Call(uintptr(unsafe.Pointer(n)), uintptr(mode),
+		pipeTypeMessage|pipeReadModeMessage|pipeRejectRemoteClients,
+		1, controlPipeBufSize, controlPipeBufSize, 0, 0)
+	if h := windows.Handle(r); h != windows.InvalidHandle {
+		return h, nil
+	}
+	return windows.InvalidHandle, err
+}
+
+func connectNamedPipe(h windows.Handle) error {
+	r, _, err := procConnectNamedPipe.Call(uintptr(h), 0)
+	if r == 0 && err != errorPipeConnected {
+		return err
+	}
+	return nil
+}
+
+// startControlPipe creates the named pipe through which ProcessSignal sends
+// commands to this process, and serves it until the server is shutdown.
+func (s *Server) startControlPipe() error {
+	name := controlPipeName(os.Getpid())
+	h, err := createNamedPipe(name, true)
+	if err != nil {
+		return err
+	}
+	go func() {
+		// Unblock the pending connect so that the loop exits.
+		<-s.quitCh
+		if f, err := os.OpenFile(name, os.O_RDWR, 0); err == nil {
+			f.Close()
+		}
+	}()
+	go func() {
+		for {
+			err := connectNamedPipe(h)
+			select {
+			case <-s.quitCh:
+				windows.CloseHandle(h)
+				return
+			default:
+			}
+			if err == nil {
+				s.serveControlPipe(h)
+			}
+			procDisconnectNamedPipe.Call(uintptr(h))
+		}
+	}()
+	return nil
+}
+
+// serveControlPipe reads a command from a connected control pipe, replies
+// and then executes the command.
+func (s *Server) serveControlPipe(h windows.Handle) {
+	var (
+		buf [controlPipeBufSize]byte
+		n   uint32
+	)
+	if err := windows.ReadFile(h, buf[:], &n, nil); err != nil {
+		return
+	}
+	command := Command(strings.TrimSpace(string(buf[:n])))
+	s.Debugf("Received %q command on the control pipe", command)
+
+	reply := controlPipeOK
+	switch command {
+	case CommandStop, CommandQuit, CommandTerm, CommandReopen, CommandRotate, CommandReload, CommandLDMode:
+	default:
+		reply = fmt.Sprintf("unknown signal %q", command)
+	}
+	windows.WriteFile(h, []byte(reply), &n, nil)
+	windows.FlushFileBuffers(h)
+	if reply != controlPipeOK {
+		return
+	}
+
+	switch command {
+	case CommandStop, CommandQuit:
+		s.Noticef("Server Exiting..")
+		os.Exit(0)
+	case CommandTerm:
+		// Graceful shutdown.
+		s.Noticef("Server Exiting..")
+		go func() {
+			s.Shutdown()
+			os.Exit(0)
+		}()
+	case CommandReopen:
+		// File log re-open for rotating file logs.
+		s.ReOpenLogFile()
+	case CommandRotate:
+		// File log rotation by the server.
+		s.RotateLogFile()
+	case CommandReload:
+		go func() {
+			if err := s.Reload(); err != nil {
+				s.Errorf("Failed to reload server configuration: %s", err)
+			}
+		}()
+	case CommandLDMode:
+		go s.lameDuckMode()
+	}
+}
+
+// sendControlCommand sends the command to the process with the given pid
+// through its control pipe.
+func sendControlCommand(command Command, pid int) error {
+	name := controlPipeName(pid)
+	var (
+		f   *os.File
+		err error
+	)
+	// The pipe has a single instance, retry while another command is served.
+	for timeout := time.Now().Add(5 * time.Second); ; {
+		f, err = os.OpenFile(name, os.O_RDWR, 0)
+		if err == nil || time.Now().After(timeout) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		return fmt.Errorf("could not connect to process %d: %v", pid, err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write([]byte(command)); err != nil {
+		return fmt.Errorf("could not send command to process %d: %v", pid, err)
+	}
+	var buf [controlPipeBufSize]byte
+	n, err := f.Read(buf[:])
+	if err != nil {
+		return fmt.Errorf("could not read reply from process %d: %v", pid, err)
+	}
+	if reply := string(buf[:n]); reply != controlPipeOK {
+		return errors.New(reply)
+	}
+	return nil
+}
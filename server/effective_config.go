@@ -0,0 +1,174 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"time"
+)
+
+// redactedValue replaces the value of secret options in the effective configuration.
+const redactedValue = "[REDACTED]"
+
+// Names of the option fields, in any of the options structures, whose value
+// is never reported.
+var secretConfigFields = map[string]struct{}{
+	"Password":         {},
+	"Authorization":    {},
+	"JetStreamKey":     {},
+	"JetStreamPrevKey": {},
+	"AccessKey":        {},
+	"SecretKey":        {},
+	"Headers":          {},
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+	urlPtrType   = reflect.TypeOf((*url.URL)(nil))
+	tlsPtrType   = reflect.TypeOf((*tls.Config)(nil))
+	accPtrType   = reflect.TypeOf((*Account)(nil))
+)
+
+// EffectiveConfig returns the options the server runs with, defaults and
+// reloaded values included, as indented JSON with the secrets redacted.
+func (s *Server) EffectiveConfig() ([]byte, error) {
+	return effectiveConfigJSON(s.getOpts())
+}
+
+// EffectiveConfig returns the options, with the defaults the server would
+// apply when starting, as indented JSON with the secrets redacted.
+// The options themselves are not modified.
+func (o *Options) EffectiveConfig() ([]byte, error) {
+	opts := o.Clone()
+	setBaselineOptions(opts)
+	return effectiveConfigJSON(opts)
+}
+
+func effectiveConfigJSON(opts *Options) ([]byte, error) {
+	return json.MarshalIndent(configValue(reflect.ValueOf(opts)), _EMPTY_, "  ")
+}
+
+// configValue converts an option value to a value suitable for JSON encoding.
+// Structures are reported with their exported fields, keyed by field name,
+// and values that do not convey configuration (functions, channels) skipped.
+func configValue(v reflect.Value) interface{} {
+	switch v.Type() {
+	case durationType:
+		return time.Duration(v.Int()).String()
+	case timeType:
+		return v.Interface()
+	case urlPtrType:
+		if v.IsNil() {
+			return nil
+		}
+		return v.Interface().(*url.URL).Redacted()
+	case tlsPtrType:
+		if v.IsNil() {
+			return nil
+		}
+		return tlsConfigSummary(v.Interface().(*tls.Config))
+	case accPtrType:
+		if v.IsNil() {
+			return nil
+		}
+		return v.Interface().(*Account).Name
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return configValue(v.Elem())
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		// Implementations such as account resolvers and custom authentication
+		// are only reported by type.
+		return fmt.Sprintf("%T", v.Interface())
+	case reflect.Struct:
+		m := make(map[string]interface{})
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != _EMPTY_ {
+				continue
+			}
+			fv := v.Field(i)
+			switch fv.Kind() {
+			case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+				continue
+			}
+			if _, ok := secretConfigFields[f.Name]; ok {
+				if !fv.IsZero() {
+					m[f.Name] = redactedValue
+				}
+				continue
+			}
+			m[f.Name] = configValue(fv)
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		l := make([]interface{}, v.Len())
+		for i := range l {
+			l[i] = configValue(v.Index(i))
+		}
+		return l
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		m := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			m[fmt.Sprint(iter.Key().Interface())] = configValue(iter.Value())
+		}
+		return m
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return nil
+	}
+	return v.Interface()
+}
+
+// tlsConfigSummary reports the settings of a TLS configuration, without the
+// keys and certificates themselves.
+func tlsConfigSummary(tc *tls.Config) map[string]interface{} {
+	m := map[string]interface{}{
+		"Certificates":       len(tc.Certificates),
+		"ClientAuth":         tc.ClientAuth.String(),
+		"InsecureSkipVerify": tc.InsecureSkipVerify,
+	}
+	if tc.MinVersion != 0 {
+		m["MinVersion"] = tls.VersionName(tc.MinVersion)
+	}
+	if tc.ServerName != _EMPTY_ {
+		m["ServerName"] = tc.ServerName
+	}
+	if len(tc.CipherSuites) > 0 {
+		suites := make([]string, 0, len(tc.CipherSuites))
+		for _, cs := range tc.CipherSuites {
+			suites = append(suites, tls.CipherSuiteName(cs))
+		}
+		m["CipherSuites"] = suites
+	}
+	return m
+}
@@ -16,6 +16,7 @@ package server
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
 var (
@@ -34,6 +35,10 @@ var (
 	// ErrMaxPayload represents an error condition when the payload is too big.
 	ErrMaxPayload = errors.New("maximum payload exceeded")
 
+	// ErrMsgHeadersNotSupported represents an error condition when a client
+	// publishes a message with headers without having enabled them.
+	ErrMsgHeadersNotSupported = errors.New("message headers not supported")
+
 	// ErrMaxControlLine represents an error condition when the control line is too big.
 	ErrMaxControlLine = errors.New("maximum control line exceeded")
 
@@ -47,6 +52,14 @@ var (
 	// server has been reached.
 	ErrTooManyConnections = errors.New("maximum connections exceeded")
 
+	// ErrTooManyIPConnections signals a client that the maximum number of
+	// connections from its IP address has been reached.
+	ErrTooManyIPConnections = errors.New("maximum connections per IP exceeded")
+
+	// ErrTooManyUserConnections signals a client that the maximum number of
+	// connections of its user has been reached.
+	ErrTooManyUserConnections = errors.New("maximum user connections exceeded")
+
 	// ErrTooManyAccountConnections signals that an acount has reached its maximum number of active
 	// connections.
 	ErrTooManyAccountConnections = errors.New("maximum account active connections exceeded")
@@ -76,6 +89,10 @@ var (
 	// ErrMissingAccount is returned when an account does not exist.
 	ErrMissingAccount = errors.New("account missing")
 
+	// ErrAccountManagedByOperator is returned when an account is attempted to be
+	// defined or changed at runtime while accounts are managed by an operator.
+	ErrAccountManagedByOperator = errors.New("accounts are managed by operator")
+
 	// ErrAccountValidation is returned when an account has failed validation.
 	ErrAccountValidation = errors.New("account validation failed")
 
@@ -85,6 +102,9 @@ var (
 	// ErrNoAccountResolver is returned when we attempt an update but do not have an account resolver.
 	ErrNoAccountResolver = errors.New("account resolver missing")
 
+	// ErrAccountDraining is returned when an account is being or was drained.
+	ErrAccountDraining = errors.New("account is draining")
+
 	// ErrAccountResolverUpdateTooSoon is returned when we attempt an update too soon to last request.
 	ErrAccountResolverUpdateTooSoon = errors.New("account resolver update too soon")
 
@@ -106,9 +126,33 @@ var (
 	// Gateway's name.
 	ErrWrongGateway = errors.New("wrong gateway")
 
+	// ErrLeafNodeLoop signals a leafnode connection that would create a loop,
+	// either by connecting back to this server or through other leafnodes.
+	ErrLeafNodeLoop = errors.New("leafnode loop detected")
+
+	// ErrClusterNameConflict is returned when a route is from a server
+	// configured with a different cluster name.
+	ErrClusterNameConflict = errors.New("cluster name conflict")
+
 	// ErrNoSysAccount is returned when an attempt to publish or subscribe is made
 	// when there is no internal system account defined.
 	ErrNoSysAccount = errors.New("system account not setup")
+
+	// ErrClientNotFound is returned when there is no client connection with
+	// the given connection ID.
+	ErrClientNotFound = errors.New("client not found")
+
+	// ErrProfilingDisabled is returned when a profile is requested from a
+	// server that does not have profiling enabled.
+	ErrProfilingDisabled = errors.New("profiling not enabled")
+
+	// ErrServerNotRunning is returned when an operation requires the server
+	// to be running and accepting clients.
+	ErrServerNotRunning = errors.New("server not running")
+
+	// ErrLameDuckMode is returned when the server is asked to enter lame duck
+	// mode while already in it.
+	ErrLameDuckMode = errors.New("server already in lame duck mode")
 )
 
 // configErr is a configuration error.
@@ -136,9 +180,11 @@ type unknownConfigFieldErr struct {
 	field string
 }
 
-// Error reports that an unknown field was in the configuration.
+// Error reports that an unknown field was in the configuration, with the
+// name of a known field close to it, if any.
 func (e *unknownConfigFieldErr) Error() string {
-	return fmt.Sprintf("%s: unknown field %q", e.Source(), e.field)
+	return fmt.Sprintf("%s: unknown field %q%s", e.Source(), e.field,
+		configFieldSuggestion(strings.ToLower(e.field)))
 }
 
 // configWarningErr is an error reported in pedantic mode.
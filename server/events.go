@@ -30,7 +30,9 @@ const (
 	connectEventSubj         = "$SYS.ACCOUNT.%s.CONNECT"
 	disconnectEventSubj      = "$SYS.ACCOUNT.%s.DISCONNECT"
 	accConnsReqSubj          = "$SYS.REQ.ACCOUNT.%s.CONNS"
+	accDrainReqSubj          = "$SYS.REQ.ACCOUNT.%s.DRAIN"
 	accUpdateEventSubj       = "$SYS.ACCOUNT.%s.CLAIMS.UPDATE"
+	accErrorsEventSubj       = "$SYS.ACCOUNT.%s.ERRORS"
 	connsRespSubj            = "$SYS._INBOX_.%s"
 	accConnsEventSubj        = "$SYS.SERVER.ACCOUNT.%s.CONNS"
 	shutdownEventSubj        = "$SYS.SERVER.%s.SHUTDOWN"
@@ -38,13 +40,26 @@ const (
 	serverStatsSubj          = "$SYS.SERVER.%s.STATSZ"
 	serverStatsReqSubj       = "$SYS.REQ.SERVER.%s.STATSZ"
 	serverStatsPingReqSubj   = "$SYS.REQ.SERVER.PING"
+	serverDirectReqSubj      = "$SYS.REQ.SERVER.%s.%s"
+	serverPingReqSubj        = "$SYS.REQ.SERVER.PING.%s"
 	leafNodeConnectEventSubj = "$SYS.ACCOUNT.%s.LEAFNODE.CONNECT"
+	slowConsumerEventSubj    = "$SYS.SERVER.%s.SLOW_CONSUMER"
+	maxSubsEventSubj         = "$SYS.SERVER.%s.MAX_SUBSCRIPTIONS"
+	routeConnectEventSubj    = "$SYS.SERVER.%s.ROUTE.CONNECT"
+	routeDisconnectEventSubj = "$SYS.SERVER.%s.ROUTE.DISCONNECT"
+	leafConnectEventSubj     = "$SYS.SERVER.%s.LEAFNODE.CONNECT"
+	leafDisconnectEventSubj  = "$SYS.SERVER.%s.LEAFNODE.DISCONNECT"
 
 	shutdownEventTokens = 4
 	serverSubjectIndex  = 2
 	accUpdateTokens     = 5
 	accUpdateAccIndex   = 2
+	accReqTokens        = 5
+	accReqAccIndex      = 3
 	defaultEventsHBItvl = 30 * time.Second
+
+	// Maximum number of subjects reported in a slow consumer event.
+	slowConsumerMaxSubjects = 10
 )
 
 // FIXME(dlc) - make configurable.
@@ -82,11 +97,44 @@ type ConnectEventMsg struct {
 // DisconnectEventMsg is sent when a new connection previously defined from a
 // ConnectEventMsg is closed.
 type DisconnectEventMsg struct {
-	Server   ServerInfo `json:"server"`
-	Client   ClientInfo `json:"client"`
-	Sent     DataStats  `json:"sent"`
-	Received DataStats  `json:"received"`
-	Reason   string     `json:"reason"`
+	Server   ServerInfo    `json:"server"`
+	Client   ClientInfo    `json:"client"`
+	Sent     DataStats     `json:"sent"`
+	Received DataStats     `json:"received"`
+	Reason   string        `json:"reason"`
+	Duration time.Duration `json:"duration"`
+}
+
+// RemoteConnectEventMsg is sent when a route or a leafnode connection is
+// established.
+type RemoteConnectEventMsg struct {
+	Server ServerInfo `json:"server"`
+	Remote RemoteInfo `json:"remote"`
+}
+
+// RemoteDisconnectEventMsg is sent when a route or a leafnode connection
+// previously reported with a RemoteConnectEventMsg is closed. Error holds
+// the cause of the close, when known.
+type RemoteDisconnectEventMsg struct {
+	Server   ServerInfo    `json:"server"`
+	Remote   RemoteInfo    `json:"remote"`
+	Reason   string        `json:"reason"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// RemoteInfo identifies the server on the other side of a route or of a
+// leafnode connection.
+type RemoteInfo struct {
+	CID       uint64     `json:"cid"`
+	ID        string     `json:"id,omitempty"`
+	Cluster   string     `json:"cluster,omitempty"`
+	Host      string     `json:"host,omitempty"`
+	Port      int        `json:"port,omitempty"`
+	Account   string     `json:"acc,omitempty"`
+	Solicited bool       `json:"solicited,omitempty"`
+	Start     time.Time  `json:"start"`
+	Stop      *time.Time `json:"stop,omitempty"`
 }
 
 // AccountNumConns is an event that will be sent from a server that is tracking
@@ -100,6 +148,51 @@ type AccountNumConns struct {
 	TotalConns int        `json:"total_conns"`
 }
 
+// AccountErrorsEventMsg is sent when the number of errors of an account within
+// the error window reaches the configured threshold.
+type AccountErrorsEventMsg struct {
+	Server               ServerInfo    `json:"server"`
+	Account              string        `json:"acc"`
+	Threshold            int           `json:"threshold"`
+	Window               time.Duration `json:"window"`
+	SlowConsumers        int64         `json:"slow_consumers"`
+	PermissionViolations int64         `json:"permission_violations"`
+	ProtocolErrors       int64         `json:"protocol_errors"`
+}
+
+// SlowConsumerEventMsg is sent when a connection is marked as a slow
+// consumer, with the subjects of the messages it had pending.
+type SlowConsumerEventMsg struct {
+	Server   ServerInfo             `json:"server"`
+	Kind     string                 `json:"kind"`
+	CID      uint64                 `json:"cid"`
+	Name     string                 `json:"name,omitempty"`
+	Account  string                 `json:"acc,omitempty"`
+	Reason   string                 `json:"reason"`
+	Pending  int64                  `json:"pending_bytes"`
+	Subjects []*SlowConsumerSubject `json:"subjects,omitempty"`
+}
+
+// MaxSubscriptionsEventMsg is sent when a connection reaches its maximum
+// number of subscriptions, with the subject of the refused subscription.
+type MaxSubscriptionsEventMsg struct {
+	Server        ServerInfo `json:"server"`
+	Kind          string     `json:"kind"`
+	Client        ClientInfo `json:"client"`
+	Subject       string     `json:"subject,omitempty"`
+	Subscriptions int        `json:"subscriptions"`
+	Max           int        `json:"max_subscriptions"`
+}
+
+// SlowConsumerSubject reports the messages of a subject pending for a slow
+// consumer. The account is set for routes and gateways.
+type SlowConsumerSubject struct {
+	Account string `json:"acc,omitempty"`
+	Subject string `json:"subject"`
+	Msgs    int    `json:"msgs"`
+	Bytes   int64  `json:"bytes"`
+}
+
 // accNumConnsReq is sent when we are starting to track an account for the first
 // time. We will request others send info to us about their local state.
 type accNumConnsReq struct {
@@ -107,28 +200,75 @@ type accNumConnsReq struct {
 	Account string     `json:"acc"`
 }
 
+// AccountDrainRequest is an optional payload for an account drain request.
+// GracePeriod is a duration string, e.g. "30s", and defaults to the lame
+// duck duration.
+type AccountDrainRequest struct {
+	GracePeriod string `json:"grace_period,omitempty"`
+}
+
+// AccountDrainResponse is sent by each server in response to an account
+// drain request.
+type AccountDrainResponse struct {
+	Server  ServerInfo `json:"server"`
+	Account string     `json:"acc"`
+	Clients int        `json:"clients"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// ServerAPIResponse is the response to a monitoring request sent to the
+// servers over the system account. Data holds the monitoring endpoint's
+// result, e.g. a Varz or a Connz.
+type ServerAPIResponse struct {
+	Server ServerInfo  `json:"server"`
+	Data   interface{} `json:"data,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// KickClientReq is the payload of a request to disconnect a client.
+type KickClientReq struct {
+	CID    uint64 `json:"cid"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// LDMClientReq is the payload of a request to signal the lame duck mode to
+// a client.
+type LDMClientReq struct {
+	CID uint64 `json:"cid"`
+}
+
+// LameDuckModeReq is the payload of a request to make a server enter lame
+// duck mode.
+type LameDuckModeReq struct {
+	// Duration over which the clients are closed, the lame_duck_duration
+	// of the server if empty.
+	Duration string `json:"duration,omitempty"`
+}
+
 // ServerInfo identifies remote servers.
 type ServerInfo struct {
 	Host    string    `json:"host"`
 	ID      string    `json:"id"`
 	Cluster string    `json:"cluster,omitempty"`
 	Version string    `json:"ver"`
+	Tags    []string  `json:"tags,omitempty"`
 	Seq     uint64    `json:"seq"`
 	Time    time.Time `json:"time"`
 }
 
 // ClientInfo is detailed information about the client forming a connection.
 type ClientInfo struct {
-	Start   time.Time  `json:"start,omitempty"`
-	Host    string     `json:"host,omitempty"`
-	ID      uint64     `json:"id"`
-	Account string     `json:"acc"`
-	User    string     `json:"user,omitempty"`
-	Name    string     `json:"name,omitempty"`
-	Lang    string     `json:"lang,omitempty"`
-	Version string     `json:"ver,omitempty"`
-	RTT     string     `json:"rtt,omitempty"`
-	Stop    *time.Time `json:"stop,omitempty"`
+	Start   time.Time         `json:"start,omitempty"`
+	Host    string            `json:"host,omitempty"`
+	ID      uint64            `json:"id"`
+	Account string            `json:"acc"`
+	User    string            `json:"user,omitempty"`
+	Name    string            `json:"name,omitempty"`
+	Lang    string            `json:"lang,omitempty"`
+	Version string            `json:"ver,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	RTT     string            `json:"rtt,omitempty"`
+	Stop    *time.Time        `json:"stop,omitempty"`
 }
 
 // ServerStats hold various statistics that we will periodically send out.
@@ -146,6 +286,7 @@ type ServerStats struct {
 	SlowConsumers    int64          `json:"slow_consumers"`
 	Routes           []*RouteStat   `json:"routes,omitempty"`
 	Gateways         []*GatewayStat `json:"gateways,omitempty"`
+	Accounts         []*AccountStat `json:"accounts,omitempty"`
 }
 
 // RouteStat holds route statistics.
@@ -165,6 +306,17 @@ type GatewayStat struct {
 	NumInbound int       `json:"inbound_connections"`
 }
 
+// AccountStat holds account statistics. Sent and received
+// only account for local clients and leafnodes of the account.
+type AccountStat struct {
+	Account   string    `json:"acc"`
+	Conns     int       `json:"conns"`
+	LeafNodes int       `json:"leafnodes"`
+	NumSubs   uint32    `json:"subscriptions"`
+	Sent      DataStats `json:"sent"`
+	Received  DataStats `json:"received"`
+}
+
 // DataStats reports how may msg and bytes. Applicable for both sent and received.
 type DataStats struct {
 	Msgs  int64 `json:"msgs"`
@@ -201,10 +353,6 @@ func (s *Server) internalSendLoop(wg *sync.WaitGroup) {
 	id := s.info.ID
 	host := s.info.Host
 	seqp := &s.sys.seq
-	var cluster string
-	if s.gateway.enabled {
-		cluster = s.getGatewayName()
-	}
 	s.mu.Unlock()
 
 	for s.eventsRunning() {
@@ -214,10 +362,11 @@ func (s *Server) internalSendLoop(wg *sync.WaitGroup) {
 		case pm := <-sendq:
 			if pm.si != nil {
 				pm.si.Host = host
-				pm.si.Cluster = cluster
+				pm.si.Cluster = s.ClusterName()
 				pm.si.ID = id
 				pm.si.Seq = seq
 				pm.si.Version = VERSION
+				pm.si.Tags = s.getOpts().Tags
 				pm.si.Time = time.Now()
 			}
 			var b []byte
@@ -391,9 +540,41 @@ func (s *Server) sendStatsz(subj string) {
 		}
 		gw.RUnlock()
 	}
+	// Only report accounts with local connections.
+	s.accounts.Range(func(k, v interface{}) bool {
+		acc := v.(*Account)
+		acc.mu.RLock()
+		active := acc.numLocalConnections() > 0 || acc.numLocalLeafNodes() > 0
+		acc.mu.RUnlock()
+		if active {
+			m.Stats.Accounts = append(m.Stats.Accounts, acc.stat())
+		}
+		return true
+	})
 	s.sendInternalMsg(subj, _EMPTY_, &m.Server, &m)
 }
 
+// Generate an account stat for our statz update.
+func (a *Account) stat() *AccountStat {
+	a.mu.RLock()
+	as := &AccountStat{
+		Account:   a.Name,
+		Conns:     a.numLocalConnections(),
+		LeafNodes: a.numLocalLeafNodes(),
+		NumSubs:   a.sl.Count(),
+	}
+	a.mu.RUnlock()
+	as.Sent = DataStats{
+		Msgs:  atomic.LoadInt64(&a.outMsgs),
+		Bytes: atomic.LoadInt64(&a.outBytes),
+	}
+	as.Received = DataStats{
+		Msgs:  atomic.LoadInt64(&a.inMsgs),
+		Bytes: atomic.LoadInt64(&a.inBytes),
+	}
+	return as
+}
+
 // Send out our statz update.
 // This should be wrapChk() to setup common locking.
 func (s *Server) heartbeatStatsz() {
@@ -403,6 +584,15 @@ func (s *Server) heartbeatStatsz() {
 	s.sendStatsz(fmt.Sprintf(serverStatsSubj, s.info.ID))
 }
 
+// Returns the interval of the statsz updates, the events heartbeat
+// interval if not configured.
+func statszInterval(d time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return eventsHBInterval
+}
+
 // This should be wrapChk() to setup common locking.
 func (s *Server) startStatszTimer() {
 	s.sys.stmr = time.AfterFunc(s.sys.statsz, s.wrapChk(s.heartbeatStatsz))
@@ -454,7 +644,88 @@ func (s *Server) initEventTracking() {
 		s.Errorf("Error setting up internal tracking: %v", err)
 	}
 	// Listen for ping messages that will be sent to all servers for statsz.
-	if _, err := s.sysSubscribe(serverStatsPingReqSubj, s.statszReq); err != nil {
+	if _, err := s.sysSubscribe(serverStatsPingReqSubj, s.filterPingReq(s.statszReq)); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	// Listen for monitoring requests, sent either to this server or to all.
+	monSrvc := map[string]msgHandler{
+		"VARZ": func(sub *subscription, subject, reply string, _, msg []byte) {
+			optz := &VarzOptions{}
+			s.zReq(reply, msg, optz, func() (interface{}, error) { return s.Varz(optz) })
+		},
+		"CONNZ": func(sub *subscription, subject, reply string, _, msg []byte) {
+			optz := &ConnzOptions{}
+			s.zReq(reply, msg, optz, func() (interface{}, error) { return s.Connz(optz) })
+		},
+		"SUBSZ": func(sub *subscription, subject, reply string, _, msg []byte) {
+			optz := &SubszOptions{}
+			s.zReq(reply, msg, optz, func() (interface{}, error) { return s.Subsz(optz) })
+		},
+		"ROUTEZ": func(sub *subscription, subject, reply string, _, msg []byte) {
+			optz := &RoutezOptions{}
+			s.zReq(reply, msg, optz, func() (interface{}, error) { return s.Routez(optz) })
+		},
+	}
+	for name, req := range monSrvc {
+		subject = fmt.Sprintf(serverDirectReqSubj, s.info.ID, name)
+		if _, err := s.sysSubscribe(subject, req); err != nil {
+			s.Errorf("Error setting up internal tracking: %v", err)
+		}
+		subject = fmt.Sprintf(serverPingReqSubj, name)
+		if _, err := s.sysSubscribe(subject, s.filterPingReq(req)); err != nil {
+			s.Errorf("Error setting up internal tracking: %v", err)
+		}
+	}
+	// Listen for requests on a given client, only sent to this server.
+	clientSrvc := map[string]msgHandler{
+		"KICK": func(sub *subscription, subject, reply string, _, msg []byte) {
+			optz := &KickClientReq{}
+			s.zReq(reply, msg, optz, func() (interface{}, error) {
+				return nil, s.DisconnectClientByID(optz.CID, optz.Reason)
+			})
+		},
+		"LDM": func(sub *subscription, subject, reply string, _, msg []byte) {
+			optz := &LDMClientReq{}
+			s.zReq(reply, msg, optz, func() (interface{}, error) {
+				return nil, s.LDMClientByID(optz.CID)
+			})
+		},
+	}
+	for name, req := range clientSrvc {
+		subject = fmt.Sprintf(serverDirectReqSubj, s.info.ID, name)
+		if _, err := s.sysSubscribe(subject, req); err != nil {
+			s.Errorf("Error setting up internal tracking: %v", err)
+		}
+	}
+	// Listen for profile requests, only sent to this server. Profiles can take
+	// a while to capture, so they are answered from their own go routine.
+	subject = fmt.Sprintf(serverDirectReqSubj, s.info.ID, "PROFILEZ")
+	if _, err := s.sysSubscribe(subject, func(sub *subscription, subject, reply string, _, msg []byte) {
+		optz := &ProfilezOptions{}
+		go s.zReq(reply, msg, optz, func() (interface{}, error) { return s.Profilez(optz) })
+	}); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	// Listen for requests to enter lame duck mode, only sent to this server.
+	subject = fmt.Sprintf(serverDirectReqSubj, s.info.ID, "LAMEDUCK")
+	if _, err := s.sysSubscribe(subject, func(sub *subscription, subject, reply string, _, msg []byte) {
+		optz := &LameDuckModeReq{}
+		s.zReq(reply, msg, optz, func() (interface{}, error) {
+			var dur time.Duration
+			if optz.Duration != _EMPTY_ {
+				var err error
+				if dur, err = time.ParseDuration(optz.Duration); err != nil || dur <= 0 {
+					return nil, fmt.Errorf("invalid duration %q", optz.Duration)
+				}
+			}
+			return nil, s.LameDuckMode(dur)
+		})
+	}); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	// Listen for requests to drain the clients of a given account.
+	subject = fmt.Sprintf(accDrainReqSubj, "*")
+	if _, err := s.sysSubscribe(subject, s.accountDrainReq); err != nil {
 		s.Errorf("Error setting up internal tracking: %v", err)
 	}
 	// Listen for updates when leaf nodes connect for a given account. This will
@@ -466,7 +737,7 @@ func (s *Server) initEventTracking() {
 }
 
 // accountClaimUpdate will receive claim updates for accounts.
-func (s *Server) accountClaimUpdate(sub *subscription, subject, reply string, msg []byte) {
+func (s *Server) accountClaimUpdate(sub *subscription, subject, reply string, _, msg []byte) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if !s.eventsEnabled() {
@@ -499,7 +770,7 @@ func (s *Server) processRemoteServerShutdown(sid string) {
 }
 
 // remoteServerShutdownEvent is called when we get an event from another server shutting down.
-func (s *Server) remoteServerShutdown(sub *subscription, subject, reply string, msg []byte) {
+func (s *Server) remoteServerShutdown(sub *subscription, subject, reply string, _, msg []byte) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if !s.eventsEnabled() {
@@ -573,7 +844,7 @@ func (s *Server) shutdownEventing() {
 }
 
 // Request for our local connection count.
-func (s *Server) connsRequest(sub *subscription, subject, reply string, msg []byte) {
+func (s *Server) connsRequest(sub *subscription, subject, reply string, _, msg []byte) {
 	if !s.eventsRunning() {
 		return
 	}
@@ -593,9 +864,94 @@ func (s *Server) connsRequest(sub *subscription, subject, reply string, msg []by
 	}
 }
 
+// accountDrainReq will drain the local clients of the account in the subject.
+func (s *Server) accountDrainReq(sub *subscription, subject, reply string, _, msg []byte) {
+	if !s.eventsRunning() {
+		return
+	}
+	toks := strings.Split(subject, tsep)
+	if len(toks) < accReqTokens {
+		s.Debugf("Received account drain request on bad subject %q", subject)
+		return
+	}
+	m := AccountDrainResponse{Account: toks[accReqAccIndex]}
+	dur := s.getOpts().LameDuckDuration
+	if len(msg) > 0 {
+		req := AccountDrainRequest{}
+		if err := json.Unmarshal(msg, &req); err != nil {
+			m.Error = fmt.Sprintf("invalid drain request: %v", err)
+		} else if req.GracePeriod != _EMPTY_ {
+			if dur, err = time.ParseDuration(req.GracePeriod); err != nil {
+				m.Error = fmt.Sprintf("invalid grace period: %v", err)
+			}
+		}
+	}
+	if m.Error == _EMPTY_ {
+		if acc, err := s.lookupAccount(m.Account); err != nil {
+			m.Error = err.Error()
+		} else if m.Clients, err = s.drainAccount(acc, dur); err != nil {
+			m.Error = err.Error()
+		}
+	}
+	if reply == _EMPTY_ {
+		return
+	}
+	s.mu.Lock()
+	s.sendInternalMsg(reply, _EMPTY_, &m.Server, &m)
+	s.mu.Unlock()
+}
+
+// EventFilterOptions select the servers answering a request sent to all
+// servers, only the servers having all the tags answer.
+type EventFilterOptions struct {
+	Tags []string `json:"tags,omitempty"`
+}
+
+// filterPingReq returns a handler for requests sent to all servers, which
+// ignores the requests whose filter does not select this server.
+func (s *Server) filterPingReq(h msgHandler) msgHandler {
+	return func(sub *subscription, subject, reply string, hdr, msg []byte) {
+		if len(msg) > 0 {
+			var fo EventFilterOptions
+			// An invalid request is reported by the handler.
+			if err := json.Unmarshal(msg, &fo); err == nil && !hasAllTags(s.getOpts().Tags, fo.Tags) {
+				return
+			}
+		}
+		h(sub, subject, reply, hdr, msg)
+	}
+}
+
+// zReq answers a request sent over the system account. The optional payload
+// holds the JSON encoded options of the request.
+func (s *Server) zReq(reply string, msg []byte, optz interface{}, respf func() (interface{}, error)) {
+	if !s.eventsRunning() {
+		return
+	}
+	m := ServerAPIResponse{}
+	if len(msg) > 0 {
+		if err := json.Unmarshal(msg, optz); err != nil {
+			m.Error = fmt.Sprintf("invalid request: %v", err)
+		}
+	}
+	if m.Error == _EMPTY_ {
+		if data, err := respf(); err != nil {
+			m.Error = err.Error()
+		} else {
+			m.Data = data
+		}
+	}
+	if reply == _EMPTY_ {
+		return
+	}
+	s.mu.Lock()
+	s.sendInternalMsg(reply, _EMPTY_, &m.Server, &m)
+	s.mu.Unlock()
+}
+
 // leafNodeConnected is an event we will receive when a leaf node for a given account
 // connects.
-func (s *Server) leafNodeConnected(sub *subscription, subject, reply string, msg []byte) {
+func (s *Server) leafNodeConnected(sub *subscription, subject, reply string, _, msg []byte) {
 	m := accNumConnsReq{}
 	if err := json.Unmarshal(msg, &m); err != nil {
 		s.sys.client.Errorf("Error unmarshalling account connections request message: %v", err)
@@ -616,7 +972,7 @@ func (s *Server) leafNodeConnected(sub *subscription, subject, reply string, msg
 }
 
 // statszReq is a request for us to respond with current statz.
-func (s *Server) statszReq(sub *subscription, subject, reply string, msg []byte) {
+func (s *Server) statszReq(sub *subscription, subject, reply string, _, msg []byte) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if !s.eventsEnabled() || reply == _EMPTY_ {
@@ -626,7 +982,7 @@ func (s *Server) statszReq(sub *subscription, subject, reply string, msg []byte)
 }
 
 // remoteConnsUpdate gets called when we receive a remote update from another server.
-func (s *Server) remoteConnsUpdate(sub *subscription, subject, reply string, msg []byte) {
+func (s *Server) remoteConnsUpdate(sub *subscription, subject, reply string, _, msg []byte) {
 	if !s.eventsRunning() {
 		return
 	}
@@ -782,8 +1138,10 @@ func (s *Server) accountConnectEvent(c *client) {
 			Name:    c.opts.Name,
 			Lang:    c.opts.Lang,
 			Version: c.opts.Version,
+			Tags:    c.opts.Tags,
 		},
 	}
+	c.flags.set(connectEventSent)
 	c.mu.Unlock()
 
 	s.mu.Lock()
@@ -791,11 +1149,141 @@ func (s *Server) accountConnectEvent(c *client) {
 	s.mu.Unlock()
 }
 
+// Returns the identity of the server on the other side of a route or of
+// a leafnode connection.
+// Lock should be held.
+func (c *client) remoteInfo() RemoteInfo {
+	ri := RemoteInfo{
+		CID:   c.cid,
+		Host:  c.host,
+		Port:  int(c.port),
+		Start: c.start,
+	}
+	switch c.kind {
+	case ROUTER:
+		if c.route != nil {
+			ri.ID = c.route.remoteID
+			ri.Solicited = c.route.didSolicit
+		}
+	case LEAF:
+		if c.leaf != nil {
+			ri.ID = c.leaf.remoteServer
+			ri.Cluster = c.leaf.remoteCluster
+		}
+		ri.Solicited = c.isSolicitedLeafNode()
+		if c.acc != nil {
+			ri.Account = c.acc.Name
+		}
+	}
+	return ri
+}
+
+// remoteConnectEvent will send an event when a route or a leafnode
+// connection is established.
+func (s *Server) remoteConnectEvent(c *client) {
+	s.mu.Lock()
+	if !s.eventsEnabled() {
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+
+	subj := routeConnectEventSubj
+	if c.kind == LEAF {
+		subj = leafConnectEventSubj
+	}
+	c.mu.Lock()
+	m := RemoteConnectEventMsg{Remote: c.remoteInfo()}
+	c.flags.set(remoteEventSent)
+	c.mu.Unlock()
+
+	s.mu.Lock()
+	s.sendInternalMsg(fmt.Sprintf(subj, s.info.ID), _EMPTY_, &m.Server, &m)
+	s.mu.Unlock()
+}
+
+// remoteDisconnectEvent will send an event when a route or a leafnode
+// connection that was reported as connected is closed.
+func (s *Server) remoteDisconnectEvent(c *client, reason ClosedState) {
+	s.mu.Lock()
+	if !s.eventsEnabled() {
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+
+	subj := routeDisconnectEventSubj
+	if c.kind == LEAF {
+		subj = leafDisconnectEventSubj
+	}
+	now := time.Now()
+	c.mu.Lock()
+	if !c.flags.isSet(remoteEventSent) {
+		c.mu.Unlock()
+		return
+	}
+	m := RemoteDisconnectEventMsg{
+		Remote:   c.remoteInfo(),
+		Reason:   reason.String(),
+		Error:    c.closeErr,
+		Duration: now.Sub(c.start),
+	}
+	m.Remote.Stop = &now
+	c.mu.Unlock()
+
+	s.mu.Lock()
+	s.sendInternalMsg(fmt.Sprintf(subj, s.info.ID), _EMPTY_, &m.Server, &m)
+	s.mu.Unlock()
+}
+
+// accountErrorsEvent will send an event when an account reached the error
+// threshold within the error window.
+func (s *Server) accountErrorsEvent(acc *Account, threshold int, window time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	m := AccountErrorsEventMsg{
+		Account:              acc.Name,
+		Threshold:            threshold,
+		Window:               window,
+		SlowConsumers:        atomic.LoadInt64(&acc.slowConsumers),
+		PermissionViolations: atomic.LoadInt64(&acc.permViolations),
+		ProtocolErrors:       atomic.LoadInt64(&acc.protoErrors),
+	}
+	s.Warnf("Account %q reached %d errors within %v", acc.Name, threshold, window)
+	subj := fmt.Sprintf(accErrorsEventSubj, acc.Name)
+	s.sendInternalMsg(subj, _EMPTY_, &m.Server, &m)
+}
+
+// slowConsumerEvent will send an event about a slow consumer.
+func (s *Server) slowConsumerEvent(m *SlowConsumerEventMsg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	subj := fmt.Sprintf(slowConsumerEventSubj, s.info.ID)
+	s.sendInternalMsg(subj, _EMPTY_, &m.Server, m)
+}
+
+// maxSubsEvent will send an event about a connection that reached its
+// maximum number of subscriptions.
+func (s *Server) maxSubsEvent(m *MaxSubscriptionsEventMsg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	subj := fmt.Sprintf(maxSubsEventSubj, s.info.ID)
+	s.sendInternalMsg(subj, _EMPTY_, &m.Server, m)
+}
+
 // accountDisconnectEvent will send an account client disconnect event if there is interest.
 // This is a billing event.
 func (s *Server) accountDisconnectEvent(c *client, now time.Time, reason string) {
 	s.mu.Lock()
-	gacc := s.gacc
 	if !s.eventsEnabled() {
 		s.mu.Unlock()
 		return
@@ -804,8 +1292,8 @@ func (s *Server) accountDisconnectEvent(c *client, now time.Time, reason string)
 
 	c.mu.Lock()
 
-	// Ignore global account activity
-	if c.acc == nil || c.acc == gacc {
+	// Only report connections we have reported as connected.
+	if c.acc == nil || !c.flags.isSet(connectEventSent) {
 		c.mu.Unlock()
 		return
 	}
@@ -821,6 +1309,7 @@ func (s *Server) accountDisconnectEvent(c *client, now time.Time, reason string)
 			Name:    c.opts.Name,
 			Lang:    c.opts.Lang,
 			Version: c.opts.Version,
+			Tags:    c.opts.Tags,
 			RTT:     c.getRTT(),
 		},
 		Sent: DataStats{
@@ -831,7 +1320,8 @@ func (s *Server) accountDisconnectEvent(c *client, now time.Time, reason string)
 			Msgs:  c.outMsgs,
 			Bytes: c.outBytes,
 		},
-		Reason: reason,
+		Reason:   reason,
+		Duration: now.Sub(c.start),
 	}
 	c.mu.Unlock()
 
@@ -862,6 +1352,7 @@ func (s *Server) sendAuthErrorEvent(c *client) {
 			Name:    c.opts.Name,
 			Lang:    c.opts.Lang,
 			Version: c.opts.Version,
+			Tags:    c.opts.Tags,
 			RTT:     c.getRTT(),
 		},
 		Sent: DataStats{
@@ -885,9 +1376,9 @@ func (s *Server) sendAuthErrorEvent(c *client) {
 
 // Internal message callback. If the msg is needed past the callback it is
 // required to be copied.
-type msgHandler func(sub *subscription, subject, reply string, msg []byte)
+type msgHandler func(sub *subscription, subject, reply string, hdr, msg []byte)
 
-func (s *Server) deliverInternalMsg(sub *subscription, subject, reply, msg []byte) {
+func (s *Server) deliverInternalMsg(sub *subscription, subject, reply, hdr, msg []byte) {
 	s.mu.Lock()
 	if !s.eventsEnabled() || s.sys.subs == nil {
 		s.mu.Unlock()
@@ -896,7 +1387,7 @@ func (s *Server) deliverInternalMsg(sub *subscription, subject, reply, msg []byt
 	cb := s.sys.subs[string(sub.sid)]
 	s.mu.Unlock()
 	if cb != nil {
-		cb(sub, string(subject), string(reply), msg)
+		cb(sub, string(subject), string(reply), hdr, msg)
 	}
 }
 
@@ -942,6 +1433,9 @@ func nameForClient(c *client) string {
 	if c.user != nil {
 		return c.user.Nkey
 	}
+	if c.opts.Username != _EMPTY_ {
+		return c.opts.Username
+	}
 	return "N/A"
 }
 
@@ -14,12 +14,16 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"reflect"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -378,7 +382,7 @@ func TestSystemAccountInternalSubscriptions(t *testing.T) {
 
 	received := make(chan *nats.Msg)
 	// Create message callback handler.
-	cb := func(sub *subscription, subject, reply string, msg []byte) {
+	cb := func(sub *subscription, subject, reply string, _, msg []byte) {
 		copy := append([]byte(nil), msg...)
 		received <- &nats.Msg{Subject: subject, Reply: reply, Data: copy}
 	}
@@ -452,7 +456,7 @@ func TestSystemAccountConnectionUpdatesStopAfterNoLocal(t *testing.T) {
 
 	// Listen for updates to the new account connection activity.
 	received := make(chan *nats.Msg, 10)
-	cb := func(sub *subscription, subject, reply string, msg []byte) {
+	cb := func(sub *subscription, subject, reply string, _, msg []byte) {
 		copy := append([]byte(nil), msg...)
 		received <- &nats.Msg{Subject: subject, Reply: reply, Data: copy}
 	}
@@ -835,6 +839,279 @@ func TestSystemAccountFromConfig(t *testing.T) {
 	}
 }
 
+func TestSystemAccountConnectEventsConfigAccounts(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		system_account: SYS
+		accounts {
+			SYS { users [{user: sys, password: pwd}] }
+			FOO { users [{user: foo, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ncs, err := nats.Connect(fmt.Sprintf("nats://sys:pwd@%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncs.Close()
+
+	sub, _ := ncs.SubscribeSync("$SYS.ACCOUNT.FOO.>")
+	defer sub.Unsubscribe()
+	ncs.Flush()
+
+	// A bad login should not produce any event on the account.
+	if _, err := nats.Connect(fmt.Sprintf("nats://foo:bad@%s:%d", opts.Host, opts.Port)); err == nil {
+		t.Fatal("Expected error on connect")
+	}
+	// Nor should a CONNECT failing the checks that follow the authentication.
+	c, err := net.Dial("tcp", net.JoinHostPort(opts.Host, fmt.Sprintf("%d", opts.Port)))
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	br := bufio.NewReader(c)
+	br.ReadString('\n')
+	c.Write([]byte("CONNECT {\"user\":\"foo\",\"pass\":\"pwd\",\"protocol\":99}\r\n"))
+	if l, _ := br.ReadString('\n'); !strings.Contains(l, ErrBadClientProtocol.Error()) {
+		t.Fatalf("Expected protocol error, got %q", l)
+	}
+	if msg, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected event %q", msg.Subject)
+	}
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://foo:pwd@%s:%d", opts.Host, opts.Port), nats.Name("FOO EVENTS"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	msg, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Error receiving msg: %v", err)
+	}
+	if msg.Subject != "$SYS.ACCOUNT.FOO.CONNECT" {
+		t.Fatalf("Expected connect event, got %q", msg.Subject)
+	}
+	cem := ConnectEventMsg{}
+	if err := json.Unmarshal(msg.Data, &cem); err != nil {
+		t.Fatalf("Error unmarshalling connect event message: %v", err)
+	}
+	if cem.Client.Account != "FOO" || cem.Client.User != "foo" || cem.Client.Name != "FOO EVENTS" {
+		t.Fatalf("Unexpected client info: %+v", cem.Client)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	nc.Close()
+
+	msg, err = sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Error receiving msg: %v", err)
+	}
+	if msg.Subject != "$SYS.ACCOUNT.FOO.DISCONNECT" {
+		t.Fatalf("Expected disconnect event, got %q", msg.Subject)
+	}
+	dem := DisconnectEventMsg{}
+	if err := json.Unmarshal(msg.Data, &dem); err != nil {
+		t.Fatalf("Error unmarshalling disconnect event message: %v", err)
+	}
+	if dem.Client.ID != cem.Client.ID || dem.Reason != ClientClosed.String() {
+		t.Fatalf("Unexpected disconnect event: %+v", dem)
+	}
+	if dem.Duration < 50*time.Millisecond {
+		t.Fatalf("Expected duration of at least 50ms, got %v", dem.Duration)
+	}
+	if _, err := sub.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected no more events, got %v", err)
+	}
+}
+
+func TestSystemAccountDefaultFromConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			$SYS {
+				users [{user: monitor, password: pwd, permissions: {publish: "_INBOX.>", subscribe: "$SYS.>"}}]
+			}
+			FOO { users [{user: foo, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	if acc := s.SystemAccount(); acc == nil || acc.Name != DEFAULT_SYSTEM_ACCOUNT {
+		t.Fatalf("Expected system account to be %q, got %v", DEFAULT_SYSTEM_ACCOUNT, acc)
+	}
+
+	errCh := make(chan error, 1)
+	ncs, err := nats.Connect(fmt.Sprintf("nats://monitor:pwd@%s:%d", opts.Host, opts.Port),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			errCh <- err
+		}))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncs.Close()
+
+	sub, _ := ncs.SubscribeSync("$SYS.ACCOUNT.FOO.CONNECT")
+	ncs.Flush()
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://foo:pwd@%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	if _, err := sub.NextMsg(time.Second); err != nil {
+		t.Fatalf("Error receiving connect event: %v", err)
+	}
+
+	// The monitoring user should not be able to publish system events.
+	ncs.Publish("$SYS.ACCOUNT.FOO.CONNECT", []byte("{}"))
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), "Permissions Violation") {
+			t.Fatalf("Expected permissions violation, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected permissions violation")
+	}
+}
+
+func TestSystemAccountErrorsEvent(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		system_account: SYS
+		account_error_threshold: 3
+		accounts {
+			SYS { users [{user: sys, password: pwd}] }
+			FOO { users [{user: foo, password: pwd, permissions: {publish: {deny: "bar"}}}] }
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ncs, err := nats.Connect(fmt.Sprintf("nats://sys:pwd@%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncs.Close()
+	sub, _ := ncs.SubscribeSync(fmt.Sprintf(accErrorsEventSubj, "FOO"))
+	ncs.Flush()
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://foo:pwd@%s:%d", opts.Host, opts.Port),
+		nats.ErrorHandler(func(*nats.Conn, *nats.Subscription, error) {}))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	for i := 0; i < 5; i++ {
+		nc.Publish("bar", []byte("hello"))
+	}
+	nc.Flush()
+
+	msg, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Error receiving account errors event: %v", err)
+	}
+	em := AccountErrorsEventMsg{}
+	if err := json.Unmarshal(msg.Data, &em); err != nil {
+		t.Fatalf("Error unmarshalling event: %v", err)
+	}
+	if em.Account != "FOO" || em.Threshold != 3 || em.Window != DEFAULT_ACCOUNT_ERROR_WINDOW {
+		t.Fatalf("Unexpected event: %+v", em)
+	}
+	if em.PermissionViolations < 3 {
+		t.Fatalf("Expected at least 3 permission violations, got %d", em.PermissionViolations)
+	}
+	// Only one event per window.
+	if _, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatal("Did not expect another event")
+	}
+
+	az, err := s.Accountz(&AccountzOptions{Account: "FOO"})
+	if err != nil {
+		t.Fatalf("Error getting accountz: %v", err)
+	}
+	if ai := az.Accounts[0]; ai.PermViolations != 5 || ai.ProtoErrors != 0 || ai.SlowConsumers != 0 {
+		t.Fatalf("Unexpected account error stats: %+v", ai)
+	}
+}
+
+func TestSystemAccountDrainRequest(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		system_account: SYS
+		accounts {
+			SYS { users [{user: sys, password: pwd}] }
+			FOO { users [{user: foo, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ncs, err := nats.Connect(fmt.Sprintf("nats://sys:pwd@%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncs.Close()
+
+	dch := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		nc, err := nats.Connect(fmt.Sprintf("nats://foo:pwd@%s:%d", opts.Host, opts.Port),
+			nats.NoReconnect(), nats.DisconnectHandler(func(*nats.Conn) { dch <- struct{}{} }))
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		defer nc.Close()
+	}
+
+	subj := fmt.Sprintf(accDrainReqSubj, "FOO")
+	// Bad grace period
+	msg, err := ncs.Request(subj, []byte(`{"grace_period": "abc"}`), time.Second)
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	resp := AccountDrainResponse{}
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		t.Fatalf("Error unmarshalling response: %v", err)
+	}
+	if resp.Error == "" {
+		t.Fatal("Expected an error for invalid grace period")
+	}
+
+	msg, err = ncs.Request(subj, []byte(`{"grace_period": "50ms"}`), time.Second)
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	resp = AccountDrainResponse{}
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		t.Fatalf("Error unmarshalling response: %v", err)
+	}
+	if resp.Error != "" || resp.Account != "FOO" || resp.Clients != 2 || resp.Server.ID != s.ID() {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-dch:
+		case <-time.After(time.Second):
+			t.Fatal("Client was not disconnected")
+		}
+	}
+	if !ncs.IsConnected() {
+		t.Fatal("System account client should still be connected")
+	}
+}
+
 func TestAccountClaimsUpdates(t *testing.T) {
 	s, opts := runTrustedServer(t)
 	defer s.Shutdown()
@@ -1014,7 +1291,7 @@ func TestSystemAccountWithGateways(t *testing.T) {
 	nca.Flush()
 	// If this tests fails with wrong number after 10 seconds we may have
 	// added a new inititial subscription for the eventing system.
-	checkExpectedSubs(t, 9, sa)
+	checkExpectedSubs(t, 22, sa)
 
 	// Create a client on B and see if we receive the event
 	urlb := fmt.Sprintf("nats://%s:%d", ob.Host, ob.Port)
@@ -1161,6 +1438,15 @@ func TestServerEventsStatsZ(t *testing.T) {
 	if lr := len(m3.Stats.Routes); lr != 1 {
 		t.Fatalf("Expected a route, but got %d", lr)
 	}
+	var sas *AccountStat
+	for _, as := range m3.Stats.Accounts {
+		if as.Account == optsA.SystemAccount {
+			sas = as
+		}
+	}
+	if sas == nil || sas.Conns != 1 || sas.Received.Msgs < 2 {
+		t.Fatalf("Unexpected account stat for system account: %+v", sas)
+	}
 }
 
 func TestServerEventsPingStatsZ(t *testing.T) {
@@ -1200,6 +1486,433 @@ func TestServerEventsPingStatsZ(t *testing.T) {
 	}
 }
 
+func TestServerEventsStatszInterval(t *testing.T) {
+	confTmpl := `
+		listen: "127.0.0.1:-1"
+		system_account: SYS
+		statsz_interval: "%s"
+		accounts {
+			SYS { users [{user: sys, password: pwd}] }
+			FOO { users [{user: foo, password: pwd}] }
+		}
+	`
+	conf := createConfFile(t, []byte(fmt.Sprintf(confTmpl, "50ms")))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ncs, err := nats.Connect(fmt.Sprintf("nats://sys:pwd@%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncs.Close()
+	sub, _ := ncs.SubscribeSync(fmt.Sprintf(serverStatsSubj, s.ID()))
+	ncs.Flush()
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://foo:pwd@%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	nc.Publish("foo", []byte("hello"))
+	nc.Flush()
+
+	// The updates are sent at the configured interval, with a summary of
+	// the accounts with local connections.
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		msg, err := sub.NextMsg(time.Second)
+		if err != nil {
+			return err
+		}
+		m := ServerStatsMsg{}
+		if err := json.Unmarshal(msg.Data, &m); err != nil {
+			t.Fatalf("Error unmarshalling the statz json: %v", err)
+		}
+		for _, as := range m.Stats.Accounts {
+			if as.Account == "FOO" && as.Conns == 1 && as.Received.Msgs == 1 {
+				return nil
+			}
+		}
+		return fmt.Errorf("account FOO not reported: %+v", m.Stats.Accounts)
+	})
+
+	// The interval can be changed with a reload.
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(confTmpl, "1h")))
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	s.mu.Lock()
+	statsz := s.sys.statsz
+	s.mu.Unlock()
+	if statsz != time.Hour {
+		t.Fatalf("Expected statsz interval to be 1h, got %v", statsz)
+	}
+	// Drain the updates that may have been sent before the reload.
+	for {
+		if _, err := sub.NextMsg(100 * time.Millisecond); err != nil {
+			break
+		}
+	}
+	if msg, err := sub.NextMsg(250 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected statsz update: %s", msg.Data)
+	}
+}
+
+func TestServerEventsMonitoringRequests(t *testing.T) {
+	sa, _, sb, optsB, akp := runTrustedCluster(t)
+	defer sa.Shutdown()
+	defer sb.Shutdown()
+
+	url := fmt.Sprintf("nats://%s:%d", optsB.Host, optsB.Port)
+	nc, err := nats.Connect(url, createUserCreds(t, sb, akp))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	request := func(subj, req string, data interface{}) *ServerAPIResponse {
+		t.Helper()
+		msg, err := nc.Request(subj, []byte(req), time.Second)
+		if err != nil {
+			t.Fatalf("Error on request %q: %v", subj, err)
+		}
+		resp := &ServerAPIResponse{Data: data}
+		if err := json.Unmarshal(msg.Data, resp); err != nil {
+			t.Fatalf("Error unmarshalling the response: %v", err)
+		}
+		return resp
+	}
+
+	// The requests are answered by the remote server.
+	varz := &Varz{}
+	if resp := request(fmt.Sprintf(serverDirectReqSubj, sa.ID(), "VARZ"), _EMPTY_, varz); resp.Error != _EMPTY_ || resp.Server.ID != sa.ID() || varz.ID != sa.ID() {
+		t.Fatalf("Unexpected varz response: %+v - %+v", resp, varz)
+	}
+	connz := &Connz{}
+	if resp := request(fmt.Sprintf(serverDirectReqSubj, sb.ID(), "CONNZ"), `{"auth": true}`, connz); resp.Error != _EMPTY_ || connz.ID != sb.ID() || connz.NumConns != 1 {
+		t.Fatalf("Unexpected connz response: %+v - %+v", resp, connz)
+	}
+	routez := &Routez{}
+	if resp := request(fmt.Sprintf(serverDirectReqSubj, sa.ID(), "ROUTEZ"), _EMPTY_, routez); resp.Error != _EMPTY_ || routez.NumRoutes != 1 {
+		t.Fatalf("Unexpected routez response: %+v - %+v", resp, routez)
+	}
+	subsz := &Subsz{}
+	req := fmt.Sprintf(`{"account": %q}`, sa.SystemAccount().Name)
+	if resp := request(fmt.Sprintf(serverDirectReqSubj, sa.ID(), "SUBSZ"), req, subsz); resp.Error != _EMPTY_ || subsz.NumSubs == 0 {
+		t.Fatalf("Unexpected subsz response: %+v - %+v", resp, subsz)
+	}
+
+	// Errors are reported in the response.
+	if resp := request(fmt.Sprintf(serverDirectReqSubj, sa.ID(), "SUBSZ"), `{"account": "NOT_THERE"}`, nil); resp.Error == _EMPTY_ || resp.Data != nil {
+		t.Fatalf("Expected an error, got %+v", resp)
+	}
+	if resp := request(fmt.Sprintf(serverDirectReqSubj, sa.ID(), "CONNZ"), "bad", nil); !strings.Contains(resp.Error, "invalid request") {
+		t.Fatalf("Expected an invalid request error, got %+v", resp)
+	}
+
+	// A ping is answered by all servers.
+	reply := nc.NewRespInbox()
+	sub, _ := nc.SubscribeSync(reply)
+	nc.PublishRequest(fmt.Sprintf(serverPingReqSubj, "VARZ"), reply, nil)
+	ids := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		msg, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Error receiving msg: %v", err)
+		}
+		varz := &Varz{}
+		if err := json.Unmarshal(msg.Data, &ServerAPIResponse{Data: varz}); err != nil {
+			t.Fatalf("Error unmarshalling the response: %v", err)
+		}
+		ids[varz.ID] = true
+	}
+	if !ids[sa.ID()] || !ids[sb.ID()] {
+		t.Fatalf("Expected responses from both servers, got %v", ids)
+	}
+}
+
+func TestServerEventsKickAndLDMClient(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		system_account: SYS
+		accounts {
+			SYS { users [{user: sys, password: pwd}] }
+			FOO { users [{user: foo, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ncs, err := nats.Connect(fmt.Sprintf("nats://sys:pwd@%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncs.Close()
+
+	request := func(name, req string) *ServerAPIResponse {
+		t.Helper()
+		msg, err := ncs.Request(fmt.Sprintf(serverDirectReqSubj, s.ID(), name), []byte(req), time.Second)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		resp := &ServerAPIResponse{}
+		if err := json.Unmarshal(msg.Data, resp); err != nil {
+			t.Fatalf("Error unmarshalling the response: %v", err)
+		}
+		return resp
+	}
+
+	// A client that supports async INFO protocols is asked to reconnect.
+	conn, err := net.Dial("tcp", net.JoinHostPort(opts.Host, fmt.Sprintf("%d", opts.Port)))
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	if _, err := br.ReadString('\n'); err != nil {
+		t.Fatalf("Error reading INFO: %v", err)
+	}
+	conn.Write([]byte("CONNECT {\"protocol\":1,\"verbose\":false,\"user\":\"foo\",\"pass\":\"pwd\"}\r\nPING\r\n"))
+	if l, err := br.ReadString('\n'); err != nil || l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q - %v", l, err)
+	}
+	cz, _ := s.Connz(&ConnzOptions{Account: "FOO"})
+	if len(cz.Conns) != 1 {
+		t.Fatalf("Expected one connection, got %+v", cz.Conns)
+	}
+	cid := cz.Conns[0].Cid
+	if resp := request("LDM", fmt.Sprintf(`{"cid": %d}`, cid)); resp.Error != _EMPTY_ {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	l, err := br.ReadString('\n')
+	if err != nil || !strings.HasPrefix(l, "INFO ") {
+		t.Fatalf("Expected INFO, got %q - %v", l, err)
+	}
+	var info Info
+	if err := json.Unmarshal([]byte(l[5:]), &info); err != nil || !info.LameDuckMode {
+		t.Fatalf("Expected lame duck mode in INFO, got %q - %v", l, err)
+	}
+
+	// The client is disconnected with the given reason.
+	if resp := request("KICK", fmt.Sprintf(`{"cid": %d, "reason": "bye"}`, cid)); resp.Error != _EMPTY_ {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	if l, err := br.ReadString('\n'); err != nil || l != "-ERR 'bye'\r\n" {
+		t.Fatalf("Expected -ERR, got %q - %v", l, err)
+	}
+	if _, err := br.ReadString('\n'); err == nil {
+		t.Fatalf("Expected the connection to be closed")
+	}
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		for _, ci := range s.ClosedConnections() {
+			if ci.Cid == cid && ci.Reason == Kicked.String() {
+				return nil
+			}
+		}
+		return fmt.Errorf("client %d not closed", cid)
+	})
+
+	// Unknown clients are reported.
+	for _, name := range []string{"KICK", "LDM"} {
+		if resp := request(name, fmt.Sprintf(`{"cid": %d}`, cid)); resp.Error != ErrClientNotFound.Error() {
+			t.Fatalf("Expected client not found for %s, got %+v", name, resp)
+		}
+	}
+}
+
+func TestServerEventsLameDuckMode(t *testing.T) {
+	atomic.StoreInt64(&lameDuckModeInitialDelay, int64(300*time.Millisecond))
+	defer atomic.StoreInt64(&lameDuckModeInitialDelay, lameDuckModeDefaultInitialDelay)
+
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		system_account: SYS
+		accounts {
+			SYS { users [{user: sys, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ncs, err := nats.Connect(fmt.Sprintf("nats://sys:pwd@%s:%d", opts.Host, opts.Port), nats.NoReconnect())
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncs.Close()
+
+	request := func(req string) *ServerAPIResponse {
+		t.Helper()
+		msg, err := ncs.Request(fmt.Sprintf(serverDirectReqSubj, s.ID(), "LAMEDUCK"), []byte(req), time.Second)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		resp := &ServerAPIResponse{}
+		if err := json.Unmarshal(msg.Data, resp); err != nil {
+			t.Fatalf("Error unmarshalling the response: %v", err)
+		}
+		return resp
+	}
+
+	if resp := request(`{"duration": "soon"}`); !strings.Contains(resp.Error, "invalid duration") {
+		t.Fatalf("Expected invalid duration error, got %+v", resp)
+	}
+	if s.isLameDuckMode() {
+		t.Fatal("Server should not be in lame duck mode")
+	}
+	if resp := request(`{"duration": "400ms"}`); resp.Error != _EMPTY_ {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if !s.isLameDuckMode() {
+			return fmt.Errorf("Server not in lame duck mode")
+		}
+		return nil
+	})
+	if resp := request(_EMPTY_); resp.Error != ErrLameDuckMode.Error() {
+		t.Fatalf("Expected %q, got %+v", ErrLameDuckMode, resp)
+	}
+	// The clients are closed over the given duration, and not the default one.
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if s.isRunning() {
+			return fmt.Errorf("Server still running")
+		}
+		return nil
+	})
+}
+
+func TestServerEventsSlowConsumer(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		system_account: SYS
+		accounts {
+			SYS { users [{user: sys, password: pwd}] }
+			FOO { users [{user: foo, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ncs, err := nats.Connect(fmt.Sprintf("nats://sys:pwd@%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncs.Close()
+	sub, _ := ncs.SubscribeSync(fmt.Sprintf(slowConsumerEventSubj, s.ID()))
+	ncs.Flush()
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://foo:pwd@%s:%d", opts.Host, opts.Port), nats.Name("slow"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	cz, _ := s.Connz(&ConnzOptions{Account: "FOO"})
+	if len(cz.Conns) != 1 {
+		t.Fatalf("Expected one connection, got %+v", cz.Conns)
+	}
+	c := s.getClient(cz.Conns[0].Cid)
+
+	// Queue messages while holding the lock so that they are not flushed,
+	// until the max pending is exceeded.
+	c.mu.Lock()
+	c.out.mp = c.out.pb + 1000
+	for i := 0; i < 20; i++ {
+		c.queueOutbound([]byte("MSG foo.big 1 40\r\n" + strings.Repeat("x", 40) + "\r\n"))
+		if i%4 == 0 {
+			c.queueOutbound([]byte("MSG foo.small 1 5\r\nhello\r\n"))
+		}
+	}
+	c.mu.Unlock()
+
+	msg, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Error receiving slow consumer event: %v", err)
+	}
+	m := SlowConsumerEventMsg{}
+	if err := json.Unmarshal(msg.Data, &m); err != nil {
+		t.Fatalf("Error unmarshalling the event: %v", err)
+	}
+	if m.Server.ID != s.ID() || m.Kind != "Client" || m.CID != c.cid || m.Name != "slow" || m.Account != "FOO" ||
+		m.Reason != SlowConsumerPendingBytes.String() || m.Pending <= 1000 {
+		t.Fatalf("Unexpected event: %+v", m)
+	}
+	if len(m.Subjects) != 2 || m.Subjects[0].Subject != "foo.big" || m.Subjects[1].Subject != "foo.small" {
+		t.Fatalf("Unexpected subjects: %+v", m.Subjects)
+	}
+	if big := m.Subjects[0]; big.Msgs < 10 || big.Bytes != int64(big.Msgs*len("MSG foo.big 1 40\r\n")+big.Msgs*42) {
+		t.Fatalf("Unexpected stats for foo.big: %+v", big)
+	}
+}
+
+func TestServerEventsMaxSubscriptions(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		max_subscriptions: 2
+		system_account: SYS
+		accounts {
+			SYS { users [{user: sys, password: pwd}] }
+			FOO { users [{user: foo, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ncs, err := nats.Connect(fmt.Sprintf("nats://sys:pwd@%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncs.Close()
+	sub, _ := ncs.SubscribeSync(fmt.Sprintf(maxSubsEventSubj, s.ID()))
+	ncs.Flush()
+
+	c, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	cr := bufio.NewReader(c)
+	cr.ReadString('\n')
+	c.Write([]byte("CONNECT {\"verbose\":false,\"user\":\"foo\",\"pass\":\"pwd\",\"name\":\"greedy\"}\r\n" +
+		"SUB foo 1\r\nSUB bar 2\r\nSUB baz 3\r\nSUB bat 4\r\nPING\r\n"))
+	for _, expected := range []string{"-ERR '" + ErrTooManySubs.Error(), "-ERR '" + ErrTooManySubs.Error(), "PONG"} {
+		if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, expected) {
+			t.Fatalf("Expected %q, got %q", expected, l)
+		}
+	}
+
+	// A single advisory is sent, for the first refused subscription.
+	msg, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Error receiving max subscriptions event: %v", err)
+	}
+	m := MaxSubscriptionsEventMsg{}
+	if err := json.Unmarshal(msg.Data, &m); err != nil {
+		t.Fatalf("Error unmarshalling the event: %v", err)
+	}
+	if m.Server.ID != s.ID() || m.Kind != "Client" || m.Client.Name != "greedy" || m.Client.Account != "FOO" ||
+		m.Client.User != "foo" || m.Subject != "baz" || m.Subscriptions != 2 || m.Max != 2 {
+		t.Fatalf("Unexpected event: %+v", m)
+	}
+	if msg, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected event: %s", msg.Data)
+	}
+	// The connection is kept.
+	c.Write([]byte("PING\r\n"))
+	if l, _ := cr.ReadString('\n'); l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q", l)
+	}
+}
+
 func TestGatewayNameClientInfo(t *testing.T) {
 	sa, _, sb, _, _ := runTrustedCluster(t)
 	defer sa.Shutdown()
@@ -1326,7 +2039,7 @@ func TestConnectionUpdatesTimerProperlySet(t *testing.T) {
 
 	// Listen for HB updates...
 	count := int32(0)
-	cb := func(sub *subscription, subject, reply string, msg []byte) {
+	cb := func(sub *subscription, subject, reply string, _, msg []byte) {
 		atomic.AddInt32(&count, 1)
 	}
 	subj := fmt.Sprintf(accConnsEventSubj, pub)
@@ -1370,3 +2083,202 @@ func TestConnectionUpdatesTimerProperlySet(t *testing.T) {
 		return nil
 	})
 }
+
+func TestServerEventsProfilez(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		system_account: SYS
+		prof: true
+		accounts {
+			SYS { users [{user: sys, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ncs, err := nats.Connect(fmt.Sprintf("nats://sys:pwd@%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncs.Close()
+
+	request := func(req string) *ProfilezStatus {
+		t.Helper()
+		msg, err := ncs.Request(fmt.Sprintf(serverDirectReqSubj, s.ID(), "PROFILEZ"), []byte(req), 2*time.Second)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		resp := &ServerAPIResponse{Data: &ProfilezStatus{}}
+		if err := json.Unmarshal(msg.Data, resp); err != nil {
+			t.Fatalf("Error unmarshalling the response: %v", err)
+		}
+		if resp.Error != _EMPTY_ {
+			t.Fatalf("Unexpected error: %v", resp.Error)
+		}
+		return resp.Data.(*ProfilezStatus)
+	}
+
+	ps := request(`{"name": "goroutine", "debug": 1}`)
+	if !bytes.HasPrefix(ps.Profile, []byte("goroutine profile:")) {
+		t.Fatalf("Unexpected goroutine profile: %q", ps.Profile)
+	}
+	if ps := request(fmt.Sprintf(`{"name": "cpu", "duration": %d}`, 100*time.Millisecond)); len(ps.Profile) == 0 {
+		t.Fatalf("Expected a CPU profile")
+	}
+
+	msg, err := ncs.Request(fmt.Sprintf(serverDirectReqSubj, s.ID(), "PROFILEZ"), []byte(`{"name": "bad"}`), time.Second)
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	if !strings.Contains(string(msg.Data), `unknown profile \"bad\"`) {
+		t.Fatalf("Expected an error for an unknown profile, got %s", msg.Data)
+	}
+
+	// Profiles are not available unless profiling is enabled.
+	s2 := RunServer(DefaultOptions())
+	defer s2.Shutdown()
+	if _, err := s2.Profilez(&ProfilezOptions{Name: "heap"}); err != ErrProfilingDisabled {
+		t.Fatalf("Expected %v, got %v", ErrProfilingDisabled, err)
+	}
+}
+
+func TestServerEventsRouteAndLeafNodeConnections(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		system_account: SYS
+		accounts {
+			SYS { users [{user: sys, password: pwd}] }
+		}
+		cluster { name: "A", listen: "127.0.0.1:-1" }
+		leafnodes { listen: "127.0.0.1:-1" }
+	`))
+	defer os.Remove(conf)
+	s1, o1 := RunServerWithConfig(conf)
+	defer s1.Shutdown()
+
+	ncs, err := nats.Connect(fmt.Sprintf("nats://sys:pwd@%s:%d", o1.Host, o1.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncs.Close()
+	routeSub, _ := ncs.SubscribeSync(fmt.Sprintf("$SYS.SERVER.%s.ROUTE.*", s1.ID()))
+	leafSub, _ := ncs.SubscribeSync(fmt.Sprintf("$SYS.SERVER.%s.LEAFNODE.*", s1.ID()))
+	ncs.Flush()
+
+	next := func(sub *nats.Subscription, subj string, ev interface{}) {
+		t.Helper()
+		msg, err := sub.NextMsg(2 * time.Second)
+		if err != nil {
+			t.Fatalf("Error receiving event: %v", err)
+		}
+		if msg.Subject != fmt.Sprintf(subj, s1.ID()) {
+			t.Fatalf("Unexpected subject %q", msg.Subject)
+		}
+		if err := json.Unmarshal(msg.Data, ev); err != nil {
+			t.Fatalf("Error unmarshalling event: %v", err)
+		}
+	}
+
+	o2 := DefaultOptions()
+	o2.Cluster.Name = "A"
+	o2.Cluster.Host = "127.0.0.1"
+	o2.Cluster.Port = -1
+	o2.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", o1.Cluster.Port))
+	s2 := RunServer(o2)
+	checkClusterFormed(t, s1, s2)
+
+	cm := RemoteConnectEventMsg{}
+	next(routeSub, routeConnectEventSubj, &cm)
+	if cm.Server.ID != s1.ID() || cm.Remote.ID != s2.ID() || cm.Remote.Solicited || cm.Remote.Start.IsZero() {
+		t.Fatalf("Unexpected route connect event: %+v", cm)
+	}
+	s2.Shutdown()
+	dm := RemoteDisconnectEventMsg{}
+	next(routeSub, routeDisconnectEventSubj, &dm)
+	if dm.Remote.ID != s2.ID() || dm.Remote.CID != cm.Remote.CID || dm.Reason == _EMPTY_ || dm.Remote.Stop == nil {
+		t.Fatalf("Unexpected route disconnect event: %+v", dm)
+	}
+
+	o3 := DefaultOptions()
+	o3.LeafNode.Remotes = []*RemoteLeafOpts{{
+		URL: &url.URL{Scheme: "nats-leaf", Host: fmt.Sprintf("127.0.0.1:%d", o1.LeafNode.Port)},
+	}}
+	s3 := RunServer(o3)
+	defer s3.Shutdown()
+
+	cm = RemoteConnectEventMsg{}
+	next(leafSub, leafConnectEventSubj, &cm)
+	if cm.Remote.ID != s3.ID() || cm.Remote.Account != globalAccountName || cm.Remote.Solicited {
+		t.Fatalf("Unexpected leafnode connect event: %+v", cm)
+	}
+	// The remote reports an error before closing the connection.
+	s1.mu.Lock()
+	var lc *client
+	for _, l := range s1.leafs {
+		lc = l
+	}
+	s1.mu.Unlock()
+	lc.processErr("'Something went wrong'")
+	dm = RemoteDisconnectEventMsg{}
+	next(leafSub, leafDisconnectEventSubj, &dm)
+	if dm.Remote.ID != s3.ID() || dm.Reason != ParseError.String() || dm.Error != "'Something went wrong'" {
+		t.Fatalf("Unexpected leafnode disconnect event: %+v", dm)
+	}
+}
+
+func TestServerEventsTags(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		server_tags: ["az:us-east-1a", "tier:edge"]
+		system_account: SYS
+		accounts {
+			SYS { users [{user: sys, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ncs, err := nats.Connect(fmt.Sprintf("nats://sys:pwd@%s:%d", opts.Host, opts.Port), nats.NoReconnect())
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncs.Close()
+
+	request := func(filter string) *ServerAPIResponse {
+		t.Helper()
+		msg, err := ncs.Request(fmt.Sprintf(serverPingReqSubj, "VARZ"), []byte(filter), 250*time.Millisecond)
+		if err == nats.ErrTimeout {
+			return nil
+		} else if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		resp := &ServerAPIResponse{}
+		if err := json.Unmarshal(msg.Data, resp); err != nil {
+			t.Fatalf("Error unmarshalling the response: %v", err)
+		}
+		return resp
+	}
+
+	resp := request(`{"tags": ["tier:edge"]}`)
+	if resp == nil {
+		t.Fatal("Expected a response for the server tags")
+	}
+	if !reflect.DeepEqual(resp.Server.Tags, []string{"az:us-east-1a", "tier:edge"}) {
+		t.Fatalf("Unexpected server info tags: %v", resp.Server.Tags)
+	}
+	b, _ := json.Marshal(resp.Data)
+	v := &Varz{}
+	if err := json.Unmarshal(b, v); err != nil {
+		t.Fatalf("Error unmarshalling varz: %v", err)
+	}
+	if !reflect.DeepEqual(v.Tags, []string{"az:us-east-1a", "tier:edge"}) {
+		t.Fatalf("Unexpected varz tags: %v", v.Tags)
+	}
+	if resp := request(`{"tags": ["tier:edge", "az:us-west-2a"]}`); resp != nil {
+		t.Fatalf("Server should not answer a request for other tags, got %+v", resp)
+	}
+}
@@ -0,0 +1,1318 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// FileStoreConfig is the configuration of a file based message store.
+type FileStoreConfig struct {
+	// StoreDir is the directory where the message blocks are stored.
+	StoreDir string
+	// BlockSize is the size at which a new message block is started.
+	BlockSize uint64
+	// Cipher and Key encrypt the messages and the state of the consumers
+	// when the key is set. PrevKey is the key being rotated, the store is
+	// encrypted with Key once opened.
+	Cipher  StoreCipher
+	Key     string
+	PrevKey string
+	// Tier is where the blocks older than the tier threshold of the
+	// stream are offloaded to, under TierPrefix.
+	Tier       tierStore
+	TierPrefix string
+}
+
+const (
+	// Directory holding the message blocks.
+	msgDir = "msgs"
+	// Suffix of message block files.
+	blkSuffix = ".blk"
+	// Default size of message blocks.
+	defaultStreamBlockSize = 8 * 1024 * 1024
+	// Directory holding the state of the consumers.
+	consumerDir = "obs"
+	// File holding the state of a consumer.
+	consumerStateFile = "state.json"
+	// Interval at which changes to the state of consumers are written.
+	consumerStateFlushInterval = 100 * time.Millisecond
+	// File holding the key of an encrypted store, sealed by the
+	// configured key.
+	keyFile = "key"
+	// Version of the format of the key file.
+	keyFileVersion = 1
+	// Size of the header of the key file, the version, the cipher and
+	// the salt.
+	keyFileHdrSize = 2 + 16
+	// Context of the derivation of the key sealing the key of a store.
+	storeKeyInfo = "nats-server store key"
+	// Prefix of the state of a consumer when encrypted, the plain state
+	// is a JSON object.
+	consumerStateEncrypted = 0x01
+)
+
+// Source of the keys, salts and nonces, replaced by tests.
+var storeRand io.Reader = rand.Reader
+
+// Kinds of records in a message block.
+const (
+	recMsg byte = iota
+	recDelete
+	// Written on purge so that the last sequence survives restarts.
+	recSeqMarker
+	// Index of a message of an offloaded block, the message holds its
+	// location in the object.
+	recTiered
+	// Key of the object an offloaded block was uploaded to.
+	recTierRef
+
+	// Set on the kind of message records whose message starts with the
+	// size of its header block, followed by the headers.
+	recHeaders byte = 0x40
+	// Set on the kind of records whose subject and message are encrypted.
+	recEncrypted byte = 0x80
+)
+
+// Size of the record header: length, kind, sequence, timestamp and
+// subject length. A crc32 checksum follows the record.
+const (
+	recHdrSize = 4 + 1 + 8 + 8 + 2
+	recCRCSize = 4
+)
+
+// fileStore is a StreamStore that persists messages in append-only
+// block files. Deletes are recorded in the block of the message, and a
+// block is removed once all its messages are deleted.
+type fileStore struct {
+	mu     sync.RWMutex
+	fcfg   FileStoreConfig
+	cfg    StreamConfig
+	state  StreamState
+	blks   []*msgBlock
+	lmb    *msgBlock
+	fss    subjIndex
+	ageChk *time.Timer
+	scb    func(md, bd int64)
+	aek    cipher.AEAD
+	closed bool
+
+	// Offloading to the tier, and the last offloaded block fetched.
+	tierChk *time.Timer
+	tmu     sync.Mutex
+	tkey    string
+	tbuf    []byte
+}
+
+type msgBlock struct {
+	index uint64
+	fn    string
+	f     *os.File
+	size  int64
+	msgs  map[uint64]*fileMsg
+	// Key of the object holding the messages once offloaded.
+	tkey string
+}
+
+// Location and metadata of a message in a block.
+type fileMsg struct {
+	off  int64
+	rl   uint32
+	subj string
+	ts   int64
+	sz   uint64
+}
+
+func newFileStore(fcfg FileStoreConfig, cfg StreamConfig) (*fileStore, error) {
+	if cfg.Storage != FileStorage {
+		return nil, fmt.Errorf("fileStore requires file storage type in config")
+	}
+	if fcfg.StoreDir == _EMPTY_ {
+		return nil, fmt.Errorf("store directory required")
+	}
+	if fcfg.BlockSize == 0 {
+		fcfg.BlockSize = defaultStreamBlockSize
+	}
+	mdir := filepath.Join(fcfg.StoreDir, msgDir)
+	if err := os.MkdirAll(mdir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create storage directory - %v", err)
+	}
+	fs := &fileStore{fcfg: fcfg, cfg: cfg, fss: make(subjIndex)}
+	if err := fs.setupEncryption(); err != nil {
+		return nil, err
+	}
+	if err := fs.recover(); err != nil {
+		fs.closeBlocks()
+		return nil, err
+	}
+	if fs.lmb == nil {
+		if _, err := fs.newMsgBlock(); err != nil {
+			fs.closeBlocks()
+			return nil, err
+		}
+	}
+	fs.mu.Lock()
+	fs.enforceLimits()
+	if fs.cfg.MaxAge != 0 && fs.state.Msgs > 0 {
+		fs.startAgeChk()
+	}
+	if fs.cfg.TierAfter > 0 && fs.fcfg.Tier != nil {
+		fs.startTierChk()
+	}
+	fs.mu.Unlock()
+	return fs, nil
+}
+
+// Rebuilds the index from the message blocks on disk.
+func (fs *fileStore) recover() error {
+	mdir := filepath.Join(fs.fcfg.StoreDir, msgDir)
+	fis, err := ioutil.ReadDir(mdir)
+	if err != nil {
+		return err
+	}
+	var indexes []uint64
+	for _, fi := range fis {
+		name := fi.Name()
+		if !strings.HasSuffix(name, blkSuffix) {
+			continue
+		}
+		index, err := strconv.ParseUint(strings.TrimSuffix(name, blkSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	for _, index := range indexes {
+		mb, err := fs.loadMsgBlock(index)
+		if err != nil {
+			return err
+		}
+		fs.blks = append(fs.blks, mb)
+		fs.lmb = mb
+		for seq, fm := range mb.msgs {
+			fs.state.Msgs++
+			fs.state.Bytes += fm.sz
+			if fs.state.FirstSeq == 0 || seq < fs.state.FirstSeq {
+				fs.state.FirstSeq = seq
+				fs.state.FirstTime = time.Unix(0, fm.ts).UTC()
+			}
+		}
+	}
+	// Remove blocks with no messages left, except the last one.
+	for i := 0; i < len(fs.blks)-1; i++ {
+		if mb := fs.blks[i]; len(mb.msgs) == 0 {
+			fs.removeMsgBlock(mb)
+			i--
+		}
+	}
+	for _, mb := range fs.blks {
+		for seq, fm := range mb.msgs {
+			fs.fss.add(fm.subj, seq)
+		}
+	}
+	for _, seqs := range fs.fss {
+		sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	}
+	if fs.state.Msgs == 0 {
+		fs.state.FirstSeq = fs.state.LastSeq + 1
+	}
+	return nil
+}
+
+// Loads a message block, truncating a partially written last record.
+// Lock is not needed since this is done when creating the store.
+func (fs *fileStore) loadMsgBlock(index uint64) (*msgBlock, error) {
+	fn := filepath.Join(fs.fcfg.StoreDir, msgDir, fmt.Sprintf("%d%s", index, blkSuffix))
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if fs.aek != nil {
+		if buf, err = fs.encryptMsgBlock(fn, buf); err != nil {
+			return nil, err
+		}
+	}
+	mb := &msgBlock{index: index, fn: fn, msgs: make(map[uint64]*fileMsg)}
+	var off int64
+	for int(off) < len(buf) {
+		kind, seq, ts, subj, msg, rl, err := decodeRecord(buf[off:])
+		if err != nil {
+			// Partial or corrupt record, drop the rest of the block.
+			if err := os.Truncate(fn, off); err != nil {
+				return nil, err
+			}
+			break
+		}
+		// Encrypted records are verified, they are never dropped.
+		if kind&recEncrypted != 0 {
+			if kind, subj, msg, err = fs.decryptRecord(kind, seq, ts, msg); err != nil {
+				return nil, fmt.Errorf("message block %d failed verification - %v", index, err)
+			}
+		}
+		var hdr []byte
+		if kind, hdr, msg, err = recordMsgParts(kind, msg); err != nil {
+			return nil, fmt.Errorf("message block %d failed verification - %v", index, err)
+		}
+		switch kind {
+		case recMsg:
+			mb.msgs[seq] = &fileMsg{off: off, rl: rl, subj: subj, ts: ts, sz: storedMsgSize(subj, hdr, msg)}
+			if seq > fs.state.LastSeq {
+				fs.state.LastSeq = seq
+				fs.state.LastTime = time.Unix(0, ts).UTC()
+			}
+		case recTiered:
+			fm, err := decodeTierLoc(msg, subj, ts)
+			if err != nil {
+				return nil, fmt.Errorf("message block %d failed verification - %v", index, err)
+			}
+			mb.msgs[seq] = fm
+			if seq > fs.state.LastSeq {
+				fs.state.LastSeq = seq
+				fs.state.LastTime = time.Unix(0, ts).UTC()
+			}
+		case recTierRef:
+			mb.tkey = string(msg)
+		case recDelete:
+			delete(mb.msgs, seq)
+		case recSeqMarker:
+			if seq > fs.state.LastSeq {
+				fs.state.LastSeq = seq
+				fs.state.LastTime = time.Unix(0, ts).UTC()
+			}
+		}
+		off += int64(rl)
+	}
+	mb.size = off
+	if mb.f, err = os.OpenFile(fn, os.O_RDWR, 0644); err != nil {
+		return nil, err
+	}
+	return mb, nil
+}
+
+// Creates a new message block that becomes the last one.
+// Lock should be held, or not needed when creating the store.
+func (fs *fileStore) newMsgBlock() (*msgBlock, error) {
+	var index uint64 = 1
+	if fs.lmb != nil {
+		index = fs.lmb.index + 1
+	}
+	fn := filepath.Join(fs.fcfg.StoreDir, msgDir, fmt.Sprintf("%d%s", index, blkSuffix))
+	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error creating msg block file - %v", err)
+	}
+	mb := &msgBlock{index: index, fn: fn, f: f, msgs: make(map[uint64]*fileMsg)}
+	fs.blks = append(fs.blks, mb)
+	fs.lmb = mb
+	return mb, nil
+}
+
+// Closes and removes the block file. Lock should be held.
+func (fs *fileStore) removeMsgBlock(mb *msgBlock) {
+	if mb.f != nil {
+		mb.f.Close()
+		mb.f = nil
+	}
+	os.Remove(mb.fn)
+	if mb.tkey != _EMPTY_ && fs.fcfg.Tier != nil {
+		go fs.fcfg.Tier.Delete(mb.tkey)
+	}
+	for i, b := range fs.blks {
+		if b == mb {
+			fs.blks = append(fs.blks[:i], fs.blks[i+1:]...)
+			break
+		}
+	}
+	if fs.lmb == mb {
+		fs.lmb = nil
+	}
+}
+
+// Encodes a record in the block format.
+func encodeRecord(kind byte, seq uint64, ts int64, subj string, msg []byte) []byte {
+	rl := recHdrSize + len(subj) + len(msg) + recCRCSize
+	buf := make([]byte, rl)
+	binary.LittleEndian.PutUint32(buf[0:], uint32(rl))
+	buf[4] = kind
+	binary.LittleEndian.PutUint64(buf[5:], seq)
+	binary.LittleEndian.PutUint64(buf[13:], uint64(ts))
+	binary.LittleEndian.PutUint16(buf[21:], uint16(len(subj)))
+	copy(buf[recHdrSize:], subj)
+	copy(buf[recHdrSize+len(subj):], msg)
+	crc := crc32.ChecksumIEEE(buf[4 : rl-recCRCSize])
+	binary.LittleEndian.PutUint32(buf[rl-recCRCSize:], crc)
+	return buf
+}
+
+// Decodes the record at the start of buf and validates its checksum.
+// The returned message references buf.
+func decodeRecord(buf []byte) (kind byte, seq uint64, ts int64, subj string, msg []byte, rl uint32, err error) {
+	if len(buf) < recHdrSize+recCRCSize {
+		return 0, 0, 0, _EMPTY_, nil, 0, ErrStoreCorrupt
+	}
+	rl = binary.LittleEndian.Uint32(buf[0:])
+	if rl < recHdrSize+recCRCSize || int(rl) > len(buf) {
+		return 0, 0, 0, _EMPTY_, nil, 0, ErrStoreCorrupt
+	}
+	crc := binary.LittleEndian.Uint32(buf[rl-recCRCSize:])
+	if crc32.ChecksumIEEE(buf[4:rl-recCRCSize]) != crc {
+		return 0, 0, 0, _EMPTY_, nil, 0, ErrStoreCorrupt
+	}
+	kind = buf[4]
+	seq = binary.LittleEndian.Uint64(buf[5:])
+	ts = int64(binary.LittleEndian.Uint64(buf[13:]))
+	slen := int(binary.LittleEndian.Uint16(buf[21:]))
+	if recHdrSize+slen > int(rl)-recCRCSize {
+		return 0, 0, 0, _EMPTY_, nil, 0, ErrStoreCorrupt
+	}
+	subj = string(buf[recHdrSize : recHdrSize+slen])
+	msg = buf[recHdrSize+slen : rl-recCRCSize]
+	return kind, seq, ts, subj, msg, rl, nil
+}
+
+// Encodes a record of the kind carrying a subject and message, with its
+// header block if any, encrypted if the store is.
+func (fs *fileStore) encodeMsgRecord(kind byte, seq uint64, ts int64, subj string, hdr, msg []byte) ([]byte, error) {
+	if len(hdr) > 0 {
+		buf := make([]byte, 4+len(hdr)+len(msg))
+		binary.LittleEndian.PutUint32(buf, uint32(len(hdr)))
+		copy(buf[4:], hdr)
+		copy(buf[4+len(hdr):], msg)
+		kind, msg = kind|recHeaders, buf
+	}
+	if fs.aek == nil {
+		return encodeRecord(kind, seq, ts, subj, msg), nil
+	}
+	pt := make([]byte, 2+len(subj)+len(msg))
+	binary.LittleEndian.PutUint16(pt, uint16(len(subj)))
+	copy(pt[2:], subj)
+	copy(pt[2+len(subj):], msg)
+	kind |= recEncrypted
+	ct, err := sealData(fs.aek, pt, recordAD(kind, seq, ts))
+	if err != nil {
+		return nil, err
+	}
+	return encodeRecord(kind, seq, ts, _EMPTY_, ct), nil
+}
+
+// Decrypts the subject and message of an encrypted record, returns the
+// kind of the record.
+func (fs *fileStore) decryptRecord(kind byte, seq uint64, ts int64, ct []byte) (byte, string, []byte, error) {
+	if fs.aek == nil {
+		return 0, _EMPTY_, nil, ErrStoreEncrypted
+	}
+	pt, err := openData(fs.aek, ct, recordAD(kind, seq, ts))
+	if err != nil || len(pt) < 2 {
+		return 0, _EMPTY_, nil, ErrStoreCorrupt
+	}
+	slen := int(binary.LittleEndian.Uint16(pt))
+	if 2+slen > len(pt) {
+		return 0, _EMPTY_, nil, ErrStoreCorrupt
+	}
+	return kind &^ recEncrypted, string(pt[2 : 2+slen]), pt[2+slen:], nil
+}
+
+// Splits the message of a record into its header block, if the kind has
+// the flag, and message. Returns the kind without the flag.
+func recordMsgParts(kind byte, msg []byte) (byte, []byte, []byte, error) {
+	if kind&recHeaders == 0 {
+		return kind, nil, msg, nil
+	}
+	if len(msg) < 4 {
+		return 0, nil, nil, ErrStoreCorrupt
+	}
+	hl := binary.LittleEndian.Uint32(msg)
+	if uint64(hl) > uint64(len(msg)-4) {
+		return 0, nil, nil, ErrStoreCorrupt
+	}
+	return kind &^ recHeaders, msg[4 : 4+hl], msg[4+hl:], nil
+}
+
+// Authenticated data of an encrypted record, so that it can not be moved.
+func recordAD(kind byte, seq uint64, ts int64) []byte {
+	ad := make([]byte, 17)
+	ad[0] = kind
+	binary.LittleEndian.PutUint64(ad[1:], seq)
+	binary.LittleEndian.PutUint64(ad[9:], uint64(ts))
+	return ad
+}
+
+// Rewrites the block with its messages encrypted if some are not, which
+// is the case for stores written before the key was set. Returns the
+// content of the block.
+func (fs *fileStore) encryptMsgBlock(fn string, buf []byte) ([]byte, error) {
+	var nbuf []byte
+	var plain bool
+	for off := 0; off < len(buf); {
+		kind, seq, ts, subj, msg, rl, err := decodeRecord(buf[off:])
+		if err != nil {
+			break
+		}
+		rec := buf[off : off+int(rl)]
+		// The header block stays part of the message of the record.
+		if k := kind &^ recHeaders; k == recMsg || k == recTiered {
+			if rec, err = fs.encodeMsgRecord(kind, seq, ts, subj, nil, msg); err != nil {
+				return nil, err
+			}
+			plain = true
+		}
+		nbuf = append(nbuf, rec...)
+		off += int(rl)
+	}
+	if !plain {
+		return buf, nil
+	}
+	tmp := fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, nbuf, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, fn); err != nil {
+		return nil, err
+	}
+	return nbuf, nil
+}
+
+// Opens the key of the store with the configured key, the previous key
+// when rotating, or creates it for a new store. An existing store keeps
+// the cipher it was created with.
+func (fs *fileStore) setupEncryption() error {
+	kfn := filepath.Join(fs.fcfg.StoreDir, keyFile)
+	buf, err := ioutil.ReadFile(kfn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if fs.fcfg.Key == _EMPTY_ {
+		if buf != nil {
+			return ErrStoreEncrypted
+		}
+		return nil
+	}
+	var key []byte
+	write := buf == nil
+	if buf == nil {
+		key = make([]byte, 32)
+		if _, err := io.ReadFull(storeRand, key); err != nil {
+			return err
+		}
+	} else {
+		sc, k, err := openKeyFile(buf, fs.fcfg.Key)
+		if err == ErrStoreKeyMismatch && fs.fcfg.PrevKey != _EMPTY_ {
+			sc, k, err = openKeyFile(buf, fs.fcfg.PrevKey)
+			write = true
+		}
+		if err != nil {
+			return err
+		}
+		fs.fcfg.Cipher, key = sc, k
+	}
+	if write {
+		kb, err := sealKeyFile(fs.fcfg.Cipher, fs.fcfg.Key, key)
+		if err != nil {
+			return err
+		}
+		tmp := kfn + ".tmp"
+		if err := ioutil.WriteFile(tmp, kb, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, kfn); err != nil {
+			return err
+		}
+	}
+	fs.aek, err = newStoreAEAD(fs.fcfg.Cipher, key)
+	return err
+}
+
+// Seals the key of the store with the configured key in the format of
+// the key file: its version, the cipher, a random salt and the sealed
+// key, authenticated with the header.
+func sealKeyFile(sc StoreCipher, passphrase string, key []byte) ([]byte, error) {
+	buf := make([]byte, keyFileHdrSize, keyFileHdrSize+len(key)+64)
+	buf[0], buf[1] = keyFileVersion, byte(sc)
+	if _, err := io.ReadFull(storeRand, buf[2:keyFileHdrSize]); err != nil {
+		return nil, err
+	}
+	kek, err := newStoreAEAD(sc, deriveStoreKey(passphrase, buf[2:keyFileHdrSize]))
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealData(kek, key, buf)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, sealed...), nil
+}
+
+// Opens the key file sealed by sealKeyFile, returns the cipher of the
+// store and its key.
+func openKeyFile(buf []byte, passphrase string) (StoreCipher, []byte, error) {
+	if len(buf) < keyFileHdrSize || buf[0] != keyFileVersion {
+		return NoCipher, nil, ErrStoreCorrupt
+	}
+	sc := StoreCipher(buf[1])
+	kek, err := newStoreAEAD(sc, deriveStoreKey(passphrase, buf[2:keyFileHdrSize]))
+	if err != nil {
+		return NoCipher, nil, err
+	}
+	key, err := openData(kek, buf[keyFileHdrSize:], buf[:keyFileHdrSize])
+	if err != nil {
+		return NoCipher, nil, ErrStoreKeyMismatch
+	}
+	return sc, key, nil
+}
+
+// Returns the 256 bits key derived from the configured key and the salt
+// of the store.
+func deriveStoreKey(passphrase string, salt []byte) []byte {
+	key := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, []byte(passphrase), salt, []byte(storeKeyInfo)), key)
+	return key
+}
+
+// Returns the AEAD of the cipher for the key.
+func newStoreAEAD(sc StoreCipher, key []byte) (cipher.AEAD, error) {
+	switch sc {
+	case AES:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case ChaCha:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, fmt.Errorf("unsupported store cipher %v", sc)
+	}
+}
+
+// Encrypts the data, the random nonce is prepended to the result.
+func sealData(aead cipher.AEAD, data, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := io.ReadFull(storeRand, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, ad), nil
+}
+
+// Decrypts and authenticates data encrypted by sealData.
+func openData(aead cipher.AEAD, data, ad []byte) ([]byte, error) {
+	ns := aead.NonceSize()
+	if len(data) < ns {
+		return nil, ErrStoreCorrupt
+	}
+	return aead.Open(nil, data[:ns], data[ns:], ad)
+}
+
+// Appends a record to the block. Lock should be held.
+func (mb *msgBlock) writeRecord(rec []byte) (int64, error) {
+	off := mb.size
+	n, err := mb.f.WriteAt(rec, off)
+	mb.size += int64(n)
+	return off, err
+}
+
+// StoreMsg stores a message.
+func (fs *fileStore) StoreMsg(subj string, hdr, msg []byte) (uint64, int64, error) {
+	return fs.storeMsg(subj, hdr, msg, 0, 0)
+}
+
+// StoreRawMsg stores a message with the given sequence and timestamp.
+func (fs *fileStore) StoreRawMsg(subj string, hdr, msg []byte, seq uint64, ts int64) error {
+	if seq == 0 {
+		return ErrStoreSeqOutOfOrder
+	}
+	_, _, err := fs.storeMsg(subj, hdr, msg, seq, ts)
+	return err
+}
+
+// Stores the message, the next sequence and the current time are used
+// when not given.
+func (fs *fileStore) storeMsg(subj string, hdr, msg []byte, seq uint64, ts int64) (uint64, int64, error) {
+	fs.mu.Lock()
+	if fs.closed {
+		fs.mu.Unlock()
+		return 0, 0, ErrStoreClosed
+	}
+	if seq == 0 {
+		seq = fs.state.LastSeq + 1
+	} else if seq <= fs.state.LastSeq {
+		fs.mu.Unlock()
+		return 0, 0, ErrStoreSeqOutOfOrder
+	}
+	if ts == 0 {
+		ts = time.Now().UnixNano()
+	}
+	rec, err := fs.encodeMsgRecord(recMsg, seq, ts, subj, hdr, msg)
+	if err != nil {
+		fs.mu.Unlock()
+		return 0, 0, err
+	}
+
+	mb := fs.lmb
+	if mb.size > 0 && uint64(mb.size)+uint64(len(rec)) > fs.fcfg.BlockSize {
+		if mb, err = fs.newMsgBlock(); err != nil {
+			fs.mu.Unlock()
+			return 0, 0, err
+		}
+	}
+	off, err := mb.writeRecord(rec)
+	if err != nil {
+		fs.mu.Unlock()
+		return 0, 0, err
+	}
+	sz := storedMsgSize(subj, hdr, msg)
+	mb.msgs[seq] = &fileMsg{off: off, rl: uint32(len(rec)), subj: subj, ts: ts, sz: sz}
+	fs.fss.add(subj, seq)
+	if fs.state.Msgs == 0 {
+		fs.state.FirstSeq = seq
+		fs.state.FirstTime = time.Unix(0, ts).UTC()
+	}
+	fs.state.Msgs++
+	fs.state.Bytes += sz
+	fs.state.LastSeq = seq
+	fs.state.LastTime = time.Unix(0, ts).UTC()
+
+	removed, removedBytes := fs.enforcePerSubject(subj)
+	r, rb := fs.enforceLimits()
+	removed, removedBytes = removed+r, removedBytes+rb
+	if fs.ageChk == nil && fs.cfg.MaxAge != 0 {
+		fs.startAgeChk()
+	}
+	cb := fs.scb
+	fs.mu.Unlock()
+
+	if cb != nil {
+		cb(1-int64(removed), int64(sz)-int64(removedBytes))
+	}
+	return seq, ts, nil
+}
+
+// Removes the oldest messages of the subject while over the limit per
+// subject. Lock should be held.
+func (fs *fileStore) enforcePerSubject(subj string) (uint64, uint64) {
+	var removed, removedBytes uint64
+	for fs.cfg.MaxMsgsPer > 0 && len(fs.fss[subj]) > int(fs.cfg.MaxMsgsPer) {
+		removedBytes += fs.removeMsg(fs.fss[subj][0])
+		removed++
+	}
+	return removed, removedBytes
+}
+
+// Removes the oldest messages while over the limits. Returns the number
+// of messages and bytes removed. Lock should be held.
+func (fs *fileStore) enforceLimits() (uint64, uint64) {
+	var removed, removedBytes uint64
+	for fs.cfg.MaxMsgs > 0 && fs.state.Msgs > uint64(fs.cfg.MaxMsgs) {
+		removedBytes += fs.removeMsg(fs.state.FirstSeq)
+		removed++
+	}
+	for fs.cfg.MaxBytes > 0 && fs.state.Bytes > uint64(fs.cfg.MaxBytes) {
+		removedBytes += fs.removeMsg(fs.state.FirstSeq)
+		removed++
+	}
+	return removed, removedBytes
+}
+
+// Returns the block holding the message. Lock should be held.
+func (fs *fileStore) msgBlockForSeq(seq uint64) (*msgBlock, *fileMsg) {
+	for _, mb := range fs.blks {
+		if fm, ok := mb.msgs[seq]; ok {
+			return mb, fm
+		}
+	}
+	return nil, nil
+}
+
+// Removes the message, records the delete and updates the state.
+// Returns the size of the message removed. Lock should be held.
+func (fs *fileStore) removeMsg(seq uint64) uint64 {
+	mb, fm := fs.msgBlockForSeq(seq)
+	if mb == nil {
+		return 0
+	}
+	delete(mb.msgs, seq)
+	fs.fss.remove(fm.subj, seq)
+	if len(mb.msgs) == 0 && mb != fs.lmb {
+		fs.removeMsgBlock(mb)
+	} else {
+		mb.writeRecord(encodeRecord(recDelete, seq, 0, _EMPTY_, nil))
+	}
+	fs.state.Msgs--
+	fs.state.Bytes -= fm.sz
+	if seq == fs.state.FirstSeq {
+		fs.updateFirst()
+	}
+	return fm.sz
+}
+
+// Lock should be held.
+func (fs *fileStore) updateFirst() {
+	if fs.state.Msgs == 0 {
+		fs.state.FirstSeq = fs.state.LastSeq + 1
+		fs.state.FirstTime = time.Time{}
+		return
+	}
+	for seq := fs.state.FirstSeq; seq <= fs.state.LastSeq; seq++ {
+		if _, fm := fs.msgBlockForSeq(seq); fm != nil {
+			fs.state.FirstSeq = seq
+			fs.state.FirstTime = time.Unix(0, fm.ts).UTC()
+			return
+		}
+	}
+}
+
+// Lock should be held.
+func (fs *fileStore) startAgeChk() {
+	fs.ageChk = time.AfterFunc(fs.cfg.MaxAge, fs.expireMsgs)
+}
+
+// Removes the messages older than the max age.
+func (fs *fileStore) expireMsgs() {
+	var removed, removedBytes uint64
+	fs.mu.Lock()
+	if fs.closed {
+		fs.mu.Unlock()
+		return
+	}
+	minAge := time.Now().UnixNano() - int64(fs.cfg.MaxAge)
+	for fs.state.Msgs > 0 {
+		_, fm := fs.msgBlockForSeq(fs.state.FirstSeq)
+		if fm == nil || fm.ts > minAge {
+			break
+		}
+		removedBytes += fs.removeMsg(fs.state.FirstSeq)
+		removed++
+	}
+	if fs.state.Msgs == 0 || fs.cfg.MaxAge == 0 {
+		fs.ageChk = nil
+	} else {
+		_, fm := fs.msgBlockForSeq(fs.state.FirstSeq)
+		fs.ageChk.Reset(time.Duration(fm.ts - minAge))
+	}
+	cb := fs.scb
+	fs.mu.Unlock()
+
+	if cb != nil && removed > 0 {
+		cb(-int64(removed), -int64(removedBytes))
+	}
+}
+
+// Reads the message from its block. Read lock should be held, it is
+// released before fetching the block if it was offloaded.
+func (fs *fileStore) readMsgAndUnlock(seq uint64, mb *msgBlock, fm *fileMsg) (*StoredMsg, error) {
+	if mb.tkey != _EMPTY_ {
+		key, off, rl := mb.tkey, fm.off, fm.rl
+		fs.mu.RUnlock()
+		return fs.readTieredMsg(seq, key, off, rl)
+	}
+	defer fs.mu.RUnlock()
+	buf := make([]byte, fm.rl)
+	if _, err := mb.f.ReadAt(buf, fm.off); err != nil {
+		return nil, err
+	}
+	return fs.decodeMsg(seq, buf)
+}
+
+// Decodes the message record read from a block.
+func (fs *fileStore) decodeMsg(seq uint64, buf []byte) (*StoredMsg, error) {
+	kind, rseq, ts, subj, msg, _, err := decodeRecord(buf)
+	if err == nil && kind&recEncrypted != 0 {
+		kind, subj, msg, err = fs.decryptRecord(kind, rseq, ts, msg)
+	}
+	var hdr []byte
+	if err == nil {
+		kind, hdr, msg, err = recordMsgParts(kind, msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if kind != recMsg || rseq != seq {
+		return nil, ErrStoreCorrupt
+	}
+	sm := &StoredMsg{Subject: subj, Sequence: seq, Time: time.Unix(0, ts).UTC()}
+	if len(hdr) > 0 {
+		sm.Header = hdr
+	}
+	if len(msg) > 0 {
+		sm.Data = msg
+	}
+	return sm, nil
+}
+
+// LoadMsg returns the message with the given sequence.
+func (fs *fileStore) LoadMsg(seq uint64) (*StoredMsg, error) {
+	fs.mu.RLock()
+	if fs.closed {
+		fs.mu.RUnlock()
+		return nil, ErrStoreClosed
+	}
+	mb, fm := fs.msgBlockForSeq(seq)
+	if mb == nil {
+		last := fs.state.LastSeq
+		fs.mu.RUnlock()
+		if seq > last {
+			return nil, ErrStoreEOF
+		}
+		return nil, ErrStoreMsgNotFound
+	}
+	return fs.readMsgAndUnlock(seq, mb, fm)
+}
+
+// LoadLastMsg returns the last message stored on the given subject.
+func (fs *fileStore) LoadLastMsg(subj string) (*StoredMsg, error) {
+	fs.mu.RLock()
+	if fs.closed {
+		fs.mu.RUnlock()
+		return nil, ErrStoreClosed
+	}
+	for i := len(fs.blks) - 1; i >= 0; i-- {
+		mb := fs.blks[i]
+		var lseq uint64
+		var lfm *fileMsg
+		for seq, fm := range mb.msgs {
+			if seq > lseq && (subj == _EMPTY_ || matchLiteral(fm.subj, subj)) {
+				lseq, lfm = seq, fm
+			}
+		}
+		if lfm != nil {
+			return fs.readMsgAndUnlock(lseq, mb, lfm)
+		}
+	}
+	fs.mu.RUnlock()
+	return nil, ErrStoreMsgNotFound
+}
+
+// SubjectSeqs returns the sequences of the messages stored on the
+// literal subject, in order.
+func (fs *fileStore) SubjectSeqs(subj string) []uint64 {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.fss.seqs(subj)
+}
+
+// LastSeqs returns the sequence of the last message of each subject
+// matching the filter, in order.
+func (fs *fileStore) LastSeqs(filter string) []uint64 {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.fss.lastSeqs(filter)
+}
+
+// RemoveMsg removes the message with the given sequence.
+func (fs *fileStore) RemoveMsg(seq uint64) (bool, error) {
+	fs.mu.Lock()
+	if fs.closed {
+		fs.mu.Unlock()
+		return false, ErrStoreClosed
+	}
+	sz := fs.removeMsg(seq)
+	cb := fs.scb
+	fs.mu.Unlock()
+
+	if sz == 0 {
+		return false, nil
+	}
+	if cb != nil {
+		cb(-1, -int64(sz))
+	}
+	return true, nil
+}
+
+// Purge removes all messages. The last sequence is recorded in a new
+// block so that it survives restarts.
+func (fs *fileStore) Purge() (uint64, error) {
+	fs.mu.Lock()
+	if fs.closed {
+		fs.mu.Unlock()
+		return 0, ErrStoreClosed
+	}
+	purged, bytes := fs.state.Msgs, fs.state.Bytes
+	for len(fs.blks) > 0 {
+		fs.removeMsgBlock(fs.blks[0])
+	}
+	fs.fss = make(subjIndex)
+	mb, err := fs.newMsgBlock()
+	if err != nil {
+		fs.mu.Unlock()
+		return 0, err
+	}
+	if _, err := mb.writeRecord(encodeRecord(recSeqMarker, fs.state.LastSeq, time.Now().UnixNano(), _EMPTY_, nil)); err != nil {
+		fs.mu.Unlock()
+		return 0, err
+	}
+	fs.state.Msgs, fs.state.Bytes = 0, 0
+	fs.updateFirst()
+	cb := fs.scb
+	fs.mu.Unlock()
+
+	if cb != nil && purged > 0 {
+		cb(-int64(purged), -int64(bytes))
+	}
+	return purged, nil
+}
+
+// SkipMsg uses the sequence without storing a message. The sequence is
+// recorded so that it survives restarts.
+func (fs *fileStore) SkipMsg(seq uint64) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.closed {
+		return ErrStoreClosed
+	}
+	if seq <= fs.state.LastSeq {
+		return ErrStoreSeqOutOfOrder
+	}
+	return fs.skipTo(seq)
+}
+
+// Records the sequence as the last one. Lock should be held.
+func (fs *fileStore) skipTo(seq uint64) error {
+	ts := time.Now().UnixNano()
+	if _, err := fs.lmb.writeRecord(encodeRecord(recSeqMarker, seq, ts, _EMPTY_, nil)); err != nil {
+		return err
+	}
+	fs.state.LastSeq = seq
+	fs.state.LastTime = time.Unix(0, ts).UTC()
+	if fs.state.Msgs == 0 {
+		fs.updateFirst()
+	}
+	return nil
+}
+
+// Compact removes the messages below the sequence.
+func (fs *fileStore) Compact(seq uint64) (uint64, error) {
+	fs.mu.Lock()
+	if fs.closed {
+		fs.mu.Unlock()
+		return 0, ErrStoreClosed
+	}
+	var removed, removedBytes uint64
+	for fs.state.Msgs > 0 && fs.state.FirstSeq < seq {
+		removedBytes += fs.removeMsg(fs.state.FirstSeq)
+		removed++
+	}
+	var err error
+	if seq > fs.state.LastSeq+1 {
+		err = fs.skipTo(seq - 1)
+	}
+	cb := fs.scb
+	fs.mu.Unlock()
+
+	if cb != nil && removed > 0 {
+		cb(-int64(removed), -int64(removedBytes))
+	}
+	return removed, err
+}
+
+// GetSeqFromTime returns the first sequence stored at or after the time.
+func (fs *fileStore) GetSeqFromTime(t time.Time) uint64 {
+	ts := t.UnixNano()
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	for seq := fs.state.FirstSeq; seq <= fs.state.LastSeq; seq++ {
+		if _, fm := fs.msgBlockForSeq(seq); fm != nil && fm.ts >= ts {
+			return seq
+		}
+	}
+	return fs.state.LastSeq + 1
+}
+
+// NumPending returns the number of messages at or after the sequence
+// matching the filter, and the sequence of the last one.
+func (fs *fileStore) NumPending(sseq uint64, filter string) (num uint64, last uint64) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	for _, mb := range fs.blks {
+		for seq, fm := range mb.msgs {
+			if seq >= sseq && (filter == _EMPTY_ || matchLiteral(fm.subj, filter)) {
+				num++
+				if seq > last {
+					last = seq
+				}
+			}
+		}
+	}
+	return num, last
+}
+
+// State returns the current state of the store.
+func (fs *fileStore) State() StreamState {
+	fs.mu.RLock()
+	state := fs.state
+	fs.mu.RUnlock()
+	return state
+}
+
+// RegisterStorageUpdates registers the callback for changes in storage.
+func (fs *fileStore) RegisterStorageUpdates(cb func(md, bd int64)) {
+	fs.mu.Lock()
+	fs.scb = cb
+	fs.mu.Unlock()
+}
+
+// UpdateConfig applies the new limits.
+func (fs *fileStore) UpdateConfig(cfg *StreamConfig) error {
+	if cfg == nil {
+		return fmt.Errorf("config required")
+	}
+	fs.mu.Lock()
+	if fs.closed {
+		fs.mu.Unlock()
+		return ErrStoreClosed
+	}
+	fs.cfg = *cfg
+	var removed, removedBytes uint64
+	if fs.cfg.MaxMsgsPer > 0 {
+		for subj := range fs.fss {
+			r, rb := fs.enforcePerSubject(subj)
+			removed, removedBytes = removed+r, removedBytes+rb
+		}
+	}
+	r, rb := fs.enforceLimits()
+	removed, removedBytes = removed+r, removedBytes+rb
+	if fs.ageChk != nil && fs.cfg.MaxAge == 0 {
+		fs.ageChk.Stop()
+		fs.ageChk = nil
+	} else if fs.ageChk == nil && fs.cfg.MaxAge != 0 && fs.state.Msgs > 0 {
+		fs.startAgeChk()
+	}
+	if fs.tierChk != nil && fs.cfg.TierAfter == 0 {
+		fs.tierChk.Stop()
+		fs.tierChk = nil
+	} else if fs.tierChk == nil && fs.cfg.TierAfter > 0 && fs.fcfg.Tier != nil {
+		fs.startTierChk()
+	}
+	cb := fs.scb
+	fs.mu.Unlock()
+
+	if cb != nil && removed > 0 {
+		cb(-int64(removed), -int64(removedBytes))
+	}
+	return nil
+}
+
+// ConsumerStore returns a store persisting the state of the consumer
+// in the directory of the stream.
+func (fs *fileStore) ConsumerStore(name string) (ConsumerStore, error) {
+	dir := filepath.Join(fs.fcfg.StoreDir, consumerDir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create consumer directory - %v", err)
+	}
+	return &consumerFileStore{dir: dir, aek: fs.aek}, nil
+}
+
+// consumerFileStore persists the state of a consumer. Updates are
+// written periodically, losing the last ones on a crash only leads to
+// messages being redelivered.
+type consumerFileStore struct {
+	mu     sync.Mutex
+	dir    string
+	aek    cipher.AEAD
+	state  *ConsumerState
+	dirty  bool
+	ftmr   *time.Timer
+	closed bool
+}
+
+// Update records the new state.
+func (o *consumerFileStore) Update(state *ConsumerState) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return ErrStoreClosed
+	}
+	o.state = state.copy()
+	o.dirty = true
+	if o.ftmr == nil {
+		o.ftmr = time.AfterFunc(consumerStateFlushInterval, o.flush)
+	}
+	return nil
+}
+
+func (o *consumerFileStore) flush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.ftmr = nil
+	if err := o.writeState(); err != nil && !o.closed {
+		// Try again later.
+		o.ftmr = time.AfterFunc(consumerStateFlushInterval, o.flush)
+	}
+}
+
+// Lock should be held.
+func (o *consumerFileStore) writeState() error {
+	if !o.dirty || o.state == nil {
+		return nil
+	}
+	b, err := json.Marshal(o.state)
+	if err != nil {
+		return err
+	}
+	if o.aek != nil {
+		ct, err := sealData(o.aek, b, nil)
+		if err != nil {
+			return err
+		}
+		b = append([]byte{consumerStateEncrypted}, ct...)
+	}
+	tmp := filepath.Join(o.dir, consumerStateFile+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(o.dir, consumerStateFile)); err != nil {
+		return err
+	}
+	o.dirty = false
+	return nil
+}
+
+// State returns the last recorded state.
+func (o *consumerFileStore) State() (*ConsumerState, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.state != nil {
+		return o.state.copy(), nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(o.dir, consumerStateFile))
+	if os.IsNotExist(err) {
+		return &ConsumerState{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	// The state is written in plain text until the store is encrypted.
+	if len(b) > 0 && b[0] == consumerStateEncrypted {
+		if o.aek == nil {
+			return nil, ErrStoreEncrypted
+		}
+		if b, err = openData(o.aek, b[1:], nil); err != nil {
+			return nil, ErrStoreCorrupt
+		}
+	}
+	var state ConsumerState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, ErrStoreCorrupt
+	}
+	o.state = &state
+	return state.copy(), nil
+}
+
+// Stop writes any pending update and stops the store.
+func (o *consumerFileStore) Stop() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	if o.ftmr != nil {
+		o.ftmr.Stop()
+		o.ftmr = nil
+	}
+	return o.writeState()
+}
+
+// Delete stops the store and removes the state.
+func (o *consumerFileStore) Delete() error {
+	o.mu.Lock()
+	o.closed = true
+	if o.ftmr != nil {
+		o.ftmr.Stop()
+		o.ftmr = nil
+	}
+	o.mu.Unlock()
+	return os.RemoveAll(o.dir)
+}
+
+// Delete stops the store and removes all its data, including the
+// offloaded blocks.
+func (fs *fileStore) Delete() error {
+	fs.mu.RLock()
+	state := fs.state
+	cb := fs.scb
+	var tkeys []string
+	for _, mb := range fs.blks {
+		if mb.tkey != _EMPTY_ {
+			tkeys = append(tkeys, mb.tkey)
+		}
+	}
+	fs.mu.RUnlock()
+	if err := fs.Stop(); err != nil {
+		return err
+	}
+	for _, key := range tkeys {
+		if fs.fcfg.Tier != nil {
+			fs.fcfg.Tier.Delete(key)
+		}
+	}
+	if cb != nil && state.Msgs > 0 {
+		cb(-int64(state.Msgs), -int64(state.Bytes))
+	}
+	return os.RemoveAll(fs.fcfg.StoreDir)
+}
+
+// Stop stops the store and closes the block files.
+func (fs *fileStore) Stop() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.closed {
+		return nil
+	}
+	fs.closed = true
+	if fs.ageChk != nil {
+		fs.ageChk.Stop()
+		fs.ageChk = nil
+	}
+	if fs.tierChk != nil {
+		fs.tierChk.Stop()
+		fs.tierChk = nil
+	}
+	return fs.closeBlocks()
+}
+
+// Syncs and closes the block files. Lock should be held, or not needed
+// when creating the store.
+func (fs *fileStore) closeBlocks() error {
+	var err error
+	for _, mb := range fs.blks {
+		if mb.f == nil {
+			continue
+		}
+		if serr := mb.f.Sync(); serr != nil && err == nil {
+			err = serr
+		}
+		mb.f.Close()
+		mb.f = nil
+	}
+	return err
+}
@@ -0,0 +1,559 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createFileStoreDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "fstore")
+	if err != nil {
+		t.Fatalf("Error creating store dir: %v", err)
+	}
+	return dir
+}
+
+func newTestFileStore(t *testing.T, fcfg FileStoreConfig, cfg StreamConfig) *fileStore {
+	t.Helper()
+	cfg.Storage = FileStorage
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	return fs
+}
+
+func TestFileStoreBasics(t *testing.T) {
+	storeDir := createFileStoreDir(t)
+	defer os.RemoveAll(storeDir)
+
+	fs := newTestFileStore(t, FileStoreConfig{StoreDir: storeDir}, StreamConfig{})
+	defer fs.Stop()
+
+	subj, msg := "foo", []byte("Hello World")
+	for i := 1; i <= 5; i++ {
+		if seq, _, err := fs.StoreMsg(subj, nil, msg); err != nil {
+			t.Fatalf("Error storing msg: %v", err)
+		} else if seq != uint64(i) {
+			t.Fatalf("Expected sequence to be %d, got %d", i, seq)
+		}
+	}
+	state := fs.State()
+	if state.Msgs != 5 {
+		t.Fatalf("Expected 5 msgs, got %d", state.Msgs)
+	}
+	if expected := 5 * storedMsgSize(subj, nil, msg); state.Bytes != expected {
+		t.Fatalf("Expected %d bytes, got %d", expected, state.Bytes)
+	}
+	sm, err := fs.LoadMsg(2)
+	if err != nil {
+		t.Fatalf("Unexpected error looking up msg: %v", err)
+	}
+	if sm.Subject != subj || string(sm.Data) != string(msg) || sm.Sequence != 2 {
+		t.Fatalf("Unexpected message: %+v", sm)
+	}
+	if _, err := fs.LoadMsg(6); err != ErrStoreEOF {
+		t.Fatalf("Expected EOF error, got %v", err)
+	}
+	if removed, _ := fs.RemoveMsg(3); !removed {
+		t.Fatalf("Expected message to be removed")
+	}
+	if _, err := fs.LoadMsg(3); err != ErrStoreMsgNotFound {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+}
+
+func TestFileStoreMsgHeaders(t *testing.T) {
+	storeDir := createFileStoreDir(t)
+	defer os.RemoveAll(storeDir)
+
+	hdr := []byte("NATS/1.0\r\nA: B\r\n\r\n")
+	fs := newTestFileStore(t, FileStoreConfig{StoreDir: storeDir}, StreamConfig{})
+	fs.StoreMsg("foo", hdr, []byte("plain"))
+	fs.StoreMsg("foo", nil, []byte("NATS/1.0\r\n\r\n"))
+	if state := fs.State(); state.Bytes != storedMsgSize("foo", hdr, []byte("plain"))+storedMsgSize("foo", nil, []byte("NATS/1.0\r\n\r\n")) {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	fs.Stop()
+
+	// The headers are kept apart on recovery and once encrypted.
+	fs = newTestFileStore(t, FileStoreConfig{StoreDir: storeDir, Cipher: AES, Key: "s3cr3t"}, StreamConfig{})
+	defer fs.Stop()
+	fs.StoreMsg("foo", hdr, []byte("encrypted"))
+	for i, expected := range []struct {
+		hdr  []byte
+		data string
+	}{{hdr, "plain"}, {nil, "NATS/1.0\r\n\r\n"}, {hdr, "encrypted"}} {
+		sm, err := fs.LoadMsg(uint64(i + 1))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !bytes.Equal(sm.Header, expected.hdr) || string(sm.Data) != expected.data {
+			t.Fatalf("Unexpected message %d: %q %q", i+1, sm.Header, sm.Data)
+		}
+	}
+}
+
+func TestFileStoreRecovery(t *testing.T) {
+	storeDir := createFileStoreDir(t)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 1024}
+	fs := newTestFileStore(t, fcfg, StreamConfig{})
+
+	for i := 0; i < 100; i++ {
+		fs.StoreMsg(fmt.Sprintf("foo.%d", i), nil, []byte("Hello World"))
+	}
+	for seq := uint64(1); seq <= 30; seq++ {
+		fs.RemoveMsg(seq)
+	}
+	fs.RemoveMsg(50)
+	state := fs.State()
+	fs.Stop()
+
+	fs = newTestFileStore(t, fcfg, StreamConfig{})
+	defer fs.Stop()
+
+	if rstate := fs.State(); rstate != state {
+		t.Fatalf("Expected state of %+v, got %+v", state, rstate)
+	}
+	if _, err := fs.LoadMsg(50); err != ErrStoreMsgNotFound {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+	sm, err := fs.LoadMsg(51)
+	if err != nil || sm.Subject != "foo.50" {
+		t.Fatalf("Unexpected message: %+v - %v", sm, err)
+	}
+	// Blocks holding only deleted messages should have been removed.
+	fis, _ := ioutil.ReadDir(filepath.Join(storeDir, msgDir))
+	if len(fis) != len(fs.blks) {
+		t.Fatalf("Expected %d block files, got %d", len(fs.blks), len(fis))
+	}
+	if fs.blks[0].index == 1 {
+		t.Fatalf("Expected first block to have been removed")
+	}
+	// New messages continue the sequence.
+	if seq, _, _ := fs.StoreMsg("bar", nil, nil); seq != 101 {
+		t.Fatalf("Expected sequence 101, got %d", seq)
+	}
+}
+
+func TestFileStorePurgeKeepsSequence(t *testing.T) {
+	storeDir := createFileStoreDir(t)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir}
+	fs := newTestFileStore(t, fcfg, StreamConfig{})
+
+	var bd int64
+	fs.RegisterStorageUpdates(func(_, b int64) { bd += b })
+	for i := 0; i < 10; i++ {
+		fs.StoreMsg("foo", nil, []byte("Hello World"))
+	}
+	if purged, _ := fs.Purge(); purged != 10 {
+		t.Fatalf("Expected 10 messages purged, got %d", purged)
+	}
+	if bd != 0 {
+		t.Fatalf("Expected no bytes accounted for, got %d", bd)
+	}
+	fs.Stop()
+
+	fs = newTestFileStore(t, fcfg, StreamConfig{})
+	defer fs.Stop()
+
+	state := fs.State()
+	if state.Msgs != 0 || state.FirstSeq != 11 || state.LastSeq != 10 {
+		t.Fatalf("Unexpected state after purge: %+v", state)
+	}
+	if seq, _, _ := fs.StoreMsg("foo", nil, nil); seq != 11 {
+		t.Fatalf("Expected sequence 11, got %d", seq)
+	}
+}
+
+func TestFileStorePartialWriteRecovery(t *testing.T) {
+	storeDir := createFileStoreDir(t)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir}
+	fs := newTestFileStore(t, fcfg, StreamConfig{})
+	for i := 0; i < 10; i++ {
+		fs.StoreMsg("foo", nil, []byte("Hello World"))
+	}
+	fn := fs.lmb.fn
+	fs.Stop()
+
+	// Simulate a partially written last record.
+	fi, err := os.Stat(fn)
+	if err != nil {
+		t.Fatalf("Error getting block file info: %v", err)
+	}
+	if err := os.Truncate(fn, fi.Size()-5); err != nil {
+		t.Fatalf("Error truncating block file: %v", err)
+	}
+
+	fs = newTestFileStore(t, fcfg, StreamConfig{})
+	defer fs.Stop()
+
+	state := fs.State()
+	if state.Msgs != 9 || state.LastSeq != 9 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	if seq, _, _ := fs.StoreMsg("foo", nil, []byte("Hello World")); seq != 10 {
+		t.Fatalf("Expected sequence 10, got %d", seq)
+	}
+	if sm, err := fs.LoadMsg(10); err != nil || string(sm.Data) != "Hello World" {
+		t.Fatalf("Unexpected message: %+v - %v", sm, err)
+	}
+}
+
+func TestFileStoreLimits(t *testing.T) {
+	storeDir := createFileStoreDir(t)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 512}
+	fs := newTestFileStore(t, fcfg, StreamConfig{MaxMsgs: 10})
+	defer fs.Stop()
+
+	for i := 0; i < 100; i++ {
+		fs.StoreMsg("foo", nil, []byte("Hello World"))
+	}
+	state := fs.State()
+	if state.Msgs != 10 || state.FirstSeq != 91 || state.LastSeq != 100 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	if err := fs.UpdateConfig(&StreamConfig{Storage: FileStorage, MaxMsgs: 5}); err != nil {
+		t.Fatalf("Unexpected error updating config: %v", err)
+	}
+	if state := fs.State(); state.Msgs != 5 || state.FirstSeq != 96 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	if err := fs.UpdateConfig(&StreamConfig{Storage: FileStorage, MaxAge: 50 * time.Millisecond}); err != nil {
+		t.Fatalf("Unexpected error updating config: %v", err)
+	}
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		if state := fs.State(); state.Msgs != 0 {
+			return fmt.Errorf("Expected no msgs, got %d", state.Msgs)
+		}
+		return nil
+	})
+}
+
+func TestFileStoreConsumerState(t *testing.T) {
+	storeDir := createFileStoreDir(t)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir}
+	fs := newTestFileStore(t, fcfg, StreamConfig{})
+	cs, err := fs.ConsumerStore("dur")
+	if err != nil {
+		t.Fatalf("Error creating consumer store: %v", err)
+	}
+	state := &ConsumerState{
+		Delivered:   SequencePair{Consumer: 5, Stream: 10},
+		AckFloor:    SequencePair{Consumer: 3, Stream: 6},
+		Pending:     map[uint64]*Pending{8: {Sequence: 4, Timestamp: 1}, 10: {Sequence: 5, Timestamp: 2}},
+		Redelivered: map[uint64]uint64{8: 2},
+	}
+	if err := cs.Update(state); err != nil {
+		t.Fatalf("Error updating state: %v", err)
+	}
+	cs.Stop()
+	fs.Stop()
+
+	fs = newTestFileStore(t, fcfg, StreamConfig{})
+	defer fs.Stop()
+	if cs, err = fs.ConsumerStore("dur"); err != nil {
+		t.Fatalf("Error creating consumer store: %v", err)
+	}
+	rstate, err := cs.State()
+	if err != nil {
+		t.Fatalf("Error reading state: %v", err)
+	}
+	if rstate.Delivered != state.Delivered || rstate.AckFloor != state.AckFloor ||
+		len(rstate.Pending) != 2 || *rstate.Pending[10] != *state.Pending[10] || rstate.Redelivered[8] != 2 {
+		t.Fatalf("Expected state %+v, got %+v", state, rstate)
+	}
+	if err := cs.Delete(); err != nil {
+		t.Fatalf("Error deleting consumer store: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(storeDir, consumerDir, "dur")); !os.IsNotExist(err) {
+		t.Fatalf("Expected consumer directory to be removed, got %v", err)
+	}
+}
+
+func TestFileStoreRawMsgSkipAndCompact(t *testing.T) {
+	storeDir := createFileStoreDir(t)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir}
+	fs := newTestFileStore(t, fcfg, StreamConfig{})
+
+	ts := time.Now().UnixNano()
+	for _, seq := range []uint64{1, 2, 5} {
+		if err := fs.StoreRawMsg("foo", nil, []byte("Hello World"), seq, ts); err != nil {
+			t.Fatalf("Error storing msg: %v", err)
+		}
+	}
+	if err := fs.StoreRawMsg("foo", nil, nil, 3, ts); err != ErrStoreSeqOutOfOrder {
+		t.Fatalf("Expected out of order error, got %v", err)
+	}
+	if _, err := fs.LoadMsg(3); err != ErrStoreMsgNotFound {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+	if err := fs.SkipMsg(10); err != nil {
+		t.Fatalf("Error skipping: %v", err)
+	}
+	if purged, _ := fs.Compact(3); purged != 2 {
+		t.Fatalf("Expected 2 messages removed, got %d", purged)
+	}
+	state := fs.State()
+	if state.Msgs != 1 || state.FirstSeq != 5 || state.LastSeq != 10 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	fs.Stop()
+
+	fs = newTestFileStore(t, fcfg, StreamConfig{})
+	defer fs.Stop()
+
+	if rstate := fs.State(); rstate != state {
+		t.Fatalf("Expected state of %+v, got %+v", state, rstate)
+	}
+	if seq, _, _ := fs.StoreMsg("foo", nil, nil); seq != 11 {
+		t.Fatalf("Expected sequence 11, got %d", seq)
+	}
+}
+
+func TestFileStorePerSubjectLimit(t *testing.T) {
+	storeDir := createFileStoreDir(t)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 256}
+	fs := newTestFileStore(t, fcfg, StreamConfig{MaxMsgsPer: 2})
+
+	for i := 0; i < 5; i++ {
+		fs.StoreMsg("foo.a", nil, []byte("Hello World"))
+		fs.StoreMsg("foo.b", nil, []byte("Hello World"))
+	}
+	if seqs := fs.LastSeqs("foo.>"); fmt.Sprint(seqs) != "[9 10]" {
+		t.Fatalf("Unexpected last sequences: %v", seqs)
+	}
+	fs.Stop()
+
+	// The index of the subjects is rebuilt on recovery.
+	fs = newTestFileStore(t, fcfg, StreamConfig{MaxMsgsPer: 2})
+	defer fs.Stop()
+
+	if state := fs.State(); state.Msgs != 4 || state.FirstSeq != 7 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	if seqs := fs.SubjectSeqs("foo.b"); fmt.Sprint(seqs) != "[8 10]" {
+		t.Fatalf("Unexpected sequences: %v", seqs)
+	}
+	fs.StoreMsg("foo.b", nil, nil)
+	if seqs := fs.SubjectSeqs("foo.b"); fmt.Sprint(seqs) != "[10 11]" {
+		t.Fatalf("Unexpected sequences: %v", seqs)
+	}
+	if _, err := fs.LoadMsg(8); err != ErrStoreMsgNotFound {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+}
+
+func TestFileStoreEncryption(t *testing.T) {
+	storeDir := createFileStoreDir(t)
+	defer os.RemoveAll(storeDir)
+
+	// Messages stored before the key is set are encrypted on recovery.
+	fcfg := FileStoreConfig{StoreDir: storeDir}
+	fs := newTestFileStore(t, fcfg, StreamConfig{})
+	fs.StoreMsg("secret.plain", nil, []byte("Hello World"))
+	cs, _ := fs.ConsumerStore("dur")
+	cs.Update(&ConsumerState{Delivered: SequencePair{Consumer: 1, Stream: 1}})
+	cs.Stop()
+	fn := fs.lmb.fn
+	fs.Stop()
+
+	fcfg = FileStoreConfig{StoreDir: storeDir, Cipher: AES, Key: "s3cr3t"}
+	fs = newTestFileStore(t, fcfg, StreamConfig{})
+	for i := 0; i < 9; i++ {
+		fs.StoreMsg("secret.subject", nil, []byte("Hello World"))
+	}
+	cs, _ = fs.ConsumerStore("dur")
+	cs.Update(&ConsumerState{Delivered: SequencePair{Consumer: 10, Stream: 10}})
+	cs.Stop()
+	fs.Stop()
+
+	for _, f := range []string{fn, filepath.Join(storeDir, consumerDir, "dur", consumerStateFile)} {
+		buf, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatalf("Error reading file: %v", err)
+		}
+		if bytes.Contains(buf, []byte("secret")) || bytes.Contains(buf, []byte("Hello")) || bytes.Contains(buf, []byte("delivered")) {
+			t.Fatalf("Expected %q to be encrypted", f)
+		}
+	}
+
+	if _, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, StreamConfig{Storage: FileStorage}); err != ErrStoreEncrypted {
+		t.Fatalf("Expected encrypted store error, got %v", err)
+	}
+	if _, err := newFileStore(FileStoreConfig{StoreDir: storeDir, Cipher: AES, Key: "wrong"}, StreamConfig{Storage: FileStorage}); err != ErrStoreKeyMismatch {
+		t.Fatalf("Expected key mismatch error, got %v", err)
+	}
+
+	// Rotate the key, the previous one no longer opens the store.
+	fcfg = FileStoreConfig{StoreDir: storeDir, Cipher: AES, Key: "n3w", PrevKey: "s3cr3t"}
+	fs = newTestFileStore(t, fcfg, StreamConfig{})
+	if state := fs.State(); state.Msgs != 10 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	if sm, err := fs.LoadMsg(1); err != nil || sm.Subject != "secret.plain" || string(sm.Data) != "Hello World" {
+		t.Fatalf("Unexpected message: %+v - %v", sm, err)
+	}
+	if sm, err := fs.LoadMsg(10); err != nil || sm.Subject != "secret.subject" || string(sm.Data) != "Hello World" {
+		t.Fatalf("Unexpected message: %+v - %v", sm, err)
+	}
+	cs, _ = fs.ConsumerStore("dur")
+	if state, err := cs.State(); err != nil || state.Delivered.Stream != 10 {
+		t.Fatalf("Unexpected consumer state: %+v - %v", state, err)
+	}
+	cs.Stop()
+	fs.Stop()
+	if _, err := newFileStore(FileStoreConfig{StoreDir: storeDir, Cipher: AES, Key: "s3cr3t"}, StreamConfig{Storage: FileStorage}); err != ErrStoreKeyMismatch {
+		t.Fatalf("Expected key mismatch error, got %v", err)
+	}
+
+	// Tampered messages fail verification on startup, even with a valid
+	// checksum.
+	buf, _ := ioutil.ReadFile(fn)
+	rl := binary.LittleEndian.Uint32(buf)
+	buf[rl-recCRCSize-1] ^= 0xff
+	binary.LittleEndian.PutUint32(buf[rl-recCRCSize:], crc32.ChecksumIEEE(buf[4:rl-recCRCSize]))
+	ioutil.WriteFile(fn, buf, 0644)
+	fcfg = FileStoreConfig{StoreDir: storeDir, Cipher: AES, Key: "n3w"}
+	if _, err := newFileStore(fcfg, StreamConfig{Storage: FileStorage}); err == nil || !strings.Contains(err.Error(), "failed verification") {
+		t.Fatalf("Expected verification error, got %v", err)
+	}
+}
+
+func TestFileStoreEncryptionChaCha(t *testing.T) {
+	storeDir := createFileStoreDir(t)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, Cipher: ChaCha, Key: "s3cr3t"}
+	fs := newTestFileStore(t, fcfg, StreamConfig{})
+	for i := 0; i < 10; i++ {
+		fs.StoreMsg("secret.subject", nil, []byte("Hello World"))
+	}
+	fn := fs.lmb.fn
+	fs.Stop()
+
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	if bytes.Contains(buf, []byte("secret")) || bytes.Contains(buf, []byte("Hello")) {
+		t.Fatalf("Expected %q to be encrypted", fn)
+	}
+
+	// The store keeps the cipher it was created with when the configured
+	// one changes.
+	for i, sc := range []StoreCipher{AES, ChaCha} {
+		fs = newTestFileStore(t, FileStoreConfig{StoreDir: storeDir, Cipher: sc, Key: "s3cr3t"}, StreamConfig{})
+		if fs.fcfg.Cipher != ChaCha {
+			t.Fatalf("Expected the store to keep its cipher, got %v", fs.fcfg.Cipher)
+		}
+		if state := fs.State(); state.Msgs != uint64(10+i) {
+			t.Fatalf("Unexpected state: %+v", state)
+		}
+		if sm, err := fs.LoadMsg(10); err != nil || sm.Subject != "secret.subject" || string(sm.Data) != "Hello World" {
+			t.Fatalf("Unexpected message: %+v - %v", sm, err)
+		}
+		fs.StoreMsg("secret.subject", nil, []byte("Hello World"))
+		fs.Stop()
+	}
+
+	// The key file has a salt and the cipher, authenticated with the key.
+	kfn := filepath.Join(storeDir, keyFile)
+	buf, _ = ioutil.ReadFile(kfn)
+	if buf[0] != keyFileVersion || StoreCipher(buf[1]) != ChaCha {
+		t.Fatalf("Unexpected key file header: %v", buf[:keyFileHdrSize])
+	}
+	buf[1] = byte(AES)
+	ioutil.WriteFile(kfn, buf, 0600)
+	if _, err := newFileStore(fcfg, StreamConfig{Storage: FileStorage}); err != ErrStoreKeyMismatch {
+		t.Fatalf("Expected key mismatch error, got %v", err)
+	}
+}
+
+// Returns the same byte forever.
+type testConstReader byte
+
+func (r testConstReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+// Returns an error.
+type testErrReader struct{}
+
+func (testErrReader) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("no entropy")
+}
+
+func TestFileStoreEncryptedConsumerStateNonce(t *testing.T) {
+	storeDir := createFileStoreDir(t)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, Cipher: AES, Key: "s3cr3t"}
+	fs := newTestFileStore(t, fcfg, StreamConfig{})
+	defer fs.Stop()
+	cs, _ := fs.ConsumerStore("dur")
+
+	// A nonce starting like the plain JSON state.
+	storeRand = testConstReader('{')
+	defer func() { storeRand = rand.Reader }()
+	cs.Update(&ConsumerState{Delivered: SequencePair{Consumer: 5, Stream: 7}})
+	if err := cs.Stop(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cs, _ = fs.ConsumerStore("dur")
+	if state, err := cs.State(); err != nil || state.Delivered.Stream != 7 {
+		t.Fatalf("Unexpected consumer state: %+v - %v", state, err)
+	}
+	cs.Stop()
+
+	// Failing to get a nonce fails the write.
+	storeRand = testErrReader{}
+	cs, _ = fs.ConsumerStore("dur")
+	cs.Update(&ConsumerState{Delivered: SequencePair{Consumer: 6, Stream: 8}})
+	if err := cs.Stop(); err == nil {
+		t.Fatal("Expected an error writing the state")
+	}
+	if _, _, err := fs.StoreMsg("foo", nil, []byte("bar")); err == nil {
+		t.Fatal("Expected an error storing the message")
+	}
+}
@@ -419,6 +419,7 @@ func (s *Server) gatewayAcceptLoop(ch chan struct{}) {
 		TLSVerify:    tlsReq,
 		MaxPayload:   s.info.MaxPayload,
 		Gateway:      opts.Gateway.Name,
+		Tags:         opts.Tags,
 	}
 	// If we have selected a random port...
 	if port == 0 {
@@ -585,17 +586,22 @@ func (s *Server) solicitGateway(cfg *gatewayCfg, firstConnect bool) {
 		report := s.shouldReportConnectErr(firstConnect, attempts)
 		// Iteration is random
 		for _, u := range urls {
-			address, err := s.getRandomIP(s.gateway.resolver, u.Host)
-			if err != nil {
-				s.Errorf("Error getting IP for %s gateway %q (%s): %v", typeStr, cfg.Name, u.Host, err)
-				continue
+			// The host is resolved by the proxy, if any.
+			address := u.Host
+			if opts.Gateway.Proxy == nil {
+				var err error
+				address, err = s.getRandomIP(s.gateway.resolver, u.Host)
+				if err != nil {
+					s.Errorf("Error getting IP for %s gateway %q (%s): %v", typeStr, cfg.Name, u.Host, err)
+					continue
+				}
 			}
 			if report {
 				s.Noticef(connFmt, typeStr, cfg.Name, u.Host, address, attempts)
 			} else {
 				s.Debugf(connFmt, typeStr, cfg.Name, u.Host, address, attempts)
 			}
-			conn, err := net.DialTimeout("tcp", address, DEFAULT_ROUTE_DIAL)
+			conn, err := dialWithProxy(opts.Gateway.Proxy, address, DEFAULT_ROUTE_DIAL)
 			if err == nil {
 				// We could connect, create the gateway connection and return.
 				s.createGateway(cfg, u, conn)
@@ -1036,7 +1042,9 @@ func (s *Server) forwardNewGatewayToLocalCluster(oinfo *Info) {
 
 	for _, r := range s.routes {
 		r.mu.Lock()
-		r.sendInfo(infoJSON)
+		if !r.route.isPooled() {
+			r.sendInfo(infoJSON)
+		}
 		r.mu.Unlock()
 	}
 }
@@ -1297,6 +1305,17 @@ func (s *Server) getRemoteGateway(name string) *gatewayCfg {
 	return cfg
 }
 
+// Returns the configuration of all remote gateways.
+func (s *Server) getRemoteGateways() []*gatewayCfg {
+	s.gateway.RLock()
+	cfgs := make([]*gatewayCfg, 0, len(s.gateway.remotes))
+	for _, cfg := range s.gateway.remotes {
+		cfgs = append(cfgs, cfg)
+	}
+	s.gateway.RUnlock()
+	return cfgs
+}
+
 // Used in tests
 func (g *gatewayCfg) bumpConnAttempts() {
 	g.Lock()
@@ -2317,7 +2336,8 @@ func (c *client) sendMsgToGateways(acc *Account, msg, subject, reply []byte, qgr
 			mh = append(mh, mreply...)
 			mh = append(mh, ' ')
 		}
-		mh = append(mh, c.pa.szb...)
+		// Gateways do not support headers.
+		mh = c.appendPayloadSize(mh)
 		mh = append(mh, CR_LF...)
 
 		// We reuse the subscription object that we pass to deliverMsg.
@@ -2353,6 +2373,10 @@ func (s *Server) gatewayHandleServiceImport(acc *Account, subject []byte, c *cli
 	s.mu.Lock()
 	for _, r := range s.routes {
 		r.mu.Lock()
+		if !r.route.carriesAccount(acc.Name) {
+			r.mu.Unlock()
+			continue
+		}
 		r.sendProto(rsproto, false)
 		if r.trace {
 			r.traceOutOp("", rsproto[:len(rsproto)-LEN_CR_LF])
@@ -0,0 +1,365 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+const (
+	httpBridgePublishPath = "/publish/"
+	httpBridgeRequestPath = "/request/"
+
+	// Default time waited for the response of a request.
+	httpBridgeDefaultRequestTimeout = 2 * time.Second
+)
+
+// HTTP bridge state of the server, by account name.
+type srvHTTPBridge struct {
+	mu       sync.Mutex
+	accounts map[string]*httpBridgeAccount
+}
+
+// HTTP bridge state of an account.
+type httpBridgeAccount struct {
+	mu sync.Mutex
+	// Internal client publishing the messages and receiving the
+	// responses of the requests.
+	c *client
+	// Responses are received on this prefix followed by a token,
+	// and handed to the waiting requests.
+	respPrefix string
+	resps      map[string]chan []byte
+	limiter    *httpBridgeLimiter
+}
+
+// Token bucket limiting the messages of an account.
+type httpBridgeLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newHTTPBridgeLimiter(rate, burst int) *httpBridgeLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &httpBridgeLimiter{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Returns whether a message is allowed now. Account lock should be held.
+func (l *httpBridgeLimiter) allow(now time.Time) bool {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Starts the HTTP bridge listener.
+func (s *Server) startHTTPBridge() error {
+	// Snapshot server options.
+	opts := s.getOpts()
+	bo := &opts.HTTPBridge
+
+	port := bo.Port
+	if port == -1 {
+		port = 0
+	}
+	hp := net.JoinHostPort(bo.Host, strconv.Itoa(port))
+	var (
+		l   net.Listener
+		err error
+	)
+	proto := "http"
+	if bo.TLSConfig != nil {
+		proto += "s"
+		config := bo.TLSConfig.Clone()
+		config.ClientAuth = tls.NoClientCert
+		l, err = tls.Listen("tcp", hp, config)
+	} else {
+		l, err = net.Listen("tcp", hp)
+	}
+	if err != nil {
+		return fmt.Errorf("can't listen to the http bridge port: %v", err)
+	}
+	s.Noticef("Listening for %s bridge requests on %s", proto,
+		net.JoinHostPort(bo.Host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(httpBridgePublishPath, s.HandleHTTPBridgePublish)
+	mux.HandleFunc(httpBridgeRequestPath, s.HandleHTTPBridgeRequest)
+	srv := &http.Server{
+		Addr:           hp,
+		Handler:        mux,
+		MaxHeaderBytes: 1 << 20,
+	}
+
+	s.mu.Lock()
+	// If we have selected a random port...
+	if port == 0 {
+		// Write resolved port back to options.
+		bo.Port = l.Addr().(*net.TCPAddr).Port
+	}
+	s.httpBridgeListener = l
+	s.mu.Unlock()
+
+	go func() {
+		srv.Serve(l)
+		s.done <- true
+	}()
+	return nil
+}
+
+// HandleHTTPBridgePublish publishes the body of a POST request on the
+// subject following /publish/ in the path.
+func (s *Server) HandleHTTPBridgePublish(w http.ResponseWriter, r *http.Request) {
+	hba, subject, msg, ok := s.httpBridgeCheck(w, r, httpBridgePublishPath)
+	if !ok {
+		return
+	}
+	hba.c.publishInternal(subject, _EMPTY_, nil, msg)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleHTTPBridgeRequest sends the body of a POST request as a request
+// on the subject following /request/ in the path, and responds with the
+// payload of the response.
+func (s *Server) HandleHTTPBridgeRequest(w http.ResponseWriter, r *http.Request) {
+	hba, subject, msg, ok := s.httpBridgeCheck(w, r, httpBridgeRequestPath)
+	if !ok {
+		return
+	}
+	timeout := s.getOpts().HTTPBridge.RequestTimeout
+	if ts := r.URL.Query().Get("timeout"); ts != _EMPTY_ {
+		dur, err := time.ParseDuration(ts)
+		if err != nil || dur <= 0 {
+			http.Error(w, fmt.Sprintf("invalid timeout %q", ts), http.StatusBadRequest)
+			return
+		}
+		timeout = dur
+	}
+
+	token := nuid.Next()
+	ch := make(chan []byte, 1)
+	hba.mu.Lock()
+	hba.resps[token] = ch
+	hba.mu.Unlock()
+	defer func() {
+		hba.mu.Lock()
+		delete(hba.resps, token)
+		hba.mu.Unlock()
+	}()
+
+	hba.c.publishInternal(subject, hba.respPrefix+token, nil, msg)
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case resp := <-ch:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(resp)
+	case <-t.C:
+		http.Error(w, "request timed out", http.StatusGatewayTimeout)
+	case <-r.Context().Done():
+	}
+}
+
+// Authenticates the request and checks the subject and the message. The
+// errors are written to the response.
+func (s *Server) httpBridgeCheck(w http.ResponseWriter, r *http.Request, prefix string) (*httpBridgeAccount, string, []byte, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, _EMPTY_, nil, false
+	}
+	subject := strings.TrimPrefix(r.URL.Path, prefix)
+	if !IsValidLiteralSubject(subject) {
+		http.Error(w, fmt.Sprintf("invalid subject %q", subject), http.StatusBadRequest)
+		return nil, _EMPTY_, nil, false
+	}
+	acc, pc, ok := s.httpBridgeAuthenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="nats"`)
+		http.Error(w, "authorization violation", http.StatusUnauthorized)
+		return nil, _EMPTY_, nil, false
+	}
+	if pc != nil && !pc.pubAllowed(subject) {
+		http.Error(w, fmt.Sprintf("permissions violation for publish to %q", subject), http.StatusForbidden)
+		return nil, _EMPTY_, nil, false
+	}
+
+	hba := s.httpBridgeAccount(acc)
+	if hba.limiter != nil {
+		hba.mu.Lock()
+		allowed := hba.limiter.allow(time.Now())
+		hba.mu.Unlock()
+		if !allowed {
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return nil, _EMPTY_, nil, false
+		}
+	}
+
+	mpay := s.getOpts().MaxPayload
+	msg, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(mpay)+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, _EMPTY_, nil, false
+	}
+	if mpay > 0 && len(msg) > int(mpay) {
+		http.Error(w, ErrMaxPayload.Error(), http.StatusRequestEntityTooLarge)
+		return nil, _EMPTY_, nil, false
+	}
+	return hba, subject, msg, true
+}
+
+// Authenticates the request with the basic authentication credentials, or
+// the bearer token when the server is configured with one. Returns the
+// account of the user and, if restricted, a client holding its
+// permissions. Only users with a password can be authenticated.
+func (s *Server) httpBridgeAuthenticate(r *http.Request) (*Account, *client, bool) {
+	opts := s.getOpts()
+	user, pass, hasBasic := r.BasicAuth()
+
+	s.mu.Lock()
+	authRequired := s.info.AuthRequired
+	gacc := s.gacc
+	var u *User
+	if s.users != nil {
+		if hasBasic {
+			u = s.users[user]
+			if u != nil && !comparePasswords(u.Password, pass) {
+				u = nil
+			}
+		} else if opts.NoAuthUser != _EMPTY_ {
+			u = s.users[opts.NoAuthUser]
+		}
+	}
+	s.mu.Unlock()
+
+	switch {
+	case u != nil:
+		acc := u.Account
+		if acc == nil {
+			acc = gacc
+		}
+		var pc *client
+		if u.Permissions != nil {
+			pc = &client{srv: s, kind: CLIENT, utags: u.Tags}
+			pc.setPermissions(u.Permissions)
+		}
+		return acc, pc, true
+	case opts.Username != _EMPTY_:
+		if hasBasic && user == opts.Username && comparePasswords(opts.Password, pass) {
+			return gacc, nil, true
+		}
+	case opts.Authorization != _EMPTY_:
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if comparePasswords(opts.Authorization, token) {
+			return gacc, nil, true
+		}
+	case !authRequired:
+		return gacc, nil, true
+	}
+	return nil, nil, false
+}
+
+// Returns the HTTP bridge state of the account, creating it if needed.
+func (s *Server) httpBridgeAccount(acc *Account) *httpBridgeAccount {
+	s.httpBridge.mu.Lock()
+	defer s.httpBridge.mu.Unlock()
+	if s.httpBridge.accounts == nil {
+		s.httpBridge.accounts = make(map[string]*httpBridgeAccount)
+	}
+	hba := s.httpBridge.accounts[acc.Name]
+	if hba != nil {
+		return hba
+	}
+	bo := &s.getOpts().HTTPBridge
+	rate, ok := bo.AccountRateLimits[acc.Name]
+	if !ok {
+		rate = bo.RateLimit
+	}
+	hba = &httpBridgeAccount{
+		c:          s.createInternalJetStreamClient(acc),
+		respPrefix: fmt.Sprintf("_INBOX.%s.", nuid.Next()),
+		resps:      make(map[string]chan []byte),
+		limiter:    newHTTPBridgeLimiter(rate, bo.Burst),
+	}
+	if _, err := hba.c.subscribeInternal(hba.respPrefix+"*", 1, hba.deliverResponse); err != nil {
+		s.Errorf("Error subscribing to the http bridge responses of account %q: %v", acc.Name, err)
+	}
+	s.httpBridge.accounts[acc.Name] = hba
+	return hba
+}
+
+func (hba *httpBridgeAccount) deliverResponse(_ *subscription, subject, _ string, _, msg []byte) {
+	hba.mu.Lock()
+	ch := hba.resps[strings.TrimPrefix(subject, hba.respPrefix)]
+	hba.mu.Unlock()
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- append([]byte(nil), msg...):
+	default:
+	}
+}
+
+// Validates the options of the HTTP bridge.
+func validateHTTPBridgeOptions(o *Options) error {
+	bo := &o.HTTPBridge
+	if bo.Port == 0 {
+		return nil
+	}
+	if bo.RateLimit < 0 || bo.Burst < 0 {
+		return fmt.Errorf("http_bridge rate_limit and burst can not be negative")
+	}
+	for name, rate := range bo.AccountRateLimits {
+		if rate < 0 {
+			return fmt.Errorf("http_bridge rate limit of account %q can not be negative", name)
+		}
+		found := name == globalAccountName
+		for _, acc := range o.Accounts {
+			if acc.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("http_bridge rate limit for unknown account %q", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func testHTTPBridgePost(t *testing.T, o *Options, path, user, pass, body string) (int, string) {
+	t.Helper()
+	u := fmt.Sprintf("http://%s:%d%s", o.HTTPBridge.Host, o.HTTPBridge.Port, path)
+	req, err := http.NewRequest(http.MethodPost, u, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	if user != _EMPTY_ {
+		req.SetBasicAuth(user, pass)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func TestHTTPBridgeConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A { users [{user: a, password: pwd}] }
+		}
+		http_bridge {
+			listen: "127.0.0.1:-1"
+			rate_limit: 100
+			burst: 200
+			account_rate_limits { A: 10 }
+			request_timeout: "5s"
+		}
+	`))
+	defer os.Remove(conf)
+	o, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	bo := o.HTTPBridge
+	if bo.Host != "127.0.0.1" || bo.Port != -1 || bo.RateLimit != 100 || bo.Burst != 200 ||
+		bo.AccountRateLimits["A"] != 10 || bo.RequestTimeout != 5*time.Second {
+		t.Fatalf("Unexpected http bridge options: %+v", bo)
+	}
+	if err := validateOptions(o); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	o.HTTPBridge.AccountRateLimits["B"] = 10
+	if err := validateOptions(o); err == nil || !strings.Contains(err.Error(), "unknown account") {
+		t.Fatalf("Expected an error for an unknown account, got %v", err)
+	}
+}
+
+func TestHTTPBridgePublishAndRequest(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				users [
+					{user: a, password: pwd}
+					{user: hook, password: pwd, permissions: {publish: "hooks.>"}}
+				]
+			}
+		}
+		http_bridge {
+			listen: "127.0.0.1:-1"
+			request_timeout: "250ms"
+		}
+	`))
+	defer os.Remove(conf)
+	s, o := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://a:pwd@%s:%d", o.Host, o.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	sub, _ := nc.SubscribeSync("hooks.>")
+	nc.Subscribe("svc", func(m *nats.Msg) {
+		m.Respond(append([]byte("re: "), m.Data...))
+	})
+	nc.Flush()
+
+	if code, _ := testHTTPBridgePost(t, o, "/publish/hooks.build", "hook", "pwd", "done"); code != http.StatusNoContent {
+		t.Fatalf("Unexpected status %d", code)
+	}
+	if m, err := sub.NextMsg(time.Second); err != nil || m.Subject != "hooks.build" || string(m.Data) != "done" {
+		t.Fatalf("Unexpected message %+v: %v", m, err)
+	}
+
+	if code, body := testHTTPBridgePost(t, o, "/request/svc", "a", "pwd", "ping"); code != http.StatusOK || body != "re: ping" {
+		t.Fatalf("Unexpected response %d %q", code, body)
+	}
+	if code, _ := testHTTPBridgePost(t, o, "/request/nobody", "a", "pwd", "ping"); code != http.StatusGatewayTimeout {
+		t.Fatalf("Expected a timeout, got %d", code)
+	}
+
+	for _, test := range []struct {
+		name       string
+		path       string
+		user, pass string
+		code       int
+	}{
+		{"no credentials", "/publish/foo", "", "", http.StatusUnauthorized},
+		{"bad password", "/publish/foo", "a", "bad", http.StatusUnauthorized},
+		{"not allowed", "/request/svc", "hook", "pwd", http.StatusForbidden},
+		{"wildcard", "/publish/foo.*", "a", "pwd", http.StatusBadRequest},
+		{"no subject", "/publish/", "a", "pwd", http.StatusBadRequest},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if code, _ := testHTTPBridgePost(t, o, test.path, test.user, test.pass, "x"); code != test.code {
+				t.Fatalf("Expected status %d, got %d", test.code, code)
+			}
+		})
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s:%d/publish/foo", o.HTTPBridge.Host, o.HTTPBridge.Port))
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected method not allowed, got %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPBridgeRateLimit(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A { users [{user: a, password: pwd}] }
+			B { users [{user: b, password: pwd}] }
+		}
+		http_bridge {
+			listen: "127.0.0.1:-1"
+			rate_limit: 1
+			burst: 2
+			account_rate_limits { B: 0 }
+		}
+	`))
+	defer os.Remove(conf)
+	s, o := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	for i := 0; i < 3; i++ {
+		code, _ := testHTTPBridgePost(t, o, "/publish/foo", "a", "pwd", "x")
+		if i < 2 && code != http.StatusNoContent {
+			t.Fatalf("Unexpected status %d for message %d", code, i+1)
+		} else if i == 2 && code != http.StatusTooManyRequests {
+			t.Fatalf("Expected the rate limit to be exceeded, got %d", code)
+		}
+	}
+	// The limits are per account.
+	for i := 0; i < 5; i++ {
+		if code, _ := testHTTPBridgePost(t, o, "/publish/foo", "b", "pwd", "x"); code != http.StatusNoContent {
+			t.Fatalf("Unexpected status %d", code)
+		}
+	}
+}
@@ -0,0 +1,755 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// JetStreamConfig determines this server's configuration.
+// MaxMemory and MaxStore are in bytes, a value of 0 means unlimited.
+type JetStreamConfig struct {
+	MaxMemory int64       `json:"max_memory"`
+	MaxStore  int64       `json:"max_storage"`
+	StoreDir  string      `json:"store_dir,omitempty"`
+	Cipher    StoreCipher `json:"cipher,omitempty"`
+	// Key encrypts the file based streams, PrevKey is the key being
+	// rotated. They are never exposed.
+	Key     string `json:"-"`
+	PrevKey string `json:"-"`
+	// Tier is where the streams offload their aged blocks.
+	Tier *TierConfig `json:"tier,omitempty"`
+}
+
+// JetStreamAccountStats returns current statistics about the
+// account's JetStream usage.
+type JetStreamAccountStats struct {
+	Memory    uint64                 `json:"memory"`
+	Store     uint64                 `json:"storage"`
+	Streams   int                    `json:"streams"`
+	Consumers int                    `json:"consumers"`
+	Limits    JetStreamAccountLimits `json:"limits"`
+}
+
+// JetStreamAccountLimits are the limits of the JetStream resources of
+// an account. The storage limits are in bytes, a value of 0 means
+// unlimited.
+type JetStreamAccountLimits struct {
+	MaxMemory    int64 `json:"max_memory"`
+	MaxStore     int64 `json:"max_storage"`
+	MaxStreams   int   `json:"max_streams"`
+	MaxConsumers int   `json:"max_consumers"`
+}
+
+var (
+	// ErrJetStreamMaxStreams is returned when the account has reached
+	// its maximum number of streams.
+	ErrJetStreamMaxStreams = errors.New("maximum number of streams reached")
+	// ErrJetStreamMaxAccountConsumers is returned when the account has
+	// reached its maximum number of consumers.
+	ErrJetStreamMaxAccountConsumers = errors.New("maximum number of consumers reached")
+)
+
+const (
+	// JetStreamStoreDir is the name of the directory, under the configured
+	// store directory, where JetStream keeps its data.
+	JetStreamStoreDir = "jetstream"
+	// Directory, under the account's directory, holding the streams.
+	streamsDir = "streams"
+	// File holding the configuration of a stream.
+	streamMetaFile = "meta.json"
+)
+
+// Internal state of JetStream for the server.
+type jetStream struct {
+	mu        sync.RWMutex
+	srv       *Server
+	config    JetStreamConfig
+	accounts  map[string]*jsAccount
+	memUsed   int64
+	storeUsed int64
+	// Set in clustered mode, before the accounts are enabled.
+	cluster *jetStreamCluster
+	// Set when tiered storage is configured.
+	tier tierStore
+}
+
+// Internal state of JetStream for an account.
+type jsAccount struct {
+	mu       sync.RWMutex
+	js       *jetStream
+	account  *Account
+	storeDir string
+	streams  map[string]*Stream
+	client   *client
+	outq     *jsOutQ
+	apiSubs  []*subscription
+	sid      int
+	// Internal client of the mirrors and sources, which must receive the
+	// messages sent by the client of the account.
+	sclient   *client
+	soutq     *jsOutQ
+	memUsed   int64
+	storeUsed int64
+}
+
+// Message queued to be sent by an internal JetStream client.
+type jsPubMsg struct {
+	subj  string
+	dsubj string
+	reply string
+	hdr   []byte
+	msg   []byte
+}
+
+// jsOutQ is an unbounded queue of messages to be sent by an internal
+// client. Messages are queued from within message callbacks, so this
+// must never block.
+type jsOutQ struct {
+	mu   sync.Mutex
+	msgs []*jsPubMsg
+	mch  chan struct{}
+	quit chan struct{}
+}
+
+func newJSOutQ() *jsOutQ {
+	return &jsOutQ{mch: make(chan struct{}, 1), quit: make(chan struct{})}
+}
+
+func (q *jsOutQ) send(pm *jsPubMsg) {
+	q.mu.Lock()
+	q.msgs = append(q.msgs, pm)
+	q.mu.Unlock()
+	select {
+	case q.mch <- struct{}{}:
+	default:
+	}
+}
+
+func (q *jsOutQ) pending() []*jsPubMsg {
+	q.mu.Lock()
+	msgs := q.msgs
+	q.msgs = nil
+	q.mu.Unlock()
+	return msgs
+}
+
+func (q *jsOutQ) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.msgs)
+}
+
+func (q *jsOutQ) stop() {
+	select {
+	case <-q.quit:
+	default:
+		close(q.quit)
+	}
+}
+
+// Creates an internal client registered with the given account.
+func (s *Server) createInternalJetStreamClient(acc *Account) *client {
+	c := &client{srv: s, kind: SYSTEM, opts: internalOpts, msubs: -1, mpay: -1, start: time.Now(), last: time.Now()}
+	c.initClient()
+	c.echo = false
+	c.registerWithAccount(acc)
+	return c
+}
+
+// Sends the messages queued for the internal client.
+func (s *Server) jsInternalSendLoop(c *client, q *jsOutQ) {
+	defer s.grWG.Done()
+	for {
+		select {
+		case <-q.mch:
+			c.pmu.Lock()
+			for _, pm := range q.pending() {
+				c.processPublish(pm.subj, pm.dsubj, pm.reply, pm.hdr, pm.msg)
+			}
+			c.flushClients(0)
+			c.pmu.Unlock()
+		case <-q.quit:
+			return
+		case <-s.quitCh:
+			return
+		}
+	}
+}
+
+// Subscribes the internal client with the given callback.
+// Lock should not be held.
+func (c *client) subscribeInternal(subject string, sid int, cb msgHandler) (*subscription, error) {
+	sub, err := c.processSubEx([]byte(subject+" "+strconv.Itoa(sid)), cb)
+	if err == nil && sub == nil {
+		err = fmt.Errorf("could not subscribe to %q", subject)
+	}
+	return sub, err
+}
+
+// EnableJetStream will enable JetStream support on this server with
+// the given configuration. A nil configuration will use the defaults.
+func (s *Server) EnableJetStream(config *JetStreamConfig) error {
+	s.mu.Lock()
+	if s.js != nil {
+		s.mu.Unlock()
+		return fmt.Errorf("jetstream already enabled")
+	}
+	s.mu.Unlock()
+
+	var cfg JetStreamConfig
+	if config != nil {
+		cfg = *config
+	}
+	if cfg.StoreDir == _EMPTY_ {
+		cfg.StoreDir = filepath.Join(os.TempDir(), "nats")
+	}
+	if cfg.Key == _EMPTY_ && cfg.PrevKey != _EMPTY_ {
+		return fmt.Errorf("previous encryption key requires a key")
+	}
+	if cfg.Key != _EMPTY_ && cfg.Cipher == NoCipher {
+		cfg.Cipher = AES
+	}
+	sdir := filepath.Join(cfg.StoreDir, JetStreamStoreDir)
+	if err := os.MkdirAll(sdir, 0755); err != nil {
+		return fmt.Errorf("could not create storage directory - %v", err)
+	}
+	// Make sure we can write to the directory.
+	tmpfile, err := ioutil.TempFile(sdir, "_test_")
+	if err != nil {
+		return fmt.Errorf("storage directory is not writable")
+	}
+	tmpfile.Close()
+	os.Remove(tmpfile.Name())
+
+	js := &jetStream{srv: s, config: cfg, accounts: make(map[string]*jsAccount)}
+	if cfg.Tier != nil {
+		if js.tier, err = newS3Store(cfg.Tier); err != nil {
+			return err
+		}
+	}
+	// Streams are replicated between the servers of a cluster.
+	if opts := s.getOpts(); opts.Cluster.Port != 0 || len(opts.Routes) > 0 {
+		if err := js.setupCluster(); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.js = js
+	s.mu.Unlock()
+
+	s.Noticef("Starting JetStream")
+	s.Noticef("  Max Memory:      %s", friendlyBytes(cfg.MaxMemory))
+	s.Noticef("  Max Storage:     %s", friendlyBytes(cfg.MaxStore))
+	s.Noticef("  Store Directory: %q", sdir)
+	if cfg.Key != _EMPTY_ {
+		s.Noticef("  Encryption:      %v", cfg.Cipher)
+	}
+	if cfg.Tier != nil {
+		s.Noticef("  Tiered Storage:  %s/%s", cfg.Tier.Endpoint, cfg.Tier.Bucket)
+	}
+	if js.cluster != nil {
+		s.Noticef("  Cluster Node ID: %s", js.cluster.id)
+	}
+
+	s.configureJetStreamAccounts()
+	if js.cluster != nil {
+		return js.cluster.start()
+	}
+	return nil
+}
+
+// JetStreamEnabled reports if JetStream is enabled.
+func (s *Server) JetStreamEnabled() bool {
+	return s.getJetStream() != nil
+}
+
+// JetStreamConfig returns a copy of the JetStream configuration,
+// or nil if JetStream is not enabled.
+func (s *Server) JetStreamConfig() *JetStreamConfig {
+	js := s.getJetStream()
+	if js == nil {
+		return nil
+	}
+	cfg := js.config
+	return &cfg
+}
+
+func (s *Server) getJetStream() *jetStream {
+	s.mu.Lock()
+	js := s.js
+	s.mu.Unlock()
+	return js
+}
+
+// Enables JetStream for the accounts that are not yet enabled and
+// disables it for the ones that no longer exist. This is done on
+// startup and after the accounts have been reloaded.
+func (s *Server) configureJetStreamAccounts() {
+	js := s.getJetStream()
+	if js == nil {
+		return
+	}
+	sacc := s.SystemAccount()
+	current := make(map[string]*Account)
+	s.accounts.Range(func(k, v interface{}) bool {
+		acc := v.(*Account)
+		if acc != sacc {
+			current[acc.Name] = acc
+		}
+		return true
+	})
+	js.mu.RLock()
+	var remove []*jsAccount
+	for name, jsa := range js.accounts {
+		if _, ok := current[name]; !ok {
+			remove = append(remove, jsa)
+		}
+	}
+	js.mu.RUnlock()
+	for _, jsa := range remove {
+		js.disableAccount(jsa)
+	}
+	for _, acc := range current {
+		if err := js.enableAccount(acc); err != nil {
+			s.Errorf("Error enabling JetStream for account %q: %v", acc.Name, err)
+		}
+	}
+}
+
+// Enables JetStream for the account, recovering its streams from disk.
+// If already enabled, the account reference is updated since accounts
+// are recreated on configuration reload.
+func (js *jetStream) enableAccount(acc *Account) error {
+	s := js.srv
+	js.mu.Lock()
+	if jsa, ok := js.accounts[acc.Name]; ok {
+		js.mu.Unlock()
+		jsa.mu.Lock()
+		jsa.account = acc
+		c := jsa.client
+		jsa.mu.Unlock()
+		if c != nil {
+			c.mu.Lock()
+			c.acc = acc
+			c.accn.Store(acc.Name)
+			c.mu.Unlock()
+		}
+		return nil
+	}
+	jsa := &jsAccount{
+		js:       js,
+		account:  acc,
+		storeDir: filepath.Join(js.config.StoreDir, JetStreamStoreDir, acc.Name),
+		streams:  make(map[string]*Stream),
+		outq:     newJSOutQ(),
+	}
+	js.accounts[acc.Name] = jsa
+	js.mu.Unlock()
+
+	jsa.client = s.createInternalJetStreamClient(acc)
+	s.startGoRoutine(func() { s.jsInternalSendLoop(jsa.client, jsa.outq) })
+
+	if err := jsa.subscribeToAPI(); err != nil {
+		return err
+	}
+	if js.cluster != nil {
+		// Replicated streams are created from their assignments.
+		js.cluster.createAccountStreams(acc.Name)
+	} else {
+		jsa.recoverStreams()
+	}
+	return nil
+}
+
+// Disables JetStream for the account. Streams are stopped but their
+// data is kept.
+func (js *jetStream) disableAccount(jsa *jsAccount) {
+	js.mu.Lock()
+	delete(js.accounts, jsa.account.Name)
+	js.mu.Unlock()
+	jsa.stop()
+}
+
+// Stops all streams of the account and releases the internal client.
+func (jsa *jsAccount) stop() {
+	jsa.mu.Lock()
+	streams := make([]*Stream, 0, len(jsa.streams))
+	for _, mset := range jsa.streams {
+		streams = append(streams, mset)
+	}
+	jsa.streams = nil
+	subs := jsa.apiSubs
+	jsa.apiSubs = nil
+	c := jsa.client
+	jsa.mu.Unlock()
+
+	for _, mset := range streams {
+		mset.stop(false)
+	}
+	// The sources stopped with the streams.
+	jsa.mu.Lock()
+	sc, sq := jsa.sclient, jsa.soutq
+	jsa.sclient, jsa.soutq = nil, nil
+	jsa.mu.Unlock()
+	if sc != nil {
+		sc.mu.Lock()
+		acc := sc.acc
+		sc.mu.Unlock()
+		if acc != nil {
+			acc.removeClient(sc)
+		}
+		sq.stop()
+	}
+	if c != nil {
+		for _, sub := range subs {
+			c.unsubscribe(c.acc, sub, true)
+		}
+		c.mu.Lock()
+		acc := c.acc
+		c.mu.Unlock()
+		if acc != nil {
+			acc.removeClient(c)
+		}
+	}
+	jsa.outq.stop()
+}
+
+// Recreates the file based streams stored for the account.
+func (jsa *jsAccount) recoverStreams() {
+	s := jsa.js.srv
+	sdir := filepath.Join(jsa.storeDir, streamsDir)
+	fis, _ := ioutil.ReadDir(sdir)
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(sdir, fi.Name(), streamMetaFile))
+		if err != nil {
+			s.Warnf("  Error reading stream metadata for %q: %v", fi.Name(), err)
+			continue
+		}
+		var meta streamMeta
+		if err := json.Unmarshal(buf, &meta); err != nil {
+			s.Warnf("  Error unmarshalling stream metadata for %q: %v", fi.Name(), err)
+			continue
+		}
+		mset, err := jsa.addStream(&meta.Config, meta.Created)
+		if err != nil {
+			s.Warnf("  Error recreating stream %q: %v", fi.Name(), err)
+			continue
+		}
+		mset.recoverConsumers()
+		state := mset.State()
+		s.Noticef("  Restored stream %q in account %q: %d messages, %s",
+			meta.Config.Name, jsa.account.Name, state.Msgs, friendlyBytes(int64(state.Bytes)))
+	}
+}
+
+// Stops JetStream, streams are stopped and their data kept.
+func (s *Server) shutdownJetStream() {
+	s.mu.Lock()
+	js := s.js
+	s.js = nil
+	s.mu.Unlock()
+	if js == nil {
+		return
+	}
+	js.mu.Lock()
+	accounts := make([]*jsAccount, 0, len(js.accounts))
+	for _, jsa := range js.accounts {
+		accounts = append(accounts, jsa)
+	}
+	js.accounts = nil
+	js.mu.Unlock()
+
+	for _, jsa := range accounts {
+		jsa.stop()
+	}
+	if js.cluster != nil {
+		js.cluster.stop()
+	}
+}
+
+// Returns the JetStream state for the account, or nil if not enabled.
+func (s *Server) lookupJSAccount(name string) *jsAccount {
+	js := s.getJetStream()
+	if js == nil {
+		return nil
+	}
+	js.mu.RLock()
+	jsa := js.accounts[name]
+	js.mu.RUnlock()
+	return jsa
+}
+
+// Returns the JetStream state for this account, or nil if not enabled.
+func (a *Account) getJetStream() *jsAccount {
+	a.mu.RLock()
+	s := a.srv
+	a.mu.RUnlock()
+	if s == nil {
+		return nil
+	}
+	return s.lookupJSAccount(a.Name)
+}
+
+// JetStreamEnabled reports if JetStream is enabled for this account.
+func (a *Account) JetStreamEnabled() bool {
+	return a.getJetStream() != nil
+}
+
+// JetStreamUsage reports the JetStream usage of this account.
+func (a *Account) JetStreamUsage() JetStreamAccountStats {
+	var stats JetStreamAccountStats
+	if jsa := a.getJetStream(); jsa != nil {
+		jsa.mu.RLock()
+		stats.Streams = len(jsa.streams)
+		jsa.mu.RUnlock()
+		stats.Consumers = jsa.numConsumers()
+		stats.Memory = uint64(atomic.LoadInt64(&jsa.memUsed))
+		stats.Store = uint64(atomic.LoadInt64(&jsa.storeUsed))
+		stats.Limits = a.JetStreamLimits()
+	}
+	return stats
+}
+
+// JetStreamLimits returns the JetStream limits of the account, from the
+// configuration or the JWT of the account.
+func (a *Account) JetStreamLimits() JetStreamAccountLimits {
+	a.mu.RLock()
+	if a.jsLimits != nil {
+		limits := *a.jsLimits
+		a.mu.RUnlock()
+		return limits
+	}
+	claimJWT, limits, from := a.claimJWT, a.jwtLimits, a.jwtLimitsFrom
+	a.mu.RUnlock()
+	if claimJWT == from {
+		return limits
+	}
+	limits = jetStreamLimitsFromJWT(claimJWT)
+	a.mu.Lock()
+	a.jwtLimits, a.jwtLimitsFrom = limits, claimJWT
+	a.mu.Unlock()
+	return limits
+}
+
+// Returns the JetStream limits of an account JWT. They are read from
+// the payload of the JWT, which is verified when the account is
+// registered, since the claims do not carry them.
+func jetStreamLimitsFromJWT(claimJWT string) JetStreamAccountLimits {
+	var limits JetStreamAccountLimits
+	parts := strings.Split(claimJWT, ".")
+	if len(parts) != 3 {
+		return limits
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return limits
+	}
+	var claims struct {
+		Nats struct {
+			Limits struct {
+				MemStorage  int64 `json:"mem_storage"`
+				DiskStorage int64 `json:"disk_storage"`
+				Streams     int64 `json:"streams"`
+				Consumer    int64 `json:"consumer"`
+			} `json:"limits"`
+		} `json:"nats"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return limits
+	}
+	// Negative values, meaning unlimited in the JWT, are left as 0.
+	l := claims.Nats.Limits
+	if l.MemStorage > 0 {
+		limits.MaxMemory = l.MemStorage
+	}
+	if l.DiskStorage > 0 {
+		limits.MaxStore = l.DiskStorage
+	}
+	if l.Streams > 0 {
+		limits.MaxStreams = int(l.Streams)
+	}
+	if l.Consumer > 0 {
+		limits.MaxConsumers = int(l.Consumer)
+	}
+	return limits
+}
+
+// Returns the JetStream limits of the account.
+func (jsa *jsAccount) limits() JetStreamAccountLimits {
+	jsa.mu.RLock()
+	acc := jsa.account
+	jsa.mu.RUnlock()
+	return acc.JetStreamLimits()
+}
+
+// Returns the number of consumers of the streams of the account.
+func (jsa *jsAccount) numConsumers() int {
+	jsa.mu.RLock()
+	streams := make([]*Stream, 0, len(jsa.streams))
+	for _, mset := range jsa.streams {
+		streams = append(streams, mset)
+	}
+	jsa.mu.RUnlock()
+	var n int
+	for _, mset := range streams {
+		n += mset.NumConsumers()
+	}
+	return n
+}
+
+// Returns an error if the account can not create the stream, given the
+// number of streams it has.
+func (jsa *jsAccount) checkStreamLimits(cfg *StreamConfig, streams int) error {
+	limits := jsa.limits()
+	if limits.MaxStreams > 0 && streams >= limits.MaxStreams {
+		return ErrJetStreamMaxStreams
+	}
+	if jsa.limitsExceeded(cfg.Storage) {
+		return ErrJetStreamResourcesExceeded
+	}
+	return checkStreamMaxBytes(cfg, limits)
+}
+
+// Returns an error if the maximum bytes of the stream exceed the
+// storage limit of the account.
+func checkStreamMaxBytes(cfg *StreamConfig, limits JetStreamAccountLimits) error {
+	max := limits.MaxStore
+	if cfg.Storage == MemoryStorage {
+		max = limits.MaxMemory
+	}
+	if max > 0 && cfg.MaxBytes > max {
+		return fmt.Errorf("stream max bytes exceeds the account limit of %d bytes", max)
+	}
+	return nil
+}
+
+// Returns an error if the account can not create the consumer. In
+// clustered mode, only the consumers known to this server are counted.
+func (jsa *jsAccount) checkConsumerLimits(mset *Stream, cfg *ConsumerConfig) error {
+	limits := jsa.limits()
+	if limits.MaxConsumers <= 0 {
+		return nil
+	}
+	// Creating a durable that exists does not add a consumer.
+	if cfg.Durable != _EMPTY_ && mset.LookupConsumer(cfg.Durable) != nil {
+		return nil
+	}
+	if jsa.numConsumers() >= limits.MaxConsumers {
+		return ErrJetStreamMaxAccountConsumers
+	}
+	return nil
+}
+
+// AddStream adds a stream to this account.
+func (a *Account) AddStream(config *StreamConfig) (*Stream, error) {
+	jsa := a.getJetStream()
+	if jsa == nil {
+		return nil, ErrJetStreamNotEnabled
+	}
+	return jsa.addStream(config, time.Now().UTC())
+}
+
+// LookupStream returns the stream with the given name.
+func (a *Account) LookupStream(name string) (*Stream, error) {
+	jsa := a.getJetStream()
+	if jsa == nil {
+		return nil, ErrJetStreamNotEnabled
+	}
+	jsa.mu.RLock()
+	mset, ok := jsa.streams[name]
+	jsa.mu.RUnlock()
+	if !ok {
+		return nil, ErrJetStreamStreamNotFound
+	}
+	return mset, nil
+}
+
+// Streams returns the streams of this account sorted by name.
+func (a *Account) Streams() []*Stream {
+	jsa := a.getJetStream()
+	if jsa == nil {
+		return nil
+	}
+	jsa.mu.RLock()
+	streams := make([]*Stream, 0, len(jsa.streams))
+	for _, mset := range jsa.streams {
+		streams = append(streams, mset)
+	}
+	jsa.mu.RUnlock()
+	sort.Slice(streams, func(i, j int) bool { return streams[i].Name() < streams[j].Name() })
+	return streams
+}
+
+// Updates the usage of the account and server for the storage type.
+func (jsa *jsAccount) updateUsage(st StorageType, bd int64) {
+	if st == MemoryStorage {
+		atomic.AddInt64(&jsa.memUsed, bd)
+		atomic.AddInt64(&jsa.js.memUsed, bd)
+	} else {
+		atomic.AddInt64(&jsa.storeUsed, bd)
+		atomic.AddInt64(&jsa.js.storeUsed, bd)
+	}
+}
+
+// Returns true if the server or account limit for the storage type is
+// reached.
+func (jsa *jsAccount) limitsExceeded(st StorageType) bool {
+	js, limits := jsa.js, jsa.limits()
+	if st == MemoryStorage {
+		return js.config.MaxMemory > 0 && atomic.LoadInt64(&js.memUsed) >= js.config.MaxMemory ||
+			limits.MaxMemory > 0 && atomic.LoadInt64(&jsa.memUsed) >= limits.MaxMemory
+	}
+	return js.config.MaxStore > 0 && atomic.LoadInt64(&js.storeUsed) >= js.config.MaxStore ||
+		limits.MaxStore > 0 && atomic.LoadInt64(&jsa.storeUsed) >= limits.MaxStore
+}
+
+// Returns a new subscription id for the internal client.
+// Lock should be held.
+func (jsa *jsAccount) nextSid() int {
+	jsa.sid++
+	return jsa.sid
+}
+
+// Returns the size in a human readable form, 0 or less is unlimited.
+func friendlyBytes(bytes int64) string {
+	if bytes <= 0 {
+		return "unlimited"
+	}
+	fbytes := float64(bytes)
+	base := 1024
+	pre := []string{"K", "M", "G", "T", "P", "E"}
+	if fbytes < float64(base) {
+		return fmt.Sprintf("%v B", fbytes)
+	}
+	exp := int(math.Log(fbytes) / math.Log(float64(base)))
+	index := exp - 1
+	return fmt.Sprintf("%.2f %sB", fbytes/math.Pow(float64(base), float64(exp)), pre[index])
+}
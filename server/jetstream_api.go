@@ -0,0 +1,803 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Request API subjects for JetStream. They are handled in each account
+// that has JetStream enabled.
+const (
+	// JSApiPrefix is the prefix of all JetStream API subjects.
+	JSApiPrefix = "$JS.API"
+
+	// JSApiInfo is for obtaining general information about JetStream
+	// usage for this account.
+	JSApiInfo = "$JS.API.INFO"
+
+	// JSApiStreamCreate is the endpoint to create new streams.
+	JSApiStreamCreate  = "$JS.API.STREAM.CREATE.*"
+	JSApiStreamCreateT = "$JS.API.STREAM.CREATE.%s"
+
+	// JSApiStreamUpdate is the endpoint to update existing streams.
+	JSApiStreamUpdate  = "$JS.API.STREAM.UPDATE.*"
+	JSApiStreamUpdateT = "$JS.API.STREAM.UPDATE.%s"
+
+	// JSApiStreamNames is the endpoint that will return a list of stream names.
+	JSApiStreamNames = "$JS.API.STREAM.NAMES"
+
+	// JSApiStreamList is the endpoint that will return all detailed stream information.
+	JSApiStreamList = "$JS.API.STREAM.LIST"
+
+	// JSApiStreamInfo is for obtaining general information about a named stream.
+	JSApiStreamInfo  = "$JS.API.STREAM.INFO.*"
+	JSApiStreamInfoT = "$JS.API.STREAM.INFO.%s"
+
+	// JSApiStreamDelete is the endpoint to delete streams.
+	JSApiStreamDelete  = "$JS.API.STREAM.DELETE.*"
+	JSApiStreamDeleteT = "$JS.API.STREAM.DELETE.%s"
+
+	// JSApiStreamPurge is the endpoint to purge streams.
+	JSApiStreamPurge  = "$JS.API.STREAM.PURGE.*"
+	JSApiStreamPurgeT = "$JS.API.STREAM.PURGE.%s"
+
+	// JSApiMsgGet is the endpoint to get a message.
+	JSApiMsgGet  = "$JS.API.STREAM.MSG.GET.*"
+	JSApiMsgGetT = "$JS.API.STREAM.MSG.GET.%s"
+
+	// JSApiMsgDelete is the endpoint to delete messages from a stream.
+	JSApiMsgDelete  = "$JS.API.STREAM.MSG.DELETE.*"
+	JSApiMsgDeleteT = "$JS.API.STREAM.MSG.DELETE.%s"
+
+	// JSApiStreamReplay is the endpoint to replay the messages of a
+	// stream to a subject.
+	JSApiStreamReplay  = "$JS.API.STREAM.REPLAY.*"
+	JSApiStreamReplayT = "$JS.API.STREAM.REPLAY.%s"
+
+	// JSApiConsumerCreate is the endpoint to create ephemeral consumers
+	// for streams.
+	JSApiConsumerCreate  = "$JS.API.CONSUMER.CREATE.*"
+	JSApiConsumerCreateT = "$JS.API.CONSUMER.CREATE.%s"
+
+	// JSApiDurableCreate is the endpoint to create durable consumers
+	// for streams.
+	JSApiDurableCreate  = "$JS.API.CONSUMER.DURABLE.CREATE.*.*"
+	JSApiDurableCreateT = "$JS.API.CONSUMER.DURABLE.CREATE.%s.%s"
+
+	// JSApiConsumerNames is the endpoint for the names of the consumers
+	// of a stream.
+	JSApiConsumerNames  = "$JS.API.CONSUMER.NAMES.*"
+	JSApiConsumerNamesT = "$JS.API.CONSUMER.NAMES.%s"
+
+	// JSApiConsumerList is the endpoint for the information of all the
+	// consumers of a stream.
+	JSApiConsumerList  = "$JS.API.CONSUMER.LIST.*"
+	JSApiConsumerListT = "$JS.API.CONSUMER.LIST.%s"
+
+	// JSApiConsumerInfo is for obtaining information about a consumer.
+	JSApiConsumerInfo  = "$JS.API.CONSUMER.INFO.*.*"
+	JSApiConsumerInfoT = "$JS.API.CONSUMER.INFO.%s.%s"
+
+	// JSApiConsumerDelete is the endpoint to delete consumers.
+	JSApiConsumerDelete  = "$JS.API.CONSUMER.DELETE.*.*"
+	JSApiConsumerDeleteT = "$JS.API.CONSUMER.DELETE.%s.%s"
+
+	// JSApiRequestNextT is the subject to request the next messages
+	// of a pull consumer.
+	JSApiRequestNextT = "$JS.API.CONSUMER.MSG.NEXT.%s.%s"
+
+	// Reply subject of replayed messages, includes the stream name,
+	// sequence and timestamp of the message.
+	jsReplayReplyT = "$JS.REPLAY.%s.%d.%d"
+)
+
+// ApiResponse is the common part of all JetStream API responses.
+type ApiResponse struct {
+	Type  string    `json:"type"`
+	Error *ApiError `json:"error,omitempty"`
+}
+
+// ApiError is included in responses when an error occurred.
+type ApiError struct {
+	Code        int    `json:"code"`
+	Description string `json:"description,omitempty"`
+}
+
+// JSPubAckResponse is the response to a message published to a stream.
+type JSPubAckResponse struct {
+	Error *ApiError `json:"error,omitempty"`
+	*PubAck
+}
+
+// JSApiAccountInfoResponse reports the JetStream usage of the account.
+type JSApiAccountInfoResponse struct {
+	ApiResponse
+	*JetStreamAccountStats
+}
+
+const JSApiAccountInfoResponseType = "io.nats.jetstream.api.v1.account_info_response"
+
+// JSApiStreamCreateResponse is the response to a stream create request.
+type JSApiStreamCreateResponse struct {
+	ApiResponse
+	*StreamInfo
+}
+
+const JSApiStreamCreateResponseType = "io.nats.jetstream.api.v1.stream_create_response"
+
+// JSApiStreamUpdateResponse is the response to a stream update request.
+type JSApiStreamUpdateResponse struct {
+	ApiResponse
+	*StreamInfo
+}
+
+const JSApiStreamUpdateResponseType = "io.nats.jetstream.api.v1.stream_update_response"
+
+// JSApiStreamInfoResponse is the response to a stream info request.
+type JSApiStreamInfoResponse struct {
+	ApiResponse
+	*StreamInfo
+}
+
+const JSApiStreamInfoResponseType = "io.nats.jetstream.api.v1.stream_info_response"
+
+// JSApiStreamDeleteResponse is the response to a stream delete request.
+type JSApiStreamDeleteResponse struct {
+	ApiResponse
+	Success bool `json:"success,omitempty"`
+}
+
+const JSApiStreamDeleteResponseType = "io.nats.jetstream.api.v1.stream_delete_response"
+
+// JSApiStreamPurgeResponse is the response to a stream purge request.
+type JSApiStreamPurgeResponse struct {
+	ApiResponse
+	Success bool   `json:"success,omitempty"`
+	Purged  uint64 `json:"purged"`
+}
+
+const JSApiStreamPurgeResponseType = "io.nats.jetstream.api.v1.stream_purge_response"
+
+// JSApiStreamNamesResponse lists the names of the streams.
+type JSApiStreamNamesResponse struct {
+	ApiResponse
+	Streams []string `json:"streams"`
+}
+
+const JSApiStreamNamesResponseType = "io.nats.jetstream.api.v1.stream_names_response"
+
+// JSApiStreamListResponse lists the information of the streams.
+type JSApiStreamListResponse struct {
+	ApiResponse
+	Streams []*StreamInfo `json:"streams"`
+}
+
+const JSApiStreamListResponseType = "io.nats.jetstream.api.v1.stream_list_response"
+
+// JSApiMsgGetRequest selects a message by sequence, or the last message
+// stored on a subject.
+type JSApiMsgGetRequest struct {
+	Seq     uint64 `json:"seq,omitempty"`
+	LastFor string `json:"last_by_subj,omitempty"`
+}
+
+// JSApiMsgGetResponse is the response to a message get request.
+type JSApiMsgGetResponse struct {
+	ApiResponse
+	Message *StoredMsg `json:"message,omitempty"`
+}
+
+const JSApiMsgGetResponseType = "io.nats.jetstream.api.v1.stream_msg_get_response"
+
+// JSApiMsgDeleteRequest selects the message to delete.
+type JSApiMsgDeleteRequest struct {
+	Seq uint64 `json:"seq"`
+}
+
+// JSApiMsgDeleteResponse is the response to a message delete request.
+type JSApiMsgDeleteResponse struct {
+	ApiResponse
+	Success bool `json:"success,omitempty"`
+}
+
+const JSApiMsgDeleteResponseType = "io.nats.jetstream.api.v1.stream_msg_delete_response"
+
+// JSApiStreamReplayRequest asks for the messages of a stream to be
+// delivered to a subject.
+type JSApiStreamReplayRequest struct {
+	DeliverSubject string       `json:"deliver_subject"`
+	StartSeq       uint64       `json:"start_seq,omitempty"`
+	StartTime      *time.Time   `json:"start_time,omitempty"`
+	FilterSubject  string       `json:"filter_subject,omitempty"`
+	ReplayPolicy   ReplayPolicy `json:"replay_policy"`
+}
+
+// JSApiStreamReplayResponse reports the number of messages that will be
+// delivered and the sequence of the last one.
+type JSApiStreamReplayResponse struct {
+	ApiResponse
+	NumPending uint64 `json:"num_pending"`
+	LastSeq    uint64 `json:"last_seq,omitempty"`
+}
+
+const JSApiStreamReplayResponseType = "io.nats.jetstream.api.v1.stream_replay_response"
+
+// JSApiConsumerCreateResponse is the response to a consumer create request.
+type JSApiConsumerCreateResponse struct {
+	ApiResponse
+	*ConsumerInfo
+}
+
+const JSApiConsumerCreateResponseType = "io.nats.jetstream.api.v1.consumer_create_response"
+
+// JSApiConsumerInfoResponse is the response to a consumer info request.
+type JSApiConsumerInfoResponse struct {
+	ApiResponse
+	*ConsumerInfo
+}
+
+const JSApiConsumerInfoResponseType = "io.nats.jetstream.api.v1.consumer_info_response"
+
+// JSApiConsumerDeleteResponse is the response to a consumer delete request.
+type JSApiConsumerDeleteResponse struct {
+	ApiResponse
+	Success bool `json:"success,omitempty"`
+}
+
+const JSApiConsumerDeleteResponseType = "io.nats.jetstream.api.v1.consumer_delete_response"
+
+// JSApiConsumerNamesResponse lists the names of the consumers of a stream.
+type JSApiConsumerNamesResponse struct {
+	ApiResponse
+	Consumers []string `json:"consumers"`
+}
+
+const JSApiConsumerNamesResponseType = "io.nats.jetstream.api.v1.consumer_names_response"
+
+// JSApiConsumerListResponse lists the information of the consumers of a stream.
+type JSApiConsumerListResponse struct {
+	ApiResponse
+	Consumers []*ConsumerInfo `json:"consumers"`
+}
+
+const JSApiConsumerListResponseType = "io.nats.jetstream.api.v1.consumer_list_response"
+
+// Subscribes the internal client of the account to the API subjects.
+func (jsa *jsAccount) subscribeToAPI() error {
+	handlers := map[string]msgHandler{
+		JSApiInfo:           jsa.jsAccountInfoRequest,
+		JSApiStreamCreate:   jsa.jsStreamCreateRequest,
+		JSApiStreamUpdate:   jsa.jsStreamUpdateRequest,
+		JSApiStreamNames:    jsa.jsStreamNamesRequest,
+		JSApiStreamList:     jsa.jsStreamListRequest,
+		JSApiStreamInfo:     jsa.jsStreamInfoRequest,
+		JSApiStreamDelete:   jsa.jsStreamDeleteRequest,
+		JSApiStreamPurge:    jsa.jsStreamPurgeRequest,
+		JSApiMsgGet:         jsa.jsMsgGetRequest,
+		JSApiMsgDelete:      jsa.jsMsgDeleteRequest,
+		JSApiStreamReplay:   jsa.jsStreamReplayRequest,
+		JSApiConsumerCreate: jsa.jsConsumerCreateRequest,
+		JSApiDurableCreate:  jsa.jsConsumerCreateRequest,
+		JSApiConsumerNames:  jsa.jsConsumerNamesRequest,
+		JSApiConsumerList:   jsa.jsConsumerListRequest,
+		JSApiConsumerInfo:   jsa.jsConsumerInfoRequest,
+		JSApiConsumerDelete: jsa.jsConsumerDeleteRequest,
+		JSApiKVCreate:       jsa.jsKVCreateRequest,
+		JSApiKVDelete:       jsa.jsKVDeleteRequest,
+		JSApiKVInfo:         jsa.jsKVInfoRequest,
+		JSApiKVPut:          jsa.jsKVPutRequest,
+		JSApiKVGet:          jsa.jsKVGetRequest,
+		JSApiKVHistory:      jsa.jsKVHistoryRequest,
+		JSApiKVDel:          jsa.jsKVDelRequest,
+		JSApiKVWatch:        jsa.jsKVWatchRequest,
+
+		JSApiObjectStoreCreate: jsa.jsObjectStoreCreateRequest,
+		JSApiObjectStoreDelete: jsa.jsObjectStoreDeleteRequest,
+		JSApiObjectPut:         jsa.jsObjectPutRequest,
+		JSApiObjectGet:         jsa.jsObjectGetRequest,
+		JSApiObjectInfo:        jsa.jsObjectGetRequest,
+		JSApiObjectDelete:      jsa.jsObjectDeleteRequest,
+		JSApiObjectList:        jsa.jsObjectListRequest,
+	}
+	for subj, cb := range handlers {
+		jsa.mu.Lock()
+		sid := jsa.nextSid()
+		c := jsa.client
+		jsa.mu.Unlock()
+		sub, err := c.subscribeInternal(subj, sid, cb)
+		if err != nil {
+			return err
+		}
+		jsa.mu.Lock()
+		jsa.apiSubs = append(jsa.apiSubs, sub)
+		jsa.mu.Unlock()
+	}
+	return nil
+}
+
+// Sends the API response to the reply subject.
+func (jsa *jsAccount) sendAPIResponse(reply string, v interface{}) {
+	if reply == _EMPTY_ {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		jsa.js.srv.Warnf("Error marshalling JetStream API response: %v", err)
+		return
+	}
+	jsa.outq.send(&jsPubMsg{subj: reply, msg: b})
+}
+
+// Returns the stream name, which is the last token of the API subject.
+func streamNameFromSubject(subject string) string {
+	return subject[strings.LastIndexByte(subject, btsep)+1:]
+}
+
+// Looks up the stream named in the API subject, filling in the error
+// of the response if not found.
+func (jsa *jsAccount) streamFromSubject(subject string, resp *ApiResponse) *Stream {
+	name := streamNameFromSubject(subject)
+	jsa.mu.RLock()
+	mset := jsa.streams[name]
+	jsa.mu.RUnlock()
+	if mset == nil {
+		resp.Error = &ApiError{Code: 404, Description: ErrJetStreamStreamNotFound.Error()}
+	}
+	return mset
+}
+
+// Returns the stream name of the consumer API subjects, which is the
+// token before the consumer name.
+func consumerStreamFromSubject(subject string) string {
+	tokens := strings.Split(subject, tsep)
+	return tokens[len(tokens)-2]
+}
+
+// Looks up the stream and consumer named by the last two tokens of the
+// API subject, filling in the error of the response if not found.
+func (jsa *jsAccount) consumerFromSubject(subject string, resp *ApiResponse) *Consumer {
+	tokens := strings.Split(subject, tsep)
+	sname, oname := tokens[len(tokens)-2], tokens[len(tokens)-1]
+	jsa.mu.RLock()
+	mset := jsa.streams[sname]
+	jsa.mu.RUnlock()
+	if mset == nil {
+		resp.Error = &ApiError{Code: 404, Description: ErrJetStreamStreamNotFound.Error()}
+		return nil
+	}
+	o := mset.LookupConsumer(oname)
+	if o == nil {
+		resp.Error = &ApiError{Code: 404, Description: ErrJetStreamConsumerNotFound.Error()}
+	}
+	return o
+}
+
+// Request for current usage and limits for this account.
+func (jsa *jsAccount) jsAccountInfoRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	if !jsa.js.isMetaLeader() {
+		return
+	}
+	stats := jsa.account.JetStreamUsage()
+	if jsc := jsa.js.cluster; jsc != nil {
+		stats.Streams = len(jsc.accountStreams(jsa.account.Name))
+	}
+	resp := JSApiAccountInfoResponse{ApiResponse: ApiResponse{Type: JSApiAccountInfoResponseType}, JetStreamAccountStats: &stats}
+	jsa.sendAPIResponse(reply, &resp)
+}
+
+// Request to create a stream.
+func (jsa *jsAccount) jsStreamCreateRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	if !jsa.js.isMetaLeader() {
+		return
+	}
+	resp := JSApiStreamCreateResponse{ApiResponse: ApiResponse{Type: JSApiStreamCreateResponseType}}
+	var cfg StreamConfig
+	if err := json.Unmarshal(msg, &cfg); err != nil {
+		resp.Error = &ApiError{Code: 400, Description: "invalid JSON"}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	if name := streamNameFromSubject(subject); cfg.Name != name {
+		resp.Error = &ApiError{Code: 400, Description: "stream name in subject does not match request"}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	jsa.createStream(&cfg, reply)
+}
+
+// Creates the stream and responds, once assigned in clustered mode.
+func (jsa *jsAccount) createStream(cfg *StreamConfig, reply string) {
+	if jsc := jsa.js.cluster; jsc != nil {
+		jsc.createStream(jsa, cfg, reply)
+		return
+	}
+	resp := JSApiStreamCreateResponse{ApiResponse: ApiResponse{Type: JSApiStreamCreateResponseType}}
+	jsa.mu.RLock()
+	streams := len(jsa.streams)
+	jsa.mu.RUnlock()
+	var mset *Stream
+	err := jsa.checkStreamLimits(cfg, streams)
+	if err == nil {
+		mset, err = jsa.addStream(cfg, time.Now().UTC())
+	}
+	if err != nil {
+		resp.Error = &ApiError{Code: 500, Description: err.Error()}
+	} else {
+		resp.StreamInfo = mset.Info()
+	}
+	jsa.sendAPIResponse(reply, &resp)
+}
+
+// Request to update a stream.
+func (jsa *jsAccount) jsStreamUpdateRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	if !jsa.js.isMetaLeader() {
+		return
+	}
+	resp := JSApiStreamUpdateResponse{ApiResponse: ApiResponse{Type: JSApiStreamUpdateResponseType}}
+	var cfg StreamConfig
+	if err := json.Unmarshal(msg, &cfg); err != nil {
+		resp.Error = &ApiError{Code: 400, Description: "invalid JSON"}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	if name := streamNameFromSubject(subject); cfg.Name != name {
+		resp.Error = &ApiError{Code: 400, Description: "stream name in subject does not match request"}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	if jsc := jsa.js.cluster; jsc != nil {
+		jsc.updateStream(jsa, &cfg, reply)
+		return
+	}
+	if mset := jsa.streamFromSubject(subject, &resp.ApiResponse); mset != nil {
+		if err := mset.Update(&cfg); err != nil {
+			resp.Error = &ApiError{Code: 500, Description: err.Error()}
+		} else {
+			resp.StreamInfo = mset.Info()
+		}
+	}
+	jsa.sendAPIResponse(reply, &resp)
+}
+
+// Request for the names of the streams.
+func (jsa *jsAccount) jsStreamNamesRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	if !jsa.js.isMetaLeader() {
+		return
+	}
+	resp := JSApiStreamNamesResponse{ApiResponse: ApiResponse{Type: JSApiStreamNamesResponseType}, Streams: []string{}}
+	if jsc := jsa.js.cluster; jsc != nil {
+		for _, sa := range jsc.accountStreams(jsa.account.Name) {
+			resp.Streams = append(resp.Streams, sa.Config.Name)
+		}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	for _, mset := range jsa.account.Streams() {
+		resp.Streams = append(resp.Streams, mset.Name())
+	}
+	jsa.sendAPIResponse(reply, &resp)
+}
+
+// Request for the information of all streams.
+func (jsa *jsAccount) jsStreamListRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	if !jsa.js.isMetaLeader() {
+		return
+	}
+	resp := JSApiStreamListResponse{ApiResponse: ApiResponse{Type: JSApiStreamListResponseType}, Streams: []*StreamInfo{}}
+	if jsc := jsa.js.cluster; jsc != nil {
+		for _, sa := range jsc.accountStreams(jsa.account.Name) {
+			resp.Streams = append(resp.Streams, jsc.streamInfo(sa))
+		}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	for _, mset := range jsa.account.Streams() {
+		resp.Streams = append(resp.Streams, mset.Info())
+	}
+	jsa.sendAPIResponse(reply, &resp)
+}
+
+// Request for the information of a stream.
+func (jsa *jsAccount) jsStreamInfoRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	if !jsa.answersFor(streamNameFromSubject(subject)) {
+		return
+	}
+	resp := JSApiStreamInfoResponse{ApiResponse: ApiResponse{Type: JSApiStreamInfoResponseType}}
+	if mset := jsa.streamFromSubject(subject, &resp.ApiResponse); mset != nil {
+		resp.StreamInfo = mset.Info()
+	}
+	jsa.sendAPIResponse(reply, &resp)
+}
+
+// Request to delete a stream.
+func (jsa *jsAccount) jsStreamDeleteRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	if !jsa.js.isMetaLeader() {
+		return
+	}
+	jsa.deleteStream(streamNameFromSubject(subject), reply)
+}
+
+// Deletes the stream and responds, once removed in clustered mode.
+func (jsa *jsAccount) deleteStream(name, reply string) {
+	if jsc := jsa.js.cluster; jsc != nil {
+		jsc.deleteStream(jsa, name, reply)
+		return
+	}
+	resp := JSApiStreamDeleteResponse{ApiResponse: ApiResponse{Type: JSApiStreamDeleteResponseType}}
+	jsa.mu.RLock()
+	mset := jsa.streams[name]
+	jsa.mu.RUnlock()
+	if mset == nil {
+		resp.Error = &ApiError{Code: 404, Description: ErrJetStreamStreamNotFound.Error()}
+	} else if err := mset.Delete(); err != nil {
+		resp.Error = &ApiError{Code: 500, Description: err.Error()}
+	} else {
+		resp.Success = true
+	}
+	jsa.sendAPIResponse(reply, &resp)
+}
+
+// Request to purge a stream.
+func (jsa *jsAccount) jsStreamPurgeRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	if !jsa.answersFor(streamNameFromSubject(subject)) {
+		return
+	}
+	resp := JSApiStreamPurgeResponse{ApiResponse: ApiResponse{Type: JSApiStreamPurgeResponseType}}
+	if mset := jsa.streamFromSubject(subject, &resp.ApiResponse); mset != nil && mset.isClustered() {
+		// The response is sent once purged.
+		if err := mset.proposePurge(reply); err != nil {
+			resp.Error = &ApiError{Code: 500, Description: err.Error()}
+			jsa.sendAPIResponse(reply, &resp)
+		}
+		return
+	} else if mset != nil {
+		purged, err := mset.Purge()
+		if err != nil {
+			resp.Error = &ApiError{Code: 500, Description: err.Error()}
+		} else {
+			resp.Success, resp.Purged = true, purged
+		}
+	}
+	jsa.sendAPIResponse(reply, &resp)
+}
+
+// Request to get a message from a stream.
+func (jsa *jsAccount) jsMsgGetRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	if !jsa.answersFor(streamNameFromSubject(subject)) {
+		return
+	}
+	resp := JSApiMsgGetResponse{ApiResponse: ApiResponse{Type: JSApiMsgGetResponseType}}
+	var req JSApiMsgGetRequest
+	if err := json.Unmarshal(msg, &req); err != nil || (req.Seq == 0) == (req.LastFor == _EMPTY_) {
+		resp.Error = &ApiError{Code: 400, Description: "request requires either a sequence or a subject"}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	if mset := jsa.streamFromSubject(subject, &resp.ApiResponse); mset != nil {
+		var sm *StoredMsg
+		var err error
+		if req.Seq > 0 {
+			sm, err = mset.GetMsg(req.Seq)
+		} else {
+			sm, err = mset.GetLastMsg(req.LastFor)
+		}
+		if err != nil {
+			resp.Error = &ApiError{Code: 404, Description: err.Error()}
+		} else {
+			resp.Message = sm
+		}
+	}
+	jsa.sendAPIResponse(reply, &resp)
+}
+
+// Request to delete a message from a stream.
+func (jsa *jsAccount) jsMsgDeleteRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	if !jsa.answersFor(streamNameFromSubject(subject)) {
+		return
+	}
+	resp := JSApiMsgDeleteResponse{ApiResponse: ApiResponse{Type: JSApiMsgDeleteResponseType}}
+	var req JSApiMsgDeleteRequest
+	if err := json.Unmarshal(msg, &req); err != nil || req.Seq == 0 {
+		resp.Error = &ApiError{Code: 400, Description: "request requires a sequence"}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	if mset := jsa.streamFromSubject(subject, &resp.ApiResponse); mset != nil && mset.isClustered() {
+		// The response is sent once removed.
+		if err := mset.propose(&streamOp{Op: deleteMsgOp, Seq: req.Seq, Reply: reply}); err != nil {
+			resp.Error = &ApiError{Code: 500, Description: err.Error()}
+			jsa.sendAPIResponse(reply, &resp)
+		}
+		return
+	} else if mset != nil {
+		removed, err := mset.RemoveMsg(req.Seq)
+		if err != nil {
+			resp.Error = &ApiError{Code: 500, Description: err.Error()}
+		} else if !removed {
+			resp.Error = &ApiError{Code: 404, Description: ErrStoreMsgNotFound.Error()}
+		} else {
+			resp.Success = true
+		}
+	}
+	jsa.sendAPIResponse(reply, &resp)
+}
+
+// Request to replay the messages of a stream.
+func (jsa *jsAccount) jsStreamReplayRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	if !jsa.answersFor(streamNameFromSubject(subject)) {
+		return
+	}
+	resp := JSApiStreamReplayResponse{ApiResponse: ApiResponse{Type: JSApiStreamReplayResponseType}}
+	var req JSApiStreamReplayRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = &ApiError{Code: 400, Description: "invalid JSON"}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	mset := jsa.streamFromSubject(subject, &resp.ApiResponse)
+	var sseq uint64
+	if mset != nil {
+		var err error
+		sseq, resp.NumPending, resp.LastSeq, err = mset.replayRange(&req)
+		if err != nil {
+			resp.Error = &ApiError{Code: 400, Description: err.Error()}
+		}
+	}
+	// Send the response first so that it is queued ahead of the messages.
+	jsa.sendAPIResponse(reply, &resp)
+	if resp.Error == nil && resp.NumPending > 0 {
+		mset.startReplay(&req, sseq, resp.LastSeq)
+	}
+}
+
+// Request to create a consumer. Durable consumers are created on the
+// durable endpoint which includes the durable name.
+func (jsa *jsAccount) jsConsumerCreateRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	tokens := strings.Split(subject, tsep)
+	sname := tokens[len(tokens)-1]
+	durable := subjectIsSubsetMatch(subject, JSApiDurableCreate)
+	if durable {
+		sname = tokens[len(tokens)-2]
+	}
+	if !jsa.answersFor(sname) {
+		return
+	}
+	resp := JSApiConsumerCreateResponse{ApiResponse: ApiResponse{Type: JSApiConsumerCreateResponseType}}
+	var req CreateConsumerRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = &ApiError{Code: 400, Description: "invalid JSON"}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	if durable {
+		if req.Config.Durable != tokens[len(tokens)-1] {
+			resp.Error = &ApiError{Code: 400, Description: "consumer name in subject does not match durable name in request"}
+		}
+	} else if req.Config.Durable != _EMPTY_ {
+		resp.Error = &ApiError{Code: 400, Description: "consumer expected to be ephemeral but a durable name was set in request"}
+	}
+	if resp.Error == nil && req.Stream != sname {
+		resp.Error = &ApiError{Code: 400, Description: "stream name in subject does not match request"}
+	}
+	if resp.Error != nil {
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	jsa.mu.RLock()
+	mset := jsa.streams[sname]
+	jsa.mu.RUnlock()
+	if mset == nil {
+		resp.Error = &ApiError{Code: 404, Description: ErrJetStreamStreamNotFound.Error()}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	jsa.createConsumer(mset, &req.Config, reply)
+}
+
+// Adds the consumer to the stream and responds, once added on the
+// members in clustered mode.
+func (jsa *jsAccount) createConsumer(mset *Stream, config *ConsumerConfig, reply string) {
+	resp := JSApiConsumerCreateResponse{ApiResponse: ApiResponse{Type: JSApiConsumerCreateResponseType}}
+	if err := jsa.checkConsumerLimits(mset, config); err != nil {
+		resp.Error = &ApiError{Code: 500, Description: err.Error()}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	if mset.isClustered() {
+		// The response is sent once the consumer is added, unless it exists.
+		o, err := mset.proposeAddConsumer(config, reply)
+		if err != nil {
+			resp.Error = &ApiError{Code: 500, Description: err.Error()}
+		} else if o != nil {
+			resp.ConsumerInfo = o.Info()
+		} else {
+			return
+		}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	o, err := mset.AddConsumer(config)
+	if err != nil {
+		resp.Error = &ApiError{Code: 500, Description: err.Error()}
+	} else {
+		resp.ConsumerInfo = o.Info()
+	}
+	jsa.sendAPIResponse(reply, &resp)
+}
+
+// Request for the names of the consumers of a stream.
+func (jsa *jsAccount) jsConsumerNamesRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	if !jsa.answersFor(streamNameFromSubject(subject)) {
+		return
+	}
+	resp := JSApiConsumerNamesResponse{ApiResponse: ApiResponse{Type: JSApiConsumerNamesResponseType}, Consumers: []string{}}
+	if mset := jsa.streamFromSubject(subject, &resp.ApiResponse); mset != nil {
+		for _, o := range mset.Consumers() {
+			resp.Consumers = append(resp.Consumers, o.Name())
+		}
+	}
+	jsa.sendAPIResponse(reply, &resp)
+}
+
+// Request for the information of all the consumers of a stream.
+func (jsa *jsAccount) jsConsumerListRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	if !jsa.answersFor(streamNameFromSubject(subject)) {
+		return
+	}
+	resp := JSApiConsumerListResponse{ApiResponse: ApiResponse{Type: JSApiConsumerListResponseType}, Consumers: []*ConsumerInfo{}}
+	if mset := jsa.streamFromSubject(subject, &resp.ApiResponse); mset != nil {
+		for _, o := range mset.Consumers() {
+			resp.Consumers = append(resp.Consumers, o.Info())
+		}
+	}
+	jsa.sendAPIResponse(reply, &resp)
+}
+
+// Request for the information of a consumer.
+func (jsa *jsAccount) jsConsumerInfoRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	if !jsa.answersFor(consumerStreamFromSubject(subject)) {
+		return
+	}
+	resp := JSApiConsumerInfoResponse{ApiResponse: ApiResponse{Type: JSApiConsumerInfoResponseType}}
+	if o := jsa.consumerFromSubject(subject, &resp.ApiResponse); o != nil {
+		resp.ConsumerInfo = o.Info()
+	}
+	jsa.sendAPIResponse(reply, &resp)
+}
+
+// Request to delete a consumer.
+func (jsa *jsAccount) jsConsumerDeleteRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	if !jsa.answersFor(consumerStreamFromSubject(subject)) {
+		return
+	}
+	resp := JSApiConsumerDeleteResponse{ApiResponse: ApiResponse{Type: JSApiConsumerDeleteResponseType}}
+	if o := jsa.consumerFromSubject(subject, &resp.ApiResponse); o != nil && o.mset.isClustered() {
+		// The response is sent once deleted.
+		if err := o.mset.proposeConsumerDelete(o.name, reply); err != nil {
+			resp.Error = &ApiError{Code: 500, Description: err.Error()}
+			jsa.sendAPIResponse(reply, &resp)
+		}
+		return
+	} else if o != nil {
+		if err := o.Delete(); err != nil {
+			resp.Error = &ApiError{Code: 500, Description: err.Error()}
+		} else {
+			resp.Success = true
+		}
+	}
+	jsa.sendAPIResponse(reply, &resp)
+}
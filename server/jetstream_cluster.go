@@ -0,0 +1,1644 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+// ClusterInfo shows the members of the group of a replicated stream.
+type ClusterInfo struct {
+	Name     string      `json:"name,omitempty"`
+	Leader   string      `json:"leader,omitempty"`
+	Replicas []*PeerInfo `json:"replicas,omitempty"`
+}
+
+// PeerInfo shows if a member of the group is up to date with the leader.
+type PeerInfo struct {
+	Name    string `json:"name"`
+	Current bool   `json:"current"`
+}
+
+// ErrJetStreamInsufficientPeers is returned when there are not enough
+// servers matching the placement of a stream.
+var ErrJetStreamInsufficientPeers = errors.New("insufficient peers for placement")
+
+// Subjects used between the JetStream servers of a cluster, in the
+// system account.
+const (
+	// Servers announce themselves and their tags.
+	jsClusterPeerSubj = "$JSC.PEER"
+	// Members of a stream group serve the messages that followers are
+	// missing, with the group and the member.
+	jsClusterCatchupSubjT = "$JSC.CU.%s.%s"
+	// Inbox of the requests of a server, with a unique token.
+	jsClusterInboxT = "$JSC.R.%s.%s"
+)
+
+const (
+	// Directory of the cluster state, under the one of the system account.
+	jsClusterDir = "_js_"
+	// Directory of the stream groups, under the cluster directory.
+	jsGroupsDir = "groups"
+	// Identifier of this server in the groups.
+	jsNodeIDFile = "node.id"
+	// Streams assigned by the metadata group.
+	jsMetaStateFile = "streams.json"
+	// The group holding the assignments of the streams to servers.
+	jsMetaGroup = "_meta_"
+
+	jsClusterAnnounceInterval = time.Second
+	// Peers not heard from in this long are not selected for new streams.
+	jsClusterPeerTimeout = 5 * jsClusterAnnounceInterval
+	// A new cluster forms the metadata group once no new server has
+	// been seen for this long.
+	jsClusterBootstrapDelay = 2 * time.Second
+	// Interval at which the leader of a stream replicates the state of
+	// the consumers that changed.
+	jsClusterConsumerStateInterval = 250 * time.Millisecond
+	// Size of the messages sent in one catchup response.
+	jsClusterCatchupBatchSize = 256 * 1024
+	jsClusterCatchupTimeout   = 5 * time.Second
+)
+
+// Announced by each server on the peer subject.
+type jsPeerInfo struct {
+	ID   string   `json:"id"`
+	Tags []string `json:"tags,omitempty"`
+	// Set once the server is a member of the metadata group.
+	Meta bool `json:"meta,omitempty"`
+}
+
+type jsPeer struct {
+	jsPeerInfo
+	last time.Time
+}
+
+// The members of the raft group of a stream.
+type raftGroup struct {
+	Name  string   `json:"name"`
+	Peers []string `json:"peers"`
+}
+
+func (rg *raftGroup) isMember(id string) bool {
+	for _, p := range rg.Peers {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Assignment of a stream to a group of servers.
+type streamAssignment struct {
+	Account string       `json:"account"`
+	Config  StreamConfig `json:"config"`
+	Created time.Time    `json:"created"`
+	Group   *raftGroup   `json:"group"`
+}
+
+type metaOpType uint8
+
+const (
+	assignStreamOp metaOpType = iota + 1
+	updateStreamOp
+	removeStreamOp
+)
+
+// Entry of the metadata group. The leader responds to the request once
+// the entry is applied.
+type metaOp struct {
+	Op     metaOpType        `json:"op"`
+	Stream *streamAssignment `json:"stream"`
+	Reply  string            `json:"reply,omitempty"`
+}
+
+// State of the JetStream servers of a cluster. Streams are assigned to
+// servers by the metadata group, each stream is then replicated by its
+// own group.
+type jetStreamCluster struct {
+	mu      sync.RWMutex
+	js      *jetStream
+	s       *Server
+	id      string
+	tags    []string
+	dir     string
+	c       *client
+	outq    *jsOutQ
+	sid     int
+	subs    []*subscription
+	meta    *raft
+	leader  bool
+	peers   map[string]*jsPeer
+	lastNew time.Time
+	streams map[string]map[string]*streamAssignment
+	qch     chan struct{}
+}
+
+// Sets up the cluster state and its internal client in the system
+// account. The assigned streams are created once the accounts are
+// enabled, and the cluster is then started.
+func (js *jetStream) setupCluster() error {
+	s := js.srv
+	sacc := s.SystemAccount()
+	if sacc == nil {
+		return fmt.Errorf("jetstream in clustered mode requires a system account")
+	}
+	dir := filepath.Join(js.config.StoreDir, JetStreamStoreDir, sacc.Name, jsClusterDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not create cluster directory - %v", err)
+	}
+	id, err := loadNodeID(dir)
+	if err != nil {
+		return err
+	}
+	jsc := &jetStreamCluster{
+		js:      js,
+		s:       s,
+		id:      id,
+		tags:    s.getOpts().Tags,
+		dir:     dir,
+		outq:    newJSOutQ(),
+		peers:   make(map[string]*jsPeer),
+		lastNew: time.Now(),
+		streams: make(map[string]map[string]*streamAssignment),
+		qch:     make(chan struct{}),
+	}
+	if err := jsc.loadState(); err != nil {
+		return err
+	}
+	jsc.c = s.createInternalJetStreamClient(sacc)
+	s.startGoRoutine(func() { s.jsInternalSendLoop(jsc.c, jsc.outq) })
+	js.cluster = jsc
+	return nil
+}
+
+// Returns the identifier of this server, created on first use.
+func loadNodeID(dir string) (string, error) {
+	fn := filepath.Join(dir, jsNodeIDFile)
+	if b, err := ioutil.ReadFile(fn); err == nil {
+		if id := strings.TrimSpace(string(b)); id != _EMPTY_ {
+			return id, nil
+		}
+	}
+	id := nuid.Next()
+	if err := ioutil.WriteFile(fn, []byte(id), 0644); err != nil {
+		return _EMPTY_, fmt.Errorf("could not write node id - %v", err)
+	}
+	return id, nil
+}
+
+// Loads the stream assignments.
+func (jsc *jetStreamCluster) loadState() error {
+	b, err := ioutil.ReadFile(filepath.Join(jsc.dir, jsMetaStateFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var sas []*streamAssignment
+	if err := json.Unmarshal(b, &sas); err != nil {
+		return fmt.Errorf("could not read stream assignments - %v", err)
+	}
+	jsc.streams = assignmentsByAccount(sas)
+	return nil
+}
+
+func assignmentsByAccount(sas []*streamAssignment) map[string]map[string]*streamAssignment {
+	streams := make(map[string]map[string]*streamAssignment)
+	for _, sa := range sas {
+		if sa.Group == nil {
+			continue
+		}
+		if streams[sa.Account] == nil {
+			streams[sa.Account] = make(map[string]*streamAssignment)
+		}
+		streams[sa.Account][sa.Config.Name] = sa
+	}
+	return streams
+}
+
+// Returns the stream assignments, sorted. Lock should be held.
+func (jsc *jetStreamCluster) assignments() []*streamAssignment {
+	var sas []*streamAssignment
+	for _, streams := range jsc.streams {
+		for _, sa := range streams {
+			sas = append(sas, sa)
+		}
+	}
+	sort.Slice(sas, func(i, j int) bool {
+		if sas[i].Account != sas[j].Account {
+			return sas[i].Account < sas[j].Account
+		}
+		return sas[i].Config.Name < sas[j].Config.Name
+	})
+	return sas
+}
+
+// Writes the stream assignments. Lock should be held.
+func (jsc *jetStreamCluster) writeState() error {
+	b, err := json.Marshal(jsc.assignments())
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(jsc.dir, jsMetaStateFile+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(jsc.dir, jsMetaStateFile))
+}
+
+// Starts announcing this server. A member of the metadata group rejoins
+// it right away, a new server first looks for the other servers.
+func (jsc *jetStreamCluster) start() error {
+	s := jsc.s
+	sub, err := jsc.subscribe(jsClusterPeerSubj, jsc.processPeerInfo)
+	if err != nil {
+		return err
+	}
+	jsc.mu.Lock()
+	jsc.subs = append(jsc.subs, sub)
+	jsc.mu.Unlock()
+	if _, err := os.Stat(filepath.Join(jsc.dir, jsMetaGroup, raftStateFile)); err == nil {
+		if err := jsc.startMeta(nil, false); err != nil {
+			return err
+		}
+	}
+	jsc.sendPeerInfo()
+	s.startGoRoutine(jsc.monitorCluster)
+	return nil
+}
+
+// Stops the metadata group and the internal client.
+func (jsc *jetStreamCluster) stop() {
+	jsc.mu.Lock()
+	select {
+	case <-jsc.qch:
+		jsc.mu.Unlock()
+		return
+	default:
+		close(jsc.qch)
+	}
+	meta, subs := jsc.meta, jsc.subs
+	jsc.subs = nil
+	jsc.mu.Unlock()
+
+	if meta != nil {
+		meta.Stop()
+	}
+	for _, sub := range subs {
+		jsc.unsubscribe(sub)
+	}
+	jsc.outq.stop()
+	c := jsc.c
+	c.mu.Lock()
+	acc := c.acc
+	c.mu.Unlock()
+	if acc != nil {
+		acc.removeClient(c)
+	}
+}
+
+// Subscribes the internal client, part of the raft transport.
+func (jsc *jetStreamCluster) subscribe(subject string, cb msgHandler) (*subscription, error) {
+	jsc.mu.Lock()
+	jsc.sid++
+	sid := jsc.sid
+	jsc.mu.Unlock()
+	return jsc.c.subscribeInternal(subject, sid, cb)
+}
+
+// Unsubscribes the internal client, part of the raft transport.
+func (jsc *jetStreamCluster) unsubscribe(sub *subscription) {
+	if sub != nil {
+		jsc.c.unsubscribe(jsc.c.acc, sub, true)
+	}
+}
+
+// Sends a message from the internal client, part of the raft transport.
+func (jsc *jetStreamCluster) send(subject, reply string, msg []byte) {
+	jsc.outq.send(&jsPubMsg{subj: subject, reply: reply, msg: msg})
+}
+
+// Sends the request and waits for the response.
+func (jsc *jetStreamCluster) request(subject string, v interface{}, timeout time.Duration) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan []byte, 1)
+	inbox := fmt.Sprintf(jsClusterInboxT, jsc.id, nuid.Next())
+	sub, err := jsc.subscribe(inbox, func(_ *subscription, _, _ string, _, msg []byte) {
+		select {
+		case ch <- append([]byte(nil), msg...):
+		default:
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer jsc.unsubscribe(sub)
+	jsc.send(subject, inbox, b)
+	select {
+	case msg := <-ch:
+		return msg, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("request on %q timed out", subject)
+	case <-jsc.qch:
+		return nil, errRaftClosed
+	}
+}
+
+// Announces this server to the others.
+func (jsc *jetStreamCluster) sendPeerInfo() {
+	jsc.mu.RLock()
+	pi := &jsPeerInfo{ID: jsc.id, Tags: jsc.tags, Meta: jsc.meta != nil}
+	jsc.mu.RUnlock()
+	b, err := json.Marshal(pi)
+	if err != nil {
+		return
+	}
+	jsc.send(jsClusterPeerSubj, _EMPTY_, b)
+}
+
+// Invoked when a server announces itself. New servers are answered
+// right away so they learn about this one, and are added to the
+// metadata group by its leader.
+func (jsc *jetStreamCluster) processPeerInfo(_ *subscription, _, _ string, _, msg []byte) {
+	var pi jsPeerInfo
+	if err := json.Unmarshal(msg, &pi); err != nil || pi.ID == _EMPTY_ || pi.ID == jsc.id {
+		return
+	}
+	now := time.Now()
+	jsc.mu.Lock()
+	p, ok := jsc.peers[pi.ID]
+	if !ok {
+		p = &jsPeer{}
+		jsc.peers[pi.ID] = p
+		jsc.lastNew = now
+	}
+	p.jsPeerInfo, p.last = pi, now
+	jsc.mu.Unlock()
+
+	if !ok {
+		jsc.s.Debugf("JetStream cluster discovered peer %q", pi.ID)
+		jsc.sendPeerInfo()
+	}
+	jsc.addPeers()
+}
+
+// Announces this server, forms the metadata group and adds the new
+// servers to it.
+func (jsc *jetStreamCluster) monitorCluster() {
+	s := jsc.s
+	defer s.grWG.Done()
+
+	t := time.NewTicker(jsClusterAnnounceInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			jsc.sendPeerInfo()
+			jsc.checkMetaGroup()
+			jsc.addPeers()
+		case <-jsc.qch:
+			return
+		case <-s.quitCh:
+			return
+		}
+	}
+}
+
+// Starts the metadata group if not done yet. An existing group is
+// joined, otherwise a new one is formed with the known servers once
+// no new server has shown up for a while.
+func (jsc *jetStreamCluster) checkMetaGroup() {
+	jsc.mu.RLock()
+	if jsc.meta != nil {
+		jsc.mu.RUnlock()
+		return
+	}
+	var peers, members []string
+	for id, p := range jsc.peers {
+		peers = append(peers, id)
+		if p.Meta {
+			members = append(members, id)
+		}
+	}
+	wait := time.Since(jsc.lastNew) < jsClusterBootstrapDelay
+	jsc.mu.RUnlock()
+
+	var err error
+	switch {
+	case len(members) > 0:
+		err = jsc.startMeta(members, true)
+	case !wait:
+		err = jsc.startMeta(peers, false)
+	default:
+		return
+	}
+	if err != nil {
+		jsc.s.Errorf("JetStream cluster failed to start the metadata group: %v", err)
+	}
+}
+
+func (jsc *jetStreamCluster) startMeta(peers []string, join bool) error {
+	n, err := newRaft(raftConfig{
+		Group:       jsMetaGroup,
+		ID:          jsc.id,
+		Peers:       peers,
+		Dir:         filepath.Join(jsc.dir, jsMetaGroup),
+		SyncApplied: true,
+		Join:        join,
+	}, jsc, jsc)
+	if err != nil {
+		return err
+	}
+	jsc.mu.Lock()
+	jsc.meta = n
+	jsc.mu.Unlock()
+	jsc.sendPeerInfo()
+	return nil
+}
+
+// Adds the known servers to the metadata group, on the leader.
+func (jsc *jetStreamCluster) addPeers() {
+	jsc.mu.RLock()
+	meta, leader := jsc.meta, jsc.leader
+	ids := make([]string, 0, len(jsc.peers))
+	for id := range jsc.peers {
+		ids = append(ids, id)
+	}
+	jsc.mu.RUnlock()
+	if meta == nil || !leader {
+		return
+	}
+	members := make(map[string]struct{})
+	for _, p := range meta.Peers() {
+		members[p] = struct{}{}
+	}
+	for _, id := range ids {
+		if _, ok := members[id]; !ok {
+			jsc.s.Debugf("JetStream cluster adding peer %q", id)
+			meta.ProposeAddPeer(id)
+		}
+	}
+}
+
+// Returns true if this server is the leader of the metadata group.
+func (jsc *jetStreamCluster) isLeader() bool {
+	jsc.mu.RLock()
+	defer jsc.mu.RUnlock()
+	return jsc.leader
+}
+
+// Returns the members of the metadata group and whether they are up to
+// date with the leader, or nil if the group is not formed yet.
+func (jsc *jetStreamCluster) metaClusterInfo() *ClusterInfo {
+	jsc.mu.RLock()
+	meta := jsc.meta
+	jsc.mu.RUnlock()
+	if meta == nil {
+		return nil
+	}
+	ci := &ClusterInfo{Name: jsc.s.ClusterName(), Leader: meta.GroupLeader()}
+	for _, p := range meta.Peers() {
+		if p != ci.Leader {
+			ci.Replicas = append(ci.Replicas, &PeerInfo{Name: p, Current: meta.Current(p)})
+		}
+	}
+	return ci
+}
+
+// Returns true if the account level API requests are answered by this
+// server. In clustered mode only the metadata leader answers them.
+func (js *jetStream) isMetaLeader() bool {
+	return js.cluster == nil || js.cluster.isLeader()
+}
+
+// Returns true if this server answers the API requests for the stream.
+// In clustered mode the leader of the stream does, and the metadata
+// leader does for streams that do not exist.
+func (jsa *jsAccount) answersFor(stream string) bool {
+	jsc := jsa.js.cluster
+	if jsc == nil {
+		return true
+	}
+	jsa.mu.RLock()
+	mset := jsa.streams[stream]
+	jsa.mu.RUnlock()
+	if mset != nil {
+		return mset.isLeader()
+	}
+	return jsc.isLeader() && jsc.lookupStream(jsa.account.Name, stream) == nil
+}
+
+func (jsc *jetStreamCluster) lookupStream(account, name string) *streamAssignment {
+	jsc.mu.RLock()
+	defer jsc.mu.RUnlock()
+	return jsc.streams[account][name]
+}
+
+// Returns the assignments of the streams of the account, sorted by name.
+func (jsc *jetStreamCluster) accountStreams(account string) []*streamAssignment {
+	jsc.mu.RLock()
+	sas := make([]*streamAssignment, 0, len(jsc.streams[account]))
+	for _, sa := range jsc.streams[account] {
+		sas = append(sas, sa)
+	}
+	jsc.mu.RUnlock()
+	sort.Slice(sas, func(i, j int) bool { return sas[i].Config.Name < sas[j].Config.Name })
+	return sas
+}
+
+// Returns the information of the stream, from the local member if any.
+func (jsc *jetStreamCluster) streamInfo(sa *streamAssignment) *StreamInfo {
+	if jsa := jsc.s.lookupJSAccount(sa.Account); jsa != nil {
+		jsa.mu.RLock()
+		mset := jsa.streams[sa.Config.Name]
+		jsa.mu.RUnlock()
+		if mset != nil {
+			return mset.Info()
+		}
+	}
+	ci := &ClusterInfo{Name: jsc.s.ClusterName()}
+	for _, p := range sa.Group.Peers {
+		ci.Replicas = append(ci.Replicas, &PeerInfo{Name: p})
+	}
+	return &StreamInfo{Config: sa.Config, Created: sa.Created, Cluster: ci}
+}
+
+// Creates the local members of the streams of the account.
+func (jsc *jetStreamCluster) createAccountStreams(account string) {
+	for _, sa := range jsc.accountStreams(account) {
+		if !sa.Group.isMember(jsc.id) {
+			continue
+		}
+		if err := jsc.createLocalStream(sa); err != nil {
+			jsc.s.Warnf("  Error creating stream %q in account %q: %v", sa.Config.Name, account, err)
+		}
+	}
+}
+
+// Creates the local member of the stream, if not done yet.
+func (jsc *jetStreamCluster) createLocalStream(sa *streamAssignment) error {
+	jsa := jsc.s.lookupJSAccount(sa.Account)
+	if jsa == nil {
+		return ErrJetStreamNotEnabled
+	}
+	jsa.mu.RLock()
+	mset := jsa.streams[sa.Config.Name]
+	jsa.mu.RUnlock()
+	if mset != nil {
+		return nil
+	}
+	cfg := sa.Config
+	mset, err := jsa.addStreamWithGroup(&cfg, sa.Created, sa.Group)
+	if err != nil {
+		return err
+	}
+	mset.recoverConsumers()
+	return nil
+}
+
+// Returns the local member of the stream, if any.
+func (jsc *jetStreamCluster) localStream(sa *streamAssignment) *Stream {
+	jsa := jsc.s.lookupJSAccount(sa.Account)
+	if jsa == nil {
+		return nil
+	}
+	jsa.mu.RLock()
+	defer jsa.mu.RUnlock()
+	return jsa.streams[sa.Config.Name]
+}
+
+// Checks that the subjects of the stream do not overlap with the other
+// streams of the account. Lock should be held.
+func (jsc *jetStreamCluster) checkStreamSubjects(account string, cfg *StreamConfig) error {
+	for name, sa := range jsc.streams[account] {
+		if name == cfg.Name {
+			continue
+		}
+		for _, subj := range cfg.Subjects {
+			for _, other := range sa.Config.Subjects {
+				if subjectsCollide(subj, other) {
+					return fmt.Errorf("subjects overlap with stream %q", name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Selects the servers of a new stream among the members of the
+// metadata group, which are known to be up and have the tags of the
+// placement. The least loaded ones are preferred.
+func (jsc *jetStreamCluster) selectPeers(cfg *StreamConfig, members []string) ([]string, error) {
+	var tags []string
+	if cfg.Placement != nil {
+		tags = cfg.Placement.Tags
+	}
+	jsc.mu.RLock()
+	load := make(map[string]int)
+	for _, streams := range jsc.streams {
+		for _, sa := range streams {
+			for _, p := range sa.Group.Peers {
+				load[p]++
+			}
+		}
+	}
+	var candidates []string
+	for _, id := range members {
+		var ptags []string
+		if id == jsc.id {
+			ptags = jsc.tags
+		} else if p := jsc.peers[id]; p != nil && time.Since(p.last) < jsClusterPeerTimeout {
+			ptags = p.Tags
+		} else {
+			continue
+		}
+		if hasAllTags(ptags, tags) {
+			candidates = append(candidates, id)
+		}
+	}
+	jsc.mu.RUnlock()
+
+	if len(candidates) < cfg.Replicas {
+		return nil, ErrJetStreamInsufficientPeers
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	sort.SliceStable(candidates, func(i, j int) bool { return load[candidates[i]] < load[candidates[j]] })
+	return candidates[:cfg.Replicas], nil
+}
+
+func hasAllTags(have, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if strings.EqualFold(h, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Proposes the operation to the metadata group.
+func (jsc *jetStreamCluster) propose(op *metaOp) error {
+	jsc.mu.RLock()
+	meta := jsc.meta
+	jsc.mu.RUnlock()
+	if meta == nil {
+		return errNotLeader
+	}
+	b, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	return meta.Propose(b)
+}
+
+// Assigns a new stream to servers. The response is sent once assigned.
+func (jsc *jetStreamCluster) createStream(jsa *jsAccount, config *StreamConfig, reply string) {
+	resp := JSApiStreamCreateResponse{ApiResponse: ApiResponse{Type: JSApiStreamCreateResponseType}}
+	jsc.mu.RLock()
+	streams := len(jsc.streams[jsa.account.Name])
+	jsc.mu.RUnlock()
+	err := jsa.checkStreamLimits(config, streams)
+	var sa *streamAssignment
+	if err == nil {
+		sa, err = jsc.newStreamAssignment(jsa.account.Name, config)
+	}
+	if err == nil {
+		err = jsc.propose(&metaOp{Op: assignStreamOp, Stream: sa, Reply: reply})
+	}
+	if err != nil {
+		resp.Error = &ApiError{Code: 500, Description: err.Error()}
+		jsa.sendAPIResponse(reply, &resp)
+	}
+}
+
+func (jsc *jetStreamCluster) newStreamAssignment(account string, config *StreamConfig) (*streamAssignment, error) {
+	cfg, err := checkStreamCfg(config)
+	if err != nil {
+		return nil, err
+	}
+	jsc.mu.RLock()
+	meta := jsc.meta
+	jsc.mu.RUnlock()
+	if meta == nil {
+		return nil, errNotLeader
+	}
+	members := meta.Peers()
+
+	jsc.mu.RLock()
+	if _, ok := jsc.streams[account][cfg.Name]; ok {
+		err = ErrJetStreamStreamExists
+	} else {
+		err = jsc.checkStreamSubjects(account, &cfg)
+	}
+	jsc.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	peers, err := jsc.selectPeers(&cfg, members)
+	if err != nil {
+		return nil, err
+	}
+	return &streamAssignment{
+		Account: account,
+		Config:  cfg,
+		Created: time.Now().UTC(),
+		Group:   &raftGroup{Name: "S-" + nuid.Next(), Peers: peers},
+	}, nil
+}
+
+// Updates the configuration of a stream on all its servers.
+func (jsc *jetStreamCluster) updateStream(jsa *jsAccount, config *StreamConfig, reply string) {
+	resp := JSApiStreamUpdateResponse{ApiResponse: ApiResponse{Type: JSApiStreamUpdateResponseType}}
+	cfg, err := checkStreamCfg(config)
+	if err == nil {
+		err = checkStreamMaxBytes(&cfg, jsa.limits())
+	}
+	if err != nil {
+		resp.Error = &ApiError{Code: 500, Description: err.Error()}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	account := jsa.account.Name
+	jsc.mu.RLock()
+	sa := jsc.streams[account][cfg.Name]
+	if sa != nil {
+		switch old := sa.Config; {
+		case cfg.Storage != old.Storage:
+			err = fmt.Errorf("stream configuration update can not change storage type")
+		case cfg.Retention != old.Retention:
+			err = fmt.Errorf("stream configuration update can not change retention policy")
+		case cfg.Replicas != old.Replicas:
+			err = fmt.Errorf("stream configuration update can not change replicas")
+		default:
+			err = jsc.checkStreamSubjects(account, &cfg)
+		}
+	}
+	jsc.mu.RUnlock()
+	if sa == nil {
+		resp.Error = &ApiError{Code: 404, Description: ErrJetStreamStreamNotFound.Error()}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	if err == nil {
+		nsa := *sa
+		nsa.Config = cfg
+		err = jsc.propose(&metaOp{Op: updateStreamOp, Stream: &nsa, Reply: reply})
+	}
+	if err != nil {
+		resp.Error = &ApiError{Code: 500, Description: err.Error()}
+		jsa.sendAPIResponse(reply, &resp)
+	}
+}
+
+// Removes a stream from all its servers.
+func (jsc *jetStreamCluster) deleteStream(jsa *jsAccount, name, reply string) {
+	resp := JSApiStreamDeleteResponse{ApiResponse: ApiResponse{Type: JSApiStreamDeleteResponseType}}
+	sa := jsc.lookupStream(jsa.account.Name, name)
+	if sa == nil {
+		resp.Error = &ApiError{Code: 404, Description: ErrJetStreamStreamNotFound.Error()}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	if err := jsc.propose(&metaOp{Op: removeStreamOp, Stream: sa, Reply: reply}); err != nil {
+		resp.Error = &ApiError{Code: 500, Description: err.Error()}
+		jsa.sendAPIResponse(reply, &resp)
+	}
+}
+
+// Sends the response of the metadata leader.
+func (jsc *jetStreamCluster) respond(account, reply string, v interface{}) {
+	if reply == _EMPTY_ {
+		return
+	}
+	if jsa := jsc.s.lookupJSAccount(account); jsa != nil {
+		jsa.sendAPIResponse(reply, v)
+	}
+}
+
+// Applies the stream assignments of the metadata group.
+func (jsc *jetStreamCluster) applyEntries(entries []*raftEntry) {
+	for _, e := range entries {
+		var op metaOp
+		if err := json.Unmarshal(e.Data, &op); err != nil || op.Stream == nil || op.Stream.Group == nil {
+			jsc.s.Warnf("JetStream cluster could not decode metadata entry: %v", err)
+			continue
+		}
+		switch op.Op {
+		case assignStreamOp:
+			jsc.applyStreamAssignment(&op)
+		case updateStreamOp:
+			jsc.applyStreamUpdate(&op)
+		case removeStreamOp:
+			jsc.applyStreamRemoval(&op)
+		}
+	}
+	jsc.mu.Lock()
+	err := jsc.writeState()
+	jsc.mu.Unlock()
+	if err != nil {
+		jsc.s.Warnf("JetStream cluster could not write stream assignments: %v", err)
+	}
+}
+
+func (jsc *jetStreamCluster) applyStreamAssignment(op *metaOp) {
+	sa := op.Stream
+	resp := JSApiStreamCreateResponse{ApiResponse: ApiResponse{Type: JSApiStreamCreateResponseType}}
+	jsc.mu.Lock()
+	isLeader := jsc.leader
+	if _, ok := jsc.streams[sa.Account][sa.Config.Name]; ok {
+		jsc.mu.Unlock()
+		if isLeader {
+			resp.Error = &ApiError{Code: 500, Description: ErrJetStreamStreamExists.Error()}
+			jsc.respond(sa.Account, op.Reply, &resp)
+		}
+		return
+	}
+	if jsc.streams[sa.Account] == nil {
+		jsc.streams[sa.Account] = make(map[string]*streamAssignment)
+	}
+	jsc.streams[sa.Account][sa.Config.Name] = sa
+	jsc.mu.Unlock()
+
+	var err error
+	if sa.Group.isMember(jsc.id) {
+		if err = jsc.createLocalStream(sa); err != nil {
+			jsc.s.Warnf("JetStream cluster failed to create stream %q in account %q: %v",
+				sa.Config.Name, sa.Account, err)
+		}
+	}
+	if isLeader {
+		if err != nil {
+			resp.Error = &ApiError{Code: 500, Description: err.Error()}
+		} else {
+			resp.StreamInfo = jsc.streamInfo(sa)
+		}
+		jsc.respond(sa.Account, op.Reply, &resp)
+	}
+}
+
+func (jsc *jetStreamCluster) applyStreamUpdate(op *metaOp) {
+	sa := op.Stream
+	resp := JSApiStreamUpdateResponse{ApiResponse: ApiResponse{Type: JSApiStreamUpdateResponseType}}
+	jsc.mu.Lock()
+	isLeader := jsc.leader
+	osa := jsc.streams[sa.Account][sa.Config.Name]
+	if osa != nil {
+		jsc.streams[sa.Account][sa.Config.Name] = sa
+	}
+	jsc.mu.Unlock()
+
+	var err error
+	if osa == nil {
+		err = ErrJetStreamStreamNotFound
+	} else if mset := jsc.localStream(sa); mset != nil {
+		cfg := sa.Config
+		if err = mset.Update(&cfg); err != nil {
+			jsc.s.Warnf("JetStream cluster failed to update stream %q in account %q: %v",
+				sa.Config.Name, sa.Account, err)
+		}
+	}
+	if isLeader {
+		if err != nil {
+			resp.Error = &ApiError{Code: 500, Description: err.Error()}
+		} else {
+			resp.StreamInfo = jsc.streamInfo(sa)
+		}
+		jsc.respond(sa.Account, op.Reply, &resp)
+	}
+}
+
+func (jsc *jetStreamCluster) applyStreamRemoval(op *metaOp) {
+	sa := op.Stream
+	resp := JSApiStreamDeleteResponse{ApiResponse: ApiResponse{Type: JSApiStreamDeleteResponseType}}
+	jsc.mu.Lock()
+	isLeader := jsc.leader
+	osa := jsc.streams[sa.Account][sa.Config.Name]
+	if osa != nil {
+		delete(jsc.streams[sa.Account], sa.Config.Name)
+	}
+	jsc.mu.Unlock()
+
+	var err error
+	if osa == nil {
+		err = ErrJetStreamStreamNotFound
+	} else if mset := jsc.localStream(sa); mset != nil {
+		err = mset.Delete()
+	}
+	if isLeader {
+		if err != nil {
+			resp.Error = &ApiError{Code: 500, Description: err.Error()}
+		} else {
+			resp.Success = true
+		}
+		jsc.respond(sa.Account, op.Reply, &resp)
+	}
+}
+
+// Snapshot of the metadata group, the stream assignments.
+func (jsc *jetStreamCluster) snapshot() []byte {
+	jsc.mu.RLock()
+	b, _ := json.Marshal(jsc.assignments())
+	jsc.mu.RUnlock()
+	return b
+}
+
+// Replaces the stream assignments with the ones of the leader, creating,
+// updating and removing the local streams accordingly.
+func (jsc *jetStreamCluster) installSnapshot(_ string, data []byte) error {
+	var sas []*streamAssignment
+	if err := json.Unmarshal(data, &sas); err != nil {
+		return err
+	}
+	streams := assignmentsByAccount(sas)
+	jsc.mu.Lock()
+	old := jsc.streams
+	jsc.streams = streams
+	err := jsc.writeState()
+	jsc.mu.Unlock()
+	if err != nil {
+		jsc.s.Warnf("JetStream cluster could not write stream assignments: %v", err)
+	}
+
+	for account, osas := range old {
+		for name, osa := range osas {
+			if sa := streams[account][name]; sa == nil || sa.Group.Name != osa.Group.Name {
+				if mset := jsc.localStream(osa); mset != nil {
+					mset.Delete()
+				}
+			}
+		}
+	}
+	for _, sa := range sas {
+		if !sa.Group.isMember(jsc.id) {
+			continue
+		}
+		if mset := jsc.localStream(sa); mset != nil {
+			if cfg := sa.Config; !reflect.DeepEqual(mset.Config(), cfg) {
+				mset.Update(&cfg)
+			}
+		} else if err := jsc.createLocalStream(sa); err != nil {
+			jsc.s.Warnf("JetStream cluster failed to create stream %q in account %q: %v",
+				sa.Config.Name, sa.Account, err)
+		}
+	}
+	return nil
+}
+
+func (jsc *jetStreamCluster) leaderChanged(isLeader bool) {
+	jsc.mu.Lock()
+	jsc.leader = isLeader
+	jsc.mu.Unlock()
+	if isLeader {
+		jsc.s.Noticef("JetStream cluster new metadata leader")
+		jsc.addPeers()
+	}
+}
+
+// Operations of the group of a stream.
+type streamOpType uint8
+
+const (
+	streamMsgOp streamOpType = iota + 1
+	deleteMsgOp
+	purgeStreamOp
+	addConsumerOp
+	deleteConsumerOp
+	consumerStateOp
+)
+
+// Entry of the group of a stream. The leader responds to the request
+// once the entry is applied.
+type streamOp struct {
+	Op       streamOpType        `json:"op"`
+	Subject  string              `json:"subj,omitempty"`
+	Hdr      []byte              `json:"hdr,omitempty"`
+	Data     []byte              `json:"data,omitempty"`
+	Seq      uint64              `json:"seq,omitempty"`
+	Time     int64               `json:"ts,omitempty"`
+	Reply    string              `json:"reply,omitempty"`
+	Consumer *consumerAssignment `json:"consumer,omitempty"`
+}
+
+// A consumer of a replicated stream.
+type consumerAssignment struct {
+	Name    string          `json:"name"`
+	Config  *ConsumerConfig `json:"config,omitempty"`
+	Created time.Time       `json:"created"`
+	State   *ConsumerState  `json:"state,omitempty"`
+}
+
+// Snapshot of the group of a stream. The messages are fetched from the
+// leader by the followers.
+type streamSnapshot struct {
+	FirstSeq  uint64                `json:"first_seq"`
+	LastSeq   uint64                `json:"last_seq"`
+	Consumers []*consumerAssignment `json:"consumers,omitempty"`
+}
+
+type streamCatchupRequest struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+// The messages from the requested sequence, up to the last sequence
+// covered, which includes the deleted messages.
+type streamCatchupResponse struct {
+	Msgs  []*StoredMsg `json:"msgs,omitempty"`
+	Last  uint64       `json:"last"`
+	Error string       `json:"error,omitempty"`
+}
+
+// Starts the member of the group of the stream.
+func (mset *Stream) startGroup(rg *raftGroup) error {
+	jsc := mset.jsa.js.cluster
+	if jsc == nil {
+		return fmt.Errorf("replicas > 1 not supported in non-clustered mode")
+	}
+	sub, err := jsc.subscribe(fmt.Sprintf(jsClusterCatchupSubjT, rg.Name, jsc.id), mset.processCatchupRequest)
+	if err != nil {
+		return err
+	}
+	mset.mu.Lock()
+	mset.group, mset.cusub = rg, sub
+	mset.mu.Unlock()
+	node, err := newRaft(raftConfig{
+		Group:    rg.Name,
+		ID:       jsc.id,
+		Peers:    rg.Peers,
+		Dir:      filepath.Join(jsc.dir, jsGroupsDir, rg.Name),
+		Volatile: mset.config.Storage == MemoryStorage,
+	}, mset, jsc)
+	if err != nil {
+		return err
+	}
+	mset.mu.Lock()
+	mset.node = node
+	mset.mu.Unlock()
+	return nil
+}
+
+// Returns true if the stream is replicated.
+func (mset *Stream) isClustered() bool {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return mset.node != nil
+}
+
+// Returns true if this server processes the messages and requests of
+// the stream, which for replicated streams is the leader.
+func (mset *Stream) isLeader() bool {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return mset.node == nil || mset.leader
+}
+
+// Returns the members of the group of a replicated stream.
+func (mset *Stream) clusterInfo() *ClusterInfo {
+	mset.mu.RLock()
+	node := mset.node
+	mset.mu.RUnlock()
+	if node == nil {
+		return nil
+	}
+	ci := &ClusterInfo{Name: mset.jsa.js.srv.ClusterName(), Leader: node.GroupLeader()}
+	for _, p := range node.Peers() {
+		if p != ci.Leader {
+			ci.Replicas = append(ci.Replicas, &PeerInfo{Name: p, Current: node.Current(p)})
+		}
+	}
+	return ci
+}
+
+// Proposes the operation to the group of the stream.
+func (mset *Stream) propose(op *streamOp) error {
+	mset.mu.RLock()
+	node := mset.node
+	mset.mu.RUnlock()
+	if node == nil {
+		return errNotLeader
+	}
+	b, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	return node.Propose(b)
+}
+
+// Proposes a published message with the next sequence, which is
+// returned.
+func (mset *Stream) proposeMsg(subj, reply string, hdr, msg []byte) (uint64, error) {
+	mset.clMu.Lock()
+	defer mset.clMu.Unlock()
+	seq := mset.clseq + 1
+	op := &streamOp{Op: streamMsgOp, Subject: subj, Reply: reply, Hdr: hdr, Data: msg, Seq: seq, Time: time.Now().UnixNano()}
+	if err := mset.propose(op); err != nil {
+		return 0, err
+	}
+	mset.clseq = seq
+	return seq, nil
+}
+
+// Proposes to purge the messages proposed so far.
+func (mset *Stream) proposePurge(reply string) error {
+	mset.clMu.Lock()
+	defer mset.clMu.Unlock()
+	return mset.propose(&streamOp{Op: purgeStreamOp, Seq: mset.clseq, Reply: reply})
+}
+
+// Proposes a new consumer. Returns the consumer if a durable with the
+// same configuration exists, in which case nothing is proposed.
+func (mset *Stream) proposeAddConsumer(config *ConsumerConfig, reply string) (*Consumer, error) {
+	mset.mu.RLock()
+	cfg, err := mset.checkConsumerCfg(config)
+	if err != nil {
+		mset.mu.RUnlock()
+		return nil, err
+	}
+	if o := mset.consumers[cfg.Durable]; cfg.Durable != _EMPTY_ && o != nil {
+		mset.mu.RUnlock()
+		if o.Config() == cfg {
+			return o, nil
+		}
+		return nil, ErrJetStreamConsumerExists
+	}
+	if mset.config.MaxConsumers > 0 && len(mset.consumers) >= mset.config.MaxConsumers {
+		mset.mu.RUnlock()
+		return nil, ErrJetStreamMaxConsumers
+	}
+	mset.mu.RUnlock()
+	name := cfg.Durable
+	if name == _EMPTY_ {
+		name = nuid.Next()
+	}
+	ca := &consumerAssignment{Name: name, Config: &cfg, Created: time.Now().UTC()}
+	return nil, mset.propose(&streamOp{Op: addConsumerOp, Consumer: ca, Reply: reply})
+}
+
+// Proposes to delete the consumer.
+func (mset *Stream) proposeConsumerDelete(name, reply string) error {
+	return mset.propose(&streamOp{Op: deleteConsumerOp, Consumer: &consumerAssignment{Name: name}, Reply: reply})
+}
+
+// Sends the response of the leader, if any.
+func (mset *Stream) respond(reply string, v interface{}) {
+	mset.mu.RLock()
+	isLeader, jsa := mset.leader, mset.jsa
+	mset.mu.RUnlock()
+	if isLeader {
+		jsa.sendAPIResponse(reply, v)
+	}
+}
+
+// Applies the operations of the group to the stream.
+func (mset *Stream) applyEntries(entries []*raftEntry) {
+	for _, e := range entries {
+		var op streamOp
+		if err := json.Unmarshal(e.Data, &op); err != nil {
+			mset.jsa.js.srv.Warnf("JetStream could not decode entry of stream %q: %v", mset.Name(), err)
+			continue
+		}
+		switch op.Op {
+		case streamMsgOp:
+			mset.applyMsg(&op)
+		case deleteMsgOp:
+			mset.applyDeleteMsg(&op)
+		case purgeStreamOp:
+			mset.applyPurge(&op)
+		case addConsumerOp:
+			mset.applyAddConsumer(&op)
+		case deleteConsumerOp:
+			mset.applyDeleteConsumer(&op)
+		case consumerStateOp:
+			if op.Consumer != nil && op.Consumer.State != nil {
+				if o := mset.LookupConsumer(op.Consumer.Name); o != nil {
+					o.applyState(op.Consumer.State)
+				}
+			}
+		}
+	}
+}
+
+// Stores a message with the sequence given by the leader. Messages are
+// stored once, they may be applied again after a restart.
+func (mset *Stream) applyMsg(op *streamOp) {
+	mset.mu.RLock()
+	if mset.closed {
+		mset.mu.RUnlock()
+		return
+	}
+	jsa, store, cfg, isLeader, rpub := mset.jsa, mset.store, mset.config, mset.leader, mset.rpub
+	interest := cfg.Retention != InterestPolicy || mset.checkInterest(op.Subject)
+	consumers := mset.getConsumers()
+	mset.mu.RUnlock()
+
+	// The ids are tracked by every replica, in case it becomes the leader.
+	// A message whose id was applied within the window, e.g. published
+	// again before the first one was applied, only uses its sequence, the
+	// same way on all replicas.
+	id := getMsgId(op.Hdr)
+	var dup *ddentry
+	if id != _EMPTY_ {
+		mset.ddMu.Lock()
+		if dde := mset.ddmap[id]; dde != nil && dde.seq != op.Seq && op.Time-dde.ts < int64(cfg.Duplicates) {
+			dup = dde
+		}
+		mset.ddMu.Unlock()
+	}
+	var err error
+	if dup != nil {
+		err = store.SkipMsg(op.Seq)
+	} else {
+		err = store.StoreRawMsg(op.Subject, op.Hdr, op.Data, op.Seq, op.Time)
+	}
+	switch {
+	case err == nil && dup != nil:
+	case err == nil:
+		if id != _EMPTY_ {
+			mset.ddMu.Lock()
+			mset.storeMsgId(&ddentry{id, op.Seq, op.Time})
+			mset.ddMu.Unlock()
+		}
+		// With the interest policy, messages without consumers are not kept.
+		if !interest {
+			store.RemoveMsg(op.Seq)
+		} else if ttl, _ := getMsgTTL(op.Hdr); ttl > 0 {
+			mset.trackMsgTTL(op.Seq, op.Time+int64(ttl))
+		}
+		// Only the leader republishes.
+		if isLeader {
+			jsa.republish(rpub, &cfg, op.Subject, op.Hdr, op.Data, op.Seq, op.Time)
+		}
+	case err == ErrStoreSeqOutOfOrder:
+		err = nil
+	case err == ErrStoreClosed:
+	default:
+		jsa.js.srv.Warnf("JetStream failed to store a msg on account %q stream %q: %v",
+			jsa.account.Name, cfg.Name, err)
+	}
+	for _, o := range consumers {
+		o.signal()
+	}
+	if !isLeader || op.Reply == _EMPTY_ || cfg.NoAck {
+		return
+	}
+	var resp JSPubAckResponse
+	if err != nil {
+		resp.Error = &ApiError{Code: 503, Description: err.Error()}
+	} else if dup != nil {
+		resp.PubAck = &PubAck{Stream: cfg.Name, Seq: dup.seq, Duplicate: true}
+	} else {
+		resp.PubAck = &PubAck{Stream: cfg.Name, Seq: op.Seq}
+	}
+	b, _ := json.Marshal(&resp)
+	jsa.outq.send(&jsPubMsg{subj: op.Reply, msg: b})
+}
+
+func (mset *Stream) applyDeleteMsg(op *streamOp) {
+	resp := JSApiMsgDeleteResponse{ApiResponse: ApiResponse{Type: JSApiMsgDeleteResponseType}}
+	removed, err := mset.RemoveMsg(op.Seq)
+	if op.Reply == _EMPTY_ {
+		return
+	}
+	if err != nil {
+		resp.Error = &ApiError{Code: 500, Description: err.Error()}
+	} else if !removed {
+		resp.Error = &ApiError{Code: 404, Description: ErrStoreMsgNotFound.Error()}
+	} else {
+		resp.Success = true
+	}
+	mset.respond(op.Reply, &resp)
+}
+
+// Purges the messages up to the sequence of the operation, which was
+// the last one proposed.
+func (mset *Stream) applyPurge(op *streamOp) {
+	resp := JSApiStreamPurgeResponse{ApiResponse: ApiResponse{Type: JSApiStreamPurgeResponseType}}
+	mset.mu.RLock()
+	store := mset.store
+	consumers := mset.getConsumers()
+	mset.mu.RUnlock()
+	purged, err := store.Compact(op.Seq + 1)
+	if err == nil {
+		firstSeq := store.State().FirstSeq
+		for _, o := range consumers {
+			o.purge(firstSeq)
+		}
+	}
+	if op.Reply == _EMPTY_ {
+		return
+	}
+	if err != nil {
+		resp.Error = &ApiError{Code: 500, Description: err.Error()}
+	} else {
+		resp.Success, resp.Purged = true, purged
+	}
+	mset.respond(op.Reply, &resp)
+}
+
+func (mset *Stream) applyAddConsumer(op *streamOp) {
+	resp := JSApiConsumerCreateResponse{ApiResponse: ApiResponse{Type: JSApiConsumerCreateResponseType}}
+	ca := op.Consumer
+	if ca == nil || ca.Config == nil {
+		return
+	}
+	o := mset.LookupConsumer(ca.Name)
+	var err error
+	if o == nil {
+		cfg := *ca.Config
+		o, err = mset.addConsumer(&cfg, ca.Name, ca.Created)
+	}
+	if op.Reply == _EMPTY_ {
+		return
+	}
+	if err != nil {
+		resp.Error = &ApiError{Code: 500, Description: err.Error()}
+	} else {
+		resp.ConsumerInfo = o.Info()
+	}
+	mset.respond(op.Reply, &resp)
+}
+
+func (mset *Stream) applyDeleteConsumer(op *streamOp) {
+	resp := JSApiConsumerDeleteResponse{ApiResponse: ApiResponse{Type: JSApiConsumerDeleteResponseType}}
+	if op.Consumer == nil {
+		return
+	}
+	o := mset.LookupConsumer(op.Consumer.Name)
+	if o == nil {
+		resp.Error = &ApiError{Code: 404, Description: ErrJetStreamConsumerNotFound.Error()}
+	} else if err := o.Delete(); err != nil {
+		resp.Error = &ApiError{Code: 500, Description: err.Error()}
+	} else {
+		resp.Success = true
+	}
+	mset.respond(op.Reply, &resp)
+}
+
+// Invoked when this server becomes or stops being the leader of the
+// stream. Only the leader processes the published messages and
+// delivers to the consumers.
+func (mset *Stream) leaderChanged(isLeader bool) {
+	mset.mu.RLock()
+	store, closed := mset.store, mset.closed
+	mset.mu.RUnlock()
+	if closed {
+		return
+	}
+	if isLeader {
+		// All entries of previous leaders have been applied.
+		mset.clMu.Lock()
+		mset.clseq = store.State().LastSeq
+		mset.clMu.Unlock()
+	}
+	mset.mu.Lock()
+	if mset.closed {
+		mset.mu.Unlock()
+		return
+	}
+	mset.leader = isLeader
+	if mset.lqch != nil {
+		close(mset.lqch)
+		mset.lqch = nil
+	}
+	var lqch chan struct{}
+	if isLeader {
+		mset.lqch = make(chan struct{})
+		lqch = mset.lqch
+	}
+	consumers := mset.getConsumers()
+	name, s := mset.config.Name, mset.jsa.js.srv
+	mset.mu.Unlock()
+
+	for _, o := range consumers {
+		if err := o.setLeader(isLeader); err != nil {
+			s.Warnf("JetStream failed to activate consumer %q of stream %q: %v", o.name, name, err)
+		}
+	}
+	if isLeader {
+		s.Debugf("JetStream stream %q in account %q is led by this server", name, mset.jsa.account.Name)
+		s.startGoRoutine(func() { mset.replicateConsumerStates(lqch) })
+		mset.startSources(lqch)
+	}
+}
+
+// Replicates the state of the consumers that changed, on the leader.
+func (mset *Stream) replicateConsumerStates(lqch chan struct{}) {
+	s := mset.jsa.js.srv
+	defer s.grWG.Done()
+
+	t := time.NewTicker(jsClusterConsumerStateInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			for _, o := range mset.Consumers() {
+				if state := o.stateChanged(); state != nil {
+					ca := &consumerAssignment{Name: o.name, State: state}
+					mset.propose(&streamOp{Op: consumerStateOp, Consumer: ca})
+				}
+			}
+		case <-lqch:
+			return
+		case <-s.quitCh:
+			return
+		}
+	}
+}
+
+// Snapshot of the stream, its range of messages and its consumers.
+func (mset *Stream) snapshot() []byte {
+	mset.mu.RLock()
+	store := mset.store
+	mset.mu.RUnlock()
+	state := store.State()
+	snap := &streamSnapshot{FirstSeq: state.FirstSeq, LastSeq: state.LastSeq}
+	for _, o := range mset.Consumers() {
+		o.mu.Lock()
+		cfg := o.cfg
+		snap.Consumers = append(snap.Consumers, &consumerAssignment{
+			Name:    o.name,
+			Config:  &cfg,
+			Created: o.created,
+			State:   o.currentState().copy(),
+		})
+		o.mu.Unlock()
+	}
+	b, _ := json.Marshal(snap)
+	return b
+}
+
+// Brings the stream up to the snapshot of the leader. The messages are
+// fetched from the leader and the consumers are replaced.
+func (mset *Stream) installSnapshot(leader string, data []byte) error {
+	var snap streamSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	mset.mu.RLock()
+	store, closed := mset.store, mset.closed
+	mset.mu.RUnlock()
+	if closed {
+		return ErrStoreClosed
+	}
+	if _, err := store.Compact(snap.FirstSeq); err != nil {
+		return err
+	}
+	if err := mset.catchup(leader, snap.LastSeq); err != nil {
+		return err
+	}
+	mset.syncConsumers(snap.Consumers)
+	return nil
+}
+
+// Fetches the messages after the last one stored, up to the sequence.
+func (mset *Stream) catchup(leader string, last uint64) error {
+	mset.mu.RLock()
+	store, rg := mset.store, mset.group
+	mset.mu.RUnlock()
+	jsc := mset.jsa.js.cluster
+	subj := fmt.Sprintf(jsClusterCatchupSubjT, rg.Name, leader)
+	for {
+		state := store.State()
+		if state.LastSeq >= last {
+			return nil
+		}
+		req := &streamCatchupRequest{From: state.LastSeq + 1, To: last}
+		msg, err := jsc.request(subj, req, jsClusterCatchupTimeout)
+		if err != nil {
+			return err
+		}
+		var resp streamCatchupResponse
+		if err := json.Unmarshal(msg, &resp); err != nil {
+			return err
+		}
+		if resp.Error != _EMPTY_ {
+			return errors.New(resp.Error)
+		}
+		if resp.Last < req.From {
+			return fmt.Errorf("catchup of stream %q made no progress", mset.Name())
+		}
+		for _, sm := range resp.Msgs {
+			ts := sm.Time.UnixNano()
+			err := store.StoreRawMsg(sm.Subject, sm.Header, sm.Data, sm.Sequence, ts)
+			if err != nil && err != ErrStoreSeqOutOfOrder {
+				return err
+			}
+			if id := getMsgId(sm.Header); err == nil && id != _EMPTY_ {
+				mset.ddMu.Lock()
+				mset.storeMsgId(&ddentry{id, sm.Sequence, ts})
+				mset.ddMu.Unlock()
+			}
+		}
+		// The last messages may have been deleted.
+		if store.State().LastSeq < resp.Last {
+			if err := store.SkipMsg(resp.Last); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Serves the messages that a follower is missing.
+func (mset *Stream) processCatchupRequest(_ *subscription, _, reply string, _, msg []byte) {
+	var req streamCatchupRequest
+	if reply == _EMPTY_ || json.Unmarshal(msg, &req) != nil {
+		return
+	}
+	mset.mu.RLock()
+	store := mset.store
+	mset.mu.RUnlock()
+	state := store.State()
+	resp := &streamCatchupResponse{}
+	to := req.To
+	if to > state.LastSeq {
+		to = state.LastSeq
+	}
+	seq := req.From
+	if seq < state.FirstSeq {
+		seq = state.FirstSeq
+		resp.Last = seq - 1
+	}
+	for size := 0; seq <= to; seq++ {
+		sm, err := store.LoadMsg(seq)
+		if err == ErrStoreMsgNotFound {
+			resp.Last = seq
+			continue
+		}
+		if err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		if size += len(sm.Subject) + len(sm.Header) + len(sm.Data); size > jsClusterCatchupBatchSize && len(resp.Msgs) > 0 {
+			break
+		}
+		resp.Msgs = append(resp.Msgs, sm)
+		resp.Last = seq
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+	mset.jsa.js.cluster.send(reply, _EMPTY_, b)
+}
+
+// Replaces the consumers with the ones of the leader.
+func (mset *Stream) syncConsumers(cas []*consumerAssignment) {
+	s := mset.jsa.js.srv
+	keep := make(map[string]struct{}, len(cas))
+	for _, ca := range cas {
+		keep[ca.Name] = struct{}{}
+		o := mset.LookupConsumer(ca.Name)
+		if o == nil && ca.Config != nil {
+			cfg := *ca.Config
+			var err error
+			if o, err = mset.addConsumer(&cfg, ca.Name, ca.Created); err != nil {
+				s.Warnf("JetStream failed to create consumer %q of stream %q: %v", ca.Name, mset.Name(), err)
+				continue
+			}
+		}
+		if o != nil && ca.State != nil {
+			o.applyState(ca.State)
+		}
+	}
+	for _, o := range mset.Consumers() {
+		if _, ok := keep[o.name]; !ok {
+			o.Delete()
+		}
+	}
+}
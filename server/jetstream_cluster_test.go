@@ -0,0 +1,503 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type jsTestCluster struct {
+	t       *testing.T
+	servers []*Server
+	confs   []string
+	dirs    []string
+}
+
+// Runs a cluster of JetStream servers, each with the given tags. The
+// cluster ports are fixed so that servers can be restarted.
+func createJetStreamCluster(t *testing.T, tags ...string) *jsTestCluster {
+	t.Helper()
+	ports := make([]int, len(tags))
+	for i := range ports {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Error getting a port: %v", err)
+		}
+		ports[i] = l.Addr().(*net.TCPAddr).Port
+		l.Close()
+	}
+	var routes []string
+	for _, port := range ports {
+		routes = append(routes, fmt.Sprintf("nats-route://127.0.0.1:%d", port))
+	}
+	c := &jsTestCluster{t: t}
+	for i, tag := range tags {
+		dir, _ := ioutil.TempDir("", "js")
+		conf := createConfFile(t, []byte(fmt.Sprintf(`
+			listen: "127.0.0.1:-1"
+			server_tags: %q
+			jetstream { store_dir: %q }
+			accounts {
+				SYS { users [{user: sys, password: pwd}] }
+				JS { users [{user: js, password: pwd}] }
+			}
+			system_account: SYS
+			cluster {
+				listen: "127.0.0.1:%d"
+				routes [%s]
+			}
+		`, tag, dir, ports[i], strings.Join(routes, ", "))))
+		c.dirs = append(c.dirs, dir)
+		c.confs = append(c.confs, conf)
+		s, _ := RunServerWithConfig(conf)
+		c.servers = append(c.servers, s)
+	}
+	checkClusterFormed(t, c.servers...)
+	c.waitOnMetaLeader()
+	return c
+}
+
+func (c *jsTestCluster) shutdown() {
+	for _, s := range c.servers {
+		s.Shutdown()
+	}
+	for i := range c.confs {
+		os.Remove(c.confs[i])
+		os.RemoveAll(c.dirs[i])
+	}
+}
+
+func (c *jsTestCluster) restart(i int) {
+	c.t.Helper()
+	c.servers[i], _ = RunServerWithConfig(c.confs[i])
+	checkClusterFormed(c.t, c.servers...)
+}
+
+func (c *jsTestCluster) clientURL(s *Server) string {
+	opts := s.getOpts()
+	return fmt.Sprintf("nats://js:pwd@%s:%d", opts.Host, opts.Port)
+}
+
+func (c *jsTestCluster) nodeID(s *Server) string {
+	return s.getJetStream().cluster.id
+}
+
+// Waits for a metadata leader, with all the servers in the group.
+func (c *jsTestCluster) waitOnMetaLeader() {
+	c.t.Helper()
+	checkFor(c.t, 15*time.Second, 100*time.Millisecond, func() error {
+		leaders := 0
+		for _, s := range c.servers {
+			jsc := s.getJetStream().cluster
+			jsc.mu.RLock()
+			meta := jsc.meta
+			jsc.mu.RUnlock()
+			if meta == nil || len(meta.Peers()) != len(c.servers) {
+				return fmt.Errorf("server %q not in the metadata group", jsc.id)
+			}
+			if jsc.isLeader() {
+				leaders++
+			}
+		}
+		if leaders != 1 {
+			return fmt.Errorf("expected one metadata leader, got %d", leaders)
+		}
+		return nil
+	})
+}
+
+// Returns the local member of the stream, or nil.
+func (c *jsTestCluster) stream(s *Server, name string) *Stream {
+	if !s.isRunning() {
+		return nil
+	}
+	acc, err := s.LookupAccount("JS")
+	if err != nil {
+		return nil
+	}
+	mset, _ := acc.LookupStream(name)
+	return mset
+}
+
+// Waits for the leader of the stream and returns its server.
+func (c *jsTestCluster) waitOnStreamLeader(name string) *Server {
+	c.t.Helper()
+	var leader *Server
+	checkFor(c.t, 10*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			if mset := c.stream(s, name); mset != nil && mset.isClustered() && mset.isLeader() {
+				leader = s
+				return nil
+			}
+		}
+		return fmt.Errorf("no leader for stream %q", name)
+	})
+	return leader
+}
+
+// Waits for the running members of the stream to hold the messages.
+func (c *jsTestCluster) checkMsgs(name string, msgs uint64, members int) {
+	c.t.Helper()
+	checkFor(c.t, 10*time.Second, 100*time.Millisecond, func() error {
+		found := 0
+		for _, s := range c.servers {
+			mset := c.stream(s, name)
+			if mset == nil {
+				continue
+			}
+			found++
+			if state := mset.State(); state.Msgs != msgs {
+				return fmt.Errorf("expected %d msgs on %q, got %d", msgs, c.nodeID(s), state.Msgs)
+			}
+		}
+		if found != members {
+			return fmt.Errorf("expected %d members, got %d", members, found)
+		}
+		return nil
+	})
+}
+
+func TestJetStreamClusterReplicatedStream(t *testing.T) {
+	c := createJetStreamCluster(t, "a", "b", "c")
+	defer c.shutdown()
+
+	s := c.servers[0]
+	nc := natsConnect(t, c.clientURL(s))
+	defer nc.Close()
+
+	info := jsCreateStream(t, nc, &StreamConfig{Name: "S", Storage: FileStorage, Replicas: 3})
+	if info.Config.Replicas != 3 || info.Cluster == nil || len(info.Cluster.Replicas)+1 < 3 {
+		t.Fatalf("Unexpected stream info: %+v", info)
+	}
+	var resp JSApiStreamCreateResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiStreamCreateT, "S"), &StreamConfig{Name: "S", Replicas: 3}, &resp)
+	if resp.Error == nil {
+		t.Fatalf("Expected error creating the stream again")
+	}
+
+	leader := c.waitOnStreamLeader("S")
+	for i := 0; i < 10; i++ {
+		if ack := jsPublish(t, nc, "S", "hello"); ack.Error != nil || ack.Seq != uint64(i+1) {
+			t.Fatalf("Unexpected ack: %+v", ack)
+		}
+	}
+	c.checkMsgs("S", 10, 3)
+
+	var sinfo JSApiStreamInfoResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiStreamInfoT, "S"), nil, &sinfo)
+	if sinfo.Error != nil || sinfo.Cluster == nil || sinfo.Cluster.Leader != c.nodeID(leader) || len(sinfo.Cluster.Replicas) != 2 {
+		t.Fatalf("Unexpected stream info: %+v", sinfo)
+	}
+
+	// The state of the consumer is replicated to the followers.
+	jsCreateConsumer(t, nc, "S", &ConsumerConfig{Durable: "D", AckPolicy: AckExplicit})
+	for i := 1; i <= 5; i++ {
+		m := jsNextMsg(t, nc, "S", "D")
+		nc.Publish(m.Reply, nil)
+	}
+	natsFlush(t, nc)
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			o := c.stream(s, "S").LookupConsumer("D")
+			if o == nil {
+				return fmt.Errorf("consumer missing on %q", c.nodeID(s))
+			}
+			if state, _ := o.store.State(); state.AckFloor.Stream != 5 {
+				return fmt.Errorf("unexpected consumer state on %q: %+v", c.nodeID(s), state)
+			}
+		}
+		return nil
+	})
+
+	// Fail over to another server, no message is lost.
+	li := 0
+	for i, s := range c.servers {
+		if s == leader {
+			li = i
+		}
+	}
+	leader.Shutdown()
+	nleader := c.waitOnStreamLeader("S")
+	if nleader == leader {
+		t.Fatalf("Expected a new leader")
+	}
+	nc2 := natsConnect(t, c.clientURL(nleader))
+	defer nc2.Close()
+	for i := 0; i < 10; i++ {
+		if ack := jsPublish(t, nc2, "S", "hello"); ack.Error != nil || ack.Seq != uint64(i+11) {
+			t.Fatalf("Unexpected ack: %+v", ack)
+		}
+	}
+	c.checkMsgs("S", 20, 2)
+	m := jsNextMsg(t, nc2, "S", "D")
+	if tokens := strings.Split(m.Reply, tsep); len(tokens) < 6 || tokens[5] != "6" {
+		t.Fatalf("Expected stream sequence 6, got reply %q", m.Reply)
+	}
+
+	// The restarted server catches up.
+	c.restart(li)
+	c.checkMsgs("S", 20, 3)
+	sm, err := c.stream(c.servers[li], "S").GetMsg(20)
+	if err != nil || string(sm.Data) != "\"hello\"" {
+		t.Fatalf("Unexpected message: %+v - %v", sm, err)
+	}
+
+	// Streams are removed from all servers.
+	var dresp JSApiStreamDeleteResponse
+	jsRequest(t, nc2, fmt.Sprintf(JSApiStreamDeleteT, "S"), nil, &dresp)
+	if dresp.Error != nil || !dresp.Success {
+		t.Fatalf("Unexpected response: %+v", dresp)
+	}
+	c.checkMsgs("S", 0, 0)
+}
+
+func TestJetStreamClusterMsgIdDuplicates(t *testing.T) {
+	c := createJetStreamCluster(t, "a", "b", "c")
+	defer c.shutdown()
+
+	nc := natsConnect(t, c.clientURL(c.servers[0]))
+	defer nc.Close()
+	jsCreateStream(t, nc, &StreamConfig{Name: "DD", Storage: FileStorage, Replicas: 3, Duplicates: time.Minute})
+	leader := c.waitOnStreamLeader("DD")
+
+	hc := newJSHdrConn(t, c.clientURL(c.servers[0]))
+	defer func() { hc.close() }()
+	hdrWithId := func(id string) string {
+		return fmt.Sprintf("NATS/1.0\r\n%s: %s\r\n\r\n", JSMsgId, id)
+	}
+	publish := func(id string) *PubAck {
+		t.Helper()
+		data := hc.request("DD", hdrWithId(id), []byte("hello"))
+		var resp JSPubAckResponse
+		if err := json.Unmarshal(data, &resp); err != nil || resp.Error != nil {
+			t.Fatalf("Unexpected response %q: %v", data, err)
+		}
+		return resp.PubAck
+	}
+	if ack := publish("1"); ack.Seq != 1 || ack.Duplicate {
+		t.Fatalf("Unexpected ack: %+v", ack)
+	}
+
+	// Duplicates published before the first one is applied are only
+	// stored once.
+	inbox := nats.NewInbox()
+	hc.subscribe(inbox)
+	for i := 0; i < 2; i++ {
+		hc.publish("DD", inbox, hdrWithId("2"), []byte("hello"))
+	}
+	var seqs []uint64
+	dups := 0
+	for i := 0; i < 2; i++ {
+		var resp JSPubAckResponse
+		if err := json.Unmarshal(hc.nextMsg(5*time.Second).data, &resp); err != nil || resp.Error != nil {
+			t.Fatalf("Unexpected response %+v: %v", resp, err)
+		}
+		seqs = append(seqs, resp.Seq)
+		if resp.Duplicate {
+			dups++
+		}
+	}
+	if dups != 1 || seqs[0] != 2 || seqs[1] != 2 {
+		t.Fatalf("Expected one duplicate of sequence 2, got %v with %d duplicates", seqs, dups)
+	}
+	c.checkMsgs("DD", 2, 3)
+
+	// The new leader knows the ids within the window.
+	if leader == c.servers[0] {
+		hc.close()
+		hc = newJSHdrConn(t, c.clientURL(c.servers[1]))
+	}
+	leader.Shutdown()
+	if nleader := c.waitOnStreamLeader("DD"); nleader == leader {
+		t.Fatalf("Expected a new leader")
+	}
+	for id, seq := range map[string]uint64{"1": 1, "2": 2} {
+		if ack := publish(id); ack.Seq != seq || !ack.Duplicate {
+			t.Fatalf("Expected a duplicate ack for sequence %d, got %+v", seq, ack)
+		}
+	}
+	ack := publish("3")
+	if ack.Duplicate {
+		t.Fatalf("Unexpected ack: %+v", ack)
+	}
+	c.checkMsgs("DD", 3, 2)
+
+	// A duplicate entry of the log only uses its sequence on every member.
+	op := &streamOp{Op: streamMsgOp, Subject: "DD", Hdr: []byte(hdrWithId("3")), Data: []byte("hello"), Seq: ack.Seq + 1, Time: time.Now().UnixNano()}
+	for _, s := range c.servers {
+		if mset := c.stream(s, "DD"); mset != nil {
+			mset.applyMsg(op)
+			if state := mset.State(); state.Msgs != 3 || state.LastSeq != op.Seq {
+				t.Fatalf("Unexpected state on %q: %+v", c.nodeID(s), state)
+			}
+		}
+	}
+}
+
+func TestJetStreamClusterPlacement(t *testing.T) {
+	c := createJetStreamCluster(t, "ssd", "ssd", "hdd")
+	defer c.shutdown()
+
+	nc := natsConnect(t, c.clientURL(c.servers[0]))
+	defer nc.Close()
+
+	members := func(name string) []string {
+		var ids []string
+		for _, s := range c.servers {
+			if c.stream(s, name) != nil {
+				ids = append(ids, c.nodeID(s))
+			}
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	expected := func(servers ...*Server) []string {
+		var ids []string
+		for _, s := range servers {
+			ids = append(ids, c.nodeID(s))
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	// Followers create the stream once they apply the assignment.
+	checkMembers := func(name string, servers ...*Server) {
+		t.Helper()
+		checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+			if ids, exp := members(name), expected(servers...); fmt.Sprint(ids) != fmt.Sprint(exp) {
+				return fmt.Errorf("expected stream on %v, got %v", exp, ids)
+			}
+			return nil
+		})
+	}
+
+	jsCreateStream(t, nc, &StreamConfig{Name: "FAST", Replicas: 2, Placement: &Placement{Tags: []string{"ssd"}}})
+	checkMembers("FAST", c.servers[0], c.servers[1])
+	jsCreateStream(t, nc, &StreamConfig{Name: "SLOW", Placement: &Placement{Tags: []string{"hdd"}}})
+	checkMembers("SLOW", c.servers[2])
+	c.waitOnStreamLeader("SLOW")
+	// The interest of the stream has to reach this server first.
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		acc, _ := c.servers[0].LookupAccount("JS")
+		if r := acc.sl.Match("SLOW"); len(r.psubs) == 0 {
+			return fmt.Errorf("no interest on \"SLOW\"")
+		}
+		return nil
+	})
+	if ack := jsPublish(t, nc, "SLOW", "hello"); ack.Error != nil || ack.Seq != 1 {
+		t.Fatalf("Unexpected ack: %+v", ack)
+	}
+
+	var resp JSApiStreamCreateResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiStreamCreateT, "BAD"),
+		&StreamConfig{Name: "BAD", Replicas: 2, Placement: &Placement{Tags: []string{"hdd"}}}, &resp)
+	if resp.Error == nil || !strings.Contains(resp.Error.Description, "insufficient peers") {
+		t.Fatalf("Expected placement error, got %+v", resp)
+	}
+
+	var names JSApiStreamNamesResponse
+	jsRequest(t, nc, JSApiStreamNames, nil, &names)
+	if fmt.Sprint(names.Streams) != "[FAST SLOW]" {
+		t.Fatalf("Unexpected stream names: %+v", names)
+	}
+}
+
+func TestJetStreamClusterMirrorAndSources(t *testing.T) {
+	defer func(interval time.Duration) { sourceHealthInterval = interval }(sourceHealthInterval)
+	sourceHealthInterval = 250 * time.Millisecond
+
+	c := createJetStreamCluster(t, "a", "b", "c")
+	defer c.shutdown()
+
+	nc := natsConnect(t, c.clientURL(c.servers[0]))
+	defer nc.Close()
+
+	jsCreateStream(t, nc, &StreamConfig{Name: "S", Storage: FileStorage, Replicas: 3})
+	jsCreateStream(t, nc, &StreamConfig{Name: "M", Storage: FileStorage, Replicas: 3, Mirror: &StreamSource{Name: "S"}})
+	jsCreateStream(t, nc, &StreamConfig{Name: "AGG", Storage: FileStorage, Replicas: 3, Sources: []*StreamSource{{Name: "S"}}})
+	c.waitOnStreamLeader("S")
+	for i := 0; i < 10; i++ {
+		jsPublish(t, nc, "S", fmt.Sprintf("msg-%d", i))
+	}
+	c.checkMsgs("M", 10, 3)
+	c.checkMsgs("AGG", 10, 3)
+
+	// A new leader of the mirror resumes after the last message.
+	leader := c.waitOnStreamLeader("M")
+	leader.Shutdown()
+	if nleader := c.waitOnStreamLeader("M"); nleader == leader {
+		t.Fatalf("Expected a new leader")
+	}
+	nc2 := natsConnect(t, c.clientURL(c.waitOnStreamLeader("S")))
+	defer nc2.Close()
+	for i := 10; i < 15; i++ {
+		jsPublish(t, nc2, "S", fmt.Sprintf("msg-%d", i))
+	}
+	c.checkMsgs("M", 15, 2)
+	for _, s := range c.servers {
+		if mset := c.stream(s, "M"); mset != nil {
+			if sm, err := mset.GetMsg(15); err != nil || string(sm.Data) != "\"msg-14\"" {
+				t.Fatalf("Unexpected message: %+v - %v", sm, err)
+			}
+		}
+	}
+	c.checkMsgs("AGG", 15, 2)
+}
+
+func TestJetStreamClusterJsz(t *testing.T) {
+	c := createJetStreamCluster(t, "a", "b", "c")
+	defer c.shutdown()
+
+	nc := natsConnect(t, c.clientURL(c.servers[0]))
+	defer nc.Close()
+	jsCreateStream(t, nc, &StreamConfig{Name: "S", Storage: FileStorage, Replicas: 3})
+	c.waitOnStreamLeader("S")
+	jsPublish(t, nc, "S", "hello")
+	c.checkMsgs("S", 1, 3)
+
+	for _, s := range c.servers {
+		checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+			jsi, err := s.Jsz(&JSzOptions{Account: "JS", Streams: true})
+			if err != nil {
+				return err
+			}
+			if jsi.Meta == nil || jsi.Meta.Leader == _EMPTY_ || len(jsi.Meta.Replicas) != len(c.servers)-1 {
+				return fmt.Errorf("unexpected meta info: %+v", jsi.Meta)
+			}
+			// Only the leader knows if its peers are current.
+			for _, p := range jsi.Meta.Replicas {
+				if s.getJetStream().isMetaLeader() && !p.Current {
+					return fmt.Errorf("peer %q not current", p.Name)
+				}
+			}
+			if jsi.Streams != 1 || len(jsi.AccountDetails) != 1 || len(jsi.AccountDetails[0].Streams) != 1 {
+				return fmt.Errorf("unexpected jsz: %+v", jsi)
+			}
+			if sd := jsi.AccountDetails[0].Streams[0]; sd.Cluster == nil || sd.Cluster.Leader == _EMPTY_ {
+				return fmt.Errorf("unexpected stream cluster info: %+v", sd.Cluster)
+			}
+			return nil
+		})
+	}
+}
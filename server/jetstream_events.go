@@ -0,0 +1,58 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	// JSAdvisoryPrefix is the prefix of the subjects of the advisories
+	// JetStream publishes in the accounts.
+	JSAdvisoryPrefix = "$JS.EVENT.ADVISORY"
+
+	// JSAdvisoryConsumerMaxDeliveryExceedPre is the prefix of the advisory
+	// published when a message reaches the maximum deliveries of a
+	// consumer. The stream and consumer names are appended.
+	JSAdvisoryConsumerMaxDeliveryExceedPre = JSAdvisoryPrefix + ".CONSUMER.MAX_DELIVERIES"
+)
+
+// JSConsumerDeliveryExceededAdvisoryType is the type of the max deliveries advisory.
+const JSConsumerDeliveryExceededAdvisoryType = "io.nats.jetstream.advisory.v1.max_deliver"
+
+// JSConsumerDeliveryExceededAdvisory is published when a message is no
+// longer redelivered because it reached the maximum deliveries of the
+// consumer.
+type JSConsumerDeliveryExceededAdvisory struct {
+	Type       string    `json:"type"`
+	ID         string    `json:"id"`
+	Time       time.Time `json:"timestamp"`
+	Stream     string    `json:"stream"`
+	Consumer   string    `json:"consumer"`
+	StreamSeq  uint64    `json:"stream_seq"`
+	Deliveries uint64    `json:"deliveries"`
+	// Set when the message was moved to the dead letter stream.
+	DeadLetterStream string `json:"dead_letter_stream,omitempty"`
+}
+
+// Publishes the advisory in the account.
+func (jsa *jsAccount) sendAdvisory(subj string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		jsa.js.srv.Warnf("Error marshalling JetStream advisory: %v", err)
+		return
+	}
+	jsa.outq.send(&jsPubMsg{subj: subj, msg: b})
+}
@@ -0,0 +1,439 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Request API subjects of the key-value buckets. A bucket is a stream
+// named KV_<bucket> that stores the values of key on $KV.<bucket>.<key>,
+// keeping the last revisions of each key.
+const (
+	// JSApiKVCreate is the endpoint to create buckets.
+	JSApiKVCreate  = "$JS.API.KV.CREATE.*"
+	JSApiKVCreateT = "$JS.API.KV.CREATE.%s"
+
+	// JSApiKVDelete is the endpoint to delete buckets.
+	JSApiKVDelete  = "$JS.API.KV.DELETE.*"
+	JSApiKVDeleteT = "$JS.API.KV.DELETE.%s"
+
+	// JSApiKVInfo is for obtaining information about a bucket.
+	JSApiKVInfo  = "$JS.API.KV.INFO.*"
+	JSApiKVInfoT = "$JS.API.KV.INFO.%s"
+
+	// JSApiKVPut is the endpoint to set the value of a key.
+	JSApiKVPut  = "$JS.API.KV.PUT.*.>"
+	JSApiKVPutT = "$JS.API.KV.PUT.%s.%s"
+
+	// JSApiKVGet is the endpoint to get the value of a key.
+	JSApiKVGet  = "$JS.API.KV.GET.*.>"
+	JSApiKVGetT = "$JS.API.KV.GET.%s.%s"
+
+	// JSApiKVHistory is the endpoint for the revisions of a key.
+	JSApiKVHistory  = "$JS.API.KV.HISTORY.*.>"
+	JSApiKVHistoryT = "$JS.API.KV.HISTORY.%s.%s"
+
+	// JSApiKVDel is the endpoint to delete a key.
+	JSApiKVDel  = "$JS.API.KV.DEL.*.>"
+	JSApiKVDelT = "$JS.API.KV.DEL.%s.%s"
+
+	// JSApiKVWatch is the endpoint to watch the keys of a bucket.
+	JSApiKVWatch  = "$JS.API.KV.WATCH.*"
+	JSApiKVWatchT = "$JS.API.KV.WATCH.%s"
+
+	// Subjects of the values of the keys of a bucket.
+	kvSubjectsT = "$KV.%s.>"
+	kvKeyT      = "$KV.%s.%s"
+
+	// Prefix of the name of the stream of a bucket.
+	kvStreamPrefix = "KV_"
+)
+
+// KVMaxHistory is the maximum number of revisions kept per key.
+const KVMaxHistory = 64
+
+// KVOperation is the header of the revisions that delete a key.
+const KVOperation = "KV-Operation"
+
+// Operations of the revisions of a key.
+const (
+	KVOpPut = "PUT"
+	KVOpDel = "DEL"
+)
+
+// KVConfig is the configuration of a bucket.
+type KVConfig struct {
+	Bucket       string        `json:"bucket"`
+	History      int64         `json:"history,omitempty"`
+	TTL          time.Duration `json:"ttl,omitempty"`
+	MaxValueSize int32         `json:"max_value_size,omitempty"`
+	MaxBytes     int64         `json:"max_bytes,omitempty"`
+	Storage      StorageType   `json:"storage"`
+	Replicas     int           `json:"num_replicas"`
+}
+
+// KVInfo shows the config and current state of a bucket.
+type KVInfo struct {
+	Config  KVConfig     `json:"config"`
+	Created time.Time    `json:"created"`
+	Values  uint64       `json:"values"`
+	Bytes   uint64       `json:"bytes"`
+	Cluster *ClusterInfo `json:"cluster,omitempty"`
+}
+
+// KVEntry is a revision of a key.
+type KVEntry struct {
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	Value     []byte    `json:"value,omitempty"`
+	Revision  uint64    `json:"revision"`
+	Created   time.Time `json:"created"`
+	Operation string    `json:"operation"`
+}
+
+// JSApiKVInfoResponse is the response to a bucket info request.
+type JSApiKVInfoResponse struct {
+	ApiResponse
+	*KVInfo
+}
+
+const JSApiKVInfoResponseType = "io.nats.jetstream.api.v1.kv_info_response"
+
+// JSApiKVPutRequest sets the value of a key, which expires after the
+// TTL if set.
+type JSApiKVPutRequest struct {
+	Value []byte        `json:"value,omitempty"`
+	TTL   time.Duration `json:"ttl,omitempty"`
+}
+
+// JSApiKVGetRequest selects the revision of the key, the last one if
+// not set.
+type JSApiKVGetRequest struct {
+	Revision uint64 `json:"revision,omitempty"`
+}
+
+// JSApiKVGetResponse is the response to a key get request.
+type JSApiKVGetResponse struct {
+	ApiResponse
+	Entry *KVEntry `json:"entry,omitempty"`
+}
+
+const JSApiKVGetResponseType = "io.nats.jetstream.api.v1.kv_get_response"
+
+// JSApiKVHistoryResponse lists the revisions kept for a key, oldest first.
+type JSApiKVHistoryResponse struct {
+	ApiResponse
+	Entries []*KVEntry `json:"entries"`
+}
+
+const JSApiKVHistoryResponseType = "io.nats.jetstream.api.v1.kv_history_response"
+
+// JSApiKVWatchRequest asks for the revisions of the keys matching Key
+// to be delivered to a subject. The last revision of each key is sent
+// first, unless all the revisions or only the updates are requested.
+type JSApiKVWatchRequest struct {
+	DeliverSubject string `json:"deliver_subject"`
+	Key            string `json:"key,omitempty"`
+	IncludeHistory bool   `json:"include_history,omitempty"`
+	UpdatesOnly    bool   `json:"updates_only,omitempty"`
+}
+
+// Returns the configuration of the stream of the bucket.
+func kvStreamConfig(cfg *KVConfig) (*StreamConfig, error) {
+	if !isValidName(cfg.Bucket) {
+		return nil, fmt.Errorf("bucket name is required and can not contain '.', '*', '>'")
+	}
+	history := cfg.History
+	if history == 0 {
+		history = 1
+	}
+	if history < 1 || history > KVMaxHistory {
+		return nil, fmt.Errorf("history must be between 1 and %d", KVMaxHistory)
+	}
+	if cfg.TTL < 0 {
+		return nil, fmt.Errorf("ttl can not be negative")
+	}
+	return &StreamConfig{
+		Name:        kvStreamPrefix + cfg.Bucket,
+		Subjects:    []string{fmt.Sprintf(kvSubjectsT, cfg.Bucket)},
+		MaxMsgsPer:  history,
+		MaxBytes:    cfg.MaxBytes,
+		MaxAge:      cfg.TTL,
+		MaxMsgSize:  cfg.MaxValueSize,
+		Storage:     cfg.Storage,
+		Replicas:    cfg.Replicas,
+		AllowMsgTTL: true,
+	}, nil
+}
+
+// Returns the configuration of the bucket from the one of its stream.
+func kvConfig(bucket string, cfg *StreamConfig) KVConfig {
+	kcfg := KVConfig{
+		Bucket:   bucket,
+		History:  cfg.MaxMsgsPer,
+		TTL:      cfg.MaxAge,
+		Storage:  cfg.Storage,
+		Replicas: cfg.Replicas,
+	}
+	if cfg.MaxMsgSize > 0 {
+		kcfg.MaxValueSize = cfg.MaxMsgSize
+	}
+	if cfg.MaxBytes > 0 {
+		kcfg.MaxBytes = cfg.MaxBytes
+	}
+	return kcfg
+}
+
+// Returns the bucket and key of the key API subjects.
+func kvKeyFromSubject(subject string) (string, string) {
+	tokens := strings.SplitN(subject, tsep, 6)
+	return tokens[4], tokens[5]
+}
+
+// Looks up the stream of the bucket, filling in the error of the
+// response if not found.
+func (jsa *jsAccount) kvStream(bucket string, resp *ApiResponse) *Stream {
+	jsa.mu.RLock()
+	mset := jsa.streams[kvStreamPrefix+bucket]
+	jsa.mu.RUnlock()
+	if mset == nil {
+		resp.Error = &ApiError{Code: 404, Description: "bucket not found"}
+	}
+	return mset
+}
+
+// Request to create a bucket, answered with the stream create response.
+func (jsa *jsAccount) jsKVCreateRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	if !jsa.js.isMetaLeader() {
+		return
+	}
+	resp := JSApiStreamCreateResponse{ApiResponse: ApiResponse{Type: JSApiStreamCreateResponseType}}
+	var cfg KVConfig
+	if err := json.Unmarshal(msg, &cfg); err != nil {
+		resp.Error = &ApiError{Code: 400, Description: "invalid JSON"}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	if name := streamNameFromSubject(subject); cfg.Bucket != name {
+		resp.Error = &ApiError{Code: 400, Description: "bucket name in subject does not match request"}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	scfg, err := kvStreamConfig(&cfg)
+	if err != nil {
+		resp.Error = &ApiError{Code: 400, Description: err.Error()}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	jsa.createStream(scfg, reply)
+}
+
+// Request to delete a bucket, answered with the stream delete response.
+func (jsa *jsAccount) jsKVDeleteRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	if !jsa.js.isMetaLeader() {
+		return
+	}
+	jsa.deleteStream(kvStreamPrefix+streamNameFromSubject(subject), reply)
+}
+
+// Request for the information of a bucket.
+func (jsa *jsAccount) jsKVInfoRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	bucket := streamNameFromSubject(subject)
+	if !jsa.answersFor(kvStreamPrefix + bucket) {
+		return
+	}
+	resp := JSApiKVInfoResponse{ApiResponse: ApiResponse{Type: JSApiKVInfoResponseType}}
+	if mset := jsa.kvStream(bucket, &resp.ApiResponse); mset != nil {
+		info := mset.Info()
+		resp.KVInfo = &KVInfo{
+			Config:  kvConfig(bucket, &info.Config),
+			Created: info.Created,
+			Values:  info.State.Msgs,
+			Bytes:   info.State.Bytes,
+			Cluster: info.Cluster,
+		}
+	}
+	jsa.sendAPIResponse(reply, &resp)
+}
+
+// Request to set the value of a key, answered with the ack of the
+// stream. Its sequence is the revision of the key.
+func (jsa *jsAccount) jsKVPutRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	bucket, key := kvKeyFromSubject(subject)
+	if !jsa.answersFor(kvStreamPrefix + bucket) {
+		return
+	}
+	var req JSApiKVPutRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		jsa.sendAPIResponse(reply, &JSPubAckResponse{Error: &ApiError{Code: 400, Description: "invalid JSON"}})
+		return
+	}
+	if req.TTL < 0 {
+		jsa.sendAPIResponse(reply, &JSPubAckResponse{Error: &ApiError{Code: 400, Description: "ttl can not be negative"}})
+		return
+	}
+	hdr := ""
+	if req.TTL > 0 {
+		hdr = fmt.Sprintf("%s: %v\r\n", JSMsgTTL, req.TTL)
+	}
+	jsa.storeKV(bucket, key, hdr, req.Value, reply)
+}
+
+// Request to delete a key, which is kept as a revision without value.
+func (jsa *jsAccount) jsKVDelRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	bucket, key := kvKeyFromSubject(subject)
+	if !jsa.answersFor(kvStreamPrefix + bucket) {
+		return
+	}
+	jsa.storeKV(bucket, key, fmt.Sprintf("%s: %s\r\n", KVOperation, KVOpDel), nil, reply)
+}
+
+// Stores a revision of the key, the stream sends the ack.
+func (jsa *jsAccount) storeKV(bucket, key, hdr string, value []byte, reply string) {
+	var resp ApiResponse
+	mset := jsa.kvStream(bucket, &resp)
+	if mset != nil && !IsValidLiteralSubject(key) {
+		resp.Error = &ApiError{Code: 400, Description: fmt.Sprintf("invalid key %q", key)}
+	}
+	if resp.Error != nil {
+		jsa.sendAPIResponse(reply, &JSPubAckResponse{Error: resp.Error})
+		return
+	}
+	mset.processInboundMsg(nil, fmt.Sprintf(kvKeyT, bucket, key), reply, addHeaders(nil, hdr), value)
+}
+
+// Returns the revision of the key stored in the message, nil if it
+// has expired.
+func kvEntry(bucket, key string, sm *StoredMsg) *KVEntry {
+	if ttl, _ := getMsgTTL(sm.Header); ttl > 0 && time.Since(sm.Time) >= ttl {
+		return nil
+	}
+	e := &KVEntry{Bucket: bucket, Key: key, Revision: sm.Sequence, Created: sm.Time, Operation: KVOpPut}
+	if string(getHeader(KVOperation, sm.Header)) == KVOpDel {
+		e.Operation = KVOpDel
+	}
+	e.Value = sm.Data
+	if len(e.Value) == 0 {
+		e.Value = nil
+	}
+	return e
+}
+
+// Request to get the value of a key. Deleted and expired keys are
+// not found, unless a revision is requested.
+func (jsa *jsAccount) jsKVGetRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	bucket, key := kvKeyFromSubject(subject)
+	if !jsa.answersFor(kvStreamPrefix + bucket) {
+		return
+	}
+	resp := JSApiKVGetResponse{ApiResponse: ApiResponse{Type: JSApiKVGetResponseType}}
+	var req JSApiKVGetRequest
+	if len(msg) > 0 {
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = &ApiError{Code: 400, Description: "invalid JSON"}
+			jsa.sendAPIResponse(reply, &resp)
+			return
+		}
+	}
+	if mset := jsa.kvStream(bucket, &resp.ApiResponse); mset != nil {
+		subj := fmt.Sprintf(kvKeyT, bucket, key)
+		var sm *StoredMsg
+		var err error
+		if req.Revision > 0 {
+			if sm, err = mset.GetMsg(req.Revision); err == nil && sm.Subject != subj {
+				err = ErrStoreMsgNotFound
+			}
+		} else {
+			sm, err = mset.GetLastMsg(subj)
+		}
+		if err == nil {
+			resp.Entry = kvEntry(bucket, key, sm)
+		}
+		if resp.Entry == nil || (req.Revision == 0 && resp.Entry.Operation == KVOpDel) {
+			resp.Entry = nil
+			resp.Error = &ApiError{Code: 404, Description: "key not found"}
+		}
+	}
+	jsa.sendAPIResponse(reply, &resp)
+}
+
+// Request for the revisions kept for a key.
+func (jsa *jsAccount) jsKVHistoryRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	bucket, key := kvKeyFromSubject(subject)
+	if !jsa.answersFor(kvStreamPrefix + bucket) {
+		return
+	}
+	resp := JSApiKVHistoryResponse{ApiResponse: ApiResponse{Type: JSApiKVHistoryResponseType}, Entries: []*KVEntry{}}
+	if mset := jsa.kvStream(bucket, &resp.ApiResponse); mset != nil {
+		mset.mu.RLock()
+		store := mset.store
+		mset.mu.RUnlock()
+		if store != nil {
+			for _, seq := range store.SubjectSeqs(fmt.Sprintf(kvKeyT, bucket, key)) {
+				if sm, err := store.LoadMsg(seq); err == nil {
+					if e := kvEntry(bucket, key, sm); e != nil {
+						resp.Entries = append(resp.Entries, e)
+					}
+				}
+			}
+		}
+		if len(resp.Entries) == 0 {
+			resp.Error = &ApiError{Code: 404, Description: "key not found"}
+		}
+	}
+	jsa.sendAPIResponse(reply, &resp)
+}
+
+// Request to watch the keys of a bucket, answered with the consumer
+// create response. The revisions are delivered as stored, with the
+// subject of the key.
+func (jsa *jsAccount) jsKVWatchRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	bucket := streamNameFromSubject(subject)
+	if !jsa.answersFor(kvStreamPrefix + bucket) {
+		return
+	}
+	resp := JSApiConsumerCreateResponse{ApiResponse: ApiResponse{Type: JSApiConsumerCreateResponseType}}
+	var req JSApiKVWatchRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = &ApiError{Code: 400, Description: "invalid JSON"}
+	} else if req.DeliverSubject == _EMPTY_ {
+		resp.Error = &ApiError{Code: 400, Description: "watch requires a deliver subject"}
+	} else if req.Key == _EMPTY_ {
+		req.Key = ">"
+	}
+	if resp.Error == nil && !IsValidSubject(req.Key) {
+		resp.Error = &ApiError{Code: 400, Description: fmt.Sprintf("invalid key %q", req.Key)}
+	}
+	mset := jsa.kvStream(bucket, &resp.ApiResponse)
+	if resp.Error != nil {
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	cfg := &ConsumerConfig{
+		DeliverSubject: req.DeliverSubject,
+		DeliverPolicy:  DeliverLastPerSubject,
+		AckPolicy:      AckNone,
+		FilterSubject:  fmt.Sprintf(kvKeyT, bucket, req.Key),
+	}
+	if req.IncludeHistory {
+		cfg.DeliverPolicy = DeliverAll
+	} else if req.UpdatesOnly {
+		cfg.DeliverPolicy = DeliverNew
+	}
+	jsa.createConsumer(mset, cfg, reply)
+}
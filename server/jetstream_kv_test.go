@@ -0,0 +1,187 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func kvPut(t *testing.T, nc *nats.Conn, bucket, key, value string, ttl time.Duration) uint64 {
+	t.Helper()
+	var resp JSPubAckResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiKVPutT, bucket, key), &JSApiKVPutRequest{Value: []byte(value), TTL: ttl}, &resp)
+	if resp.Error != nil || resp.PubAck == nil {
+		t.Fatalf("Unexpected put response: %+v", resp)
+	}
+	return resp.Seq
+}
+
+func kvGet(t *testing.T, nc *nats.Conn, bucket, key string) *JSApiKVGetResponse {
+	t.Helper()
+	var resp JSApiKVGetResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiKVGetT, bucket, key), nil, &resp)
+	return &resp
+}
+
+func TestJetStreamKVBasics(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	s := runJetStreamServer(t, storeDir)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+
+	var cresp JSApiStreamCreateResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiKVCreateT, "CFG"), &KVConfig{Bucket: "CFG", History: 65}, &cresp)
+	if cresp.Error == nil {
+		t.Fatalf("Expected error for the history limit")
+	}
+	cresp = JSApiStreamCreateResponse{}
+	jsRequest(t, nc, fmt.Sprintf(JSApiKVCreateT, "CFG"), &KVConfig{Bucket: "CFG", History: 3, Storage: MemoryStorage}, &cresp)
+	if cresp.Error != nil || cresp.Config.Name != "KV_CFG" || cresp.Config.MaxMsgsPer != 3 {
+		t.Fatalf("Unexpected create response: %+v", cresp)
+	}
+
+	if resp := kvGet(t, nc, "CFG", "app.port"); resp.Error == nil || resp.Error.Code != 404 {
+		t.Fatalf("Expected key not found, got %+v", resp)
+	}
+	for i := 1; i <= 5; i++ {
+		if rev := kvPut(t, nc, "CFG", "app.port", fmt.Sprintf("%d", 4220+i), 0); rev != uint64(i) {
+			t.Fatalf("Expected revision %d, got %d", i, rev)
+		}
+	}
+	resp := kvGet(t, nc, "CFG", "app.port")
+	if resp.Error != nil || string(resp.Entry.Value) != "4225" || resp.Entry.Revision != 5 || resp.Entry.Operation != KVOpPut {
+		t.Fatalf("Unexpected get response: %+v", resp)
+	}
+	var hresp JSApiKVHistoryResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiKVHistoryT, "CFG", "app.port"), nil, &hresp)
+	if hresp.Error != nil || len(hresp.Entries) != 3 || hresp.Entries[0].Revision != 3 {
+		t.Fatalf("Unexpected history response: %+v", hresp)
+	}
+
+	// Deleted keys are not found, the previous revisions are kept.
+	var dresp JSPubAckResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiKVDelT, "CFG", "app.port"), nil, &dresp)
+	if dresp.Error != nil || dresp.Seq != 6 {
+		t.Fatalf("Unexpected delete response: %+v", dresp)
+	}
+	if resp := kvGet(t, nc, "CFG", "app.port"); resp.Error == nil || resp.Error.Code != 404 {
+		t.Fatalf("Expected key not found, got %+v", resp)
+	}
+	var rresp JSApiKVGetResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiKVGetT, "CFG", "app.port"), &JSApiKVGetRequest{Revision: 5}, &rresp)
+	if rresp.Error != nil || string(rresp.Entry.Value) != "4225" {
+		t.Fatalf("Unexpected get response: %+v", rresp)
+	}
+
+	// Keys with a TTL expire on their own.
+	kvPut(t, nc, "CFG", "session", "abc", 100*time.Millisecond)
+	if resp := kvGet(t, nc, "CFG", "session"); resp.Error != nil || string(resp.Entry.Value) != "abc" {
+		t.Fatalf("Unexpected get response: %+v", resp)
+	}
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if resp := kvGet(t, nc, "CFG", "session"); resp.Error == nil {
+			return fmt.Errorf("key has not expired")
+		}
+		return nil
+	})
+
+	var iresp JSApiKVInfoResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiKVInfoT, "CFG"), nil, &iresp)
+	if iresp.Error != nil || iresp.Config.Bucket != "CFG" || iresp.Config.History != 3 || iresp.Values != 3 {
+		t.Fatalf("Unexpected info response: %+v", iresp)
+	}
+
+	var bresp JSApiStreamDeleteResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiKVDeleteT, "CFG"), nil, &bresp)
+	if bresp.Error != nil || !bresp.Success {
+		t.Fatalf("Unexpected delete response: %+v", bresp)
+	}
+	if resp := kvGet(t, nc, "CFG", "app.port"); resp.Error == nil || resp.Error.Description != "bucket not found" {
+		t.Fatalf("Expected bucket not found, got %+v", resp)
+	}
+}
+
+func TestJetStreamKVWatch(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	s := runJetStreamServer(t, storeDir)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+
+	var cresp JSApiStreamCreateResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiKVCreateT, "CFG"), &KVConfig{Bucket: "CFG", History: 5}, &cresp)
+	if cresp.Error != nil {
+		t.Fatalf("Unexpected create response: %+v", cresp)
+	}
+	kvPut(t, nc, "CFG", "a", "1", 0)
+	kvPut(t, nc, "CFG", "a", "2", 0)
+	kvPut(t, nc, "CFG", "b", "1", 0)
+	kvPut(t, nc, "CFG", "c.d", "1", 0)
+
+	watch := func(req *JSApiKVWatchRequest) *nats.Subscription {
+		t.Helper()
+		sub, _ := nc.SubscribeSync(req.DeliverSubject)
+		var resp JSApiConsumerCreateResponse
+		jsRequest(t, nc, fmt.Sprintf(JSApiKVWatchT, "CFG"), req, &resp)
+		if resp.Error != nil {
+			t.Fatalf("Unexpected watch response: %+v", resp)
+		}
+		return sub
+	}
+	expect := func(sub *nats.Subscription, subjects ...string) {
+		t.Helper()
+		for _, subj := range subjects {
+			m, err := sub.NextMsg(time.Second)
+			if err != nil {
+				t.Fatalf("Error getting update: %v", err)
+			}
+			if m.Subject != subj {
+				t.Fatalf("Expected update on %q, got %q", subj, m.Subject)
+			}
+		}
+		if m, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+			t.Fatalf("Unexpected update: %+v", m)
+		}
+	}
+
+	// The last revision of each key, then the updates.
+	last := watch(&JSApiKVWatchRequest{DeliverSubject: "w.last", Key: "*"})
+	expect(last, "$KV.CFG.a", "$KV.CFG.b")
+	all := watch(&JSApiKVWatchRequest{DeliverSubject: "w.all", IncludeHistory: true})
+	expect(all, "$KV.CFG.a", "$KV.CFG.a", "$KV.CFG.b", "$KV.CFG.c.d")
+	updates := watch(&JSApiKVWatchRequest{DeliverSubject: "w.updates", UpdatesOnly: true})
+	expect(updates)
+
+	kvPut(t, nc, "CFG", "b", "2", 0)
+	expect(last, "$KV.CFG.b")
+	expect(all, "$KV.CFG.b")
+	expect(updates, "$KV.CFG.b")
+
+	var resp JSApiConsumerCreateResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiKVWatchT, "CFG"), &JSApiKVWatchRequest{}, &resp)
+	if resp.Error == nil {
+		t.Fatalf("Expected error without a deliver subject")
+	}
+}
@@ -0,0 +1,393 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Request API subjects of the object stores. A store is a stream named
+// OBJ_<bucket>. The chunks of an object are published by the client on
+// $O.<bucket>.C.<nuid>, then the object is put with its metadata, which
+// is kept on $O.<bucket>.M.<encoded name> once the chunks are verified.
+const (
+	// JSApiObjectStoreCreate is the endpoint to create object stores.
+	JSApiObjectStoreCreate  = "$JS.API.OBJ.CREATE.*"
+	JSApiObjectStoreCreateT = "$JS.API.OBJ.CREATE.%s"
+
+	// JSApiObjectStoreDelete is the endpoint to delete object stores.
+	JSApiObjectStoreDelete  = "$JS.API.OBJ.DELETE.*"
+	JSApiObjectStoreDeleteT = "$JS.API.OBJ.DELETE.%s"
+
+	// JSApiObjectPut is the endpoint to put an object once its chunks
+	// are published.
+	JSApiObjectPut  = "$JS.API.OBJ.PUT.*"
+	JSApiObjectPutT = "$JS.API.OBJ.PUT.%s"
+
+	// JSApiObjectGet is the endpoint to get the chunks of an object.
+	JSApiObjectGet  = "$JS.API.OBJ.GET.*"
+	JSApiObjectGetT = "$JS.API.OBJ.GET.%s"
+
+	// JSApiObjectInfo is for obtaining the metadata of an object.
+	JSApiObjectInfo  = "$JS.API.OBJ.INFO.*"
+	JSApiObjectInfoT = "$JS.API.OBJ.INFO.%s"
+
+	// JSApiObjectDelete is the endpoint to delete an object.
+	JSApiObjectDelete  = "$JS.API.OBJ.DEL.*"
+	JSApiObjectDeleteT = "$JS.API.OBJ.DEL.%s"
+
+	// JSApiObjectList is the endpoint for the metadata of all the
+	// objects of a store.
+	JSApiObjectList  = "$JS.API.OBJ.LIST.*"
+	JSApiObjectListT = "$JS.API.OBJ.LIST.%s"
+
+	// ObjectChunksT is the subject of the chunks of an object.
+	ObjectChunksT = "$O.%s.C.%s"
+
+	// Subjects of the chunks and metadata of a store.
+	objChunksAllT = "$O.%s.C.>"
+	objMetaAllT   = "$O.%s.M.>"
+	objMetaT      = "$O.%s.M.%s"
+
+	// Prefix of the name of the stream of an object store.
+	objStreamPrefix = "OBJ_"
+
+	// Prefix of the digest of the objects.
+	objDigestPrefix = "SHA-256="
+)
+
+// ObjectStoreConfig is the configuration of an object store.
+type ObjectStoreConfig struct {
+	Bucket   string        `json:"bucket"`
+	TTL      time.Duration `json:"ttl,omitempty"`
+	MaxBytes int64         `json:"max_bytes,omitempty"`
+	Storage  StorageType   `json:"storage"`
+	Replicas int           `json:"num_replicas"`
+}
+
+// ObjectInfo is the metadata of an object. The digest is the SHA-256
+// of the content, filled in by the server if not set on put.
+type ObjectInfo struct {
+	Bucket   string    `json:"bucket"`
+	Name     string    `json:"name"`
+	Nuid     string    `json:"nuid"`
+	Size     uint64    `json:"size"`
+	Chunks   uint32    `json:"chunks"`
+	Digest   string    `json:"digest,omitempty"`
+	Modified time.Time `json:"mtime"`
+}
+
+// JSApiObjectRequest selects an object. Get requests include the
+// subject the chunks are delivered to.
+type JSApiObjectRequest struct {
+	Name           string `json:"name"`
+	DeliverSubject string `json:"deliver_subject,omitempty"`
+}
+
+// JSApiObjectInfoResponse is the response to object info and get requests.
+type JSApiObjectInfoResponse struct {
+	ApiResponse
+	*ObjectInfo
+}
+
+const JSApiObjectInfoResponseType = "io.nats.jetstream.api.v1.object_info_response"
+
+// JSApiObjectDeleteResponse is the response to an object delete request.
+type JSApiObjectDeleteResponse struct {
+	ApiResponse
+	Success bool `json:"success,omitempty"`
+}
+
+const JSApiObjectDeleteResponseType = "io.nats.jetstream.api.v1.object_delete_response"
+
+// JSApiObjectListResponse lists the metadata of the objects of a store.
+type JSApiObjectListResponse struct {
+	ApiResponse
+	Objects []*ObjectInfo `json:"objects"`
+}
+
+const JSApiObjectListResponseType = "io.nats.jetstream.api.v1.object_list_response"
+
+// Returns the configuration of the stream of the object store.
+func objStreamConfig(cfg *ObjectStoreConfig) (*StreamConfig, error) {
+	if !isValidName(cfg.Bucket) {
+		return nil, fmt.Errorf("bucket name is required and can not contain '.', '*', '>'")
+	}
+	if cfg.TTL < 0 {
+		return nil, fmt.Errorf("ttl can not be negative")
+	}
+	return &StreamConfig{
+		Name:     objStreamPrefix + cfg.Bucket,
+		Subjects: []string{fmt.Sprintf(objChunksAllT, cfg.Bucket), fmt.Sprintf(objMetaAllT, cfg.Bucket)},
+		MaxBytes: cfg.MaxBytes,
+		MaxAge:   cfg.TTL,
+		Storage:  cfg.Storage,
+		Replicas: cfg.Replicas,
+	}, nil
+}
+
+// Returns the subject of the metadata of the object.
+func objMetaSubject(bucket, name string) string {
+	return fmt.Sprintf(objMetaT, bucket, base64.RawURLEncoding.EncodeToString([]byte(name)))
+}
+
+// Looks up the stream of the object store, filling in the error of the
+// response if not found.
+func (jsa *jsAccount) objStream(bucket string, resp *ApiResponse) (*Stream, StreamStore) {
+	jsa.mu.RLock()
+	mset := jsa.streams[objStreamPrefix+bucket]
+	jsa.mu.RUnlock()
+	if mset == nil {
+		resp.Error = &ApiError{Code: 404, Description: "object store not found"}
+		return nil, nil
+	}
+	mset.mu.RLock()
+	store := mset.store
+	mset.mu.RUnlock()
+	if store == nil {
+		resp.Error = &ApiError{Code: 500, Description: ErrStoreClosed.Error()}
+		return nil, nil
+	}
+	return mset, store
+}
+
+// Returns the metadata of the object and its sequence, or nil if the
+// object does not exist.
+func loadObjectInfo(store StreamStore, bucket, name string) (*ObjectInfo, uint64) {
+	sm, err := store.LoadLastMsg(objMetaSubject(bucket, name))
+	if err != nil {
+		return nil, 0
+	}
+	var info ObjectInfo
+	if err := json.Unmarshal(sm.Data, &info); err != nil {
+		return nil, 0
+	}
+	return &info, sm.Sequence
+}
+
+// Checks the chunks of the object against its metadata and fills in
+// the digest if not set.
+func checkObjectChunks(store StreamStore, info *ObjectInfo) error {
+	seqs := store.SubjectSeqs(fmt.Sprintf(ObjectChunksT, info.Bucket, info.Nuid))
+	if len(seqs) != int(info.Chunks) {
+		return fmt.Errorf("expected %d chunks, got %d", info.Chunks, len(seqs))
+	}
+	h := sha256.New()
+	var size uint64
+	for _, seq := range seqs {
+		sm, err := store.LoadMsg(seq)
+		if err != nil {
+			return err
+		}
+		h.Write(sm.Data)
+		size += uint64(len(sm.Data))
+	}
+	if size != info.Size {
+		return fmt.Errorf("expected object size of %d, got %d", info.Size, size)
+	}
+	digest := objDigestPrefix + base64.URLEncoding.EncodeToString(h.Sum(nil))
+	if info.Digest == _EMPTY_ {
+		info.Digest = digest
+	} else if info.Digest != digest {
+		return fmt.Errorf("object digest mismatch")
+	}
+	return nil
+}
+
+// Removes the chunks of the object.
+func (mset *Stream) removeObjectChunks(store StreamStore, bucket, nuid string) {
+	for _, seq := range store.SubjectSeqs(fmt.Sprintf(ObjectChunksT, bucket, nuid)) {
+		mset.removeStoredMsg(store, seq)
+	}
+}
+
+// Request to create an object store, answered with the stream create
+// response.
+func (jsa *jsAccount) jsObjectStoreCreateRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	if !jsa.js.isMetaLeader() {
+		return
+	}
+	resp := JSApiStreamCreateResponse{ApiResponse: ApiResponse{Type: JSApiStreamCreateResponseType}}
+	var cfg ObjectStoreConfig
+	if err := json.Unmarshal(msg, &cfg); err != nil {
+		resp.Error = &ApiError{Code: 400, Description: "invalid JSON"}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	if name := streamNameFromSubject(subject); cfg.Bucket != name {
+		resp.Error = &ApiError{Code: 400, Description: "bucket name in subject does not match request"}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	scfg, err := objStreamConfig(&cfg)
+	if err != nil {
+		resp.Error = &ApiError{Code: 400, Description: err.Error()}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	jsa.createStream(scfg, reply)
+}
+
+// Request to delete an object store, answered with the stream delete
+// response.
+func (jsa *jsAccount) jsObjectStoreDeleteRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	if !jsa.js.isMetaLeader() {
+		return
+	}
+	jsa.deleteStream(objStreamPrefix+streamNameFromSubject(subject), reply)
+}
+
+// Request to put an object whose chunks have been published, answered
+// with the ack of its metadata. The chunks of a replaced object are
+// removed, as are the chunks of an object that fails the checks.
+func (jsa *jsAccount) jsObjectPutRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	bucket := streamNameFromSubject(subject)
+	if !jsa.answersFor(objStreamPrefix + bucket) {
+		return
+	}
+	var resp ApiResponse
+	var info ObjectInfo
+	if err := json.Unmarshal(msg, &info); err != nil {
+		resp.Error = &ApiError{Code: 400, Description: "invalid JSON"}
+	} else if info.Name == _EMPTY_ {
+		resp.Error = &ApiError{Code: 400, Description: "object name is required"}
+	} else if !isValidName(info.Nuid) {
+		resp.Error = &ApiError{Code: 400, Description: fmt.Sprintf("invalid object nuid %q", info.Nuid)}
+	}
+	var mset *Stream
+	var store StreamStore
+	if resp.Error == nil {
+		mset, store = jsa.objStream(bucket, &resp)
+	}
+	if resp.Error != nil {
+		jsa.sendAPIResponse(reply, &JSPubAckResponse{Error: resp.Error})
+		return
+	}
+	info.Bucket, info.Modified = bucket, time.Now().UTC()
+	if err := checkObjectChunks(store, &info); err != nil {
+		mset.removeObjectChunks(store, bucket, info.Nuid)
+		jsa.sendAPIResponse(reply, &JSPubAckResponse{Error: &ApiError{Code: 400, Description: err.Error()}})
+		return
+	}
+	prev, pseq := loadObjectInfo(store, bucket, info.Name)
+	b, _ := json.Marshal(&info)
+	mset.processInboundMsg(nil, objMetaSubject(bucket, info.Name), reply, nil, b)
+	if prev != nil {
+		mset.removeStoredMsg(store, pseq)
+		if prev.Nuid != info.Nuid {
+			mset.removeObjectChunks(store, bucket, prev.Nuid)
+		}
+	}
+}
+
+// Request for the metadata of an object, or for its chunks when the
+// request has a deliver subject. The chunks are delivered in order
+// after the response.
+func (jsa *jsAccount) jsObjectGetRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	bucket := streamNameFromSubject(subject)
+	if !jsa.answersFor(objStreamPrefix + bucket) {
+		return
+	}
+	resp := JSApiObjectInfoResponse{ApiResponse: ApiResponse{Type: JSApiObjectInfoResponseType}}
+	var req JSApiObjectRequest
+	if err := json.Unmarshal(msg, &req); err != nil || req.Name == _EMPTY_ {
+		resp.Error = &ApiError{Code: 400, Description: "request requires an object name"}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	get := subjectIsSubsetMatch(subject, JSApiObjectGet)
+	if get && (req.DeliverSubject == _EMPTY_ || !IsValidLiteralSubject(req.DeliverSubject)) {
+		resp.Error = &ApiError{Code: 400, Description: "get requires a valid deliver subject"}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	mset, store := jsa.objStream(bucket, &resp.ApiResponse)
+	if mset == nil {
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	if resp.ObjectInfo, _ = loadObjectInfo(store, bucket, req.Name); resp.ObjectInfo == nil {
+		resp.Error = &ApiError{Code: 404, Description: "object not found"}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	var seqs []uint64
+	if get {
+		seqs = store.SubjectSeqs(fmt.Sprintf(ObjectChunksT, bucket, resp.Nuid))
+		if len(seqs) != int(resp.Chunks) {
+			resp.ObjectInfo = nil
+			resp.Error = &ApiError{Code: 500, Description: "object chunks missing"}
+		}
+	}
+	// Send the response first so that it is queued ahead of the chunks.
+	jsa.sendAPIResponse(reply, &resp)
+	if resp.Error == nil && len(seqs) > 0 {
+		rreq := &JSApiStreamReplayRequest{
+			DeliverSubject: req.DeliverSubject,
+			FilterSubject:  fmt.Sprintf(ObjectChunksT, bucket, resp.Nuid),
+		}
+		mset.startReplay(rreq, seqs[0], seqs[len(seqs)-1])
+	}
+}
+
+// Request to delete an object with its chunks.
+func (jsa *jsAccount) jsObjectDeleteRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	bucket := streamNameFromSubject(subject)
+	if !jsa.answersFor(objStreamPrefix + bucket) {
+		return
+	}
+	resp := JSApiObjectDeleteResponse{ApiResponse: ApiResponse{Type: JSApiObjectDeleteResponseType}}
+	var req JSApiObjectRequest
+	if err := json.Unmarshal(msg, &req); err != nil || req.Name == _EMPTY_ {
+		resp.Error = &ApiError{Code: 400, Description: "request requires an object name"}
+		jsa.sendAPIResponse(reply, &resp)
+		return
+	}
+	if mset, store := jsa.objStream(bucket, &resp.ApiResponse); mset != nil {
+		if info, seq := loadObjectInfo(store, bucket, req.Name); info == nil {
+			resp.Error = &ApiError{Code: 404, Description: "object not found"}
+		} else {
+			mset.removeStoredMsg(store, seq)
+			mset.removeObjectChunks(store, bucket, info.Nuid)
+			resp.Success = true
+		}
+	}
+	jsa.sendAPIResponse(reply, &resp)
+}
+
+// Request for the metadata of all the objects of a store.
+func (jsa *jsAccount) jsObjectListRequest(sub *subscription, subject, reply string, _, msg []byte) {
+	bucket := streamNameFromSubject(subject)
+	if !jsa.answersFor(objStreamPrefix + bucket) {
+		return
+	}
+	resp := JSApiObjectListResponse{ApiResponse: ApiResponse{Type: JSApiObjectListResponseType}, Objects: []*ObjectInfo{}}
+	if mset, store := jsa.objStream(bucket, &resp.ApiResponse); mset != nil {
+		for _, seq := range store.LastSeqs(fmt.Sprintf(objMetaAllT, bucket)) {
+			sm, err := store.LoadMsg(seq)
+			if err != nil {
+				continue
+			}
+			var info ObjectInfo
+			if json.Unmarshal(sm.Data, &info) == nil {
+				resp.Objects = append(resp.Objects, &info)
+			}
+		}
+	}
+	jsa.sendAPIResponse(reply, &resp)
+}
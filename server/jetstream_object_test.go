@@ -0,0 +1,141 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Publishes the object in chunks and puts it.
+func objPut(t *testing.T, nc *nats.Conn, bucket, name, nuid string, data []byte, chunkSize int) *JSPubAckResponse {
+	t.Helper()
+	info := &ObjectInfo{Name: name, Nuid: nuid, Size: uint64(len(data))}
+	for i := 0; i < len(data); i += chunkSize {
+		end := i + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err := nc.Request(fmt.Sprintf(ObjectChunksT, bucket, nuid), data[i:end], time.Second); err != nil {
+			t.Fatalf("Error publishing chunk: %v", err)
+		}
+		info.Chunks++
+	}
+	var resp JSPubAckResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiObjectPutT, bucket), info, &resp)
+	return &resp
+}
+
+func TestJetStreamObjectStore(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	opts := DefaultOptions()
+	opts.Cluster.Port = 0
+	opts.JetStream = true
+	opts.StoreDir = storeDir
+	opts.MaxPayload = 1024
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+
+	var cresp JSApiStreamCreateResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiObjectStoreCreateT, "FILES"), &ObjectStoreConfig{Bucket: "FILES"}, &cresp)
+	if cresp.Error != nil || cresp.Config.Name != "OBJ_FILES" {
+		t.Fatalf("Unexpected create response: %+v", cresp)
+	}
+
+	// The object is larger than the maximum payload.
+	data := make([]byte, 10000)
+	rand.Read(data)
+	if ack := objPut(t, nc, "FILES", "reports/2020.pdf", "N1", data, 1000); ack.Error != nil {
+		t.Fatalf("Unexpected put response: %+v", ack)
+	}
+	sum := sha256.Sum256(data)
+	digest := "SHA-256=" + base64.URLEncoding.EncodeToString(sum[:])
+	var iresp JSApiObjectInfoResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiObjectInfoT, "FILES"), &JSApiObjectRequest{Name: "reports/2020.pdf"}, &iresp)
+	if iresp.Error != nil || iresp.Size != 10000 || iresp.Chunks != 10 || iresp.Digest != digest {
+		t.Fatalf("Unexpected info response: %+v", iresp)
+	}
+
+	sub := natsSubSync(t, nc, "get.1")
+	var gresp JSApiObjectInfoResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiObjectGetT, "FILES"), &JSApiObjectRequest{Name: "reports/2020.pdf", DeliverSubject: "get.1"}, &gresp)
+	if gresp.Error != nil || gresp.Chunks != 10 {
+		t.Fatalf("Unexpected get response: %+v", gresp)
+	}
+	var got []byte
+	for i := 0; i < 10; i++ {
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Error getting chunk: %v", err)
+		}
+		got = append(got, m.Data...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Object content does not match")
+	}
+
+	// Objects failing the checks are rejected and their chunks removed.
+	for i := 0; i < 3; i++ {
+		nc.Request(fmt.Sprintf(ObjectChunksT, "FILES", "N2"), data[i*1000:(i+1)*1000], time.Second)
+	}
+	var bad JSPubAckResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiObjectPutT, "FILES"), &ObjectInfo{Name: "bad", Nuid: "N2", Size: 3000, Chunks: 3, Digest: digest}, &bad)
+	if bad.Error == nil || bad.Error.Description != "object digest mismatch" {
+		t.Fatalf("Expected digest mismatch, got %+v", bad)
+	}
+	mset, _ := s.globalAccount().LookupStream("OBJ_FILES")
+	if seqs := mset.store.SubjectSeqs(fmt.Sprintf(ObjectChunksT, "FILES", "N2")); len(seqs) != 0 {
+		t.Fatalf("Expected chunks to be removed, got %v", seqs)
+	}
+
+	// Replacing an object removes the previous chunks.
+	if ack := objPut(t, nc, "FILES", "reports/2020.pdf", "N3", data[:1500], 1000); ack.Error != nil {
+		t.Fatalf("Unexpected put response: %+v", ack)
+	}
+	if seqs := mset.store.SubjectSeqs(fmt.Sprintf(ObjectChunksT, "FILES", "N1")); len(seqs) != 0 {
+		t.Fatalf("Expected chunks to be removed, got %v", seqs)
+	}
+	var lresp JSApiObjectListResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiObjectListT, "FILES"), nil, &lresp)
+	if lresp.Error != nil || len(lresp.Objects) != 1 || lresp.Objects[0].Nuid != "N3" || lresp.Objects[0].Size != 1500 {
+		t.Fatalf("Unexpected list response: %+v", lresp)
+	}
+
+	var dresp JSApiObjectDeleteResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiObjectDeleteT, "FILES"), &JSApiObjectRequest{Name: "reports/2020.pdf"}, &dresp)
+	if dresp.Error != nil || !dresp.Success {
+		t.Fatalf("Unexpected delete response: %+v", dresp)
+	}
+	if state := mset.State(); state.Msgs != 0 {
+		t.Fatalf("Expected no messages left, got %+v", state)
+	}
+	iresp = JSApiObjectInfoResponse{}
+	jsRequest(t, nc, fmt.Sprintf(JSApiObjectInfoT, "FILES"), &JSApiObjectRequest{Name: "reports/2020.pdf"}, &iresp)
+	if iresp.Error == nil || iresp.Error.Code != 404 {
+		t.Fatalf("Expected object not found, got %+v", iresp)
+	}
+}
@@ -0,0 +1,1679 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func runJetStreamServer(t *testing.T, storeDir string) *Server {
+	t.Helper()
+	opts := DefaultOptions()
+	opts.Cluster.Port = 0
+	opts.JetStream = true
+	opts.StoreDir = storeDir
+	return RunServer(opts)
+}
+
+func jsClientURL(s *Server) string {
+	opts := s.getOpts()
+	return fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+}
+
+func jsRequest(t *testing.T, nc *nats.Conn, subj string, req interface{}, resp interface{}) {
+	t.Helper()
+	var data []byte
+	if req != nil {
+		var err error
+		if data, err = json.Marshal(req); err != nil {
+			t.Fatalf("Error marshalling request: %v", err)
+		}
+	}
+	msg, err := nc.Request(subj, data, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Error on request %q: %v", subj, err)
+	}
+	if err := json.Unmarshal(msg.Data, resp); err != nil {
+		t.Fatalf("Error unmarshalling response %q: %v", msg.Data, err)
+	}
+}
+
+func jsCreateStream(t *testing.T, nc *nats.Conn, cfg *StreamConfig) *StreamInfo {
+	t.Helper()
+	var resp JSApiStreamCreateResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiStreamCreateT, cfg.Name), cfg, &resp)
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error creating stream: %+v", resp.Error)
+	}
+	if resp.Type != JSApiStreamCreateResponseType || resp.StreamInfo == nil {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	return resp.StreamInfo
+}
+
+func jsPublish(t *testing.T, nc *nats.Conn, subj, msg string) *JSPubAckResponse {
+	t.Helper()
+	var resp JSPubAckResponse
+	jsRequest(t, nc, subj, msg, &resp)
+	return &resp
+}
+
+// A client connection with headers, which the client library used by the
+// tests does not support.
+type jsHdrConn struct {
+	t   *testing.T
+	nc  net.Conn
+	br  *bufio.Reader
+	sid int
+}
+
+// A message received by a jsHdrConn.
+type jsHdrMsg struct {
+	subject string
+	reply   string
+	hdr     []byte
+	data    []byte
+}
+
+func newJSHdrConn(t *testing.T, clientURL string) *jsHdrConn {
+	t.Helper()
+	u, err := url.Parse(clientURL)
+	if err != nil {
+		t.Fatalf("Error parsing url %q: %v", clientURL, err)
+	}
+	nc, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	hc := &jsHdrConn{t: t, nc: nc, br: bufio.NewReader(nc)}
+	pwd, _ := u.User.Password()
+	hc.send(fmt.Sprintf("CONNECT {\"verbose\":false,\"headers\":true,\"user\":%q,\"pass\":%q}\r\n", u.User.Username(), pwd))
+	hc.flush()
+	return hc
+}
+
+func (hc *jsHdrConn) close() {
+	hc.nc.Close()
+}
+
+func (hc *jsHdrConn) send(proto string) {
+	hc.t.Helper()
+	if _, err := hc.nc.Write([]byte(proto)); err != nil {
+		hc.t.Fatalf("Error sending %q: %v", proto, err)
+	}
+}
+
+// Waits for the server to process what was sent, no message must be
+// received in the meantime.
+func (hc *jsHdrConn) flush() {
+	hc.t.Helper()
+	hc.send("PING\r\n")
+	hc.nc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer hc.nc.SetReadDeadline(time.Time{})
+	for {
+		l, err := hc.br.ReadString('\n')
+		if err == nil && strings.HasPrefix(l, "INFO") {
+			continue
+		}
+		if err != nil || l != "PONG\r\n" {
+			hc.t.Fatalf("Expected a PONG, got %q: %v", l, err)
+		}
+		return
+	}
+}
+
+// Subscribes to the subject and returns the sid.
+func (hc *jsHdrConn) subscribe(subj string) int {
+	hc.t.Helper()
+	hc.sid++
+	hc.send(fmt.Sprintf("SUB %s %d\r\n", subj, hc.sid))
+	hc.flush()
+	return hc.sid
+}
+
+// Publishes the message, with HPUB if it has a header block.
+func (hc *jsHdrConn) publish(subj, reply, hdr string, data []byte) {
+	hc.t.Helper()
+	if reply != _EMPTY_ {
+		subj += " " + reply
+	}
+	if hdr == _EMPTY_ {
+		hc.send(fmt.Sprintf("PUB %s %d\r\n%s\r\n", subj, len(data), data))
+	} else {
+		hc.send(fmt.Sprintf("HPUB %s %d %d\r\n%s%s\r\n", subj, len(hdr), len(hdr)+len(data), hdr, data))
+	}
+}
+
+// Returns the next message received by the subscriptions.
+func (hc *jsHdrConn) nextMsg(timeout time.Duration) *jsHdrMsg {
+	hc.t.Helper()
+	hc.nc.SetReadDeadline(time.Now().Add(timeout))
+	defer hc.nc.SetReadDeadline(time.Time{})
+	for {
+		l, err := hc.br.ReadString('\n')
+		if err != nil {
+			hc.t.Fatalf("Error reading message: %v", err)
+		}
+		args := strings.Fields(l)
+		if len(args) == 0 {
+			continue
+		}
+		nargs, hl := 4, 0
+		switch args[0] {
+		case "PING":
+			hc.send("PONG\r\n")
+			continue
+		case "INFO":
+			continue
+		case "MSG":
+		case "HMSG":
+			nargs++
+			hl, _ = strconv.Atoi(args[len(args)-2])
+		default:
+			hc.t.Fatalf("Unexpected protocol %q", l)
+		}
+		m := &jsHdrMsg{subject: args[1]}
+		if len(args) > nargs {
+			m.reply = args[3]
+		}
+		size, _ := strconv.Atoi(args[len(args)-1])
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(hc.br, buf); err != nil {
+			hc.t.Fatalf("Error reading message: %v", err)
+		}
+		if hl > 0 {
+			m.hdr = buf[:hl]
+		}
+		m.data = buf[hl:size]
+		return m
+	}
+}
+
+// Sends the request and returns the data of the response.
+func (hc *jsHdrConn) request(subj, hdr string, data []byte) []byte {
+	hc.t.Helper()
+	inbox := nats.NewInbox()
+	sid := hc.subscribe(inbox)
+	hc.send(fmt.Sprintf("UNSUB %d 1\r\n", sid))
+	hc.publish(subj, inbox, hdr, data)
+	return hc.nextMsg(2 * time.Second).data
+}
+
+func TestJetStreamStreamBasics(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	s := runJetStreamServer(t, storeDir)
+	defer s.Shutdown()
+
+	if !s.JetStreamEnabled() {
+		t.Fatalf("Expected JetStream to be enabled")
+	}
+	nc := natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+
+	for _, st := range []StorageType{MemoryStorage, FileStorage} {
+		t.Run(st.String(), func(t *testing.T) {
+			name := "ORDERS_" + strings.ToUpper(st.String())
+			subj := strings.ToLower(st.String()) + ".orders.*"
+			si := jsCreateStream(t, nc, &StreamConfig{Name: name, Subjects: []string{subj}, Storage: st})
+			if si.Config.Name != name || si.Config.MaxMsgs != -1 || si.State.Msgs != 0 {
+				t.Fatalf("Unexpected stream info: %+v", si)
+			}
+			pub := strings.ToLower(st.String()) + ".orders.new"
+			for i := 1; i <= 10; i++ {
+				ack := jsPublish(t, nc, pub, fmt.Sprintf("order-%d", i))
+				if ack.Error != nil || ack.PubAck == nil || ack.Stream != name || ack.Seq != uint64(i) {
+					t.Fatalf("Unexpected publish ack: %+v", ack)
+				}
+			}
+			var info JSApiStreamInfoResponse
+			jsRequest(t, nc, fmt.Sprintf(JSApiStreamInfoT, name), nil, &info)
+			if info.Error != nil || info.State.Msgs != 10 || info.State.LastSeq != 10 {
+				t.Fatalf("Unexpected stream info: %+v", info)
+			}
+
+			var get JSApiMsgGetResponse
+			jsRequest(t, nc, fmt.Sprintf(JSApiMsgGetT, name), &JSApiMsgGetRequest{Seq: 5}, &get)
+			if get.Error != nil || get.Message == nil || string(get.Message.Data) != "\"order-5\"" || get.Message.Subject != pub {
+				t.Fatalf("Unexpected message: %+v", get)
+			}
+			var del JSApiMsgDeleteResponse
+			jsRequest(t, nc, fmt.Sprintf(JSApiMsgDeleteT, name), &JSApiMsgDeleteRequest{Seq: 5}, &del)
+			if !del.Success {
+				t.Fatalf("Unexpected delete response: %+v", del)
+			}
+			get = JSApiMsgGetResponse{}
+			jsRequest(t, nc, fmt.Sprintf(JSApiMsgGetT, name), &JSApiMsgGetRequest{Seq: 5}, &get)
+			if get.Error == nil || get.Error.Code != 404 {
+				t.Fatalf("Expected not found error, got %+v", get)
+			}
+
+			var purge JSApiStreamPurgeResponse
+			jsRequest(t, nc, fmt.Sprintf(JSApiStreamPurgeT, name), nil, &purge)
+			if !purge.Success || purge.Purged != 9 {
+				t.Fatalf("Unexpected purge response: %+v", purge)
+			}
+			if usage := s.globalAccount().JetStreamUsage(); usage.Memory != 0 || usage.Store != 0 {
+				t.Fatalf("Expected no usage after purge, got %+v", usage)
+			}
+
+			var dresp JSApiStreamDeleteResponse
+			jsRequest(t, nc, fmt.Sprintf(JSApiStreamDeleteT, name), nil, &dresp)
+			if !dresp.Success {
+				t.Fatalf("Unexpected delete response: %+v", dresp)
+			}
+			if _, err := s.globalAccount().LookupStream(name); err != ErrJetStreamStreamNotFound {
+				t.Fatalf("Expected stream to be deleted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestJetStreamStreamConfigErrors(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	s := runJetStreamServer(t, storeDir)
+	defer s.Shutdown()
+
+	acc := s.globalAccount()
+	if _, err := acc.AddStream(&StreamConfig{Name: "foo.bar"}); err == nil {
+		t.Fatalf("Expected error for invalid name")
+	}
+	if _, err := acc.AddStream(&StreamConfig{Name: "FOO", Subjects: []string{"foo.*", "foo.bar"}}); err == nil {
+		t.Fatalf("Expected error for overlapping subjects")
+	}
+	if _, err := acc.AddStream(&StreamConfig{Name: "FOO", Subjects: []string{"$JS.API.>"}}); err == nil {
+		t.Fatalf("Expected error for reserved subjects")
+	}
+	if _, err := acc.AddStream(&StreamConfig{Name: "FOO", Replicas: 3}); err == nil ||
+		!strings.Contains(err.Error(), "non-clustered") {
+		t.Fatalf("Expected error for replicas without a cluster, got %v", err)
+	}
+	if _, err := acc.AddStream(&StreamConfig{Name: "FOO", Replicas: StreamMaxReplicas + 1}); err == nil {
+		t.Fatalf("Expected error for too many replicas")
+	}
+	if _, err := acc.AddStream(&StreamConfig{Name: "FOO", MaxAge: time.Second, Duplicates: time.Minute}); err == nil {
+		t.Fatalf("Expected error for duplicates window larger than max age")
+	}
+	if _, err := acc.AddStream(&StreamConfig{Name: "FOO", Subjects: []string{"foo.>"}}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := acc.AddStream(&StreamConfig{Name: "FOO"}); err != ErrJetStreamStreamExists {
+		t.Fatalf("Expected stream exists error, got %v", err)
+	}
+	if _, err := acc.AddStream(&StreamConfig{Name: "BAR", Subjects: []string{"*.baz"}}); err == nil ||
+		!strings.Contains(err.Error(), "overlap") {
+		t.Fatalf("Expected error for subjects overlapping another stream, got %v", err)
+	}
+
+	nc := natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+
+	var resp JSApiStreamCreateResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiStreamCreateT, "BAZ"), &StreamConfig{Name: "OTHER"}, &resp)
+	if resp.Error == nil || resp.Error.Code != 400 {
+		t.Fatalf("Expected error for name mismatch, got %+v", resp)
+	}
+	var names JSApiStreamNamesResponse
+	jsRequest(t, nc, JSApiStreamNames, nil, &names)
+	if len(names.Streams) != 1 || names.Streams[0] != "FOO" {
+		t.Fatalf("Unexpected stream names: %+v", names)
+	}
+}
+
+func TestJetStreamLimitsAndDiscard(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	s := runJetStreamServer(t, storeDir)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+
+	jsCreateStream(t, nc, &StreamConfig{Name: "OLD", MaxMsgs: 5})
+	jsCreateStream(t, nc, &StreamConfig{Name: "NEW", MaxMsgs: 5, Discard: DiscardNew, MaxMsgSize: 10})
+	for i := 0; i < 10; i++ {
+		if ack := jsPublish(t, nc, "OLD", "hello"); ack.Error != nil {
+			t.Fatalf("Unexpected error: %+v", ack.Error)
+		}
+		ack := jsPublish(t, nc, "NEW", "hello")
+		if i < 5 && ack.Error != nil {
+			t.Fatalf("Unexpected error: %+v", ack.Error)
+		} else if i >= 5 && ack.Error == nil {
+			t.Fatalf("Expected error once limit is reached")
+		}
+	}
+	mset, _ := s.globalAccount().LookupStream("OLD")
+	if state := mset.State(); state.Msgs != 5 || state.FirstSeq != 6 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	mset, _ = s.globalAccount().LookupStream("NEW")
+	if state := mset.State(); state.Msgs != 5 || state.LastSeq != 5 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	mset.Purge()
+	if ack := jsPublish(t, nc, "NEW", "hello world!"); ack.Error == nil {
+		t.Fatalf("Expected error for message too large")
+	}
+}
+
+func TestJetStreamMsgIdDuplicates(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	s := runJetStreamServer(t, storeDir)
+	defer func() { s.Shutdown() }()
+
+	nc := natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+
+	info := jsCreateStream(t, nc, &StreamConfig{Name: "DD", Storage: FileStorage, Duplicates: 250 * time.Millisecond})
+	if info.Config.Duplicates != 250*time.Millisecond {
+		t.Fatalf("Unexpected config: %+v", info.Config)
+	}
+	hc := newJSHdrConn(t, jsClientURL(s))
+	defer func() { hc.close() }()
+	publish := func(hdr string) *PubAck {
+		t.Helper()
+		data := hc.request("DD", hdr, []byte("hello"))
+		var resp JSPubAckResponse
+		if err := json.Unmarshal(data, &resp); err != nil || resp.Error != nil {
+			t.Fatalf("Unexpected response %q: %v", data, err)
+		}
+		return resp.PubAck
+	}
+	withId := func(id string) string {
+		return fmt.Sprintf("NATS/1.0\r\n%s: %s\r\n\r\n", JSMsgId, id)
+	}
+	if ack := publish(withId("1")); ack.Seq != 1 || ack.Duplicate {
+		t.Fatalf("Unexpected ack: %+v", ack)
+	}
+	if ack := publish(withId("2")); ack.Seq != 2 || ack.Duplicate {
+		t.Fatalf("Unexpected ack: %+v", ack)
+	}
+	if ack := publish(withId("1")); ack.Seq != 1 || !ack.Duplicate {
+		t.Fatalf("Expected duplicate ack, got %+v", ack)
+	}
+	mset, _ := s.globalAccount().LookupStream("DD")
+	if state := mset.State(); state.Msgs != 2 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+
+	// The ids within the window are recovered on restart.
+	nc.Close()
+	s.Shutdown()
+	s = runJetStreamServer(t, storeDir)
+	nc = natsConnect(t, jsClientURL(s))
+	hc.close()
+	hc = newJSHdrConn(t, jsClientURL(s))
+	if ack := publish(withId("2")); ack.Seq != 2 || !ack.Duplicate {
+		t.Fatalf("Expected duplicate ack, got %+v", ack)
+	}
+
+	// Once the window expires the message is stored again.
+	time.Sleep(300 * time.Millisecond)
+	if ack := publish(withId("1")); ack.Seq != 3 || ack.Duplicate {
+		t.Fatalf("Unexpected ack: %+v", ack)
+	}
+	mset, _ = s.globalAccount().LookupStream("DD")
+	checkFor(t, time.Second, 50*time.Millisecond, func() error {
+		mset.ddMu.Lock()
+		defer mset.ddMu.Unlock()
+		if ids := len(mset.ddmap); ids != 1 {
+			return fmt.Errorf("Expected expired ids to be removed, got %d ids", ids)
+		}
+		return nil
+	})
+
+	// Only the headers of the protocol are used, a payload that looks like
+	// a header block is stored and delivered as such.
+	spoof := []byte(withId("1") + "hello")
+	for i := 0; i < 2; i++ {
+		var resp JSPubAckResponse
+		if data := hc.request("DD", _EMPTY_, spoof); json.Unmarshal(data, &resp) != nil || resp.Error != nil || resp.Duplicate {
+			t.Fatalf("Unexpected response %q", data)
+		}
+	}
+	hc.subscribe("d")
+	jsCreateConsumer(t, nc, "DD", &ConsumerConfig{DeliverSubject: "d", DeliverPolicy: DeliverLast, AckPolicy: AckNone})
+	if m := hc.nextMsg(time.Second); m.hdr != nil || !bytes.Equal(m.data, spoof) {
+		t.Fatalf("Unexpected message %q %q", m.hdr, m.data)
+	}
+}
+
+func TestJetStreamInterestRetentionWithoutConsumers(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	s := runJetStreamServer(t, storeDir)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+
+	jsCreateStream(t, nc, &StreamConfig{Name: "IP", Retention: InterestPolicy})
+	jsCreateStream(t, nc, &StreamConfig{Name: "WQ", Retention: WorkQueuePolicy})
+	for i := 0; i < 5; i++ {
+		if ack := jsPublish(t, nc, "IP", "hello"); ack.Error != nil || ack.Seq != uint64(i+1) {
+			t.Fatalf("Unexpected ack: %+v", ack)
+		}
+		jsPublish(t, nc, "WQ", "hello")
+	}
+	mset, _ := s.globalAccount().LookupStream("IP")
+	if state := mset.State(); state.Msgs != 0 || state.LastSeq != 5 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	mset, _ = s.globalAccount().LookupStream("WQ")
+	if state := mset.State(); state.Msgs != 5 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+}
+
+func TestJetStreamReplay(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	s := runJetStreamServer(t, storeDir)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+
+	jsCreateStream(t, nc, &StreamConfig{Name: "EVENTS", Subjects: []string{"events.>"}})
+	for i := 0; i < 20; i++ {
+		jsPublish(t, nc, fmt.Sprintf("events.%d", i%2), fmt.Sprintf("%d", i))
+	}
+
+	sub := natsSubSync(t, nc, "replay")
+	natsFlush(t, nc)
+
+	req := &JSApiStreamReplayRequest{DeliverSubject: "replay", StartSeq: 5, FilterSubject: "events.1"}
+	var resp JSApiStreamReplayResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiStreamReplayT, "EVENTS"), req, &resp)
+	if resp.Error != nil || resp.NumPending != 8 || resp.LastSeq != 20 {
+		t.Fatalf("Unexpected replay response: %+v", resp)
+	}
+	for i := 0; i < 8; i++ {
+		msg := natsNexMsg(t, sub, time.Second)
+		// Messages are presented with the subject they were stored under.
+		if msg.Subject != "events.1" {
+			t.Fatalf("Unexpected subject: %q", msg.Subject)
+		}
+		expected := fmt.Sprintf("\"%d\"", 5+i*2)
+		if string(msg.Data) != expected {
+			t.Fatalf("Expected %s, got %s", expected, msg.Data)
+		}
+		if !strings.HasPrefix(msg.Reply, fmt.Sprintf("$JS.REPLAY.EVENTS.%d.", 6+i*2)) {
+			t.Fatalf("Unexpected reply: %q", msg.Reply)
+		}
+	}
+	if msg, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected message: %+v", msg)
+	}
+
+	resp = JSApiStreamReplayResponse{}
+	jsRequest(t, nc, fmt.Sprintf(JSApiStreamReplayT, "EVENTS"), &JSApiStreamReplayRequest{DeliverSubject: "replay.*"}, &resp)
+	if resp.Error == nil {
+		t.Fatalf("Expected error for wildcard deliver subject")
+	}
+}
+
+func TestJetStreamFileStreamRecovery(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	s := runJetStreamServer(t, storeDir)
+
+	nc := natsConnect(t, jsClientURL(s))
+	jsCreateStream(t, nc, &StreamConfig{Name: "FS", Subjects: []string{"fs.>"}, Storage: FileStorage, MaxMsgs: 100})
+	jsCreateStream(t, nc, &StreamConfig{Name: "MS", Subjects: []string{"ms.>"}})
+	for i := 0; i < 10; i++ {
+		jsPublish(t, nc, "fs.foo", "hello")
+		jsPublish(t, nc, "ms.foo", "hello")
+	}
+	nc.Close()
+	usage := s.globalAccount().JetStreamUsage()
+	if usage.Streams != 2 || usage.Store == 0 || usage.Memory == 0 {
+		t.Fatalf("Unexpected usage: %+v", usage)
+	}
+	s.Shutdown()
+
+	s = runJetStreamServer(t, storeDir)
+	defer s.Shutdown()
+
+	mset, err := s.globalAccount().LookupStream("FS")
+	if err != nil {
+		t.Fatalf("Expected file stream to be recovered: %v", err)
+	}
+	if cfg := mset.Config(); cfg.MaxMsgs != 100 || cfg.Subjects[0] != "fs.>" {
+		t.Fatalf("Unexpected config: %+v", cfg)
+	}
+	if state := mset.State(); state.Msgs != 10 || state.LastSeq != 10 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	if _, err := s.globalAccount().LookupStream("MS"); err != ErrJetStreamStreamNotFound {
+		t.Fatalf("Expected memory stream to be gone, got %v", err)
+	}
+	if u := s.globalAccount().JetStreamUsage(); u.Store != usage.Store || u.Memory != 0 || u.Streams != 1 {
+		t.Fatalf("Unexpected usage: %+v", u)
+	}
+
+	nc = natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+	if ack := jsPublish(t, nc, "fs.bar", "hello"); ack.Error != nil || ack.Seq != 11 {
+		t.Fatalf("Unexpected ack: %+v", ack)
+	}
+}
+
+func TestJetStreamAccounts(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		jetstream {
+			store_dir: %q
+			max_memory_store: 1MB
+		}
+		accounts {
+			A { users [{user: a, password: pwd}] }
+			B { users [{user: b, password: pwd}] }
+		}
+	`, storeDir)))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	if cfg := s.JetStreamConfig(); cfg == nil || cfg.MaxMemory != 1024*1024 || cfg.StoreDir != storeDir {
+		t.Fatalf("Unexpected config: %+v", cfg)
+	}
+	nca := natsConnect(t, fmt.Sprintf("nats://a:pwd@%s:%d", opts.Host, opts.Port))
+	defer nca.Close()
+	ncb := natsConnect(t, fmt.Sprintf("nats://b:pwd@%s:%d", opts.Host, opts.Port))
+	defer ncb.Close()
+
+	// Streams with the same name and subjects can exist in each account.
+	jsCreateStream(t, nca, &StreamConfig{Name: "S"})
+	jsCreateStream(t, ncb, &StreamConfig{Name: "S"})
+	jsPublish(t, nca, "S", "hello")
+
+	var info JSApiAccountInfoResponse
+	jsRequest(t, nca, JSApiInfo, nil, &info)
+	if info.Error != nil || info.Streams != 1 || info.Memory == 0 {
+		t.Fatalf("Unexpected account info: %+v", info)
+	}
+	info = JSApiAccountInfoResponse{}
+	jsRequest(t, ncb, JSApiInfo, nil, &info)
+	if info.Error != nil || info.Streams != 1 || info.Memory != 0 {
+		t.Fatalf("Unexpected account info: %+v", info)
+	}
+
+	// A message larger than the remaining memory is rejected once the
+	// limit is reached.
+	big := strings.Repeat("x", 512*1024)
+	jsPublish(t, ncb, "S", big)
+	jsPublish(t, ncb, "S", big)
+	if ack := jsPublish(t, ncb, "S", "hello"); ack.Error == nil {
+		t.Fatalf("Expected error once the server limit is reached")
+	}
+}
+
+func TestJetStreamConfigValidation(t *testing.T) {
+	opts := DefaultOptions()
+	opts.JetStream = true
+	opts.Cluster.Port = -1
+	if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "clustered mode") {
+		t.Fatalf("Expected error for jetstream in a cluster, got %v", err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		content string
+		enabled bool
+		err     string
+	}{
+		{"bool", "jetstream: true", true, ""},
+		{"string", "jetstream: enabled", true, ""},
+		{"disabled", "jetstream: disabled", false, ""},
+		{"block", "jetstream { max_file_store: 10MB }", true, ""},
+		{"bad string", "jetstream: maybe", false, "Expected 'enabled' or 'disabled'"},
+		{"unknown field", "jetstream { max_foo: 1 }", false, "unknown field"},
+		{"encryption", "jetstream { key: s3cr3t, cipher: aes }", true, ""},
+		{"chacha encryption", "jetstream { key: s3cr3t, cipher: chacha }", true, ""},
+		{"bad cipher", "jetstream { key: s3cr3t, cipher: des }", false, "not supported"},
+		{"tier", "jetstream { tier { endpoint: \"http://localhost:9000\", bucket: nats } }", true, ""},
+		{"tier no bucket", "jetstream { tier { endpoint: \"http://localhost:9000\" } }", false, "endpoint and a bucket"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(test.content))
+			defer os.Remove(conf)
+			o, err := ProcessConfigFile(conf)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if o.JetStream != test.enabled {
+				t.Fatalf("Expected enabled to be %v", test.enabled)
+			}
+		})
+	}
+
+	// The key is usually taken from the environment.
+	os.Setenv("JS_TEST_KEY", "s3cr3t")
+	defer os.Unsetenv("JS_TEST_KEY")
+	conf := createConfFile(t, []byte("jetstream { key: $JS_TEST_KEY }"))
+	defer os.Remove(conf)
+	o, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if o.JetStreamKey != "s3cr3t" {
+		t.Fatalf("Unexpected key %q", o.JetStreamKey)
+	}
+}
+
+func jsCreateConsumer(t *testing.T, nc *nats.Conn, stream string, cfg *ConsumerConfig) *ConsumerInfo {
+	t.Helper()
+	subj := fmt.Sprintf(JSApiConsumerCreateT, stream)
+	if cfg.Durable != _EMPTY_ {
+		subj = fmt.Sprintf(JSApiDurableCreateT, stream, cfg.Durable)
+	}
+	var resp JSApiConsumerCreateResponse
+	jsRequest(t, nc, subj, &CreateConsumerRequest{Stream: stream, Config: *cfg}, &resp)
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error creating consumer: %+v", resp.Error)
+	}
+	if resp.Type != JSApiConsumerCreateResponseType || resp.ConsumerInfo == nil {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	return resp.ConsumerInfo
+}
+
+// Requests the next message of a pull consumer. Messages are delivered
+// with their original subject, so a dedicated inbox is used instead of
+// the request muxer of the client.
+func jsNextMsg(t *testing.T, nc *nats.Conn, stream, consumer string) *nats.Msg {
+	t.Helper()
+	inbox := nats.NewInbox()
+	sub := natsSubSync(t, nc, inbox)
+	defer sub.Unsubscribe()
+	if err := nc.PublishRequest(fmt.Sprintf(JSApiRequestNextT, stream, consumer), inbox, nil); err != nil {
+		t.Fatalf("Error requesting next message: %v", err)
+	}
+	return natsNexMsg(t, sub, time.Second)
+}
+
+func TestJetStreamPushConsumer(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	s := runJetStreamServer(t, storeDir)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+
+	jsCreateStream(t, nc, &StreamConfig{Name: "ORDERS", Subjects: []string{"orders.*"}})
+	for i := 0; i < 5; i++ {
+		jsPublish(t, nc, "orders.new", "hello")
+		jsPublish(t, nc, "orders.old", "hello")
+	}
+
+	sub := natsSubSync(t, nc, "d")
+	natsFlush(t, nc)
+	ci := jsCreateConsumer(t, nc, "ORDERS", &ConsumerConfig{DeliverSubject: "d", FilterSubject: "orders.new", AckPolicy: AckExplicit})
+	if ci.Name == _EMPTY_ || ci.Config.AckWait != JsAckWaitDefault || ci.NumPending != 5 {
+		t.Fatalf("Unexpected consumer info: %+v", ci)
+	}
+	for i := 0; i < 5; i++ {
+		m := natsNexMsg(t, sub, time.Second)
+		if m.Subject != "orders.new" {
+			t.Fatalf("Unexpected subject %q", m.Subject)
+		}
+		if !strings.HasPrefix(m.Reply, fmt.Sprintf("$JS.ACK.ORDERS.%s.1.%d.%d.", ci.Name, 2*i+1, i+1)) {
+			t.Fatalf("Unexpected reply subject %q", m.Reply)
+		}
+		if _, err := nc.Request(m.Reply, nil, time.Second); err != nil {
+			t.Fatalf("Error acking message: %v", err)
+		}
+	}
+	var info JSApiConsumerInfoResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiConsumerInfoT, "ORDERS", ci.Name), nil, &info)
+	if info.Error != nil || info.NumAckPending != 0 || info.AckFloor.Stream != 10 || info.Delivered.Consumer != 5 {
+		t.Fatalf("Unexpected consumer info: %+v", info.ConsumerInfo)
+	}
+	var names JSApiConsumerNamesResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiConsumerNamesT, "ORDERS"), nil, &names)
+	if len(names.Consumers) != 1 || names.Consumers[0] != ci.Name {
+		t.Fatalf("Unexpected consumer names: %+v", names)
+	}
+	var si JSApiStreamInfoResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiStreamInfoT, "ORDERS"), nil, &si)
+	if si.State.Consumers != 1 {
+		t.Fatalf("Expected 1 consumer, got %d", si.State.Consumers)
+	}
+
+	// Ephemeral consumers go away once the deliver subject has no interest.
+	sub.Unsubscribe()
+	natsFlush(t, nc)
+	mset, _ := s.globalAccount().LookupStream("ORDERS")
+	checkFor(t, 3*jsEphemeralInactiveThreshold, 100*time.Millisecond, func() error {
+		if n := len(mset.Consumers()); n != 0 {
+			return fmt.Errorf("Expected no consumers, got %d", n)
+		}
+		return nil
+	})
+}
+
+func TestJetStreamConsumerRedelivery(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	s := runJetStreamServer(t, storeDir)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+
+	jsCreateStream(t, nc, &StreamConfig{Name: "ORDERS", Subjects: []string{"orders"}})
+	jsPublish(t, nc, "orders", "hello")
+	jsPublish(t, nc, "orders", "world")
+
+	sub := natsSubSync(t, nc, "d")
+	natsFlush(t, nc)
+	jsCreateConsumer(t, nc, "ORDERS", &ConsumerConfig{
+		Durable:        "dlc",
+		DeliverSubject: "d",
+		AckPolicy:      AckExplicit,
+		AckWait:        100 * time.Millisecond,
+		MaxDeliver:     3,
+	})
+
+	// Ack the second message only, the first one is redelivered until
+	// the max deliver count is reached.
+	m := natsNexMsg(t, sub, time.Second)
+	m2 := natsNexMsg(t, sub, time.Second)
+	m2.Respond(nil)
+	for dc := 2; dc <= 3; dc++ {
+		rm := natsNexMsg(t, sub, time.Second)
+		if string(rm.Data) != string(m.Data) {
+			t.Fatalf("Unexpected redelivered message %q", rm.Data)
+		}
+		if !strings.HasPrefix(rm.Reply, fmt.Sprintf("$JS.ACK.ORDERS.dlc.%d.1.", dc)) {
+			t.Fatalf("Unexpected reply subject %q", rm.Reply)
+		}
+	}
+	if rm, err := sub.NextMsg(300 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected redelivery: %q", rm.Reply)
+	}
+
+	// A nak redelivers right away, progress delays the redelivery.
+	jsPublish(t, nc, "orders", "again")
+	m = natsNexMsg(t, sub, time.Second)
+	m.Respond(AckNak)
+	m = natsNexMsg(t, sub, 50*time.Millisecond)
+	time.Sleep(60 * time.Millisecond)
+	m.Respond(AckProgress)
+	if _, err := sub.NextMsg(60 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected redelivery after progress")
+	}
+	m.Respond(AckTerm)
+	if _, err := sub.NextMsg(200 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected redelivery after term")
+	}
+	o := s.globalAccount().lookupTestStream(t, "ORDERS").LookupConsumer("dlc")
+	if info := o.Info(); info.NumAckPending != 0 || info.AckFloor.Stream != 3 {
+		t.Fatalf("Unexpected consumer info: %+v", info)
+	}
+}
+
+func (a *Account) lookupTestStream(t *testing.T, name string) *Stream {
+	t.Helper()
+	mset, err := a.LookupStream(name)
+	if err != nil {
+		t.Fatalf("Error looking up stream %q: %v", name, err)
+	}
+	return mset
+}
+
+func TestJetStreamPullConsumerWorkQueue(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	s := runJetStreamServer(t, storeDir)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+
+	jsCreateStream(t, nc, &StreamConfig{Name: "WQ", Subjects: []string{"wq.*"}, Retention: WorkQueuePolicy})
+	for i := 0; i < 10; i++ {
+		jsPublish(t, nc, "wq.a", fmt.Sprintf("job-%d", i))
+	}
+
+	// Pull consumers require a durable name and explicit acks.
+	var resp JSApiConsumerCreateResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiConsumerCreateT, "WQ"), &CreateConsumerRequest{Stream: "WQ", Config: ConsumerConfig{AckPolicy: AckExplicit}}, &resp)
+	if resp.Error == nil {
+		t.Fatalf("Expected an error for an ephemeral pull consumer")
+	}
+	jsCreateConsumer(t, nc, "WQ", &ConsumerConfig{Durable: "w1", FilterSubject: "wq.a", AckPolicy: AckExplicit})
+	resp = JSApiConsumerCreateResponse{}
+	jsRequest(t, nc, fmt.Sprintf(JSApiDurableCreateT, "WQ", "w2"), &CreateConsumerRequest{Stream: "WQ", Config: ConsumerConfig{Durable: "w2", AckPolicy: AckExplicit}}, &resp)
+	if resp.Error == nil || !strings.Contains(resp.Error.Description, "overlapping") {
+		t.Fatalf("Expected overlapping filters error, got %+v", resp.Error)
+	}
+
+	next := fmt.Sprintf(JSApiRequestNextT, "WQ", "w1")
+	m := jsNextMsg(t, nc, "WQ", "w1")
+	if string(m.Data) != "\"job-0\"" {
+		t.Fatalf("Unexpected message %q", m.Data)
+	}
+	nc.Publish(m.Reply, nil)
+
+	// Request a batch on a single inbox.
+	inbox := nats.NewInbox()
+	sub := natsSubSync(t, nc, inbox)
+	if err := nc.PublishRequest(next, inbox, []byte("4")); err != nil {
+		t.Fatalf("Error requesting batch: %v", err)
+	}
+	for i := 1; i <= 4; i++ {
+		m := natsNexMsg(t, sub, time.Second)
+		if string(m.Data) != fmt.Sprintf("\"job-%d\"", i) {
+			t.Fatalf("Unexpected message %q", m.Data)
+		}
+		if _, err := nc.Request(m.Reply, nil, time.Second); err != nil {
+			t.Fatalf("Error acking message: %v", err)
+		}
+	}
+	if _, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatalf("Expected only 4 messages")
+	}
+	// Acked messages are removed from the work queue.
+	mset := s.globalAccount().lookupTestStream(t, "WQ")
+	if state := mset.State(); state.Msgs != 5 || state.FirstSeq != 6 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+}
+
+func TestJetStreamInterestRetentionWithConsumers(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	s := runJetStreamServer(t, storeDir)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+
+	jsCreateStream(t, nc, &StreamConfig{Name: "IP", Subjects: []string{"ip"}, Retention: InterestPolicy})
+	mset := s.globalAccount().lookupTestStream(t, "IP")
+	o1, err := mset.AddConsumer(&ConsumerConfig{Durable: "o1", AckPolicy: AckExplicit})
+	if err != nil {
+		t.Fatalf("Error adding consumer: %v", err)
+	}
+	o2, err := mset.AddConsumer(&ConsumerConfig{Durable: "o2", AckPolicy: AckExplicit})
+	if err != nil {
+		t.Fatalf("Error adding consumer: %v", err)
+	}
+	jsPublish(t, nc, "ip", "hello")
+	if state := mset.State(); state.Msgs != 1 {
+		t.Fatalf("Expected message to be kept, got %+v", state)
+	}
+	for _, o := range []*Consumer{o1, o2} {
+		m := jsNextMsg(t, nc, "IP", o.Name())
+		if _, err := nc.Request(m.Reply, nil, time.Second); err != nil {
+			t.Fatalf("Error acking message: %v", err)
+		}
+		expected := uint64(1)
+		if o == o2 {
+			expected = 0
+		}
+		if state := mset.State(); state.Msgs != expected {
+			t.Fatalf("Expected %d msgs after ack from %q, got %d", expected, o.Name(), state.Msgs)
+		}
+	}
+	// Creating a durable with a different config is an error, the same
+	// config returns the existing consumer.
+	if o, err := mset.AddConsumer(&ConsumerConfig{Durable: "o1", AckPolicy: AckExplicit}); err != nil || o != o1 {
+		t.Fatalf("Expected existing consumer, got %v", err)
+	}
+	if _, err := mset.AddConsumer(&ConsumerConfig{Durable: "o1", AckPolicy: AckExplicit, MaxDeliver: 2}); err != ErrJetStreamConsumerExists {
+		t.Fatalf("Expected consumer exists error, got %v", err)
+	}
+}
+
+func TestJetStreamDurableConsumerRecovery(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	s := runJetStreamServer(t, storeDir)
+
+	nc := natsConnect(t, jsClientURL(s))
+	jsCreateStream(t, nc, &StreamConfig{Name: "FS", Subjects: []string{"fs"}, Storage: FileStorage})
+	for i := 0; i < 10; i++ {
+		jsPublish(t, nc, "fs", fmt.Sprintf("msg-%d", i))
+	}
+	jsCreateConsumer(t, nc, "FS", &ConsumerConfig{Durable: "dur", AckPolicy: AckExplicit})
+	for i := 0; i < 3; i++ {
+		m := jsNextMsg(t, nc, "FS", "dur")
+		if i < 2 {
+			if _, err := nc.Request(m.Reply, nil, time.Second); err != nil {
+				t.Fatalf("Error acking message: %v", err)
+			}
+		}
+	}
+	nc.Close()
+	s.Shutdown()
+
+	s = runJetStreamServer(t, storeDir)
+	defer s.Shutdown()
+
+	o := s.globalAccount().lookupTestStream(t, "FS").LookupConsumer("dur")
+	if o == nil {
+		t.Fatalf("Expected durable consumer to be recovered")
+	}
+	if info := o.Info(); info.Delivered.Stream != 3 || info.AckFloor.Stream != 2 || info.NumAckPending != 1 || info.NumPending != 7 {
+		t.Fatalf("Unexpected consumer info: %+v", info)
+	}
+	nc = natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+	if m := jsNextMsg(t, nc, "FS", "dur"); string(m.Data) != "\"msg-3\"" {
+		t.Fatalf("Unexpected message %q", m.Data)
+	}
+	var del JSApiConsumerDeleteResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiConsumerDeleteT, "FS", "dur"), nil, &del)
+	if !del.Success {
+		t.Fatalf("Unexpected delete response: %+v", del)
+	}
+}
+
+func TestJetStreamTieredStorage(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	s := runJetStreamServer(t, storeDir)
+	defer s.Shutdown()
+	nc := natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+
+	cfg := &StreamConfig{Name: "T", Storage: FileStorage, TierAfter: time.Hour}
+	var resp JSApiStreamCreateResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiStreamCreateT, "T"), cfg, &resp)
+	if resp.Error == nil || !strings.Contains(resp.Error.Description, "not configured") {
+		t.Fatalf("Expected tiered storage not configured error, got %+v", resp.Error)
+	}
+	resp = JSApiStreamCreateResponse{}
+	jsRequest(t, nc, fmt.Sprintf(JSApiStreamCreateT, "M"), &StreamConfig{Name: "M", Storage: MemoryStorage, TierAfter: time.Hour}, &resp)
+	if resp.Error == nil || !strings.Contains(resp.Error.Description, "requires file storage") {
+		t.Fatalf("Expected file storage error, got %+v", resp.Error)
+	}
+	nc.Close()
+	s.Shutdown()
+
+	ts := newTestS3Server(t)
+	defer ts.Close()
+	opts := DefaultOptions()
+	opts.Cluster.Port = 0
+	opts.JetStream = true
+	opts.StoreDir = storeDir
+	opts.JetStreamTier = &TierConfig{Endpoint: ts.URL, Bucket: "nats", AccessKey: "AK", SecretKey: "SK"}
+	s = RunServer(opts)
+	defer s.Shutdown()
+	nc = natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+
+	jsCreateStream(t, nc, cfg)
+	fs, ok := s.globalAccount().lookupTestStream(t, "T").store.(*fileStore)
+	if !ok || fs.fcfg.Tier == nil || fs.fcfg.TierPrefix != "$G/T" {
+		t.Fatalf("Expected the store to offload to the tier, got %+v", fs.fcfg)
+	}
+	if fs.tierChk == nil {
+		t.Fatalf("Expected the store to check for blocks to offload")
+	}
+}
+
+func TestJetStreamMirrorAndSources(t *testing.T) {
+	defer func(interval time.Duration) { sourceHealthInterval = interval }(sourceHealthInterval)
+	sourceHealthInterval = 100 * time.Millisecond
+
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	s := runJetStreamServer(t, storeDir)
+
+	nc := natsConnect(t, jsClientURL(s))
+	jsCreateStream(t, nc, &StreamConfig{Name: "ORDERS", Subjects: []string{"orders.*"}, Storage: FileStorage})
+	jsCreateStream(t, nc, &StreamConfig{Name: "EVENTS", Subjects: []string{"events"}, Storage: FileStorage})
+	for i := 0; i < 6; i++ {
+		region := "eu"
+		if i%2 == 1 {
+			region = "us"
+		}
+		jsPublish(t, nc, "orders."+region, fmt.Sprintf("order-%d", i))
+	}
+	jsPublish(t, nc, "events", "event-0")
+
+	for _, cfg := range []*StreamConfig{
+		{Name: "BAD", Subjects: []string{"bad"}, Mirror: &StreamSource{Name: "ORDERS"}},
+		{Name: "BAD", Mirror: &StreamSource{Name: "ORDERS"}, Sources: []*StreamSource{{Name: "EVENTS"}}},
+		{Name: "BAD", Sources: []*StreamSource{{Name: "EVENTS"}, {Name: "EVENTS"}}},
+		{Name: "BAD", Sources: []*StreamSource{{Name: "BAD"}}},
+	} {
+		var resp JSApiStreamCreateResponse
+		jsRequest(t, nc, fmt.Sprintf(JSApiStreamCreateT, cfg.Name), cfg, &resp)
+		if resp.Error == nil {
+			t.Fatalf("Expected error creating stream %+v", cfg)
+		}
+	}
+	jsCreateStream(t, nc, &StreamConfig{Name: "M", Storage: FileStorage, Mirror: &StreamSource{Name: "ORDERS"}})
+	jsCreateStream(t, nc, &StreamConfig{Name: "AGG", Storage: FileStorage, Sources: []*StreamSource{
+		{Name: "ORDERS", FilterSubject: "orders.eu"},
+		{Name: "EVENTS"},
+	}})
+
+	checkCounts := func(mirrored, sourced uint64) {
+		t.Helper()
+		checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+			if state := s.globalAccount().lookupTestStream(t, "M").State(); state.Msgs != mirrored || state.LastSeq != mirrored {
+				return fmt.Errorf("unexpected mirror state: %+v", state)
+			}
+			if state := s.globalAccount().lookupTestStream(t, "AGG").State(); state.Msgs != sourced {
+				return fmt.Errorf("unexpected sourced state: %+v", state)
+			}
+			return nil
+		})
+	}
+	checkCounts(6, 4)
+
+	// Mirrors keep the sequences, sourced messages record their origin.
+	m := s.globalAccount().lookupTestStream(t, "M")
+	if sm, err := m.GetMsg(2); err != nil || sm.Subject != "orders.us" || string(sm.Data) != "\"order-1\"" {
+		t.Fatalf("Unexpected mirrored message: %+v, %v", sm, err)
+	}
+	agg := s.globalAccount().lookupTestStream(t, "AGG")
+	sourced := make(map[string]uint64)
+	for seq := uint64(1); seq <= 4; seq++ {
+		sm, err := agg.GetMsg(seq)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		key, sseq := getSourceHeader(sm.Header)
+		if key == "ORDERS" && sm.Subject != "orders.eu" {
+			t.Fatalf("Unexpected sourced message: %+v", sm)
+		}
+		sourced[key] = sseq
+	}
+	if len(sourced) != 2 || sourced["ORDERS"] != 5 || sourced["EVENTS"] != 1 {
+		t.Fatalf("Unexpected source headers: %+v", sourced)
+	}
+	info := agg.Info()
+	if len(info.Sources) != 2 || info.Sources[0].Name != "EVENTS" || info.Sources[0].Seq != 1 || info.Sources[1].Seq != 5 {
+		t.Fatalf("Unexpected sources info: %+v", info.Sources)
+	}
+	if info := m.Info(); info.Mirror == nil || info.Mirror.Seq != 6 || len(info.Config.Subjects) != 0 {
+		t.Fatalf("Unexpected mirror info: %+v", info)
+	}
+	nc.Close()
+	s.Shutdown()
+
+	// Mirrors and sources resume after a restart.
+	s = runJetStreamServer(t, storeDir)
+	defer s.Shutdown()
+	nc = natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+	jsPublish(t, nc, "orders.eu", "order-6")
+	jsPublish(t, nc, "events", "event-1")
+	checkCounts(7, 6)
+}
+
+func TestJetStreamDelayedDelivery(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	s := runJetStreamServer(t, storeDir)
+	defer func() { s.Shutdown() }()
+
+	nc := natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+
+	jsCreateStream(t, nc, &StreamConfig{Name: "D", Storage: FileStorage})
+	hc := newJSHdrConn(t, jsClientURL(s))
+	defer hc.close()
+	publish := func(hdr, body string) *JSPubAckResponse {
+		t.Helper()
+		if hdr != _EMPTY_ {
+			hdr = fmt.Sprintf("NATS/1.0\r\n%s\r\n\r\n", hdr)
+		}
+		data := hc.request("D", hdr, []byte(body))
+		var resp JSPubAckResponse
+		if err := json.Unmarshal(data, &resp); err != nil {
+			t.Fatalf("Unexpected response %q: %v", data, err)
+		}
+		return &resp
+	}
+	if pa := publish(JSMsgDelay+": soon", "bad"); pa.Error == nil || !strings.Contains(pa.Error.Description, "invalid message delay") {
+		t.Fatalf("Expected invalid delay error, got %+v", pa.Error)
+	}
+	if pa := publish(JSMsgDeliverAt+": tomorrow", "bad"); pa.Error == nil || !strings.Contains(pa.Error.Description, "invalid message delivery time") {
+		t.Fatalf("Expected invalid delivery time error, got %+v", pa.Error)
+	}
+
+	start := time.Now()
+	publish(JSMsgDelay+": 300ms", "1")
+	publish(JSMsgDeliverAt+": "+start.Add(600*time.Millisecond).Format(time.RFC3339Nano), "2")
+	publish(_EMPTY_, "3")
+
+	sub := natsSubSync(t, nc, "d")
+	natsFlush(t, nc)
+	jsCreateConsumer(t, nc, "D", &ConsumerConfig{Durable: "dlc", DeliverSubject: "d", AckPolicy: AckExplicit})
+	for _, expected := range []struct {
+		body  string
+		after time.Duration
+	}{{"3", 0}, {"1", 300 * time.Millisecond}, {"2", 600 * time.Millisecond}} {
+		m := natsNexMsg(t, sub, 2*time.Second)
+		if !bytes.HasSuffix(m.Data, []byte(expected.body)) {
+			t.Fatalf("Expected message %q, got %q", expected.body, m.Data)
+		}
+		if elapsed := time.Since(start); elapsed < expected.after {
+			t.Fatalf("Message %q delivered after %v, expected at least %v", expected.body, elapsed, expected.after)
+		}
+		m.Respond(nil)
+	}
+
+	// Delayed messages are delivered after a restart.
+	publish(JSMsgDelay+": 500ms", "4")
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		var info JSApiConsumerInfoResponse
+		jsRequest(t, nc, fmt.Sprintf(JSApiConsumerInfoT, "D", "dlc"), nil, &info)
+		if info.ConsumerInfo == nil || info.NumScheduled != 1 {
+			return fmt.Errorf("Expected a scheduled message, got %+v", info.ConsumerInfo)
+		}
+		return nil
+	})
+	nc.Close()
+	s.Shutdown()
+	s = runJetStreamServer(t, storeDir)
+	nc = natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+	sub = natsSubSync(t, nc, "d")
+	m := natsNexMsg(t, sub, 2*time.Second)
+	if !bytes.HasSuffix(m.Data, []byte("4")) {
+		t.Fatalf("Unexpected message %q", m.Data)
+	}
+
+	// The delay of the stream applies to all its messages.
+	jsCreateStream(t, nc, &StreamConfig{Name: "DS", Storage: MemoryStorage, DeliveryDelay: 250 * time.Millisecond})
+	sub = natsSubSync(t, nc, "ds")
+	natsFlush(t, nc)
+	jsCreateConsumer(t, nc, "DS", &ConsumerConfig{DeliverSubject: "ds", AckPolicy: AckNone})
+	start = time.Now()
+	jsPublish(t, nc, "DS", "hello")
+	natsNexMsg(t, sub, time.Second)
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("Message delivered after %v", elapsed)
+	}
+}
+
+func TestJetStreamDeadLetter(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	s := runJetStreamServer(t, storeDir)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+
+	jsCreateStream(t, nc, &StreamConfig{Name: "JOBS", Subjects: []string{"jobs.*"}, Retention: WorkQueuePolicy})
+	jsCreateStream(t, nc, &StreamConfig{Name: "DLQ", Subjects: []string{"dlq"}})
+
+	for _, cfg := range []*ConsumerConfig{
+		{Durable: "bad", AckPolicy: AckExplicit, MaxDeliver: 2, DeadLetterStream: "D.LQ"},
+		{Durable: "bad", AckPolicy: AckExplicit, MaxDeliver: 2, DeadLetterStream: "JOBS"},
+		{Durable: "bad", AckPolicy: AckExplicit, DeadLetterStream: "DLQ"},
+	} {
+		var resp JSApiConsumerCreateResponse
+		jsRequest(t, nc, fmt.Sprintf(JSApiDurableCreateT, "JOBS", cfg.Durable), &CreateConsumerRequest{Stream: "JOBS", Config: *cfg}, &resp)
+		if resp.Error == nil || !strings.Contains(resp.Error.Description, "dead letter") {
+			t.Fatalf("Expected dead letter error for %+v, got %+v", cfg, resp.Error)
+		}
+	}
+
+	adv := natsSubSync(t, nc, JSAdvisoryConsumerMaxDeliveryExceedPre+".JOBS.>")
+	sub := natsSubSync(t, nc, "d")
+	natsFlush(t, nc)
+	jsCreateConsumer(t, nc, "JOBS", &ConsumerConfig{
+		Durable:          "worker",
+		DeliverSubject:   "d",
+		AckPolicy:        AckExplicit,
+		AckWait:          50 * time.Millisecond,
+		MaxDeliver:       2,
+		DeadLetterStream: "DLQ",
+	})
+	jsPublish(t, nc, "jobs.1", "poison")
+	jsPublish(t, nc, "jobs.2", "fine")
+	// The poisoned message is never acked.
+	natsNexMsg(t, sub, time.Second)
+	natsNexMsg(t, sub, time.Second).Respond(nil)
+	natsNexMsg(t, sub, time.Second)
+
+	m := natsNexMsg(t, adv, 2*time.Second)
+	var a JSConsumerDeliveryExceededAdvisory
+	if err := json.Unmarshal(m.Data, &a); err != nil {
+		t.Fatalf("Unexpected advisory %q: %v", m.Data, err)
+	}
+	if m.Subject != JSAdvisoryConsumerMaxDeliveryExceedPre+".JOBS.worker" ||
+		a.Type != JSConsumerDeliveryExceededAdvisoryType || a.ID == _EMPTY_ ||
+		a.Stream != "JOBS" || a.Consumer != "worker" || a.StreamSeq != 1 || a.Deliveries != 2 || a.DeadLetterStream != "DLQ" {
+		t.Fatalf("Unexpected advisory on %q: %+v", m.Subject, a)
+	}
+	if rm, err := sub.NextMsg(150 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected redelivery: %q", rm.Data)
+	}
+
+	// The message is moved to the dead letter stream.
+	acc := s.globalAccount()
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		if state := acc.lookupTestStream(t, "JOBS").State(); state.Msgs != 0 {
+			return fmt.Errorf("Expected no messages left, got %d", state.Msgs)
+		}
+		return nil
+	})
+	dlq := acc.lookupTestStream(t, "DLQ")
+	if state := dlq.State(); state.Msgs != 1 {
+		t.Fatalf("Expected a dead letter message, got %d", state.Msgs)
+	}
+	sm, err := dlq.GetMsg(1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sm.Subject != "jobs.1" || string(getHeader(JSDeadLetter, sm.Header)) != "JOBS worker 1" || string(sm.Data) != `"poison"` {
+		t.Fatalf("Unexpected dead letter message: %q %q %q", sm.Subject, sm.Header, sm.Data)
+	}
+}
+
+func TestJetStreamRePublish(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	s := runJetStreamServer(t, storeDir)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+
+	for _, rp := range []*RePublish{
+		{Destination: "orders.>"},
+		{Source: "orders.*", Destination: "repub.$2"},
+	} {
+		var resp JSApiStreamCreateResponse
+		jsRequest(t, nc, fmt.Sprintf(JSApiStreamCreateT, "ORDERS"), &StreamConfig{Name: "ORDERS", Subjects: []string{"orders.>"}, RePublish: rp}, &resp)
+		if resp.Error == nil || !strings.Contains(resp.Error.Description, "republish") {
+			t.Fatalf("Expected republish error for %+v, got %+v", rp, resp.Error)
+		}
+	}
+
+	jsCreateStream(t, nc, &StreamConfig{
+		Name:      "ORDERS",
+		Subjects:  []string{"orders.>"},
+		RePublish: &RePublish{Source: "orders.*.new", Destination: "repub.{{wildcard(1)}}"},
+	})
+	hc := newJSHdrConn(t, jsClientURL(s))
+	defer hc.close()
+	hc.subscribe("repub.>")
+	jsPublish(t, nc, "orders.1.new", "first")
+	jsPublish(t, nc, "orders.1.shipped", "ignored")
+	jsPublish(t, nc, "orders.2.new", "second")
+
+	for i, body := range []string{"first", "second"} {
+		m := hc.nextMsg(time.Second)
+		seq := uint64(2*i + 1)
+		if m.subject != fmt.Sprintf("repub.%d", i+1) || string(m.data) != fmt.Sprintf("%q", body) {
+			t.Fatalf("Unexpected republished message %q: %q", m.subject, m.data)
+		}
+		if string(getHeader(JSStream, m.hdr)) != "ORDERS" ||
+			string(getHeader(JSSequence, m.hdr)) != fmt.Sprintf("%d", seq) ||
+			string(getHeader(JSSubject, m.hdr)) != fmt.Sprintf("orders.%d.new", i+1) ||
+			getHeader(JSTimeStamp, m.hdr) == nil {
+			t.Fatalf("Unexpected headers: %q", m.hdr)
+		}
+	}
+
+	// Only the headers and the size of the message.
+	cfg := StreamConfig{
+		Name:      "ORDERS",
+		Subjects:  []string{"orders.>"},
+		RePublish: &RePublish{Destination: "repub.>", HeadersOnly: true},
+	}
+	var resp JSApiStreamUpdateResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiStreamUpdateT, "ORDERS"), &cfg, &resp)
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", resp.Error)
+	}
+	jsPublish(t, nc, "orders.3.new", "third")
+	m := hc.nextMsg(time.Second)
+	if m.subject != "repub.orders.3.new" || len(m.data) != 0 || string(getHeader(JSMsgSize, m.hdr)) != "7" {
+		t.Fatalf("Unexpected republished message %q: %q %q", m.subject, m.hdr, m.data)
+	}
+}
+
+func TestJetStreamIngestFiltersAndTransform(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	s := runJetStreamServer(t, storeDir)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+
+	for _, cfg := range []*StreamConfig{
+		{Name: "EV", Subjects: []string{"events.>"}, IngestFilters: []string{"events..x"}},
+		{Name: "EV", Subjects: []string{"events.>"}, SubjectTransform: &SubjectTransformConfig{Source: "events.*", Destination: "ev.$2"}},
+		{Name: "EV", Subjects: []string{"events.>"}, SubjectTransform: &SubjectTransformConfig{Destination: "$JS.API.>"}},
+	} {
+		var resp JSApiStreamCreateResponse
+		jsRequest(t, nc, fmt.Sprintf(JSApiStreamCreateT, cfg.Name), cfg, &resp)
+		if resp.Error == nil {
+			t.Fatalf("Expected an error for %+v", cfg)
+		}
+	}
+
+	jsCreateStream(t, nc, &StreamConfig{
+		Name:             "EV",
+		Subjects:         []string{"events.>"},
+		IngestFilters:    []string{"events.*.click", "events.*.buy"},
+		SubjectTransform: &SubjectTransformConfig{Source: "events.*.*", Destination: "ev.$2.$1"},
+	})
+	publish := func(subj string) *JSPubAckResponse {
+		t.Helper()
+		m, err := nc.Request(subj, []byte("ok"), time.Second)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		var resp JSPubAckResponse
+		if err := json.Unmarshal(m.Data, &resp); err != nil {
+			t.Fatalf("Unexpected response %q: %v", m.Data, err)
+		}
+		return &resp
+	}
+	if pa := publish("events.1.move"); pa.Error == nil || pa.Error.Description != ErrJetStreamMsgFiltered.Error() {
+		t.Fatalf("Expected filtered error, got %+v", pa)
+	}
+	for _, subj := range []string{"events.1.click", "events.2.buy"} {
+		if pa := publish(subj); pa.Error != nil {
+			t.Fatalf("Unexpected error: %+v", pa.Error)
+		}
+	}
+
+	mset := s.globalAccount().lookupTestStream(t, "EV")
+	if state := mset.State(); state.Msgs != 2 {
+		t.Fatalf("Expected 2 messages, got %d", state.Msgs)
+	}
+	for seq, subj := range []string{"ev.click.1", "ev.buy.2"} {
+		sm, err := mset.GetMsg(uint64(seq + 1))
+		if err != nil || sm.Subject != subj {
+			t.Fatalf("Expected stored subject %q, got %+v, %v", subj, sm, err)
+		}
+	}
+
+	// Consumers filter on the stored subjects.
+	jsCreateConsumer(t, nc, "EV", &ConsumerConfig{Durable: "buys", AckPolicy: AckExplicit, FilterSubject: "ev.buy.*"})
+	m := jsNextMsg(t, nc, "EV", "buys")
+	if m.Subject != "ev.buy.2" {
+		t.Fatalf("Unexpected message %q", m.Subject)
+	}
+}
+
+func TestJetStreamFlowControlAndHeartbeats(t *testing.T) {
+	fcw := consumerFlowControlWindow
+	consumerFlowControlWindow = 1000
+	defer func() { consumerFlowControlWindow = fcw }()
+
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	s := runJetStreamServer(t, storeDir)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+
+	var resp JSApiConsumerCreateResponse
+	jsCreateStream(t, nc, &StreamConfig{Name: "FC"})
+	jsRequest(t, nc, fmt.Sprintf(JSApiDurableCreateT, "FC", "pull"), &CreateConsumerRequest{Stream: "FC",
+		Config: ConsumerConfig{Durable: "pull", AckPolicy: AckExplicit, FlowControl: true}}, &resp)
+	if resp.Error == nil {
+		t.Fatalf("Expected an error for flow control in pull mode")
+	}
+
+	// Idle heartbeats with the last delivered sequences.
+	hc := newJSHdrConn(t, jsClientURL(s))
+	defer hc.close()
+	hc.subscribe("d")
+	jsCreateConsumer(t, nc, "FC", &ConsumerConfig{
+		Durable:        "dlc",
+		DeliverSubject: "d",
+		AckPolicy:      AckNone,
+		FlowControl:    true,
+		Heartbeat:      100 * time.Millisecond,
+	})
+	m := hc.nextMsg(time.Second)
+	if !bytes.HasPrefix(m.hdr, []byte("NATS/1.0 100 Idle Heartbeat\r\n")) || string(getHeader(JSLastStreamSeq, m.hdr)) != "0" {
+		t.Fatalf("Unexpected heartbeat %q", m.hdr)
+	}
+
+	// The delivery stalls after the window without flow control responses.
+	body := strings.Repeat("x", 98)
+	for i := 0; i < 20; i++ {
+		jsPublish(t, nc, "FC", body)
+	}
+	// Heartbeats of a stalled consumer carry the flow control subject.
+	var fc string
+	var stalled []byte
+	received := 0
+	for stalled == nil {
+		m := hc.nextMsg(time.Second)
+		switch {
+		case bytes.HasPrefix(m.hdr, []byte("NATS/1.0 100 FlowControl Request")):
+			fc = m.reply
+		case bytes.HasPrefix(m.hdr, []byte("NATS/1.0 100 Idle Heartbeat")):
+			stalled = getHeader(JSConsumerStalled, m.hdr)
+		default:
+			received++
+		}
+	}
+	if !strings.HasPrefix(fc, "$JS.FC.FC.dlc.") || string(stalled) != fc || received != 10 {
+		t.Fatalf("Expected flow control request %q and 10 messages, got %q and %d", stalled, fc, received)
+	}
+	var info JSApiConsumerInfoResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiConsumerInfoT, "FC", "dlc"), nil, &info)
+	if info.ConsumerInfo == nil || !info.Stalled {
+		t.Fatalf("Expected consumer to be stalled, got %+v", info.ConsumerInfo)
+	}
+
+	// Answering resumes the delivery.
+	for received < 20 {
+		m := hc.nextMsg(time.Second)
+		switch {
+		case strings.HasPrefix(m.reply, "$JS.FC."):
+			hc.publish(m.reply, _EMPTY_, _EMPTY_, nil)
+		case bytes.HasPrefix(m.hdr, []byte("NATS/1.0 100")):
+			if stalled := getHeader(JSConsumerStalled, m.hdr); stalled != nil {
+				hc.publish(string(stalled), _EMPTY_, _EMPTY_, nil)
+			}
+		default:
+			received++
+		}
+	}
+}
+
+func TestJetStreamAccountLimits(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		jetstream { store_dir: %q }
+		accounts {
+			A {
+				users [{user: a, password: pwd}]
+				jetstream { max_streams: 1, max_consumers: 1, max_file: 512 }
+			}
+		}
+	`, storeDir)))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, fmt.Sprintf("nats://a:pwd@%s:%d", opts.Host, opts.Port))
+	defer nc.Close()
+
+	jsCreateStream(t, nc, &StreamConfig{Name: "S", Storage: FileStorage})
+	var resp JSApiStreamCreateResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiStreamCreateT, "T"), &StreamConfig{Name: "T", Storage: FileStorage}, &resp)
+	if resp.Error == nil || resp.Error.Description != ErrJetStreamMaxStreams.Error() {
+		t.Fatalf("Expected max streams error, got %+v", resp.Error)
+	}
+	var uresp JSApiStreamUpdateResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiStreamUpdateT, "S"), &StreamConfig{Name: "S", Storage: FileStorage, MaxBytes: 1024}, &uresp)
+	if uresp.Error == nil || !strings.Contains(uresp.Error.Description, "account limit") {
+		t.Fatalf("Expected account limit error, got %+v", uresp.Error)
+	}
+
+	jsCreateConsumer(t, nc, "S", &ConsumerConfig{Durable: "d1", AckPolicy: AckExplicit})
+	// Creating the same durable again is fine.
+	jsCreateConsumer(t, nc, "S", &ConsumerConfig{Durable: "d1", AckPolicy: AckExplicit})
+	var cresp JSApiConsumerCreateResponse
+	jsRequest(t, nc, fmt.Sprintf(JSApiDurableCreateT, "S", "d2"),
+		&CreateConsumerRequest{Stream: "S", Config: ConsumerConfig{Durable: "d2", AckPolicy: AckExplicit}}, &cresp)
+	if cresp.Error == nil || cresp.Error.Description != ErrJetStreamMaxAccountConsumers.Error() {
+		t.Fatalf("Expected max consumers error, got %+v", cresp.Error)
+	}
+
+	msg := strings.Repeat("X", 100)
+	var stored int
+	for i := 0; i < 10; i++ {
+		if pa := jsPublish(t, nc, "S", msg); pa.Error != nil {
+			if pa.Error.Description != ErrJetStreamResourcesExceeded.Error() {
+				t.Fatalf("Unexpected error: %+v", pa.Error)
+			}
+			break
+		}
+		stored++
+	}
+	if stored == 0 || stored == 10 {
+		t.Fatalf("Expected the storage limit to be reached, stored %d messages", stored)
+	}
+
+	var info JSApiAccountInfoResponse
+	jsRequest(t, nc, JSApiInfo, nil, &info)
+	if info.JetStreamAccountStats == nil {
+		t.Fatalf("Unexpected response: %+v", info)
+	}
+	expected := JetStreamAccountLimits{MaxStore: 512, MaxStreams: 1, MaxConsumers: 1}
+	if info.Limits != expected || info.Streams != 1 || info.Consumers != 1 || info.Store < 512 {
+		t.Fatalf("Unexpected account info: %+v", info.JetStreamAccountStats)
+	}
+
+	az, err := s.Accountz(&AccountzOptions{Account: "A"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if js := az.Accounts[0].JetStream; js == nil || js.Limits != expected || js.Streams != 1 {
+		t.Fatalf("Unexpected accountz jetstream info: %+v", js)
+	}
+}
+
+func TestJetStreamAccountLimitsFromJWT(t *testing.T) {
+	payload := `{"sub":"A","nats":{"limits":{"subs":-1,"mem_storage":-1,"disk_storage":1048576,"streams":2,"consumer":10}}}`
+	claimJWT := "e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"
+	expected := JetStreamAccountLimits{MaxStore: 1048576, MaxStreams: 2, MaxConsumers: 10}
+	if limits := jetStreamLimitsFromJWT(claimJWT); limits != expected {
+		t.Fatalf("Expected limits %+v, got %+v", expected, limits)
+	}
+	if limits := jetStreamLimitsFromJWT("bad"); limits != (JetStreamAccountLimits{}) {
+		t.Fatalf("Expected no limits, got %+v", limits)
+	}
+
+	// Configured limits take precedence.
+	acc := NewAccount("A")
+	acc.claimJWT = claimJWT
+	if limits := acc.JetStreamLimits(); limits != expected {
+		t.Fatalf("Expected limits %+v, got %+v", expected, limits)
+	}
+	acc.jsLimits = &JetStreamAccountLimits{MaxStreams: 1}
+	if limits := acc.JetStreamLimits(); limits.MaxStreams != 1 || limits.MaxStore != 0 {
+		t.Fatalf("Expected the configured limits, got %+v", limits)
+	}
+}
+
+func TestJetStreamMirrorAcrossAccounts(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		jetstream { store_dir: %q }
+		accounts {
+			A {
+				users [{user: a, password: pwd}]
+				exports [
+					{service: "$JS.API.CONSUMER.CREATE.S"}
+					{stream: "deliver.b.>"}
+				]
+			}
+			B {
+				users [{user: b, password: pwd}]
+				imports [
+					{service: {account: A, subject: "$JS.API.CONSUMER.CREATE.S"}, to: "JS.A.API.CONSUMER.CREATE.S"}
+					{stream: {account: A, subject: "deliver.b.>"}}
+				]
+			}
+		}
+	`, storeDir)))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nca := natsConnect(t, fmt.Sprintf("nats://a:pwd@%s:%d", opts.Host, opts.Port))
+	defer nca.Close()
+	ncb := natsConnect(t, fmt.Sprintf("nats://b:pwd@%s:%d", opts.Host, opts.Port))
+	defer ncb.Close()
+
+	jsCreateStream(t, nca, &StreamConfig{Name: "S", Subjects: []string{"s.>"}})
+	for i := 0; i < 5; i++ {
+		jsPublish(t, nca, "s.x", fmt.Sprintf("msg-%d", i))
+	}
+	jsCreateStream(t, ncb, &StreamConfig{Name: "M", Mirror: &StreamSource{
+		Name:     "S",
+		External: &ExternalStream{ApiPrefix: "JS.A.API", DeliverPrefix: "deliver.b"},
+	}})
+	accB, _ := s.LookupAccount("B")
+	checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+		if state := accB.lookupTestStream(t, "M").State(); state.Msgs != 5 {
+			return fmt.Errorf("unexpected mirror state: %+v", state)
+		}
+		return nil
+	})
+	jsPublish(t, nca, "s.y", "msg-5")
+	checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+		if state := accB.lookupTestStream(t, "M").State(); state.LastSeq != 6 {
+			return fmt.Errorf("unexpected mirror state: %+v", state)
+		}
+		return nil
+	})
+}
@@ -24,25 +24,32 @@ import (
 
 var nscDecoratedRe = regexp.MustCompile(`\s*(?:(?:[-]{3,}[^\n]*[-]{3,}\n)(.+)(?:\n\s*[-]{3,}[^\n]*[-]{3,}[\n]*))`)
 
-// readOperatorJWT
-func readOperatorJWT(jwtfile string) (*jwt.OperatorClaims, error) {
+// readJWTFile returns the JWT contained in the file, which can be
+// decorated as generated by nsc.
+func readJWTFile(jwtfile string) (string, error) {
 	contents, err := ioutil.ReadFile(jwtfile)
 	if err != nil {
-		return nil, err
+		return _EMPTY_, err
 	}
 	defer wipeSlice(contents)
 
-	var claim string
 	items := nscDecoratedRe.FindAllSubmatch(contents, -1)
 	if len(items) == 0 {
-		claim = string(contents)
-	} else {
-		// First result should be the JWT.
-		// We copy here so that if the file contained a seed file too we wipe appropriately.
-		raw := items[0][1]
-		tmp := make([]byte, len(raw))
-		copy(tmp, raw)
-		claim = string(tmp)
+		return string(contents), nil
+	}
+	// First result should be the JWT.
+	// We copy here so that if the file contained a seed file too we wipe appropriately.
+	raw := items[0][1]
+	tmp := make([]byte, len(raw))
+	copy(tmp, raw)
+	return string(tmp), nil
+}
+
+// readOperatorJWT
+func readOperatorJWT(jwtfile string) (*jwt.OperatorClaims, error) {
+	claim, err := readJWTFile(jwtfile)
+	if err != nil {
+		return nil, err
 	}
 	opc, err := jwt.DecodeOperatorClaims(claim)
 	if err != nil {
@@ -51,6 +58,19 @@ func readOperatorJWT(jwtfile string) (*jwt.OperatorClaims, error) {
 	return opc, nil
 }
 
+// readAccountJWT reads an account JWT, e.g. an account template.
+func readAccountJWT(jwtfile string) (*jwt.AccountClaims, error) {
+	claim, err := readJWTFile(jwtfile)
+	if err != nil {
+		return nil, err
+	}
+	ac, err := jwt.DecodeAccountClaims(claim)
+	if err != nil {
+		return nil, err
+	}
+	return ac, nil
+}
+
 // Just wipe slice with 'x', for clearing contents of nkey seed file.
 func wipeSlice(buf []byte) {
 	for i := range buf {
@@ -97,3 +117,31 @@ func validateTrustedOperators(o *Options) error {
 	}
 	return nil
 }
+
+// validateAccountTemplate will check that an account template is only used
+// with trusted keys and that it was issued by one of them.
+func validateAccountTemplate(o *Options) error {
+	ac := o.AccountTemplate
+	if ac == nil {
+		return nil
+	}
+	if len(o.TrustedKeys) == 0 {
+		return fmt.Errorf("account template requires trusted operators")
+	}
+	trusted := false
+	for _, key := range o.TrustedKeys {
+		if key == ac.Issuer {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return fmt.Errorf("account template issuer %q is not trusted", ac.Issuer)
+	}
+	vr := jwt.CreateValidationResults()
+	ac.Validate(vr)
+	if vr.IsBlocking(true) {
+		return fmt.Errorf("account template is not valid: %v", vr.Errors())
+	}
+	return nil
+}
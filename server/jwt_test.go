@@ -1034,7 +1034,8 @@ func TestJWTAccountLimitsSubs(t *testing.T) {
 		t.Fatalf("Expected an ERR for max subscriptions exceeded, got: %v", l)
 	}
 
-	// Now update the claims and expect if max is lower to be disconnected.
+	// Now update the claims and expect an error if max is lower. The
+	// connection and its subscriptions are kept.
 	fooAC.Limits.Subs = 5
 	fooJWT, err = fooAC.Encode(okp)
 	if err != nil {
@@ -1042,6 +1043,8 @@ func TestJWTAccountLimitsSubs(t *testing.T) {
 	}
 	addAccountToMemResolver(s, fooPub, fooJWT)
 	s.updateAccountClaims(fooAcc, fooAC)
+	// The PING also flushes the error sent in the background.
+	parseAsync("PING\r\n")
 	l, _ = cr.ReadString('\n')
 	if !strings.HasPrefix(l, "-ERR") {
 		t.Fatalf("Expected an ERR, got: %v", l)
@@ -1049,6 +1052,13 @@ func TestJWTAccountLimitsSubs(t *testing.T) {
 	if !strings.Contains(l, "maximum subscriptions exceeded") {
 		t.Fatalf("Expected an ERR for max subscriptions exceeded, got: %v", l)
 	}
+	expectPong(cr)
+	c.mu.Lock()
+	nsubs := len(c.subs)
+	c.mu.Unlock()
+	if nsubs != 10 {
+		t.Fatalf("Expected 10 subscriptions, got %d", nsubs)
+	}
 }
 
 func TestJWTAccountLimitsSubsButServerOverrides(t *testing.T) {
@@ -1257,6 +1267,91 @@ func TestJWTAccountLimitsMaxConns(t *testing.T) {
 	newClient("-ERR ")
 }
 
+func TestJWTUserMaxConnsTag(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	fooKP, _ := nkeys.CreateAccount()
+	fooPub, _ := fooKP.PublicKey()
+	fooAC := jwt.NewAccountClaims(fooPub)
+	fooJWT, err := fooAC.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	addAccountToMemResolver(s, fooPub, fooJWT)
+
+	nkp, _ := nkeys.CreateUser()
+	pub, _ := nkp.PublicKey()
+	nuc := jwt.NewUserClaims(pub)
+	nuc.Tags.Add(jwtMaxConnsTag + "2")
+	ujwt, err := nuc.Encode(fooKP)
+	if err != nil {
+		t.Fatalf("Error generating user JWT: %v", err)
+	}
+
+	newClient := func(expPre string) {
+		t.Helper()
+		c, cr, l := newClientForServer(s)
+		var info nonceInfo
+		json.Unmarshal([]byte(l[5:]), &info)
+		sigraw, _ := nkp.Sign([]byte(info.Nonce))
+		sig := base64.RawURLEncoding.EncodeToString(sigraw)
+		go c.parse([]byte(fmt.Sprintf("CONNECT {\"jwt\":%q,\"sig\":\"%s\"}\r\nPING\r\n", ujwt, sig)))
+		if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, expPre) {
+			t.Fatalf("Expected a response starting with %q, got %q", expPre, l)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		newClient("PONG")
+	}
+	newClient("-ERR '" + ErrTooManyUserConnections.Error())
+}
+
+func TestJWTUserPermissionTags(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	fooKP, _ := nkeys.CreateAccount()
+	fooPub, _ := fooKP.PublicKey()
+	fooAC := jwt.NewAccountClaims(fooPub)
+	fooJWT, err := fooAC.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	addAccountToMemResolver(s, fooPub, fooJWT)
+
+	nkp, _ := nkeys.CreateUser()
+	pub, _ := nkp.PublicKey()
+	nuc := jwt.NewUserClaims(pub)
+	nuc.Pub.Allow.Add("orders.{{tag(region)}}.>")
+	nuc.Tags.Add("region:eu")
+	ujwt, err := nuc.Encode(fooKP)
+	if err != nil {
+		t.Fatalf("Error generating user JWT: %v", err)
+	}
+
+	c, cr, l := newClientForServer(s)
+	var info nonceInfo
+	json.Unmarshal([]byte(l[5:]), &info)
+	sigraw, _ := nkp.Sign([]byte(info.Nonce))
+	sig := base64.RawURLEncoding.EncodeToString(sigraw)
+	// The tag sent by the client does not change the permissions.
+	go c.parse([]byte(fmt.Sprintf("CONNECT {\"jwt\":%q,\"sig\":\"%s\",\"tags\":{\"region\":\"us\"}}\r\n"+
+		"PUB orders.us.1 2\r\nok\r\nPUB orders.eu.1 2\r\nok\r\nPING\r\n", ujwt, sig)))
+	if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, "-ERR 'Permissions Violation for Publish to \"orders.us.1\"") {
+		t.Fatalf("Expected a permissions violation, got %q", l)
+	}
+	if l, _ := cr.ReadString('\n'); l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q", l)
+	}
+}
+
 // This will test that we can switch from a public export to a private
 // one and back with export claims to make sure the claim update mechanism
 // is working properly.
@@ -1836,3 +1931,96 @@ func TestJWTAccountImportSignerRemoved(t *testing.T) {
 	expectPong(clientReader)
 	checkShadow(0)
 }
+
+func TestJWTAccountTemplate(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	// Create the template, the subject is replaced for new accounts.
+	tkp, _ := nkeys.CreateAccount()
+	tpub, _ := tkp.PublicKey()
+	tac := jwt.NewAccountClaims(tpub)
+	tac.Limits.Conn = 1
+	tac.Exports.Add(&jwt.Export{Subject: "public.>", Type: jwt.Stream})
+	tjwt, err := tac.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	tmpl, err := jwt.DecodeAccountClaims(tjwt)
+	if err != nil {
+		t.Fatalf("Error decoding account JWT: %v", err)
+	}
+
+	// Without a template unknown accounts are rejected.
+	fooKP, _ := nkeys.CreateAccount()
+	fooPub, _ := fooKP.PublicKey()
+	c, cr, cs := createClient(t, s, fooKP)
+	go c.parse([]byte(cs))
+	if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, "-ERR ") {
+		t.Fatalf("Expected an error, got %q", l)
+	}
+
+	s.optsMu.Lock()
+	s.opts.AccountTemplate = tmpl
+	s.optsMu.Unlock()
+
+	c, cr, cs = createClient(t, s, fooKP)
+	go c.parse([]byte(cs))
+	if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, "PONG") {
+		t.Fatalf("Expected a PONG, got %q", l)
+	}
+	acc, err := s.LookupAccount(fooPub)
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	if acc.MaxActiveConnections() != 1 {
+		t.Fatalf("Expected connection limit from template, got %d", acc.MaxActiveConnections())
+	}
+	if !acc.checkStreamImportAuthorized(NewAccount("bar"), "public.foo", nil) {
+		t.Fatal("Expected stream export from template")
+	}
+	// The template limits apply.
+	c, cr, cs = createClient(t, s, fooKP)
+	go c.parse([]byte(cs))
+	if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, "-ERR ") {
+		t.Fatalf("Expected an error, got %q", l)
+	}
+}
+
+func TestJWTAccountTemplateValidation(t *testing.T) {
+	okp, _ := nkeys.FromSeed(oSeed)
+	opub, _ := okp.PublicKey()
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	newTemplate := func(signer nkeys.KeyPair) *jwt.AccountClaims {
+		t.Helper()
+		ajwt, err := jwt.NewAccountClaims(apub).Encode(signer)
+		if err != nil {
+			t.Fatalf("Error generating account JWT: %v", err)
+		}
+		ac, err := jwt.DecodeAccountClaims(ajwt)
+		if err != nil {
+			t.Fatalf("Error decoding account JWT: %v", err)
+		}
+		return ac
+	}
+
+	opts := defaultServerOptions
+	opts.AccountTemplate = newTemplate(okp)
+	if err := validateAccountTemplate(&opts); err == nil {
+		t.Fatal("Expected error using a template without trusted keys")
+	}
+	opts.TrustedKeys = []string{opub}
+	if err := validateAccountTemplate(&opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	okp2, _ := nkeys.CreateOperator()
+	opts.AccountTemplate = newTemplate(okp2)
+	if err := validateAccountTemplate(&opts); err == nil || !strings.Contains(err.Error(), "not trusted") {
+		t.Fatalf("Expected error for untrusted template, got %v", err)
+	}
+}
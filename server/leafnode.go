@@ -24,6 +24,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/url"
+	"os"
 	"regexp"
 	"runtime"
 	"strconv"
@@ -42,13 +43,35 @@ type leaf struct {
 	smap map[string]int32
 	// We have any auth stuff here for solicited connections.
 	remote *leafNodeCfg
+	// Used to detect changes of the credentials file for solicited connections.
+	credsMod time.Time
+	credsTmr *time.Timer
+	// Identity of the server on the other side, from its INFO or CONNECT.
+	remoteServer  string
+	remoteCluster string
 }
 
+// How often a solicited leafnode connection checks its credentials file for changes.
+var leafNodeCredsCheckInterval = 5 * time.Second
+
+// How long a solicited leafnode connection waits before reconnecting
+// after a loop has been detected.
+var leafNodeReconnectDelayAfterLoopDetected = 30 * time.Second
+
+// Prefix of the loop detection subject. Each server sends interest on this
+// prefix followed by its ID over its leafnode connections. Like any other
+// interest it is propagated through the other leafnodes, so that a server
+// receiving its own subject knows that the connection creates a loop, and
+// the subjects an account has interest on list the servers it can reach.
+const leafNodeLoopDetectionSubjectPrefix = "$LDS."
+
 type leafNodeCfg struct {
 	sync.RWMutex
 	*RemoteLeafOpts
 	urls   []*url.URL
 	curURL *url.URL
+	// Set when a loop was detected with this remote.
+	loopDetected bool
 }
 
 func (c *client) isSolicitedLeafNode() bool {
@@ -75,6 +98,9 @@ func (s *Server) remoteLeafNodeStillValid(remote *leafNodeCfg) bool {
 
 // Ensure that leafnode is properly configured.
 func validateLeafNode(o *Options) error {
+	if o.LeafNode.Websocket.Port != 0 && o.LeafNode.Port == 0 {
+		return fmt.Errorf("leafnode websocket requires the leafnode port to be set")
+	}
 	if o.LeafNode.Port == 0 {
 		return nil
 	}
@@ -90,7 +116,12 @@ func validateLeafNode(o *Options) error {
 }
 
 func (s *Server) reConnectToRemoteLeafNode(remote *leafNodeCfg) {
-	delay := s.getOpts().LeafNode.ReconnectInterval
+	interval, jitter, _ := remote.reconnectPolicy(s.getOpts())
+	delay := interval + jitterDelay(jitter)
+	if remote.clearLoopDetected() {
+		delay = leafNodeReconnectDelayAfterLoopDetected
+		s.Warnf("Loop detected for leafnode remote %q, delaying reconnect for %v", remote.URL.Host, delay)
+	}
 	select {
 	case <-time.After(delay):
 	case <-s.quitCh:
@@ -100,6 +131,22 @@ func (s *Server) reConnectToRemoteLeafNode(remote *leafNodeCfg) {
 	s.connectToRemoteLeafNode(remote, false)
 }
 
+// Returns the reconnect interval, jitter and maximum backoff for this
+// remote, which default to the ones of the leafnode block.
+func (cfg *leafNodeCfg) reconnectPolicy(opts *Options) (time.Duration, time.Duration, time.Duration) {
+	interval, jitter, maxBackoff := opts.LeafNode.ReconnectInterval, opts.LeafNode.ReconnectJitter, opts.LeafNode.ReconnectMaxBackoff
+	if cfg.ReconnectInterval > 0 {
+		interval = cfg.ReconnectInterval
+	}
+	if cfg.ReconnectJitter > 0 {
+		jitter = cfg.ReconnectJitter
+	}
+	if cfg.ReconnectMaxBackoff > 0 {
+		maxBackoff = cfg.ReconnectMaxBackoff
+	}
+	return interval, jitter, maxBackoff
+}
+
 // Creates a leafNodeCfg object that wraps the RemoteLeafOpts.
 func newLeafNodeCfg(remote *RemoteLeafOpts) *leafNodeCfg {
 	cfg := &leafNodeCfg{
@@ -127,6 +174,22 @@ func (cfg *leafNodeCfg) pickNextURL() *url.URL {
 	return cfg.curURL
 }
 
+// Marks that a loop was detected with this remote.
+func (cfg *leafNodeCfg) setLoopDetected() {
+	cfg.Lock()
+	cfg.loopDetected = true
+	cfg.Unlock()
+}
+
+// Returns if a loop was detected with this remote and resets the flag.
+func (cfg *leafNodeCfg) clearLoopDetected() bool {
+	cfg.Lock()
+	defer cfg.Unlock()
+	detected := cfg.loopDetected
+	cfg.loopDetected = false
+	return detected
+}
+
 // Returns the current URL
 func (cfg *leafNodeCfg) getCurrentURL() *url.URL {
 	cfg.RLock()
@@ -158,7 +221,7 @@ func (s *Server) connectToRemoteLeafNode(remote *leafNodeCfg, firstConnect bool)
 	}
 
 	opts := s.getOpts()
-	reconnectDelay := opts.LeafNode.ReconnectInterval
+	reconnectDelay, _, maxBackoff := remote.reconnectPolicy(opts)
 	s.mu.Lock()
 	dialTimeout := s.leafNodeOpts.dialTimeout
 	resolver := s.leafNodeOpts.resolver
@@ -171,14 +234,29 @@ func (s *Server) connectToRemoteLeafNode(remote *leafNodeCfg, firstConnect bool)
 	attempts := 0
 	for s.isRunning() && s.remoteLeafNodeStillValid(remote) {
 		rURL := remote.pickNextURL()
-		url, err := s.getRandomIP(resolver, rURL.Host)
-		if err == nil {
-			var ipStr string
-			if url != rURL.Host {
-				ipStr = fmt.Sprintf(" (%s)", url)
+		hostPort := rURL.Host
+		isWS := isWebsocketURL(rURL)
+		if isWS {
+			hostPort = wsHostPort(rURL)
+		}
+		var err error
+		if remote.Proxy != nil {
+			s.Debugf("Trying to connect as leafnode to remote server on %s through proxy %s", hostPort, remote.Proxy.Host)
+			conn, err = dialWithProxy(remote.Proxy, hostPort, dialTimeout)
+		} else {
+			var url string
+			url, err = s.getRandomIP(resolver, hostPort)
+			if err == nil {
+				var ipStr string
+				if url != hostPort {
+					ipStr = fmt.Sprintf(" (%s)", url)
+				}
+				s.Debugf("Trying to connect as leafnode to remote server on %s%s", hostPort, ipStr)
+				conn, err = net.DialTimeout("tcp", url, dialTimeout)
 			}
-			s.Debugf("Trying to connect as leafnode to remote server on %s%s", rURL.Host, ipStr)
-			conn, err = net.DialTimeout("tcp", url, dialTimeout)
+		}
+		if err == nil && isWS {
+			conn, err = s.wsSolicitLeafNode(conn, remote, rURL)
 		}
 		if err != nil {
 			attempts++
@@ -187,10 +265,14 @@ func (s *Server) connectToRemoteLeafNode(remote *leafNodeCfg, firstConnect bool)
 			} else {
 				s.Debugf(connErrFmt, attempts, err)
 			}
+			if firstConnect && remote.ConnectRetries > 0 && attempts > remote.ConnectRetries {
+				s.Errorf("Giving up connecting as leafnode to remote server %q after %v attempts", rURL.Host, attempts)
+				return
+			}
 			select {
 			case <-s.quitCh:
 				return
-			case <-time.After(reconnectDelay):
+			case <-time.After(backoffDelay(reconnectDelay, maxBackoff, attempts)):
 				continue
 			}
 		}
@@ -249,6 +331,8 @@ func (s *Server) leafNodeAcceptLoop(ch chan struct{}) {
 		TLSVerify:    tlsVerify,
 		MaxPayload:   s.info.MaxPayload, // TODO(dlc) - Allow override?
 		Proto:        1,                 // Fixed for now.
+		Cluster:      s.ClusterName(),
+		Headers:      true,
 	}
 	// If we have selected a random port...
 	if port == 0 {
@@ -298,16 +382,22 @@ func (s *Server) leafNodeAcceptLoop(ch chan struct{}) {
 var credsRe = regexp.MustCompile(`\s*(?:(?:[-]{3,}[^\n]*[-]{3,}\n)(.+)(?:\n\s*[-]{3,}[^\n]*[-]{3,}\n))`)
 
 // Lock should be held entering here.
-func (c *client) sendLeafConnect(tlsRequired bool) {
+func (c *client) sendLeafConnect(tlsRequired bool, servers []string) {
 	// We support basic user/pass and operator based user JWT with signatures.
 	cinfo := leafConnectInfo{
-		TLS:  tlsRequired,
-		Name: c.srv.info.ID,
+		TLS:     tlsRequired,
+		Name:    c.srv.info.ID,
+		Cluster: c.srv.ClusterName(),
+		Servers: servers,
+		Headers: true,
 	}
 
 	// Check for credentials first, that will take precedence..
 	if creds := c.leaf.remote.Credentials; creds != "" {
 		c.Debugf("Authenticating with credentials file %q", c.leaf.remote.Credentials)
+		if fi, err := os.Stat(creds); err == nil {
+			c.leaf.credsMod = fi.ModTime()
+		}
 		contents, err := ioutil.ReadFile(creds)
 		if err != nil {
 			c.Errorf("%v", err)
@@ -352,6 +442,43 @@ func (c *client) sendLeafConnect(tlsRequired bool) {
 	c.sendProto([]byte(fmt.Sprintf(ConProto, b)), true)
 }
 
+// Lock should be held.
+func (c *client) setLeafCredsTimer() {
+	c.leaf.credsTmr = time.AfterFunc(leafNodeCredsCheckInterval, c.processLeafCredsTimer)
+}
+
+// Lock should be held.
+func (c *client) clearLeafCredsTimer() {
+	if c.leaf == nil || c.leaf.credsTmr == nil {
+		return
+	}
+	c.leaf.credsTmr.Stop()
+	c.leaf.credsTmr = nil
+}
+
+// processLeafCredsTimer checks if the credentials file of a solicited leafnode
+// connection has changed. If so the connection is closed so that it reconnects
+// with the new credentials.
+func (c *client) processLeafCredsTimer() {
+	c.mu.Lock()
+	c.leaf.credsTmr = nil
+	if c.nc == nil {
+		c.mu.Unlock()
+		return
+	}
+	creds := c.leaf.remote.Credentials
+	fi, err := os.Stat(creds)
+	if err != nil || fi.ModTime().Equal(c.leaf.credsMod) {
+		c.setLeafCredsTimer()
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+
+	c.Noticef("Credentials file %q changed, reconnecting", creds)
+	c.closeConnection(ClientClosed)
+}
+
 // Makes a deep copy of the LeafNode Info structure.
 // The server lock is held on entry.
 func (s *Server) copyLeafNodeInfo() *Info {
@@ -443,6 +570,7 @@ func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 
 	// Determines if we are soliciting the connection or not.
 	var solicited bool
+	var servers []string
 
 	if remote != nil {
 		solicited = true
@@ -459,7 +587,11 @@ func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 			return nil
 		}
 		c.acc = acc
+		c.accn.Store(acc.Name)
 		c.leaf.remote = remote
+		// Let the remote know which servers this account can already
+		// reach, so that it can detect loops.
+		servers = s.leafNodeOrigins(acc)
 	}
 
 	// Grab server variables
@@ -500,8 +632,16 @@ func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 			return nil
 		}
 
-		// Do TLS here as needed.
-		tlsRequired := c.leaf.remote.TLS || c.leaf.remote.TLSConfig != nil
+		// Make sure that we did not connect to ourself.
+		if c.leaf.remoteServer == s.info.ID {
+			c.mu.Unlock()
+			c.leafLoopDetected()
+			return nil
+		}
+
+		// Do TLS here as needed. For websocket, TLS is done at
+		// the transport level before the websocket handshake.
+		tlsRequired := !isWebsocketConn(c.nc) && (c.leaf.remote.TLS || c.leaf.remote.TLSConfig != nil)
 		if tlsRequired {
 			c.Debugf("Starting TLS leafnode client handshake")
 			// Specify the ServerName we are expecting.
@@ -550,7 +690,7 @@ func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 			c.mu.Lock()
 		}
 
-		c.sendLeafConnect(tlsRequired)
+		c.sendLeafConnect(tlsRequired, servers)
 		c.Debugf("Remote leafnode connect msg sent")
 
 	} else {
@@ -560,6 +700,11 @@ func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 		s.generateNonce(c.nonce)
 		info.Nonce = string(c.nonce)
 		info.CID = c.cid
+		// TLS for websocket connections is handled by the transport.
+		if isWebsocketConn(c.nc) {
+			info.TLSRequired = false
+			info.TLSVerify = false
+		}
 		b, _ := json.Marshal(info)
 		pcs := [][]byte{[]byte("INFO"), b, []byte(CR_LF)}
 		c.sendInfo(bytes.Join(pcs, []byte(" ")))
@@ -609,6 +754,11 @@ func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 	// Set the Ping timer
 	c.setPingTimer()
 
+	// Watch for credentials changes if we solicited.
+	if solicited && c.leaf.remote.Credentials != "" {
+		c.setLeafCredsTimer()
+	}
+
 	c.mu.Unlock()
 
 	// Update server's accounting here if we solicited.
@@ -640,13 +790,18 @@ func (c *client) processLeafnodeInfo(info *Info) {
 	if c.flags.setIfNotSet(infoReceived) {
 		// Capture a nonce here.
 		c.nonce = []byte(info.Nonce)
+		c.leaf.remoteServer = info.ID
+		c.leaf.remoteCluster = info.Cluster
+		c.headers = info.Headers
 		if info.TLSRequired && c.leaf.remote != nil {
 			c.leaf.remote.TLS = true
 		}
 	}
 	// For both initial INFO and async INFO protocols, Possibly
 	// update our list of remote leafnode URLs we can connect to.
-	if c.leaf.remote != nil && len(info.LeafNodeURLs) > 0 {
+	// The advertised URLs are not websocket ones, so they are
+	// ignored if we connected over websocket.
+	if c.leaf.remote != nil && len(info.LeafNodeURLs) > 0 && !isWebsocketConn(c.nc) {
 		// Consider the incoming array as the most up-to-date
 		// representation of the remote cluster's list of URLs.
 		c.updateLeafNodeURLs(info)
@@ -723,6 +878,7 @@ func (s *Server) addLeafNodeConnection(c *client) {
 	s.mu.Lock()
 	s.leafs[cid] = c
 	s.mu.Unlock()
+	s.remoteConnectEvent(c)
 }
 
 func (s *Server) removeLeafNodeConnection(c *client) {
@@ -742,6 +898,13 @@ type leafConnectInfo struct {
 	TLS  bool   `json:"tls_required"`
 	Comp bool   `json:"compression,omitempty"`
 	Name string `json:"name,omitempty"`
+	// Name of the cluster the remote server belongs to.
+	Cluster string `json:"cluster,omitempty"`
+
+	// IDs of the servers the bound account can reach over leafnodes,
+	// including the server sending the connect.
+	Servers []string `json:"servers,omitempty"`
+	Headers bool     `json:"headers,omitempty"`
 
 	// Just used to detect wrong connection attempts.
 	Gateway string `json:"gateway,omitempty"`
@@ -775,6 +938,21 @@ func (c *client) processLeafNodeConnect(s *Server, arg []byte, lang string) erro
 		return ErrWrongGateway
 	}
 
+	// Servers identify themselves with their ID. Reject a connection from
+	// ourself, or from a server that can already reach one of the servers
+	// our bound account can reach, since there would be two paths to it.
+	if proto.Name != "" {
+		c.mu.Lock()
+		c.leaf.remoteServer = proto.Name
+		c.leaf.remoteCluster = proto.Cluster
+		acc := c.acc
+		c.mu.Unlock()
+		if proto.Name == s.info.ID || (acc != nil && stringsIntersect(proto.Servers, s.leafNodeOrigins(acc))) {
+			c.leafLoopDetected()
+			return ErrLeafNodeLoop
+		}
+	}
+
 	// Leaf Nodes do not do echo or verbose or pedantic.
 	c.opts.Verbose = false
 	c.opts.Echo = false
@@ -807,6 +985,9 @@ func (s *Server) initLeafNodeSmap(c *client) {
 		c.Debugf("Leafnode does not have an account bound")
 		return
 	}
+	// Our loop detection subject, see leafNodeLoopDetectionSubjectPrefix.
+	lds := leafNodeLoopDetectionSubjectPrefix + s.info.ID
+
 	// Collect all account subs here.
 	_subs := [32]*subscription{}
 	subs := _subs[:0]
@@ -841,15 +1022,29 @@ func (s *Server) initLeafNodeSmap(c *client) {
 
 	// Now walk the results and add them to our smap
 	c.mu.Lock()
+	// Loop detection subjects are only exchanged with servers.
+	isServer := c.leaf.remoteServer != ""
 	for _, sub := range subs {
-		// We ignore ourselves here.
-		if c != sub.client {
+		// We ignore ourselves here, and interest we can not import.
+		if c == sub.client {
+			continue
+		}
+		if isLeafNodeLoopDetectionSubject(sub.subject) {
+			if isServer {
+				c.leaf.smap[keyFromSub(sub)]++
+			}
+		} else if c.canImport(string(sub.subject)) {
 			c.leaf.smap[keyFromSub(sub)]++
 		}
 	}
+	if isServer {
+		c.leaf.smap[lds]++
+	}
 	// FIXME(dlc) - We need to update appropriately on an account claims update.
 	for _, isubj := range ims {
-		c.leaf.smap[isubj]++
+		if c.canImport(isubj) {
+			c.leaf.smap[isubj]++
+		}
 	}
 	c.mu.Unlock()
 }
@@ -894,6 +1089,17 @@ func (c *client) updateSmap(sub *subscription, delta int32) {
 	key := keyFromSub(sub)
 
 	c.mu.Lock()
+	// Do not send interest the leafnode is not allowed to export to us.
+	// Loop detection subjects are only sent to servers, regardless of that.
+	if isLeafNodeLoopDetectionSubject(sub.subject) {
+		if c.leaf.remoteServer == "" {
+			c.mu.Unlock()
+			return
+		}
+	} else if !c.canImport(string(sub.subject)) {
+		c.mu.Unlock()
+		return
+	}
 	n := c.leaf.smap[key]
 	// We will update if its a queue, if count is zero (or negative), or we were 0 and are N > 0.
 	update := sub.queue != nil || n == 0 || n+delta <= 0
@@ -909,6 +1115,54 @@ func (c *client) updateSmap(sub *subscription, delta int32) {
 	c.mu.Unlock()
 }
 
+// Returns true if the subject is a leafnode loop detection subject.
+func isLeafNodeLoopDetectionSubject(subject []byte) bool {
+	return bytes.HasPrefix(subject, []byte(leafNodeLoopDetectionSubjectPrefix))
+}
+
+// Returns the IDs of the servers the account can reach over leafnodes,
+// this server included. They are collected from the loop detection
+// subjects the account has interest on, which are propagated through
+// all the hops.
+func (s *Server) leafNodeOrigins(acc *Account) []string {
+	_subs := [32]*subscription{}
+	subs := _subs[:0]
+	acc.mu.RLock()
+	acc.sl.All(&subs)
+	acc.mu.RUnlock()
+
+	origins := []string{s.info.ID}
+	for _, sub := range subs {
+		if !isLeafNodeLoopDetectionSubject(sub.subject) {
+			continue
+		}
+		if id := string(sub.subject[len(leafNodeLoopDetectionSubjectPrefix):]); !stringsContains(origins, id) {
+			origins = append(origins, id)
+		}
+	}
+	return origins
+}
+
+// Reports a leafnode loop to the other side and closes the connection.
+// Lock should not be held.
+func (c *client) leafLoopDetected() {
+	c.mu.Lock()
+	var accName string
+	if c.acc != nil {
+		accName = c.acc.Name
+	}
+	remote := c.leaf.remote
+	c.mu.Unlock()
+
+	errTxt := fmt.Sprintf("%s for account %q", ErrLeafNodeLoop, accName)
+	c.Errorf(errTxt)
+	c.sendErr(errTxt)
+	if remote != nil {
+		remote.setLoopDetected()
+	}
+	c.closeConnection(LeafNodeLoopDetected)
+}
+
 // Send the subscription interest change to the other side.
 // Lock should be held.
 func (c *client) sendLeafNodeSubUpdate(key string, n int32) {
@@ -1023,8 +1277,16 @@ func (c *client) processLeafSub(argo []byte) (err error) {
 		return nil
 	}
 
-	// Check permissions if applicable.
-	if !c.canExport(string(sub.subject)) {
+	// Our own loop detection subject came back, so this connection
+	// closes a loop. Other servers' ones are not subject to permissions.
+	if isLeafNodeLoopDetectionSubject(sub.subject) {
+		if string(sub.subject[len(leafNodeLoopDetectionSubjectPrefix):]) == srv.info.ID {
+			c.mu.Unlock()
+			c.leafLoopDetected()
+			return nil
+		}
+	} else if !c.canExport(string(sub.subject)) {
+		// Check permissions if applicable.
 		c.mu.Unlock()
 		c.Debugf("Can not export %q, ignoring remote subscription request", sub.subject)
 		return nil
@@ -1033,7 +1295,7 @@ func (c *client) processLeafSub(argo []byte) (err error) {
 	// Check if we have a maximum on the number of subscriptions.
 	if c.subsAtLimit() {
 		c.mu.Unlock()
-		c.maxSubsExceeded()
+		c.maxSubsExceeded(sub.subject)
 		return nil
 	}
 
@@ -1127,9 +1389,9 @@ func (c *client) processLeafMsgArgs(trace bool, arg []byte) error {
 		c.traceInOp("LMSG", arg)
 	}
 
-	// Unroll splitArgs to avoid runtime/heap issues
-	a := [MAX_MSG_ARGS][]byte{}
-	args := a[:0]
+	// Unroll splitArgs to avoid runtime/heap issues. The queue names are
+	// referenced from the arguments, so those are kept in a reused slice.
+	args := c.msgArgs[:0]
 	start := -1
 	for i, b := range arg {
 		switch b {
@@ -1147,6 +1409,7 @@ func (c *client) processLeafMsgArgs(trace bool, arg []byte) error {
 	if start >= 0 {
 		args = append(args, arg[start:])
 	}
+	c.msgArgs = args
 
 	c.pa.arg = arg
 	switch len(args) {
@@ -1196,6 +1459,14 @@ func (c *client) processLeafMsgArgs(trace bool, arg []byte) error {
 	return nil
 }
 
+// processLeafHeaderMsgArgs processes an inbound HMSG from a leaf node.
+func (c *client) processLeafHeaderMsgArgs(trace bool, arg []byte) error {
+	if trace {
+		c.traceInOp("HMSG", arg)
+	}
+	return c.processHeaderMsgArgs(arg, func(arg []byte) error { return c.processLeafMsgArgs(false, arg) })
+}
+
 // processInboundLeafMsg is called to process an inbound msg from a leaf node.
 func (c *client) processInboundLeafMsg(msg []byte) {
 	// Update statistics
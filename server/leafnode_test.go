@@ -14,13 +14,24 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 )
 
 type captureLeafNodeRandomIPLogger struct {
@@ -136,3 +147,533 @@ func TestLeafNodeTLSWithCerts(t *testing.T) {
 		return nil
 	})
 }
+
+func TestLeafNodeCredentialsFileChange(t *testing.T) {
+	ci := leafNodeCredsCheckInterval
+	leafNodeCredsCheckInterval = 50 * time.Millisecond
+	defer func() { leafNodeCredsCheckInterval = ci }()
+
+	okp, _ := nkeys.FromSeed(oSeed)
+	opub, _ := okp.PublicKey()
+
+	// Account with a signing key.
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	skp, _ := nkeys.CreateAccount()
+	spub, _ := skp.PublicKey()
+	ac := jwt.NewAccountClaims(apub)
+	ac.SigningKeys.Add(spub)
+	ajwt, err := ac.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+
+	o1 := DefaultOptions()
+	o1.TrustedKeys = []string{opub}
+	o1.AccountResolver = &MemAccResolver{}
+	o1.LeafNode.Host = "127.0.0.1"
+	o1.LeafNode.Port = -1
+	s1 := RunServer(o1)
+	defer s1.Shutdown()
+	s1.AccountResolver().Store(apub, ajwt)
+
+	genCreds := func(signer nkeys.KeyPair, issuerAccount string) (string, []byte) {
+		t.Helper()
+		ukp, _ := nkeys.CreateUser()
+		upub, _ := ukp.PublicKey()
+		uc := jwt.NewUserClaims(upub)
+		uc.IssuerAccount = issuerAccount
+		ujwt, err := uc.Encode(signer)
+		if err != nil {
+			t.Fatalf("Error generating user JWT: %v", err)
+		}
+		seed, _ := ukp.Seed()
+		return ujwt, []byte(fmt.Sprintf("-----BEGIN NATS USER JWT-----\n%s\n------END NATS USER JWT------\n\n"+
+			"-----BEGIN USER NKEY SEED-----\n%s\n------END USER NKEY SEED------\n", ujwt, seed))
+	}
+	ujwt, creds := genCreds(akp, "")
+	credsFile := createConfFile(t, creds)
+	defer os.Remove(credsFile)
+
+	checkLeafJWT := func(expected string) {
+		t.Helper()
+		checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+			s1.mu.Lock()
+			defer s1.mu.Unlock()
+			if len(s1.leafs) != 1 {
+				return fmt.Errorf("Number of leaf nodes is %d", len(s1.leafs))
+			}
+			for _, ln := range s1.leafs {
+				ln.mu.Lock()
+				ljwt, acc := ln.opts.JWT, ln.acc
+				ln.mu.Unlock()
+				if ljwt != expected {
+					return fmt.Errorf("Leaf node is not using the expected JWT")
+				}
+				if acc == nil || acc.Name != apub {
+					return fmt.Errorf("Leaf node is not bound to the account")
+				}
+			}
+			return nil
+		})
+	}
+
+	o2 := DefaultOptions()
+	o2.LeafNode.ReconnectInterval = 15 * time.Millisecond
+	o2.LeafNode.Remotes = []*RemoteLeafOpts{{
+		URL:         &url.URL{Scheme: "nats-leaf", Host: fmt.Sprintf("127.0.0.1:%d", o1.LeafNode.Port)},
+		Credentials: credsFile,
+	}}
+	s2 := RunServer(o2)
+	defer s2.Shutdown()
+	checkLeafJWT(ujwt)
+
+	// Replace the credentials with a user issued by the account signing key.
+	ujwt, creds = genCreds(skp, apub)
+	if err := ioutil.WriteFile(credsFile, creds, 0600); err != nil {
+		t.Fatalf("Error writing credentials file: %v", err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(credsFile, future, future)
+	checkLeafJWT(ujwt)
+}
+
+func TestLeafNodeHubPermissions(t *testing.T) {
+	conf1 := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		leafnodes {
+			listen: "127.0.0.1:-1"
+			permissions {
+				import: "import.>"
+				export: "export.>"
+			}
+		}
+	`))
+	defer os.Remove(conf1)
+	s1, o1 := RunServerWithConfig(conf1)
+	defer s1.Shutdown()
+
+	if p := o1.LeafNode.Permissions; p == nil || p.Import == nil || p.Export == nil ||
+		p.Import.Allow[0] != "import.>" || p.Export.Allow[0] != "export.>" {
+		t.Fatalf("Unexpected leafnode permissions: %+v", p)
+	}
+
+	o2 := DefaultOptions()
+	o2.LeafNode.Remotes = []*RemoteLeafOpts{{
+		URL: &url.URL{Scheme: "nats-leaf", Host: fmt.Sprintf("127.0.0.1:%d", o1.LeafNode.Port)},
+	}}
+	s2 := RunServer(o2)
+	defer s2.Shutdown()
+
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if nln := s1.NumLeafNodes(); nln != 1 {
+			return fmt.Errorf("Number of leaf nodes is %d", nln)
+		}
+		return nil
+	})
+
+	nc1, err := nats.Connect(fmt.Sprintf("nats://%s:%d", o1.Host, o1.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc1.Close()
+	nc2, err := nats.Connect(fmt.Sprintf("nats://%s:%d", o2.Host, o2.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc2.Close()
+
+	// Interest on the hub is only sent to the leafnode for imported subjects,
+	// and interest from the leafnode is only accepted for exported subjects.
+	hubSub, _ := nc1.SubscribeSync("other.hub")
+	hubImport, _ := nc1.SubscribeSync("import.hub")
+	nc1.Flush()
+	leafSub, _ := nc2.SubscribeSync("other.leaf")
+	leafExport, _ := nc2.SubscribeSync("export.leaf")
+	nc2.Flush()
+
+	// Each side has its 2 local subscriptions plus one from the other side,
+	// and the loop detection subscription of the other side.
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if n := s1.globalAccount().sl.Count(); n != 4 {
+			return fmt.Errorf("Expected 4 subscriptions on the hub, got %d", n)
+		}
+		if n := s2.globalAccount().sl.Count(); n != 4 {
+			return fmt.Errorf("Expected 4 subscriptions on the leafnode, got %d", n)
+		}
+		return nil
+	})
+
+	nc2.Publish("import.hub", []byte("ok"))
+	nc2.Publish("other.hub", []byte("not ok"))
+	nc2.Flush()
+	nc1.Publish("export.leaf", []byte("ok"))
+	nc1.Publish("other.leaf", []byte("not ok"))
+	nc1.Flush()
+
+	for _, sub := range []*nats.Subscription{hubImport, leafExport} {
+		if _, err := sub.NextMsg(time.Second); err != nil {
+			t.Fatalf("Expected message on %q: %v", sub.Subject, err)
+		}
+	}
+	for _, sub := range []*nats.Subscription{hubSub, leafSub} {
+		if m, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+			t.Fatalf("Did not expect message on %q", m.Subject)
+		}
+	}
+}
+
+// Runs a minimal HTTP proxy that only supports the CONNECT method.
+func runConnectProxy(t *testing.T) (net.Listener, *int32) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error creating proxy listener: %v", err)
+	}
+	var tunnels int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				rc, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer rc.Close()
+				atomic.AddInt32(&tunnels, 1)
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				go io.Copy(rc, conn)
+				io.Copy(conn, rc)
+			}(conn)
+		}
+	}()
+	return l, &tunnels
+}
+
+func TestLeafNodeWebsocket(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		compress bool
+		proxy    bool
+	}{
+		{"plain", false, false},
+		{"compression", true, false},
+		{"proxy", false, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf1 := createConfFile(t, []byte(fmt.Sprintf(`
+				listen: "127.0.0.1:-1"
+				leafnodes {
+					listen: "127.0.0.1:-1"
+					websocket {
+						listen: "127.0.0.1:-1"
+						compression: %v
+					}
+				}
+			`, test.compress)))
+			defer os.Remove(conf1)
+			s1, o1 := RunServerWithConfig(conf1)
+			defer s1.Shutdown()
+
+			o2 := DefaultOptions()
+			o2.LeafNode.ReconnectInterval = 50 * time.Millisecond
+			o2.LeafNode.Remotes = []*RemoteLeafOpts{{
+				URL:         &url.URL{Scheme: "ws", Host: fmt.Sprintf("127.0.0.1:%d", o1.LeafNode.Websocket.Port)},
+				Compression: test.compress,
+			}}
+			var tunnels *int32
+			if test.proxy {
+				var l net.Listener
+				l, tunnels = runConnectProxy(t)
+				defer l.Close()
+				o2.LeafNode.Remotes[0].Proxy = &url.URL{Scheme: "http", Host: l.Addr().String()}
+			}
+			s2 := RunServer(o2)
+			defer s2.Shutdown()
+
+			checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+				if nln := s1.NumLeafNodes(); nln != 1 {
+					return fmt.Errorf("Number of leaf nodes is %d", nln)
+				}
+				return nil
+			})
+			if test.proxy && atomic.LoadInt32(tunnels) != 1 {
+				t.Fatalf("Expected connection to go through the proxy")
+			}
+			var ln *client
+			s2.mu.Lock()
+			for _, c := range s2.leafs {
+				ln = c
+			}
+			s2.mu.Unlock()
+			ln.mu.Lock()
+			ws, ok := ln.nc.(*wsConn)
+			ln.mu.Unlock()
+			if !ok {
+				t.Fatalf("Expected leafnode connection to be a websocket")
+			}
+			if ws.compress != test.compress {
+				t.Fatalf("Expected compression to be %v", test.compress)
+			}
+
+			nc1, err := nats.Connect(fmt.Sprintf("nats://%s:%d", o1.Host, o1.Port))
+			if err != nil {
+				t.Fatalf("Error on connect: %v", err)
+			}
+			defer nc1.Close()
+			nc2, err := nats.Connect(fmt.Sprintf("nats://%s:%d", o2.Host, o2.Port))
+			if err != nil {
+				t.Fatalf("Error on connect: %v", err)
+			}
+			defer nc2.Close()
+
+			sub1, _ := nc1.SubscribeSync("hub")
+			nc1.Flush()
+			sub2, _ := nc2.SubscribeSync("leaf")
+			nc2.Flush()
+			// Each side also has the loop detection subscription of the other.
+			checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+				if n := s1.globalAccount().sl.Count(); n != 3 {
+					return fmt.Errorf("Expected 3 subscriptions on the hub, got %d", n)
+				}
+				if n := s2.globalAccount().sl.Count(); n != 3 {
+					return fmt.Errorf("Expected 3 subscriptions on the leafnode, got %d", n)
+				}
+				return nil
+			})
+
+			// Use a payload big enough to require an extended frame length.
+			big := bytes.Repeat([]byte("x"), 100*1024)
+			nc2.Publish("hub", big)
+			nc2.Flush()
+			nc1.Publish("leaf", []byte("hello"))
+			nc1.Flush()
+			if m, err := sub1.NextMsg(time.Second); err != nil || !bytes.Equal(m.Data, big) {
+				t.Fatalf("Did not get expected message on the hub: %v", err)
+			}
+			if m, err := sub2.NextMsg(time.Second); err != nil || string(m.Data) != "hello" {
+				t.Fatalf("Did not get expected message on the leafnode: %v", err)
+			}
+		})
+	}
+}
+
+type captureLeafNodeLoopLogger struct {
+	DummyLogger
+	ch chan string
+}
+
+func (l *captureLeafNodeLoopLogger) Errorf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if strings.Contains(msg, ErrLeafNodeLoop.Error()) {
+		select {
+		case l.ch <- msg:
+		default:
+		}
+	}
+}
+
+func runLeafNodeLoopServer(t *testing.T, o *Options) (*Server, *captureLeafNodeLoopLogger) {
+	t.Helper()
+	s, err := NewServer(o)
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	l := &captureLeafNodeLoopLogger{ch: make(chan string, 1)}
+	s.SetLogger(l, false, false)
+	go s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		t.Fatalf("Server not ready")
+	}
+	return s, l
+}
+
+func getFreeLeafNodePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error getting a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestLeafNodeLoopDetection(t *testing.T) {
+	orgDelay := leafNodeReconnectDelayAfterLoopDetected
+	leafNodeReconnectDelayAfterLoopDetected = 100 * time.Millisecond
+	defer func() { leafNodeReconnectDelayAfterLoopDetected = orgDelay }()
+
+	t.Run("self", func(t *testing.T) {
+		port := getFreeLeafNodePort(t)
+		o := DefaultOptions()
+		o.LeafNode.Host = "127.0.0.1"
+		o.LeafNode.Port = port
+		o.LeafNode.ReconnectInterval = 50 * time.Millisecond
+		o.LeafNode.Remotes = []*RemoteLeafOpts{{
+			URL: &url.URL{Scheme: "nats-leaf", Host: fmt.Sprintf("127.0.0.1:%d", port)},
+		}}
+		s, l := runLeafNodeLoopServer(t, o)
+		defer s.Shutdown()
+
+		select {
+		case <-l.ch:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Loop was not detected")
+		}
+		if n := s.NumLeafNodes(); n != 0 {
+			t.Fatalf("Expected no leafnode, got %d", n)
+		}
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		portA := getFreeLeafNodePort(t)
+		portB := getFreeLeafNodePort(t)
+
+		oA := DefaultOptions()
+		oA.LeafNode.Host = "127.0.0.1"
+		oA.LeafNode.Port = portA
+		oA.LeafNode.ReconnectInterval = 50 * time.Millisecond
+		oA.LeafNode.Remotes = []*RemoteLeafOpts{{
+			URL: &url.URL{Scheme: "nats-leaf", Host: fmt.Sprintf("127.0.0.1:%d", portB)},
+		}}
+		sA, lA := runLeafNodeLoopServer(t, oA)
+		defer sA.Shutdown()
+
+		oB := DefaultOptions()
+		oB.LeafNode.Host = "127.0.0.1"
+		oB.LeafNode.Port = portB
+		oB.LeafNode.ReconnectInterval = 50 * time.Millisecond
+		oB.LeafNode.Remotes = []*RemoteLeafOpts{{
+			URL: &url.URL{Scheme: "nats-leaf", Host: fmt.Sprintf("127.0.0.1:%d", portA)},
+		}}
+		sB, lB := runLeafNodeLoopServer(t, oB)
+		defer sB.Shutdown()
+
+		select {
+		case <-lA.ch:
+		case <-lB.ch:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Loop was not detected")
+		}
+		// Only one of the two connections should be kept.
+		checkFor(t, time.Second, 15*time.Millisecond, func() error {
+			if nA, nB := sA.NumLeafNodes(), sB.NumLeafNodes(); nA != 1 || nB != 1 {
+				return fmt.Errorf("Expected 1 leafnode on each server, got %d and %d", nA, nB)
+			}
+			return nil
+		})
+		// And this stays so after the reconnect delay.
+		time.Sleep(3 * leafNodeReconnectDelayAfterLoopDetected)
+		if nA, nB := sA.NumLeafNodes(), sB.NumLeafNodes(); nA != 1 || nB != 1 {
+			t.Fatalf("Expected 1 leafnode on each server, got %d and %d", nA, nB)
+		}
+	})
+
+	t.Run("three servers", func(t *testing.T) {
+		portA := getFreeLeafNodePort(t)
+		portB := getFreeLeafNodePort(t)
+		portC := getFreeLeafNodePort(t)
+
+		newOpts := func(port, remotePort int, reconnect time.Duration) *Options {
+			o := DefaultOptions()
+			o.LeafNode.Host = "127.0.0.1"
+			o.LeafNode.Port = port
+			o.LeafNode.ReconnectInterval = reconnect
+			o.LeafNode.Remotes = []*RemoteLeafOpts{{
+				URL: &url.URL{Scheme: "nats-leaf", Host: fmt.Sprintf("127.0.0.1:%d", remotePort)},
+			}}
+			return o
+		}
+		countLeafs := func(servers ...*Server) int {
+			n := 0
+			for _, s := range servers {
+				n += s.NumLeafNodes()
+			}
+			return n
+		}
+
+		// C solicits A, which is not running yet, so it will retry.
+		sC, lC := runLeafNodeLoopServer(t, newOpts(portC, portA, 250*time.Millisecond))
+		defer sC.Shutdown()
+		// B solicits C.
+		sB, lB := runLeafNodeLoopServer(t, newOpts(portB, portC, 50*time.Millisecond))
+		defer sB.Shutdown()
+		checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+			if n := countLeafs(sB, sC); n != 2 {
+				return fmt.Errorf("Expected B and C to be connected, got %d leafnodes", n)
+			}
+			return nil
+		})
+		// A solicits B, and C then connects to A, which closes the loop.
+		sA, lA := runLeafNodeLoopServer(t, newOpts(portA, portB, 50*time.Millisecond))
+		defer sA.Shutdown()
+
+		select {
+		case <-lA.ch:
+		case <-lB.ch:
+		case <-lC.ch:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Loop was not detected")
+		}
+		// Only two of the three connections should be kept.
+		checkFor(t, time.Second, 15*time.Millisecond, func() error {
+			if n := countLeafs(sA, sB, sC); n != 4 {
+				return fmt.Errorf("Expected 4 leafnodes, got %d", n)
+			}
+			return nil
+		})
+		// And this stays so after the reconnect delay.
+		time.Sleep(3 * leafNodeReconnectDelayAfterLoopDetected)
+		if n := countLeafs(sA, sB, sC); n != 4 {
+			t.Fatalf("Expected 4 leafnodes, got %d", n)
+		}
+	})
+}
+
+type captureLeafNodeGiveUpLogger struct {
+	DummyLogger
+	ch chan string
+}
+
+func (l *captureLeafNodeGiveUpLogger) Errorf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if strings.Contains(msg, "Giving up") {
+		select {
+		case l.ch <- msg:
+		default:
+		}
+	}
+}
+
+func TestLeafNodeRemoteConnectRetries(t *testing.T) {
+	u, _ := url.Parse(fmt.Sprintf("nats://127.0.0.1:%d", getFreeLeafNodePort(t)))
+	o := DefaultOptions()
+	o.LeafNode.ReconnectInterval = 10 * time.Millisecond
+	o.LeafNode.Remotes = []*RemoteLeafOpts{{URL: u, ConnectRetries: 3}}
+	s, err := NewServer(o)
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	l := &captureLeafNodeGiveUpLogger{ch: make(chan string, 1)}
+	s.SetLogger(l, false, false)
+	go s.Start()
+	defer s.Shutdown()
+
+	select {
+	case msg := <-l.ch:
+		if !strings.Contains(msg, "after 4 attempts") {
+			t.Fatalf("Unexpected error: %q", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Server did not give up connecting to the remote")
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server/pse"
+)
+
+// Orders of the client connect URLs sent to the clients.
+const (
+	// ConnectURLsOrderNone sends the URLs in the order they are known.
+	ConnectURLsOrderNone = "none"
+	// ConnectURLsOrderShuffle shuffles the URLs for each client.
+	ConnectURLsOrderShuffle = "shuffle"
+	// ConnectURLsOrderWeighted shuffles the URLs for each client, placing
+	// the URLs of the least loaded servers first more often.
+	ConnectURLsOrderWeighted = "weighted"
+)
+
+// ServerLoad is the load of a server, advertised to the clients with the
+// client connect URLs of the server and exchanged between the servers of
+// a cluster.
+type ServerLoad struct {
+	Connections int     `json:"connections"`
+	CPU         float64 `json:"cpu"`
+}
+
+// Returns the normalized connect URLs order or an error if invalid.
+// An empty order is the same as ConnectURLsOrderNone.
+func validateConnectURLsOrder(order string) (string, error) {
+	switch o := strings.ToLower(order); o {
+	case _EMPTY_, ConnectURLsOrderNone:
+		return ConnectURLsOrderNone, nil
+	case ConnectURLsOrderShuffle, ConnectURLsOrderWeighted:
+		return o, nil
+	default:
+		return _EMPTY_, fmt.Errorf("invalid connect_urls_order %q, should be one of %q, %q or %q",
+			order, ConnectURLsOrderNone, ConnectURLsOrderShuffle, ConnectURLsOrderWeighted)
+	}
+}
+
+// Returns true if the servers of the cluster exchange their load, which is
+// the case when advertised to the clients or used to order the URLs.
+func loadHintsEnabled(opts *Options) bool {
+	return opts.Cluster.LoadHints || opts.Cluster.ConnectURLsOrder == ConnectURLsOrderWeighted
+}
+
+// Periodically sends the load of this server to the routes that exchange
+// load hints, and updates the load of the servers behind the client
+// connect URLs.
+func (s *Server) loadHintsLoop() {
+	defer s.grWG.Done()
+
+	for s.isRunning() {
+		s.updateLoadHints()
+
+		interval := s.getOpts().Cluster.LoadHintsInterval
+		if interval <= 0 {
+			interval = DEFAULT_LOAD_HINTS_INTERVAL
+		}
+		select {
+		case <-s.quitCh:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (s *Server) updateLoadHints() {
+	var rss, vss int64
+	var pcpu float64
+	pse.ProcUsage(&pcpu, &rss, &vss)
+	opts := s.getOpts()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	load := &ServerLoad{Connections: len(s.clients), CPU: pcpu}
+	b, _ := json.Marshal(&Info{ID: s.info.ID, Load: load})
+	infoJSON := []byte(fmt.Sprintf(InfoProto, b))
+	for _, r := range s.remotes {
+		r.mu.Lock()
+		if r.route.loadHints {
+			r.sendInfo(infoJSON)
+		}
+		r.mu.Unlock()
+	}
+
+	// The load of the URLs advertised to the clients, of this server unless
+	// it is going away, and of the remote servers that sent their load.
+	loads := make(map[string]*ServerLoad)
+	if !s.ldm {
+		for _, u := range s.clientConnectURLs {
+			loads[u] = load
+		}
+	}
+	for id, rl := range s.routeLoads {
+		r := s.remotes[id]
+		if r == nil {
+			delete(s.routeLoads, id)
+			continue
+		}
+		r.mu.Lock()
+		for _, u := range r.route.connectURLs {
+			if _, ok := s.clientConnectURLsMap[u]; ok {
+				loads[u] = rl
+			}
+		}
+		r.mu.Unlock()
+	}
+	s.urlsLoad = loads
+	s.info.ConnectURLsLoad = nil
+	if opts.Cluster.LoadHints {
+		s.info.ConnectURLsLoad = loads
+	}
+}
+
+// Invoked when a route sends the load of its server.
+func (s *Server) processRouteLoad(id string, load *ServerLoad) {
+	s.mu.Lock()
+	if s.remotes[id] != nil {
+		s.routeLoads[id] = load
+	}
+	s.mu.Unlock()
+}
+
+// orderConnectURLs orders the URLs in place, shuffled or weighted by the
+// load of their servers. A server's weight is the inverse of its number of
+// connections and CPU usage, the servers of unknown load having the weight
+// of a server without any.
+func orderConnectURLs(urls []string, order string, loads map[string]*ServerLoad) {
+	switch order {
+	case ConnectURLsOrderShuffle:
+		rand.Shuffle(len(urls), func(i, j int) { urls[i], urls[j] = urls[j], urls[i] })
+	case ConnectURLsOrderWeighted:
+		// Exponentially distributed keys with the weights as rates, so that
+		// each URL is first with a probability proportional to its weight.
+		keys := make(map[string]float64, len(urls))
+		for _, u := range urls {
+			w := 1.0
+			if l := loads[u]; l != nil {
+				w = 1 / (float64(1+l.Connections) * (1 + math.Max(l.CPU, 0)/100))
+			}
+			keys[u] = rand.ExpFloat64() / w
+		}
+		sort.Slice(urls, func(i, j int) bool { return keys[urls[i]] < keys[urls[j]] })
+	}
+}
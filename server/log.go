@@ -14,8 +14,12 @@
 package server
 
 import (
+	"fmt"
 	"io"
+	"net"
+	"net/url"
 	"os"
+	"runtime"
 	"sync/atomic"
 
 	srvlog "github.com/nats-io/nats-server/v2/logger"
@@ -43,6 +47,96 @@ type Logger interface {
 	Tracef(format string, v ...interface{})
 }
 
+// FieldLogger is a Logger that can also log statements with structured
+// fields, given as key and value pairs, such as the JSON logger.
+type FieldLogger interface {
+	Logger
+
+	// Log a statement with fields
+	Logf(level srvlog.Level, fields []interface{}, format string, v ...interface{})
+}
+
+// Log formats of the outputs.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Returns if the output with the given format, which defaults
+// to the log_format option, produces JSON.
+func isJSONLogFormat(format, defaultFormat string) bool {
+	if format == _EMPTY_ {
+		format = defaultFormat
+	}
+	return format == logFormatJSON
+}
+
+// System loggers, selected with the syslog_backend option.
+const (
+	// The journal on Linux when available, the event log on Windows
+	// and syslog otherwise.
+	syslogBackendAuto     = "auto"
+	syslogBackendSyslog   = "syslog"
+	syslogBackendJournal  = "journal"
+	syslogBackendEventLog = "eventlog"
+)
+
+func validateLogFormats(o *Options) error {
+	for name, f := range map[string]string{
+		"log_format":     o.LogFormat,
+		"logfile_format": o.LogFileFormat,
+		"syslog_format":  o.SyslogFormat,
+	} {
+		if f != _EMPTY_ && f != logFormatText && f != logFormatJSON {
+			return fmt.Errorf("%s should be %q or %q, got %q", name, logFormatText, logFormatJSON, f)
+		}
+	}
+	switch o.SyslogBackend {
+	case _EMPTY_, syslogBackendAuto:
+	case syslogBackendSyslog:
+		if runtime.GOOS == "windows" {
+			return fmt.Errorf("syslog_backend %q is not available on Windows", o.SyslogBackend)
+		}
+	case syslogBackendJournal:
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("syslog_backend %q is only available on Linux", o.SyslogBackend)
+		}
+	case syslogBackendEventLog:
+		if runtime.GOOS != "windows" {
+			return fmt.Errorf("syslog_backend %q is only available on Windows", o.SyslogBackend)
+		}
+	default:
+		return fmt.Errorf("syslog_backend should be %q, %q, %q or %q, got %q", syslogBackendAuto,
+			syslogBackendSyslog, syslogBackendJournal, syslogBackendEventLog, o.SyslogBackend)
+	}
+	return nil
+}
+
+// Scheme of the remote syslog URL for syslog over TLS, as per RFC 5425.
+const remoteSyslogTLSScheme = "tls"
+
+func validateRemoteSyslog(o *Options) error {
+	if o.RemoteSyslogBuffer < 0 {
+		return fmt.Errorf("remote_syslog_buffer can not be negative, got %v", o.RemoteSyslogBuffer)
+	}
+	isTLS := false
+	if o.RemoteSyslog != _EMPTY_ {
+		u, err := url.Parse(o.RemoteSyslog)
+		if err != nil {
+			return fmt.Errorf("invalid remote_syslog %q: %v", o.RemoteSyslog, err)
+		}
+		if isTLS = u.Scheme == remoteSyslogTLSScheme; isTLS {
+			if _, _, err := net.SplitHostPort(u.Host); err != nil {
+				return fmt.Errorf("invalid remote_syslog %q: %v", o.RemoteSyslog, err)
+			}
+		}
+	}
+	if !isTLS && (o.RemoteSyslogTLSConfig != nil || o.RemoteSyslogBuffer > 0) {
+		return fmt.Errorf("remote_syslog_tls and remote_syslog_buffer require a %s:// remote_syslog", remoteSyslogTLSScheme)
+	}
+	return nil
+}
+
 // ConfigureLogger configures and sets the logger for the server.
 func (s *Server) ConfigureLogger() {
 	var (
@@ -63,12 +157,19 @@ func (s *Server) ConfigureLogger() {
 		syslog = true
 	}
 
+	if opts.SyslogName != _EMPTY_ {
+		srvlog.SetSyslogName(opts.SyslogName)
+	}
+
+	var warning error
 	if opts.LogFile != "" {
-		log = srvlog.NewFileLogger(opts.LogFile, opts.Logtime, opts.Debug, opts.Trace, true)
+		log = s.newFileLogger(opts)
 	} else if opts.RemoteSyslog != "" {
-		log = srvlog.NewRemoteSysLogger(opts.RemoteSyslog, opts.Debug, opts.Trace)
+		log = s.newRemoteSysLogger(opts)
 	} else if syslog {
-		log = srvlog.NewSysLogger(opts.Debug, opts.Trace)
+		log, warning = s.newSysLogger(opts)
+	} else if isJSONLogFormat(opts.LogFormat, logFormatText) {
+		log = srvlog.NewJSONStdLogger(s.info.ID, opts.Debug, opts.Trace)
 	} else {
 		colors := true
 		// Check to see if stderr is being redirected and if so turn off color
@@ -81,6 +182,70 @@ func (s *Server) ConfigureLogger() {
 	}
 
 	s.SetLogger(log, opts.Debug, opts.Trace)
+	if warning != nil {
+		s.Warnf("%v", warning)
+	}
+}
+
+// Returns the logger writing to the remote syslog, over TLS if its URL has
+// the tls scheme.
+func (s *Server) newRemoteSysLogger(opts *Options) Logger {
+	json := isJSONLogFormat(opts.SyslogFormat, opts.LogFormat)
+	if u, err := url.Parse(opts.RemoteSyslog); err == nil && u.Scheme == remoteSyslogTLSScheme {
+		sl := srvlog.NewTLSSysLogger(u.Host, opts.RemoteSyslogTLSConfig, opts.RemoteSyslogBuffer, opts.Debug, opts.Trace)
+		if json {
+			return srvlog.NewJSONTLSSysLogger(sl, s.info.ID)
+		}
+		return sl
+	}
+	sl := srvlog.NewRemoteSysLogger(opts.RemoteSyslog, opts.Debug, opts.Trace)
+	if json {
+		return srvlog.NewJSONSysLogger(sl, s.info.ID)
+	}
+	return sl
+}
+
+// Returns the system logger selected by the syslog_backend option. The
+// journal falls back to syslog, with a warning, if it can not be used.
+func (s *Server) newSysLogger(opts *Options) (Logger, error) {
+	var err error
+	backend := opts.SyslogBackend
+	if backend == _EMPTY_ || backend == syslogBackendAuto {
+		if srvlog.JournalAvailable() {
+			backend = syslogBackendJournal
+		}
+	}
+	if backend == syslogBackendJournal {
+		var jl *srvlog.JournalLogger
+		if jl, err = srvlog.NewJournalLogger(s.info.ID, opts.Debug, opts.Trace); err == nil {
+			return jl, nil
+		}
+		err = fmt.Errorf("Unable to log to the journal, using syslog: %v", err)
+	}
+	// On Windows, the system logger writes to the event log.
+	sl := srvlog.NewSysLogger(opts.Debug, opts.Trace)
+	if isJSONLogFormat(opts.SyslogFormat, opts.LogFormat) {
+		return srvlog.NewJSONSysLogger(sl, s.info.ID), err
+	}
+	return sl, err
+}
+
+// Returns the logger writing to the log file in the configured format.
+func (s *Server) newFileLogger(opts *Options) Logger {
+	ro := srvlog.RotateOpts{
+		SizeLimit:  opts.LogSizeLimit,
+		MaxAge:     opts.LogMaxAge,
+		MaxBackups: opts.LogMaxBackups,
+		Compress:   opts.LogCompress,
+		// Logging continues in the current file on errors.
+		ErrorHandler: func(err error) {
+			s.Errorf("%v", err)
+		},
+	}
+	if isJSONLogFormat(opts.LogFileFormat, opts.LogFormat) {
+		return srvlog.NewJSONFileLogger(opts.LogFile, s.info.ID, opts.Debug, opts.Trace, ro)
+	}
+	return srvlog.NewRotatingFileLogger(opts.LogFile, opts.Logtime, opts.Debug, opts.Trace, true, ro)
 }
 
 // SetLogger sets the logger of the server
@@ -130,13 +295,35 @@ func (s *Server) ReOpenLogFile() {
 	if opts.LogFile == "" {
 		s.Noticef("File log re-open ignored, not a file logger")
 	} else {
-		fileLog := srvlog.NewFileLogger(opts.LogFile,
-			opts.Logtime, opts.Debug, opts.Trace, true)
-		s.SetLogger(fileLog, opts.Debug, opts.Trace)
+		s.SetLogger(s.newFileLogger(opts), opts.Debug, opts.Trace)
 		s.Noticef("File log re-opened")
 	}
 }
 
+// RotateLogFile if the logger is a file based logger, moves the file to a
+// backup with a timestamp suffix and starts a new one, the backups being
+// compressed and removed as configured.
+func (s *Server) RotateLogFile() {
+	// Check to make sure this is a file logger.
+	s.logging.RLock()
+	ll := s.logging.logger
+	s.logging.RUnlock()
+
+	if ll == nil {
+		s.Noticef("File log rotation ignored, no logger")
+		return
+	}
+
+	rl, ok := ll.(interface{ Rotate() error })
+	if !ok || s.getOpts().LogFile == "" {
+		s.Noticef("File log rotation ignored, not a file logger")
+	} else if err := rl.Rotate(); err != nil {
+		s.Errorf("Error rotating log file: %v", err)
+	} else {
+		s.Noticef("File log rotated")
+	}
+}
+
 // Noticef logs a notice statement
 func (s *Server) Noticef(format string, v ...interface{}) {
 	s.executeLogCall(func(logger Logger, format string, v ...interface{}) {
@@ -187,6 +374,47 @@ func (s *Server) Tracef(format string, v ...interface{}) {
 	}, format, v...)
 }
 
+// Logs the statement with the fields if the logger supports them,
+// otherwise the statement is logged with the prefix.
+func (s *Server) logWithFields(level srvlog.Level, fields []interface{}, prefix, format string, v ...interface{}) {
+	switch level {
+	case srvlog.LevelDebug:
+		if atomic.LoadInt32(&s.logging.debug) == 0 {
+			return
+		}
+	case srvlog.LevelTrace:
+		if atomic.LoadInt32(&s.logging.trace) == 0 {
+			return
+		}
+	}
+
+	s.logging.RLock()
+	defer s.logging.RUnlock()
+	logger := s.logging.logger
+	if logger == nil {
+		return
+	}
+	if fl, ok := logger.(FieldLogger); ok {
+		fl.Logf(level, fields, format, v...)
+		return
+	}
+	format = prefix + format
+	switch level {
+	case srvlog.LevelTrace:
+		logger.Tracef(format, v...)
+	case srvlog.LevelDebug:
+		logger.Debugf(format, v...)
+	case srvlog.LevelInfo:
+		logger.Noticef(format, v...)
+	case srvlog.LevelWarn:
+		logger.Warnf(format, v...)
+	case srvlog.LevelError:
+		logger.Errorf(format, v...)
+	case srvlog.LevelFatal:
+		logger.Fatalf(format, v...)
+	}
+}
+
 func (s *Server) executeLogCall(f func(logger Logger, format string, v ...interface{}), format string, args ...interface{}) {
 	s.logging.RLock()
 	defer s.logging.RUnlock()
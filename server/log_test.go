@@ -14,16 +14,24 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/nats-io/nats-server/v2/logger"
+	"github.com/nats-io/nats.go"
 )
 
 func TestSetLogger(t *testing.T) {
@@ -344,3 +352,234 @@ func TestRemovePassFromTrace(t *testing.T) {
 		})
 	}
 }
+
+func TestJSONLogFormat(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "_nats-server")
+	if err != nil {
+		t.Fatalf("Could not create tmp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	logFile := filepath.Join(tmpDir, "nats-server.log")
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		log_file: %q
+		logfile_format: json
+		accounts {
+			A { users [{user: a, password: pwd, permissions: {publish: {deny: "secret"}}}] }
+		}
+	`, logFile)))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://a:pwd@%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	nc.Publish("secret", []byte("hello"))
+	nc.Flush()
+
+	var violation map[string]interface{}
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		buf, err := ioutil.ReadFile(logFile)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+			var m map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &m); err != nil {
+				t.Fatalf("Error decoding %q: %v", line, err)
+			}
+			if m["server_id"] != s.ID() {
+				t.Fatalf("Unexpected server id in %q", line)
+			}
+			if strings.HasPrefix(m["msg"].(string), "Publish Violation") {
+				violation = m
+			}
+		}
+		if violation == nil {
+			return fmt.Errorf("Violation not logged yet")
+		}
+		return nil
+	})
+	if violation["level"] != "error" || violation["subject"] != "secret" || violation["account"] != "A" ||
+		violation["conn_type"] != "client" || violation["client_id"] == nil {
+		t.Fatalf("Unexpected statement: %v", violation)
+	}
+
+	opts.LogFileFormat = "xml"
+	if err := validateOptions(opts); err == nil || !strings.Contains(err.Error(), "logfile_format") {
+		t.Fatalf("Expected an error about the format, got %v", err)
+	}
+}
+
+func TestLogFileRotation(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "_nats-server")
+	if err != nil {
+		t.Fatalf("Could not create tmp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	logFile := filepath.Join(tmpDir, "nats-server.log")
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		log_file: %q
+		logfile_size_limit: 1MB
+		logfile_max_age: "1h"
+		logfile_max_backups: 2
+		logfile_compress: true
+	`, logFile)))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if opts.LogSizeLimit != 1024*1024 || opts.LogMaxAge != time.Hour || opts.LogMaxBackups != 2 || !opts.LogCompress {
+		t.Fatalf("Unexpected rotation options: %v %v %v %v",
+			opts.LogSizeLimit, opts.LogMaxAge, opts.LogMaxBackups, opts.LogCompress)
+	}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	// The file is rotated on demand too.
+	for i := 0; i < 3; i++ {
+		s.RotateLogFile()
+	}
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		backups, err := filepath.Glob(logFile + ".*.gz")
+		if err != nil {
+			return err
+		}
+		if len(backups) != 2 {
+			return fmt.Errorf("Expected 2 compressed backups, got %q", backups)
+		}
+		return nil
+	})
+	buf, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	if !strings.Contains(string(buf), "File log rotated") || strings.Contains(string(buf), "Server is ready") {
+		t.Fatalf("Unexpected content: %q", buf)
+	}
+
+	// Re-opening the file, e.g. once moved by an external tool, does not
+	// rotate it.
+	s.ReOpenLogFile()
+	buf, err = ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	if !strings.Contains(string(buf), "File log rotated") || !strings.Contains(string(buf), "File log re-opened") {
+		t.Fatalf("Unexpected content: %q", buf)
+	}
+	if backups, _ := filepath.Glob(logFile + ".*"); len(backups) != 2 {
+		t.Fatalf("Expected 2 backups, got %q", backups)
+	}
+}
+
+func TestSyslogBackendConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		syslog: true
+		syslog_backend: AUTO
+		syslog_name: nats-test
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if opts.SyslogBackend != syslogBackendAuto || opts.SyslogName != "nats-test" {
+		t.Fatalf("Unexpected options: %q, %q", opts.SyslogBackend, opts.SyslogName)
+	}
+	if err := validateOptions(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for backend, goos := range map[string]string{
+		syslogBackendJournal:  "linux",
+		syslogBackendEventLog: "windows",
+	} {
+		opts.SyslogBackend = backend
+		err := validateOptions(opts)
+		if ok := err == nil; ok != (runtime.GOOS == goos) {
+			t.Fatalf("Unexpected result for %q on %s: %v", backend, runtime.GOOS, err)
+		}
+	}
+	opts.SyslogBackend = "console"
+	if err := validateOptions(opts); err == nil || !strings.Contains(err.Error(), "syslog_backend") {
+		t.Fatalf("Expected an error about the backend, got %v", err)
+	}
+}
+
+func TestRemoteSyslogTLS(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		remote_syslog: "tls://127.0.0.1:6514"
+		remote_syslog_tls { ca_file: "../test/configs/certs/ca.pem" }
+		remote_syslog_buffer: 100
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if opts.RemoteSyslogTLSConfig == nil || opts.RemoteSyslogTLSConfig.RootCAs == nil || opts.RemoteSyslogBuffer != 100 {
+		t.Fatalf("Unexpected options: %+v, %v", opts.RemoteSyslogTLSConfig, opts.RemoteSyslogBuffer)
+	}
+	if err := validateOptions(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	opts.RemoteSyslog = "udp://127.0.0.1:514"
+	if err := validateOptions(opts); err == nil || !strings.Contains(err.Error(), "remote_syslog_tls") {
+		t.Fatalf("Expected an error about the TLS remote syslog, got %v", err)
+	}
+
+	// The server logs to a syslog server over TLS.
+	cert, err := tls.LoadX509KeyPair("../test/configs/certs/server-cert.pem", "../test/configs/certs/server-key.pem")
+	if err != nil {
+		t.Fatalf("Error loading certificate: %v", err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+
+	tlsConfig := opts.RemoteSyslogTLSConfig.Clone()
+	// Verify as of a time the test certificates are valid.
+	tlsConfig.Time = func() time.Time { return time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC) }
+	sopts := DefaultOptions()
+	sopts.NoLog = false
+	sopts.RemoteSyslog = "tls://" + l.Addr().String()
+	sopts.RemoteSyslogTLSConfig = tlsConfig
+	s := RunServer(sopts)
+	defer s.Shutdown()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Error accepting: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	for {
+		size, err := br.ReadString(' ')
+		if err != nil {
+			t.Fatalf("Error reading: %v", err)
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(size))
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(br, msg); err != nil {
+			t.Fatalf("Error reading: %v", err)
+		}
+		if bytes.Contains(msg, []byte("Server is ready")) {
+			break
+		}
+	}
+}
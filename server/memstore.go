@@ -0,0 +1,514 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memStore is a StreamStore that keeps messages in memory only.
+type memStore struct {
+	mu      sync.RWMutex
+	cfg     StreamConfig
+	state   StreamState
+	msgs    map[uint64]*storedMsg
+	fss     subjIndex
+	ageChk  *time.Timer
+	scb     func(md, bd int64)
+	stopped bool
+}
+
+// Internal representation of a stored message.
+type storedMsg struct {
+	subj string
+	hdr  []byte
+	msg  []byte
+	seq  uint64
+	ts   int64
+}
+
+func newMemStore(cfg *StreamConfig) (*memStore, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("config required")
+	}
+	if cfg.Storage != MemoryStorage {
+		return nil, fmt.Errorf("memStore requires memory storage type in config")
+	}
+	return &memStore{msgs: make(map[uint64]*storedMsg), fss: make(subjIndex), cfg: *cfg}, nil
+}
+
+// StoreMsg stores a message.
+func (ms *memStore) StoreMsg(subj string, hdr, msg []byte) (uint64, int64, error) {
+	return ms.storeMsg(subj, hdr, msg, 0, 0)
+}
+
+// StoreRawMsg stores a message with the given sequence and timestamp.
+func (ms *memStore) StoreRawMsg(subj string, hdr, msg []byte, seq uint64, ts int64) error {
+	if seq == 0 {
+		return ErrStoreSeqOutOfOrder
+	}
+	_, _, err := ms.storeMsg(subj, hdr, msg, seq, ts)
+	return err
+}
+
+// Stores the message, the next sequence and the current time are used
+// when not given.
+func (ms *memStore) storeMsg(subj string, hdr, msg []byte, seq uint64, ts int64) (uint64, int64, error) {
+	ms.mu.Lock()
+	if ms.stopped {
+		ms.mu.Unlock()
+		return 0, 0, ErrStoreClosed
+	}
+	if seq == 0 {
+		seq = ms.state.LastSeq + 1
+	} else if seq <= ms.state.LastSeq {
+		ms.mu.Unlock()
+		return 0, 0, ErrStoreSeqOutOfOrder
+	}
+	if ts == 0 {
+		ts = time.Now().UnixNano()
+	}
+	// Make copy since the caller may reuse the buffer.
+	if len(hdr) > 0 {
+		hdr = append([]byte(nil), hdr...)
+	} else {
+		hdr = nil
+	}
+	if len(msg) > 0 {
+		msg = append([]byte(nil), msg...)
+	}
+	if ms.state.Msgs == 0 {
+		ms.state.FirstSeq = seq
+		ms.state.FirstTime = time.Unix(0, ts).UTC()
+	}
+	ms.msgs[seq] = &storedMsg{subj, hdr, msg, seq, ts}
+	ms.fss.add(subj, seq)
+	ms.state.Msgs++
+	sz := storedMsgSize(subj, hdr, msg)
+	ms.state.Bytes += sz
+	ms.state.LastSeq = seq
+	ms.state.LastTime = time.Unix(0, ts).UTC()
+
+	// Limits checks and enforcement.
+	removed, removedBytes := ms.enforcePerSubject(subj)
+	r, rb := ms.enforceLimits()
+	removed, removedBytes = removed+r, removedBytes+rb
+	if ms.ageChk == nil && ms.cfg.MaxAge != 0 {
+		ms.startAgeChk()
+	}
+	cb := ms.scb
+	ms.mu.Unlock()
+
+	if cb != nil {
+		cb(1-int64(removed), int64(sz)-int64(removedBytes))
+	}
+	return seq, ts, nil
+}
+
+// Removes the oldest messages of the subject while over the limit per
+// subject. Lock held on entry.
+func (ms *memStore) enforcePerSubject(subj string) (removed, removedBytes uint64) {
+	for ms.cfg.MaxMsgsPer > 0 && len(ms.fss[subj]) > int(ms.cfg.MaxMsgsPer) {
+		removedBytes += ms.removeMsg(ms.msgs[ms.fss[subj][0]])
+		removed++
+	}
+	return removed, removedBytes
+}
+
+// Removes the oldest messages while over the limits. Lock held on entry.
+func (ms *memStore) enforceLimits() (removed, removedBytes uint64) {
+	for ms.cfg.MaxMsgs > 0 && ms.state.Msgs > uint64(ms.cfg.MaxMsgs) {
+		removedBytes += ms.removeFirst()
+		removed++
+	}
+	for ms.cfg.MaxBytes > 0 && ms.state.Bytes > uint64(ms.cfg.MaxBytes) {
+		removedBytes += ms.removeFirst()
+		removed++
+	}
+	return removed, removedBytes
+}
+
+// Removes the first message and returns its size. Lock held on entry.
+func (ms *memStore) removeFirst() uint64 {
+	for seq := ms.state.FirstSeq; seq <= ms.state.LastSeq; seq++ {
+		if sm, ok := ms.msgs[seq]; ok {
+			return ms.removeMsg(sm)
+		}
+	}
+	return 0
+}
+
+// Removes the message and updates the state. Returns the size of the
+// message. Lock held on entry.
+func (ms *memStore) removeMsg(sm *storedMsg) uint64 {
+	delete(ms.msgs, sm.seq)
+	ms.fss.remove(sm.subj, sm.seq)
+	sz := storedMsgSize(sm.subj, sm.hdr, sm.msg)
+	ms.state.Msgs--
+	ms.state.Bytes -= sz
+	if sm.seq == ms.state.FirstSeq {
+		ms.updateFirst()
+	}
+	return sz
+}
+
+// Lock held on entry.
+func (ms *memStore) updateFirst() {
+	if ms.state.Msgs == 0 {
+		ms.state.FirstSeq = ms.state.LastSeq + 1
+		ms.state.FirstTime = time.Time{}
+		return
+	}
+	for seq := ms.state.FirstSeq; seq <= ms.state.LastSeq; seq++ {
+		if sm, ok := ms.msgs[seq]; ok {
+			ms.state.FirstSeq = seq
+			ms.state.FirstTime = time.Unix(0, sm.ts).UTC()
+			return
+		}
+	}
+}
+
+// Lock held on entry.
+func (ms *memStore) startAgeChk() {
+	ms.ageChk = time.AfterFunc(ms.cfg.MaxAge, ms.expireMsgs)
+}
+
+// Removes the messages older than the max age.
+func (ms *memStore) expireMsgs() {
+	var removed, removedBytes uint64
+	ms.mu.Lock()
+	if ms.stopped {
+		ms.mu.Unlock()
+		return
+	}
+	now := time.Now().UnixNano()
+	minAge := now - int64(ms.cfg.MaxAge)
+	for ms.state.Msgs > 0 {
+		sm := ms.msgs[ms.state.FirstSeq]
+		if sm == nil || sm.ts > minAge {
+			break
+		}
+		removedBytes += ms.removeMsg(sm)
+		removed++
+	}
+	if ms.state.Msgs == 0 || ms.cfg.MaxAge == 0 {
+		ms.ageChk = nil
+	} else {
+		fireIn := time.Duration(ms.msgs[ms.state.FirstSeq].ts - minAge)
+		ms.ageChk.Reset(fireIn)
+	}
+	cb := ms.scb
+	ms.mu.Unlock()
+
+	if cb != nil && removed > 0 {
+		cb(-int64(removed), -int64(removedBytes))
+	}
+}
+
+// LoadMsg returns the message with the given sequence.
+func (ms *memStore) LoadMsg(seq uint64) (*StoredMsg, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ms.stopped {
+		return nil, ErrStoreClosed
+	}
+	sm, ok := ms.msgs[seq]
+	if !ok {
+		if seq > ms.state.LastSeq {
+			return nil, ErrStoreEOF
+		}
+		return nil, ErrStoreMsgNotFound
+	}
+	return sm.toStoredMsg(), nil
+}
+
+// LoadLastMsg returns the last message stored on the given subject.
+func (ms *memStore) LoadLastMsg(subj string) (*StoredMsg, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ms.stopped {
+		return nil, ErrStoreClosed
+	}
+	for seq := ms.state.LastSeq; seq >= ms.state.FirstSeq && seq > 0; seq-- {
+		if sm, ok := ms.msgs[seq]; ok && (subj == _EMPTY_ || matchLiteral(sm.subj, subj)) {
+			return sm.toStoredMsg(), nil
+		}
+	}
+	return nil, ErrStoreMsgNotFound
+}
+
+// SubjectSeqs returns the sequences of the messages stored on the
+// literal subject, in order.
+func (ms *memStore) SubjectSeqs(subj string) []uint64 {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.fss.seqs(subj)
+}
+
+// LastSeqs returns the sequence of the last message of each subject
+// matching the filter, in order.
+func (ms *memStore) LastSeqs(filter string) []uint64 {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.fss.lastSeqs(filter)
+}
+
+func (sm *storedMsg) toStoredMsg() *StoredMsg {
+	return &StoredMsg{
+		Subject:  sm.subj,
+		Sequence: sm.seq,
+		Header:   append([]byte(nil), sm.hdr...),
+		Data:     append([]byte(nil), sm.msg...),
+		Time:     time.Unix(0, sm.ts).UTC(),
+	}
+}
+
+// RemoveMsg removes the message with the given sequence.
+func (ms *memStore) RemoveMsg(seq uint64) (bool, error) {
+	ms.mu.Lock()
+	if ms.stopped {
+		ms.mu.Unlock()
+		return false, ErrStoreClosed
+	}
+	sm, ok := ms.msgs[seq]
+	var sz uint64
+	if ok {
+		sz = ms.removeMsg(sm)
+	}
+	cb := ms.scb
+	ms.mu.Unlock()
+
+	if ok && cb != nil {
+		cb(-1, -int64(sz))
+	}
+	return ok, nil
+}
+
+// Purge removes all messages.
+func (ms *memStore) Purge() (uint64, error) {
+	ms.mu.Lock()
+	if ms.stopped {
+		ms.mu.Unlock()
+		return 0, ErrStoreClosed
+	}
+	purged := ms.state.Msgs
+	bytes := ms.state.Bytes
+	ms.msgs = make(map[uint64]*storedMsg)
+	ms.fss = make(subjIndex)
+	ms.state.Msgs = 0
+	ms.state.Bytes = 0
+	ms.updateFirst()
+	cb := ms.scb
+	ms.mu.Unlock()
+
+	if cb != nil && purged > 0 {
+		cb(-int64(purged), -int64(bytes))
+	}
+	return purged, nil
+}
+
+// SkipMsg uses the sequence without storing a message.
+func (ms *memStore) SkipMsg(seq uint64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.stopped {
+		return ErrStoreClosed
+	}
+	if seq <= ms.state.LastSeq {
+		return ErrStoreSeqOutOfOrder
+	}
+	ms.state.LastSeq = seq
+	ms.state.LastTime = time.Now().UTC()
+	if ms.state.Msgs == 0 {
+		ms.updateFirst()
+	}
+	return nil
+}
+
+// Compact removes the messages below the sequence.
+func (ms *memStore) Compact(seq uint64) (uint64, error) {
+	ms.mu.Lock()
+	if ms.stopped {
+		ms.mu.Unlock()
+		return 0, ErrStoreClosed
+	}
+	var removed, removedBytes uint64
+	for ms.state.Msgs > 0 && ms.state.FirstSeq < seq {
+		removedBytes += ms.removeMsg(ms.msgs[ms.state.FirstSeq])
+		removed++
+	}
+	if seq > ms.state.LastSeq+1 {
+		ms.state.LastSeq = seq - 1
+		ms.updateFirst()
+	}
+	cb := ms.scb
+	ms.mu.Unlock()
+
+	if cb != nil && removed > 0 {
+		cb(-int64(removed), -int64(removedBytes))
+	}
+	return removed, nil
+}
+
+// GetSeqFromTime returns the first sequence stored at or after the time.
+func (ms *memStore) GetSeqFromTime(t time.Time) uint64 {
+	ts := t.UnixNano()
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ms.state.Msgs == 0 {
+		return ms.state.LastSeq + 1
+	}
+	seqs := make([]uint64, 0, len(ms.msgs))
+	for seq := range ms.msgs {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	i := sort.Search(len(seqs), func(i int) bool { return ms.msgs[seqs[i]].ts >= ts })
+	if i == len(seqs) {
+		return ms.state.LastSeq + 1
+	}
+	return seqs[i]
+}
+
+// NumPending returns the number of messages at or after the sequence
+// matching the filter, and the sequence of the last one.
+func (ms *memStore) NumPending(sseq uint64, filter string) (num uint64, last uint64) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if sseq < ms.state.FirstSeq {
+		sseq = ms.state.FirstSeq
+	}
+	for seq := sseq; seq <= ms.state.LastSeq; seq++ {
+		if sm, ok := ms.msgs[seq]; ok && (filter == _EMPTY_ || matchLiteral(sm.subj, filter)) {
+			num++
+			last = seq
+		}
+	}
+	return num, last
+}
+
+// State returns the current state of the store.
+func (ms *memStore) State() StreamState {
+	ms.mu.RLock()
+	state := ms.state
+	ms.mu.RUnlock()
+	return state
+}
+
+// RegisterStorageUpdates registers the callback for changes in storage.
+func (ms *memStore) RegisterStorageUpdates(cb func(md, bd int64)) {
+	ms.mu.Lock()
+	ms.scb = cb
+	ms.mu.Unlock()
+}
+
+// UpdateConfig applies the new limits.
+func (ms *memStore) UpdateConfig(cfg *StreamConfig) error {
+	if cfg == nil {
+		return fmt.Errorf("config required")
+	}
+	ms.mu.Lock()
+	ms.cfg = *cfg
+	var removed, removedBytes uint64
+	if ms.cfg.MaxMsgsPer > 0 {
+		for subj := range ms.fss {
+			r, rb := ms.enforcePerSubject(subj)
+			removed, removedBytes = removed+r, removedBytes+rb
+		}
+	}
+	r, rb := ms.enforceLimits()
+	removed, removedBytes = removed+r, removedBytes+rb
+	if ms.ageChk != nil && ms.cfg.MaxAge == 0 {
+		ms.ageChk.Stop()
+		ms.ageChk = nil
+	} else if ms.ageChk == nil && ms.cfg.MaxAge != 0 && ms.state.Msgs > 0 {
+		ms.startAgeChk()
+	}
+	cb := ms.scb
+	ms.mu.Unlock()
+
+	if cb != nil && removed > 0 {
+		cb(-int64(removed), -int64(removedBytes))
+	}
+	return nil
+}
+
+// ConsumerStore returns a store keeping the consumer state in memory.
+func (ms *memStore) ConsumerStore(name string) (ConsumerStore, error) {
+	return &consumerMemStore{}, nil
+}
+
+// consumerMemStore keeps the state of a consumer in memory only.
+type consumerMemStore struct {
+	mu    sync.Mutex
+	state *ConsumerState
+}
+
+// Update records the new state.
+func (cs *consumerMemStore) Update(state *ConsumerState) error {
+	cs.mu.Lock()
+	cs.state = state.copy()
+	cs.mu.Unlock()
+	return nil
+}
+
+// State returns the last recorded state.
+func (cs *consumerMemStore) State() (*ConsumerState, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.state == nil {
+		return &ConsumerState{}, nil
+	}
+	return cs.state.copy(), nil
+}
+
+// Stop stops the store.
+func (cs *consumerMemStore) Stop() error { return nil }
+
+// Delete removes the state.
+func (cs *consumerMemStore) Delete() error {
+	cs.mu.Lock()
+	cs.state = nil
+	cs.mu.Unlock()
+	return nil
+}
+
+// Delete stops the store and releases all messages.
+func (ms *memStore) Delete() error {
+	if _, err := ms.Purge(); err != nil {
+		return err
+	}
+	return ms.Stop()
+}
+
+// Stop stops the store.
+func (ms *memStore) Stop() error {
+	ms.mu.Lock()
+	if ms.stopped {
+		ms.mu.Unlock()
+		return nil
+	}
+	ms.stopped = true
+	if ms.ageChk != nil {
+		ms.ageChk.Stop()
+		ms.ageChk = nil
+	}
+	ms.msgs = nil
+	ms.fss = nil
+	ms.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,276 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemStoreBasics(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	defer ms.Stop()
+
+	subj, msg := "foo", []byte("Hello World")
+	seq, ts, err := ms.StoreMsg(subj, nil, msg)
+	if err != nil {
+		t.Fatalf("Error storing msg: %v", err)
+	}
+	if seq != 1 {
+		t.Fatalf("Expected sequence to be 1, got %d", seq)
+	}
+	state := ms.State()
+	if state.Msgs != 1 {
+		t.Fatalf("Expected 1 msg, got %d", state.Msgs)
+	}
+	if expected := storedMsgSize(subj, nil, msg); state.Bytes != expected {
+		t.Fatalf("Expected %d bytes, got %d", expected, state.Bytes)
+	}
+	sm, err := ms.LoadMsg(1)
+	if err != nil {
+		t.Fatalf("Unexpected error looking up msg: %v", err)
+	}
+	if sm.Subject != subj || string(sm.Data) != string(msg) || sm.Time.UnixNano() != ts {
+		t.Fatalf("Unexpected message: %+v", sm)
+	}
+	if _, err := ms.LoadMsg(2); err != ErrStoreEOF {
+		t.Fatalf("Expected EOF error, got %v", err)
+	}
+}
+
+func TestMemStoreMsgLimit(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage, MaxMsgs: 10})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	defer ms.Stop()
+
+	for i := 0; i < 10; i++ {
+		ms.StoreMsg("foo", nil, []byte("Hello World"))
+	}
+	state := ms.State()
+	if state.Msgs != 10 {
+		t.Fatalf("Expected %d msgs, got %d", 10, state.Msgs)
+	}
+	if _, _, err := ms.StoreMsg("foo", nil, []byte("Hello World")); err != nil {
+		t.Fatalf("Error storing msg: %v", err)
+	}
+	state = ms.State()
+	if state.Msgs != 10 {
+		t.Fatalf("Expected %d msgs, got %d", 10, state.Msgs)
+	}
+	if state.FirstSeq != 2 || state.LastSeq != 11 {
+		t.Fatalf("Unexpected sequences: %+v", state)
+	}
+	if _, err := ms.LoadMsg(1); err != ErrStoreMsgNotFound {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+}
+
+func TestMemStoreBytesLimit(t *testing.T) {
+	subj, msg := "foo", make([]byte, 512)
+	sz := storedMsgSize(subj, nil, msg)
+	toStore := uint64(1024)
+	maxBytes := toStore * sz
+
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage, MaxBytes: int64(maxBytes)})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	defer ms.Stop()
+
+	for i := uint64(0); i < toStore; i++ {
+		ms.StoreMsg(subj, nil, msg)
+	}
+	state := ms.State()
+	if state.Msgs != toStore || state.Bytes != maxBytes {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	// Now send 10 more and check that bytes limit is enforced.
+	for i := 0; i < 10; i++ {
+		if _, _, err := ms.StoreMsg(subj, nil, msg); err != nil {
+			t.Fatalf("Error storing msg: %v", err)
+		}
+	}
+	state = ms.State()
+	if state.Msgs != toStore || state.Bytes != maxBytes {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	if state.FirstSeq != 11 || state.LastSeq != toStore+10 {
+		t.Fatalf("Unexpected sequences: %+v", state)
+	}
+}
+
+func TestMemStoreAgeLimit(t *testing.T) {
+	maxAge := 50 * time.Millisecond
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage, MaxAge: maxAge})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	defer ms.Stop()
+
+	for i := 0; i < 100; i++ {
+		ms.StoreMsg("foo", nil, []byte("Hello World"))
+	}
+	if state := ms.State(); state.Msgs != 100 {
+		t.Fatalf("Expected %d msgs, got %d", 100, state.Msgs)
+	}
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		if state := ms.State(); state.Msgs != 0 {
+			return fmt.Errorf("Expected no msgs, got %d", state.Msgs)
+		}
+		return nil
+	})
+}
+
+func TestMemStoreRemoveAndPurge(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	defer ms.Stop()
+
+	var md, bd int64
+	ms.RegisterStorageUpdates(func(m, b int64) {
+		md += m
+		bd += b
+	})
+	for i := 0; i < 10; i++ {
+		ms.StoreMsg(fmt.Sprintf("foo.%d", i), nil, []byte("Hello World"))
+	}
+	if removed, _ := ms.RemoveMsg(1); !removed {
+		t.Fatalf("Expected message to be removed")
+	}
+	if removed, _ := ms.RemoveMsg(5); !removed {
+		t.Fatalf("Expected message to be removed")
+	}
+	if removed, _ := ms.RemoveMsg(5); removed {
+		t.Fatalf("Expected message to be already removed")
+	}
+	state := ms.State()
+	if state.Msgs != 8 || state.FirstSeq != 2 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	if md != 8 || uint64(bd) != state.Bytes {
+		t.Fatalf("Unexpected storage updates: %d msgs %d bytes", md, bd)
+	}
+	if num, last := ms.NumPending(3, "foo.*"); num != 7 || last != 10 {
+		t.Fatalf("Unexpected pending: %d last %d", num, last)
+	}
+	// The message on foo.4 was the one with sequence 5.
+	if _, err := ms.LoadLastMsg("foo.4"); err != ErrStoreMsgNotFound {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+	if sm, err := ms.LoadLastMsg("foo.*"); err != nil || sm.Sequence != 10 {
+		t.Fatalf("Unexpected last message: %+v - %v", sm, err)
+	}
+	if purged, _ := ms.Purge(); purged != 8 {
+		t.Fatalf("Expected 8 messages purged, got %d", purged)
+	}
+	state = ms.State()
+	if state.Msgs != 0 || state.Bytes != 0 || state.FirstSeq != 11 || state.LastSeq != 10 {
+		t.Fatalf("Unexpected state after purge: %+v", state)
+	}
+	if md != 0 || bd != 0 {
+		t.Fatalf("Unexpected storage updates: %d msgs %d bytes", md, bd)
+	}
+	// Sequence continues after a purge.
+	if seq, _, _ := ms.StoreMsg("foo", nil, nil); seq != 11 {
+		t.Fatalf("Expected sequence 11, got %d", seq)
+	}
+}
+
+func TestMemStoreRawMsgSkipAndCompact(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	defer ms.Stop()
+
+	ts := time.Now().UnixNano()
+	if err := ms.StoreRawMsg("foo", nil, []byte("1"), 1, ts); err != nil {
+		t.Fatalf("Error storing msg: %v", err)
+	}
+	// Gaps are allowed, going back is not.
+	if err := ms.StoreRawMsg("foo", nil, []byte("5"), 5, ts); err != nil {
+		t.Fatalf("Error storing msg: %v", err)
+	}
+	if err := ms.StoreRawMsg("foo", nil, nil, 5, ts); err != ErrStoreSeqOutOfOrder {
+		t.Fatalf("Expected out of order error, got %v", err)
+	}
+	sm, err := ms.LoadMsg(5)
+	if err != nil || string(sm.Data) != "5" || sm.Time.UnixNano() != ts {
+		t.Fatalf("Unexpected message: %+v - %v", sm, err)
+	}
+	if state := ms.State(); state.Msgs != 2 || state.FirstSeq != 1 || state.LastSeq != 5 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	if err := ms.SkipMsg(8); err != nil {
+		t.Fatalf("Error skipping: %v", err)
+	}
+	if seq, _, _ := ms.StoreMsg("foo", nil, nil); seq != 9 {
+		t.Fatalf("Expected sequence 9, got %d", seq)
+	}
+	if purged, _ := ms.Compact(6); purged != 2 {
+		t.Fatalf("Expected 2 messages removed, got %d", purged)
+	}
+	if state := ms.State(); state.Msgs != 1 || state.FirstSeq != 9 || state.LastSeq != 9 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	// Compacting past the end moves the sequence forward.
+	ms.Compact(20)
+	if state := ms.State(); state.Msgs != 0 || state.FirstSeq != 20 || state.LastSeq != 19 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+}
+
+func TestMemStorePerSubjectLimit(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage, MaxMsgsPer: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	defer ms.Stop()
+
+	for i := 0; i < 5; i++ {
+		ms.StoreMsg("foo.a", nil, []byte("Hello World"))
+		ms.StoreMsg("foo.b", nil, []byte("Hello World"))
+	}
+	ms.StoreMsg("bar", nil, nil)
+	if state := ms.State(); state.Msgs != 5 || state.FirstSeq != 7 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	if seqs := ms.SubjectSeqs("foo.a"); fmt.Sprint(seqs) != "[7 9]" {
+		t.Fatalf("Unexpected sequences: %v", seqs)
+	}
+	if seqs := ms.LastSeqs("foo.*"); fmt.Sprint(seqs) != "[9 10]" {
+		t.Fatalf("Unexpected last sequences: %v", seqs)
+	}
+	ms.RemoveMsg(10)
+	if seqs := ms.LastSeqs(_EMPTY_); fmt.Sprint(seqs) != "[8 9 11]" {
+		t.Fatalf("Unexpected last sequences: %v", seqs)
+	}
+	if err := ms.UpdateConfig(&StreamConfig{Storage: MemoryStorage, MaxMsgsPer: 1}); err != nil {
+		t.Fatalf("Unexpected error updating config: %v", err)
+	}
+	if seqs := ms.SubjectSeqs("foo.a"); fmt.Sprint(seqs) != "[9]" {
+		t.Fatalf("Unexpected sequences: %v", seqs)
+	}
+	if state := ms.State(); state.Msgs != 3 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server/pse"
+)
+
+const (
+	metricsPrefix      = "nats_server_"
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// Builds a response in the Prometheus text exposition format.
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+// Writes the HELP and TYPE lines of a metric family.
+func (mw *metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(mw, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricsPrefix, name, help, metricsPrefix, name, typ)
+}
+
+// Writes a sample, labels are given as name and value pairs.
+func (mw *metricsWriter) sample(name string, value float64, labels ...string) {
+	mw.WriteString(metricsPrefix)
+	mw.WriteString(name)
+	if len(labels) > 0 {
+		mw.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				mw.WriteByte(',')
+			}
+			fmt.Fprintf(mw, "%s=\"%s\"", labels[i], metricsEscape(labels[i+1]))
+		}
+		mw.WriteByte('}')
+	}
+	mw.WriteByte(' ')
+	mw.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	mw.WriteByte('\n')
+}
+
+// Writes a metric family with a single sample.
+func (mw *metricsWriter) metric(name, typ, help string, value float64) {
+	mw.family(name, typ, help)
+	mw.sample(name, value)
+}
+
+var metricsEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func metricsEscape(s string) string {
+	return metricsEscaper.Replace(s)
+}
+
+// Per account values collected for the metrics.
+type accountMetrics struct {
+	name      string
+	conns     int
+	leafs     int
+	subs      uint32
+	inMsgs    int64
+	inBytes   int64
+	outMsgs   int64
+	outBytes  int64
+	slowCons  int64
+	permViols int64
+}
+
+func (s *Server) collectAccountMetrics() []accountMetrics {
+	var am []accountMetrics
+	s.accounts.Range(func(k, v interface{}) bool {
+		acc := v.(*Account)
+		acc.mu.RLock()
+		m := accountMetrics{
+			name:  acc.Name,
+			conns: acc.numLocalConnections(),
+			leafs: acc.numLocalLeafNodes(),
+		}
+		if acc.sl != nil {
+			m.subs = acc.sl.Count()
+		}
+		acc.mu.RUnlock()
+		m.inMsgs = atomic.LoadInt64(&acc.inMsgs)
+		m.inBytes = atomic.LoadInt64(&acc.inBytes)
+		m.outMsgs = atomic.LoadInt64(&acc.outMsgs)
+		m.outBytes = atomic.LoadInt64(&acc.outBytes)
+		m.slowCons = atomic.LoadInt64(&acc.slowConsumers)
+		m.permViols = atomic.LoadInt64(&acc.permViolations)
+		am = append(am, m)
+		return true
+	})
+	sort.Slice(am, func(i, j int) bool { return am[i].name < am[j].name })
+	return am
+}
+
+// HandleMetrics will process HTTP requests for metrics in the
+// Prometheus text exposition format.
+func (s *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	var rss, vss int64
+	var pcpu float64
+
+	// We want to do that outside of the lock.
+	pse.ProcUsage(&pcpu, &rss, &vss)
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	s.mu.Lock()
+	s.httpReqStats[MetricsPath]++
+	info := s.info
+	start := s.start
+	conns := len(s.clients)
+	totalConns := s.totalClients
+	routes := len(s.routes)
+	leafs := len(s.leafs)
+	s.mu.Unlock()
+
+	mw := &metricsWriter{}
+
+	mw.family("info", "gauge", "Information about the server.")
+	mw.sample("info", 1, "server_id", info.ID, "version", info.Version, "cluster", s.ClusterName())
+	mw.metric("uptime_seconds", "gauge", "Time since the server started.", time.Since(start).Seconds())
+	mw.metric("connections", "gauge", "Number of client connections.", float64(conns))
+	mw.metric("connections_total", "counter", "Number of client connections accepted.", float64(totalConns))
+	mw.metric("routes", "gauge", "Number of route connections.", float64(routes))
+	mw.metric("gateways_outbound", "gauge", "Number of outbound gateway connections.", float64(s.numOutboundGateways()))
+	mw.metric("gateways_inbound", "gauge", "Number of inbound gateway connections.", float64(s.numInboundGateways()))
+	mw.metric("leafnodes", "gauge", "Number of leafnode connections.", float64(leafs))
+	mw.metric("subscriptions", "gauge", "Number of subscriptions.", float64(s.NumSubscriptions()))
+	mw.metric("in_msgs_total", "counter", "Number of messages received.", float64(atomic.LoadInt64(&s.inMsgs)))
+	mw.metric("out_msgs_total", "counter", "Number of messages sent.", float64(atomic.LoadInt64(&s.outMsgs)))
+	mw.metric("in_bytes_total", "counter", "Number of bytes received.", float64(atomic.LoadInt64(&s.inBytes)))
+	mw.metric("out_bytes_total", "counter", "Number of bytes sent.", float64(atomic.LoadInt64(&s.outBytes)))
+	mw.metric("slow_consumers_total", "counter", "Number of slow consumers detected.", float64(atomic.LoadInt64(&s.slowConsumers)))
+
+	mw.metric("cpu_percent", "gauge", "CPU usage of the process.", pcpu)
+	mw.metric("resident_memory_bytes", "gauge", "Resident memory of the process.", float64(rss))
+	mw.metric("goroutines", "gauge", "Number of goroutines.", float64(runtime.NumGoroutine()))
+	mw.metric("heap_alloc_bytes", "gauge", "Bytes of allocated heap objects.", float64(ms.HeapAlloc))
+	mw.metric("heap_sys_bytes", "gauge", "Bytes of heap memory obtained from the OS.", float64(ms.HeapSys))
+	mw.metric("sys_bytes", "gauge", "Bytes of memory obtained from the OS.", float64(ms.Sys))
+	mw.metric("gc_total", "counter", "Number of completed GC cycles.", float64(ms.NumGC))
+	mw.metric("gc_pause_seconds_total", "counter", "Total time spent in GC pauses.", float64(ms.PauseTotalNs)/float64(time.Second))
+
+	am := s.collectAccountMetrics()
+	accountFamily := func(name, typ, help string, value func(m *accountMetrics) float64) {
+		mw.family(name, typ, help)
+		for i := range am {
+			mw.sample(name, value(&am[i]), "account", am[i].name)
+		}
+	}
+	accountFamily("account_connections", "gauge", "Number of client connections per account.",
+		func(m *accountMetrics) float64 { return float64(m.conns) })
+	accountFamily("account_leafnodes", "gauge", "Number of leafnode connections per account.",
+		func(m *accountMetrics) float64 { return float64(m.leafs) })
+	accountFamily("account_subscriptions", "gauge", "Number of subscriptions per account.",
+		func(m *accountMetrics) float64 { return float64(m.subs) })
+	accountFamily("account_in_msgs_total", "counter", "Number of messages received per account.",
+		func(m *accountMetrics) float64 { return float64(m.inMsgs) })
+	accountFamily("account_out_msgs_total", "counter", "Number of messages sent per account.",
+		func(m *accountMetrics) float64 { return float64(m.outMsgs) })
+	accountFamily("account_in_bytes_total", "counter", "Number of bytes received per account.",
+		func(m *accountMetrics) float64 { return float64(m.inBytes) })
+	accountFamily("account_out_bytes_total", "counter", "Number of bytes sent per account.",
+		func(m *accountMetrics) float64 { return float64(m.outBytes) })
+	accountFamily("account_slow_consumers_total", "counter", "Number of slow consumers per account.",
+		func(m *accountMetrics) float64 { return float64(m.slowCons) })
+	accountFamily("account_permission_violations_total", "counter", "Number of permission violations per account.",
+		func(m *accountMetrics) float64 { return float64(m.permViols) })
+
+	w.Header().Set("Content-Type", metricsContentType)
+	w.Write(mw.Bytes())
+}
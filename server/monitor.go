@@ -14,6 +14,7 @@
 package server
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -21,12 +22,15 @@ import (
 	"net/http"
 	"net/url"
 	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
 	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/nats-io/jwt"
 	"github.com/nats-io/nats-server/v2/server/pse"
 )
 
@@ -45,6 +49,7 @@ type Connz struct {
 	Total    int         `json:"total"`
 	Offset   int         `json:"offset"`
 	Limit    int         `json:"limit"`
+	Next     uint64      `json:"next,omitempty"`
 	Conns    []*ConnInfo `json:"connections"`
 }
 
@@ -72,6 +77,24 @@ type ConnzOptions struct {
 
 	// Filter by connection state.
 	State ConnState `json:"state"`
+
+	// Filter by the account of the connections.
+	Account string `json:"acc"`
+
+	// Filter by the user name of the connections.
+	User string `json:"user"`
+
+	// Filter by a range of connection IDs, bounds included. No bound if 0.
+	MinCID uint64 `json:"min_cid"`
+	MaxCID uint64 `json:"max_cid"`
+
+	// Filter on connections that have a subscription matching this subject.
+	FilterSubject string `json:"filter_subject"`
+
+	// After is a cursor used for pagination when sorting by connection ID.
+	// Connz() only returns connections with a greater ID, and the ID to use
+	// for the next page is returned in Connz.Next.
+	After uint64 `json:"after"`
 }
 
 // ConnState is for filtering states of connections. We will only have two, open and closed.
@@ -88,29 +111,33 @@ const (
 
 // ConnInfo has detailed information on a per connection basis.
 type ConnInfo struct {
-	Cid            uint64     `json:"cid"`
-	IP             string     `json:"ip"`
-	Port           int        `json:"port"`
-	Start          time.Time  `json:"start"`
-	LastActivity   time.Time  `json:"last_activity"`
-	Stop           *time.Time `json:"stop,omitempty"`
-	Reason         string     `json:"reason,omitempty"`
-	RTT            string     `json:"rtt,omitempty"`
-	Uptime         string     `json:"uptime"`
-	Idle           string     `json:"idle"`
-	Pending        int        `json:"pending_bytes"`
-	InMsgs         int64      `json:"in_msgs"`
-	OutMsgs        int64      `json:"out_msgs"`
-	InBytes        int64      `json:"in_bytes"`
-	OutBytes       int64      `json:"out_bytes"`
-	NumSubs        uint32     `json:"subscriptions"`
-	Name           string     `json:"name,omitempty"`
-	Lang           string     `json:"lang,omitempty"`
-	Version        string     `json:"version,omitempty"`
-	TLSVersion     string     `json:"tls_version,omitempty"`
-	TLSCipher      string     `json:"tls_cipher_suite,omitempty"`
-	AuthorizedUser string     `json:"authorized_user,omitempty"`
-	Subs           []string   `json:"subscriptions_list,omitempty"`
+	Cid            uint64            `json:"cid"`
+	IP             string            `json:"ip"`
+	Port           int               `json:"port"`
+	Start          time.Time         `json:"start"`
+	LastActivity   time.Time         `json:"last_activity"`
+	Stop           *time.Time        `json:"stop,omitempty"`
+	Reason         string            `json:"reason,omitempty"`
+	RTT            string            `json:"rtt,omitempty"`
+	Uptime         string            `json:"uptime"`
+	Idle           string            `json:"idle"`
+	Pending        int               `json:"pending_bytes"`
+	InMsgs         int64             `json:"in_msgs"`
+	OutMsgs        int64             `json:"out_msgs"`
+	InBytes        int64             `json:"in_bytes"`
+	OutBytes       int64             `json:"out_bytes"`
+	NumSubs        uint32            `json:"subscriptions"`
+	Name           string            `json:"name,omitempty"`
+	Lang           string            `json:"lang,omitempty"`
+	Version        string            `json:"version,omitempty"`
+	Tags           map[string]string `json:"tags,omitempty"`
+	ReplyHits      uint64            `json:"reply_cache_hits,omitempty"`
+	ReplyMisses    uint64            `json:"reply_cache_misses,omitempty"`
+	TLSVersion     string            `json:"tls_version,omitempty"`
+	TLSCipher      string            `json:"tls_cipher_suite,omitempty"`
+	AuthorizedUser string            `json:"authorized_user,omitempty"`
+	Account        string            `json:"account,omitempty"`
+	Subs           []string          `json:"subscriptions_list,omitempty"`
 }
 
 // DefaultConnListSize is the default size of the connection list.
@@ -119,6 +146,9 @@ const DefaultConnListSize = 1024
 // DefaultSubListSize is the default size of the subscriptions list.
 const DefaultSubListSize = 1024
 
+// DefaultAccountListSize is the default size of the account list of /jsz.
+const DefaultAccountListSize = 1024
+
 const defaultStackBufSize = 10000
 
 // Connz returns a Connz struct containing inormation about connections.
@@ -131,6 +161,8 @@ func (s *Server) Connz(opts *ConnzOptions) (*Connz, error) {
 		limit   = DefaultConnListSize
 		cid     = uint64(0)
 		state   = ConnOpen
+		after   uint64
+		filter  *connzFilter
 	)
 
 	if opts != nil {
@@ -164,6 +196,24 @@ func (s *Server) Connz(opts *ConnzOptions) (*Connz, error) {
 		if sortOpt == ByReason && state != ConnClosed {
 			return nil, fmt.Errorf("sort by reason only valid on closed connections")
 		}
+		// The cursor is a connection ID.
+		after = opts.After
+		if after > 0 && sortOpt != ByCid && sortOpt != ByStart {
+			return nil, fmt.Errorf("after only valid when sorting by cid")
+		}
+		if opts.FilterSubject != _EMPTY_ && !IsValidSubject(opts.FilterSubject) {
+			return nil, fmt.Errorf("invalid filter subject: %q", opts.FilterSubject)
+		}
+		if opts.Account != _EMPTY_ || opts.User != _EMPTY_ || opts.MinCID > 0 ||
+			opts.MaxCID > 0 || opts.FilterSubject != _EMPTY_ {
+			filter = &connzFilter{
+				acc:    opts.Account,
+				user:   opts.User,
+				minCID: opts.MinCID,
+				maxCID: opts.MaxCID,
+				subj:   opts.FilterSubject,
+			}
+		}
 
 		// If searching by CID
 		if opts.CID > 0 {
@@ -253,6 +303,16 @@ func (s *Server) Connz(opts *ConnzOptions) (*Connz, error) {
 	}
 	s.mu.Unlock()
 
+	// Total is the number of connections matching the filters.
+	if filter != nil {
+		openClients, closedClients = filter.apply(openClients, closedClients)
+		c.Total = len(openClients) + len(closedClients)
+		if cid == 0 {
+			totalClients = c.Total
+			pconns = pconns[:totalClients]
+		}
+	}
+
 	// Just return with empty array if nothing here.
 	if len(openClients) == 0 && len(closedClients) == 0 {
 		c.Conns = ConnInfos{}
@@ -332,10 +392,16 @@ func (s *Server) Connz(opts *ConnzOptions) (*Connz, error) {
 		sort.Sort(byReason{pconns})
 	}
 
+	// Skip the connections up to the cursor.
+	if after > 0 {
+		i := sort.Search(len(pconns), func(i int) bool { return pconns[i].Cid > after })
+		pconns = pconns[i:]
+	}
+
 	minoff := c.Offset
 	maxoff := c.Offset + c.Limit
 
-	maxIndex := totalClients
+	maxIndex := len(pconns)
 
 	// Make sure these are sane.
 	if minoff > maxIndex {
@@ -352,10 +418,108 @@ func (s *Server) Connz(opts *ConnzOptions) (*Connz, error) {
 	// Low TTL, say < 1sec.
 	c.Conns = pconns[minoff:maxoff]
 	c.NumConns = len(c.Conns)
+	if (sortOpt == ByCid || sortOpt == ByStart) && maxoff < maxIndex && maxoff > minoff {
+		c.Next = pconns[maxoff-1].Cid
+	}
 
 	return c, nil
 }
 
+// ClosedConnections returns the recently closed connections, oldest first,
+// with the reason of the close, the uptime and stats of the connection at
+// that time, its subscriptions and authorized user.
+func (s *Server) ClosedConnections() []*ConnInfo {
+	closed := s.closedClients()
+	conns := make([]*ConnInfo, 0, len(closed))
+	for _, cc := range closed {
+		ci := cc.ConnInfo
+		ci.Subs = cc.subs
+		ci.AuthorizedUser = cc.user
+		conns = append(conns, &ci)
+	}
+	return conns
+}
+
+// Filters of Connz() other than the connection state.
+type connzFilter struct {
+	acc    string
+	user   string
+	minCID uint64
+	maxCID uint64
+	subj   string
+}
+
+// Returns the connections that match the filter.
+func (f *connzFilter) apply(open []*client, closed []*closedClient) ([]*client, []*closedClient) {
+	fopen := open[:0]
+	for _, c := range open {
+		if f.matchClient(c) {
+			fopen = append(fopen, c)
+		}
+	}
+	var fclosed []*closedClient
+	for _, cc := range closed {
+		if f.matchClosed(cc) {
+			fclosed = append(fclosed, cc)
+		}
+	}
+	return fopen, fclosed
+}
+
+func (f *connzFilter) matchClient(c *client) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var acc string
+	if c.acc != nil {
+		acc = c.acc.Name
+	}
+	if !f.matchConn(c.cid, acc, c.opts.Username) {
+		return false
+	}
+	if f.subj == _EMPTY_ {
+		return true
+	}
+	for _, sub := range c.subs {
+		if f.matchSubject(string(sub.subject)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *connzFilter) matchClosed(cc *closedClient) bool {
+	if !f.matchConn(cc.Cid, cc.Account, cc.user) {
+		return false
+	}
+	if f.subj == _EMPTY_ {
+		return true
+	}
+	for _, subj := range cc.subs {
+		if f.matchSubject(subj) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *connzFilter) matchConn(cid uint64, acc, user string) bool {
+	return (f.minCID == 0 || cid >= f.minCID) && (f.maxCID == 0 || cid <= f.maxCID) &&
+		(f.acc == _EMPTY_ || acc == f.acc) && (f.user == _EMPTY_ || user == f.user)
+}
+
+func (f *connzFilter) matchSubject(subject string) bool {
+	return subjectMatchesFilter(f.subj, subject)
+}
+
+// A subscription subject matches if it would receive messages published on
+// the filter subject, or, for a filter with wildcards, if it is a subset of it.
+func subjectMatchesFilter(filter, subject string) bool {
+	if subjectIsLiteral(filter) {
+		return matchLiteral(filter, subject)
+	}
+	return subjectIsSubsetMatch(subject, filter)
+}
+
 // Fills in the ConnInfo from the client.
 // client should be locked.
 func (ci *ConnInfo) fill(client *client, nc net.Conn, now time.Time) {
@@ -372,10 +536,16 @@ func (ci *ConnInfo) fill(client *client, nc net.Conn, now time.Time) {
 	ci.Name = client.opts.Name
 	ci.Lang = client.opts.Lang
 	ci.Version = client.opts.Version
+	ci.Tags = client.opts.Tags
+	if client.acc != nil {
+		ci.Account = client.acc.Name
+	}
 	// inMsgs and inBytes are updated outside of the client's lock, so
 	// we need to use atomic here.
 	ci.InMsgs = atomic.LoadInt64(&client.inMsgs)
 	ci.InBytes = atomic.LoadInt64(&client.inBytes)
+	ci.ReplyHits = atomic.LoadUint64(&client.rhits)
+	ci.ReplyMisses = atomic.LoadUint64(&client.rmisses)
 
 	// If the connection is gone, too bad, we won't set TLSVersion and TLSCipher.
 	// Exclude clients that are still doing handshake so we don't block in
@@ -501,6 +671,18 @@ func (s *Server) HandleConnz(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
+	minCID, err := decodeUint64(w, r, "min_cid")
+	if err != nil {
+		return
+	}
+	maxCID, err := decodeUint64(w, r, "max_cid")
+	if err != nil {
+		return
+	}
+	after, err := decodeUint64(w, r, "after")
+	if err != nil {
+		return
+	}
 
 	connzOpts := &ConnzOptions{
 		Sort:          sortOpt,
@@ -510,6 +692,12 @@ func (s *Server) HandleConnz(w http.ResponseWriter, r *http.Request) {
 		Limit:         limit,
 		CID:           cid,
 		State:         state,
+		Account:       r.URL.Query().Get("acc"),
+		User:          r.URL.Query().Get("user"),
+		MinCID:        minCID,
+		MaxCID:        maxCID,
+		FilterSubject: r.URL.Query().Get("filter_subject"),
+		After:         after,
 	}
 
 	s.mu.Lock()
@@ -533,12 +721,13 @@ func (s *Server) HandleConnz(w http.ResponseWriter, r *http.Request) {
 
 // Routez represents detailed information on current client connections.
 type Routez struct {
-	ID        string             `json:"server_id"`
-	Now       time.Time          `json:"now"`
-	Import    *SubjectPermission `json:"import,omitempty"`
-	Export    *SubjectPermission `json:"export,omitempty"`
-	NumRoutes int                `json:"num_routes"`
-	Routes    []*RouteInfo       `json:"routes"`
+	ID          string             `json:"server_id"`
+	ClusterName string             `json:"cluster_name,omitempty"`
+	Now         time.Time          `json:"now"`
+	Import      *SubjectPermission `json:"import,omitempty"`
+	Export      *SubjectPermission `json:"export,omitempty"`
+	NumRoutes   int                `json:"num_routes"`
+	Routes      []*RouteInfo       `json:"routes"`
 }
 
 // RoutezOptions are options passed to Routez
@@ -564,6 +753,29 @@ type RouteInfo struct {
 	OutBytes     int64              `json:"out_bytes"`
 	NumSubs      uint32             `json:"subscriptions"`
 	Subs         []string           `json:"subscriptions_list,omitempty"`
+	Compression  string             `json:"compression,omitempty"`
+	CompStats    *RouteCompression  `json:"compression_stats,omitempty"`
+	Batching     bool               `json:"batching,omitempty"`
+	BatchStats   *RouteBatches      `json:"batch_stats,omitempty"`
+	PoolIdx      int                `json:"pool_idx,omitempty"`
+	Account      string             `json:"account,omitempty"`
+	Tags         []string           `json:"tags,omitempty"`
+}
+
+// RouteCompression has the number of bytes sent and received on the
+// wire for a compressed route, and the same before compression.
+type RouteCompression struct {
+	InBytes     int64 `json:"in_bytes"`
+	InRawBytes  int64 `json:"in_uncompressed_bytes"`
+	OutBytes    int64 `json:"out_bytes"`
+	OutRawBytes int64 `json:"out_uncompressed_bytes"`
+}
+
+// RouteBatches has the number of batches sent and received on a route
+// that frames its messages in batches.
+type RouteBatches struct {
+	InBatches  int64 `json:"in_batches"`
+	OutBatches int64 `json:"out_batches"`
 }
 
 // Routez returns a Routez struct containing inormation about routes.
@@ -578,6 +790,7 @@ func (s *Server) Routez(routezOpts *RoutezOptions) (*Routez, error) {
 
 	// copy the server id for monitoring
 	rs.ID = s.info.ID
+	rs.ClusterName = s.ClusterName()
 
 	// Check for defined permissions for all connected routes.
 	if perms := s.getOpts().Cluster.Permissions; perms != nil {
@@ -600,6 +813,9 @@ func (s *Server) Routez(routezOpts *RoutezOptions) (*Routez, error) {
 			NumSubs:      uint32(len(r.subs)),
 			Import:       r.opts.Import,
 			Export:       r.opts.Export,
+			PoolIdx:      r.route.poolIdx,
+			Account:      r.route.accName,
+			Tags:         r.route.tags,
 		}
 
 		if subs && len(r.subs) > 0 {
@@ -608,6 +824,24 @@ func (s *Server) Routez(routezOpts *RoutezOptions) (*Routez, error) {
 				ri.Subs = append(ri.Subs, string(sub.subject))
 			}
 		}
+		if r.route.cw != nil {
+			ri.Compression = r.route.compression
+		}
+		if cs := &r.route.cstats; r.route.cw != nil || atomic.LoadInt64(&cs.inWire) > 0 {
+			ri.CompStats = &RouteCompression{
+				InBytes:     atomic.LoadInt64(&cs.inWire),
+				InRawBytes:  atomic.LoadInt64(&cs.inRaw),
+				OutBytes:    atomic.LoadInt64(&cs.outWire),
+				OutRawBytes: atomic.LoadInt64(&cs.outRaw),
+			}
+		}
+		ri.Batching = r.route.batch
+		if bs := &r.route.bstats; r.route.batch || atomic.LoadInt64(&bs.in) > 0 {
+			ri.BatchStats = &RouteBatches{
+				InBatches:  atomic.LoadInt64(&bs.in),
+				OutBatches: atomic.LoadInt64(&bs.out),
+			}
+		}
 		switch conn := r.nc.(type) {
 		case *net.TCPConn, *tls.Conn:
 			addr := conn.RemoteAddr().(*net.TCPAddr)
@@ -647,6 +881,116 @@ func (s *Server) HandleRoutez(w http.ResponseWriter, r *http.Request) {
 	ResponseHandler(w, r, b)
 }
 
+// Leafz represents detailed information on current leafnode connections.
+type Leafz struct {
+	ID       string      `json:"server_id"`
+	Now      time.Time   `json:"now"`
+	NumLeafs int         `json:"leafnodes"`
+	Leafs    []*LeafInfo `json:"leafs"`
+}
+
+// LeafzOptions are options passed to Leafz
+type LeafzOptions struct {
+	// Subscriptions indicates that Leafz will return a leafnode's subscriptions
+	Subscriptions bool `json:"subscriptions"`
+}
+
+// LeafInfo has detailed information on a per leafnode connection basis.
+type LeafInfo struct {
+	Cid           uint64   `json:"cid"`
+	RemoteID      string   `json:"remote_id"`
+	RemoteCluster string   `json:"remote_cluster,omitempty"`
+	Account       string   `json:"account"`
+	DidSolicit    bool     `json:"did_solicit"`
+	IP            string   `json:"ip"`
+	Port          int      `json:"port"`
+	RTT           string   `json:"rtt,omitempty"`
+	InMsgs        int64    `json:"in_msgs"`
+	OutMsgs       int64    `json:"out_msgs"`
+	InBytes       int64    `json:"in_bytes"`
+	OutBytes      int64    `json:"out_bytes"`
+	NumSubs       uint32   `json:"subscriptions"`
+	Subs          []string `json:"subscriptions_list,omitempty"`
+}
+
+// Leafz returns a Leafz struct containing information about leafnodes.
+func (s *Server) Leafz(leafzOpts *LeafzOptions) (*Leafz, error) {
+	lz := &Leafz{Leafs: []*LeafInfo{}}
+	lz.Now = time.Now()
+
+	subs := leafzOpts != nil && leafzOpts.Subscriptions
+
+	// Grab the leafnode connections under the server lock.
+	s.mu.Lock()
+	lz.ID = s.info.ID
+	leafs := make([]*client, 0, len(s.leafs))
+	for _, ln := range s.leafs {
+		leafs = append(leafs, ln)
+	}
+	s.mu.Unlock()
+
+	for _, ln := range leafs {
+		ln.mu.Lock()
+		li := &LeafInfo{
+			Cid:           ln.cid,
+			RemoteID:      ln.leaf.remoteServer,
+			RemoteCluster: ln.leaf.remoteCluster,
+			DidSolicit:    ln.leaf.remote != nil,
+			RTT:           ln.getRTT(),
+			InMsgs:        atomic.LoadInt64(&ln.inMsgs),
+			OutMsgs:       ln.outMsgs,
+			InBytes:       atomic.LoadInt64(&ln.inBytes),
+			OutBytes:      ln.outBytes,
+			NumSubs:       uint32(len(ln.subs)),
+		}
+		if ln.acc != nil {
+			li.Account = ln.acc.Name
+		}
+		if subs && len(ln.subs) > 0 {
+			li.Subs = make([]string, 0, len(ln.subs))
+			for _, sub := range ln.subs {
+				li.Subs = append(li.Subs, string(sub.subject))
+			}
+		}
+		if ln.nc != nil {
+			if addr, ok := ln.nc.RemoteAddr().(*net.TCPAddr); ok {
+				li.IP = addr.IP.String()
+				li.Port = addr.Port
+			}
+		}
+		ln.mu.Unlock()
+		lz.Leafs = append(lz.Leafs, li)
+	}
+	lz.NumLeafs = len(lz.Leafs)
+	return lz, nil
+}
+
+// HandleLeafz process HTTP requests for leafnode information.
+func (s *Server) HandleLeafz(w http.ResponseWriter, r *http.Request) {
+	subs, err := decodeBool(w, r, "subs")
+	if err != nil {
+		return
+	}
+	var opts *LeafzOptions
+	if subs {
+		opts = &LeafzOptions{Subscriptions: true}
+	}
+
+	s.mu.Lock()
+	s.httpReqStats[LeafzPath]++
+	s.mu.Unlock()
+
+	// As of now, no error is ever returned.
+	lz, _ := s.Leafz(opts)
+	b, err := json.MarshalIndent(lz, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /leafz request: %v", err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
 // Subsz represents detail information on current connections.
 type Subsz struct {
 	*SublistStats
@@ -657,7 +1001,6 @@ type Subsz struct {
 }
 
 // SubszOptions are the options passed to Subsz.
-// As of now, there are no options defined.
 type SubszOptions struct {
 	// Offset is used for pagination. Subsz() only returns connections starting at this
 	// offset from the global results.
@@ -672,6 +1015,12 @@ type SubszOptions struct {
 	// Test the list against this subject. Needs to be literal since it signifies a publish subject.
 	// We will only return subscriptions that would match if a message was sent to this subject.
 	Test string `json:"test,omitempty"`
+
+	// Filter the list on subscriptions matching this subject, which may have wildcards.
+	FilterSubject string `json:"filter_subject,omitempty"`
+
+	// Account scopes the stats and the list to this account, the global account if empty.
+	Account string `json:"account,omitempty"`
 }
 
 // SubDetail is for verbose information for subscriptions.
@@ -682,6 +1031,7 @@ type SubDetail struct {
 	Msgs    int64  `json:"msgs"`
 	Max     int64  `json:"max,omitempty"`
 	Cid     uint64 `json:"cid"`
+	Account string `json:"account,omitempty"`
 }
 
 // Subsz returns a Subsz struct containing subjects statistics
@@ -692,6 +1042,8 @@ func (s *Server) Subsz(opts *SubszOptions) (*Subsz, error) {
 		offset    int
 		limit     = DefaultSubListSize
 		testSub   = ""
+		filter    string
+		acc       = s.globalAccount()
 	)
 
 	if opts != nil {
@@ -711,17 +1063,32 @@ func (s *Server) Subsz(opts *SubszOptions) (*Subsz, error) {
 				return nil, fmt.Errorf("invalid test subject, must be valid publish subject: %s", testSub)
 			}
 		}
+		if opts.FilterSubject != "" {
+			filter = opts.FilterSubject
+			if !IsValidSubject(filter) {
+				return nil, fmt.Errorf("invalid filter subject: %s", filter)
+			}
+		}
+		if opts.Account != "" {
+			v, ok := s.accounts.Load(opts.Account)
+			if !ok {
+				return nil, fmt.Errorf("account %q not found", opts.Account)
+			}
+			acc = v.(*Account)
+		}
 	}
 
-	// FIXME(dlc) - Make account aware.
-	sz := &Subsz{s.gacc.sl.Stats(), 0, offset, limit, nil}
+	acc.mu.RLock()
+	sl := acc.sl
+	acc.mu.RUnlock()
+	sz := &Subsz{sl.Stats(), 0, offset, limit, nil}
 
 	if subdetail {
 		// Now add in subscription's details
 		var raw [4096]*subscription
 		subs := raw[:0]
 
-		s.gacc.sl.localSubs(&subs)
+		sl.localSubs(&subs)
 		details := make([]SubDetail, len(subs))
 		i := 0
 		// TODO(dlc) - may be inefficient and could just do normal match when total subs is large and filtering.
@@ -730,6 +1097,9 @@ func (s *Server) Subsz(opts *SubszOptions) (*Subsz, error) {
 			if test && !matchLiteral(testSub, string(sub.subject)) {
 				continue
 			}
+			if filter != "" && !subjectMatchesFilter(filter, string(sub.subject)) {
+				continue
+			}
 			if sub.client == nil {
 				continue
 			}
@@ -741,10 +1111,18 @@ func (s *Server) Subsz(opts *SubszOptions) (*Subsz, error) {
 				Msgs:    sub.nm,
 				Max:     sub.max,
 				Cid:     sub.client.cid,
+				Account: acc.Name,
 			}
 			sub.client.mu.Unlock()
 			i++
 		}
+		// Keep the same order between pages.
+		sort.Slice(details[:i], func(a, b int) bool {
+			if details[a].Cid != details[b].Cid {
+				return details[a].Cid < details[b].Cid
+			}
+			return details[a].Sid < details[b].Sid
+		})
 		minoff := sz.Offset
 		maxoff := sz.Offset + sz.Limit
 
@@ -789,6 +1167,8 @@ func (s *Server) HandleSubsz(w http.ResponseWriter, r *http.Request) {
 		Offset:        offset,
 		Limit:         limit,
 		Test:          testSub,
+		FilterSubject: r.URL.Query().Get("filter_subject"),
+		Account:       r.URL.Query().Get("acc"),
 	}
 
 	st, err := s.Subsz(subszOpts)
@@ -833,6 +1213,84 @@ func (s *Server) HandleStacksz(w http.ResponseWriter, r *http.Request) {
 	ResponseHandler(w, r, buf[:n])
 }
 
+// profAuth requires the profiling credentials, when configured, to access
+// the given handler.
+func (s *Server) profAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		po := s.getOpts().Prof
+		if po.Username != _EMPTY_ {
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != po.Username || !comparePasswords(po.Password, pass) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="profiling"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+const (
+	// Duration of CPU profiles and traces when not set in the request.
+	profilezDefaultDuration = 5 * time.Second
+	// Longest CPU profile or trace that can be requested.
+	profilezMaxDuration = time.Minute
+)
+
+// ProfilezOptions are the options of a request for a profile of the server.
+type ProfilezOptions struct {
+	// Name is "cpu", "trace", or the name of a runtime/pprof profile
+	// such as "heap", "goroutine" or "block".
+	Name string `json:"name"`
+	// Debug is the format of runtime/pprof profiles, as in their
+	// WriteTo method.
+	Debug int `json:"debug,omitempty"`
+	// Duration of a CPU profile or of a trace.
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// ProfilezStatus holds a profile captured on request.
+type ProfilezStatus struct {
+	Profile []byte `json:"profile,omitempty"`
+}
+
+// Profilez captures the requested profile, if profiling is enabled.
+func (s *Server) Profilez(opts *ProfilezOptions) (*ProfilezStatus, error) {
+	if o := s.getOpts(); !o.Prof.Enabled && o.ProfPort == 0 {
+		return nil, ErrProfilingDisabled
+	}
+	d := opts.Duration
+	if d <= 0 {
+		d = profilezDefaultDuration
+	} else if d > profilezMaxDuration {
+		return nil, fmt.Errorf("profile duration exceeds %v", profilezMaxDuration)
+	}
+	var buf bytes.Buffer
+	switch opts.Name {
+	case "cpu", "profile":
+		if err := pprof.StartCPUProfile(&buf); err != nil {
+			return nil, err
+		}
+		time.Sleep(d)
+		pprof.StopCPUProfile()
+	case "trace":
+		if err := trace.Start(&buf); err != nil {
+			return nil, err
+		}
+		time.Sleep(d)
+		trace.Stop()
+	default:
+		p := pprof.Lookup(opts.Name)
+		if p == nil {
+			return nil, fmt.Errorf("unknown profile %q", opts.Name)
+		}
+		if err := p.WriteTo(&buf, opts.Debug); err != nil {
+			return nil, err
+		}
+	}
+	return &ProfilezStatus{Profile: buf.Bytes()}, nil
+}
+
 // Varz will output server information on the monitoring port at /varz.
 type Varz struct {
 	ID                string            `json:"server_id"`
@@ -861,6 +1319,7 @@ type Varz struct {
 	Cluster           ClusterOptsVarz   `json:"cluster,omitempty"`
 	Gateway           GatewayOptsVarz   `json:"gateway,omitempty"`
 	LeafNode          LeafNodeOptsVarz  `json:"leaf,omitempty"`
+	Tags              []string          `json:"tags,omitempty"`
 	TLSTimeout        float64           `json:"tls_timeout"`
 	WriteDeadline     time.Duration     `json:"write_deadline"`
 	Start             time.Time         `json:"start"`
@@ -868,8 +1327,10 @@ type Varz struct {
 	Uptime            string            `json:"uptime"`
 	Mem               int64             `json:"mem"`
 	Cores             int               `json:"cores"`
+	MaxProcs          int               `json:"gomaxprocs"`
 	CPU               float64           `json:"cpu"`
 	Connections       int               `json:"connections"`
+	PolledConnections int               `json:"polled_connections,omitempty"`
 	TotalConnections  uint64            `json:"total_connections"`
 	Routes            int               `json:"routes"`
 	Remotes           int               `json:"remotes"`
@@ -878,13 +1339,117 @@ type Varz struct {
 	InBytes           int64             `json:"in_bytes"`
 	OutBytes          int64             `json:"out_bytes"`
 	SlowConsumers     int64             `json:"slow_consumers"`
+	TotalPending      int64             `json:"total_pending"`
+	PendingPauses     int64             `json:"pending_pauses"`
+	Rates             VarzRates         `json:"rates"`
+	Flushes           VarzFlushes       `json:"flushes"`
 	Subscriptions     uint32            `json:"subscriptions"`
 	HTTPReqStats      map[string]uint64 `json:"http_req_stats"`
 	ConfigLoadTime    time.Time         `json:"config_load_time"`
+	Lastz             string            `json:"lastz"`
+	Delta             *VarzDelta        `json:"delta,omitempty"`
+}
+
+// VarzRates are the throughput of the server, per second.
+type VarzRates struct {
+	InMsgs   float64 `json:"in_msgs"`
+	OutMsgs  float64 `json:"out_msgs"`
+	InBytes  float64 `json:"in_bytes"`
+	OutBytes float64 `json:"out_bytes"`
+}
+
+// VarzFlushes are statistics of the writes to the connections.
+type VarzFlushes struct {
+	Count      int64            `json:"count"`
+	Bytes      int64            `json:"bytes"`
+	Vectors    int64            `json:"vectors"`
+	AvgSize    float64          `json:"avg_size"`
+	AvgVectors float64          `json:"avg_vectors"`
+	Sizes      []FlushSizeCount `json:"sizes"`
+}
+
+// FlushSizeCount is the number of flushes of more bytes than the Max of the
+// previous bucket and at most Max bytes. Max is 0 for the last bucket.
+type FlushSizeCount struct {
+	Max   int64 `json:"max,omitempty"`
+	Count int64 `json:"count"`
+}
+
+// VarzDelta contains the change of the counters since the Varz the
+// Lastz option was taken from.
+type VarzDelta struct {
+	Interval      time.Duration `json:"interval"`
+	InMsgs        int64         `json:"in_msgs"`
+	OutMsgs       int64         `json:"out_msgs"`
+	InBytes       int64         `json:"in_bytes"`
+	OutBytes      int64         `json:"out_bytes"`
+	SlowConsumers int64         `json:"slow_consumers"`
+	Rates         VarzRates     `json:"rates"`
+}
+
+// Minimum interval between two computations of the Varz rates, so that
+// frequent requests do not report rates over very short intervals.
+const varzRatesInterval = time.Second
+
+// Counters of the server at a given time, from which the rates and
+// deltas are computed.
+type varzRateSample struct {
+	time          time.Time
+	inMsgs        int64
+	outMsgs       int64
+	inBytes       int64
+	outBytes      int64
+	slowConsumers int64
+	rates         VarzRates
+}
+
+// Returns the rates over the interval from the given sample to this one.
+func (vs *varzRateSample) ratesSince(prev *varzRateSample) VarzRates {
+	secs := vs.time.Sub(prev.time).Seconds()
+	if secs <= 0 {
+		return VarzRates{}
+	}
+	return VarzRates{
+		InMsgs:   float64(vs.inMsgs-prev.inMsgs) / secs,
+		OutMsgs:  float64(vs.outMsgs-prev.outMsgs) / secs,
+		InBytes:  float64(vs.inBytes-prev.inBytes) / secs,
+		OutBytes: float64(vs.outBytes-prev.outBytes) / secs,
+	}
+}
+
+// Returns the opaque token passed back with the Lastz option.
+func (vs *varzRateSample) lastz() string {
+	return fmt.Sprintf("%d.%d.%d.%d.%d.%d", vs.time.UnixNano(),
+		vs.inMsgs, vs.outMsgs, vs.inBytes, vs.outBytes, vs.slowConsumers)
+}
+
+// Parses a token returned by lastz().
+func parseLastz(lastz string) (*varzRateSample, error) {
+	fields := strings.Split(lastz, ".")
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid lastz %q", lastz)
+	}
+	var vals [6]int64
+	for i, f := range fields {
+		v, err := strconv.ParseInt(f, 10, 64)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid lastz %q", lastz)
+		}
+		vals[i] = v
+	}
+	return &varzRateSample{
+		time:          time.Unix(0, vals[0]),
+		inMsgs:        vals[1],
+		outMsgs:       vals[2],
+		inBytes:       vals[3],
+		outBytes:      vals[4],
+		slowConsumers: vals[5],
+	}, nil
 }
 
 // ClusterOptsVarz contains monitoring cluster information
 type ClusterOptsVarz struct {
+	Name        string   `json:"name,omitempty"`
 	Host        string   `json:"addr,omitempty"`
 	Port        int      `json:"cluster_port,omitempty"`
 	AuthTimeout float64  `json:"auth_timeout,omitempty"`
@@ -929,7 +1494,11 @@ type RemoteLeafOptsVarz struct {
 
 // VarzOptions are the options passed to Varz().
 // Currently, there are no options defined.
-type VarzOptions struct{}
+type VarzOptions struct {
+	// Lastz is the Lastz field of a previous Varz, to get the change of
+	// the counters since then in the Delta field.
+	Lastz string `json:"lastz"`
+}
 
 func myUptime(d time.Duration) string {
 	// Just use total seconds for uptime, and display days / years
@@ -979,6 +1548,11 @@ func (s *Server) HandleRoot(w http.ResponseWriter, r *http.Request) {
 	<a href=/connz>connz</a><br/>
 	<a href=/routez>routez</a><br/>
 	<a href=/subsz>subsz</a><br/>
+	<a href=/accountz>accountz</a><br/>
+	<a href=/leafz>leafz</a><br/>
+	<a href=/metrics>metrics</a><br/>
+	<a href=/jsz>jsz</a><br/>
+	<a href=/healthz>healthz</a><br/>
     <br/>
     <a href=http://nats.io/documentation/server/monitoring/>help</a>
   </body>
@@ -1000,9 +1574,73 @@ func (s *Server) Varz(varzOpts *VarzOptions) (*Varz, error) {
 	v := s.createVarz(pcpu, rss)
 	s.mu.Unlock()
 
+	var lastz string
+	if varzOpts != nil {
+		lastz = varzOpts.Lastz
+	}
+	if err := s.setVarzDelta(v, lastz); err != nil {
+		return nil, err
+	}
 	return v, nil
 }
 
+// Sets the rates and the Lastz token from the counters of the given Varz.
+// The rates are recomputed at most every varzRatesInterval.
+// Server lock is held on entry.
+func (s *Server) updateVarzRates(v *Varz) {
+	cur := varzRateSample{
+		time:          v.Now,
+		inMsgs:        v.InMsgs,
+		outMsgs:       v.OutMsgs,
+		inBytes:       v.InBytes,
+		outBytes:      v.OutBytes,
+		slowConsumers: v.SlowConsumers,
+	}
+	prev := &s.varzRates
+	if prev.time.IsZero() {
+		prev.time = s.start
+	}
+	if cur.time.Sub(prev.time) >= varzRatesInterval {
+		cur.rates = cur.ratesSince(prev)
+		s.varzRates = cur
+	}
+	v.Rates = s.varzRates.rates
+	v.Lastz = cur.lastz()
+}
+
+// Sets the Delta of the given Varz from the Lastz of a previous one.
+func (s *Server) setVarzDelta(v *Varz, lastz string) error {
+	v.Delta = nil
+	if lastz == _EMPTY_ {
+		return nil
+	}
+	prev, err := parseLastz(lastz)
+	if err != nil {
+		return err
+	}
+	cur, err := parseLastz(v.Lastz)
+	if err != nil {
+		return err
+	}
+	// If the counters went backwards, the token is from a previous run
+	// of the server, so the delta is since the start.
+	if prev.inMsgs > cur.inMsgs || prev.outMsgs > cur.outMsgs ||
+		prev.inBytes > cur.inBytes || prev.outBytes > cur.outBytes ||
+		prev.slowConsumers > cur.slowConsumers || prev.time.Before(v.Start) {
+		prev = &varzRateSample{time: v.Start}
+	}
+	v.Delta = &VarzDelta{
+		Interval:      cur.time.Sub(prev.time),
+		InMsgs:        cur.inMsgs - prev.inMsgs,
+		OutMsgs:       cur.outMsgs - prev.outMsgs,
+		InBytes:       cur.inBytes - prev.inBytes,
+		OutBytes:      cur.outBytes - prev.outBytes,
+		SlowConsumers: cur.slowConsumers - prev.slowConsumers,
+		Rates:         cur.ratesSince(prev),
+	}
+	return nil
+}
+
 // Returns a Varz instance.
 // Server lock is held on entry.
 func (s *Server) createVarz(pcpu float64, rss int64) *Varz {
@@ -1107,6 +1745,7 @@ func (s *Server) updateVarzConfigReloadableFields(v *Varz) {
 	v.AuthTimeout = opts.AuthTimeout
 	v.MaxControlLine = opts.MaxControlLine
 	v.MaxPayload = int(opts.MaxPayload)
+	v.Tags = opts.Tags
 	v.MaxPending = opts.MaxPending
 	v.TLSTimeout = opts.TLSTimeout
 	v.WriteDeadline = opts.WriteDeadline
@@ -1118,6 +1757,25 @@ func (s *Server) updateVarzConfigReloadableFields(v *Varz) {
 	}
 }
 
+// Updates the flush statistics of the Varz.
+func (s *Server) updateVarzFlushes(f *VarzFlushes) {
+	f.Count = atomic.LoadInt64(&s.flushes)
+	f.Bytes = atomic.LoadInt64(&s.flushBytes)
+	f.Vectors = atomic.LoadInt64(&s.flushVectors)
+	f.AvgSize, f.AvgVectors = 0, 0
+	if f.Count > 0 {
+		f.AvgSize = float64(f.Bytes) / float64(f.Count)
+		f.AvgVectors = float64(f.Vectors) / float64(f.Count)
+	}
+	f.Sizes = make([]FlushSizeCount, len(s.flushSizes))
+	for i := range s.flushSizes {
+		if i < len(flushSizeBounds) {
+			f.Sizes[i].Max = flushSizeBounds[i]
+		}
+		f.Sizes[i].Count = atomic.LoadInt64(&s.flushSizes[i])
+	}
+}
+
 // Updates the runtime Varz fields, that is, fields that change during
 // runtime and that should be updated any time Varz() or polling of /varz
 // is done.
@@ -1128,19 +1786,29 @@ func (s *Server) updateVarzRuntimeFields(v *Varz, forceUpdate bool, pcpu float64
 	v.Mem = rss
 	v.CPU = pcpu
 	v.Cores = numCores
+	v.MaxProcs = runtime.GOMAXPROCS(0)
 	if l := len(s.info.ClientConnectURLs); l > 0 {
 		v.ClientConnectURLs = make([]string, l)
 		copy(v.ClientConnectURLs, s.info.ClientConnectURLs)
 	}
 	v.Connections = len(s.clients)
+	if s.poller != nil {
+		v.PolledConnections = s.poller.numConns()
+	}
 	v.TotalConnections = s.totalClients
 	v.Routes = len(s.routes)
 	v.Remotes = len(s.remotes)
+	// The cluster name may change if it was generated.
+	v.Cluster.Name = s.ClusterName()
 	v.InMsgs = atomic.LoadInt64(&s.inMsgs)
 	v.InBytes = atomic.LoadInt64(&s.inBytes)
 	v.OutMsgs = atomic.LoadInt64(&s.outMsgs)
 	v.OutBytes = atomic.LoadInt64(&s.outBytes)
 	v.SlowConsumers = atomic.LoadInt64(&s.slowConsumers)
+	v.TotalPending = atomic.LoadInt64(&s.outPending)
+	v.PendingPauses = atomic.LoadInt64(&s.pendPauses)
+	s.updateVarzRates(v)
+	s.updateVarzFlushes(&v.Flushes)
 	// FIXME(dlc) - make this multi-account aware.
 	v.Subscriptions = s.gacc.sl.Count()
 	v.HTTPReqStats = make(map[string]uint64, len(s.httpReqStats))
@@ -1206,6 +1874,13 @@ func (s *Server) HandleVarz(w http.ResponseWriter, r *http.Request) {
 	}
 	s.mu.Unlock()
 
+	if err := s.setVarzDelta(s.varz, r.URL.Query().Get("lastz")); err != nil {
+		s.varzMu.Unlock()
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
 	// Do the marshaling outside of server lock, but under varzMu lock.
 	b, err := json.MarshalIndent(s.varz, "", "  ")
 	s.varzMu.Unlock()
@@ -1241,7 +1916,8 @@ type Gatewayz struct {
 	InboundGateways  map[string][]*RemoteGatewayz `json:"inbound_gateways"`
 }
 
-// RemoteGatewayz represents information about an outbound connection to a gateway
+// RemoteGatewayz represents information about an outbound connection to a gateway.
+// The connection is not set for a configured gateway that is not connected.
 type RemoteGatewayz struct {
 	IsConfigured bool               `json:"configured"`
 	Connection   *ConnInfo          `json:"connection,omitempty"`
@@ -1318,6 +1994,9 @@ func (s *Server) createOutboundsRemoteGatewayz(opts *GatewayzOptions, now time.T
 	if targetGWName != _EMPTY_ {
 		c := s.getOutboundGatewayConnection(targetGWName)
 		if c == nil {
+			if cfg := s.getRemoteGateway(targetGWName); cfg != nil && !cfg.isImplicit() {
+				return map[string]*RemoteGatewayz{targetGWName: {IsConfigured: true}}
+			}
 			return nil
 		}
 		outbounds := make(map[string]*RemoteGatewayz, 1)
@@ -1338,6 +2017,12 @@ func (s *Server) createOutboundsRemoteGatewayz(opts *GatewayzOptions, now time.T
 			outbounds[name] = rgw
 		}
 	}
+	// Add the configured gateways that are not connected.
+	for _, cfg := range s.getRemoteGateways() {
+		if name := cfg.Name; outbounds[name] == nil && !cfg.isImplicit() {
+			outbounds[name] = &RemoteGatewayz{IsConfigured: true}
+		}
+	}
 	return outbounds
 }
 
@@ -1529,6 +2214,634 @@ func (s *Server) HandleGatewayz(w http.ResponseWriter, r *http.Request) {
 	ResponseHandler(w, r, b)
 }
 
+// AccountzOptions are the options passed to Accountz()
+type AccountzOptions struct {
+	// Account will limit the results to the account with this name or public key.
+	Account string `json:"account"`
+}
+
+// Accountz represents detailed information on registered accounts.
+type Accountz struct {
+	ID            string         `json:"server_id"`
+	Now           time.Time      `json:"now"`
+	SystemAccount string         `json:"system_account,omitempty"`
+	NumAccounts   int            `json:"num_accounts"`
+	Accounts      []*AccountInfo `json:"accounts"`
+}
+
+// AccountInfo has detailed information on a per account basis.
+type AccountInfo struct {
+	Name           string               `json:"name"`
+	Issuer         string               `json:"issuer,omitempty"`
+	IsSystem       bool                 `json:"is_system,omitempty"`
+	Expired        bool                 `json:"expired"`
+	Expires        *time.Time           `json:"expires,omitempty"`
+	Updated        *time.Time           `json:"updated,omitempty"`
+	Resolver       string               `json:"resolver"`
+	NumConns       int                  `json:"num_connections"`
+	NumLocalConns  int                  `json:"num_local_connections"`
+	NumLeafNodes   int                  `json:"leafnodes"`
+	NumSubs        uint32               `json:"subscriptions"`
+	Sent           DataStats            `json:"sent"`
+	Received       DataStats            `json:"received"`
+	SlowConsumers  int64                `json:"slow_consumers"`
+	PermViolations int64                `json:"permission_violations"`
+	ProtoErrors    int64                `json:"protocol_errors"`
+	Imports        []*AccountImportInfo `json:"imports,omitempty"`
+	Exports        []*AccountExportInfo `json:"exports,omitempty"`
+	// JetStream usage and limits, when enabled for the account.
+	JetStream *JetStreamAccountStats `json:"jetstream,omitempty"`
+}
+
+// AccountImportInfo describes a stream or service import of an account.
+type AccountImportInfo struct {
+	Type    string `json:"type"`
+	Account string `json:"account"`
+	Subject string `json:"subject"`
+	To      string `json:"to,omitempty"`
+	Invalid bool   `json:"invalid,omitempty"`
+}
+
+// AccountExportInfo describes a stream or service export of an account.
+type AccountExportInfo struct {
+	Type          string   `json:"type"`
+	Subject       string   `json:"subject"`
+	TokenRequired bool     `json:"token_required,omitempty"`
+	Approved      []string `json:"approved,omitempty"`
+}
+
+// Accountz returns an Accountz struct containing information about registered accounts.
+func (s *Server) Accountz(opts *AccountzOptions) (*Accountz, error) {
+	var filter string
+	if opts != nil {
+		filter = opts.Account
+	}
+
+	s.mu.Lock()
+	az := &Accountz{
+		ID:       s.info.ID,
+		Now:      time.Now(),
+		Accounts: []*AccountInfo{},
+	}
+	var sacc *Account
+	if s.sys != nil {
+		sacc = s.sys.account
+	}
+	resolver := s.accResolver
+	s.mu.Unlock()
+
+	if sacc != nil {
+		az.SystemAccount = sacc.Name
+	}
+
+	s.accounts.Range(func(k, v interface{}) bool {
+		acc := v.(*Account)
+		if filter != _EMPTY_ && acc.Name != filter {
+			return true
+		}
+		ai := createAccountInfo(acc, sacc, resolver)
+		if acc.JetStreamEnabled() {
+			stats := acc.JetStreamUsage()
+			ai.JetStream = &stats
+		}
+		az.Accounts = append(az.Accounts, ai)
+		return true
+	})
+	if filter != _EMPTY_ && len(az.Accounts) == 0 {
+		return nil, fmt.Errorf("account %q not found", filter)
+	}
+	sort.Slice(az.Accounts, func(i, j int) bool {
+		return az.Accounts[i].Name < az.Accounts[j].Name
+	})
+	az.NumAccounts = len(az.Accounts)
+	return az, nil
+}
+
+// AccountStatzOptions are the options passed to AccountStatz()
+type AccountStatzOptions struct {
+	// Accounts will limit the results to these accounts.
+	Accounts []string `json:"accounts"`
+
+	// IncludeUnused will include accounts without local connections.
+	IncludeUnused bool `json:"include_unused"`
+}
+
+// AccountStatz represents per account statistics.
+type AccountStatz struct {
+	ID       string         `json:"server_id"`
+	Now      time.Time      `json:"now"`
+	Accounts []*AccountStat `json:"account_statz"`
+}
+
+// AccountStatz returns an AccountStatz struct containing message and byte
+// counters for the registered accounts.
+func (s *Server) AccountStatz(opts *AccountStatzOptions) (*AccountStatz, error) {
+	stz := &AccountStatz{
+		ID:       s.ID(),
+		Now:      time.Now(),
+		Accounts: []*AccountStat{},
+	}
+	var (
+		filter map[string]struct{}
+		unused bool
+	)
+	if opts != nil {
+		unused = opts.IncludeUnused
+		if len(opts.Accounts) > 0 {
+			filter = make(map[string]struct{}, len(opts.Accounts))
+			for _, name := range opts.Accounts {
+				filter[name] = struct{}{}
+			}
+		}
+	}
+	s.accounts.Range(func(k, v interface{}) bool {
+		acc := v.(*Account)
+		if filter != nil {
+			if _, ok := filter[acc.Name]; !ok {
+				return true
+			}
+		}
+		as := acc.stat()
+		if unused || as.Conns > 0 || as.LeafNodes > 0 {
+			stz.Accounts = append(stz.Accounts, as)
+		}
+		return true
+	})
+	sort.Slice(stz.Accounts, func(i, j int) bool {
+		return stz.Accounts[i].Account < stz.Accounts[j].Account
+	})
+	return stz, nil
+}
+
+// Returns the source of an account's definition.
+func accountResolverSource(acc *Account, resolver AccountResolver) string {
+	if acc.claimJWT == _EMPTY_ {
+		return "config"
+	}
+	switch resolver.(type) {
+	case *MemAccResolver:
+		return "memory"
+	case *URLAccResolver:
+		return "url"
+	case nil:
+		return "none"
+	default:
+		return "custom"
+	}
+}
+
+func createAccountInfo(acc, sacc *Account, resolver AccountResolver) *AccountInfo {
+	acc.mu.RLock()
+	defer acc.mu.RUnlock()
+
+	ai := &AccountInfo{
+		Name:          acc.Name,
+		Issuer:        acc.Issuer,
+		IsSystem:      acc == sacc,
+		Expired:       acc.expired,
+		Resolver:      accountResolverSource(acc, resolver),
+		NumConns:      len(acc.clients) + int(acc.nrclients),
+		NumLocalConns: acc.numLocalConnections(),
+		NumLeafNodes:  int(acc.nleafs + acc.nrleafs),
+		NumSubs:       acc.sl.Count(),
+		Sent: DataStats{
+			Msgs:  atomic.LoadInt64(&acc.outMsgs),
+			Bytes: atomic.LoadInt64(&acc.outBytes),
+		},
+		Received: DataStats{
+			Msgs:  atomic.LoadInt64(&acc.inMsgs),
+			Bytes: atomic.LoadInt64(&acc.inBytes),
+		},
+		SlowConsumers:  atomic.LoadInt64(&acc.slowConsumers),
+		PermViolations: atomic.LoadInt64(&acc.permViolations),
+		ProtoErrors:    atomic.LoadInt64(&acc.protoErrors),
+	}
+	if !acc.updated.IsZero() {
+		updated := acc.updated
+		ai.Updated = &updated
+	}
+	if acc.claimJWT != _EMPTY_ {
+		if ac, err := jwt.DecodeAccountClaims(acc.claimJWT); err == nil && ac.Expires > 0 {
+			expires := time.Unix(ac.Expires, 0).UTC()
+			ai.Expires = &expires
+		}
+	}
+	for _, si := range acc.imports.streams {
+		ai.Imports = append(ai.Imports, &AccountImportInfo{
+			Type:    "stream",
+			Account: si.acc.Name,
+			Subject: si.from,
+			To:      si.prefix,
+			Invalid: si.invalid,
+		})
+	}
+	for _, si := range acc.imports.services {
+		ai.Imports = append(ai.Imports, &AccountImportInfo{
+			Type:    "service",
+			Account: si.acc.Name,
+			Subject: si.from,
+			To:      si.to,
+			Invalid: si.invalid,
+		})
+	}
+	sort.Slice(ai.Imports, func(i, j int) bool {
+		if ai.Imports[i].Type != ai.Imports[j].Type {
+			return ai.Imports[i].Type > ai.Imports[j].Type
+		}
+		return ai.Imports[i].Subject < ai.Imports[j].Subject
+	})
+	ai.Exports = appendAccountExports(ai.Exports, "stream", acc.exports.streams)
+	ai.Exports = appendAccountExports(ai.Exports, "service", acc.exports.services)
+	return ai
+}
+
+func appendAccountExports(exports []*AccountExportInfo, kind string, m map[string]*exportAuth) []*AccountExportInfo {
+	subjects := make([]string, 0, len(m))
+	for subj := range m {
+		subjects = append(subjects, subj)
+	}
+	sort.Strings(subjects)
+	for _, subj := range subjects {
+		ei := &AccountExportInfo{Type: kind, Subject: subj}
+		if ea := m[subj]; ea != nil {
+			ei.TokenRequired = ea.tokenReq
+			for name := range ea.approved {
+				ei.Approved = append(ei.Approved, name)
+			}
+			sort.Strings(ei.Approved)
+		}
+		exports = append(exports, ei)
+	}
+	return exports
+}
+
+// HandleAccountz process HTTP requests for account information.
+func (s *Server) HandleAccountz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[AccountzPath]++
+	s.mu.Unlock()
+
+	opts := &AccountzOptions{Account: r.URL.Query().Get("acc")}
+	az, err := s.Accountz(opts)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	b, err := json.MarshalIndent(az, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /accountz request: %v", err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
+// HealthzOptions are options passed to Healthz.
+type HealthzOptions struct {
+	// Live only checks that the server is running, for liveness probes.
+	Live bool `json:"live,omitempty"`
+	// JSEnabled requires JetStream to be enabled.
+	JSEnabled bool `json:"js_enabled,omitempty"`
+	// Routes is the number of cluster peers that must be connected.
+	Routes int `json:"routes,omitempty"`
+	// Resolver requires the account resolver to be reachable.
+	Resolver bool `json:"resolver,omitempty"`
+}
+
+// HealthStatus is the result of a health check.
+type HealthStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Healthz returns the health of the server. Unless only liveness is
+// checked, a server that is starting or in lame duck mode is not healthy.
+func (s *Server) Healthz(opts *HealthzOptions) *HealthStatus {
+	if opts == nil {
+		opts = &HealthzOptions{}
+	}
+	if err := s.healthz(opts); err != nil {
+		return &HealthStatus{Status: "unavailable", Error: err.Error()}
+	}
+	return &HealthStatus{Status: "ok"}
+}
+
+func (s *Server) healthz(opts *HealthzOptions) error {
+	sopts := s.getOpts()
+	s.mu.Lock()
+	running, ldm := s.running, s.ldm
+	// Same conditions as in ReadyForConnections().
+	ready := s.listener != nil && (sopts.Cluster.Port == 0 || s.routeListener != nil) &&
+		(sopts.Gateway.Name == _EMPTY_ || s.gatewayListener != nil)
+	resolver := s.accResolver
+	s.mu.Unlock()
+
+	if !running {
+		return fmt.Errorf("server is not running")
+	}
+	if opts.Live {
+		return nil
+	}
+	if !ready {
+		return fmt.Errorf("server is starting")
+	}
+	if ldm {
+		return fmt.Errorf("server is in lame duck mode")
+	}
+	if opts.JSEnabled && !s.JetStreamEnabled() {
+		return fmt.Errorf("JetStream is not enabled")
+	}
+	if opts.Routes > 0 {
+		if np := s.numRoutePeers(); np < opts.Routes {
+			return fmt.Errorf("%d cluster peers connected, %d required", np, opts.Routes)
+		}
+	}
+	if opts.Resolver {
+		switch ar := resolver.(type) {
+		case nil:
+			return fmt.Errorf("no account resolver configured")
+		case *URLAccResolver:
+			// Same check as when the resolver is created.
+			if _, err := ar.Fetch(_EMPTY_); err != nil {
+				return fmt.Errorf("account resolver is not reachable: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the number of distinct servers this server has routes to.
+func (s *Server) numRoutePeers() int {
+	s.mu.Lock()
+	routes := make([]*client, 0, len(s.routes))
+	for _, r := range s.routes {
+		routes = append(routes, r)
+	}
+	s.mu.Unlock()
+
+	peers := make(map[string]struct{}, len(routes))
+	for _, r := range routes {
+		r.mu.Lock()
+		if id := r.route.remoteID; id != _EMPTY_ {
+			peers[id] = struct{}{}
+		}
+		r.mu.Unlock()
+	}
+	return len(peers)
+}
+
+// Decodes a boolean parameter that is true when given without value.
+func decodeFlag(w http.ResponseWriter, r *http.Request, param string) (bool, error) {
+	vals, ok := r.URL.Query()[param]
+	if !ok {
+		return false, nil
+	}
+	if len(vals) == 0 || vals[0] == "" {
+		return true, nil
+	}
+	return decodeBool(w, r, param)
+}
+
+// HandleHealthz process HTTP requests for the health of the server. It
+// returns a 503 status code with the reason when the server is not healthy.
+func (s *Server) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	opts := &HealthzOptions{}
+	var err error
+	if opts.Live, err = decodeFlag(w, r, "live"); err != nil {
+		return
+	}
+	if opts.JSEnabled, err = decodeFlag(w, r, "js-enabled"); err != nil {
+		return
+	}
+	if opts.Resolver, err = decodeFlag(w, r, "resolver"); err != nil {
+		return
+	}
+	// Either the number of peers required, or at least one.
+	if vals, ok := r.URL.Query()["routes"]; ok {
+		if len(vals) == 0 || vals[0] == "" {
+			opts.Routes = 1
+		} else if opts.Routes, err = decodeInt(w, r, "routes"); err != nil {
+			return
+		}
+	}
+
+	s.mu.Lock()
+	s.httpReqStats[HealthzPath]++
+	s.mu.Unlock()
+
+	hs := s.Healthz(opts)
+	b, err := json.Marshal(hs)
+	if err != nil {
+		s.Errorf("Error marshaling response to /healthz request: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if hs.Error != _EMPTY_ {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(b)
+}
+
+// JSzOptions are options passed to Jsz.
+type JSzOptions struct {
+	// Account restricts the details to this account.
+	Account string `json:"account,omitempty"`
+	// Accounts includes the usage of each account.
+	Accounts bool `json:"accounts,omitempty"`
+	// Streams includes the streams of each account.
+	Streams bool `json:"streams,omitempty"`
+	// Consumer includes the consumers of each stream.
+	Consumer bool `json:"consumer,omitempty"`
+	// Config includes the configuration of the streams.
+	Config bool `json:"config,omitempty"`
+	// Offset and Limit are used for the pagination of the accounts.
+	Offset int `json:"offset,omitempty"`
+	Limit  int `json:"limit,omitempty"`
+}
+
+// JSInfo has the JetStream state of the server.
+type JSInfo struct {
+	ID        string           `json:"server_id"`
+	Now       time.Time        `json:"now"`
+	Disabled  bool             `json:"disabled,omitempty"`
+	Config    *JetStreamConfig `json:"config,omitempty"`
+	Memory    uint64           `json:"memory"`
+	Store     uint64           `json:"storage"`
+	Accounts  int              `json:"accounts"`
+	Streams   int              `json:"streams"`
+	Consumers int              `json:"consumers"`
+	// Meta is the state of the metadata group in clustered mode.
+	Meta           *ClusterInfo     `json:"meta_cluster,omitempty"`
+	AccountDetails []*AccountDetail `json:"account_details,omitempty"`
+}
+
+// AccountDetail has the JetStream usage and limits of an account.
+type AccountDetail struct {
+	Name string `json:"name"`
+	JetStreamAccountStats
+	Streams []*StreamDetail `json:"stream_detail,omitempty"`
+}
+
+// StreamDetail has the state of a stream, and of its group when replicated.
+type StreamDetail struct {
+	Name      string          `json:"name"`
+	Created   time.Time       `json:"created"`
+	Cluster   *ClusterInfo    `json:"cluster,omitempty"`
+	Config    *StreamConfig   `json:"config,omitempty"`
+	State     StreamState     `json:"state"`
+	Consumers []*ConsumerInfo `json:"consumer_detail,omitempty"`
+}
+
+// Jsz returns the JetStream state of the server.
+func (s *Server) Jsz(opts *JSzOptions) (*JSInfo, error) {
+	var o JSzOptions
+	if opts != nil {
+		o = *opts
+	}
+	opts = &o
+	// Asking for the consumers or the account implies the parent levels.
+	if opts.Consumer {
+		opts.Streams = true
+	}
+	if opts.Streams || opts.Account != _EMPTY_ {
+		opts.Accounts = true
+	}
+	offset, limit := opts.Offset, opts.Limit
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 {
+		limit = DefaultAccountListSize
+	}
+
+	jsi := &JSInfo{ID: s.ID(), Now: time.Now()}
+	js := s.getJetStream()
+	if js == nil {
+		jsi.Disabled = true
+		return jsi, nil
+	}
+	config := js.config
+	jsi.Config = &config
+	jsi.Memory = uint64(atomic.LoadInt64(&js.memUsed))
+	jsi.Store = uint64(atomic.LoadInt64(&js.storeUsed))
+	if js.cluster != nil {
+		jsi.Meta = js.cluster.metaClusterInfo()
+	}
+
+	js.mu.RLock()
+	accounts := make([]*jsAccount, 0, len(js.accounts))
+	for _, jsa := range js.accounts {
+		accounts = append(accounts, jsa)
+	}
+	js.mu.RUnlock()
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].account.Name < accounts[j].account.Name })
+
+	jsi.Accounts = len(accounts)
+	for _, jsa := range accounts {
+		jsa.mu.RLock()
+		jsi.Streams += len(jsa.streams)
+		jsa.mu.RUnlock()
+		jsi.Consumers += jsa.numConsumers()
+	}
+	if !opts.Accounts {
+		return jsi, nil
+	}
+
+	if opts.Account != _EMPTY_ {
+		filtered := accounts[:0]
+		for _, jsa := range accounts {
+			if jsa.account.Name == opts.Account {
+				filtered = append(filtered, jsa)
+			}
+		}
+		accounts = filtered
+	}
+	if offset > len(accounts) {
+		offset = len(accounts)
+	}
+	if end := offset + limit; end < len(accounts) {
+		accounts = accounts[offset:end]
+	} else {
+		accounts = accounts[offset:]
+	}
+	for _, jsa := range accounts {
+		acc := jsa.account
+		ad := &AccountDetail{Name: acc.Name, JetStreamAccountStats: acc.JetStreamUsage()}
+		if opts.Streams {
+			for _, mset := range acc.Streams() {
+				sd := &StreamDetail{
+					Name:    mset.Name(),
+					Created: mset.Created(),
+					Cluster: mset.clusterInfo(),
+					State:   mset.State(),
+				}
+				if opts.Config {
+					cfg := mset.Config()
+					sd.Config = &cfg
+				}
+				if opts.Consumer {
+					for _, o := range mset.Consumers() {
+						sd.Consumers = append(sd.Consumers, o.Info())
+					}
+				}
+				ad.Streams = append(ad.Streams, sd)
+			}
+		}
+		jsi.AccountDetails = append(jsi.AccountDetails, ad)
+	}
+	return jsi, nil
+}
+
+// HandleJsz process HTTP requests for the JetStream state.
+func (s *Server) HandleJsz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[JszPath]++
+	s.mu.Unlock()
+
+	accounts, err := decodeBool(w, r, "accounts")
+	if err != nil {
+		return
+	}
+	streams, err := decodeBool(w, r, "streams")
+	if err != nil {
+		return
+	}
+	consumers, err := decodeBool(w, r, "consumers")
+	if err != nil {
+		return
+	}
+	config, err := decodeBool(w, r, "config")
+	if err != nil {
+		return
+	}
+	offset, err := decodeInt(w, r, "offset")
+	if err != nil {
+		return
+	}
+	limit, err := decodeInt(w, r, "limit")
+	if err != nil {
+		return
+	}
+
+	// As of now, no error is ever returned.
+	jsi, _ := s.Jsz(&JSzOptions{
+		Account:  r.URL.Query().Get("acc"),
+		Accounts: accounts,
+		Streams:  streams,
+		Consumer: consumers,
+		Config:   config,
+		Offset:   offset,
+		Limit:    limit,
+	})
+	b, err := json.MarshalIndent(jsi, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /jsz request: %v", err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
 // ResponseHandler handles responses for monitoring routes
 func ResponseHandler(w http.ResponseWriter, r *http.Request, data []byte) {
 	// Get callback from request
@@ -1595,6 +2908,26 @@ func (reason ClosedState) String() string {
 		return "Wrong Gateway"
 	case MissingAccount:
 		return "Missing Account"
+	case AccountDrained:
+		return "Account Drained"
+	case AccountDeleted:
+		return "Account Deleted"
+	case LeafNodeLoopDetected:
+		return "Leafnode Loop Detected"
+	case ClusterNameConflict:
+		return "Cluster Name Conflict"
+	case DuplicateClientID:
+		return "Duplicate Client ID"
+	case Kicked:
+		return "Kicked"
+	case SlowConsumerStalled:
+		return "Slow Consumer (Stalled)"
+	case MaxIPConnectionsExceeded:
+		return "Maximum IP Connections Exceeded"
+	case MaxUserConnectionsExceeded:
+		return "Maximum User Connections Exceeded"
+	case IdleTimeout:
+		return "Idle Timeout"
 	}
 	return "Unknown State"
 }
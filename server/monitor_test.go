@@ -21,6 +21,7 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"reflect"
@@ -214,6 +215,76 @@ func TestHandleVarz(t *testing.T) {
 	readBodyEx(t, url+"varz?callback=callback", http.StatusOK, appJSContent)
 }
 
+func TestMonitorVarzRatesAndDelta(t *testing.T) {
+	s := runMonitorServer()
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/varz", s.MonitorAddr().Port)
+
+	nc := createClientConnSubscribeAndPublish(t, s)
+	defer nc.Close()
+
+	last := pollVarz(t, s, 0, url, nil)
+	if last.Lastz == "" {
+		t.Fatal("Expected lastz to be set")
+	}
+	if last.Delta != nil {
+		t.Fatalf("Expected no delta without lastz, got %+v", last.Delta)
+	}
+
+	sub := natsSubSync(t, nc, "foo")
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	const n, size = 100, 10
+	for i := 0; i < n; i++ {
+		nc.Publish("foo", make([]byte, size))
+	}
+	nc.Flush()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if msgs, _, _ := sub.Pending(); msgs != n {
+			return fmt.Errorf("Expected %v pending msgs, got %v", n, msgs)
+		}
+		return nil
+	})
+	time.Sleep(varzRatesInterval + 100*time.Millisecond)
+
+	for mode := 0; mode < 2; mode++ {
+		v := pollVarz(t, s, mode, url+"?lastz="+last.Lastz, &VarzOptions{Lastz: last.Lastz})
+		d := v.Delta
+		if d == nil {
+			t.Fatalf("Expected delta to be set")
+		}
+		if d.InMsgs != n || d.InBytes != n*size {
+			t.Fatalf("Expected delta of %v msgs and %v bytes, got %v and %v", n, n*size, d.InMsgs, d.InBytes)
+		}
+		if d.OutMsgs != n || d.OutBytes != n*size {
+			t.Fatalf("Expected delta of %v out msgs and %v bytes, got %v and %v", n, n*size, d.OutMsgs, d.OutBytes)
+		}
+		if d.Interval < varzRatesInterval {
+			t.Fatalf("Unexpected interval: %v", d.Interval)
+		}
+		if d.Rates.InMsgs <= 0 || d.Rates.InBytes <= 0 || d.Rates.OutMsgs <= 0 || d.Rates.OutBytes <= 0 {
+			t.Fatalf("Expected delta rates to be set, got %+v", d.Rates)
+		}
+		if v.Rates.InMsgs <= 0 || v.Rates.InBytes <= 0 {
+			t.Fatalf("Expected rates to be set, got %+v", v.Rates)
+		}
+	}
+
+	// A token from a previous run of the server reports the counters.
+	old := fmt.Sprintf("%d.1000000.1000000.1000000.1000000.0", time.Now().UnixNano())
+	v := pollVarz(t, s, 1, url, &VarzOptions{Lastz: old})
+	if v.Delta.InMsgs != v.InMsgs || v.Delta.OutBytes != v.OutBytes {
+		t.Fatalf("Expected delta since the start, got %+v", v.Delta)
+	}
+
+	readBodyEx(t, url+"?lastz=bad", http.StatusBadRequest, textPlain)
+	if _, err := s.Varz(&VarzOptions{Lastz: "bad"}); err == nil {
+		t.Fatal("Expected error for invalid lastz")
+	}
+}
+
 func pollConz(t *testing.T, s *Server, mode int, url string, opts *ConnzOptions) *Connz {
 	t.Helper()
 	if mode == 0 {
@@ -2169,6 +2240,7 @@ func TestMonitorCluster(t *testing.T) {
 
 	resetPreviousHTTPConnections()
 	opts := DefaultMonitorOptions()
+	opts.Cluster.Name = "A"
 	opts.Cluster.Port = -1
 	opts.Cluster.AuthTimeout = 1
 	opts.Routes = RoutesFromStr("nats://127.0.0.1:1234")
@@ -2176,6 +2248,7 @@ func TestMonitorCluster(t *testing.T) {
 	defer s.Shutdown()
 
 	expected := ClusterOptsVarz{
+		"A",
 		opts.Cluster.Host,
 		opts.Cluster.Port,
 		opts.Cluster.AuthTimeout,
@@ -2195,11 +2268,12 @@ func TestMonitorCluster(t *testing.T) {
 
 		// Having this here to make sure that if fields are added in ClusterOptsVarz,
 		// we make sure to update this test (compiler will report an error if we don't)
-		_ = ClusterOptsVarz{"", 0, 0, nil}
+		_ = ClusterOptsVarz{"", "", 0, 0, nil}
 
 		// Alter the fields to make sure that we have a proper deep copy
 		// of what may be stored in the server. Anything we change here
 		// should not affect the next returned value.
+		v.Cluster.Name = "wrong"
 		v.Cluster.Host = "wrong"
 		v.Cluster.Port = 0
 		v.Cluster.AuthTimeout = 0
@@ -3125,3 +3199,762 @@ func TestMonitorGatewayzAccounts(t *testing.T) {
 		return nil
 	})
 }
+
+func pollAccountz(t *testing.T, s *Server, mode int, url string, opts *AccountzOptions) *Accountz {
+	t.Helper()
+	if mode == 0 {
+		az := &Accountz{}
+		body := readBody(t, url)
+		if err := json.Unmarshal(body, az); err != nil {
+			t.Fatalf("Got an error unmarshalling the body: %v\n", err)
+		}
+		return az
+	}
+	az, err := s.Accountz(opts)
+	if err != nil {
+		t.Fatalf("Error on Accountz: %v", err)
+	}
+	return az
+}
+
+func TestMonitorAccountz(t *testing.T) {
+	resetPreviousHTTPConnections()
+
+	conf := createConfFile(t, []byte(`
+		port: -1
+		http: -1
+		accounts {
+			A {
+				users [{user: a, password: pwd}]
+				exports [{stream: "foo.>"}, {service: "req.a", accounts: [B]}]
+			}
+			B {
+				users [{user: b, password: pwd}]
+				imports [
+					{stream: {account: A, subject: "foo.>"}, prefix: "from_a"}
+					{service: {account: A, subject: "req.a"}}
+				]
+			}
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, o := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://a:pwd@%s:%d", o.Host, o.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	nc.SubscribeSync("bar")
+	nc.SubscribeSync("baz")
+	nc.Flush()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/accountz", s.MonitorAddr().Port)
+	for mode := 0; mode < 2; mode++ {
+		az := pollAccountz(t, s, mode, url, nil)
+		if az.ID != s.ID() {
+			t.Fatalf("mode=%v - Expected server ID %q, got %q", mode, s.ID(), az.ID)
+		}
+		// A, B and the global account.
+		if az.NumAccounts != 3 || len(az.Accounts) != 3 {
+			t.Fatalf("mode=%v - Expected 3 accounts, got %v", mode, az.NumAccounts)
+		}
+
+		az = pollAccountz(t, s, mode, url+"?acc=A", &AccountzOptions{Account: "A"})
+		if az.NumAccounts != 1 {
+			t.Fatalf("mode=%v - Expected 1 account, got %v", mode, az.NumAccounts)
+		}
+		ai := az.Accounts[0]
+		if ai.Name != "A" || ai.NumConns != 1 || ai.NumLocalConns != 1 || ai.NumSubs != 2 {
+			t.Fatalf("mode=%v - Unexpected account info: %+v", mode, ai)
+		}
+		if ai.Resolver != "config" || ai.Expires != nil {
+			t.Fatalf("mode=%v - Unexpected resolver or expiration: %+v", mode, ai)
+		}
+		if len(ai.Exports) != 2 {
+			t.Fatalf("mode=%v - Expected 2 exports, got %v", mode, len(ai.Exports))
+		}
+		if e := ai.Exports[1]; e.Type != "service" || e.Subject != "req.a" || len(e.Approved) != 1 || e.Approved[0] != "B" {
+			t.Fatalf("mode=%v - Unexpected service export: %+v", mode, e)
+		}
+
+		az = pollAccountz(t, s, mode, url+"?acc=B", &AccountzOptions{Account: "B"})
+		ai = az.Accounts[0]
+		if len(ai.Imports) != 2 {
+			t.Fatalf("mode=%v - Expected 2 imports, got %v", mode, len(ai.Imports))
+		}
+		if im := ai.Imports[0]; im.Type != "stream" || im.Account != "A" || im.Subject != "foo.>" || im.To != "from_a." {
+			t.Fatalf("mode=%v - Unexpected stream import: %+v", mode, im)
+		}
+	}
+
+	// Unknown account
+	readBodyEx(t, url+"?acc=C", http.StatusBadRequest, textPlain)
+	if _, err := s.Accountz(&AccountzOptions{Account: "C"}); err == nil {
+		t.Fatal("Expected error for unknown account")
+	}
+}
+
+func TestMonitorAccountStatz(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		port: -1
+		accounts {
+			A { users [{user: a, password: pwd}] }
+			B { users [{user: b, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, o := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://a:pwd@%s:%d", o.Host, o.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	sub, _ := nc.SubscribeSync("foo")
+	for i := 0; i < 5; i++ {
+		nc.Publish("foo", []byte("hello"))
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := sub.NextMsg(time.Second); err != nil {
+			t.Fatalf("Error receiving msg: %v", err)
+		}
+	}
+
+	stz, err := s.AccountStatz(nil)
+	if err != nil {
+		t.Fatalf("Error on AccountStatz: %v", err)
+	}
+	// Only A has local connections.
+	if len(stz.Accounts) != 1 {
+		t.Fatalf("Expected 1 account, got %v", len(stz.Accounts))
+	}
+	as := stz.Accounts[0]
+	if as.Account != "A" || as.Conns != 1 || as.NumSubs != 1 {
+		t.Fatalf("Unexpected account stat: %+v", as)
+	}
+	if as.Received.Msgs != 5 || as.Received.Bytes != 25 {
+		t.Fatalf("Unexpected received stats: %+v", as.Received)
+	}
+	if as.Sent.Msgs != 5 || as.Sent.Bytes != 25 {
+		t.Fatalf("Unexpected sent stats: %+v", as.Sent)
+	}
+
+	stz, _ = s.AccountStatz(&AccountStatzOptions{Accounts: []string{"B"}, IncludeUnused: true})
+	if len(stz.Accounts) != 1 || stz.Accounts[0].Account != "B" || stz.Accounts[0].Received.Msgs != 0 {
+		t.Fatalf("Unexpected account statz: %+v", stz.Accounts)
+	}
+
+	az, _ := s.Accountz(&AccountzOptions{Account: "A"})
+	if ai := az.Accounts[0]; ai.Received != as.Received || ai.Sent != as.Sent {
+		t.Fatalf("Expected accountz stats to match, got %+v and %+v", ai.Received, ai.Sent)
+	}
+}
+
+func pollLeafz(t *testing.T, s *Server, mode int, url string, opts *LeafzOptions) *Leafz {
+	t.Helper()
+	if mode == 0 {
+		lz := &Leafz{}
+		body := readBody(t, url)
+		if err := json.Unmarshal(body, lz); err != nil {
+			t.Fatalf("Got an error unmarshalling the body: %v\n", err)
+		}
+		return lz
+	}
+	lz, err := s.Leafz(opts)
+	if err != nil {
+		t.Fatalf("Error on Leafz: %v", err)
+	}
+	return lz
+}
+
+func TestMonitorLeafz(t *testing.T) {
+	resetPreviousHTTPConnections()
+
+	ob := DefaultMonitorOptions()
+	ob.LeafNode.Host = "127.0.0.1"
+	ob.LeafNode.Port = -1
+	sb := RunServer(ob)
+	defer sb.Shutdown()
+
+	oa := DefaultOptions()
+	oa.LeafNode.Remotes = []*RemoteLeafOpts{{
+		URL: &url.URL{Scheme: "nats-leaf", Host: fmt.Sprintf("127.0.0.1:%d", ob.LeafNode.Port)},
+	}}
+	sa := RunServer(oa)
+	defer sa.Shutdown()
+
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if n := sb.NumLeafNodes(); n != 1 {
+			return fmt.Errorf("Expected 1 leafnode, got %d", n)
+		}
+		return nil
+	})
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://%s:%d", oa.Host, oa.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	nc.SubscribeSync("foo")
+	nc.SubscribeSync("bar")
+	nc.Flush()
+
+	ncb, err := nats.Connect(fmt.Sprintf("nats://%s:%d", ob.Host, ob.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncb.Close()
+	// The 2 subscriptions plus the loop detection one of sa.
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if n := sb.NumSubscriptions(); n != 3 {
+			return fmt.Errorf("Expected 3 subscriptions, got %d", n)
+		}
+		return nil
+	})
+	ncb.Publish("foo", []byte("hello"))
+	ncb.Flush()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/leafz", sb.MonitorAddr().Port)
+	for pollMode := 0; pollMode < 2; pollMode++ {
+		lz := pollLeafz(t, sb, pollMode, url, nil)
+		if lz.ID != sb.ID() {
+			t.Fatalf("Expected server ID %q, got %q", sb.ID(), lz.ID)
+		}
+		if lz.NumLeafs != 1 || len(lz.Leafs) != 1 {
+			t.Fatalf("Expected 1 leafnode, got %+v", lz)
+		}
+		li := lz.Leafs[0]
+		if li.RemoteID != sa.ID() {
+			t.Fatalf("Expected remote ID %q, got %q", sa.ID(), li.RemoteID)
+		}
+		if li.Account != globalAccountName || li.DidSolicit {
+			t.Fatalf("Unexpected leafnode info: %+v", li)
+		}
+		if li.IP != "127.0.0.1" || li.Port == 0 {
+			t.Fatalf("Unexpected leafnode address: %s:%d", li.IP, li.Port)
+		}
+		if li.NumSubs != 3 || len(li.Subs) != 0 {
+			t.Fatalf("Expected 3 subscriptions without details, got %+v", li)
+		}
+		if li.OutMsgs != 1 || li.OutBytes != 5 {
+			t.Fatalf("Expected 1 message of 5 bytes sent, got %v and %v", li.OutMsgs, li.OutBytes)
+		}
+	}
+
+	url += "?subs=true"
+	for pollMode := 0; pollMode < 2; pollMode++ {
+		lz := pollLeafz(t, sb, pollMode, url, &LeafzOptions{Subscriptions: true})
+		li := lz.Leafs[0]
+		sort.Strings(li.Subs)
+		if len(li.Subs) != 3 || li.Subs[0] != leafNodeLoopDetectionSubjectPrefix+sa.ID() ||
+			li.Subs[1] != "bar" || li.Subs[2] != "foo" {
+			t.Fatalf("Unexpected subscriptions list: %v", li.Subs)
+		}
+	}
+
+	// The soliciting side reports the connection as solicited.
+	lz := pollLeafz(t, sa, 1, "", nil)
+	if lz.NumLeafs != 1 || !lz.Leafs[0].DidSolicit || lz.Leafs[0].RemoteID != sb.ID() {
+		t.Fatalf("Unexpected leafz on soliciting server: %+v", lz.Leafs[0])
+	}
+}
+
+func TestMonitorMetrics(t *testing.T) {
+	resetPreviousHTTPConnections()
+
+	conf := createConfFile(t, []byte(`
+		port: -1
+		http: -1
+		accounts {
+			A { users [{user: a, password: pwd}] }
+			B { users [{user: b, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, o := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://a:pwd@%s:%d", o.Host, o.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	nc.SubscribeSync("foo")
+	nc.SubscribeSync("bar")
+	for i := 0; i < 3; i++ {
+		nc.Publish("foo", []byte("hello"))
+	}
+	nc.Flush()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/metrics", s.MonitorAddr().Port)
+	body := string(readBodyEx(t, url, http.StatusOK, metricsContentType))
+	for _, line := range []string{
+		"# TYPE nats_server_connections gauge",
+		"nats_server_connections 1",
+		"nats_server_subscriptions 2",
+		"nats_server_in_msgs_total 3",
+		"nats_server_out_msgs_total 3",
+		"nats_server_in_bytes_total 15",
+		"nats_server_slow_consumers_total 0",
+		"# TYPE nats_server_account_in_msgs_total counter",
+		`nats_server_account_connections{account="A"} 1`,
+		`nats_server_account_connections{account="B"} 0`,
+		`nats_server_account_subscriptions{account="A"} 2`,
+		`nats_server_account_in_msgs_total{account="A"} 3`,
+		`nats_server_account_out_bytes_total{account="A"} 15`,
+		`nats_server_account_in_msgs_total{account="B"} 0`,
+		fmt.Sprintf(`nats_server_info{server_id="%s",`, s.ID()),
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("Expected %q in metrics:\n%s", line, body)
+		}
+	}
+	for _, name := range []string{"resident_memory_bytes", "goroutines", "heap_alloc_bytes", "gc_total", "uptime_seconds"} {
+		if !strings.Contains(body, "\nnats_server_"+name+" ") {
+			t.Fatalf("Expected %q in metrics:\n%s", name, body)
+		}
+	}
+
+	v, _ := s.Varz(nil)
+	if n := v.HTTPReqStats[MetricsPath]; n != 1 {
+		t.Fatalf("Expected 1 request to %q, got %v", MetricsPath, n)
+	}
+}
+
+func TestMonitorHealthz(t *testing.T) {
+	resetPreviousHTTPConnections()
+
+	o1 := DefaultMonitorOptions()
+	o1.Port = -1
+	o1.HTTPPort = -1
+	o1.Cluster.Name = "A"
+	o1.Cluster.Host = "127.0.0.1"
+	o1.Cluster.Port = -1
+	s1 := RunServer(o1)
+	defer s1.Shutdown()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d%s", s1.MonitorAddr().Port, HealthzPath)
+	checkHealthz := func(query string, status int, reason string) {
+		t.Helper()
+		body := readBodyEx(t, url+query, status, appJSONContent)
+		var hs HealthStatus
+		if err := json.Unmarshal(body, &hs); err != nil {
+			t.Fatalf("Error decoding %q: %v", body, err)
+		}
+		if status == http.StatusOK && (hs.Status != "ok" || hs.Error != "") {
+			t.Fatalf("Unexpected status for %q: %+v", query, hs)
+		} else if status != http.StatusOK && (hs.Status != "unavailable" || !strings.Contains(hs.Error, reason)) {
+			t.Fatalf("Expected error %q for %q, got %+v", reason, query, hs)
+		}
+	}
+	checkHealthz("", http.StatusOK, "")
+	checkHealthz("?live", http.StatusOK, "")
+	checkHealthz("?js-enabled", http.StatusServiceUnavailable, "JetStream is not enabled")
+	checkHealthz("?js-enabled=false", http.StatusOK, "")
+	checkHealthz("?routes", http.StatusServiceUnavailable, "0 cluster peers connected, 1 required")
+	checkHealthz("?resolver", http.StatusServiceUnavailable, "no account resolver configured")
+	readBodyEx(t, url+"?routes=x", http.StatusBadRequest, "text/plain; charset=utf-8")
+
+	o2 := DefaultMonitorOptions()
+	o2.Port = -1
+	o2.HTTPPort = 0
+	o2.Cluster.Name = "A"
+	o2.Cluster.Host = "127.0.0.1"
+	o2.Cluster.Port = -1
+	o2.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", o1.Cluster.Port))
+	s2 := RunServer(o2)
+	defer s2.Shutdown()
+	checkClusterFormed(t, s1, s2)
+	checkHealthz("?routes", http.StatusOK, "")
+	checkHealthz("?routes=2", http.StatusServiceUnavailable, "1 cluster peers connected, 2 required")
+
+	// An unreachable URL resolver.
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ur, err := NewURLAccResolver(hs.URL)
+	if err != nil {
+		t.Fatalf("Error creating resolver: %v", err)
+	}
+	s1.mu.Lock()
+	s1.accResolver = ur
+	s1.mu.Unlock()
+	checkHealthz("?resolver", http.StatusOK, "")
+	hs.Close()
+	checkHealthz("?resolver", http.StatusServiceUnavailable, "account resolver is not reachable")
+	s1.mu.Lock()
+	s1.accResolver = nil
+	s1.ldm = true
+	s1.mu.Unlock()
+	// Still alive, but not ready.
+	checkHealthz("?live", http.StatusOK, "")
+	checkHealthz("", http.StatusServiceUnavailable, "lame duck mode")
+	s1.mu.Lock()
+	s1.ldm = false
+	s1.mu.Unlock()
+
+	// The bad request is not counted.
+	v, _ := s1.Varz(nil)
+	if n := v.HTTPReqStats[HealthzPath]; n != 12 {
+		t.Fatalf("Expected 12 requests, got %v", n)
+	}
+}
+
+func TestConnzFilters(t *testing.T) {
+	resetPreviousHTTPConnections()
+
+	conf := createConfFile(t, []byte(`
+		port: -1
+		http: -1
+		accounts {
+			A { users [{user: a1, password: pwd}, {user: a2, password: pwd}] }
+			B { users [{user: b, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+	s, o := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	connect := func(user, subj string) *nats.Conn {
+		t.Helper()
+		nc, err := nats.Connect(fmt.Sprintf("nats://%s:pwd@%s:%d", user, o.Host, o.Port))
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		nc.SubscribeSync(subj)
+		nc.Flush()
+		return nc
+	}
+	// cids 1 to 4 are open, 5 is closed.
+	for _, c := range []struct{ user, subj string }{
+		{"a1", "foo.bar"}, {"a2", "foo.*"}, {"b", "foo.bar"}, {"a1", "baz"},
+	} {
+		nc := connect(c.user, c.subj)
+		defer nc.Close()
+	}
+	nc := connect("b", "foo.baz")
+	nc.Close()
+	checkClosedConns(t, s, 1, 2*time.Second)
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/connz", s.MonitorAddr().Port)
+	cids := func(c *Connz) []uint64 {
+		var cids []uint64
+		for _, ci := range c.Conns {
+			cids = append(cids, ci.Cid)
+		}
+		return cids
+	}
+	for mode := 0; mode < 2; mode++ {
+		for _, test := range []struct {
+			query string
+			opts  *ConnzOptions
+			cids  []uint64
+		}{
+			{"?acc=A", &ConnzOptions{Account: "A"}, []uint64{1, 2, 4}},
+			{"?acc=B&state=all", &ConnzOptions{Account: "B", State: ConnAll}, []uint64{3, 5}},
+			{"?user=a1", &ConnzOptions{User: "a1"}, []uint64{1, 4}},
+			{"?min_cid=2&max_cid=3", &ConnzOptions{MinCID: 2, MaxCID: 3}, []uint64{2, 3}},
+			{"?filter_subject=foo.bar", &ConnzOptions{FilterSubject: "foo.bar"}, []uint64{1, 2, 3}},
+			{"?filter_subject=foo.>&state=closed", &ConnzOptions{FilterSubject: "foo.>", State: ConnClosed}, []uint64{5}},
+			{"?acc=A&filter_subject=foo.bar", &ConnzOptions{Account: "A", FilterSubject: "foo.bar"}, []uint64{1, 2}},
+			{"?acc=C", &ConnzOptions{Account: "C"}, nil},
+		} {
+			c := pollConz(t, s, mode, url+test.query, test.opts)
+			if got := cids(c); !reflect.DeepEqual(got, test.cids) {
+				t.Fatalf("Expected cids %v for %q, got %v", test.cids, test.query, got)
+			}
+			if c.Total != len(test.cids) {
+				t.Fatalf("Expected total of %v for %q, got %v", len(test.cids), test.query, c.Total)
+			}
+			if test.query == "?acc=A" && c.Conns[0].Account != "A" {
+				t.Fatalf("Unexpected account: %+v", c.Conns[0])
+			}
+		}
+
+		// Cursor based pagination.
+		var all []uint64
+		var after uint64
+		for i := 0; ; i++ {
+			if i > 5 {
+				t.Fatalf("Too many pages: %v", all)
+			}
+			c := pollConz(t, s, mode, fmt.Sprintf("%s?state=all&limit=2&after=%d", url, after),
+				&ConnzOptions{State: ConnAll, Limit: 2, After: after})
+			if c.Total != 5 {
+				t.Fatalf("Expected total of 5, got %v", c.Total)
+			}
+			all = append(all, cids(c)...)
+			if c.Next == 0 {
+				break
+			}
+			after = c.Next
+		}
+		if !reflect.DeepEqual(all, []uint64{1, 2, 3, 4, 5}) {
+			t.Fatalf("Unexpected cids: %v", all)
+		}
+	}
+
+	if _, err := s.Connz(&ConnzOptions{Sort: ByOutMsgs, After: 1}); err == nil {
+		t.Fatal("Expected an error for a cursor when not sorting by cid")
+	}
+	readBodyEx(t, url+"?filter_subject=foo..bar", http.StatusBadRequest, "text/plain; charset=utf-8")
+}
+
+func TestSubszAccountAndFilter(t *testing.T) {
+	resetPreviousHTTPConnections()
+
+	conf := createConfFile(t, []byte(`
+		port: -1
+		http: -1
+		accounts {
+			A { users [{user: a, password: pwd}] }
+			B { users [{user: b, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+	s, o := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	connect := func(user string, subjects ...string) *nats.Conn {
+		t.Helper()
+		nc, err := nats.Connect(fmt.Sprintf("nats://%s:pwd@%s:%d", user, o.Host, o.Port))
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		for _, subj := range subjects {
+			nc.QueueSubscribeSync(subj, "q")
+		}
+		nc.Flush()
+		return nc
+	}
+	nca := connect("a", "foo.bar", "foo.*", "baz")
+	defer nca.Close()
+	ncb := connect("b", "foo.bar")
+	defer ncb.Close()
+	nca.Publish("foo.bar", []byte("hello"))
+	nca.Flush()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/subsz?subs=1", s.MonitorAddr().Port)
+	for mode := 0; mode < 2; mode++ {
+		sl := pollSubsz(t, s, mode, url+"&acc=A", &SubszOptions{Subscriptions: true, Account: "A"})
+		if sl.NumSubs != 3 || len(sl.Subs) != 3 {
+			t.Fatalf("Expected 3 subscriptions, got %+v", sl)
+		}
+		for i, subj := range []string{"foo.bar", "foo.*", "baz"} {
+			sd := sl.Subs[i]
+			if sd.Subject != subj || sd.Account != "A" || sd.Queue != "q" || sd.Sid != fmt.Sprintf("%d", i+1) {
+				t.Fatalf("Unexpected subscription: %+v", sd)
+			}
+		}
+		if sl.Subs[0].Msgs+sl.Subs[1].Msgs == 0 {
+			t.Fatalf("Expected the messages delivered to be counted, got %+v", sl.Subs)
+		}
+		if sl.NumLevels != 2 || sl.NumWildcards != 1 || sl.NumLiterals != 2 {
+			t.Fatalf("Unexpected stats: %+v", sl.SublistStats)
+		}
+
+		sl = pollSubsz(t, s, mode, url+"&acc=A&filter_subject=foo.>", &SubszOptions{Subscriptions: true, Account: "A", FilterSubject: "foo.>"})
+		if len(sl.Subs) != 2 || sl.Subs[0].Subject != "foo.bar" || sl.Subs[1].Subject != "foo.*" {
+			t.Fatalf("Unexpected subscriptions: %+v", sl.Subs)
+		}
+		sl = pollSubsz(t, s, mode, url+"&acc=A&filter_subject=foo.bar&offset=1", &SubszOptions{Subscriptions: true, Account: "A", FilterSubject: "foo.bar", Offset: 1})
+		if len(sl.Subs) != 1 || sl.Subs[0].Subject != "foo.*" {
+			t.Fatalf("Unexpected subscriptions: %+v", sl.Subs)
+		}
+
+		sl = pollSubsz(t, s, mode, url+"&acc=B", &SubszOptions{Subscriptions: true, Account: "B"})
+		if sl.NumSubs != 1 || len(sl.Subs) != 1 || sl.Subs[0].Account != "B" || sl.Subs[0].Cid != 2 {
+			t.Fatalf("Unexpected subscriptions: %+v", sl.Subs)
+		}
+		if sl.NumLevels != 2 || sl.NumWildcards != 0 || sl.NumLiterals != 1 {
+			t.Fatalf("Unexpected stats: %+v", sl.SublistStats)
+		}
+	}
+	readBodyEx(t, url+"&acc=C", http.StatusBadRequest, textPlain)
+	readBodyEx(t, url+"&filter_subject=foo..bar", http.StatusBadRequest, textPlain)
+}
+
+func TestMonitorGatewayzConfiguredNotConnected(t *testing.T) {
+	resetPreviousHTTPConnections()
+
+	ob := testDefaultOptionsForGateway("B")
+	sb := runGatewayServer(ob)
+	defer sb.Shutdown()
+
+	// C is configured but never started.
+	oa := testGatewayOptionsFromToWithServers(t, "A", "B", sb)
+	testAddGatewayURLs(t, oa, "C", []string{"nats://127.0.0.1:1234"})
+	oa.HTTPHost = "127.0.0.1"
+	oa.HTTPPort = -1
+	sa := runGatewayServer(oa)
+	defer sa.Shutdown()
+	waitForOutboundGateways(t, sa, 1, 2*time.Second)
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/gatewayz", sa.MonitorAddr().Port)
+	for pollMode := 0; pollMode < 2; pollMode++ {
+		g := pollGatewayz(t, sa, pollMode, url+"?accs=1", &GatewayzOptions{Accounts: true})
+		if n := len(g.OutboundGateways); n != 2 {
+			t.Fatalf("mode=%v - Expected 2 outbound gateways, got %v", pollMode, n)
+		}
+		if og := g.OutboundGateways["B"]; og == nil || !og.IsConfigured || og.Connection == nil {
+			t.Fatalf("mode=%v - Unexpected outbound gateway B: %+v", pollMode, og)
+		}
+		if og := g.OutboundGateways["C"]; og == nil || !og.IsConfigured || og.Connection != nil || og.Accounts != nil {
+			t.Fatalf("mode=%v - Unexpected outbound gateway C: %+v", pollMode, og)
+		}
+
+		g = pollGatewayz(t, sa, pollMode, url+"?gw_name=C", &GatewayzOptions{Name: "C"})
+		if og := g.OutboundGateways["C"]; len(g.OutboundGateways) != 1 || og == nil || og.Connection != nil {
+			t.Fatalf("mode=%v - Unexpected outbound gateways: %+v", pollMode, g.OutboundGateways)
+		}
+		g = pollGatewayz(t, sa, pollMode, url+"?gw_name=D", &GatewayzOptions{Name: "D"})
+		if len(g.OutboundGateways) != 0 {
+			t.Fatalf("mode=%v - Unexpected outbound gateways: %+v", pollMode, g.OutboundGateways)
+		}
+	}
+}
+
+func TestMonitorJsz(t *testing.T) {
+	resetPreviousHTTPConnections()
+
+	s := RunServer(DefaultMonitorOptions())
+	jsi, _ := s.Jsz(nil)
+	if !jsi.Disabled || jsi.Config != nil {
+		t.Fatalf("Expected JetStream to be reported as disabled: %+v", jsi)
+	}
+	s.Shutdown()
+
+	storeDir, _ := ioutil.TempDir("", "js")
+	defer os.RemoveAll(storeDir)
+	opts := DefaultMonitorOptions()
+	opts.Port = -1
+	opts.HTTPPort = -1
+	opts.JetStream = true
+	opts.StoreDir = storeDir
+	s = RunServer(opts)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, jsClientURL(s))
+	defer nc.Close()
+	jsCreateStream(t, nc, &StreamConfig{Name: "S", Subjects: []string{"foo"}})
+	for i := 0; i < 5; i++ {
+		if ack := jsPublish(t, nc, "foo", "hello"); ack.Error != nil {
+			t.Fatalf("Unexpected ack: %+v", ack)
+		}
+	}
+	jsCreateConsumer(t, nc, "S", &ConsumerConfig{Durable: "C", AckPolicy: AckExplicit})
+
+	jszURL := fmt.Sprintf("http://127.0.0.1:%d%s", s.MonitorAddr().Port, JszPath)
+	for mode := 0; mode < 2; mode++ {
+		get := func(query string) *JSInfo {
+			t.Helper()
+			if mode == 1 {
+				body := readBodyEx(t, jszURL+query, http.StatusOK, appJSONContent)
+				jsi := &JSInfo{}
+				if err := json.Unmarshal(body, jsi); err != nil {
+					t.Fatalf("Error decoding %q: %v", body, err)
+				}
+				return jsi
+			}
+			q, _ := url.ParseQuery(strings.TrimPrefix(query, "?"))
+			jsi, err := s.Jsz(&JSzOptions{
+				Account:  q.Get("acc"),
+				Accounts: q.Get("accounts") == "true",
+				Streams:  q.Get("streams") == "true",
+				Consumer: q.Get("consumers") == "true",
+				Config:   q.Get("config") == "true",
+			})
+			if err != nil {
+				t.Fatalf("Error getting jsz: %v", err)
+			}
+			return jsi
+		}
+
+		jsi := get("")
+		if jsi.Disabled || jsi.Config == nil || jsi.Accounts != 1 || jsi.Streams != 1 || jsi.Consumers != 1 {
+			t.Fatalf("mode=%v - Unexpected jsz: %+v", mode, jsi)
+		}
+		if jsi.Memory == 0 || jsi.Meta != nil || len(jsi.AccountDetails) != 0 {
+			t.Fatalf("mode=%v - Unexpected jsz: %+v", mode, jsi)
+		}
+
+		jsi = get("?accounts=true")
+		if len(jsi.AccountDetails) != 1 {
+			t.Fatalf("mode=%v - Expected one account, got %+v", mode, jsi.AccountDetails)
+		}
+		if ad := jsi.AccountDetails[0]; ad.Name != globalAccountName || ad.JetStreamAccountStats.Streams != 1 || ad.Memory == 0 || len(ad.Streams) != 0 {
+			t.Fatalf("mode=%v - Unexpected account detail: %+v", mode, ad)
+		}
+
+		jsi = get("?streams=true&consumers=true&config=true")
+		if len(jsi.AccountDetails) != 1 || len(jsi.AccountDetails[0].Streams) != 1 {
+			t.Fatalf("mode=%v - Unexpected jsz: %+v", mode, jsi)
+		}
+		sd := jsi.AccountDetails[0].Streams[0]
+		if sd.Name != "S" || sd.State.Msgs != 5 || sd.Config == nil || sd.Config.Name != "S" {
+			t.Fatalf("mode=%v - Unexpected stream detail: %+v", mode, sd)
+		}
+		if len(sd.Consumers) != 1 || sd.Consumers[0].Name != "C" || sd.Consumers[0].NumPending != 5 {
+			t.Fatalf("mode=%v - Unexpected consumer detail: %+v", mode, sd.Consumers)
+		}
+
+		if jsi = get("?acc=NOT_THERE"); len(jsi.AccountDetails) != 0 {
+			t.Fatalf("mode=%v - Unexpected account details: %+v", mode, jsi.AccountDetails)
+		}
+	}
+}
+
+func TestMonitorProfiling(t *testing.T) {
+	resetPreviousHTTPConnections()
+	opts := DefaultMonitorOptions()
+	opts.HTTPPort = -1
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	// Not served unless enabled.
+	profURL := fmt.Sprintf("http://127.0.0.1:%d%sgoroutine?debug=1", s.MonitorAddr().Port, ProfPath)
+	resp, err := http.Get(profURL)
+	if err != nil {
+		t.Fatalf("Error on get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected a %d response, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+	s.Shutdown()
+
+	opts.Prof = ProfOpts{Enabled: true, Username: "admin", Password: "pwd"}
+	s = RunServer(opts)
+	defer s.Shutdown()
+	profURL = fmt.Sprintf("http://127.0.0.1:%d%sgoroutine?debug=1", s.MonitorAddr().Port, ProfPath)
+
+	for _, test := range []struct {
+		user, pass string
+		status     int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"admin", "bad", http.StatusUnauthorized},
+		{"admin", "pwd", http.StatusOK},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, profURL, nil)
+		if test.user != _EMPTY_ {
+			req.SetBasicAuth(test.user, test.pass)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error on get: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Fatalf("Expected a %d response for user %q, got %d", test.status, test.user, resp.StatusCode)
+		}
+		if test.status == http.StatusOK && !bytes.HasPrefix(body, []byte("goroutine profile:")) {
+			t.Fatalf("Unexpected goroutine profile: %q", body)
+		}
+	}
+}
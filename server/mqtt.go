@@ -0,0 +1,1162 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nats-io/nuid"
+)
+
+// MQTT 3.1.1 control packet types, in the high bits of the first byte.
+const (
+	mqttPacketConnect    = byte(0x10)
+	mqttPacketConnAck    = byte(0x20)
+	mqttPacketPub        = byte(0x30)
+	mqttPacketPubAck     = byte(0x40)
+	mqttPacketPubRec     = byte(0x50)
+	mqttPacketPubRel     = byte(0x60)
+	mqttPacketPubComp    = byte(0x70)
+	mqttPacketSub        = byte(0x80)
+	mqttPacketSubAck     = byte(0x90)
+	mqttPacketUnsub      = byte(0xa0)
+	mqttPacketUnsubAck   = byte(0xb0)
+	mqttPacketPing       = byte(0xc0)
+	mqttPacketPingResp   = byte(0xd0)
+	mqttPacketDisconnect = byte(0xe0)
+	mqttPacketMask       = byte(0xf0)
+	mqttPacketFlagMask   = byte(0x0f)
+)
+
+// Flags of the CONNECT packet.
+const (
+	mqttConnFlagReserved     = byte(0x01)
+	mqttConnFlagCleanSession = byte(0x02)
+	mqttConnFlagWill         = byte(0x04)
+	mqttConnFlagWillQoS      = byte(0x18)
+	mqttConnFlagWillRetain   = byte(0x20)
+	mqttConnFlagPassword     = byte(0x40)
+	mqttConnFlagUsername     = byte(0x80)
+)
+
+// Flags of the PUBLISH packet.
+const (
+	mqttPubFlagRetain = byte(0x01)
+	mqttPubFlagQoS    = byte(0x06)
+	mqttPubFlagDup    = byte(0x08)
+)
+
+// Return codes of the CONNACK packet.
+const (
+	mqttConnAckAccepted             = byte(0x00)
+	mqttConnAckUnacceptableProtocol = byte(0x01)
+	mqttConnAckIdentifierRejected   = byte(0x02)
+	mqttConnAckBadUserOrPassword    = byte(0x04)
+	mqttConnAckNotAuthorized        = byte(0x05)
+)
+
+const (
+	mqttProtoName  = "MQTT"
+	mqttProtoLevel = byte(0x04)
+
+	// Return code of a refused subscription in a SUBACK.
+	mqttSubAckFailure = byte(0x80)
+
+	// Default maximum of unacknowledged QoS 1 messages of a session.
+	mqttDefaultMaxAckPending = 1024
+
+	// Largest remaining length of a packet, on 4 bytes.
+	mqttMaxRemainingLength = 268435455
+)
+
+var (
+	errMQTTMalformedPacket = errors.New("malformed MQTT packet")
+	errMQTTNotConnected    = errors.New("MQTT packet received before CONNECT")
+	errMQTTQoS2            = errors.New("MQTT QoS 2 is not supported")
+)
+
+// MQTT state of a client connection.
+type mqtt struct {
+	// Bytes of a packet not received entirely yet.
+	buf []byte
+	// Client identifier, set once connected.
+	cid       string
+	keepAlive time.Duration
+	will      *mqttWill
+	acc       *mqttAccount
+	sess      *mqttSession
+	// Set when the client sent DISCONNECT, its will is then discarded.
+	disconnected bool
+}
+
+type mqttWill struct {
+	topic   string
+	subject string
+	msg     []byte
+	qos     byte
+	retain  bool
+}
+
+// MQTT state of the server, by account name.
+type srvMQTT struct {
+	mu       sync.Mutex
+	accounts map[string]*mqttAccount
+}
+
+// MQTT state of an account. Sessions and retained messages are kept in
+// memory, they do not survive a restart of the server.
+type mqttAccount struct {
+	mu sync.Mutex
+	// Internal client owning the subscriptions of the sessions, so that
+	// they outlive the connections, and publishing the wills.
+	c        *client
+	sid      int
+	sessions map[string]*mqttSession
+	// Retained messages by subject.
+	retained map[string]*mqttRetained
+	maxp     int
+}
+
+type mqttRetained struct {
+	topic string
+	msg   []byte
+	qos   byte
+}
+
+type mqttSession struct {
+	id    string
+	clean bool
+	// Connection of the client, nil while disconnected.
+	c    *client
+	subs map[string]*mqttSub
+	// QoS 1 messages not acknowledged yet, by packet identifier.
+	pending map[uint16]*mqttPending
+	lpi     uint16
+	seq     uint64
+}
+
+type mqttSub struct {
+	qos  byte
+	subs []*subscription
+}
+
+type mqttPending struct {
+	seq    uint64
+	topic  string
+	msg    []byte
+	retain bool
+}
+
+// This is the MQTT accept loop. This runs as a go-routine.
+func (s *Server) mqttAcceptLoop(ch chan struct{}) {
+	defer func() {
+		if ch != nil {
+			close(ch)
+		}
+	}()
+
+	// Snapshot server options.
+	opts := s.getOpts()
+	mo := &opts.MQTT
+
+	port := mo.Port
+	if port == -1 {
+		port = 0
+	}
+	hp := net.JoinHostPort(mo.Host, strconv.Itoa(port))
+	l, e := net.Listen("tcp", hp)
+	if e != nil {
+		s.Fatalf("Error listening on MQTT port: %d - %v", mo.Port, e)
+		return
+	}
+	s.Noticef("Listening for MQTT clients on %s",
+		net.JoinHostPort(mo.Host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
+
+	s.mu.Lock()
+	// If we have selected a random port...
+	if port == 0 {
+		// Write resolved port back to options.
+		mo.Port = l.Addr().(*net.TCPAddr).Port
+	}
+	s.mqttListener = l
+	s.mu.Unlock()
+
+	// Let them know we are up
+	close(ch)
+	ch = nil
+
+	tmpDelay := ACCEPT_MIN_SLEEP
+
+	for s.isRunning() {
+		conn, err := l.Accept()
+		if err != nil {
+			tmpDelay = s.acceptError("MQTT", err, tmpDelay)
+			continue
+		}
+		tmpDelay = ACCEPT_MIN_SLEEP
+		s.startGoRoutine(func() {
+			s.createMQTTClient(conn)
+			s.grWG.Done()
+		})
+	}
+	s.Debugf("MQTT accept loop exiting..")
+	s.done <- true
+}
+
+// Creates the client of an accepted MQTT connection. The client is
+// authenticated and bound to its account when the CONNECT is received.
+func (s *Server) createMQTTClient(conn net.Conn) *client {
+	// Snapshot server options.
+	opts := s.getOpts()
+
+	tlsConfig := opts.MQTT.TLSConfig
+	if tlsConfig != nil {
+		tc := tls.Server(conn, tlsConfig)
+		tc.SetDeadline(time.Now().Add(secondsToDuration(opts.MQTT.TLSTimeout)))
+		if err := tc.Handshake(); err != nil {
+			s.Debugf("MQTT TLS handshake error from %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return nil
+		}
+		tc.SetDeadline(time.Time{})
+		conn = tc
+	}
+
+	maxPay := int32(opts.MaxPayload)
+	maxSubs := int32(opts.MaxSubs)
+	// For system, maxSubs of 0 means unlimited, so re-adjust here.
+	if maxSubs == 0 {
+		maxSubs = -1
+	}
+	now := time.Now()
+
+	c := &client{srv: s, nc: conn, opts: clientOpts{Echo: true}, mpay: maxPay, msubs: maxSubs, start: now, last: now, mqtt: &mqtt{}}
+
+	c.registerWithAccount(s.globalAccount())
+
+	s.mu.Lock()
+	s.totalClients++
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.initClient()
+	if tlsConfig != nil {
+		c.flags.set(handshakeComplete)
+	}
+	c.Debugf("MQTT client connection created")
+	c.mu.Unlock()
+
+	// Register with the server.
+	s.mu.Lock()
+	if !s.running || s.ldm {
+		s.mu.Unlock()
+		return c
+	}
+	if opts.MaxConn > 0 && len(s.clients) >= opts.MaxConn {
+		s.mu.Unlock()
+		c.maxConnExceeded()
+		return nil
+	}
+	s.clients[c.cid] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	// The connection may have been closed
+	if c.nc == nil {
+		c.mu.Unlock()
+		return c
+	}
+	// The CONNECT packet has to be received in time.
+	c.setAuthTimer(secondsToDuration(opts.AuthTimeout))
+
+	// Spin up the read loop.
+	s.startGoRoutine(func() { c.readLoop() })
+
+	// Spin up the write loop.
+	s.startGoRoutine(func() { c.writeLoop() })
+
+	c.mu.Unlock()
+
+	return c
+}
+
+// Processes the MQTT packets received by the client. The bytes of an
+// incomplete packet are kept for the next read.
+func (c *client) mqttParse(buf []byte) error {
+	mq := c.mqtt
+	if len(mq.buf) > 0 {
+		buf = append(mq.buf, buf...)
+		mq.buf = nil
+	}
+	for len(buf) >= 2 {
+		rl, n, err := mqttReadVarInt(buf[1:])
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		if max := c.mqttMaxPacketSize(); rl > max {
+			return fmt.Errorf("MQTT packet size %d exceeds maximum of %d", rl, max)
+		}
+		if len(buf) < 1+n+rl {
+			break
+		}
+		b, body := buf[0], buf[1+n:1+n+rl]
+		buf = buf[1+n+rl:]
+		if err := c.mqttProcessPacket(b, body); err != nil {
+			return err
+		}
+		if mq.disconnected {
+			return nil
+		}
+	}
+	if len(buf) > 0 {
+		// The read buffer is reused, keep a copy.
+		mq.buf = append([]byte(nil), buf...)
+	}
+	// The connection is closed if nothing is received within one and a
+	// half times the keep alive interval.
+	if ka := mq.keepAlive; ka > 0 {
+		c.mu.Lock()
+		if c.nc != nil {
+			c.nc.SetReadDeadline(time.Now().Add(ka * 3 / 2))
+		}
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// Returns the largest packet accepted from the client: the maximum
+// payload and room for the topic.
+func (c *client) mqttMaxPacketSize() int {
+	if c.mpay <= 0 || int(c.mpay) > mqttMaxRemainingLength-64*1024 {
+		return mqttMaxRemainingLength
+	}
+	return int(c.mpay) + 64*1024
+}
+
+func (c *client) mqttProcessPacket(b byte, body []byte) error {
+	ptype, flags := b&mqttPacketMask, b&mqttPacketFlagMask
+	if ptype == mqttPacketConnect {
+		if c.mqtt.sess != nil {
+			return fmt.Errorf("MQTT second CONNECT packet")
+		}
+		return c.mqttProcessConnect(body)
+	}
+	if c.mqtt.sess == nil {
+		return errMQTTNotConnected
+	}
+	switch ptype {
+	case mqttPacketPub:
+		return c.mqttProcessPublish(flags, body)
+	case mqttPacketPubAck:
+		return c.mqttProcessPubAck(body)
+	case mqttPacketPubRec, mqttPacketPubRel, mqttPacketPubComp:
+		return errMQTTQoS2
+	case mqttPacketSub:
+		if flags != 0x02 {
+			return errMQTTMalformedPacket
+		}
+		return c.mqttProcessSubscribe(body)
+	case mqttPacketUnsub:
+		if flags != 0x02 {
+			return errMQTTMalformedPacket
+		}
+		return c.mqttProcessUnsubscribe(body)
+	case mqttPacketPing:
+		c.mu.Lock()
+		c.mqttEnqueue([]byte{mqttPacketPingResp, 0})
+		c.mu.Unlock()
+	case mqttPacketDisconnect:
+		c.mu.Lock()
+		c.mqtt.disconnected = true
+		c.mu.Unlock()
+		c.closeConnection(ClientClosed)
+	default:
+		return fmt.Errorf("unexpected MQTT packet type %d", ptype>>4)
+	}
+	return nil
+}
+
+func (c *client) mqttProcessConnect(body []byte) error {
+	r := &mqttReader{b: body}
+	proto, err := r.readString()
+	if err != nil {
+		return err
+	}
+	level, err := r.readByte()
+	if err != nil {
+		return err
+	}
+	if proto != mqttProtoName {
+		return fmt.Errorf("unexpected MQTT protocol name %q", proto)
+	}
+	if level != mqttProtoLevel {
+		c.mqttRefuse(mqttConnAckUnacceptableProtocol)
+		return fmt.Errorf("unsupported MQTT protocol level %d", level)
+	}
+	flags, err := r.readByte()
+	if err != nil {
+		return err
+	}
+	ka, err := r.readUint16()
+	if err != nil {
+		return err
+	}
+	if flags&mqttConnFlagReserved != 0 {
+		return errMQTTMalformedPacket
+	}
+	clean := flags&mqttConnFlagCleanSession != 0
+	cid, err := r.readString()
+	if err != nil {
+		return err
+	}
+
+	var will *mqttWill
+	if flags&mqttConnFlagWill != 0 {
+		will = &mqttWill{qos: (flags & mqttConnFlagWillQoS) >> 3, retain: flags&mqttConnFlagWillRetain != 0}
+		if will.topic, err = r.readString(); err != nil {
+			return err
+		}
+		if will.msg, err = r.readBytes(); err != nil {
+			return err
+		}
+		if will.qos > 2 {
+			return errMQTTMalformedPacket
+		}
+		if will.qos == 2 {
+			return errMQTTQoS2
+		}
+		if will.subject, err = mqttTopicToSubject(will.topic); err != nil {
+			return err
+		}
+		// Do not reference the read buffer.
+		will.msg = append([]byte(nil), will.msg...)
+	} else if flags&(mqttConnFlagWillQoS|mqttConnFlagWillRetain) != 0 {
+		return errMQTTMalformedPacket
+	}
+	var user, pass string
+	if flags&mqttConnFlagUsername != 0 {
+		if user, err = r.readString(); err != nil {
+			return err
+		}
+	}
+	if flags&mqttConnFlagPassword != 0 {
+		if flags&mqttConnFlagUsername == 0 {
+			return errMQTTMalformedPacket
+		}
+		p, err := r.readBytes()
+		if err != nil {
+			return err
+		}
+		pass = string(p)
+	}
+
+	if cid == _EMPTY_ {
+		if !clean {
+			c.mqttRefuse(mqttConnAckIdentifierRejected)
+			return fmt.Errorf("MQTT client identifier required for a persistent session")
+		}
+		cid = nuid.Next()
+	}
+
+	srv := c.srv
+	c.mu.Lock()
+	c.opts.Username, c.opts.Password = user, pass
+	c.opts.Name = cid
+	c.mu.Unlock()
+
+	if !c.mqttAuthenticate(user, pass) {
+		rc := mqttConnAckNotAuthorized
+		if user != _EMPTY_ {
+			rc = mqttConnAckBadUserOrPassword
+		}
+		c.mqttRefuse(rc)
+		c.authViolation()
+		return ErrAuthentication
+	}
+
+	c.mu.Lock()
+	if c.acc == nil {
+		c.mu.Unlock()
+		c.registerWithAccount(srv.gacc)
+		c.mu.Lock()
+	}
+	acc := c.acc
+	willAllowed := will == nil || c.perms == nil || c.pubAllowed(will.subject)
+	c.mu.Unlock()
+	if !willAllowed {
+		c.mqttRefuse(mqttConnAckNotAuthorized)
+		c.Errorf("Publish Violation - %s, will topic %q", c.getAuthUser(), will.topic)
+		c.closeConnection(AuthenticationViolation)
+		return ErrAuthentication
+	}
+
+	c.mu.Lock()
+	c.clearAuthTimer()
+	c.flags.set(connectReceived)
+	c.mqtt.cid = cid
+	c.mqtt.keepAlive = time.Duration(ka) * time.Second
+	c.mqtt.will = will
+	c.mu.Unlock()
+
+	srv.accountConnectEvent(c)
+
+	mqa := srv.mqttAccount(acc)
+	if old := mqa.connect(c, cid, clean); old != nil {
+		old.Debugf("MQTT client %q connected again", cid)
+		old.closeConnection(DuplicateClientID)
+	}
+	return nil
+}
+
+// Authenticates the client with the credentials of its CONNECT. The
+// connections without credentials are bound to the MQTT no auth user
+// when there is one.
+func (c *client) mqttAuthenticate(user, pass string) bool {
+	s := c.srv
+	if noAuthUser := s.getOpts().MQTT.NoAuthUser; noAuthUser != _EMPTY_ && user == _EMPTY_ && pass == _EMPTY_ {
+		s.mu.Lock()
+		u, ok := s.users[noAuthUser]
+		s.mu.Unlock()
+		if ok {
+			c.RegisterUser(u)
+			return true
+		}
+	}
+	return s.checkAuthentication(c)
+}
+
+// Sends a CONNACK refusing the connection.
+func (c *client) mqttRefuse(rc byte) {
+	c.mu.Lock()
+	c.mqttEnqueue([]byte{mqttPacketConnAck, 2, 0, rc})
+	c.mu.Unlock()
+}
+
+func (c *client) mqttProcessPublish(flags byte, body []byte) error {
+	qos := (flags & mqttPubFlagQoS) >> 1
+	if qos > 2 {
+		return errMQTTMalformedPacket
+	}
+	if qos == 2 {
+		return errMQTTQoS2
+	}
+	r := &mqttReader{b: body}
+	topic, err := r.readString()
+	if err != nil {
+		return err
+	}
+	var pi uint16
+	if qos > 0 {
+		if pi, err = r.readUint16(); err != nil {
+			return err
+		}
+		if pi == 0 {
+			return errMQTTMalformedPacket
+		}
+	}
+	payload := r.b
+	subject, err := mqttTopicToSubject(topic)
+	if err != nil {
+		return err
+	}
+	if c.mpay > 0 && len(payload) > int(c.mpay) {
+		c.maxPayloadViolation(len(payload), c.mpay)
+		return ErrMaxPayload
+	}
+
+	c.mu.Lock()
+	allowed := c.perms == nil || c.pubAllowed(subject)
+	mqa := c.mqtt.acc
+	c.mu.Unlock()
+	if flags&mqttPubFlagRetain != 0 && allowed {
+		mqa.retain(subject, topic, payload, qos)
+	}
+
+	c.pa.subject = []byte(subject)
+	c.pa.reply = nil
+	c.pa.size = len(payload)
+	c.pa.szb = []byte(strconv.Itoa(len(payload)))
+	c.pa.hdr, c.pa.hdb = 0, nil
+	msg := make([]byte, 0, len(payload)+LEN_CR_LF)
+	msg = append(msg, payload...)
+	msg = append(msg, _CRLF_...)
+	c.processInboundClientMsg(msg)
+	c.pa.subject, c.pa.szb = nil, nil
+
+	if qos == 1 {
+		c.mu.Lock()
+		c.mqttEnqueue([]byte{mqttPacketPubAck, 2, byte(pi >> 8), byte(pi)})
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+func (c *client) mqttProcessPubAck(body []byte) error {
+	r := &mqttReader{b: body}
+	pi, err := r.readUint16()
+	if err != nil {
+		return err
+	}
+	mq := c.mqtt
+	mq.acc.mu.Lock()
+	delete(mq.sess.pending, pi)
+	mq.acc.mu.Unlock()
+	return nil
+}
+
+func (c *client) mqttProcessSubscribe(body []byte) error {
+	r := &mqttReader{b: body}
+	pi, err := r.readUint16()
+	if err != nil {
+		return err
+	}
+	type filter struct {
+		filter   string
+		subjects []string
+		qos      byte
+	}
+	var filters []*filter
+	for len(r.b) > 0 {
+		f, err := r.readString()
+		if err != nil {
+			return err
+		}
+		qos, err := r.readByte()
+		if err != nil {
+			return err
+		}
+		if qos > 2 {
+			return errMQTTMalformedPacket
+		}
+		// QoS 2 subscriptions are granted QoS 1.
+		if qos > 1 {
+			qos = 1
+		}
+		subjects, err := mqttFilterToSubjects(f)
+		if err != nil {
+			c.Debugf("Invalid MQTT topic filter %q: %v", f, err)
+		}
+		filters = append(filters, &filter{f, subjects, qos})
+	}
+	if len(filters) == 0 {
+		return errMQTTMalformedPacket
+	}
+
+	// Check the permissions first.
+	c.mu.Lock()
+	for _, f := range filters {
+		for _, subj := range f.subjects {
+			if !c.canSubscribe(subj) {
+				c.Errorf("Subscription Violation - %s, Subject %q", c.getAuthUser(), subj)
+				f.subjects = nil
+				break
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	mq := c.mqtt
+	mqa := mq.acc
+	mqa.mu.Lock()
+	defer mqa.mu.Unlock()
+	ack := make([]byte, 0, 2+len(filters))
+	ack = append(ack, byte(pi>>8), byte(pi))
+	var granted []*filter
+	for _, f := range filters {
+		if len(f.subjects) == 0 || mqa.subscribe(mq.sess, f.filter, f.subjects, f.qos) != nil {
+			ack = append(ack, mqttSubAckFailure)
+			continue
+		}
+		ack = append(ack, f.qos)
+		granted = append(granted, f)
+	}
+	c.mu.Lock()
+	c.mqttEnqueue(mqttPacket(mqttPacketSubAck, ack))
+	c.mu.Unlock()
+
+	// The retained messages matching the filters follow the SUBACK.
+	for _, f := range granted {
+		mqa.sendRetained(mq.sess, f.filter, f.subjects, f.qos)
+	}
+	return nil
+}
+
+func (c *client) mqttProcessUnsubscribe(body []byte) error {
+	r := &mqttReader{b: body}
+	pi, err := r.readUint16()
+	if err != nil {
+		return err
+	}
+	var filters []string
+	for len(r.b) > 0 {
+		f, err := r.readString()
+		if err != nil {
+			return err
+		}
+		filters = append(filters, f)
+	}
+	if len(filters) == 0 {
+		return errMQTTMalformedPacket
+	}
+	mq := c.mqtt
+	mq.acc.mu.Lock()
+	for _, f := range filters {
+		mq.acc.unsubscribe(mq.sess, f)
+	}
+	mq.acc.mu.Unlock()
+	c.mu.Lock()
+	c.mqttEnqueue([]byte{mqttPacketUnsubAck, 2, byte(pi >> 8), byte(pi)})
+	c.mu.Unlock()
+	return nil
+}
+
+// Queues a packet for the client. Lock should be held.
+func (c *client) mqttEnqueue(pkt []byte) {
+	if c.nc == nil {
+		return
+	}
+	c.queueOutbound(pkt)
+	c.flushSignal()
+}
+
+// Called when the connection of an MQTT client is closed: the session is
+// detached, or removed if not persistent, and the will is published
+// unless the client disconnected gracefully.
+func (s *Server) mqttClosed(c *client) {
+	c.mu.Lock()
+	mq := c.mqtt
+	will, sess, mqa := mq.will, mq.sess, mq.acc
+	if mq.disconnected {
+		will = nil
+	}
+	c.mu.Unlock()
+	if sess == nil {
+		return
+	}
+	mqa.mu.Lock()
+	if sess.c == c {
+		sess.c = nil
+		if sess.clean {
+			mqa.removeSession(sess)
+		}
+	}
+	mqa.mu.Unlock()
+	if will != nil {
+		if will.retain {
+			mqa.retain(will.subject, will.topic, will.msg, will.qos)
+		}
+		mqa.c.publishInternal(will.subject, _EMPTY_, nil, will.msg)
+	}
+}
+
+// Returns the MQTT state of the account, creating it if needed.
+func (s *Server) mqttAccount(acc *Account) *mqttAccount {
+	s.mqtt.mu.Lock()
+	defer s.mqtt.mu.Unlock()
+	if s.mqtt.accounts == nil {
+		s.mqtt.accounts = make(map[string]*mqttAccount)
+	}
+	mqa := s.mqtt.accounts[acc.Name]
+	if mqa == nil {
+		c := s.createInternalJetStreamClient(acc)
+		// The wills are delivered to the sessions of the account.
+		c.echo = true
+		mqa = &mqttAccount{
+			c:        c,
+			sessions: make(map[string]*mqttSession),
+			retained: make(map[string]*mqttRetained),
+			maxp:     s.getOpts().MQTT.MaxAckPending,
+		}
+		s.mqtt.accounts[acc.Name] = mqa
+	}
+	return mqa
+}
+
+// Attaches the connection to the session of the client identifier,
+// creating it if needed, and sends the CONNACK followed by the messages
+// of the session not acknowledged yet. Returns the connection the session
+// was attached to, if any.
+func (mqa *mqttAccount) connect(c *client, cid string, clean bool) *client {
+	mqa.mu.Lock()
+	defer mqa.mu.Unlock()
+	sess := mqa.sessions[cid]
+	var old *client
+	if sess != nil {
+		old = sess.c
+		if clean || sess.clean {
+			mqa.removeSession(sess)
+			sess = nil
+		}
+	}
+	present := sess != nil
+	if sess == nil {
+		sess = &mqttSession{
+			id:      cid,
+			clean:   clean,
+			subs:    make(map[string]*mqttSub),
+			pending: make(map[uint16]*mqttPending),
+		}
+		mqa.sessions[cid] = sess
+	}
+	sess.c = c
+
+	c.mu.Lock()
+	c.mqtt.acc, c.mqtt.sess = mqa, sess
+	var flags byte
+	if present {
+		flags = 1
+	}
+	c.mqttEnqueue([]byte{mqttPacketConnAck, 2, flags, mqttConnAckAccepted})
+	// Send again the messages not acknowledged, in order.
+	pending := make([]uint16, 0, len(sess.pending))
+	for pi := range sess.pending {
+		pending = append(pending, pi)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return sess.pending[pending[i]].seq < sess.pending[pending[j]].seq
+	})
+	for _, pi := range pending {
+		pm := sess.pending[pi]
+		c.mqttEnqueue(mqttPublishPacket(pi, 1, pm.retain, true, pm.topic, pm.msg))
+	}
+	c.mu.Unlock()
+	return old
+}
+
+// Removes the session and its subscriptions. Lock should be held.
+func (mqa *mqttAccount) removeSession(sess *mqttSession) {
+	for filter := range sess.subs {
+		mqa.unsubscribe(sess, filter)
+	}
+	if mqa.sessions[sess.id] == sess {
+		delete(mqa.sessions, sess.id)
+	}
+}
+
+// Subscribes the session to the subjects of the filter, or updates the
+// QoS of an existing subscription. Lock should be held.
+func (mqa *mqttAccount) subscribe(sess *mqttSession, filter string, subjects []string, qos byte) error {
+	if ms := sess.subs[filter]; ms != nil {
+		ms.qos = qos
+		return nil
+	}
+	ms := &mqttSub{qos: qos}
+	cb := func(_ *subscription, subject, _ string, _, msg []byte) {
+		mqa.deliver(sess, filter, subject, msg)
+	}
+	for _, subj := range subjects {
+		mqa.sid++
+		sub, err := mqa.c.subscribeInternal(subj, mqa.sid, cb)
+		if err != nil {
+			for _, sub := range ms.subs {
+				mqa.c.processUnsub(sub.sid)
+			}
+			return err
+		}
+		ms.subs = append(ms.subs, sub)
+	}
+	sess.subs[filter] = ms
+	return nil
+}
+
+// Lock should be held.
+func (mqa *mqttAccount) unsubscribe(sess *mqttSession, filter string) {
+	ms := sess.subs[filter]
+	if ms == nil {
+		return
+	}
+	for _, sub := range ms.subs {
+		mqa.c.processUnsub(sub.sid)
+	}
+	delete(sess.subs, filter)
+}
+
+// Delivers a message received by a subscription of the session. Messages
+// are delivered with the QoS of the subscription, NATS messages having
+// none.
+func (mqa *mqttAccount) deliver(sess *mqttSession, filter, subject string, msg []byte) {
+	if !mqttFilterMatches(filter, subject) {
+		return
+	}
+	mqa.mu.Lock()
+	defer mqa.mu.Unlock()
+	ms := sess.subs[filter]
+	if ms == nil {
+		return
+	}
+	mqa.send(sess, mqttSubjectToTopic(subject), msg, ms.qos, false)
+}
+
+// Sends the retained messages matching the subjects of the filter.
+// Lock should be held.
+func (mqa *mqttAccount) sendRetained(sess *mqttSession, filter string, subjects []string, qos byte) {
+	for subject, rm := range mqa.retained {
+		if !mqttFilterMatches(filter, subject) {
+			continue
+		}
+		for _, subj := range subjects {
+			if matchLiteral(subject, subj) {
+				q := qos
+				if rm.qos < q {
+					q = rm.qos
+				}
+				mqa.send(sess, rm.topic, rm.msg, q, true)
+				break
+			}
+		}
+	}
+}
+
+// Sends a message to the session. QoS 1 messages are kept until
+// acknowledged, those received while the client is disconnected are sent
+// when it connects again. Lock should be held.
+func (mqa *mqttAccount) send(sess *mqttSession, topic string, msg []byte, qos byte, retain bool) {
+	var pi uint16
+	if qos > 0 {
+		if len(sess.pending) >= mqa.maxp {
+			mqa.c.srv.Debugf("MQTT session %q has %d messages pending, dropping message on %q",
+				sess.id, len(sess.pending), topic)
+			return
+		}
+		pi = sess.nextPacketID()
+		sess.seq++
+		sess.pending[pi] = &mqttPending{seq: sess.seq, topic: topic, msg: append([]byte(nil), msg...), retain: retain}
+	}
+	if c := sess.c; c != nil {
+		c.mu.Lock()
+		c.mqttEnqueue(mqttPublishPacket(pi, qos, retain, false, topic, msg))
+		c.mu.Unlock()
+	}
+}
+
+// Returns a packet identifier not in use. Lock should be held.
+func (sess *mqttSession) nextPacketID() uint16 {
+	for {
+		sess.lpi++
+		if sess.lpi == 0 {
+			continue
+		}
+		if _, used := sess.pending[sess.lpi]; !used {
+			return sess.lpi
+		}
+	}
+}
+
+// Stores or, with an empty message, removes the retained message of the subject.
+func (mqa *mqttAccount) retain(subject, topic string, msg []byte, qos byte) {
+	mqa.mu.Lock()
+	defer mqa.mu.Unlock()
+	if len(msg) == 0 {
+		delete(mqa.retained, subject)
+		return
+	}
+	mqa.retained[subject] = &mqttRetained{topic: topic, msg: append([]byte(nil), msg...), qos: qos}
+}
+
+// Converts an MQTT topic name to a NATS subject. The levels of the topic
+// are the tokens of the subject, so they can not be empty or contain
+// dots or spaces.
+func mqttTopicToSubject(topic string) (string, error) {
+	if topic == _EMPTY_ {
+		return _EMPTY_, fmt.Errorf("empty MQTT topic")
+	}
+	levels := strings.Split(topic, "/")
+	for _, l := range levels {
+		if l == _EMPTY_ || strings.ContainsAny(l, ". \t\r\n+#") {
+			return _EMPTY_, fmt.Errorf("MQTT topic %q not supported", topic)
+		}
+	}
+	return strings.Join(levels, tsep), nil
+}
+
+// Converts an MQTT topic filter to the NATS subjects it matches. A
+// filter ending with '#' also matches its parent level: "a/#" matches
+// "a" as well as the topics under it.
+func mqttFilterToSubjects(filter string) ([]string, error) {
+	if filter == _EMPTY_ {
+		return nil, fmt.Errorf("empty MQTT topic filter")
+	}
+	levels := strings.Split(filter, "/")
+	last := len(levels) - 1
+	for i, l := range levels {
+		switch {
+		case l == "+":
+			levels[i] = string(pwc)
+		case l == "#" && i == last:
+			levels[i] = string(fwc)
+		case l == _EMPTY_ || strings.ContainsAny(l, ". \t\r\n+#"):
+			return nil, fmt.Errorf("MQTT topic filter %q not supported", filter)
+		}
+	}
+	subject := strings.Join(levels, tsep)
+	if levels[last] == string(fwc) && last > 0 {
+		return []string{strings.Join(levels[:last], tsep), subject}, nil
+	}
+	return []string{subject}, nil
+}
+
+// Filters starting with a wildcard do not match the topics starting
+// with '$'.
+func mqttFilterMatches(filter, subject string) bool {
+	if (filter[0] == '+' || filter[0] == '#') && strings.HasPrefix(subject, "$") {
+		return false
+	}
+	return true
+}
+
+func mqttSubjectToTopic(subject string) string {
+	return strings.Replace(subject, tsep, "/", -1)
+}
+
+// Returns the remaining length of a packet and the number of bytes it
+// takes, 0 if more bytes are needed.
+func mqttReadVarInt(b []byte) (int, int, error) {
+	v, m := 0, 1
+	for i := 0; i < 4; i++ {
+		if i >= len(b) {
+			return 0, 0, nil
+		}
+		v += int(b[i]&0x7f) * m
+		if b[i]&0x80 == 0 {
+			return v, i + 1, nil
+		}
+		m *= 128
+	}
+	return 0, 0, errMQTTMalformedPacket
+}
+
+func mqttAppendVarInt(b []byte, n int) []byte {
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func mqttPacket(ptype byte, body []byte) []byte {
+	b := make([]byte, 0, 5+len(body))
+	b = append(b, ptype)
+	b = mqttAppendVarInt(b, len(body))
+	return append(b, body...)
+}
+
+func mqttPublishPacket(pi uint16, qos byte, retain, dup bool, topic string, msg []byte) []byte {
+	flags := qos << 1
+	if retain {
+		flags |= mqttPubFlagRetain
+	}
+	if dup {
+		flags |= mqttPubFlagDup
+	}
+	rl := 2 + len(topic) + len(msg)
+	if qos > 0 {
+		rl += 2
+	}
+	b := make([]byte, 0, 5+rl)
+	b = append(b, mqttPacketPub|flags)
+	b = mqttAppendVarInt(b, rl)
+	b = append(b, byte(len(topic)>>8), byte(len(topic)))
+	b = append(b, topic...)
+	if qos > 0 {
+		b = append(b, byte(pi>>8), byte(pi))
+	}
+	return append(b, msg...)
+}
+
+// Reads the fields of a packet body.
+type mqttReader struct {
+	b []byte
+}
+
+func (r *mqttReader) readByte() (byte, error) {
+	if len(r.b) < 1 {
+		return 0, errMQTTMalformedPacket
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v, nil
+}
+
+func (r *mqttReader) readUint16() (uint16, error) {
+	if len(r.b) < 2 {
+		return 0, errMQTTMalformedPacket
+	}
+	v := uint16(r.b[0])<<8 | uint16(r.b[1])
+	r.b = r.b[2:]
+	return v, nil
+}
+
+// Reads bytes prefixed by their length.
+func (r *mqttReader) readBytes() ([]byte, error) {
+	n, err := r.readUint16()
+	if err != nil {
+		return nil, err
+	}
+	if len(r.b) < int(n) {
+		return nil, errMQTTMalformedPacket
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v, nil
+}
+
+// Reads an UTF-8 string prefixed by its length.
+func (r *mqttReader) readString() (string, error) {
+	b, err := r.readBytes()
+	if err != nil {
+		return _EMPTY_, err
+	}
+	if !utf8.Valid(b) || strings.IndexByte(string(b), 0) >= 0 {
+		return _EMPTY_, errMQTTMalformedPacket
+	}
+	return string(b), nil
+}
+
+// Validates the options of the MQTT listener.
+func validateMQTTOptions(o *Options) error {
+	mo := &o.MQTT
+	if mo.Port == 0 {
+		return nil
+	}
+	if mo.MaxAckPending < 0 || mo.MaxAckPending > 0xffff {
+		return fmt.Errorf("mqtt max_ack_pending should be between 1 and %d, got %d", 0xffff, mo.MaxAckPending)
+	}
+	if mo.NoAuthUser == _EMPTY_ {
+		return nil
+	}
+	for _, u := range o.Users {
+		if u.Username == mo.NoAuthUser {
+			return nil
+		}
+	}
+	return fmt.Errorf("mqtt no_auth_user %q not present as user in authorization block or account configuration", mo.NoAuthUser)
+}
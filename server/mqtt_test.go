@@ -0,0 +1,516 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func testMQTTOptions() *Options {
+	o := DefaultOptions()
+	o.MQTT.Host = "127.0.0.1"
+	o.MQTT.Port = -1
+	o.MQTT.MaxAckPending = mqttDefaultMaxAckPending
+	return o
+}
+
+type testMQTTConn struct {
+	t  *testing.T
+	nc net.Conn
+	br *bufio.Reader
+}
+
+type testMQTTConnInfo struct {
+	cid       string
+	clean     bool
+	user      string
+	pass      string
+	will      *mqttWill
+	keepAlive uint16
+}
+
+func testMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// Connects to the MQTT listener and returns the connection with the
+// return code and session present flag of the CONNACK.
+func testMQTTConnect(t *testing.T, o *Options, ci *testMQTTConnInfo) (*testMQTTConn, byte, bool) {
+	t.Helper()
+	nc, err := net.Dial("tcp", net.JoinHostPort(o.MQTT.Host, strconv.Itoa(o.MQTT.Port)))
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	mc := &testMQTTConn{t: t, nc: nc, br: bufio.NewReader(nc)}
+
+	var flags byte
+	if ci.clean {
+		flags |= mqttConnFlagCleanSession
+	}
+	body := testMQTTString(nil, mqttProtoName)
+	body = append(body, mqttProtoLevel, 0, byte(ci.keepAlive>>8), byte(ci.keepAlive))
+	body = testMQTTString(body, ci.cid)
+	if w := ci.will; w != nil {
+		flags |= mqttConnFlagWill | w.qos<<3
+		if w.retain {
+			flags |= mqttConnFlagWillRetain
+		}
+		body = testMQTTString(body, w.topic)
+		body = testMQTTString(body, string(w.msg))
+	}
+	if ci.user != _EMPTY_ {
+		flags |= mqttConnFlagUsername
+		body = testMQTTString(body, ci.user)
+	}
+	if ci.pass != _EMPTY_ {
+		flags |= mqttConnFlagPassword
+		body = testMQTTString(body, ci.pass)
+	}
+	body[7] = flags
+	mc.write(mqttPacket(mqttPacketConnect, body))
+
+	b, ack := mc.read()
+	if b != mqttPacketConnAck || len(ack) != 2 {
+		t.Fatalf("Expected CONNACK, got %x %v", b, ack)
+	}
+	return mc, ack[1], ack[0]&1 != 0
+}
+
+func (mc *testMQTTConn) write(pkt []byte) {
+	mc.t.Helper()
+	if _, err := mc.nc.Write(pkt); err != nil {
+		mc.t.Fatalf("Error on write: %v", err)
+	}
+}
+
+// Returns the first byte and the body of the next packet.
+func (mc *testMQTTConn) read() (byte, []byte) {
+	mc.t.Helper()
+	mc.nc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b, err := mc.br.ReadByte()
+	if err != nil {
+		mc.t.Fatalf("Error on read: %v", err)
+	}
+	rl, m := 0, 1
+	for {
+		d, err := mc.br.ReadByte()
+		if err != nil {
+			mc.t.Fatalf("Error on read: %v", err)
+		}
+		rl += int(d&0x7f) * m
+		if d&0x80 == 0 {
+			break
+		}
+		m *= 128
+	}
+	body := make([]byte, rl)
+	if _, err := io.ReadFull(mc.br, body); err != nil {
+		mc.t.Fatalf("Error on read: %v", err)
+	}
+	return b, body
+}
+
+func (mc *testMQTTConn) expectNothing() {
+	mc.t.Helper()
+	mc.nc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if b, err := mc.br.ReadByte(); err == nil {
+		mc.t.Fatalf("Expected nothing, got packet %x", b)
+	}
+}
+
+func (mc *testMQTTConn) sub(pi uint16, filter string, qos byte) byte {
+	mc.t.Helper()
+	body := []byte{byte(pi >> 8), byte(pi)}
+	body = testMQTTString(body, filter)
+	body = append(body, qos)
+	mc.write(mqttPacket(mqttPacketSub|0x02, body))
+	b, ack := mc.read()
+	if b != mqttPacketSubAck || len(ack) != 3 || ack[0] != byte(pi>>8) || ack[1] != byte(pi) {
+		mc.t.Fatalf("Expected SUBACK, got %x %v", b, ack)
+	}
+	return ack[2]
+}
+
+func (mc *testMQTTConn) pub(pi uint16, topic string, qos byte, retain bool, msg string) {
+	mc.t.Helper()
+	mc.write(mqttPublishPacket(pi, qos, retain, false, topic, []byte(msg)))
+	if qos == 1 {
+		b, ack := mc.read()
+		if b != mqttPacketPubAck || len(ack) != 2 || ack[0] != byte(pi>>8) || ack[1] != byte(pi) {
+			mc.t.Fatalf("Expected PUBACK, got %x %v", b, ack)
+		}
+	}
+}
+
+type testMQTTMsg struct {
+	topic  string
+	msg    string
+	qos    byte
+	pi     uint16
+	retain bool
+	dup    bool
+}
+
+func (mc *testMQTTConn) expectMsg(topic, msg string, qos byte, retain bool) *testMQTTMsg {
+	mc.t.Helper()
+	b, body := mc.read()
+	if b&mqttPacketMask != mqttPacketPub {
+		mc.t.Fatalf("Expected PUBLISH, got %x", b)
+	}
+	r := &mqttReader{b: body}
+	m := &testMQTTMsg{
+		qos:    (b & mqttPubFlagQoS) >> 1,
+		retain: b&mqttPubFlagRetain != 0,
+		dup:    b&mqttPubFlagDup != 0,
+	}
+	m.topic, _ = r.readString()
+	if m.qos > 0 {
+		m.pi, _ = r.readUint16()
+	}
+	m.msg = string(r.b)
+	if m.topic != topic || m.msg != msg || m.qos != qos || m.retain != retain {
+		mc.t.Fatalf("Expected %q %q qos=%d retain=%v, got %+v", topic, msg, qos, retain, m)
+	}
+	return m
+}
+
+func (mc *testMQTTConn) ack(pi uint16) {
+	mc.write([]byte{mqttPacketPubAck, 2, byte(pi >> 8), byte(pi)})
+}
+
+func (mc *testMQTTConn) close() {
+	mc.nc.Close()
+}
+
+func TestMQTTConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		authorization {
+			users [{user: dev, password: pwd}]
+		}
+		mqtt {
+			listen: "127.0.0.1:-1"
+			no_auth_user: dev
+			max_ack_pending: 100
+		}
+	`))
+	defer os.Remove(conf)
+	o, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if o.MQTT.Host != "127.0.0.1" || o.MQTT.Port != -1 || o.MQTT.NoAuthUser != "dev" || o.MQTT.MaxAckPending != 100 {
+		t.Fatalf("Unexpected MQTT options: %+v", o.MQTT)
+	}
+
+	o = testMQTTOptions()
+	o.MQTT.NoAuthUser = "dev"
+	if err := validateOptions(o); err == nil {
+		t.Fatal("Expected an error for an unknown no auth user")
+	}
+	o = testMQTTOptions()
+	o.MQTT.MaxAckPending = 70000
+	if err := validateOptions(o); err == nil {
+		t.Fatal("Expected an error for max ack pending")
+	}
+}
+
+func TestMQTTTopicConversion(t *testing.T) {
+	for _, test := range []struct {
+		topic   string
+		subject string
+	}{
+		{"foo", "foo"},
+		{"foo/bar", "foo.bar"},
+		{"$SYS/x", "$SYS.x"},
+		{"/foo", ""},
+		{"foo//bar", ""},
+		{"foo.bar", ""},
+		{"foo/+", ""},
+	} {
+		subject, err := mqttTopicToSubject(test.topic)
+		if subject != test.subject || (err == nil) != (test.subject != _EMPTY_) {
+			t.Fatalf("Topic %q: expected %q, got %q (%v)", test.topic, test.subject, subject, err)
+		}
+	}
+	for _, test := range []struct {
+		filter   string
+		subjects []string
+	}{
+		{"foo/bar", []string{"foo.bar"}},
+		{"foo/+/bar", []string{"foo.*.bar"}},
+		{"foo/#", []string{"foo", "foo.>"}},
+		{"#", []string{">"}},
+		{"foo/#/bar", nil},
+		{"foo/b+", nil},
+	} {
+		subjects, _ := mqttFilterToSubjects(test.filter)
+		if !reflect.DeepEqual(subjects, test.subjects) {
+			t.Fatalf("Filter %q: expected %q, got %q", test.filter, test.subjects, subjects)
+		}
+	}
+}
+
+func TestMQTTPubSub(t *testing.T) {
+	o := testMQTTOptions()
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	mc, rc, _ := testMQTTConnect(t, o, &testMQTTConnInfo{cid: "sub", clean: true})
+	defer mc.close()
+	if rc != mqttConnAckAccepted {
+		t.Fatalf("Unexpected return code %d", rc)
+	}
+	if qos := mc.sub(1, "foo/+", 2); qos != 1 {
+		t.Fatalf("Expected QoS 1 to be granted, got %d", qos)
+	}
+	if qos := mc.sub(2, "bar/#", 0); qos != 0 {
+		t.Fatalf("Expected QoS 0 to be granted, got %d", qos)
+	}
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://%s:%d", o.Host, o.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	nc.Publish("foo.bar", []byte("hello"))
+	nc.Publish("bar", []byte("parent"))
+	nc.Publish("bar.baz.bat", []byte("child"))
+	nc.Flush()
+
+	m := mc.expectMsg("foo/bar", "hello", 1, false)
+	mc.ack(m.pi)
+	mc.expectMsg("bar", "parent", 0, false)
+	mc.expectMsg("bar/baz/bat", "child", 0, false)
+
+	// Messages of MQTT clients reach NATS subscribers and MQTT sessions.
+	sub, _ := nc.SubscribeSync("foo.>")
+	nc.Flush()
+	pc, _, _ := testMQTTConnect(t, o, &testMQTTConnInfo{cid: "pub", clean: true})
+	defer pc.close()
+	pc.pub(10, "foo/baz", 1, false, "from mqtt")
+	if m, err := sub.NextMsg(time.Second); err != nil || m.Subject != "foo.baz" || string(m.Data) != "from mqtt" {
+		t.Fatalf("Unexpected message %+v: %v", m, err)
+	}
+	m = mc.expectMsg("foo/baz", "from mqtt", 1, false)
+	mc.ack(m.pi)
+
+	// After unsubscribing nothing is received.
+	body := testMQTTString([]byte{0, 3}, "foo/+")
+	mc.write(mqttPacket(mqttPacketUnsub|0x02, body))
+	if b, ack := mc.read(); b != mqttPacketUnsubAck || ack[1] != 3 {
+		t.Fatalf("Expected UNSUBACK, got %x %v", b, ack)
+	}
+	nc.Publish("foo.bar", []byte("hello"))
+	nc.Flush()
+	mc.expectNothing()
+
+	mc.write([]byte{mqttPacketPing, 0})
+	if b, _ := mc.read(); b != mqttPacketPingResp {
+		t.Fatalf("Expected PINGRESP, got %x", b)
+	}
+}
+
+func TestMQTTRetained(t *testing.T) {
+	o := testMQTTOptions()
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	pc, _, _ := testMQTTConnect(t, o, &testMQTTConnInfo{cid: "pub", clean: true})
+	defer pc.close()
+	pc.pub(1, "sensor/1", 1, true, "21")
+	pc.pub(2, "sensor/2", 0, true, "22")
+	pc.pub(3, "sensor/3", 1, true, "23")
+	// An empty message removes the retained one.
+	pc.pub(4, "sensor/3", 1, true, "")
+
+	mc, _, _ := testMQTTConnect(t, o, &testMQTTConnInfo{cid: "sub", clean: true})
+	defer mc.close()
+	mc.sub(1, "sensor/+", 1)
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		b, body := mc.read()
+		r := &mqttReader{b: body}
+		topic, _ := r.readString()
+		got[topic] = b&mqttPubFlagRetain != 0
+	}
+	if !got["sensor/1"] || !got["sensor/2"] {
+		t.Fatalf("Expected 2 retained messages, got %v", got)
+	}
+	mc.expectNothing()
+}
+
+func TestMQTTSessionResume(t *testing.T) {
+	o := testMQTTOptions()
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	mc, _, present := testMQTTConnect(t, o, &testMQTTConnInfo{cid: "dev1"})
+	if present {
+		t.Fatal("Expected no session present")
+	}
+	mc.sub(1, "foo", 1)
+	mc.close()
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://%s:%d", o.Host, o.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	// Wait for the connection to be detached from the session.
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n := s.NumClients(); n != 1 {
+			return fmt.Errorf("%d clients", n)
+		}
+		return nil
+	})
+	nc.Publish("foo", []byte("while away"))
+	nc.Flush()
+
+	mc, _, present = testMQTTConnect(t, o, &testMQTTConnInfo{cid: "dev1"})
+	if !present {
+		t.Fatal("Expected the session to be present")
+	}
+	mc.expectMsg("foo", "while away", 1, false)
+	// Not acknowledged, it is sent again on the next connection.
+	mc.close()
+
+	mc, _, _ = testMQTTConnect(t, o, &testMQTTConnInfo{cid: "dev1"})
+	m := mc.expectMsg("foo", "while away", 1, false)
+	if !m.dup {
+		t.Fatal("Expected the dup flag")
+	}
+	mc.ack(m.pi)
+	// Make sure the acknowledgment is processed.
+	mc.write([]byte{mqttPacketPing, 0})
+	if b, _ := mc.read(); b != mqttPacketPingResp {
+		t.Fatalf("Expected PINGRESP, got %x", b)
+	}
+
+	// A new connection with the same client ID takes over the session.
+	mc2, _, present := testMQTTConnect(t, o, &testMQTTConnInfo{cid: "dev1"})
+	defer mc2.close()
+	if !present {
+		t.Fatal("Expected the session to be present")
+	}
+	mc2.expectNothing()
+	mc.nc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := mc.br.ReadByte(); err == nil {
+		t.Fatal("Expected the first connection to be closed")
+	}
+
+	// A clean session discards the previous one.
+	mc2.close()
+	mc3, _, present := testMQTTConnect(t, o, &testMQTTConnInfo{cid: "dev1", clean: true})
+	defer mc3.close()
+	if present {
+		t.Fatal("Expected no session present")
+	}
+	nc.Publish("foo", []byte("gone"))
+	nc.Flush()
+	mc3.expectNothing()
+}
+
+func TestMQTTWill(t *testing.T) {
+	o := testMQTTOptions()
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	mc, _, _ := testMQTTConnect(t, o, &testMQTTConnInfo{cid: "sub", clean: true})
+	defer mc.close()
+	mc.sub(1, "status/#", 0)
+
+	will := &mqttWill{topic: "status/dev", msg: []byte("offline")}
+	wc, _, _ := testMQTTConnect(t, o, &testMQTTConnInfo{cid: "dev", clean: true, will: will})
+	// A graceful disconnect discards the will.
+	wc.write([]byte{mqttPacketDisconnect, 0})
+	wc.close()
+	mc.expectNothing()
+
+	wc, _, _ = testMQTTConnect(t, o, &testMQTTConnInfo{cid: "dev", clean: true, will: will})
+	wc.close()
+	mc.expectMsg("status/dev", "offline", 0, false)
+}
+
+func TestMQTTAuth(t *testing.T) {
+	o := testMQTTOptions()
+	o.Users = []*User{
+		{Username: "dev", Password: "pwd", Permissions: &Permissions{
+			Publish: &SubjectPermission{Allow: []string{"dev.>"}},
+		}},
+		{Username: "admin", Password: "secret"},
+	}
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	for _, test := range []struct {
+		user, pass string
+		rc         byte
+	}{
+		{"", "", mqttConnAckNotAuthorized},
+		{"dev", "bad", mqttConnAckBadUserOrPassword},
+		{"dev", "pwd", mqttConnAckAccepted},
+	} {
+		mc, rc, _ := testMQTTConnect(t, o, &testMQTTConnInfo{cid: "c", clean: true, user: test.user, pass: test.pass})
+		mc.close()
+		if rc != test.rc {
+			t.Fatalf("User %q: expected return code %d, got %d", test.user, test.rc, rc)
+		}
+	}
+
+	// The will has to be allowed.
+	will := &mqttWill{topic: "other", msg: []byte("x")}
+	mc, rc, _ := testMQTTConnect(t, o, &testMQTTConnInfo{cid: "c", clean: true, user: "dev", pass: "pwd", will: will})
+	mc.close()
+	if rc != mqttConnAckNotAuthorized {
+		t.Fatalf("Expected the will to be refused, got %d", rc)
+	}
+
+	s.Shutdown()
+	o.MQTT.NoAuthUser = "dev"
+	s = RunServer(o)
+	defer s.Shutdown()
+	mc, rc, _ = testMQTTConnect(t, o, &testMQTTConnInfo{cid: "c", clean: true})
+	defer mc.close()
+	if rc != mqttConnAckAccepted {
+		t.Fatalf("Expected no auth user to be accepted, got %d", rc)
+	}
+	sub, _ := nats.Connect(fmt.Sprintf("nats://%s:%d", o.Host, o.Port), nats.UserInfo("admin", "secret"))
+	defer sub.Close()
+	ch := make(chan *nats.Msg, 2)
+	sub.ChanSubscribe(">", ch)
+	sub.Flush()
+	// Messages not allowed by the permissions of the user are dropped.
+	mc.pub(1, "other", 0, false, "denied")
+	mc.pub(2, "dev/x", 1, false, "allowed")
+	select {
+	case m := <-ch:
+		if m.Subject != "dev.x" {
+			t.Fatalf("Unexpected message on %q", m.Subject)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Did not get the message")
+	}
+}
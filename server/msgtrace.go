@@ -0,0 +1,250 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+const (
+	// MsgTraceDest is the header that requests the trace of a message. Its
+	// value is the subject, in the account of the message, that every
+	// server the message goes through sends a MsgTraceEvent to.
+	MsgTraceDest = "Nats-Trace-Dest"
+
+	// Maximum number of trace events waiting to be sent. Events are
+	// dropped if the server can not keep up.
+	msgTraceMaxPending = 1024
+)
+
+// Types of the hops of a traced message.
+const (
+	// MsgTraceIngress is the reception of the message by the server.
+	MsgTraceIngress = "in"
+	// MsgTraceServiceImport is the crossing of a service import.
+	MsgTraceServiceImport = "si"
+	// MsgTraceStreamImport is the crossing of a stream import.
+	MsgTraceStreamImport = "se"
+	// MsgTraceEgress is the delivery of the message to a connection.
+	MsgTraceEgress = "eg"
+)
+
+// MsgTraceEvent is sent to the trace destination of a message by every
+// server the message goes through, with the hops of the message in that
+// server.
+type MsgTraceEvent struct {
+	Server ServerInfo     `json:"server"`
+	Hops   []*MsgTraceHop `json:"hops"`
+}
+
+// MsgTraceHop describes a step of a traced message in a server.
+type MsgTraceHop struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"ts"`
+	Kind       string    `json:"kind,omitempty"`
+	CID        uint64    `json:"cid,omitempty"`
+	Name       string    `json:"name,omitempty"`
+	Account    string    `json:"acc,omitempty"`
+	Subject    string    `json:"subject,omitempty"`
+	MappedFrom string    `json:"mapped_from,omitempty"`
+	Queue      string    `json:"queue,omitempty"`
+}
+
+// The trace of a message in this server.
+type msgTrace struct {
+	acc   *Account // Account the event is sent in.
+	dest  string
+	event *MsgTraceEvent
+	// Account and subject of the message, which change when crossing a
+	// service import.
+	cacc  string
+	csubj string
+}
+
+// A trace event waiting to be sent.
+type msgTraceOut struct {
+	acc  *Account
+	dest string
+	msg  []byte
+}
+
+// Sends the trace events with internal clients of the accounts.
+type msgTracer struct {
+	srv     *Server
+	events  chan *msgTraceOut
+	clients map[*Account]*client
+}
+
+func newMsgTracer(s *Server) *msgTracer {
+	return &msgTracer{
+		srv:     s,
+		events:  make(chan *msgTraceOut, msgTraceMaxPending),
+		clients: make(map[*Account]*client),
+	}
+}
+
+// Returns the kind of the connection as reported in the hops.
+func msgTraceKind(c *client) string {
+	switch c.kind {
+	case CLIENT:
+		return "client"
+	case ROUTER:
+		return "route"
+	case GATEWAY:
+		return "gateway"
+	case LEAF:
+		return "leaf"
+	case SYSTEM:
+		return "internal"
+	}
+	return _EMPTY_
+}
+
+// Starts the trace of an inbound message if its header block has a trace
+// destination, returns nil otherwise.
+func (s *Server) startMsgTrace(c *client, hdr []byte) *msgTrace {
+	// Avoid parsing the headers of every message.
+	if !bytes.Contains(hdr, []byte(MsgTraceDest)) {
+		return nil
+	}
+	dest := getHeader(MsgTraceDest, hdr)
+	if len(dest) == 0 || !IsValidLiteralSubject(string(dest)) {
+		return nil
+	}
+	acc := c.acc
+	if c.kind == ROUTER || c.kind == GATEWAY {
+		name := string(c.pa.account)
+		if name == _EMPTY_ && c.route != nil {
+			name = c.route.accName
+		}
+		acc = nil
+		if v, ok := s.accounts.Load(name); ok {
+			acc = v.(*Account)
+		}
+	}
+	if acc == nil {
+		return nil
+	}
+	// Clients need to be allowed to publish to the destination.
+	if c.kind == CLIENT && c.perms != nil && !c.pubAllowed(string(dest)) {
+		return nil
+	}
+	mt := &msgTrace{
+		acc:   acc,
+		dest:  string(dest),
+		event: &MsgTraceEvent{},
+		cacc:  acc.Name,
+		csubj: string(c.pa.subject),
+	}
+	c.mu.Lock()
+	name := c.connName()
+	c.mu.Unlock()
+	mt.addHop(&MsgTraceHop{
+		Type:    MsgTraceIngress,
+		Kind:    msgTraceKind(c),
+		CID:     c.cid,
+		Name:    name,
+		Account: acc.Name,
+		Subject: string(c.pa.subject),
+	})
+	return mt
+}
+
+func (mt *msgTrace) addHop(hop *MsgTraceHop) {
+	hop.Time = time.Now()
+	mt.event.Hops = append(mt.event.Hops, hop)
+}
+
+// Records the crossing of a service import into the given account, and
+// returns a function that restores the account and subject of the message.
+func (mt *msgTrace) serviceImport(acc *Account, from, to string) func() {
+	hop := &MsgTraceHop{Type: MsgTraceServiceImport, Account: acc.Name, Subject: to}
+	if from != to {
+		hop.MappedFrom = from
+	}
+	mt.addHop(hop)
+	cacc, csubj := mt.cacc, mt.csubj
+	mt.cacc, mt.csubj = acc.Name, to
+	return func() { mt.cacc, mt.csubj = cacc, csubj }
+}
+
+// Records the delivery of the message to the subscription. The subject
+// is the one presented to the subscribers of streams, if any.
+// Lock of the client is held on entry.
+func (mt *msgTrace) delivered(client *client, sub *subscription, deliver []byte) {
+	accName, subject := mt.cacc, mt.csubj
+	if len(deliver) > 0 {
+		subject = string(deliver)
+	}
+	if (client.kind == CLIENT || client.kind == LEAF || client.kind == SYSTEM) && client.acc != nil {
+		accName = client.acc.Name
+	}
+	if im := sub.streamImport(); im != nil && client.kind != ROUTER {
+		hop := &MsgTraceHop{Type: MsgTraceStreamImport, Account: accName, Subject: subject}
+		if im.prefix != _EMPTY_ {
+			hop.Subject = im.prefix + subject
+			hop.MappedFrom = subject
+		}
+		mt.addHop(hop)
+		subject = hop.Subject
+	}
+	mt.addHop(&MsgTraceHop{
+		Type:    MsgTraceEgress,
+		Kind:    msgTraceKind(client),
+		CID:     client.cid,
+		Name:    client.connName(),
+		Account: accName,
+		Subject: subject,
+		Queue:   string(sub.queue),
+	})
+}
+
+// Queues the trace event to be sent to the destination.
+func (s *Server) sendMsgTrace(mt *msgTrace) {
+	s.mu.Lock()
+	mt.event.Server = ServerInfo{Host: s.info.Host, ID: s.info.ID, Version: VERSION}
+	s.mu.Unlock()
+	mt.event.Server.Cluster = s.ClusterName()
+	mt.event.Server.Time = time.Now()
+	b, err := json.Marshal(mt.event)
+	if err != nil {
+		return
+	}
+	select {
+	case s.mtrace.events <- &msgTraceOut{acc: mt.acc, dest: mt.dest, msg: b}:
+	default:
+	}
+}
+
+// Sends the trace events until the server shuts down.
+func (mtr *msgTracer) run() {
+	s := mtr.srv
+	defer s.grWG.Done()
+
+	for {
+		select {
+		case e := <-mtr.events:
+			c := mtr.clients[e.acc]
+			if c == nil {
+				c = s.createInternalJetStreamClient(e.acc)
+				mtr.clients[e.acc] = c
+			}
+			c.publishInternal(e.dest, _EMPTY_, nil, e.msg)
+		case <-s.quitCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func testMsgTraceConn(t *testing.T, o *Options, user string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	nc, err := net.Dial("tcp", net.JoinHostPort(o.Host, strconv.Itoa(o.Port)))
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	br := bufio.NewReader(nc)
+	if l, _ := br.ReadString('\n'); !strings.HasPrefix(l, "INFO ") {
+		t.Fatalf("Expected INFO, got %q", l)
+	}
+	nc.Write([]byte(fmt.Sprintf("CONNECT {\"verbose\":false,\"headers\":true,\"user\":%q,\"pass\":\"pwd\"}\r\nPING\r\n", user)))
+	if l, _ := br.ReadString('\n'); l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q", l)
+	}
+	return nc, br
+}
+
+func testMsgTracePublish(t *testing.T, nc net.Conn, br *bufio.Reader, subject, dest string) {
+	t.Helper()
+	hdr := fmt.Sprintf("NATS/1.0\r\n%s: %s\r\n\r\n", MsgTraceDest, dest)
+	nc.Write([]byte(fmt.Sprintf("HPUB %s %d %d\r\n%shello\r\nPING\r\n", subject, len(hdr), len(hdr)+5, hdr)))
+	if l, _ := br.ReadString('\n'); l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q", l)
+	}
+}
+
+func testMsgTraceEvent(t *testing.T, sub *nats.Subscription) *MsgTraceEvent {
+	t.Helper()
+	msg, err := sub.NextMsg(2 * time.Second)
+	if err != nil {
+		t.Fatalf("Error receiving trace event: %v", err)
+	}
+	e := &MsgTraceEvent{}
+	if err := json.Unmarshal(msg.Data, e); err != nil {
+		t.Fatalf("Error unmarshalling trace event: %v", err)
+	}
+	return e
+}
+
+func checkMsgTraceHops(t *testing.T, e *MsgTraceEvent, expected ...MsgTraceHop) {
+	t.Helper()
+	if len(e.Hops) != len(expected) {
+		t.Fatalf("Expected %d hops, got %d", len(expected), len(e.Hops))
+	}
+	for i, exp := range expected {
+		hop := e.Hops[i]
+		if hop.Type != exp.Type || hop.Kind != exp.Kind || hop.Account != exp.Account ||
+			hop.Subject != exp.Subject || hop.MappedFrom != exp.MappedFrom || hop.Time.IsZero() {
+			t.Fatalf("Unexpected hop %d, expected %+v, got %+v", i, exp, hop)
+		}
+	}
+}
+
+func TestMsgTraceImports(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				users [{user: a, password: pwd}]
+				exports [{stream: "foo.>"}, {service: "req.a"}]
+			}
+			B {
+				users [{user: b, password: pwd}]
+				imports [
+					{stream: {account: A, subject: "foo.>"}, prefix: "from_a"}
+					{service: {account: A, subject: "req.a"}}
+				]
+			}
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, o := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nca := natsConnect(t, fmt.Sprintf("nats://a:pwd@%s:%d", o.Host, o.Port))
+	defer nca.Close()
+	traceA := natsSubSync(t, nca, "trace")
+	natsSubSync(t, nca, "req.a")
+	natsFlush(t, nca)
+
+	ncb := natsConnect(t, fmt.Sprintf("nats://b:pwd@%s:%d", o.Host, o.Port))
+	defer ncb.Close()
+	traceB := natsSubSync(t, ncb, "trace")
+	natsSubSync(t, ncb, "from_a.foo.bar")
+	natsFlush(t, ncb)
+
+	// A message crossing a service import, with the events in the account
+	// of the publisher.
+	pc, pr := testMsgTraceConn(t, o, "b")
+	defer pc.Close()
+	testMsgTracePublish(t, pc, pr, "req.a", "trace")
+	e := testMsgTraceEvent(t, traceB)
+	if e.Server.ID != s.ID() {
+		t.Fatalf("Unexpected server in event: %+v", e.Server)
+	}
+	checkMsgTraceHops(t, e,
+		MsgTraceHop{Type: MsgTraceIngress, Kind: "client", Account: "B", Subject: "req.a"},
+		MsgTraceHop{Type: MsgTraceServiceImport, Account: "A", Subject: "req.a"},
+		MsgTraceHop{Type: MsgTraceEgress, Kind: "client", Account: "A", Subject: "req.a"})
+
+	// A message crossing a stream import with a prefix.
+	pc2, pr2 := testMsgTraceConn(t, o, "a")
+	defer pc2.Close()
+	testMsgTracePublish(t, pc2, pr2, "foo.bar", "trace")
+	checkMsgTraceHops(t, testMsgTraceEvent(t, traceA),
+		MsgTraceHop{Type: MsgTraceIngress, Kind: "client", Account: "A", Subject: "foo.bar"},
+		MsgTraceHop{Type: MsgTraceStreamImport, Account: "B", Subject: "from_a.foo.bar", MappedFrom: "foo.bar"},
+		MsgTraceHop{Type: MsgTraceEgress, Kind: "client", Account: "B", Subject: "from_a.foo.bar"})
+
+	// Messages without the header are not traced.
+	natsPub(t, nca, "foo.bar", []byte("hello"))
+	natsFlush(t, nca)
+	if msg, err := traceA.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected trace event: %s", msg.Data)
+	}
+}
+
+func TestMsgTraceRoutes(t *testing.T) {
+	o1 := DefaultOptions()
+	o1.Cluster.Name = "A"
+	o1.Cluster.Host = "127.0.0.1"
+	o1.Cluster.Port = -1
+	s1 := RunServer(o1)
+	defer s1.Shutdown()
+
+	o2 := DefaultOptions()
+	o2.Cluster.Name = "A"
+	o2.Cluster.Host = "127.0.0.1"
+	o2.Cluster.Port = -1
+	o2.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", o1.Cluster.Port))
+	s2 := RunServer(o2)
+	defer s2.Shutdown()
+	checkClusterFormed(t, s1, s2)
+
+	nc1 := natsConnect(t, fmt.Sprintf("nats://%s:%d", o1.Host, o1.Port))
+	defer nc1.Close()
+	trace := natsSubSync(t, nc1, "trace")
+	natsFlush(t, nc1)
+
+	nc2 := natsConnect(t, fmt.Sprintf("nats://%s:%d", o2.Host, o2.Port), nats.Name("sub"))
+	defer nc2.Close()
+	natsSubSync(t, nc2, "foo")
+	natsFlush(t, nc2)
+	checkExpectedSubs(t, 2, s1, s2)
+
+	pc, pr := testMsgTraceConn(t, o1, _EMPTY_)
+	defer pc.Close()
+	testMsgTracePublish(t, pc, pr, "foo", "trace")
+
+	// Both servers send an event, in any order.
+	events := map[string]*MsgTraceEvent{}
+	for i := 0; i < 2; i++ {
+		e := testMsgTraceEvent(t, trace)
+		events[e.Server.ID] = e
+	}
+	e1, e2 := events[s1.ID()], events[s2.ID()]
+	if e1 == nil || e2 == nil {
+		t.Fatalf("Expected events from both servers, got %+v", events)
+	}
+	checkMsgTraceHops(t, e1,
+		MsgTraceHop{Type: MsgTraceIngress, Kind: "client", Account: globalAccountName, Subject: "foo"},
+		MsgTraceHop{Type: MsgTraceEgress, Kind: "route", Account: globalAccountName, Subject: "foo"})
+	if name := e1.Hops[1].Name; name != s2.ID() {
+		t.Fatalf("Expected the route egress to be named after the remote server, got %q", name)
+	}
+	checkMsgTraceHops(t, e2,
+		MsgTraceHop{Type: MsgTraceIngress, Kind: "route", Account: globalAccountName, Subject: "foo"},
+		MsgTraceHop{Type: MsgTraceEgress, Kind: "client", Account: globalAccountName, Subject: "foo"})
+	if name := e2.Hops[1].Name; name != "sub" {
+		t.Fatalf("Expected the client egress to be named after the client, got %q", name)
+	}
+}
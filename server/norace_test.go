@@ -231,6 +231,117 @@ func TestNoRaceClosedSlowConsumerWriteDeadline(t *testing.T) {
 	checkReason(t, conns[0].Reason, SlowConsumerWriteDeadline)
 }
 
+func TestNoRaceClosedSlowConsumerStalled(t *testing.T) {
+	opts := DefaultOptions()
+	opts.WriteDeadline = 10 * time.Millisecond // Not used with the stall detection.
+	opts.StallTimeout = 250 * time.Millisecond
+	opts.MaxPending = 500 * 1024 * 1024 // Set high so it will not trip here.
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	c, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port), 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("CONNECT {}\r\nPING\r\nSUB foo 1\r\n")); err != nil {
+		t.Fatalf("Error sending protocols to server: %v", err)
+	}
+	c.(*net.TCPConn).SetReadBuffer(128)
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	sender, err := nats.Connect(url)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer sender.Close()
+
+	payload := make([]byte, 1024*1024)
+	for i := 0; i < 100; i++ {
+		if err := sender.Publish("foo", payload); err != nil {
+			t.Fatalf("Error on publish: %v", err)
+		}
+	}
+	if err := sender.Flush(); err != nil {
+		t.Fatalf("Error on flush: %v", err)
+	}
+
+	// The client never reads, so is closed once stalled.
+	checkClosedConns(t, s, 1, 2*time.Second)
+	conns := s.closedClients()
+	if lc := len(conns); lc != 1 {
+		t.Fatalf("len(conns) expected to be %d, got %d\n", 1, lc)
+	}
+	checkReason(t, conns[0].Reason, SlowConsumerStalled)
+}
+
+func TestNoRaceSlowConsumerStallBurstyClient(t *testing.T) {
+	opts := DefaultOptions()
+	opts.WriteDeadline = time.Millisecond // Would trip without the stall detection.
+	opts.StallTimeout = 2 * time.Second
+	opts.MaxPending = 500 * 1024 * 1024
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	c, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port), 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("CONNECT {}\r\nPING\r\nSUB foo 1\r\n")); err != nil {
+		t.Fatalf("Error sending protocols to server: %v", err)
+	}
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	sender, err := nats.Connect(url)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer sender.Close()
+
+	const total = 20
+	payload := make([]byte, 1024*1024)
+
+	// Read slowly, in bursts, the client keeps up and is not closed.
+	errCh := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 256*1024)
+		read := 0
+		c.SetReadDeadline(time.Now().Add(10 * time.Second))
+		for read < total*len(payload) {
+			n, err := c.Read(buf)
+			if err != nil {
+				errCh <- fmt.Errorf("error reading after %d bytes: %v", read, err)
+				return
+			}
+			read += n
+			// Pause now and then so that the server has to wait for the client.
+			if read%(1024*1024) < n {
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+		errCh <- nil
+	}()
+
+	for i := 0; i < total; i++ {
+		if err := sender.Publish("foo", payload); err != nil {
+			t.Fatalf("Error on publish: %v", err)
+		}
+	}
+	if err := sender.Flush(); err != nil {
+		t.Fatalf("Error on flush: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if n := s.NumClients(); n != 2 {
+		t.Fatalf("Expected 2 clients, got %d", n)
+	}
+	if n := atomic.LoadInt64(&s.slowConsumers); n != 0 {
+		t.Fatalf("Expected no slow consumer, got %d", n)
+	}
+}
+
 func TestNoRaceClosedSlowConsumerPendingBytes(t *testing.T) {
 	opts := DefaultOptions()
 	opts.WriteDeadline = 30 * time.Second // Wait for long time so write deadline does not trigger slow consumer.
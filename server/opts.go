@@ -53,6 +53,7 @@ func NoErrOnUnknownFields(noError bool) {
 // NOTE: This structure is no longer used for monitoring endpoints
 // and json tags are deprecated and may be removed in the future.
 type ClusterOpts struct {
+	Name           string            `json:"name,omitempty"`
 	Host           string            `json:"addr,omitempty"`
 	Port           int               `json:"cluster_port,omitempty"`
 	Username       string            `json:"-"`
@@ -66,6 +67,45 @@ type ClusterOpts struct {
 	Advertise      string            `json:"-"`
 	NoAdvertise    bool              `json:"-"`
 	ConnectRetries int               `json:"-"`
+	Compression    string            `json:"-"`
+	PoolSize       int               `json:"-"`
+	Accounts       []string          `json:"-"`
+	DNSRoutes      []*url.URL        `json:"-"`
+	DNSRefresh     time.Duration     `json:"-"`
+	// Proxy the routes are solicited through, HTTP or SOCKS5.
+	Proxy *url.URL `json:"-"`
+
+	// Identity the certificate of a remote route must have, one of each
+	// list if not empty.
+	TLSExpectedSANs []string `json:"-"`
+	TLSExpectedOUs  []string `json:"-"`
+
+	// Reconnect policy for solicited routes.
+	ReconnectInterval   time.Duration `json:"-"`
+	ReconnectJitter     time.Duration `json:"-"`
+	ReconnectMaxBackoff time.Duration `json:"-"`
+
+	// Ping interval and maximum outstanding pings of the routes, the
+	// server wide values are used when not set.
+	PingInterval time.Duration `json:"-"`
+	MaxPingsOut  int           `json:"-"`
+
+	// StallTimeout of the routes, the server wide value is used when not set.
+	StallTimeout time.Duration `json:"-"`
+
+	// Batch frames the messages written to the routes that also support
+	// it in batches, waiting up to BatchDelay for more messages to send.
+	Batch      bool          `json:"-"`
+	BatchDelay time.Duration `json:"-"`
+
+	// LoadHints advertises the load of the servers with the client connect
+	// URLs, exchanged between the servers at LoadHintsInterval.
+	LoadHints         bool          `json:"-"`
+	LoadHintsInterval time.Duration `json:"-"`
+
+	// ConnectURLsOrder is the order of the client connect URLs sent to each
+	// client, as known, shuffled, or weighted by the load of the servers.
+	ConnectURLsOrder string `json:"-"`
 }
 
 // GatewayOpts are options for gateways.
@@ -85,6 +125,12 @@ type GatewayOpts struct {
 	ConnectRetries int                  `json:"connect_retries,omitempty"`
 	Gateways       []*RemoteGatewayOpts `json:"gateways,omitempty"`
 	RejectUnknown  bool                 `json:"reject_unknown,omitempty"`
+	// Proxy the gateways are solicited through, HTTP or SOCKS5.
+	Proxy *url.URL `json:"-"`
+
+	// StallTimeout of the gateway connections, the server wide value is
+	// used when not set.
+	StallTimeout time.Duration `json:"-"`
 
 	// Not exported, for tests.
 	resolver         netResolver
@@ -118,11 +164,157 @@ type LeafNodeOpts struct {
 	NoAdvertise       bool              `json:"-"`
 	ReconnectInterval time.Duration     `json:"-"`
 
+	// Reconnect jitter and maximum backoff for the remotes.
+	ReconnectJitter     time.Duration `json:"-"`
+	ReconnectMaxBackoff time.Duration `json:"-"`
+
+	// Permissions restrict which subjects accepted leafnode connections
+	// can import into and export from the bound account.
+	Permissions *RoutePermissions `json:"-"`
+
+	// Websocket allows accepting leafnode connections over websocket.
+	Websocket LeafNodeWebsocketOpts `json:"-"`
+
+	// Ping interval and maximum outstanding pings of the leafnode
+	// connections, the server wide values are used when not set.
+	PingInterval time.Duration `json:"-"`
+	MaxPingsOut  int           `json:"-"`
+
+	// StallTimeout of the leafnode connections, the server wide value is
+	// used when not set.
+	StallTimeout time.Duration `json:"-"`
+
 	// Not exported, for tests.
 	resolver    netResolver
 	dialTimeout time.Duration
 }
 
+// LeafNodeWebsocketOpts are options for accepting leafnode connections over websocket.
+type LeafNodeWebsocketOpts struct {
+	Host        string      `json:"addr,omitempty"`
+	Port        int         `json:"port,omitempty"`
+	TLSConfig   *tls.Config `json:"-"`
+	TLSTimeout  float64     `json:"tls_timeout,omitempty"`
+	Compression bool        `json:"compression,omitempty"`
+}
+
+// WebsocketOpts are options for accepting client connections over websocket.
+type WebsocketOpts struct {
+	Host      string      `json:"addr,omitempty"`
+	Port      int         `json:"port,omitempty"`
+	TLSConfig *tls.Config `json:"-"`
+	// NoTLS allows the listener without TLS, for instance behind a
+	// proxy terminating it.
+	NoTLS       bool `json:"no_tls,omitempty"`
+	Compression bool `json:"compression,omitempty"`
+	// Browser requests are accepted if their origin is the host of the
+	// request when SameOrigin is set, and one of AllowedOrigins if any.
+	SameOrigin     bool     `json:"same_origin,omitempty"`
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+	// Name of the cookie holding the user JWT of clients that do not
+	// send one in their CONNECT.
+	JWTCookie string `json:"jwt_cookie,omitempty"`
+	// Time allowed for the TLS and websocket handshakes.
+	HandshakeTimeout time.Duration `json:"-"`
+}
+
+// MQTTOpts are options for accepting MQTT client connections.
+type MQTTOpts struct {
+	Host       string      `json:"addr,omitempty"`
+	Port       int         `json:"port,omitempty"`
+	TLSConfig  *tls.Config `json:"-"`
+	TLSTimeout float64     `json:"tls_timeout,omitempty"`
+	// User the connections without credentials are bound to.
+	NoAuthUser string `json:"no_auth_user,omitempty"`
+	// Maximum QoS 1 messages of a session waiting to be acknowledged,
+	// further messages are dropped.
+	MaxAckPending int `json:"max_ack_pending,omitempty"`
+}
+
+// STOMPOpts are options for accepting STOMP client connections.
+type STOMPOpts struct {
+	Host       string      `json:"addr,omitempty"`
+	Port       int         `json:"port,omitempty"`
+	TLSConfig  *tls.Config `json:"-"`
+	TLSTimeout float64     `json:"tls_timeout,omitempty"`
+}
+
+// HTTPBridgeOpts are options for the HTTP endpoint publishing messages
+// and sending requests on behalf of the users.
+type HTTPBridgeOpts struct {
+	Host      string      `json:"addr,omitempty"`
+	Port      int         `json:"port,omitempty"`
+	TLSConfig *tls.Config `json:"-"`
+	// Messages per second accepted for each account, unlimited if 0.
+	RateLimit int `json:"rate_limit,omitempty"`
+	// Messages above the rate accepted in a burst, defaults to the rate.
+	Burst int `json:"burst,omitempty"`
+	// Rates of the accounts not using RateLimit.
+	AccountRateLimits map[string]int `json:"account_rate_limits,omitempty"`
+	// Time waited for the response of a request.
+	RequestTimeout time.Duration `json:"request_timeout,omitempty"`
+}
+
+// OTelOpts are options for exporting the spans of traced messages
+// to an OpenTelemetry collector.
+type OTelOpts struct {
+	// OTLP/HTTP traces endpoint, no span is exported if empty.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Value of the service.name resource attribute.
+	ServiceName string `json:"service_name,omitempty"`
+	// Headers added to the export requests, such as credentials.
+	Headers map[string]string `json:"-"`
+	// Spans are exported at this interval or when the batch is full.
+	FlushInterval time.Duration `json:"flush_interval,omitempty"`
+	BatchSize     int           `json:"batch_size,omitempty"`
+}
+
+// TCPOpts are the socket options of the client connections, the zero
+// value keeps the Go defaults.
+type TCPOpts struct {
+	// Enable Nagle's algorithm, which Go disables by default.
+	Nagle bool `json:"-"`
+	// Sizes of the socket receive and send buffers.
+	ReadBuffer  int `json:"-"`
+	WriteBuffer int `json:"-"`
+	// Idle time before keepalive probes are sent, a negative
+	// value disables them.
+	KeepAlive time.Duration `json:"-"`
+	// Interval and number of the keepalive probes sent before the
+	// connection is considered dead. Only supported on Linux.
+	KeepAliveInterval time.Duration `json:"-"`
+	KeepAliveCount    int           `json:"-"`
+}
+
+// OutboundOpts tune how the data queued for the connections is written to
+// their sockets, the zero value keeps the defaults.
+type OutboundOpts struct {
+	// MaxVectors is the maximum number of buffers given to a single
+	// vectored write, the others being written by the next flush.
+	MaxVectors int `json:"-"`
+	// CoalesceDelay is how long the write loop of a connection waits, once
+	// signaled, for more data to write with the same system call. This
+	// trades latency for throughput, and producers do not flush in place
+	// the connections where it is set.
+	CoalesceDelay time.Duration `json:"-"`
+	// Bounds of the size of the outbound buffers, powers of 2.
+	MinBufferSize int `json:"-"`
+	MaxBufferSize int `json:"-"`
+	// BufferGrowth is how the buffers are resized: "dynamic" to follow the
+	// traffic, "grow" to never shrink them, or "fixed" to always use the
+	// maximum size.
+	BufferGrowth string `json:"-"`
+}
+
+// ProfOpts are options for the profiling endpoints.
+type ProfOpts struct {
+	// Serve the pprof endpoints on the monitoring port.
+	Enabled bool `json:"enabled,omitempty"`
+	// Credentials required by the profiling endpoints, when set.
+	Username string `json:"-"`
+	Password string `json:"-"`
+}
+
 // RemoteLeafOpts are options for connecting to a remote server as a leaf node.
 // NOTE: This structure is no longer used for monitoring endpoints
 // and json tags are deprecated and may be removed in the future.
@@ -133,67 +325,105 @@ type RemoteLeafOpts struct {
 	TLS          bool        `json:"-"`
 	TLSConfig    *tls.Config `json:"-"`
 	TLSTimeout   float64     `json:"tls_timeout,omitempty"`
+
+	// HTTP or SOCKS5 proxy the connection is established through.
+	Proxy *url.URL `json:"-"`
+
+	// Only used for websocket (ws:// or wss://) URLs.
+	Compression bool `json:"compression,omitempty"`
+
+	// Override the leafnode reconnect policy for this remote.
+	ReconnectInterval   time.Duration `json:"-"`
+	ReconnectJitter     time.Duration `json:"-"`
+	ReconnectMaxBackoff time.Duration `json:"-"`
+
+	// Number of attempts for the first connection before giving up,
+	// 0 means that the server keeps trying.
+	ConnectRetries int `json:"-"`
 }
 
 // Options block for nats-server.
 // NOTE: This structure is no longer used for monitoring endpoints
 // and json tags are deprecated and may be removed in the future.
 type Options struct {
-	ConfigFile       string        `json:"-"`
-	Host             string        `json:"addr"`
-	Port             int           `json:"port"`
-	ClientAdvertise  string        `json:"-"`
-	Trace            bool          `json:"-"`
-	Debug            bool          `json:"-"`
-	NoLog            bool          `json:"-"`
-	NoSigs           bool          `json:"-"`
-	Logtime          bool          `json:"-"`
-	MaxConn          int           `json:"max_connections"`
-	MaxSubs          int           `json:"max_subscriptions,omitempty"`
-	Nkeys            []*NkeyUser   `json:"-"`
-	Users            []*User       `json:"-"`
-	Accounts         []*Account    `json:"-"`
-	SystemAccount    string        `json:"-"`
-	AllowNewAccounts bool          `json:"-"`
-	Username         string        `json:"-"`
-	Password         string        `json:"-"`
-	Authorization    string        `json:"-"`
-	PingInterval     time.Duration `json:"ping_interval"`
-	MaxPingsOut      int           `json:"ping_max"`
-	HTTPHost         string        `json:"http_host"`
-	HTTPPort         int           `json:"http_port"`
-	HTTPSPort        int           `json:"https_port"`
-	AuthTimeout      float64       `json:"auth_timeout"`
-	MaxControlLine   int32         `json:"max_control_line"`
-	MaxPayload       int32         `json:"max_payload"`
-	MaxPending       int64         `json:"max_pending"`
-	Cluster          ClusterOpts   `json:"cluster,omitempty"`
-	Gateway          GatewayOpts   `json:"gateway,omitempty"`
-	LeafNode         LeafNodeOpts  `json:"leaf,omitempty"`
-	ProfPort         int           `json:"-"`
-	PidFile          string        `json:"-"`
-	PortsFileDir     string        `json:"-"`
-	LogFile          string        `json:"-"`
-	Syslog           bool          `json:"-"`
-	RemoteSyslog     string        `json:"-"`
-	Routes           []*url.URL    `json:"-"`
-	RoutesStr        string        `json:"-"`
-	TLSTimeout       float64       `json:"tls_timeout"`
-	TLS              bool          `json:"-"`
-	TLSVerify        bool          `json:"-"`
-	TLSMap           bool          `json:"-"`
-	TLSCert          string        `json:"-"`
-	TLSKey           string        `json:"-"`
-	TLSCaCert        string        `json:"-"`
-	TLSConfig        *tls.Config   `json:"-"`
-	WriteDeadline    time.Duration `json:"-"`
-	MaxClosedClients int           `json:"-"`
-	LameDuckDuration time.Duration `json:"-"`
+	ConfigFile       string         `json:"-"`
+	Host             string         `json:"addr"`
+	Port             int            `json:"port"`
+	ClientAdvertise  string         `json:"-"`
+	Trace            bool           `json:"-"`
+	Debug            bool           `json:"-"`
+	NoLog            bool           `json:"-"`
+	NoSigs           bool           `json:"-"`
+	Logtime          bool           `json:"-"`
+	MaxConn          int            `json:"max_connections"`
+	MaxConnPerIP     int            `json:"max_connections_per_ip,omitempty"`
+	MaxConnPerUser   int            `json:"max_connections_per_user,omitempty"`
+	MaxSubs          int            `json:"max_subscriptions,omitempty"`
+	Nkeys            []*NkeyUser    `json:"-"`
+	Users            []*User        `json:"-"`
+	Accounts         []*Account     `json:"-"`
+	SystemAccount    string         `json:"-"`
+	StatszInterval   time.Duration  `json:"-"`
+	AllowNewAccounts bool           `json:"-"`
+	NoAuthUser       string         `json:"-"`
+	Username         string         `json:"-"`
+	Password         string         `json:"-"`
+	Authorization    string         `json:"-"`
+	PingInterval     time.Duration  `json:"ping_interval"`
+	MaxPingsOut      int            `json:"ping_max"`
+	HTTPHost         string         `json:"http_host"`
+	HTTPPort         int            `json:"http_port"`
+	HTTPSPort        int            `json:"https_port"`
+	AuthTimeout      float64        `json:"auth_timeout"`
+	MaxControlLine   int32          `json:"max_control_line"`
+	MaxPayload       int32          `json:"max_payload"`
+	MaxPending       int64          `json:"max_pending"`
+	Cluster          ClusterOpts    `json:"cluster,omitempty"`
+	Gateway          GatewayOpts    `json:"gateway,omitempty"`
+	LeafNode         LeafNodeOpts   `json:"leaf,omitempty"`
+	Websocket        WebsocketOpts  `json:"-"`
+	MQTT             MQTTOpts       `json:"-"`
+	HTTPBridge       HTTPBridgeOpts `json:"-"`
+	STOMP            STOMPOpts      `json:"-"`
+	OTel             OTelOpts       `json:"-"`
+	ProfPort         int            `json:"-"`
+	Prof             ProfOpts       `json:"-"`
+	PidFile          string         `json:"-"`
+	PortsFileDir     string         `json:"-"`
+	PortsFile        string         `json:"-"`
+	LogFile          string         `json:"-"`
+	Syslog           bool           `json:"-"`
+	RemoteSyslog     string         `json:"-"`
+	LogFormat        string         `json:"-"`
+	LogFileFormat    string         `json:"-"`
+	SyslogFormat     string         `json:"-"`
+	SyslogBackend    string         `json:"-"`
+	SyslogName       string         `json:"-"`
+	LogSizeLimit     int64          `json:"-"`
+	LogMaxAge        time.Duration  `json:"-"`
+	LogMaxBackups    int            `json:"-"`
+	LogCompress      bool           `json:"-"`
+	Routes           []*url.URL     `json:"-"`
+	RoutesStr        string         `json:"-"`
+	TLSTimeout       float64        `json:"tls_timeout"`
+	TLS              bool           `json:"-"`
+	TLSVerify        bool           `json:"-"`
+	TLSMap           bool           `json:"-"`
+	TLSCert          string         `json:"-"`
+	TLSKey           string         `json:"-"`
+	TLSCaCert        string         `json:"-"`
+	TLSConfig        *tls.Config    `json:"-"`
+	WriteDeadline    time.Duration  `json:"-"`
+	MaxClosedClients int            `json:"-"`
+	LameDuckDuration time.Duration  `json:"-"`
 
 	// Operating a trusted NATS server
 	TrustedKeys      []string              `json:"-"`
 	TrustedOperators []*jwt.OperatorClaims `json:"-"`
 	AccountResolver  AccountResolver       `json:"-"`
+	// AccountTemplate, when set in operator mode, is used to create
+	// accounts that are unknown to the account resolver.
+	AccountTemplate  *jwt.AccountClaims `json:"-"`
 	resolverPreloads map[string]string
 
 	CustomClientAuthentication Authentication `json:"-"`
@@ -202,6 +432,13 @@ type Options struct {
 	// CheckConfig configuration file syntax test was successful and exit.
 	CheckConfig bool `json:"-"`
 
+	// ShowConfig prints the effective configuration and exit.
+	ShowConfig bool `json:"-"`
+
+	// UnknownFieldsAsWarnings reports unknown configuration fields as
+	// warnings instead of errors.
+	UnknownFieldsAsWarnings bool `json:"-"`
+
 	// ConnectErrorReports specifies the number of failed attempts
 	// at which point server should report the failure of an initial
 	// connection to a route, gateway or leaf node.
@@ -212,6 +449,83 @@ type Options struct {
 	// that this applies to reconnect events.
 	ReconnectErrorReports int
 
+	// AccountErrorThreshold is the number of errors (slow consumers,
+	// permission violations and protocol errors) of an account within
+	// AccountErrorWindow at which point the server sends an account
+	// errors event. A value of zero disables the event.
+	AccountErrorThreshold int
+	AccountErrorWindow    time.Duration
+
+	// JetStream enables the persistence of messages in streams. The
+	// limits are in bytes, a value of zero means unlimited.
+	JetStream          bool   `json:"jetstream"`
+	JetStreamMaxMemory int64  `json:"-"`
+	JetStreamMaxStore  int64  `json:"-"`
+	StoreDir           string `json:"-"`
+	// Encryption of the file based streams, the key can reference an
+	// environment variable.
+	JetStreamCipher  StoreCipher `json:"-"`
+	JetStreamKey     string      `json:"-"`
+	JetStreamPrevKey string      `json:"-"`
+	// Object storage the aged blocks of the streams are offloaded to.
+	JetStreamTier *TierConfig `json:"-"`
+
+	// Tags describe this server, streams can be placed on the servers
+	// matching the tags of their placement.
+	Tags []string `json:"-"`
+
+	// StallTimeout, when set, replaces the write deadline for the detection
+	// of slow consumers: a connection is closed once its pending data has
+	// not been drained below its level for that long, instead of when a
+	// single write takes longer than the write deadline.
+	StallTimeout time.Duration `json:"-"`
+
+	// IdleTimeout, when set, closes the client connections that have not
+	// published, subscribed or received messages for that long. Protocol
+	// PINGs and PONGs are not considered as activity.
+	IdleTimeout time.Duration `json:"-"`
+
+	// AcceptLoops is the number of go routines accepting client
+	// connections. On Linux, each one has its own listener bound with
+	// SO_REUSEPORT so that the kernel spreads connections between them.
+	AcceptLoops int `json:"-"`
+
+	// Poller, experimental, drives the reads of the plain TCP client
+	// connections with epoll or kqueue and PollerWorkers go routines,
+	// instead of a go routine per connection, where supported.
+	Poller        bool `json:"-"`
+	PollerWorkers int  `json:"-"`
+
+	// TCP are the socket options of the accepted client connections.
+	TCP TCPOpts `json:"-"`
+
+	// Outbound tunes the writes to all connections.
+	Outbound OutboundOpts `json:"-"`
+
+	// MaxTotalPending, when set, is the limit of the bytes pending to be
+	// written to all connections above which the reads of the publishing
+	// clients are paused, until back below three quarters of it. The
+	// pending bytes of all connections are only accounted while set.
+	MaxTotalPending int64 `json:"-"`
+
+	// MaxProcs, when set, is the GOMAXPROCS of the process. Otherwise it is
+	// lowered to the CPU quota of the container or the number of CPUs of
+	// CPUAffinity, unless NoAutoMaxProcs is set or it is set with the
+	// GOMAXPROCS environment variable.
+	MaxProcs       int  `json:"-"`
+	NoAutoMaxProcs bool `json:"-"`
+
+	// CPUAffinity, on Linux, restricts the threads of the process, and so
+	// the read and write loops of the connections, to the listed CPUs. In
+	// the configuration, it is a CPU or a list such as "0-3,6".
+	CPUAffinity []int `json:"-"`
+
+	// RemoteSyslogTLSConfig is used when the RemoteSyslog URL has the tls
+	// scheme, with up to RemoteSyslogBuffer statements kept while the
+	// remote server can not be reached.
+	RemoteSyslogTLSConfig *tls.Config `json:"-"`
+	RemoteSyslogBuffer    int         `json:"-"`
+
 	// private fields, used to know if bool options are explicitly
 	// defined in config and/or command line params.
 	inConfig  map[string]bool
@@ -264,6 +578,9 @@ func (o *Options) Clone() *Options {
 			clone.Gateway.Gateways[i] = g.clone()
 		}
 	}
+	if o.Tags != nil {
+		clone.Tags = append([]string(nil), o.Tags...)
+	}
 	// FIXME(dlc) - clone leaf node stuff.
 	return clone
 }
@@ -306,6 +623,8 @@ type TLSConfigOpts struct {
 	Timeout          float64
 	Ciphers          []uint16
 	CurvePreferences []tls.CurveID
+	ExpectedSANs     []string
+	ExpectedOUs      []string
 }
 
 var tlsUsage = `
@@ -505,6 +824,36 @@ func (o *Options) ProcessConfigFile(configFile string) error {
 				errors = append(errors, err)
 				continue
 			}
+		case "websocket", "ws":
+			if err := parseWebsocket(tk, o, &errors, &warnings); err != nil {
+				errors = append(errors, err)
+				continue
+			}
+		case "mqtt":
+			if err := parseMQTT(tk, o, &errors, &warnings); err != nil {
+				errors = append(errors, err)
+				continue
+			}
+		case "stomp":
+			if err := parseSTOMP(tk, o, &errors, &warnings); err != nil {
+				errors = append(errors, err)
+				continue
+			}
+		case "http_bridge":
+			if err := parseHTTPBridge(tk, o, &errors, &warnings); err != nil {
+				errors = append(errors, err)
+				continue
+			}
+		case "prof":
+			if err := parseProf(tk, o, &errors, &warnings); err != nil {
+				errors = append(errors, err)
+				continue
+			}
+		case "otel":
+			if err := parseOTel(tk, o, &errors, &warnings); err != nil {
+				errors = append(errors, err)
+				continue
+			}
 		case "logfile", "log_file":
 			o.LogFile = v.(string)
 		case "syslog":
@@ -512,10 +861,47 @@ func (o *Options) ProcessConfigFile(configFile string) error {
 			trackExplicitVal(o, &o.inConfig, "Syslog", o.Syslog)
 		case "remote_syslog":
 			o.RemoteSyslog = v.(string)
+		case "remote_syslog_tls":
+			tc, err := parseTLS(tk, false)
+			if err != nil {
+				errors = append(errors, err)
+				continue
+			}
+			if o.RemoteSyslogTLSConfig, err = genClientTLSConfig(tc); err != nil {
+				errors = append(errors, &configErr{tk, err.Error()})
+				continue
+			}
+		case "remote_syslog_buffer":
+			o.RemoteSyslogBuffer = int(v.(int64))
+		case "log_format":
+			o.LogFormat = strings.ToLower(v.(string))
+		case "logfile_format", "log_file_format":
+			o.LogFileFormat = strings.ToLower(v.(string))
+		case "syslog_format":
+			o.SyslogFormat = strings.ToLower(v.(string))
+		case "syslog_backend":
+			o.SyslogBackend = strings.ToLower(v.(string))
+		case "syslog_name":
+			o.SyslogName = v.(string)
+		case "logfile_size_limit", "log_size_limit":
+			o.LogSizeLimit = v.(int64)
+		case "logfile_max_age", "log_max_age":
+			dur, err := parseDurationValue(k, tk, v)
+			if err != nil {
+				errors = append(errors, err)
+				continue
+			}
+			o.LogMaxAge = dur
+		case "logfile_max_backups", "logfile_max_num", "log_max_backups":
+			o.LogMaxBackups = int(v.(int64))
+		case "logfile_compress", "log_compress":
+			o.LogCompress = v.(bool)
 		case "pidfile", "pid_file":
 			o.PidFile = v.(string)
 		case "ports_file_dir":
 			o.PortsFileDir = v.(string)
+		case "ports_file":
+			o.PortsFile = v.(string)
 		case "prof_port":
 			o.ProfPort = int(v.(int64))
 		case "max_control_line":
@@ -534,16 +920,92 @@ func (o *Options) ProcessConfigFile(configFile string) error {
 			o.MaxPayload = int32(v.(int64))
 		case "max_pending":
 			o.MaxPending = v.(int64)
+		case "max_total_pending":
+			o.MaxTotalPending = v.(int64)
 		case "max_connections", "max_conn":
 			o.MaxConn = int(v.(int64))
+		case "max_connections_per_ip":
+			o.MaxConnPerIP = int(v.(int64))
+		case "max_connections_per_user":
+			o.MaxConnPerUser = int(v.(int64))
+		case "max_closed_clients", "max_closed_connections":
+			o.MaxClosedClients = int(v.(int64))
 		case "max_subscriptions", "max_subs":
 			o.MaxSubs = int(v.(int64))
 		case "ping_interval":
 			o.PingInterval = time.Duration(int(v.(int64))) * time.Second
+		case "stall_timeout":
+			dur, err := parseDurationValue(k, tk, v)
+			if err != nil {
+				errors = append(errors, err)
+				continue
+			}
+			o.StallTimeout = dur
+		case "idle_timeout":
+			dur, err := parseDurationValue(k, tk, v)
+			if err != nil {
+				errors = append(errors, err)
+				continue
+			}
+			o.IdleTimeout = dur
+		case "accept_loops":
+			o.AcceptLoops = int(v.(int64))
+		case "poller":
+			o.Poller = v.(bool)
+		case "poller_workers":
+			o.PollerWorkers = int(v.(int64))
+		case "tcp":
+			if err := parseTCP(tk, o, &errors, &warnings); err != nil {
+				errors = append(errors, err)
+				continue
+			}
+		case "outbound":
+			if err := parseOutbound(tk, o, &errors, &warnings); err != nil {
+				errors = append(errors, err)
+				continue
+			}
+		case "max_procs":
+			o.MaxProcs = int(v.(int64))
+		case "auto_max_procs":
+			o.NoAutoMaxProcs = !v.(bool)
+		case "cpu_affinity":
+			var cpus []int
+			var err error
+			switch v := v.(type) {
+			case int64:
+				cpus = []int{int(v)}
+			case string:
+				cpus, err = parseCPUList(v)
+			case []interface{}:
+				for _, mv := range v {
+					var list []int
+					tk, mv = unwrapValue(mv)
+					switch mv := mv.(type) {
+					case int64:
+						list = []int{int(mv)}
+					case string:
+						list, err = parseCPUList(mv)
+					default:
+						err = fmt.Errorf("unsupported type in array %T", mv)
+					}
+					if err != nil {
+						break
+					}
+					cpus = append(cpus, list...)
+				}
+			default:
+				err = fmt.Errorf("unsupported type %T", v)
+			}
+			if err != nil {
+				err := &configErr{tk, fmt.Sprintf("error parsing cpu_affinity: %v", err)}
+				errors = append(errors, err)
+				continue
+			}
+			o.CPUAffinity = cpus
 		case "ping_max":
 			o.MaxPingsOut = int(v.(int64))
 		case "tls":
-			tc, err := parseTLS(tk)
+			tc, err := parseTLS(tk, false)
 			if err != nil {
 				errors = append(errors, err)
 				continue
@@ -615,6 +1077,14 @@ func (o *Options) ProcessConfigFile(configFile string) error {
 				}
 				o.TrustedOperators = append(o.TrustedOperators, opc)
 			}
+		case "account_template":
+			ac, err := readAccountJWT(v.(string))
+			if err != nil {
+				err := &configErr{tk, fmt.Sprintf("error parsing account template JWT: %v", err)}
+				errors = append(errors, err)
+				continue
+			}
+			o.AccountTemplate = ac
 		case "resolver", "account_resolver", "accounts_resolver":
 			var memResolverRe = regexp.MustCompile(`(MEM|MEMORY|mem|memory)\s*`)
 			var resolverRe = regexp.MustCompile(`(?:URL|url){1}(?:\({1}\s*"?([^\s"]*)"?\s*\){1})?\s*`)
@@ -666,6 +1136,19 @@ func (o *Options) ProcessConfigFile(configFile string) error {
 					o.resolverPreloads[key] = jwt
 				}
 			}
+		case "no_auth_user":
+			if nau, ok := v.(string); !ok {
+				err := &configErr{tk, fmt.Sprintf("no_auth_user must be a string")}
+				errors = append(errors, err)
+			} else {
+				o.NoAuthUser = nau
+			}
+		case "jetstream":
+			err := parseJetStream(tk, o, &errors, &warnings)
+			if err != nil {
+				errors = append(errors, err)
+				continue
+			}
 		case "system_account", "system":
 			if sa, ok := v.(string); !ok {
 				err := &configErr{tk, fmt.Sprintf("system account name must be a string")}
@@ -673,6 +1156,13 @@ func (o *Options) ProcessConfigFile(configFile string) error {
 			} else {
 				o.SystemAccount = sa
 			}
+		case "statsz_interval":
+			dur, err := parseDurationValue(k, tk, v)
+			if err != nil {
+				errors = append(errors, err)
+				continue
+			}
+			o.StatszInterval = dur
 		case "trusted", "trusted_keys":
 			switch v := v.(type) {
 			case string:
@@ -703,10 +1193,51 @@ func (o *Options) ProcessConfigFile(configFile string) error {
 					errors = append(errors, err)
 				}
 			}
+		case "server_tags":
+			switch v := v.(type) {
+			case string:
+				o.Tags = []string{v}
+			case []interface{}:
+				tags := make([]string, 0, len(v))
+				for _, mv := range v {
+					tk, mv = unwrapValue(mv)
+					if tag, ok := mv.(string); ok {
+						tags = append(tags, tag)
+					} else {
+						err := &configErr{tk, fmt.Sprintf("error parsing server_tags: unsupported type in array %T", mv)}
+						errors = append(errors, err)
+						continue
+					}
+				}
+				o.Tags = tags
+			default:
+				err := &configErr{tk, fmt.Sprintf("error parsing server_tags: unsupported type %T", v)}
+				errors = append(errors, err)
+			}
 		case "connect_error_reports":
 			o.ConnectErrorReports = int(v.(int64))
 		case "reconnect_error_reports":
 			o.ReconnectErrorReports = int(v.(int64))
+		case "account_error_threshold":
+			o.AccountErrorThreshold = int(v.(int64))
+		case "account_error_window":
+			dur, err := time.ParseDuration(v.(string))
+			if err != nil {
+				err := &configErr{tk, fmt.Sprintf("error parsing account_error_window: %v", err)}
+				errors = append(errors, err)
+				continue
+			}
+			o.AccountErrorWindow = dur
+		case "unknown_fields":
+			mode, _ := v.(string)
+			switch strings.ToLower(mode) {
+			case "error":
+				o.UnknownFieldsAsWarnings = false
+			case "warn":
+				o.UnknownFieldsAsWarnings = true
+			default:
+				errors = append(errors, &configErr{tk, fmt.Sprintf("invalid unknown_fields %q, expected \"error\" or \"warn\"", v)})
+			}
 		default:
 			if au := atomic.LoadInt32(&allowUnknownTopLevelField); au == 0 && !tk.IsUsedVariable() {
 				err := &unknownConfigFieldErr{
@@ -720,6 +1251,20 @@ func (o *Options) ProcessConfigFile(configFile string) error {
 		}
 	}
 
+	// Report the unknown fields, in all blocks, as warnings if asked to.
+	if o.UnknownFieldsAsWarnings {
+		n := 0
+		for _, err := range errors {
+			if _, ok := err.(*unknownConfigFieldErr); ok {
+				warnings = append(warnings, err)
+			} else {
+				errors[n] = err
+				n++
+			}
+		}
+		errors = errors[:n]
+	}
+
 	if len(errors) > 0 || len(warnings) > 0 {
 		return &processConfigErr{
 			errors:   errors,
@@ -791,6 +1336,8 @@ func parseCluster(v interface{}, opts *Options, errors *[]error, warnings *[]err
 			opts.Cluster.Port = int(mv.(int64))
 		case "host", "net":
 			opts.Cluster.Host = mv.(string)
+		case "name":
+			opts.Cluster.Name = mv.(string)
 		case "authorization":
 			auth, err := parseAuthorization(tk, opts, errors, warnings)
 			if err != nil {
@@ -830,7 +1377,7 @@ func parseCluster(v interface{}, opts *Options, errors *[]error, warnings *[]err
 			}
 			opts.Routes = routes
 		case "tls":
-			config, tlsopts, err := getTLSConfig(tk)
+			config, tlsopts, err := getTLSConfig(tk, true)
 			if err != nil {
 				*errors = append(*errors, err)
 				continue
@@ -838,13 +1385,115 @@ func parseCluster(v interface{}, opts *Options, errors *[]error, warnings *[]err
 			opts.Cluster.TLSConfig = config
 			opts.Cluster.TLSTimeout = tlsopts.Timeout
 			opts.Cluster.TLSMap = tlsopts.Map
+			opts.Cluster.TLSExpectedSANs = tlsopts.ExpectedSANs
+			opts.Cluster.TLSExpectedOUs = tlsopts.ExpectedOUs
 		case "cluster_advertise", "advertise":
 			opts.Cluster.Advertise = mv.(string)
 		case "no_advertise":
 			opts.Cluster.NoAdvertise = mv.(bool)
 			trackExplicitVal(opts, &opts.inConfig, "Cluster.NoAdvertise", opts.Cluster.NoAdvertise)
+		case "ping_interval":
+			opts.Cluster.PingInterval = time.Duration(int(mv.(int64))) * time.Second
+		case "stall_timeout":
+			dur, err := parseDurationValue(mk, tk, mv)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.Cluster.StallTimeout = dur
+		case "ping_max":
+			opts.Cluster.MaxPingsOut = int(mv.(int64))
 		case "connect_retries":
 			opts.Cluster.ConnectRetries = int(mv.(int64))
+		case "proxy":
+			url, err := parseURL(mv.(string), "cluster proxy")
+			if err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			opts.Cluster.Proxy = url
+		case "compression":
+			mode, err := validateCompressionMode(mv.(string))
+			if err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			opts.Cluster.Compression = mode
+		case "batching":
+			opts.Cluster.Batch = mv.(bool)
+		case "batch_delay":
+			dur, err := parseDurationValue(mk, tk, mv)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.Cluster.BatchDelay = dur
+		case "load_hints":
+			opts.Cluster.LoadHints = mv.(bool)
+		case "load_hints_interval":
+			dur, err := parseDurationValue(mk, tk, mv)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.Cluster.LoadHintsInterval = dur
+		case "connect_urls_order":
+			order, err := validateConnectURLsOrder(mv.(string))
+			if err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			opts.Cluster.ConnectURLsOrder = order
+		case "dns_routes":
+			ra := mv.([]interface{})
+			routes, errs := parseURLs(ra, "dns route")
+			if errs != nil {
+				*errors = append(*errors, errs...)
+				continue
+			}
+			opts.Cluster.DNSRoutes = routes
+		case "dns_refresh":
+			dur, err := time.ParseDuration(mv.(string))
+			if err != nil {
+				err := &configErr{tk, fmt.Sprintf("error parsing dns_refresh: %v", err)}
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.Cluster.DNSRefresh = dur
+		case "reconnect_interval", "reconnect":
+			dur, err := parseDurationValue(mk, tk, mv)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.Cluster.ReconnectInterval = dur
+		case "reconnect_jitter":
+			dur, err := parseDurationValue(mk, tk, mv)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.Cluster.ReconnectJitter = dur
+		case "reconnect_max_backoff":
+			dur, err := parseDurationValue(mk, tk, mv)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.Cluster.ReconnectMaxBackoff = dur
+		case "pool_size":
+			opts.Cluster.PoolSize = int(mv.(int64))
+		case "accounts":
+			accs, ok := mv.([]interface{})
+			if !ok {
+				err := &configErr{tk, fmt.Sprintf("Expected cluster accounts to be an array, got %T", mv)}
+				*errors = append(*errors, err)
+				continue
+			}
+			for _, acc := range accs {
+				_, acc = unwrapValue(acc)
+				opts.Cluster.Accounts = append(opts.Cluster.Accounts, acc.(string))
+			}
 		case "permissions":
 			perms, err := parseUserPermissions(mv, errors, warnings)
 			if err != nil {
@@ -869,93 +1518,772 @@ func parseCluster(v interface{}, opts *Options, errors *[]error, warnings *[]err
 	return nil
 }
 
-func parseURLs(a []interface{}, typ string) ([]*url.URL, []error) {
-	var (
-		errors []error
-		urls   = make([]*url.URL, 0, len(a))
-	)
-	for _, u := range a {
-		tk, u := unwrapValue(u)
-		sURL := u.(string)
-		url, err := parseURL(sURL, typ)
-		if err != nil {
-			err := &configErr{tk, err.Error()}
-			errors = append(errors, err)
+// parseAccountJetStreamLimits parses the JetStream limits of an account.
+func parseAccountJetStreamLimits(v interface{}, errors *[]error) (*JetStreamAccountLimits, error) {
+	tk, v := unwrapValue(v)
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, "jetstream limits should be a map"}
+	}
+	limits := &JetStreamAccountLimits{}
+	for mk, mv := range m {
+		tk, mv := unwrapValue(mv)
+		n, ok := mv.(int64)
+		if !ok || n < 0 {
+			*errors = append(*errors, &configErr{tk, fmt.Sprintf("jetstream %s must be a positive number", mk)})
 			continue
 		}
-		urls = append(urls, url)
+		switch strings.ToLower(mk) {
+		case "max_memory_store", "max_mem_store", "max_mem":
+			limits.MaxMemory = n
+		case "max_file_store", "max_file":
+			limits.MaxStore = n
+		case "max_streams":
+			limits.MaxStreams = int(n)
+		case "max_consumers":
+			limits.MaxConsumers = int(n)
+		default:
+			if !tk.IsUsedVariable() {
+				*errors = append(*errors, &unknownConfigFieldErr{
+					field:     mk,
+					configErr: configErr{token: tk},
+				})
+			}
+		}
 	}
-	return urls, errors
+	return limits, nil
 }
 
-func parseURL(u string, typ string) (*url.URL, error) {
-	urlStr := strings.TrimSpace(u)
-	url, err := url.Parse(urlStr)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing %s url [%q]", typ, urlStr)
+// parseStickyQueues parses the sticky queue groups of an account, mapping
+// the name of each group to the index of the subject token, starting at 1,
+// that selects its members, or 0 for the whole subject.
+func parseStickyQueues(v interface{}, errors *[]error) (map[string]int, error) {
+	tk, v := unwrapValue(v)
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, "sticky queues should be a map"}
 	}
-	return url, nil
+	sq := make(map[string]int, len(m))
+	for qn, mv := range m {
+		tk, mv := unwrapValue(mv)
+		n, ok := mv.(int64)
+		if !ok || n < 0 {
+			*errors = append(*errors, &configErr{tk, fmt.Sprintf("sticky queue %q token must be a positive number", qn)})
+			continue
+		}
+		sq[qn] = int(n)
+	}
+	return sq, nil
+}
+
+// parseJetStreamTier parses the object storage of the tiered storage.
+func parseJetStreamTier(v interface{}, errors *[]error) (*TierConfig, error) {
+	tk, v := unwrapValue(v)
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, "tier should be a map"}
+	}
+	tc := &TierConfig{}
+	for mk, mv := range m {
+		tk, mv := unwrapValue(mv)
+		s, ok := mv.(string)
+		if !ok {
+			*errors = append(*errors, &configErr{tk, fmt.Sprintf("tier %s must be a string", mk)})
+			continue
+		}
+		switch strings.ToLower(mk) {
+		case "endpoint", "url":
+			tc.Endpoint = s
+		case "bucket":
+			tc.Bucket = s
+		case "region":
+			tc.Region = s
+		case "prefix":
+			tc.Prefix = s
+		case "access_key", "access_key_id":
+			tc.AccessKey = s
+		case "secret_key", "secret_access_key":
+			tc.SecretKey = s
+		default:
+			if !tk.IsUsedVariable() {
+				*errors = append(*errors, &unknownConfigFieldErr{
+					field:     mk,
+					configErr: configErr{token: tk},
+				})
+			}
+		}
+	}
+	if tc.Endpoint == _EMPTY_ || tc.Bucket == _EMPTY_ {
+		return nil, &configErr{tk, "tier requires an endpoint and a bucket"}
+	}
+	return tc, nil
+}
+
+// parseJetStream parses the jetstream block, which can also be a boolean
+// or one of "enabled"/"disabled".
+func parseJetStream(v interface{}, opts *Options, errors *[]error, warnings *[]error) error {
+	tk, v := unwrapValue(v)
+	switch vv := v.(type) {
+	case bool:
+		opts.JetStream = vv
+		return nil
+	case string:
+		switch strings.ToLower(vv) {
+		case "enabled", "enable":
+			opts.JetStream = true
+		case "disabled", "disable":
+			opts.JetStream = false
+		default:
+			return &configErr{tk, fmt.Sprintf("Expected 'enabled' or 'disabled' for string value, got '%s'", vv)}
+		}
+		return nil
+	case map[string]interface{}:
+		opts.JetStream = true
+		for mk, mv := range vv {
+			tk, mv = unwrapValue(mv)
+			switch strings.ToLower(mk) {
+			case "store", "store_dir", "storedir":
+				sd, ok := mv.(string)
+				if !ok {
+					*errors = append(*errors, &configErr{tk, "store_dir must be a string"})
+					continue
+				}
+				opts.StoreDir = sd
+			case "max_memory_store", "max_mem_store", "max_mem":
+				mem, ok := mv.(int64)
+				if !ok || mem < 0 {
+					*errors = append(*errors, &configErr{tk, "max_memory_store must be a positive size"})
+					continue
+				}
+				opts.JetStreamMaxMemory = mem
+			case "max_file_store", "max_file":
+				store, ok := mv.(int64)
+				if !ok || store < 0 {
+					*errors = append(*errors, &configErr{tk, "max_file_store must be a positive size"})
+					continue
+				}
+				opts.JetStreamMaxStore = store
+			case "key", "ek", "encryption_key":
+				key, ok := mv.(string)
+				if !ok || key == _EMPTY_ {
+					*errors = append(*errors, &configErr{tk, "key must be a non empty string"})
+					continue
+				}
+				opts.JetStreamKey = key
+			case "prev_key", "prev_encryption_key":
+				key, ok := mv.(string)
+				if !ok || key == _EMPTY_ {
+					*errors = append(*errors, &configErr{tk, "prev_key must be a non empty string"})
+					continue
+				}
+				opts.JetStreamPrevKey = key
+			case "cipher":
+				c, _ := mv.(string)
+				switch strings.ToLower(c) {
+				case "aes", "aes-256-gcm":
+					opts.JetStreamCipher = AES
+				case "chacha", "chachapoly", "chacha20-poly1305":
+					opts.JetStreamCipher = ChaCha
+				default:
+					*errors = append(*errors, &configErr{tk, fmt.Sprintf("cipher %q is not supported, expected 'aes' or 'chacha'", mv)})
+					continue
+				}
+			case "tier", "tiered_storage":
+				tc, err := parseJetStreamTier(mv, errors)
+				if err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
+				opts.JetStreamTier = tc
+			case "enabled", "enable":
+				enabled, ok := mv.(bool)
+				if !ok {
+					*errors = append(*errors, &configErr{tk, "enabled must be a boolean"})
+					continue
+				}
+				opts.JetStream = enabled
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: mk,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+					continue
+				}
+			}
+		}
+		return nil
+	default:
+		return &configErr{tk, fmt.Sprintf("Expected map, bool or string to define JetStream, got %T", v)}
+	}
+}
+
+func parseURLs(a []interface{}, typ string) ([]*url.URL, []error) {
+	var (
+		errors []error
+		urls   = make([]*url.URL, 0, len(a))
+	)
+	for _, u := range a {
+		tk, u := unwrapValue(u)
+		sURL := u.(string)
+		url, err := parseURL(sURL, typ)
+		if err != nil {
+			err := &configErr{tk, err.Error()}
+			errors = append(errors, err)
+			continue
+		}
+		urls = append(urls, url)
+	}
+	return urls, errors
+}
+
+// Parses a duration given either as a string, such as "2s", or as
+// a number of seconds.
+func parseDurationValue(field string, tk token, v interface{}) (time.Duration, error) {
+	switch dv := v.(type) {
+	case string:
+		dur, err := time.ParseDuration(dv)
+		if err != nil {
+			return 0, &configErr{tk, fmt.Sprintf("error parsing %s: %v", field, err)}
+		}
+		return dur, nil
+	case int64:
+		return time.Duration(dv) * time.Second, nil
+	default:
+		return 0, &configErr{tk, fmt.Sprintf("%s should be a duration or a number of seconds, got %T", field, v)}
+	}
+}
+
+func parseURL(u string, typ string) (*url.URL, error) {
+	urlStr := strings.TrimSpace(u)
+	url, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s url [%q]", typ, urlStr)
+	}
+	return url, nil
+}
+
+func parseGateway(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	tk, v := unwrapValue(v)
+	gm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected gateway to be a map, got %T", v)}
+	}
+	for mk, mv := range gm {
+		// Again, unwrap token value if line check is required.
+		tk, mv = unwrapValue(mv)
+		switch strings.ToLower(mk) {
+		case "name":
+			o.Gateway.Name = mv.(string)
+		case "stall_timeout":
+			dur, err := parseDurationValue(mk, tk, mv)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			o.Gateway.StallTimeout = dur
+		case "listen":
+			hp, err := parseListen(mv)
+			if err != nil {
+				err := &configErr{tk, err.Error()}
+				*errors = append(*errors, err)
+				continue
+			}
+			o.Gateway.Host = hp.host
+			o.Gateway.Port = hp.port
+		case "port":
+			o.Gateway.Port = int(mv.(int64))
+		case "host", "net":
+			o.Gateway.Host = mv.(string)
+		case "authorization":
+			auth, err := parseAuthorization(tk, o, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			if auth.users != nil {
+				*errors = append(*errors, &configErr{tk, "Gateway authorization does not allow multiple users"})
+				continue
+			}
+			o.Gateway.Username = auth.user
+			o.Gateway.Password = auth.pass
+			o.Gateway.AuthTimeout = auth.timeout
+		case "tls":
+			config, tlsopts, err := getTLSConfig(tk, false)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			o.Gateway.TLSConfig = config
+			o.Gateway.TLSTimeout = tlsopts.Timeout
+			o.Gateway.TLSMap = tlsopts.Map
+		case "advertise":
+			o.Gateway.Advertise = mv.(string)
+		case "connect_retries":
+			o.Gateway.ConnectRetries = int(mv.(int64))
+		case "proxy":
+			url, err := parseURL(mv.(string), "gateway proxy")
+			if err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			o.Gateway.Proxy = url
+		case "gateways":
+			gateways, err := parseGateways(mv, errors, warnings)
+			if err != nil {
+				return err
+			}
+			o.Gateway.Gateways = gateways
+		case "reject_unknown":
+			o.Gateway.RejectUnknown = mv.(bool)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+				continue
+			}
+		}
+	}
+	return nil
+}
+
+// parseLeafNodes will parse the leaf node config.
+func parseLeafNodes(v interface{}, opts *Options, errors *[]error, warnings *[]error) error {
+	tk, v := unwrapValue(v)
+	cm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected map to define a leafnode, got %T", v)}
+	}
+
+	for mk, mv := range cm {
+		// Again, unwrap token value if line check is required.
+		tk, mv = unwrapValue(mv)
+		switch strings.ToLower(mk) {
+		case "listen":
+			hp, err := parseListen(mv)
+			if err != nil {
+				err := &configErr{tk, err.Error()}
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.LeafNode.Host = hp.host
+			opts.LeafNode.Port = hp.port
+		case "port":
+			opts.LeafNode.Port = int(mv.(int64))
+		case "host", "net":
+			opts.LeafNode.Host = mv.(string)
+		case "authorization":
+			auth, err := parseAuthorization(tk, opts, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			if auth.users != nil {
+				err := &configErr{tk, fmt.Sprintf("Leafnode authorization does not allow multiple users")}
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.LeafNode.Username = auth.user
+			opts.LeafNode.Password = auth.pass
+			opts.LeafNode.AuthTimeout = auth.timeout
+		case "reconnect_interval", "reconnect":
+			dur, err := parseDurationValue(mk, tk, mv)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.LeafNode.ReconnectInterval = dur
+		case "reconnect_jitter":
+			dur, err := parseDurationValue(mk, tk, mv)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.LeafNode.ReconnectJitter = dur
+		case "reconnect_max_backoff":
+			dur, err := parseDurationValue(mk, tk, mv)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.LeafNode.ReconnectMaxBackoff = dur
+		case "permissions":
+			perms, err := parseUserPermissions(mv, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			// Same as for routes, Import maps to Publish and Export to Subscribe.
+			opts.LeafNode.Permissions = &RoutePermissions{
+				Import: perms.Publish,
+				Export: perms.Subscribe,
+			}
+
+		case "remotes":
+			// Parse the remote options here.
+			remotes, err := parseRemoteLeafNodes(mv, errors, warnings)
+			if err != nil {
+				continue
+			}
+			opts.LeafNode.Remotes = remotes
+		case "websocket", "ws":
+			if err := parseLeafNodeWebsocket(tk, mv, opts, errors, warnings); err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+		case "tls":
+			tc, err := parseTLS(tk, false)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			if opts.LeafNode.TLSConfig, err = GenTLSConfig(tc); err != nil {
+				err := &configErr{tk, err.Error()}
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.LeafNode.TLSTimeout = tc.Timeout
+		case "leafnode_advertise", "advertise":
+			opts.LeafNode.Advertise = mv.(string)
+		case "no_advertise":
+			opts.LeafNode.NoAdvertise = mv.(bool)
+			trackExplicitVal(opts, &opts.inConfig, "LeafNode.NoAdvertise", opts.LeafNode.NoAdvertise)
+		case "ping_interval":
+			opts.LeafNode.PingInterval = time.Duration(int(mv.(int64))) * time.Second
+		case "stall_timeout":
+			dur, err := parseDurationValue(mk, tk, mv)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.LeafNode.StallTimeout = dur
+		case "ping_max":
+			opts.LeafNode.MaxPingsOut = int(mv.(int64))
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+				continue
+			}
+		}
+	}
+	return nil
+}
+
+func parseLeafNodeWebsocket(tk token, v interface{}, opts *Options, errors *[]error, warnings *[]error) error {
+	wm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected leafnode websocket to be a map, got %T", v)}
+	}
+	wo := &opts.LeafNode.Websocket
+	for mk, mv := range wm {
+		tk, mv := unwrapValue(mv)
+		switch strings.ToLower(mk) {
+		case "listen":
+			hp, err := parseListen(mv)
+			if err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			wo.Host = hp.host
+			wo.Port = hp.port
+		case "port":
+			wo.Port = int(mv.(int64))
+		case "host", "net":
+			wo.Host = mv.(string)
+		case "tls":
+			tc, err := parseTLS(tk, false)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			if wo.TLSConfig, err = GenTLSConfig(tc); err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			wo.TLSTimeout = tc.Timeout
+		case "compression":
+			wo.Compression = mv.(bool)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+				continue
+			}
+		}
+	}
+	return nil
+}
+
+func parseWebsocket(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	tk, v := unwrapValue(v)
+	wm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected websocket to be a map, got %T", v)}
+	}
+	wo := &o.Websocket
+	for mk, mv := range wm {
+		tk, mv := unwrapValue(mv)
+		switch strings.ToLower(mk) {
+		case "listen":
+			hp, err := parseListen(mv)
+			if err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			wo.Host = hp.host
+			wo.Port = hp.port
+		case "port":
+			wo.Port = int(mv.(int64))
+		case "host", "net":
+			wo.Host = mv.(string)
+		case "tls":
+			tc, err := parseTLS(tk, false)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			if wo.TLSConfig, err = GenTLSConfig(tc); err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			// An explicit handshake timeout takes precedence.
+			if wo.HandshakeTimeout == 0 && tc.Timeout > 0 {
+				wo.HandshakeTimeout = secondsToDuration(tc.Timeout)
+			}
+		case "no_tls":
+			wo.NoTLS = mv.(bool)
+		case "compression":
+			wo.Compression = mv.(bool)
+		case "same_origin":
+			wo.SameOrigin = mv.(bool)
+		case "allowed_origins", "allowed_origin", "allow_origins", "allow_origin", "origins", "origin":
+			switch mv := mv.(type) {
+			case string:
+				wo.AllowedOrigins = []string{mv}
+			case []interface{}:
+				wo.AllowedOrigins = nil
+				for _, o := range mv {
+					_, o = unwrapValue(o)
+					wo.AllowedOrigins = append(wo.AllowedOrigins, o.(string))
+				}
+			default:
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected websocket allowed origins to be a string or an array, got %T", mv)})
+			}
+		case "jwt_cookie":
+			wo.JWTCookie = mv.(string)
+		case "handshake_timeout":
+			switch mv := mv.(type) {
+			case string:
+				dur, err := time.ParseDuration(mv)
+				if err != nil {
+					*errors = append(*errors, &configErr{tk, fmt.Sprintf("error parsing websocket handshake_timeout: %v", err)})
+					continue
+				}
+				wo.HandshakeTimeout = dur
+			case int64:
+				// Number of seconds.
+				wo.HandshakeTimeout = time.Duration(mv) * time.Second
+			case float64:
+				wo.HandshakeTimeout = secondsToDuration(mv)
+			default:
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected websocket handshake_timeout to be a duration, got %T", mv)})
+			}
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+				continue
+			}
+		}
+	}
+	return nil
+}
+
+func parseMQTT(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	tk, v := unwrapValue(v)
+	mm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected mqtt to be a map, got %T", v)}
+	}
+	mo := &o.MQTT
+	for mk, mv := range mm {
+		tk, mv := unwrapValue(mv)
+		switch strings.ToLower(mk) {
+		case "listen":
+			hp, err := parseListen(mv)
+			if err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			mo.Host = hp.host
+			mo.Port = hp.port
+		case "port":
+			mo.Port = int(mv.(int64))
+		case "host", "net":
+			mo.Host = mv.(string)
+		case "tls":
+			tc, err := parseTLS(tk, false)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			if mo.TLSConfig, err = GenTLSConfig(tc); err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			mo.TLSTimeout = tc.Timeout
+		case "no_auth_user":
+			mo.NoAuthUser = mv.(string)
+		case "max_ack_pending", "max_pending":
+			mo.MaxAckPending = int(mv.(int64))
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+				continue
+			}
+		}
+	}
+	return nil
+}
+
+func parseSTOMP(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	tk, v := unwrapValue(v)
+	sm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected stomp to be a map, got %T", v)}
+	}
+	so := &o.STOMP
+	for mk, mv := range sm {
+		tk, mv := unwrapValue(mv)
+		switch strings.ToLower(mk) {
+		case "listen":
+			hp, err := parseListen(mv)
+			if err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			so.Host = hp.host
+			so.Port = hp.port
+		case "port":
+			so.Port = int(mv.(int64))
+		case "host", "net":
+			so.Host = mv.(string)
+		case "tls":
+			tc, err := parseTLS(tk, false)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			if so.TLSConfig, err = GenTLSConfig(tc); err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			so.TLSTimeout = tc.Timeout
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+				continue
+			}
+		}
+	}
+	return nil
 }
 
-func parseGateway(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+func parseHTTPBridge(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
 	tk, v := unwrapValue(v)
-	gm, ok := v.(map[string]interface{})
+	bm, ok := v.(map[string]interface{})
 	if !ok {
-		return &configErr{tk, fmt.Sprintf("Expected gateway to be a map, got %T", v)}
+		return &configErr{tk, fmt.Sprintf("Expected http_bridge to be a map, got %T", v)}
 	}
-	for mk, mv := range gm {
-		// Again, unwrap token value if line check is required.
-		tk, mv = unwrapValue(mv)
+	bo := &o.HTTPBridge
+	for mk, mv := range bm {
+		tk, mv := unwrapValue(mv)
 		switch strings.ToLower(mk) {
-		case "name":
-			o.Gateway.Name = mv.(string)
 		case "listen":
 			hp, err := parseListen(mv)
 			if err != nil {
-				err := &configErr{tk, err.Error()}
-				*errors = append(*errors, err)
+				*errors = append(*errors, &configErr{tk, err.Error()})
 				continue
 			}
-			o.Gateway.Host = hp.host
-			o.Gateway.Port = hp.port
+			bo.Host = hp.host
+			bo.Port = hp.port
 		case "port":
-			o.Gateway.Port = int(mv.(int64))
+			bo.Port = int(mv.(int64))
 		case "host", "net":
-			o.Gateway.Host = mv.(string)
-		case "authorization":
-			auth, err := parseAuthorization(tk, o, errors, warnings)
+			bo.Host = mv.(string)
+		case "tls":
+			tc, err := parseTLS(tk, false)
 			if err != nil {
 				*errors = append(*errors, err)
 				continue
 			}
-			if auth.users != nil {
-				*errors = append(*errors, &configErr{tk, "Gateway authorization does not allow multiple users"})
+			if bo.TLSConfig, err = GenTLSConfig(tc); err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
 				continue
 			}
-			o.Gateway.Username = auth.user
-			o.Gateway.Password = auth.pass
-			o.Gateway.AuthTimeout = auth.timeout
-		case "tls":
-			config, tlsopts, err := getTLSConfig(tk)
-			if err != nil {
-				*errors = append(*errors, err)
+		case "rate_limit", "rate":
+			bo.RateLimit = int(mv.(int64))
+		case "burst":
+			bo.Burst = int(mv.(int64))
+		case "account_rate_limits":
+			am, ok := mv.(map[string]interface{})
+			if !ok {
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected account_rate_limits to be a map, got %T", mv)})
 				continue
 			}
-			o.Gateway.TLSConfig = config
-			o.Gateway.TLSTimeout = tlsopts.Timeout
-			o.Gateway.TLSMap = tlsopts.Map
-		case "advertise":
-			o.Gateway.Advertise = mv.(string)
-		case "connect_retries":
-			o.Gateway.ConnectRetries = int(mv.(int64))
-		case "gateways":
-			gateways, err := parseGateways(mv, errors, warnings)
+			bo.AccountRateLimits = make(map[string]int, len(am))
+			for acc, rv := range am {
+				tk, rv := unwrapValue(rv)
+				rate, ok := rv.(int64)
+				if !ok {
+					*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected rate limit of account %q to be a number, got %T", acc, rv)})
+					continue
+				}
+				bo.AccountRateLimits[acc] = int(rate)
+			}
+		case "request_timeout":
+			dur, err := parseDurationValue("http_bridge request_timeout", tk, mv)
 			if err != nil {
-				return err
+				*errors = append(*errors, err)
+				continue
 			}
-			o.Gateway.Gateways = gateways
-		case "reject_unknown":
-			o.Gateway.RejectUnknown = mv.(bool)
+			bo.RequestTimeout = dur
 		default:
 			if !tk.IsUsedVariable() {
 				err := &unknownConfigFieldErr{
@@ -972,70 +2300,194 @@ func parseGateway(v interface{}, o *Options, errors *[]error, warnings *[]error)
 	return nil
 }
 
-// parseLeafNodes will parse the leaf node config.
-func parseLeafNodes(v interface{}, opts *Options, errors *[]error, warnings *[]error) error {
+// Parses the profiling options, either `prof: true` to serve the pprof
+// endpoints on the monitoring port, `prof: <port>` to serve them on their
+// own port, or a map that can also set credentials.
+func parseProf(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
 	tk, v := unwrapValue(v)
-	cm, ok := v.(map[string]interface{})
+	switch pv := v.(type) {
+	case bool:
+		o.Prof.Enabled = pv
+		return nil
+	case int64:
+		o.ProfPort = int(pv)
+		return nil
+	}
+	pm, ok := v.(map[string]interface{})
 	if !ok {
-		return &configErr{tk, fmt.Sprintf("Expected map to define a leafnode, got %T", v)}
+		return &configErr{tk, fmt.Sprintf("Expected prof to be a boolean, a port or a map, got %T", v)}
+	}
+	po := &o.Prof
+	// The map enables the endpoints on the monitoring port unless it sets
+	// a dedicated port, or explicitly says otherwise.
+	var enabled, portSet, enabledSet bool
+	for mk, mv := range pm {
+		tk, mv := unwrapValue(mv)
+		switch strings.ToLower(mk) {
+		case "enabled":
+			enabled, enabledSet = mv.(bool), true
+		case "port":
+			o.ProfPort, portSet = int(mv.(int64)), true
+		case "user", "username":
+			po.Username = mv.(string)
+		case "pass", "password":
+			po.Password = mv.(string)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+				continue
+			}
+		}
 	}
+	if enabledSet {
+		po.Enabled = enabled
+	} else {
+		po.Enabled = !portSet
+	}
+	return nil
+}
 
-	for mk, mv := range cm {
-		// Again, unwrap token value if line check is required.
-		tk, mv = unwrapValue(mv)
+func parseTCP(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	tk, v := unwrapValue(v)
+	tm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected tcp to be a map, got %T", v)}
+	}
+	to := &o.TCP
+	for mk, mv := range tm {
+		tk, mv := unwrapValue(mv)
 		switch strings.ToLower(mk) {
-		case "listen":
-			hp, err := parseListen(mv)
+		case "no_delay", "nodelay":
+			to.Nagle = !mv.(bool)
+		case "read_buffer":
+			to.ReadBuffer = int(mv.(int64))
+		case "write_buffer":
+			to.WriteBuffer = int(mv.(int64))
+		case "keep_alive", "keepalive":
+			// Can be disabled with false, or set to a duration.
+			if enabled, ok := mv.(bool); ok {
+				if !enabled {
+					to.KeepAlive = -1
+				}
+				continue
+			}
+			dur, err := parseDurationValue("tcp keep_alive", tk, mv)
 			if err != nil {
-				err := &configErr{tk, err.Error()}
 				*errors = append(*errors, err)
 				continue
 			}
-			opts.LeafNode.Host = hp.host
-			opts.LeafNode.Port = hp.port
-		case "port":
-			opts.LeafNode.Port = int(mv.(int64))
-		case "host", "net":
-			opts.LeafNode.Host = mv.(string)
-		case "authorization":
-			auth, err := parseAuthorization(tk, opts, errors, warnings)
+			to.KeepAlive = dur
+		case "keep_alive_interval":
+			dur, err := parseDurationValue("tcp keep_alive_interval", tk, mv)
 			if err != nil {
 				*errors = append(*errors, err)
 				continue
 			}
-			if auth.users != nil {
-				err := &configErr{tk, fmt.Sprintf("Leafnode authorization does not allow multiple users")}
+			to.KeepAliveInterval = dur
+		case "keep_alive_count":
+			to.KeepAliveCount = int(mv.(int64))
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
 				*errors = append(*errors, err)
 				continue
 			}
-			opts.LeafNode.Username = auth.user
-			opts.LeafNode.Password = auth.pass
-			opts.LeafNode.AuthTimeout = auth.timeout
+		}
+	}
+	return nil
+}
 
-		case "remotes":
-			// Parse the remote options here.
-			remotes, err := parseRemoteLeafNodes(mv, errors, warnings)
+func parseOutbound(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	tk, v := unwrapValue(v)
+	om, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected outbound to be a map, got %T", v)}
+	}
+	oo := &o.Outbound
+	for mk, mv := range om {
+		tk, mv := unwrapValue(mv)
+		switch strings.ToLower(mk) {
+		case "max_vectors":
+			oo.MaxVectors = int(mv.(int64))
+		case "coalesce_delay", "coalesce":
+			dur, err := parseDurationValue("outbound coalesce_delay", tk, mv)
 			if err != nil {
+				*errors = append(*errors, err)
 				continue
 			}
-			opts.LeafNode.Remotes = remotes
-		case "tls":
-			tc, err := parseTLS(tk)
-			if err != nil {
+			oo.CoalesceDelay = dur
+		case "min_buffer_size":
+			oo.MinBufferSize = int(mv.(int64))
+		case "max_buffer_size":
+			oo.MaxBufferSize = int(mv.(int64))
+		case "buffer_growth":
+			oo.BufferGrowth = strings.ToLower(mv.(string))
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
 				*errors = append(*errors, err)
 				continue
 			}
-			if opts.LeafNode.TLSConfig, err = GenTLSConfig(tc); err != nil {
-				err := &configErr{tk, err.Error()}
+		}
+	}
+	return nil
+}
+
+func parseOTel(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	tk, v := unwrapValue(v)
+	om, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected otel to be a map, got %T", v)}
+	}
+	oo := &o.OTel
+	for mk, mv := range om {
+		tk, mv := unwrapValue(mv)
+		switch strings.ToLower(mk) {
+		case "endpoint", "url":
+			oo.Endpoint = mv.(string)
+		case "service_name", "service":
+			oo.ServiceName = mv.(string)
+		case "headers":
+			hm, ok := mv.(map[string]interface{})
+			if !ok {
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected headers to be a map, got %T", mv)})
+				continue
+			}
+			oo.Headers = make(map[string]string, len(hm))
+			for k, hv := range hm {
+				tk, hv := unwrapValue(hv)
+				val, ok := hv.(string)
+				if !ok {
+					*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected header %q to be a string, got %T", k, hv)})
+					continue
+				}
+				oo.Headers[k] = val
+			}
+		case "flush_interval":
+			dur, err := parseDurationValue("otel flush_interval", tk, mv)
+			if err != nil {
 				*errors = append(*errors, err)
 				continue
 			}
-			opts.LeafNode.TLSTimeout = tc.Timeout
-		case "leafnode_advertise", "advertise":
-			opts.LeafNode.Advertise = mv.(string)
-		case "no_advertise":
-			opts.LeafNode.NoAdvertise = mv.(bool)
-			trackExplicitVal(opts, &opts.inConfig, "LeafNode.NoAdvertise", opts.LeafNode.NoAdvertise)
+			oo.FlushInterval = dur
+		case "batch_size":
+			oo.BatchSize = int(mv.(int64))
 		default:
 			if !tk.IsUsedVariable() {
 				err := &unknownConfigFieldErr{
@@ -1083,7 +2535,7 @@ func parseRemoteLeafNodes(v interface{}, errors *[]error, warnings *[]error) ([]
 			case "creds", "credentials":
 				remote.Credentials = v.(string)
 			case "tls":
-				tc, err := parseTLS(tk)
+				tc, err := parseTLS(tk, false)
 				if err != nil {
 					*errors = append(*errors, err)
 					continue
@@ -1097,6 +2549,38 @@ func parseRemoteLeafNodes(v interface{}, errors *[]error, warnings *[]error) ([]
 				// a connection (therefore behaves as a client).
 				remote.TLSConfig.RootCAs = remote.TLSConfig.ClientCAs
 				remote.TLSTimeout = tc.Timeout
+			case "proxy":
+				url, err := parseURL(v.(string), "leafnode proxy")
+				if err != nil {
+					*errors = append(*errors, &configErr{tk, err.Error()})
+					continue
+				}
+				remote.Proxy = url
+			case "compression":
+				remote.Compression = v.(bool)
+			case "reconnect_interval", "reconnect":
+				dur, err := parseDurationValue(k, tk, v)
+				if err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
+				remote.ReconnectInterval = dur
+			case "reconnect_jitter":
+				dur, err := parseDurationValue(k, tk, v)
+				if err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
+				remote.ReconnectJitter = dur
+			case "reconnect_max_backoff":
+				dur, err := parseDurationValue(k, tk, v)
+				if err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
+				remote.ReconnectMaxBackoff = dur
+			case "connect_retries":
+				remote.ConnectRetries = int(v.(int64))
 			default:
 				if !tk.IsUsedVariable() {
 					err := &unknownConfigFieldErr{
@@ -1117,8 +2601,8 @@ func parseRemoteLeafNodes(v interface{}, errors *[]error, warnings *[]error) ([]
 
 // Parse TLS and returns a TLSConfig and TLSTimeout.
 // Used by cluster and gateway parsing.
-func getTLSConfig(tk token) (*tls.Config, *TLSConfigOpts, error) {
-	tc, err := parseTLS(tk)
+func getTLSConfig(tk token, isRouteCtx bool) (*tls.Config, *TLSConfigOpts, error) {
+	tc, err := parseTLS(tk, isRouteCtx)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1158,7 +2642,7 @@ func parseGateways(v interface{}, errors *[]error, warnings *[]error) ([]*Remote
 			case "name":
 				gateway.Name = v.(string)
 			case "tls":
-				tls, tlsopts, err := getTLSConfig(tk)
+				tls, tlsopts, err := getTLSConfig(tk, false)
 				if err != nil {
 					*errors = append(*errors, err)
 					continue
@@ -1296,6 +2780,11 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 			acc := NewAccount(aname)
 			opts.Accounts = append(opts.Accounts, acc)
 
+			var (
+				users        []*User
+				nkusers      []*NkeyUser
+				defaultPerms *Permissions
+			)
 			for k, v := range mv {
 				tk, mv := unwrapValue(v)
 				switch strings.ToLower(k) {
@@ -1307,6 +2796,21 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 						continue
 					}
 					acc.Nkey = nk
+				case "no_advertise":
+					acc.noAdvertise = mv.(bool)
+				case "queue_local_preference":
+					acc.queueLocal = mv.(bool)
+				case "sticky_queues":
+					sq, err := parseStickyQueues(tk, errors)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.stickyQueues = sq
+				case "ping_interval":
+					acc.pingInterval = time.Duration(int(mv.(int64))) * time.Second
+				case "ping_max":
+					acc.maxPingsOut = int(mv.(int64))
 				case "imports":
 					streams, services, err := parseAccountImports(tk, acc, errors, warnings)
 					if err != nil {
@@ -1324,12 +2828,12 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 					exportStreams = append(exportStreams, streams...)
 					exportServices = append(exportServices, services...)
 				case "users":
-					nkeys, users, err := parseUsers(mv, opts, errors, warnings)
+					nkeys, ausers, err := parseUsers(mv, opts, errors, warnings)
 					if err != nil {
 						*errors = append(*errors, err)
 						continue
 					}
-					for _, u := range users {
+					for _, u := range ausers {
 						if _, ok := uorn[u.Username]; ok {
 							err := &configErr{tk, fmt.Sprintf("Duplicate user %q detected", u.Username)}
 							*errors = append(*errors, err)
@@ -1338,7 +2842,8 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 						uorn[u.Username] = struct{}{}
 						u.Account = acc
 					}
-					opts.Users = append(opts.Users, users...)
+					opts.Users = append(opts.Users, ausers...)
+					users = append(users, ausers...)
 
 					for _, u := range nkeys {
 						if _, ok := uorn[u.Nkey]; ok {
@@ -1350,6 +2855,21 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 						u.Account = acc
 					}
 					opts.Nkeys = append(opts.Nkeys, nkeys...)
+					nkusers = append(nkusers, nkeys...)
+				case "jetstream":
+					limits, err := parseAccountJetStreamLimits(mv, errors)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.jsLimits = limits
+				case "default_permission", "default_permissions":
+					permissions, err := parseUserPermissions(tk, errors, warnings)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					defaultPerms = permissions
 				default:
 					if !tk.IsUsedVariable() {
 						err := &unknownConfigFieldErr{
@@ -1362,6 +2882,19 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 					}
 				}
 			}
+			// Apply the account default permissions to users without explicit ones.
+			if defaultPerms != nil {
+				for _, u := range users {
+					if u.Permissions == nil {
+						u.Permissions = defaultPerms
+					}
+				}
+				for _, u := range nkusers {
+					if u.Permissions == nil {
+						u.Permissions = defaultPerms
+					}
+				}
+			}
 		}
 	}
 	// Bail already if there are previous errors.
@@ -1808,10 +3341,12 @@ func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]erro
 		}
 
 		var (
-			user  = &User{}
-			nkey  = &NkeyUser{}
-			perms *Permissions
-			err   error
+			user   = &User{}
+			nkey   = &NkeyUser{}
+			perms  *Permissions
+			mconns int
+			tags   map[string]string
+			err    error
 		)
 		for k, v := range um {
 			// Also needs to unwrap first
@@ -1824,6 +3359,14 @@ func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]erro
 				user.Username = v.(string)
 			case "pass", "password":
 				user.Password = v.(string)
+			case "max_connections", "max_conn":
+				mconns = int(v.(int64))
+			case "tags":
+				tags, err = parseUserTags(tk, v)
+				if err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
 			case "permission", "permissions", "authorization":
 				perms, err = parseUserPermissions(tk, errors, warnings)
 				if err != nil {
@@ -1843,6 +3386,8 @@ func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]erro
 				}
 			}
 		}
+		nkey.MaxConnections, user.MaxConnections = mconns, mconns
+		nkey.Tags, user.Tags = tags, tags
 		// Place perms if we have them.
 		if perms != nil {
 			// nkey takes precedent.
@@ -1873,6 +3418,25 @@ func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]erro
 	return keys, users, nil
 }
 
+// Helper function to parse the tags of a user, that its permissions can
+// reference.
+func parseUserTags(tk token, v interface{}) (map[string]string, error) {
+	tm, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected user tags to be a map, got %T", v)}
+	}
+	tags := make(map[string]string, len(tm))
+	for name, tv := range tm {
+		vt, tv := unwrapValue(tv)
+		value, ok := tv.(string)
+		if !ok {
+			return nil, &configErr{vt, fmt.Sprintf("Expected user tag %q to be a string, got %T", name, tv)}
+		}
+		tags[name] = value
+	}
+	return tags, nil
+}
+
 // Helper function to parse user/account permissions
 func parseUserPermissions(mv interface{}, errors, warnings *[]error) (*Permissions, error) {
 	var (
@@ -2040,7 +3604,9 @@ func parseCurvePreferences(curveName string) (tls.CurveID, error) {
 }
 
 // Helper function to parse TLS configs.
-func parseTLS(v interface{}) (*TLSConfigOpts, error) {
+// Parse a TLS block. The certificate identity checks are only accepted
+// in the route context.
+func parseTLS(v interface{}, isRouteCtx bool) (*TLSConfigOpts, error) {
 	var (
 		tlsm map[string]interface{}
 		tc   = TLSConfigOpts{}
@@ -2115,6 +3681,31 @@ func parseTLS(v interface{}) (*TLSConfigOpts, error) {
 				}
 				tc.CurvePreferences = append(tc.CurvePreferences, cps)
 			}
+		case "expected_san", "expected_sans", "expected_ou", "expected_ous":
+			if !isRouteCtx {
+				return nil, &configErr{tk, fmt.Sprintf("error parsing tls config, %q is only supported for cluster", mk)}
+			}
+			var list []string
+			switch mv := mv.(type) {
+			case string:
+				list = []string{mv}
+			case []interface{}:
+				for _, e := range mv {
+					etk, e := unwrapValue(e)
+					es, ok := e.(string)
+					if !ok {
+						return nil, &configErr{etk, fmt.Sprintf("error parsing tls config, expected %q entries to be strings", mk)}
+					}
+					list = append(list, es)
+				}
+			default:
+				return nil, &configErr{tk, fmt.Sprintf("error parsing tls config, expected %q to be a string or an array", mk)}
+			}
+			if strings.HasPrefix(strings.ToLower(mk), "expected_san") {
+				tc.ExpectedSANs = list
+			} else {
+				tc.ExpectedOUs = list
+			}
 		case "timeout":
 			at := float64(0)
 			switch mv := mv.(type) {
@@ -2125,7 +3716,8 @@ func parseTLS(v interface{}) (*TLSConfigOpts, error) {
 			}
 			tc.Timeout = at
 		default:
-			return nil, &configErr{tk, fmt.Sprintf("error parsing tls config, unknown field [%q]", mk)}
+			return nil, &configErr{tk, fmt.Sprintf("error parsing tls config, unknown field [%q]%s",
+				mk, configFieldSuggestion(strings.ToLower(mk)))}
 		}
 	}
 
@@ -2188,6 +3780,38 @@ func GenTLSConfig(tc *TLSConfigOpts) (*tls.Config, error) {
 	return &config, nil
 }
 
+// genClientTLSConfig returns the configuration of a connection solicited
+// by the server, for which the certificate is optional and the CAs verify
+// the remote server.
+func genClientTLSConfig(tc *TLSConfigOpts) (*tls.Config, error) {
+	if tc.CertFile != _EMPTY_ || tc.KeyFile != _EMPTY_ {
+		config, err := GenTLSConfig(tc)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = config.ClientCAs
+		return config, nil
+	}
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		CipherSuites:       tc.Ciphers,
+		CurvePreferences:   tc.CurvePreferences,
+		InsecureSkipVerify: tc.Insecure,
+	}
+	if tc.CaFile != _EMPTY_ {
+		rootPEM, err := ioutil.ReadFile(tc.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading root ca certificate: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(rootPEM) {
+			return nil, fmt.Errorf("failed to parse root ca certificate")
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
 // MergeOptions will merge two options giving preference to the flagOpts
 // if the item is present.
 func MergeOptions(fileOpts, flagOpts *Options) *Options {
@@ -2239,9 +3863,18 @@ func MergeOptions(fileOpts, flagOpts *Options) *Options {
 	if flagOpts.PortsFileDir != "" {
 		opts.PortsFileDir = flagOpts.PortsFileDir
 	}
+	if flagOpts.PortsFile != "" {
+		opts.PortsFile = flagOpts.PortsFile
+	}
 	if flagOpts.ProfPort != 0 {
 		opts.ProfPort = flagOpts.ProfPort
 	}
+	if flagOpts.JetStream {
+		opts.JetStream = true
+	}
+	if flagOpts.StoreDir != "" {
+		opts.StoreDir = flagOpts.StoreDir
+	}
 	if flagOpts.Cluster.ListenStr != "" {
 		opts.Cluster.ListenStr = flagOpts.Cluster.ListenStr
 	}
@@ -2254,6 +3887,9 @@ func MergeOptions(fileOpts, flagOpts *Options) *Options {
 	if flagOpts.Cluster.Advertise != "" {
 		opts.Cluster.Advertise = flagOpts.Cluster.Advertise
 	}
+	if flagOpts.Cluster.Name != "" {
+		opts.Cluster.Name = flagOpts.Cluster.Name
+	}
 	if flagOpts.RoutesStr != "" {
 		mergeRoutes(&opts, flagOpts)
 	}
@@ -2416,6 +4052,60 @@ func setBaselineOptions(opts *Options) {
 		if opts.LeafNode.AuthTimeout == 0 {
 			opts.LeafNode.AuthTimeout = float64(AUTH_TIMEOUT) / float64(time.Second)
 		}
+		if opts.LeafNode.Websocket.Port != 0 {
+			if opts.LeafNode.Websocket.Host == "" {
+				opts.LeafNode.Websocket.Host = opts.LeafNode.Host
+			}
+			if opts.LeafNode.Websocket.TLSTimeout == 0 {
+				opts.LeafNode.Websocket.TLSTimeout = float64(TLS_TIMEOUT) / float64(time.Second)
+			}
+		}
+	}
+	if opts.Websocket.Port != 0 {
+		if opts.Websocket.Host == "" {
+			opts.Websocket.Host = opts.Host
+		}
+		if opts.Websocket.HandshakeTimeout == 0 {
+			opts.Websocket.HandshakeTimeout = wsDefaultHandshakeTimeout
+		}
+	}
+	if opts.MQTT.Port != 0 {
+		if opts.MQTT.Host == "" {
+			opts.MQTT.Host = opts.Host
+		}
+		if opts.MQTT.TLSTimeout == 0 {
+			opts.MQTT.TLSTimeout = float64(TLS_TIMEOUT) / float64(time.Second)
+		}
+		if opts.MQTT.MaxAckPending == 0 {
+			opts.MQTT.MaxAckPending = mqttDefaultMaxAckPending
+		}
+	}
+	if opts.STOMP.Port != 0 {
+		if opts.STOMP.Host == "" {
+			opts.STOMP.Host = opts.Host
+		}
+		if opts.STOMP.TLSTimeout == 0 {
+			opts.STOMP.TLSTimeout = float64(TLS_TIMEOUT) / float64(time.Second)
+		}
+	}
+	if opts.HTTPBridge.Port != 0 {
+		if opts.HTTPBridge.Host == "" {
+			opts.HTTPBridge.Host = opts.Host
+		}
+		if opts.HTTPBridge.RequestTimeout == 0 {
+			opts.HTTPBridge.RequestTimeout = httpBridgeDefaultRequestTimeout
+		}
+	}
+	if opts.OTel.Endpoint != _EMPTY_ {
+		if opts.OTel.ServiceName == _EMPTY_ {
+			opts.OTel.ServiceName = otelDefaultServiceName
+		}
+		if opts.OTel.FlushInterval == 0 {
+			opts.OTel.FlushInterval = otelDefaultFlushInterval
+		}
+		if opts.OTel.BatchSize == 0 {
+			opts.OTel.BatchSize = otelDefaultBatchSize
+		}
 	}
 	// Set this regardless of opts.LeafNode.Port
 	if opts.LeafNode.ReconnectInterval == 0 {
@@ -2439,6 +4129,9 @@ func setBaselineOptions(opts *Options) {
 	if opts.LameDuckDuration == 0 {
 		opts.LameDuckDuration = DEFAULT_LAME_DUCK_DURATION
 	}
+	if opts.AccountErrorWindow == 0 {
+		opts.AccountErrorWindow = DEFAULT_ACCOUNT_ERROR_WINDOW
+	}
 	if opts.Gateway.Port != 0 {
 		if opts.Gateway.Host == "" {
 			opts.Gateway.Host = DEFAULT_HOST
@@ -2456,6 +4149,15 @@ func setBaselineOptions(opts *Options) {
 	if opts.ReconnectErrorReports == 0 {
 		opts.ReconnectErrorReports = DEFAULT_RECONNECT_ERROR_REPORTS
 	}
+	// In config mode, use the default system account if it has been defined.
+	if opts.SystemAccount == "" && len(opts.TrustedKeys) == 0 && len(opts.TrustedOperators) == 0 {
+		for _, acc := range opts.Accounts {
+			if acc.Name == DEFAULT_SYSTEM_ACCOUNT {
+				opts.SystemAccount = DEFAULT_SYSTEM_ACCOUNT
+				break
+			}
+		}
+	}
 }
 
 // ConfigureOptions accepts a flag set and augment it with NATS Server
@@ -2499,11 +4201,14 @@ func ConfigureOptions(fs *flag.FlagSet, args []string, printVersion, printHelp,
 	fs.StringVar(&configFile, "c", "", "Configuration file.")
 	fs.StringVar(&configFile, "config", "", "Configuration file.")
 	fs.BoolVar(&opts.CheckConfig, "t", false, "Check configuration and exit.")
-	fs.StringVar(&signal, "sl", "", "Send signal to nats-server process (stop, quit, reopen, reload)")
-	fs.StringVar(&signal, "signal", "", "Send signal to nats-server process (stop, quit, reopen, reload)")
+	fs.BoolVar(&opts.ShowConfig, "show_config", false, "Print the effective configuration and exit.")
+	fs.BoolVar(&opts.ShowConfig, "show-config", false, "Print the effective configuration and exit.")
+	fs.StringVar(&signal, "sl", "", "Send signal to nats-server process (stop, quit, reopen, reload, rotate, ldm, term)")
+	fs.StringVar(&signal, "signal", "", "Send signal to nats-server process (stop, quit, reopen, reload, rotate, ldm, term)")
 	fs.StringVar(&opts.PidFile, "P", "", "File to store process pid.")
 	fs.StringVar(&opts.PidFile, "pid", "", "File to store process pid.")
 	fs.StringVar(&opts.PortsFileDir, "ports_file_dir", "", "Creates a ports file in the specified directory (<executable_name>_<pid>.ports)")
+	fs.StringVar(&opts.PortsFile, "ports_file", "", "Creates a ports file with the given name.")
 	fs.StringVar(&opts.LogFile, "l", "", "File to store logging output.")
 	fs.StringVar(&opts.LogFile, "log", "", "File to store logging output.")
 	fs.BoolVar(&opts.Syslog, "s", false, "Enable syslog as log method.")
@@ -2517,8 +4222,13 @@ func ConfigureOptions(fs *flag.FlagSet, args []string, printVersion, printHelp,
 	fs.StringVar(&opts.Cluster.ListenStr, "cluster", "", "Cluster url from which members can solicit routes.")
 	fs.StringVar(&opts.Cluster.ListenStr, "cluster_listen", "", "Cluster url from which members can solicit routes.")
 	fs.StringVar(&opts.Cluster.Advertise, "cluster_advertise", "", "Cluster URL to advertise to other servers.")
+	fs.StringVar(&opts.Cluster.Name, "cluster_name", "", "Cluster name, generated if not set.")
 	fs.BoolVar(&opts.Cluster.NoAdvertise, "no_advertise", false, "Advertise known cluster IPs to clients.")
 	fs.IntVar(&opts.Cluster.ConnectRetries, "connect_retries", 0, "For implicit routes, number of connect retries")
+	fs.BoolVar(&opts.JetStream, "js", false, "Enable JetStream.")
+	fs.BoolVar(&opts.JetStream, "jetstream", false, "Enable JetStream.")
+	fs.StringVar(&opts.StoreDir, "sd", "", "Storage directory.")
+	fs.StringVar(&opts.StoreDir, "store_dir", "", "Storage directory.")
 	fs.BoolVar(&showTLSHelp, "help_tls", false, "TLS help.")
 	fs.BoolVar(&opts.TLS, "tls", false, "Enable TLS.")
 	fs.BoolVar(&opts.TLSVerify, "tlsverify", false, "Enable TLS with client verification.")
@@ -2609,6 +4319,10 @@ func ConfigureOptions(fs *flag.FlagSet, args []string, printVersion, printHelp,
 		err := opts.ProcessConfigFile(configFile)
 		if err != nil {
 			if opts.CheckConfig {
+				// Reported with the semantic checks.
+				if _, ok := err.(*processConfigErr); ok {
+					return opts, nil
+				}
 				return nil, err
 			}
 
@@ -0,0 +1,362 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	otelDefaultServiceName   = "nats-server"
+	otelDefaultFlushInterval = time.Second
+	otelDefaultBatchSize     = 512
+	otelExportTimeout        = 5 * time.Second
+
+	// Name of the W3C trace context header.
+	otelTraceParent = "traceparent"
+	// Length of "00-<trace-id>-<parent-id>-<flags>".
+	otelTraceParentLen = 55
+	// Offset of the parent-id in the traceparent value.
+	otelParentIDOffset = 36
+	// Sampled bit of the trace flags.
+	otelSampled = byte(0x01)
+
+	// OTLP span kinds.
+	otelKindProducer = 4
+	otelKindConsumer = 5
+)
+
+// A span recorded by the server for a traced message.
+type otelSpan struct {
+	name     string
+	kind     int
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	start    time.Time
+	end      time.Time
+	attrs    []string // Key and value pairs.
+}
+
+// Batches the spans and exports them to an OTLP/HTTP endpoint.
+type otelExporter struct {
+	srv      *Server
+	endpoint string
+	headers  map[string]string
+	resource []otlpKeyValue
+	interval time.Duration
+	batch    int
+	spans    chan *otelSpan
+	hc       *http.Client
+	failing  bool
+}
+
+func newOTelExporter(s *Server, o *OTelOpts) *otelExporter {
+	return &otelExporter{
+		srv:      s,
+		endpoint: o.Endpoint,
+		headers:  o.Headers,
+		resource: []otlpKeyValue{
+			otlpString("service.name", o.ServiceName),
+			otlpString("service.instance.id", s.info.ID),
+		},
+		interval: o.FlushInterval,
+		batch:    o.BatchSize,
+		// Spans are dropped if the exporter can not keep up.
+		spans: make(chan *otelSpan, 8*o.BatchSize),
+		hc:    &http.Client{Timeout: otelExportTimeout},
+	}
+}
+
+func validateOTelOptions(o *Options) error {
+	oo := &o.OTel
+	if oo.Endpoint == _EMPTY_ {
+		return nil
+	}
+	u, err := url.Parse(oo.Endpoint)
+	if err != nil {
+		return fmt.Errorf("otel endpoint %q is invalid: %v", oo.Endpoint, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == _EMPTY_ {
+		return fmt.Errorf("otel endpoint should be an http or https URL, got %q", oo.Endpoint)
+	}
+	if oo.BatchSize < 0 {
+		return fmt.Errorf("otel batch_size can not be negative")
+	}
+	if oo.FlushInterval < 0 {
+		return fmt.Errorf("otel flush_interval can not be negative")
+	}
+	return nil
+}
+
+// Parses the traceparent value, returning false if it is not valid.
+func otelParseTraceParent(tp []byte, span *otelSpan) (flags byte, ok bool) {
+	if len(tp) < otelTraceParentLen || tp[2] != '-' || tp[35] != '-' || tp[52] != '-' {
+		return 0, false
+	}
+	// Version 0xff is forbidden.
+	if tp[0] == 'f' && tp[1] == 'f' {
+		return 0, false
+	}
+	var fb [1]byte
+	if _, err := hex.Decode(span.traceID[:], tp[3:35]); err != nil {
+		return 0, false
+	}
+	if _, err := hex.Decode(span.parentID[:], tp[36:52]); err != nil {
+		return 0, false
+	}
+	if _, err := hex.Decode(fb[:], tp[53:55]); err != nil {
+		return 0, false
+	}
+	if span.traceID == [16]byte{} || span.parentID == [8]byte{} {
+		return 0, false
+	}
+	return fb[0], true
+}
+
+// Starts the span of an inbound message with a sampled traceparent header.
+// The parent-id of the header is replaced by the id of the span, so that
+// the spans of the next hops and of the subscribers are its children.
+func (ot *otelExporter) startSpan(c *client, hdr []byte) *otelSpan {
+	// The value is a slice of the header block, updated in place.
+	tp := getHeader(otelTraceParent, hdr)
+	if len(tp) < otelTraceParentLen {
+		return nil
+	}
+	tp = tp[:otelTraceParentLen]
+	span := &otelSpan{kind: otelKindConsumer, start: time.Now()}
+	if flags, ok := otelParseTraceParent(tp, span); !ok || flags&otelSampled == 0 {
+		return nil
+	}
+	if _, err := io.ReadFull(rand.Reader, span.spanID[:]); err != nil {
+		return nil
+	}
+	hex.Encode(tp[otelParentIDOffset:otelParentIDOffset+16], span.spanID[:])
+
+	switch c.kind {
+	case CLIENT:
+		span.name = "ingress"
+	case ROUTER:
+		span.name = "route hop"
+	case GATEWAY:
+		span.name = "gateway hop"
+	case LEAF:
+		span.name = "leafnode hop"
+	}
+	span.attrs = []string{
+		"messaging.system", "nats",
+		"messaging.destination.name", string(c.pa.subject),
+		"nats.server_id", ot.srv.info.ID,
+		"nats.client_id", strconv.FormatUint(c.cid, 10),
+	}
+	if acc := c.acc; acc != nil {
+		span.attrs = append(span.attrs, "nats.account", acc.Name)
+	}
+	return span
+}
+
+// Ends the span of an inbound message once it has been processed.
+func (ot *otelExporter) endSpan(span *otelSpan) {
+	span.end = time.Now()
+	ot.record(span)
+}
+
+// Records the delivery of a traced message to a client.
+// Lock of the client is held on entry.
+func (ot *otelExporter) delivered(parent *otelSpan, client *client, subject []byte) {
+	now := time.Now()
+	span := &otelSpan{
+		name:     "delivery",
+		kind:     otelKindProducer,
+		traceID:  parent.traceID,
+		parentID: parent.spanID,
+		start:    now,
+		end:      now,
+		attrs: []string{
+			"messaging.system", "nats",
+			"messaging.destination.name", string(subject),
+			"nats.server_id", ot.srv.info.ID,
+			"nats.client_id", strconv.FormatUint(client.cid, 10),
+		},
+	}
+	if _, err := io.ReadFull(rand.Reader, span.spanID[:]); err != nil {
+		return
+	}
+	if acc := client.acc; acc != nil {
+		span.attrs = append(span.attrs, "nats.account", acc.Name)
+	}
+	ot.record(span)
+}
+
+func (ot *otelExporter) record(span *otelSpan) {
+	select {
+	case ot.spans <- span:
+	default:
+	}
+}
+
+// Exports the recorded spans until the server shuts down.
+func (ot *otelExporter) run() {
+	s := ot.srv
+	defer s.grWG.Done()
+
+	t := time.NewTicker(ot.interval)
+	defer t.Stop()
+	batch := make([]*otelSpan, 0, ot.batch)
+	for {
+		select {
+		case span := <-ot.spans:
+			batch = append(batch, span)
+			if len(batch) >= ot.batch {
+				ot.export(batch)
+				batch = batch[:0]
+			}
+		case <-t.C:
+			if len(batch) > 0 {
+				ot.export(batch)
+				batch = batch[:0]
+			}
+		case <-s.quitCh:
+			for len(ot.spans) > 0 && len(batch) < ot.batch {
+				batch = append(batch, <-ot.spans)
+			}
+			if len(batch) > 0 {
+				ot.export(batch)
+			}
+			return
+		}
+	}
+}
+
+// OTLP JSON encoding of the spans.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func otlpString(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpValue{StringValue: value}}
+}
+
+func (ot *otelExporter) export(batch []*otelSpan) {
+	s := ot.srv
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, span := range batch {
+		ospan := otlpSpan{
+			TraceID:           hex.EncodeToString(span.traceID[:]),
+			SpanID:            hex.EncodeToString(span.spanID[:]),
+			ParentSpanID:      hex.EncodeToString(span.parentID[:]),
+			Name:              span.name,
+			Kind:              span.kind,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+		}
+		for i := 0; i+1 < len(span.attrs); i += 2 {
+			ospan.Attributes = append(ospan.Attributes, otlpString(span.attrs[i], span.attrs[i+1]))
+		}
+		spans = append(spans, ospan)
+	}
+	body, err := json.Marshal(&otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: ot.resource},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: otelDefaultServiceName, Version: VERSION},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		s.Errorf("Error encoding spans: %v", err)
+		return
+	}
+	if err := ot.post(body); err != nil {
+		// Only report the first failure until the export succeeds again.
+		if !ot.failing {
+			s.Warnf("Error exporting spans to %q: %v", ot.endpoint, err)
+			ot.failing = true
+		}
+		return
+	}
+	if ot.failing {
+		s.Noticef("Exporting spans to %q again", ot.endpoint)
+		ot.failing = false
+	}
+}
+
+func (ot *otelExporter) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, ot.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range ot.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := ot.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	return nil
+}
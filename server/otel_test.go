@@ -0,0 +1,233 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOTelConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		otel {
+			endpoint: "http://127.0.0.1:4318/v1/traces"
+			headers { Authorization: "Bearer token" }
+			flush_interval: "100ms"
+		}
+	`))
+	defer os.Remove(conf)
+	o, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	setBaselineOptions(o)
+	oo := o.OTel
+	if oo.Endpoint != "http://127.0.0.1:4318/v1/traces" || oo.Headers["Authorization"] != "Bearer token" ||
+		oo.FlushInterval != 100*time.Millisecond || oo.ServiceName != otelDefaultServiceName ||
+		oo.BatchSize != otelDefaultBatchSize {
+		t.Fatalf("Unexpected otel options: %+v", oo)
+	}
+	if err := validateOptions(o); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	o.OTel.Endpoint = "127.0.0.1:4318"
+	if err := validateOptions(o); err == nil || !strings.Contains(err.Error(), "otel endpoint") {
+		t.Fatalf("Expected an error about the endpoint, got %v", err)
+	}
+}
+
+func TestOTelTraceParent(t *testing.T) {
+	const tp = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	for _, test := range []struct {
+		name    string
+		hdr     string
+		sampled bool
+		ok      bool
+	}{
+		{"lower case", "NATS/1.0\r\nA: B\r\ntraceparent: " + tp + "\r\n\r\n", true, true},
+		{"canonical", "NATS/1.0\r\nTraceparent: " + tp + "\r\n\r\n", true, true},
+		{"not sampled", "NATS/1.0\r\ntraceparent: " + tp[:53] + "00\r\n\r\n", false, true},
+		{"missing", "NATS/1.0\r\nA: B\r\n\r\n", false, false},
+		{"no headers", "NATS/1.0\r\n\r\n", false, false},
+		{"too short", "NATS/1.0\r\ntraceparent: 00-0af7\r\n\r\n", false, false},
+		{"zero trace id", "NATS/1.0\r\ntraceparent: 00-" + strings.Repeat("0", 32) + tp[35:] + "\r\n\r\n", false, false},
+		{"bad version", "NATS/1.0\r\ntraceparent: ff" + tp[2:] + "\r\n\r\n", false, false},
+		{"not hex", "NATS/1.0\r\ntraceparent: " + tp[:10] + "zz" + tp[12:] + "\r\n\r\n", false, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			hdr := []byte(test.hdr)
+			tp := getHeader(otelTraceParent, hdr)
+			var span otelSpan
+			var flags byte
+			ok := len(tp) >= otelTraceParentLen
+			if ok {
+				flags, ok = otelParseTraceParent(tp[:otelTraceParentLen], &span)
+			}
+			if ok != test.ok {
+				t.Fatalf("Expected valid to be %v, got %v", test.ok, ok)
+			}
+			if ok && (flags&otelSampled != 0) != test.sampled {
+				t.Fatalf("Expected sampled to be %v, got flags %x", test.sampled, flags)
+			}
+		})
+	}
+}
+
+// Collects the spans posted to it.
+type testOTelCollector struct {
+	*httptest.Server
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+func newTestOTelCollector(t *testing.T) *testOTelCollector {
+	oc := &testOTelCollector{}
+	oc.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var traces otlpTraces
+		if err := json.NewDecoder(r.Body).Decode(&traces); err != nil {
+			t.Errorf("Error decoding spans: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		oc.mu.Lock()
+		for _, rs := range traces.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				oc.spans = append(oc.spans, ss.Spans...)
+			}
+		}
+		oc.mu.Unlock()
+	}))
+	return oc
+}
+
+func (oc *testOTelCollector) span(name string) *otlpSpan {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	for i := range oc.spans {
+		if oc.spans[i].Name == name {
+			sp := oc.spans[i]
+			return &sp
+		}
+	}
+	return nil
+}
+
+func testOTelConn(t *testing.T, o *Options) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	nc, err := net.Dial("tcp", net.JoinHostPort(o.Host, strconv.Itoa(o.Port)))
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	br := bufio.NewReader(nc)
+	if l, _ := br.ReadString('\n'); !strings.HasPrefix(l, "INFO ") {
+		t.Fatalf("Expected INFO, got %q", l)
+	}
+	nc.Write([]byte("CONNECT {\"verbose\":false,\"headers\":true}\r\nPING\r\n"))
+	if l, _ := br.ReadString('\n'); l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q", l)
+	}
+	return nc, br
+}
+
+func TestOTelSpans(t *testing.T) {
+	oc := newTestOTelCollector(t)
+	defer oc.Close()
+
+	o1 := DefaultOptions()
+	o1.Cluster.Name = "A"
+	o1.Cluster.Host = "127.0.0.1"
+	o1.Cluster.Port = -1
+	o1.OTel = OTelOpts{Endpoint: oc.URL, FlushInterval: 20 * time.Millisecond}
+	s1 := RunServer(o1)
+	defer s1.Shutdown()
+
+	o2 := DefaultOptions()
+	o2.Cluster.Name = "A"
+	o2.Cluster.Host = "127.0.0.1"
+	o2.Cluster.Port = -1
+	o2.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", o1.Cluster.Port))
+	o2.OTel = o1.OTel
+	s2 := RunServer(o2)
+	defer s2.Shutdown()
+	checkClusterFormed(t, s1, s2)
+
+	sc, sr := testOTelConn(t, o2)
+	defer sc.Close()
+	sc.Write([]byte("SUB foo 1\r\nPING\r\n"))
+	if l, _ := sr.ReadString('\n'); l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q", l)
+	}
+	checkExpectedSubs(t, 1, s1)
+
+	const (
+		traceID  = "0af7651916cd43dd8448eb211c80319c"
+		parentID = "b7ad6b7169203331"
+	)
+	hdr := fmt.Sprintf("NATS/1.0\r\ntraceparent: 00-%s-%s-01\r\n\r\n", traceID, parentID)
+	pc, pr := testOTelConn(t, o1)
+	defer pc.Close()
+	pc.Write([]byte(fmt.Sprintf("HPUB foo %d %d\r\n%shello\r\nPING\r\n", len(hdr), len(hdr)+5, hdr)))
+	if l, _ := pr.ReadString('\n'); l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q", l)
+	}
+
+	expected := fmt.Sprintf("HMSG foo 1 %d %d\r\n", len(hdr), len(hdr)+5)
+	if l, _ := sr.ReadString('\n'); l != expected {
+		t.Fatalf("Expected %q, got %q", expected, l)
+	}
+	buf := make([]byte, len(hdr)+5+2)
+	if _, err := io.ReadFull(sr, buf); err != nil {
+		t.Fatalf("Error reading message: %v", err)
+	}
+	tp := string(getHeader(otelTraceParent, buf))
+
+	var ingress, hop, delivery *otlpSpan
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		ingress, hop, delivery = oc.span("ingress"), oc.span("route hop"), oc.span("delivery")
+		if ingress == nil || hop == nil || delivery == nil {
+			return fmt.Errorf("Spans not exported yet")
+		}
+		return nil
+	})
+	for _, sp := range []*otlpSpan{ingress, hop, delivery} {
+		if sp.TraceID != traceID {
+			t.Fatalf("Unexpected trace id in %+v", sp)
+		}
+	}
+	if ingress.ParentSpanID != parentID {
+		t.Fatalf("Expected the ingress span to be a child of the publisher, got %+v", ingress)
+	}
+	if hop.ParentSpanID != ingress.SpanID {
+		t.Fatalf("Expected the route hop span to be a child of the ingress span, got %+v", hop)
+	}
+	if delivery.ParentSpanID != hop.SpanID {
+		t.Fatalf("Expected the delivery span to be a child of the route hop span, got %+v", delivery)
+	}
+	// The subscriber gets the route hop span as parent.
+	if want := fmt.Sprintf("00-%s-%s-01", traceID, hop.SpanID); tp != want {
+		t.Fatalf("Expected traceparent %q, got %q", want, tp)
+	}
+}
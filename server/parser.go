@@ -23,9 +23,14 @@ type pubArg struct {
 	account []byte
 	subject []byte
 	reply   []byte
+	deliver []byte // Subject presented to local subscribers, if different.
 	szb     []byte
+	hdb     []byte
 	queues  [][]byte
 	size    int
+	hdr     int       // Size of the header block, 0 if the message has none.
+	trace   *otelSpan // Span of the message if traced.
+	mt      *msgTrace // Trace of the message if it has a trace destination.
 }
 
 type parserState int
@@ -37,6 +42,11 @@ type parseState struct {
 	argBuf  []byte
 	msgBuf  []byte
 	scratch [MAX_CONTROL_LINE_SIZE]byte
+
+	// These are reused across messages so that parsing the arguments
+	// of routed messages and messages with headers does not allocate.
+	msgArgs  [][]byte
+	noHdrBuf []byte
 }
 
 // Parser constants
@@ -89,6 +99,9 @@ const (
 	OP_LS
 	OP_R
 	OP_RS
+	OP_RB
+	OP_RB_SPC
+	RB_ARG
 	OP_U
 	OP_UN
 	OP_UNS
@@ -106,6 +119,22 @@ const (
 	OP_INF
 	OP_INFO
 	INFO_ARG
+	OP_H
+	OP_HP
+	OP_HPU
+	OP_HPUB
+	OP_HPUB_SPC
+	HPUB_ARG
+	OP_HM
+	OP_HMS
+	OP_HMSG
+	OP_HMSG_SPC
+	HMSG_ARG
+	OP_D
+	OP_DR
+	OP_DRA
+	OP_DRAI
+	OP_DRAIN
 )
 
 func (c *client) parse(buf []byte) error {
@@ -166,8 +195,16 @@ func (c *client) parse(buf []byte) error {
 				}
 			case 'C', 'c':
 				c.state = OP_C
+			case 'H', 'h':
+				c.state = OP_H
 			case 'I', 'i':
 				c.state = OP_I
+			case 'D', 'd':
+				if c.kind != CLIENT {
+					goto parseErr
+				} else {
+					c.state = OP_D
+				}
 			case '+':
 				c.state = OP_PLUS
 			case '-':
@@ -235,6 +272,131 @@ func (c *client) parse(buf []byte) error {
 					c.argBuf = append(c.argBuf, b)
 				}
 			}
+		case OP_H:
+			switch b {
+			case 'P', 'p':
+				if c.kind != CLIENT {
+					goto parseErr
+				}
+				c.state = OP_HP
+			case 'M', 'm':
+				if c.kind == CLIENT {
+					goto parseErr
+				}
+				c.state = OP_HM
+			default:
+				goto parseErr
+			}
+		case OP_HP:
+			switch b {
+			case 'U', 'u':
+				c.state = OP_HPU
+			default:
+				goto parseErr
+			}
+		case OP_HPU:
+			switch b {
+			case 'B', 'b':
+				c.state = OP_HPUB
+			default:
+				goto parseErr
+			}
+		case OP_HPUB:
+			switch b {
+			case ' ', '\t':
+				c.state = OP_HPUB_SPC
+			default:
+				goto parseErr
+			}
+		case OP_HPUB_SPC:
+			switch b {
+			case ' ', '\t':
+				continue
+			default:
+				c.state = HPUB_ARG
+				c.as = i
+			}
+		case HPUB_ARG:
+			switch b {
+			case '\r':
+				c.drop = 1
+			case '\n':
+				var arg []byte
+				if c.argBuf != nil {
+					arg = c.argBuf
+					c.argBuf = nil
+				} else {
+					arg = buf[c.as : i-c.drop]
+				}
+				if err := c.processHeaderPub(c.trace, arg); err != nil {
+					return err
+				}
+				c.drop, c.as, c.state = 0, i+1, MSG_PAYLOAD
+				if c.msgBuf == nil {
+					i = c.as + c.pa.size - LEN_CR_LF
+				}
+			default:
+				if c.argBuf != nil {
+					c.argBuf = append(c.argBuf, b)
+				}
+			}
+		case OP_HM:
+			switch b {
+			case 'S', 's':
+				c.state = OP_HMS
+			default:
+				goto parseErr
+			}
+		case OP_HMS:
+			switch b {
+			case 'G', 'g':
+				c.state = OP_HMSG
+			default:
+				goto parseErr
+			}
+		case OP_HMSG:
+			switch b {
+			case ' ', '\t':
+				c.state = OP_HMSG_SPC
+			default:
+				goto parseErr
+			}
+		case OP_HMSG_SPC:
+			switch b {
+			case ' ', '\t':
+				continue
+			default:
+				c.state = HMSG_ARG
+				c.as = i
+			}
+		case HMSG_ARG:
+			switch b {
+			case '\r':
+				c.drop = 1
+			case '\n':
+				var arg []byte
+				if c.argBuf != nil {
+					arg = c.argBuf
+					c.argBuf = nil
+				} else {
+					arg = buf[c.as : i-c.drop]
+				}
+				var err error
+				if c.kind == ROUTER || c.kind == GATEWAY {
+					err = c.processRoutedHeaderMsgArgs(c.trace, arg)
+				} else if c.kind == LEAF {
+					err = c.processLeafHeaderMsgArgs(c.trace, arg)
+				}
+				if err != nil {
+					return err
+				}
+				c.drop, c.as, c.state = 0, i+1, MSG_PAYLOAD
+				i = c.as + c.pa.size - LEN_CR_LF
+			default:
+				if c.argBuf != nil {
+					c.argBuf = append(c.argBuf, b)
+				}
+			}
 		case MSG_PAYLOAD:
 			if c.msgBuf != nil {
 				// copy as much as we can to the buffer and skip ahead.
@@ -283,6 +445,7 @@ func (c *client) parse(buf []byte) error {
 			// Drop all pub args
 			c.pa.arg, c.pa.pacache, c.pa.account, c.pa.subject = nil, nil, nil, nil
 			c.pa.reply, c.pa.szb, c.pa.queues = nil, nil, nil
+			c.pa.hdr, c.pa.hdb = 0, nil
 		case OP_A:
 			switch b {
 			case '+':
@@ -448,9 +611,50 @@ func (c *client) parse(buf []byte) error {
 				c.state = OP_RS
 			case 'M', 'm':
 				c.state = OP_M
+			case 'B', 'b':
+				if c.kind != ROUTER {
+					goto parseErr
+				}
+				c.state = OP_RB
+			default:
+				goto parseErr
+			}
+		case OP_RB:
+			switch b {
+			case ' ', '\t':
+				c.state = OP_RB_SPC
 			default:
 				goto parseErr
 			}
+		case OP_RB_SPC:
+			switch b {
+			case ' ', '\t':
+				continue
+			default:
+				c.state = RB_ARG
+				c.as = i
+			}
+		case RB_ARG:
+			switch b {
+			case '\r':
+				c.drop = 1
+			case '\n':
+				var arg []byte
+				if c.argBuf != nil {
+					arg = c.argBuf
+					c.argBuf = nil
+				} else {
+					arg = buf[c.as : i-c.drop]
+				}
+				if err := c.processRouteBatch(arg, len(buf)-i-1); err != nil {
+					return err
+				}
+				c.drop, c.as, c.state = 0, i+1, OP_START
+			default:
+				if c.argBuf != nil {
+					c.argBuf = append(c.argBuf, b)
+				}
+			}
 		case OP_RS:
 			switch b {
 			case '+':
@@ -576,6 +780,40 @@ func (c *client) parse(buf []byte) error {
 				c.processPong()
 				c.drop, c.state = 0, OP_START
 			}
+		case OP_D:
+			switch b {
+			case 'R', 'r':
+				c.state = OP_DR
+			default:
+				goto parseErr
+			}
+		case OP_DR:
+			switch b {
+			case 'A', 'a':
+				c.state = OP_DRA
+			default:
+				goto parseErr
+			}
+		case OP_DRA:
+			switch b {
+			case 'I', 'i':
+				c.state = OP_DRAI
+			default:
+				goto parseErr
+			}
+		case OP_DRAI:
+			switch b {
+			case 'N', 'n':
+				c.state = OP_DRAIN
+			default:
+				goto parseErr
+			}
+		case OP_DRAIN:
+			switch b {
+			case '\n':
+				c.processDrain()
+				c.drop, c.state = 0, OP_START
+			}
 		case OP_C:
 			switch b {
 			case 'O', 'o':
@@ -757,6 +995,11 @@ func (c *client) parse(buf []byte) error {
 					return err
 				}
 				c.drop, c.as, c.state = 0, i+1, OP_START
+				// Everything past the INFO signaling the start of route
+				// compression needs to be decompressed by the readLoop.
+				if c.kind == ROUTER && c.checkRouteDecompress(buf[i+1:]) {
+					return errRouteCompressionStarted
+				}
 			default:
 				if c.argBuf != nil {
 					c.argBuf = append(c.argBuf, b)
@@ -845,7 +1088,8 @@ func (c *client) parse(buf []byte) error {
 	if c.state == SUB_ARG || c.state == UNSUB_ARG || c.state == PUB_ARG ||
 		c.state == ASUB_ARG || c.state == AUSUB_ARG ||
 		c.state == MSG_ARG || c.state == MINUS_ERR_ARG ||
-		c.state == CONNECT_ARG || c.state == INFO_ARG {
+		c.state == CONNECT_ARG || c.state == INFO_ARG ||
+		c.state == HPUB_ARG || c.state == HMSG_ARG || c.state == RB_ARG {
 		// Setup a holder buffer to deal with split buffer scenario.
 		if c.argBuf == nil {
 			c.argBuf = c.scratch[:0]
@@ -922,10 +1166,17 @@ func (c *client) clonePubArg() {
 	c.argBuf = c.scratch[:0]
 	c.argBuf = append(c.argBuf, c.pa.arg...)
 
-	// This is a routed msg
-	if c.pa.account != nil {
+	switch {
+	case c.pa.hdr > 0 && c.kind == LEAF:
+		c.processLeafHeaderMsgArgs(false, c.argBuf)
+	case c.pa.hdr > 0 && c.pa.account != nil:
+		c.processRoutedHeaderMsgArgs(false, c.argBuf)
+	case c.pa.hdr > 0:
+		c.processHeaderPub(false, c.argBuf)
+	case c.pa.account != nil:
+		// This is a routed msg
 		c.processRoutedMsgArgs(false, c.argBuf)
-	} else {
+	default:
 		c.processPub(false, c.argBuf)
 	}
 }
@@ -15,6 +15,7 @@ package server
 
 import (
 	"bytes"
+	"sync/atomic"
 	"testing"
 )
 
@@ -143,6 +144,25 @@ func TestParsePong(t *testing.T) {
 	}
 }
 
+func TestParseDrain(t *testing.T) {
+	c := dummyClient()
+	drain := []byte("DRAIN\r\n")
+	states := []parserState{OP_D, OP_DR, OP_DRA, OP_DRAI, OP_DRAIN, OP_DRAIN, OP_START}
+	for i, state := range states {
+		if err := c.parse(drain[i : i+1]); err != nil || c.state != state {
+			t.Fatalf("Unexpected: %d : %v\n", c.state, err)
+		}
+	}
+	if err := c.parse([]byte("drain  \r\n")); err != nil || c.state != OP_START {
+		t.Fatalf("Unexpected: %d : %v\n", c.state, err)
+	}
+	// Only clients can drain.
+	rc := dummyRouteClient()
+	if err := rc.parse(drain); err == nil {
+		t.Fatalf("Expected an error for a route")
+	}
+}
+
 func TestParseConnect(t *testing.T) {
 	c := dummyClient()
 	connect := []byte("CONNECT {\"verbose\":false,\"pedantic\":true,\"tls_required\":false}\r\n")
@@ -425,6 +445,170 @@ func TestParseRouteMsg(t *testing.T) {
 	}
 }
 
+func TestParseHeaderPub(t *testing.T) {
+	c := dummyClient()
+
+	hpub := []byte("HPUB foo 12 17\r\nNATS/1.0\r\n\r\nhello\r")
+	err := c.parse(hpub)
+	if err == nil {
+		t.Fatalf("Expected an error without headers support")
+	}
+
+	c = dummyClient()
+	c.headers = true
+	err = c.parse(hpub)
+	if err != nil || c.state != MSG_END_N {
+		t.Fatalf("Unexpected: %d : %v\n", c.state, err)
+	}
+	if !bytes.Equal(c.pa.subject, []byte("foo")) {
+		t.Fatalf("Did not parse subject correctly: 'foo' vs '%s'\n", c.pa.subject)
+	}
+	if c.pa.reply != nil {
+		t.Fatalf("Did not parse reply correctly: 'nil' vs '%s'\n", c.pa.reply)
+	}
+	if c.pa.hdr != 12 {
+		t.Fatalf("Did not parse header size correctly: 12 vs %d\n", c.pa.hdr)
+	}
+	if c.pa.size != 17 {
+		t.Fatalf("Did not parse msg size correctly: 17 vs %d\n", c.pa.size)
+	}
+
+	// Clear snapshots
+	c.argBuf, c.msgBuf, c.state = nil, nil, OP_START
+
+	hpub = []byte("HPUB foo.bar INBOX.22 12 23\r\nNATS/1.0\r\n\r\nhello world\r")
+	err = c.parse(hpub)
+	if err != nil || c.state != MSG_END_N {
+		t.Fatalf("Unexpected: %d : %v\n", c.state, err)
+	}
+	if !bytes.Equal(c.pa.subject, []byte("foo.bar")) {
+		t.Fatalf("Did not parse subject correctly: 'foo.bar' vs '%s'\n", c.pa.subject)
+	}
+	if !bytes.Equal(c.pa.reply, []byte("INBOX.22")) {
+		t.Fatalf("Did not parse reply correctly: 'INBOX.22' vs '%s'\n", c.pa.reply)
+	}
+	if c.pa.hdr != 12 {
+		t.Fatalf("Did not parse header size correctly: 12 vs %d\n", c.pa.hdr)
+	}
+	if c.pa.size != 23 {
+		t.Fatalf("Did not parse msg size correctly: 23 vs %d\n", c.pa.size)
+	}
+
+	// Clear snapshots
+	c.argBuf, c.msgBuf, c.state = nil, nil, OP_START
+
+	// The header block can not be larger than the message.
+	hpub = []byte("HPUB foo 18 17\r\nNATS/1.0\r\n\r\nhello\r")
+	if err := c.parse(hpub); err == nil {
+		t.Fatalf("Expected an error with a header size larger than the message")
+	}
+}
+
+func TestParseRouteHeaderMsg(t *testing.T) {
+	c := dummyRouteClient()
+
+	hmsg := []byte("HMSG $G foo.bar + reply baz 12 23\r\nNATS/1.0\r\n\r\nhello world\r")
+	err := c.parse(hmsg)
+	if err != nil || c.state != MSG_END_N {
+		t.Fatalf("Unexpected: %d : %v\n", c.state, err)
+	}
+	if !bytes.Equal(c.pa.account, []byte("$G")) {
+		t.Fatalf("Did not parse account correctly: '$G' vs '%s'\n", c.pa.account)
+	}
+	if !bytes.Equal(c.pa.subject, []byte("foo.bar")) {
+		t.Fatalf("Did not parse subject correctly: 'foo.bar' vs '%s'\n", c.pa.subject)
+	}
+	if !bytes.Equal(c.pa.reply, []byte("reply")) {
+		t.Fatalf("Did not parse reply correctly: 'reply' vs '%s'\n", c.pa.reply)
+	}
+	if len(c.pa.queues) != 1 || !bytes.Equal(c.pa.queues[0], []byte("baz")) {
+		t.Fatalf("Did not parse queues correctly: %q\n", c.pa.queues)
+	}
+	if c.pa.hdr != 12 {
+		t.Fatalf("Did not parse header size correctly: 12 vs %d\n", c.pa.hdr)
+	}
+	if c.pa.size != 23 {
+		t.Fatalf("Did not parse msg size correctly: 23 vs %d\n", c.pa.size)
+	}
+
+	// Clients can not send HMSG.
+	cc := dummyClient()
+	cc.headers = true
+	if err := cc.parse([]byte("HMSG foo 1 12 17\r\n")); err == nil {
+		t.Fatalf("Expected an error, got none")
+	}
+}
+
+func TestParseRouteMsgArgsNoAllocs(t *testing.T) {
+	c := dummyRouteClient()
+
+	for _, test := range []struct {
+		arg string
+		hdr bool
+	}{
+		{"$G foo.bar reply 5", false},
+		{"$G foo.bar + reply baz bat 5", false},
+		{"$G foo.bar | baz 12 17", true},
+	} {
+		arg := []byte(test.arg)
+		process := func() error { return c.processRoutedMsgArgs(false, arg) }
+		if test.hdr {
+			process = func() error { return c.processRoutedHeaderMsgArgs(false, arg) }
+		}
+		if err := process(); err != nil {
+			t.Fatalf("Unexpected error for %q: %v", arg, err)
+		}
+		// The arguments are kept in buffers reused across messages.
+		if n := testing.AllocsPerRun(100, func() { process() }); n != 0 {
+			t.Fatalf("Expected no allocations for %q, got %v", arg, n)
+		}
+	}
+	if len(c.pa.queues) != 1 || !bytes.Equal(c.pa.queues[0], []byte("baz")) {
+		t.Fatalf("Did not parse queues correctly: %q\n", c.pa.queues)
+	}
+	if c.pa.hdr != 12 || c.pa.size != 17 {
+		t.Fatalf("Did not parse sizes correctly: %d %d\n", c.pa.hdr, c.pa.size)
+	}
+}
+
+func TestParseRouteBatch(t *testing.T) {
+	c := dummyRouteClient()
+	c.route, c.mcl = &route{}, MAX_CONTROL_LINE_SIZE
+
+	// The bytes of the batch that follow the header in the same buffer
+	// are not left to read.
+	if err := c.parse([]byte("RB 15\r\n+OK\r\n")); err != nil {
+		t.Fatalf("Unexpected parse error: %v\n", err)
+	}
+	if c.state != OP_START || c.in.rbl != 10 {
+		t.Fatalf("Expected OP_START and 10 bytes left, got %d and %d\n", c.state, c.in.rbl)
+	}
+	// Split header.
+	c.in.rbl = 0
+	if err := c.parse([]byte("RB 1")); err != nil {
+		t.Fatalf("Unexpected parse error: %v\n", err)
+	}
+	if err := c.parse([]byte("024\r\n+OK\r\n+OK\r\n")); err != nil {
+		t.Fatalf("Unexpected parse error: %v\n", err)
+	}
+	if c.state != OP_START || c.in.rbl != 1014 {
+		t.Fatalf("Expected OP_START and 1014 bytes left, got %d and %d\n", c.state, c.in.rbl)
+	}
+	if n := atomic.LoadInt64(&c.route.bstats.in); n != 2 {
+		t.Fatalf("Expected 2 batches received, got %d", n)
+	}
+
+	c = dummyRouteClient()
+	c.route = &route{}
+	if err := c.parse([]byte("RB x\r\n")); err == nil {
+		t.Fatalf("Expected an error for a bad size, got none")
+	}
+	// Only routes send batches.
+	if err := dummyClient().parse([]byte("RB 5\r\n")); err == nil {
+		t.Fatalf("Expected an error for a client, got none")
+	}
+}
+
 func TestParseMsgSpace(t *testing.T) {
 	c := dummyRouteClient()
 
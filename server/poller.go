@@ -0,0 +1,341 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package server
+
+import (
+	"math/bits"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The poller drives the reads of the plain TCP client connections. Instead
+// of a readLoop goroutine blocked in a read for each connection, a single
+// goroutine waits for the sockets that are ready to be read, and a pool of
+// workers reads and processes what is ready, with read buffers shared by
+// all connections. A mostly idle connection then costs its writeLoop only.
+// Each socket is armed for one readiness event at a time, so that a
+// connection is only processed by one worker at a time, and armed again
+// once processed. The socket of a publisher paused on the pending bytes of
+// all connections is not armed again until they drop, instead of holding
+// a worker.
+
+// The reads can be driven by the poller on this platform.
+const pollerSupported = true
+
+// Number of ready sockets the poller waits for at once.
+const pollerMaxEvents = 256
+
+type poller struct {
+	srv    *Server
+	pq     *pollQueue
+	mu     sync.Mutex
+	conns  map[int]*pollConn
+	parked []*pollConn // Paused publishers, armed again once resumed.
+	work   chan *pollConn
+	wake   [2]int        // Pipe whose write end is closed to wake the poller on shutdown.
+	bufs   [32]sync.Pool // Read buffers, by the base 2 log of their size.
+	num    int64         // Number of connections, access is atomic.
+}
+
+// A connection read by the poller, with its socket.
+type pollConn struct {
+	c  *client
+	rc syscall.RawConn
+	fd int
+}
+
+// startPoller creates the poller and starts its goroutines, or keeps a
+// readLoop for each connection if the poller can not be created.
+func (s *Server) startPoller(opts *Options) {
+	pq, err := newPollQueue()
+	var wake [2]int
+	if err == nil {
+		if err = syscall.Pipe(wake[:]); err == nil {
+			syscall.CloseOnExec(wake[0])
+			syscall.CloseOnExec(wake[1])
+			if err = pq.add(wake[0]); err != nil {
+				syscall.Close(wake[0])
+				syscall.Close(wake[1])
+			}
+		}
+		if err != nil {
+			pq.close()
+		}
+	}
+	if err != nil {
+		s.Warnf("Error creating the poller, reading each connection from its own go routine: %v", err)
+		return
+	}
+	workers := opts.PollerWorkers
+	if workers <= 0 {
+		workers = 4 * runtime.GOMAXPROCS(0)
+	}
+	p := &poller{
+		srv:   s,
+		pq:    pq,
+		conns: make(map[int]*pollConn),
+		work:  make(chan *pollConn, pollerMaxEvents),
+		wake:  wake,
+	}
+	s.mu.Lock()
+	s.poller = p
+	s.mu.Unlock()
+	s.startGoRoutine(p.waitLoop)
+	for i := 0; i < workers; i++ {
+		s.startGoRoutine(p.workLoop)
+	}
+	s.Noticef("Reading client connections with a poller and %d workers (experimental)", workers)
+}
+
+// pollClient registers the client with the poller, if any, returning false
+// for the client to be read by a readLoop instead.
+// Lock should be held.
+func (s *Server) pollClient(c *client) bool {
+	p := s.poller
+	if p == nil {
+		return false
+	}
+	tc, ok := c.nc.(*net.TCPConn)
+	if !ok {
+		return false
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	fd := -1
+	rc.Control(func(sfd uintptr) { fd = int(sfd) })
+	if fd < 0 {
+		return false
+	}
+	// As done by the readLoop.
+	c.in.rsz = startBufSize
+	c.mcl = int32(s.getOpts().MaxControlLine)
+	c.pfd = fd
+	c.flags.set(readPolled)
+
+	p.mu.Lock()
+	p.conns[fd] = &pollConn{c: c, rc: rc, fd: fd}
+	p.mu.Unlock()
+	if err := p.pq.add(fd); err != nil {
+		p.mu.Lock()
+		delete(p.conns, fd)
+		p.mu.Unlock()
+		c.flags.clear(readPolled)
+		return false
+	}
+	atomic.AddInt64(&p.num, 1)
+	return true
+}
+
+// remove unregisters the client before its socket is closed, returning
+// false if it was not registered.
+func (p *poller) remove(c *client) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pc := p.conns[c.pfd]; pc != nil && pc.c == c {
+		delete(p.conns, c.pfd)
+		atomic.AddInt64(&p.num, -1)
+		return true
+	}
+	return false
+}
+
+// stop wakes the poller up for it to notice the server shutdown.
+func (p *poller) stop() {
+	syscall.Close(p.wake[1])
+}
+
+// Returns the number of connections read by the poller.
+func (p *poller) numConns() int {
+	return int(atomic.LoadInt64(&p.num))
+}
+
+func (p *poller) waitLoop() {
+	s := p.srv
+	defer s.grWG.Done()
+	defer p.pq.close()
+	defer syscall.Close(p.wake[0])
+
+	ready := make([]int, pollerMaxEvents)
+	for {
+		select {
+		case <-s.quitCh:
+			return
+		default:
+		}
+		n, err := p.pq.wait(ready)
+		if err != nil && err != syscall.EINTR {
+			s.Errorf("Error waiting on the poller: %v", err)
+			return
+		}
+		for _, fd := range ready[:n] {
+			if fd == p.wake[0] {
+				// Woken up by the shutdown.
+				continue
+			}
+			p.mu.Lock()
+			pc := p.conns[fd]
+			p.mu.Unlock()
+			if pc == nil {
+				continue
+			}
+			select {
+			case p.work <- pc:
+			case <-s.quitCh:
+				return
+			}
+		}
+	}
+}
+
+func (p *poller) workLoop() {
+	s := p.srv
+	defer s.grWG.Done()
+
+	for {
+		select {
+		case pc := <-p.work:
+			p.read(pc)
+		case <-s.quitCh:
+			return
+		}
+	}
+}
+
+// read reads and processes what is ready on the socket of the client, and
+// arms the socket again unless the connection is closed.
+func (p *poller) read(pc *pollConn) {
+	c := pc.c
+	c.mu.Lock()
+	closed, rsz := c.nc == nil, int(c.in.rsz)
+	c.mu.Unlock()
+	if closed {
+		return
+	}
+
+	b := p.getBuf(rsz)
+	defer p.putBuf(b)
+
+	var n int
+	var rerr error
+	err := pc.rc.Read(func(sfd uintptr) bool {
+		for {
+			n, rerr = syscall.Read(int(sfd), b)
+			if rerr != syscall.EINTR {
+				// Do not wait for the socket to be readable.
+				return true
+			}
+		}
+	})
+	if err == nil {
+		err = rerr
+	}
+	switch {
+	case err == syscall.EAGAIN:
+		// Nothing to read after all.
+	case err != nil:
+		c.setCloseErr(err.Error())
+		c.closeConnection(ReadError)
+		return
+	case n == 0:
+		c.closeConnection(ClientClosed)
+		return
+	default:
+		if ok, _ := c.processRead(b, n); !ok {
+			return
+		}
+		if c.pausePublisher() {
+			p.park(pc)
+			return
+		}
+	}
+	p.rearm(pc)
+}
+
+// rearm arms the socket of the connection again, unless it was removed.
+func (p *poller) rearm(pc *pollConn) {
+	// Removed under the lock before the socket is closed, so the socket is
+	// still the one of the connection while registered.
+	p.mu.Lock()
+	if p.conns[pc.fd] == pc {
+		p.pq.rearm(pc.fd)
+	}
+	p.mu.Unlock()
+}
+
+// park holds the connection of a paused publisher until the publishers
+// are resumed, or for up to maxPendingPause as done by the readLoop.
+func (p *poller) park(pc *pollConn) {
+	gate := p.srv.outPendingGate()
+	p.mu.Lock()
+	p.parked = append(p.parked, pc)
+	first := len(p.parked) == 1
+	p.mu.Unlock()
+	if first {
+		p.srv.startGoRoutine(func() { p.unparkLoop(gate) })
+	}
+}
+
+// unparkLoop arms again the sockets of the parked connections once the
+// publishers are resumed.
+func (p *poller) unparkLoop(gate chan struct{}) {
+	s := p.srv
+	defer s.grWG.Done()
+
+	if gate != nil {
+		select {
+		case <-gate:
+		case <-time.After(maxPendingPause):
+		case <-s.quitCh:
+			return
+		}
+	}
+	p.mu.Lock()
+	parked := p.parked
+	p.parked = nil
+	for _, pc := range parked {
+		if p.conns[pc.fd] == pc {
+			p.pq.rearm(pc.fd)
+		}
+	}
+	p.mu.Unlock()
+}
+
+// Returns a read buffer of the given size, a power of 2.
+func (p *poller) getBuf(size int) []byte {
+	if size&(size-1) != 0 {
+		return make([]byte, size)
+	}
+	if bp, ok := p.bufs[bits.TrailingZeros(uint(size))].Get().(*[]byte); ok {
+		return *bp
+	}
+	return make([]byte, size)
+}
+
+func (p *poller) putBuf(b []byte) {
+	size := cap(b)
+	if size&(size-1) != 0 {
+		return
+	}
+	b = b[:size]
+	p.bufs[bits.TrailingZeros(uint(size))].Put(&b)
+}
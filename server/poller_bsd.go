@@ -0,0 +1,67 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin || freebsd || netbsd || openbsd
+// +build darwin freebsd netbsd openbsd
+
+package server
+
+import "syscall"
+
+// pollQueue waits for the sockets to be readable with kqueue.
+type pollQueue struct {
+	fd     int
+	events []syscall.Kevent_t
+}
+
+func newPollQueue() (*pollQueue, error) {
+	fd, err := syscall.Kqueue()
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(fd)
+	return &pollQueue{fd: fd, events: make([]syscall.Kevent_t, pollerMaxEvents)}, nil
+}
+
+// Arms the socket for one readiness event.
+func (pq *pollQueue) add(fd int) error {
+	var ev [1]syscall.Kevent_t
+	syscall.SetKevent(&ev[0], fd, syscall.EVFILT_READ, syscall.EV_ADD|syscall.EV_ONESHOT)
+	_, err := syscall.Kevent(pq.fd, ev[:], nil, nil)
+	return err
+}
+
+// Arms the socket again after its readiness event.
+func (pq *pollQueue) rearm(fd int) error {
+	return pq.add(fd)
+}
+
+// Waits for ready sockets, returning how many were placed in ready.
+func (pq *pollQueue) wait(ready []int) (int, error) {
+	events := pq.events
+	if len(ready) < len(events) {
+		events = events[:len(ready)]
+	}
+	n, err := syscall.Kevent(pq.fd, nil, events, nil)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		ready[i] = int(events[i].Ident)
+	}
+	return n, nil
+}
+
+func (pq *pollQueue) close() error {
+	return syscall.Close(pq.fd)
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "syscall"
+
+// pollQueue waits for the sockets to be readable with epoll.
+type pollQueue struct {
+	fd     int
+	events []syscall.EpollEvent
+}
+
+func newPollQueue() (*pollQueue, error) {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &pollQueue{fd: fd, events: make([]syscall.EpollEvent, pollerMaxEvents)}, nil
+}
+
+// Arms the socket for one readiness event.
+func (pq *pollQueue) add(fd int) error {
+	return pq.ctl(syscall.EPOLL_CTL_ADD, fd)
+}
+
+// Arms the socket again after its readiness event.
+func (pq *pollQueue) rearm(fd int) error {
+	return pq.ctl(syscall.EPOLL_CTL_MOD, fd)
+}
+
+func (pq *pollQueue) ctl(op, fd int) error {
+	ev := syscall.EpollEvent{
+		Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT,
+		Fd:     int32(fd),
+	}
+	return syscall.EpollCtl(pq.fd, op, fd, &ev)
+}
+
+// Waits for ready sockets, returning how many were placed in ready.
+func (pq *pollQueue) wait(ready []int) (int, error) {
+	events := pq.events
+	if len(ready) < len(events) {
+		events = events[:len(ready)]
+	}
+	n, err := syscall.EpollWait(pq.fd, events, -1)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		ready[i] = int(events[i].Fd)
+	}
+	return n, nil
+}
+
+func (pq *pollQueue) close() error {
+	return syscall.Close(pq.fd)
+}
@@ -0,0 +1,40 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package server
+
+// The reads can not be driven by a poller on this platform.
+const pollerSupported = false
+
+type poller struct{}
+
+func (s *Server) startPoller(opts *Options) {
+	s.Warnf("The poller is not supported on this platform, reading each connection from its own go routine")
+}
+
+func (s *Server) pollClient(c *client) bool {
+	return false
+}
+
+func (p *poller) remove(c *client) bool {
+	return false
+}
+
+func (p *poller) stop() {}
+
+func (p *poller) numConns() int {
+	return 0
+}
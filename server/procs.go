@@ -0,0 +1,148 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Where the cgroup file systems are mounted, a variable for the tests.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// Validates the GOMAXPROCS and CPU affinity options.
+func validateProcsOptions(o *Options) error {
+	if o.MaxProcs < 0 {
+		return fmt.Errorf("max_procs can not be negative")
+	}
+	if len(o.CPUAffinity) > 0 && !cpuAffinitySupported {
+		return fmt.Errorf("cpu_affinity is not supported on this platform")
+	}
+	for _, cpu := range o.CPUAffinity {
+		if cpu < 0 || cpu >= maxAffinityCPUs {
+			return fmt.Errorf("invalid cpu_affinity CPU %d", cpu)
+		}
+	}
+	return nil
+}
+
+// Bound of the CPUs of a list, whether supported or not.
+const maxCPUListCPU = 1 << 16
+
+// parseCPUList parses a list of CPUs and ranges of CPUs, such as "0-3,6".
+func parseCPUList(list string) ([]int, error) {
+	var cpus []int
+	for _, r := range strings.Split(list, ",") {
+		r = strings.TrimSpace(r)
+		first, last := r, r
+		if i := strings.IndexByte(r, '-'); i > 0 {
+			first, last = r[:i], r[i+1:]
+		}
+		lo, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU range %q", r)
+		}
+		hi, err := strconv.Atoi(last)
+		if err != nil || hi < lo || hi >= maxCPUListCPU {
+			return nil, fmt.Errorf("invalid CPU range %q", r)
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// configureProcs sets the CPU affinity of the process, then GOMAXPROCS from
+// the options, the affinity or the CPU quota of the container, so that the
+// runtime does not run more threads than the CPUs it can use.
+func (s *Server) configureProcs(opts *Options) {
+	if len(opts.CPUAffinity) > 0 {
+		if err := setCPUAffinity(opts.CPUAffinity); err != nil {
+			s.Errorf("Error setting the CPU affinity: %v", err)
+		} else {
+			s.Noticef("CPU affinity set to %v", opts.CPUAffinity)
+		}
+	}
+	procs, from := maxProcs(opts, runtime.NumCPU(), cgroupCPUQuota())
+	if procs > 0 && procs != runtime.GOMAXPROCS(0) {
+		runtime.GOMAXPROCS(procs)
+		s.Noticef("GOMAXPROCS set to %d from the %s", procs, from)
+	}
+}
+
+// maxProcs returns the GOMAXPROCS for the options, the number of CPUs and
+// the CPU quota, and what it is based on. It returns 0 to keep the current
+// value, which is the case when set with the GOMAXPROCS environment
+// variable, unless set in the options.
+func maxProcs(opts *Options, cpus int, quota float64) (int, string) {
+	if opts.MaxProcs > 0 {
+		return opts.MaxProcs, "configuration"
+	}
+	if opts.NoAutoMaxProcs || os.Getenv("GOMAXPROCS") != _EMPTY_ {
+		return 0, _EMPTY_
+	}
+	procs, from := cpus, _EMPTY_
+	if n := len(opts.CPUAffinity); n > 0 && n < procs {
+		procs, from = n, "CPU affinity"
+	}
+	if n := int(math.Ceil(quota)); quota > 0 && n < procs {
+		procs, from = n, fmt.Sprintf("CPU quota of %g", quota)
+	}
+	if from == _EMPTY_ {
+		return 0, _EMPTY_
+	}
+	return procs, from
+}
+
+// cgroupCPUQuota returns the CPU quota of the process in number of CPUs,
+// from the cgroup v2 or v1 files, or 0 if there is none.
+func cgroupCPUQuota() float64 {
+	// cgroup v2, the quota and period or "max" for no quota.
+	if b, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "cpu.max")); err == nil {
+		f := strings.Fields(string(b))
+		if len(f) != 2 {
+			return 0
+		}
+		return quotaRatio(f[0], f[1])
+	}
+	// cgroup v1, a quota of -1 for none.
+	q, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "cpu", "cpu.cfs_quota_us"))
+	if err != nil {
+		return 0
+	}
+	p, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "cpu", "cpu.cfs_period_us"))
+	if err != nil {
+		return 0
+	}
+	return quotaRatio(strings.TrimSpace(string(q)), strings.TrimSpace(string(p)))
+}
+
+func quotaRatio(quota, period string) float64 {
+	q, err := strconv.ParseInt(quota, 10, 64)
+	if err != nil || q <= 0 {
+		return 0
+	}
+	p, err := strconv.ParseInt(period, 10, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return float64(q) / float64(p)
+}
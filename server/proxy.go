@@ -0,0 +1,260 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol values, see RFC 1928 and RFC 1929.
+const (
+	socks5Version         = byte(0x05)
+	socks5AuthNone        = byte(0x00)
+	socks5AuthPassword    = byte(0x02)
+	socks5AuthPasswordVer = byte(0x01)
+	socks5CmdConnect      = byte(0x01)
+	socks5AddrIPv4        = byte(0x01)
+	socks5AddrDomain      = byte(0x03)
+	socks5AddrIPv6        = byte(0x04)
+	socks5ReplySucceeded  = byte(0x00)
+)
+
+// Checks that the proxy URL is supported.
+func validateProxyURL(proxy *url.URL) error {
+	switch proxy.Scheme {
+	case "http", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("proxy scheme should be http, socks5 or socks5h, got %q", proxy.Scheme)
+	}
+	if proxy.Hostname() == _EMPTY_ {
+		return fmt.Errorf("proxy %q has no host", proxy)
+	}
+	return nil
+}
+
+// Dials the given address, through the proxy if not nil.
+func dialWithProxy(proxy *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	if proxy == nil {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	switch proxy.Scheme {
+	case "socks5", "socks5h":
+		return socks5ProxyDial(proxy, addr, timeout)
+	default:
+		return httpProxyDial(proxy, addr, timeout)
+	}
+}
+
+// Dials the given address through an HTTP proxy using the CONNECT method.
+func httpProxyDial(proxy *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	phost := proxy.Host
+	if proxy.Port() == "" {
+		phost = net.JoinHostPort(proxy.Hostname(), "80")
+	}
+	conn, err := net.DialTimeout("tcp", phost, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to proxy %q: %v", phost, err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if proxy.User != nil {
+		pass, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + pass))
+		fmt.Fprintf(&req, "Proxy-Authorization: Basic %s\r\n", auth)
+	}
+	req.WriteString("\r\n")
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error sending CONNECT to proxy %q: %v", phost, err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error reading CONNECT response from proxy %q: %v", phost, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %q refused to connect to %q: %s", phost, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	// The remote may have already sent data, such as the INFO protocol,
+	// that was read along with the response.
+	if br.Buffered() > 0 {
+		return &proxyConn{Conn: conn, br: br}, nil
+	}
+	return conn, nil
+}
+
+// A connection whose first reads are served from the data buffered
+// while reading the proxy response.
+type proxyConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.br != nil {
+		if c.br.Buffered() > 0 {
+			return c.br.Read(b)
+		}
+		c.br = nil
+	}
+	return c.Conn.Read(b)
+}
+
+// Dials the given address through a SOCKS5 proxy. Host names are
+// resolved by the proxy.
+func socks5ProxyDial(proxy *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	phost := proxy.Host
+	if proxy.Port() == "" {
+		phost = net.JoinHostPort(proxy.Hostname(), "1080")
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", addr)
+	}
+	conn, err := net.DialTimeout("tcp", phost, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to proxy %q: %v", phost, err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := socks5Handshake(conn, proxy, host, uint16(port)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %q refused to connect to %q: %v", phost, addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func socks5Handshake(conn net.Conn, proxy *url.URL, host string, port uint16) error {
+	method := socks5AuthNone
+	if proxy.User != nil {
+		method = socks5AuthPassword
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	var b [4]byte
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return err
+	}
+	if b[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %d", b[0])
+	}
+	if b[1] != method {
+		return fmt.Errorf("authentication method not accepted")
+	}
+	if method == socks5AuthPassword {
+		user := proxy.User.Username()
+		pass, _ := proxy.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return fmt.Errorf("proxy credentials too long")
+		}
+		req := []byte{socks5AuthPasswordVer, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, b[:2]); err != nil {
+			return err
+		}
+		if b[1] != 0 {
+			return fmt.Errorf("authentication failed")
+		}
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long")
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// The reply ends with the bound address, which is not used.
+	if _, err := io.ReadFull(conn, b[:4]); err != nil {
+		return err
+	}
+	if b[1] != socks5ReplySucceeded {
+		return fmt.Errorf("SOCKS reply %d", b[1])
+	}
+	var n int
+	switch b[3] {
+	case socks5AddrIPv4:
+		n = net.IPv4len
+	case socks5AddrIPv6:
+		n = net.IPv6len
+	case socks5AddrDomain:
+		if _, err := io.ReadFull(conn, b[:1]); err != nil {
+			return err
+		}
+		n = int(b[0])
+	default:
+		return fmt.Errorf("unexpected SOCKS address type %d", b[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, n+2))
+	return err
+}
+
+// Checks the proxies of the routes, gateways and leafnode remotes.
+func validateProxies(o *Options) error {
+	if p := o.Cluster.Proxy; p != nil {
+		if err := validateProxyURL(p); err != nil {
+			return fmt.Errorf("cluster %v", err)
+		}
+	}
+	if p := o.Gateway.Proxy; p != nil {
+		if err := validateProxyURL(p); err != nil {
+			return fmt.Errorf("gateway %v", err)
+		}
+	}
+	for _, r := range o.LeafNode.Remotes {
+		if r.Proxy != nil {
+			if err := validateProxyURL(r.Proxy); err != nil {
+				return fmt.Errorf("leafnode remote %v", err)
+			}
+		}
+	}
+	return nil
+}
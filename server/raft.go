@@ -0,0 +1,1158 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RaftState is the state of a member of a raft group.
+type RaftState uint8
+
+const (
+	Follower RaftState = iota
+	Candidate
+	Leader
+	Closed
+)
+
+func (state RaftState) String() string {
+	switch state {
+	case Follower:
+		return "Follower"
+	case Candidate:
+		return "Candidate"
+	case Leader:
+		return "Leader"
+	case Closed:
+		return "Closed"
+	}
+	return "Unknown"
+}
+
+var (
+	errNotLeader  = errors.New("raft: not leader")
+	errRaftClosed = errors.New("raft: node is closed")
+	errRaftNoLog  = errors.New("raft: log file is not open")
+)
+
+const (
+	raftHeartbeatInterval  = 250 * time.Millisecond
+	raftMinElectionTimeout = time.Second
+	raftMaxElectionTimeout = 2 * time.Second
+	// Peers not heard from in this long do not hold back compaction
+	// of the log on the leader, they will catch up from a snapshot.
+	raftLostPeerTimeout = 10 * time.Second
+	// The log is compacted once it holds this many applied entries.
+	raftCompactThreshold = 1024
+	// Maximum number of entries, and size of their data, sent in one
+	// append. An append holds at least one entry.
+	raftMaxAppendEntries = 256
+	raftMaxAppendSize    = 256 * 1024
+	// Interval at which the applied index is written.
+	raftStateFlushInterval = time.Second
+	// File holding the persistent state of a node.
+	raftStateFile = "state.json"
+	// File holding the log of a node, one record per line.
+	raftLogFile = "log.json"
+)
+
+// Subjects used between the members of a raft group. Votes are sent
+// to all members, appends to each follower. Responses go to the reply
+// subject of the member that sent the request.
+const (
+	raftVoteSubjT        = "$NRG.V.%s"
+	raftAppendSubjT      = "$NRG.AE.%s.%s"
+	raftVoteReplySubjT   = "$NRG.VR.%s.%s"
+	raftAppendReplySubjT = "$NRG.AR.%s.%s"
+)
+
+// Types of log entries.
+type raftEntryType uint8
+
+const (
+	entryNormal raftEntryType = iota
+	// Appended by a new leader to commit the entries of previous terms.
+	entryNoop
+	// Adds a peer to the group. Takes effect once appended.
+	entryAddPeer
+)
+
+// A raft log entry. The data of normal entries is JSON, so that it is
+// not encoded again in the messages between members.
+type raftEntry struct {
+	Term uint64          `json:"term"`
+	Type raftEntryType   `json:"type,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+	Peer string          `json:"peer,omitempty"`
+}
+
+type voteRequest struct {
+	Term      uint64 `json:"term"`
+	LastTerm  uint64 `json:"last_term"`
+	LastIndex uint64 `json:"last_index"`
+	Candidate string `json:"candidate"`
+}
+
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Peer    string `json:"peer"`
+	Granted bool   `json:"granted"`
+}
+
+// Appends entries following the previous index and term. When the
+// follower is behind the start of the leader's log, a snapshot of the
+// state machine at the previous index is sent instead of entries.
+type appendEntry struct {
+	Leader   string       `json:"leader"`
+	Term     uint64       `json:"term"`
+	Commit   uint64       `json:"commit"`
+	PTerm    uint64       `json:"pterm"`
+	PIndex   uint64       `json:"pindex"`
+	Entries  []*raftEntry `json:"entries,omitempty"`
+	Snapshot []byte       `json:"snapshot,omitempty"`
+	Peers    []string     `json:"peers,omitempty"`
+}
+
+type appendResponse struct {
+	Term    uint64 `json:"term"`
+	Index   uint64 `json:"index"`
+	Peer    string `json:"peer"`
+	Success bool   `json:"success"`
+}
+
+// Persistent state of a node.
+type raftPersistentState struct {
+	Term        uint64   `json:"term"`
+	Vote        string   `json:"vote,omitempty"`
+	Peers       []string `json:"peers"`
+	Applied     uint64   `json:"applied"`
+	AppliedTerm uint64   `json:"applied_term"`
+}
+
+// A record of the log file. Entries are appended at their index, which
+// drops the entries at and after it that were written before. A record
+// without an entry starts the log after the index and term, and is the
+// first one of the file.
+type raftLogRecord struct {
+	Index uint64     `json:"index"`
+	Term  uint64     `json:"term,omitempty"`
+	Entry *raftEntry `json:"entry,omitempty"`
+}
+
+// raftTransport delivers the messages between the members of a group.
+type raftTransport interface {
+	subscribe(subject string, cb msgHandler) (*subscription, error)
+	unsubscribe(sub *subscription)
+	send(subject, reply string, msg []byte)
+}
+
+// raftFSM is the state machine replicated by a raft group. Its methods
+// are invoked from a single go routine, in log order. Entries may be
+// applied again after a restart, so they must be idempotent.
+type raftFSM interface {
+	applyEntries(entries []*raftEntry)
+	snapshot() []byte
+	installSnapshot(leader string, data []byte) error
+	leaderChanged(isLeader bool)
+}
+
+type raftConfig struct {
+	Group string
+	ID    string
+	Peers []string
+	Dir   string
+	// The state machine and the log are not persisted, they are
+	// rebuilt from the leader after a restart.
+	Volatile bool
+	// The applied index is written after each apply rather than
+	// periodically.
+	SyncApplied bool
+	// The node joins an existing group, it does not campaign before it
+	// has heard from the leader.
+	Join bool
+}
+
+// raft is a member of a raft group. The log is kept in memory and
+// compacted once applied, members that are behind are sent a snapshot
+// of the state machine. Entries are written to the log file and synced
+// before they are acknowledged.
+type raft struct {
+	mu     sync.Mutex
+	group  string
+	id     string
+	dir    string
+	cfg    raftConfig
+	fsm    raftFSM
+	tr     raftTransport
+	peers  map[string]struct{}
+	state  RaftState
+	term   uint64
+	vote   string
+	leader string
+
+	// Entries after the previous index and term.
+	log    []*raftEntry
+	pindex uint64
+	pterm  uint64
+	wal    *os.File
+
+	commit  uint64
+	applied uint64
+	aterm   uint64
+	dirty   bool
+	// Snapshot received from the leader, waiting to be installed.
+	snap     []byte
+	snapFrom string
+
+	// Leader state.
+	next     map[string]uint64
+	match    map[string]uint64
+	inflight map[string]time.Time
+	seen     map[string]time.Time
+	noop     uint64
+	votes    map[string]struct{}
+	notified bool
+	joining  bool
+
+	etmr *time.Timer
+	htmr *time.Timer
+	ach  chan struct{}
+	quit chan struct{}
+	subs []*subscription
+}
+
+// Creates the node, restoring its persistent state, and starts it.
+func newRaft(cfg raftConfig, fsm raftFSM, tr raftTransport) (*raft, error) {
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create raft directory - %v", err)
+	}
+	n := &raft{
+		group:   cfg.Group,
+		id:      cfg.ID,
+		dir:     cfg.Dir,
+		cfg:     cfg,
+		fsm:     fsm,
+		tr:      tr,
+		peers:   make(map[string]struct{}),
+		ach:     make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+		joining: cfg.Join,
+	}
+	for _, p := range cfg.Peers {
+		n.peers[p] = struct{}{}
+	}
+	n.peers[n.id] = struct{}{}
+	if buf, err := ioutil.ReadFile(filepath.Join(n.dir, raftStateFile)); err == nil {
+		var ps raftPersistentState
+		if err := json.Unmarshal(buf, &ps); err != nil {
+			return nil, fmt.Errorf("could not read raft state - %v", err)
+		}
+		n.term, n.vote = ps.Term, ps.Vote
+		for _, p := range ps.Peers {
+			n.peers[p] = struct{}{}
+		}
+		if !cfg.Volatile {
+			n.pindex, n.pterm = ps.Applied, ps.AppliedTerm
+			n.commit, n.applied, n.aterm = ps.Applied, ps.Applied, ps.AppliedTerm
+		}
+	}
+	if err := n.writeState(); err != nil {
+		return nil, err
+	}
+	if !cfg.Volatile {
+		if err := n.readLog(); err != nil {
+			return nil, fmt.Errorf("could not read raft log - %v", err)
+		}
+		if err := n.writeLog(); err != nil {
+			return nil, fmt.Errorf("could not write raft log - %v", err)
+		}
+	}
+
+	subs := []struct {
+		subj string
+		cb   msgHandler
+	}{
+		{fmt.Sprintf(raftVoteSubjT, n.group), n.handleVoteRequest},
+		{fmt.Sprintf(raftAppendSubjT, n.group, n.id), n.handleAppendEntry},
+		{fmt.Sprintf(raftVoteReplySubjT, n.group, n.id), n.handleVoteResponse},
+		{fmt.Sprintf(raftAppendReplySubjT, n.group, n.id), n.handleAppendResponse},
+	}
+	for _, sub := range subs {
+		s, err := tr.subscribe(sub.subj, sub.cb)
+		if err != nil {
+			n.unsubscribe()
+			return nil, err
+		}
+		n.subs = append(n.subs, s)
+	}
+
+	n.mu.Lock()
+	if len(n.peers) == 1 && !n.joining {
+		// Nobody to wait for.
+		n.campaign()
+	} else {
+		n.resetElectionTimer()
+	}
+	n.mu.Unlock()
+
+	go n.applyLoop()
+	return n, nil
+}
+
+func (n *raft) unsubscribe() {
+	for _, sub := range n.subs {
+		n.tr.unsubscribe(sub)
+	}
+	n.subs = nil
+}
+
+// Writes the persistent state. Lock should be held.
+func (n *raft) writeState() error {
+	ps := raftPersistentState{Term: n.term, Vote: n.vote, Applied: n.applied, AppliedTerm: n.aterm}
+	for p := range n.peers {
+		ps.Peers = append(ps.Peers, p)
+	}
+	sort.Strings(ps.Peers)
+	b, err := json.Marshal(&ps)
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(filepath.Join(n.dir, raftStateFile), b); err != nil {
+		return err
+	}
+	n.dirty = false
+	return nil
+}
+
+// Writes the file through a temporary one, synced before it replaces
+// the file.
+func writeFileSync(name string, b []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// Restores the log from the log file. Records after one that can not be
+// read, which is a write that did not complete, are ignored, they were
+// not acknowledged. Lock should be held.
+func (n *raft) readLog() error {
+	f, err := os.Open(filepath.Join(n.dir, raftLogFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pindex, pterm := n.pindex, n.pterm
+	var entries []*raftEntry
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		var rec raftLogRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			break
+		}
+		if rec.Entry == nil {
+			pindex, pterm, entries = rec.Index, rec.Term, nil
+			continue
+		}
+		if rec.Index <= pindex || rec.Index > pindex+uint64(len(entries))+1 {
+			break
+		}
+		entries = append(entries[:rec.Index-pindex-1], rec.Entry)
+	}
+	// The log has to continue from the applied index. It does not when
+	// a snapshot was not installed, the leader will send it again.
+	if pindex > n.applied || pindex+uint64(len(entries)) < n.applied {
+		return nil
+	}
+	n.pindex, n.pterm, n.log = pindex, pterm, entries
+	for _, e := range n.log {
+		if e.Type == entryAddPeer {
+			n.peers[e.Peer] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// Rewrites the log file with the log, and opens it for appends.
+// Lock should be held.
+func (n *raft) writeLog() error {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	if err := enc.Encode(&raftLogRecord{Index: n.pindex, Term: n.pterm}); err != nil {
+		return err
+	}
+	for i, e := range n.log {
+		if err := enc.Encode(&raftLogRecord{Index: n.pindex + uint64(i) + 1, Entry: e}); err != nil {
+			return err
+		}
+	}
+	// Appends keep going to the current file if it could not be replaced.
+	name := filepath.Join(n.dir, raftLogFile)
+	if err := writeFileSync(name, b.Bytes()); err != nil {
+		return err
+	}
+	wal, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	if n.wal != nil {
+		n.wal.Close()
+	}
+	n.wal = wal
+	return err
+}
+
+// Appends the entries, starting at the index, to the log file and
+// syncs it. Lock should be held.
+func (n *raft) logEntries(index uint64, entries []*raftEntry) error {
+	if n.cfg.Volatile {
+		return nil
+	}
+	if n.wal == nil {
+		return errRaftNoLog
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for i, e := range entries {
+		if err := enc.Encode(&raftLogRecord{Index: index + uint64(i), Entry: e}); err != nil {
+			return err
+		}
+	}
+	if _, err := n.wal.Write(b.Bytes()); err != nil {
+		return err
+	}
+	return n.wal.Sync()
+}
+
+// ID returns the identifier of this member.
+func (n *raft) ID() string {
+	return n.id
+}
+
+// State returns the current state of this member.
+func (n *raft) State() RaftState {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state
+}
+
+// Leader returns true if this member is the leader and has applied
+// all the entries committed by previous leaders.
+func (n *raft) Leader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state == Leader && n.applied >= n.noop
+}
+
+// GroupLeader returns the identifier of the current leader, if known.
+func (n *raft) GroupLeader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+// Peers returns the members of the group.
+func (n *raft) Peers() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	peers := make([]string, 0, len(n.peers))
+	for p := range n.peers {
+		peers = append(peers, p)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// Current returns true if the peer has replicated the log up to the
+// commit index and has recently responded, only known on the leader.
+func (n *raft) Current(peer string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if peer == n.id {
+		return n.applied >= n.commit
+	}
+	if n.state != Leader {
+		return false
+	}
+	return n.match[peer] >= n.commit && time.Since(n.seen[peer]) < raftLostPeerTimeout
+}
+
+// Propose appends an entry with the JSON encoded data to the log. Only
+// the leader accepts proposals.
+func (n *raft) Propose(data []byte) error {
+	return n.propose(&raftEntry{Type: entryNormal, Data: data})
+}
+
+// ProposeAddPeer adds the peer to the group.
+func (n *raft) ProposeAddPeer(peer string) error {
+	return n.propose(&raftEntry{Type: entryAddPeer, Peer: peer})
+}
+
+func (n *raft) propose(e *raftEntry) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state == Closed {
+		return errRaftClosed
+	}
+	if n.state != Leader {
+		return errNotLeader
+	}
+	e.Term = n.term
+	if err := n.appendEntries(e); err != nil {
+		return err
+	}
+	n.updateCommit()
+	n.sendAppends(false)
+	return nil
+}
+
+// Appends to the log, once written to the log file, adding peers right
+// away. Lock should be held.
+func (n *raft) appendEntries(entries ...*raftEntry) error {
+	if err := n.logEntries(n.lastIndex()+1, entries); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		n.log = append(n.log, e)
+		if e.Type == entryAddPeer {
+			peer := e.Peer
+			if _, ok := n.peers[peer]; !ok {
+				n.peers[peer] = struct{}{}
+				if n.state == Leader {
+					n.next[peer] = n.pindex + 1
+					n.match[peer] = 0
+				}
+				n.writeState()
+			}
+		}
+	}
+	return nil
+}
+
+// Lock should be held.
+func (n *raft) lastIndex() uint64 {
+	return n.pindex + uint64(len(n.log))
+}
+
+// Lock should be held.
+func (n *raft) lastTerm() uint64 {
+	if len(n.log) == 0 {
+		return n.pterm
+	}
+	return n.log[len(n.log)-1].Term
+}
+
+// Returns the term of the entry at the index, and false if it is not in
+// the log anymore. Lock should be held.
+func (n *raft) termAt(index uint64) (uint64, bool) {
+	if index == n.pindex {
+		return n.pterm, true
+	}
+	if index < n.pindex || index > n.lastIndex() {
+		return 0, false
+	}
+	return n.log[index-n.pindex-1].Term, true
+}
+
+// Removes the entries at and after the index. Lock should be held.
+func (n *raft) truncate(index uint64) {
+	if index <= n.pindex {
+		n.log = nil
+		return
+	}
+	if index <= n.lastIndex() {
+		n.log = n.log[:index-n.pindex-1]
+	}
+}
+
+// Lock should be held.
+func (n *raft) quorum() int {
+	return len(n.peers)/2 + 1
+}
+
+// Lock should be held.
+func (n *raft) resetElectionTimer() {
+	et := raftMinElectionTimeout + time.Duration(rand.Int63n(int64(raftMaxElectionTimeout-raftMinElectionTimeout)))
+	if n.etmr == nil {
+		n.etmr = time.AfterFunc(et, n.electionTimeout)
+	} else {
+		n.etmr.Reset(et)
+	}
+}
+
+func (n *raft) electionTimeout() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state == Closed || n.state == Leader {
+		return
+	}
+	if n.joining {
+		n.resetElectionTimer()
+		return
+	}
+	n.campaign()
+}
+
+// Starts an election. Lock should be held.
+func (n *raft) campaign() {
+	n.state = Candidate
+	n.term++
+	n.vote = n.id
+	n.leader = _EMPTY_
+	n.votes = map[string]struct{}{n.id: {}}
+	n.writeState()
+	if len(n.votes) >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	n.resetElectionTimer()
+	req := &voteRequest{Term: n.term, LastTerm: n.lastTerm(), LastIndex: n.lastIndex(), Candidate: n.id}
+	n.sendMsg(fmt.Sprintf(raftVoteSubjT, n.group), fmt.Sprintf(raftVoteReplySubjT, n.group, n.id), req)
+}
+
+// Lock should be held.
+func (n *raft) becomeLeader() {
+	n.state = Leader
+	n.leader = n.id
+	if n.etmr != nil {
+		n.etmr.Stop()
+	}
+	n.next = make(map[string]uint64)
+	n.match = make(map[string]uint64)
+	n.inflight = make(map[string]time.Time)
+	n.seen = make(map[string]time.Time)
+	now := time.Now()
+	for p := range n.peers {
+		if p != n.id {
+			n.next[p] = n.lastIndex() + 1
+			n.seen[p] = now
+		}
+	}
+	// Entries of previous terms are committed once the no-op is.
+	if err := n.appendEntries(&raftEntry{Term: n.term, Type: entryNoop}); err != nil {
+		n.stepDown(n.term, _EMPTY_)
+		return
+	}
+	n.noop = n.lastIndex()
+	n.updateCommit()
+	n.sendAppends(true)
+	n.htmr = time.AfterFunc(raftHeartbeatInterval, n.heartbeat)
+}
+
+// Lock should be held.
+func (n *raft) stepDown(term uint64, leader string) {
+	if term > n.term {
+		n.term = term
+		n.vote = _EMPTY_
+		n.writeState()
+	}
+	wasLeader := n.state == Leader
+	n.state = Follower
+	n.leader = leader
+	if n.htmr != nil {
+		n.htmr.Stop()
+		n.htmr = nil
+	}
+	n.resetElectionTimer()
+	if wasLeader {
+		n.signalApply()
+	}
+}
+
+func (n *raft) heartbeat() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state != Leader {
+		return
+	}
+	// Step down if a quorum can not be reached anymore.
+	active := 1
+	for p, last := range n.seen {
+		if _, ok := n.peers[p]; ok && time.Since(last) < 2*raftMaxElectionTimeout {
+			active++
+		}
+	}
+	if active < n.quorum() {
+		n.stepDown(n.term, _EMPTY_)
+		return
+	}
+	n.sendAppends(true)
+	n.htmr.Reset(raftHeartbeatInterval)
+}
+
+// Sends the entries each follower is missing. Followers with an append
+// in flight are skipped, unless this is a heartbeat.
+// Lock should be held.
+func (n *raft) sendAppends(heartbeat bool) {
+	for p := range n.peers {
+		if p == n.id {
+			continue
+		}
+		if !heartbeat && !n.inflight[p].IsZero() {
+			continue
+		}
+		n.sendAppend(p)
+	}
+}
+
+// Lock should be held.
+func (n *raft) sendAppend(peer string) {
+	next := n.next[peer]
+	if next == 0 {
+		next = 1
+	}
+	// Peers are sent along so that members learn about each other.
+	ae := &appendEntry{Leader: n.id, Term: n.term, Commit: n.commit}
+	for p := range n.peers {
+		ae.Peers = append(ae.Peers, p)
+	}
+	if next <= n.pindex {
+		// The entries are gone, send a snapshot instead. The state
+		// machine is at the applied index, which is the start of the
+		// log once compacted.
+		ae.PIndex, ae.PTerm = n.pindex, n.pterm
+		ae.Snapshot = n.fsm.snapshot()
+		if ae.Snapshot == nil {
+			ae.Snapshot = []byte{}
+		}
+	} else {
+		ae.PIndex = next - 1
+		ae.PTerm, _ = n.termAt(ae.PIndex)
+		size := 0
+		for index := ae.PIndex + 1; index <= n.lastIndex() && len(ae.Entries) < raftMaxAppendEntries; index++ {
+			e := n.log[index-n.pindex-1]
+			if size += len(e.Data); size > raftMaxAppendSize && len(ae.Entries) > 0 {
+				break
+			}
+			ae.Entries = append(ae.Entries, e)
+		}
+	}
+	n.inflight[peer] = time.Now()
+	n.sendMsg(fmt.Sprintf(raftAppendSubjT, n.group, peer), fmt.Sprintf(raftAppendReplySubjT, n.group, n.id), ae)
+}
+
+// Lock should be held.
+func (n *raft) sendMsg(subj, reply string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	n.tr.send(subj, reply, b)
+}
+
+// Advances the commit index to the highest entry of the current term
+// replicated on a quorum. Lock should be held.
+func (n *raft) updateCommit() {
+	indexes := []uint64{n.lastIndex()}
+	for p, m := range n.match {
+		if _, ok := n.peers[p]; ok && p != n.id {
+			indexes = append(indexes, m)
+		}
+	}
+	for len(indexes) < len(n.peers) {
+		indexes = append(indexes, 0)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] > indexes[j] })
+	index := indexes[n.quorum()-1]
+	if index > n.commit {
+		if term, ok := n.termAt(index); ok && term == n.term {
+			n.commit = index
+			n.signalApply()
+		}
+	}
+}
+
+// Lock should be held.
+func (n *raft) signalApply() {
+	select {
+	case n.ach <- struct{}{}:
+	default:
+	}
+}
+
+func (n *raft) handleVoteRequest(_ *subscription, _, reply string, _, msg []byte) {
+	var req voteRequest
+	if err := json.Unmarshal(msg, &req); err != nil || req.Candidate == n.id {
+		return
+	}
+	n.mu.Lock()
+	// Members that are not yet added must not disrupt the group.
+	if _, ok := n.peers[req.Candidate]; !ok || n.state == Closed {
+		n.mu.Unlock()
+		return
+	}
+	if req.Term > n.term {
+		n.stepDown(req.Term, _EMPTY_)
+	}
+	resp := &voteResponse{Term: n.term, Peer: n.id}
+	upToDate := req.LastTerm > n.lastTerm() || (req.LastTerm == n.lastTerm() && req.LastIndex >= n.lastIndex())
+	if req.Term == n.term && upToDate && (n.vote == _EMPTY_ || n.vote == req.Candidate) {
+		n.vote = req.Candidate
+		n.writeState()
+		n.resetElectionTimer()
+		resp.Granted = true
+	}
+	if reply != _EMPTY_ {
+		n.sendMsg(reply, _EMPTY_, resp)
+	}
+	n.mu.Unlock()
+}
+
+func (n *raft) handleVoteResponse(_ *subscription, _, _ string, _, msg []byte) {
+	var resp voteResponse
+	if err := json.Unmarshal(msg, &resp); err != nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.stepDown(resp.Term, _EMPTY_)
+		return
+	}
+	if n.state != Candidate || resp.Term != n.term || !resp.Granted {
+		return
+	}
+	if _, ok := n.peers[resp.Peer]; !ok {
+		return
+	}
+	n.votes[resp.Peer] = struct{}{}
+	if len(n.votes) >= n.quorum() {
+		n.becomeLeader()
+	}
+}
+
+func (n *raft) handleAppendEntry(_ *subscription, _, reply string, _, msg []byte) {
+	var ae appendEntry
+	if err := json.Unmarshal(msg, &ae); err != nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state == Closed {
+		return
+	}
+	resp := &appendResponse{Peer: n.id}
+	respond := func() {
+		resp.Term = n.term
+		if reply != _EMPTY_ {
+			n.sendMsg(reply, _EMPTY_, resp)
+		}
+	}
+	if ae.Term < n.term {
+		respond()
+		return
+	}
+	if ae.Term > n.term || n.state != Follower || n.leader != ae.Leader {
+		n.stepDown(ae.Term, ae.Leader)
+	} else {
+		n.resetElectionTimer()
+	}
+	n.joining = false
+	added := false
+	for _, p := range ae.Peers {
+		if _, ok := n.peers[p]; !ok {
+			n.peers[p] = struct{}{}
+			added = true
+		}
+	}
+	if added {
+		n.writeState()
+	}
+
+	if ae.Snapshot != nil {
+		if ae.PIndex > n.commit {
+			n.log = nil
+			n.pindex, n.pterm = ae.PIndex, ae.PTerm
+			n.commit = ae.PIndex
+			n.snap, n.snapFrom = ae.Snapshot, ae.Leader
+			n.writeState()
+			n.rewriteLog()
+			n.signalApply()
+		}
+		resp.Success, resp.Index = true, ae.PIndex
+		respond()
+		return
+	}
+
+	pindex, entries := ae.PIndex, ae.Entries
+	if pindex < n.pindex {
+		// Already compacted, those entries were committed.
+		skip := n.pindex - pindex
+		if skip > uint64(len(entries)) {
+			resp.Success, resp.Index = true, pindex+uint64(len(entries))
+			respond()
+			return
+		}
+		entries = entries[skip:]
+		pindex = n.pindex
+	} else if term, ok := n.termAt(pindex); !ok || term != ae.PTerm {
+		if ok {
+			n.truncate(pindex)
+		}
+		// Committed entries match the leader, start from there.
+		resp.Index = n.commit
+		if last := n.lastIndex(); last < resp.Index {
+			resp.Index = last
+		}
+		respond()
+		return
+	}
+	for i, e := range entries {
+		index := pindex + uint64(i) + 1
+		if term, ok := n.termAt(index); ok {
+			if term == e.Term {
+				continue
+			}
+			n.truncate(index)
+		}
+		if err := n.appendEntries(entries[i:]...); err != nil {
+			// Not acknowledged, the leader will send them again.
+			resp.Index = n.lastIndex()
+			respond()
+			return
+		}
+		break
+	}
+	last := pindex + uint64(len(entries))
+	commit := ae.Commit
+	if commit > last {
+		commit = last
+	}
+	if commit > n.commit {
+		n.commit = commit
+		n.signalApply()
+	}
+	resp.Success, resp.Index = true, last
+	respond()
+}
+
+func (n *raft) handleAppendResponse(_ *subscription, _, _ string, _, msg []byte) {
+	var resp appendResponse
+	if err := json.Unmarshal(msg, &resp); err != nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.stepDown(resp.Term, _EMPTY_)
+		return
+	}
+	if n.state != Leader || resp.Term != n.term {
+		return
+	}
+	if _, ok := n.peers[resp.Peer]; !ok {
+		return
+	}
+	delete(n.inflight, resp.Peer)
+	n.seen[resp.Peer] = time.Now()
+	if resp.Success {
+		if resp.Index > n.match[resp.Peer] {
+			n.match[resp.Peer] = resp.Index
+		}
+		n.next[resp.Peer] = resp.Index + 1
+		n.updateCommit()
+	} else {
+		n.next[resp.Peer] = resp.Index + 1
+	}
+	if n.next[resp.Peer] <= n.lastIndex() {
+		n.sendAppend(resp.Peer)
+	}
+}
+
+// Applies the committed entries, installs snapshots and notifies
+// changes of leadership to the state machine.
+func (n *raft) applyLoop() {
+	ftmr := time.NewTicker(raftStateFlushInterval)
+	defer ftmr.Stop()
+	for {
+		select {
+		case <-n.ach:
+		case <-ftmr.C:
+			n.mu.Lock()
+			if n.dirty && n.state != Closed {
+				n.writeState()
+			}
+			n.mu.Unlock()
+			continue
+		case <-n.quit:
+			return
+		}
+
+		n.mu.Lock()
+		if snap, from := n.snap, n.snapFrom; snap != nil {
+			n.snap = nil
+			index, term := n.pindex, n.pterm
+			n.mu.Unlock()
+			if err := n.fsm.installSnapshot(from, snap); err != nil {
+				// Will be sent again by the leader.
+				n.mu.Lock()
+				if n.pindex == index {
+					n.log = nil
+					n.commit = n.applied
+					n.pindex, n.pterm = n.applied, n.aterm
+					n.rewriteLog()
+				}
+				n.mu.Unlock()
+				continue
+			}
+			n.mu.Lock()
+			if index > n.applied && n.state != Closed {
+				n.applied, n.aterm = index, term
+				n.writeState()
+			}
+		}
+		var entries []*raftEntry
+		first := n.applied + 1
+		if first <= n.pindex {
+			first = n.pindex + 1
+		}
+		for index := first; index <= n.commit; index++ {
+			entries = append(entries, n.log[index-n.pindex-1])
+		}
+		n.mu.Unlock()
+
+		var normal []*raftEntry
+		for _, e := range entries {
+			if e.Type == entryNormal {
+				normal = append(normal, e)
+			}
+		}
+		if len(normal) > 0 {
+			n.fsm.applyEntries(normal)
+		}
+
+		n.mu.Lock()
+		if n.state == Closed {
+			n.mu.Unlock()
+			return
+		}
+		if len(entries) > 0 {
+			n.applied = first + uint64(len(entries)) - 1
+			n.aterm = entries[len(entries)-1].Term
+			n.dirty = true
+			if n.cfg.SyncApplied {
+				n.writeState()
+			}
+		}
+		n.compact()
+		isLeader := n.state == Leader && n.applied >= n.noop
+		notify := isLeader != n.notified
+		n.notified = isLeader
+		more := n.applied < n.commit
+		n.mu.Unlock()
+
+		if notify {
+			n.fsm.leaderChanged(isLeader)
+		}
+		if more {
+			n.mu.Lock()
+			n.signalApply()
+			n.mu.Unlock()
+		}
+	}
+}
+
+// Drops the applied entries from the log. The leader keeps the ones
+// that active followers have not replicated yet. Lock should be held.
+func (n *raft) compact() {
+	if uint64(len(n.log)) < raftCompactThreshold {
+		return
+	}
+	index := n.applied
+	if n.state == Leader {
+		for p, m := range n.match {
+			if m < index && time.Since(n.seen[p]) < raftLostPeerTimeout {
+				index = m
+			}
+		}
+	}
+	if index <= n.pindex {
+		return
+	}
+	n.pterm, _ = n.termAt(index)
+	n.log = append([]*raftEntry(nil), n.log[index-n.pindex:]...)
+	n.pindex = index
+	n.rewriteLog()
+}
+
+// Rewrites the log file after the start of the log changed. Nothing is
+// lost when this fails, the log file then still holds the entries that
+// were dropped. Lock should be held.
+func (n *raft) rewriteLog() {
+	if n.cfg.Volatile || n.state == Closed {
+		return
+	}
+	n.writeLog()
+}
+
+// Stop stops the node, keeping its state.
+func (n *raft) Stop() {
+	n.mu.Lock()
+	if n.state == Closed {
+		n.mu.Unlock()
+		return
+	}
+	n.state = Closed
+	if n.etmr != nil {
+		n.etmr.Stop()
+	}
+	if n.htmr != nil {
+		n.htmr.Stop()
+	}
+	close(n.quit)
+	n.writeState()
+	if n.wal != nil {
+		n.wal.Close()
+		n.wal = nil
+	}
+	n.mu.Unlock()
+	n.unsubscribe()
+}
+
+// Delete stops the node and removes its state.
+func (n *raft) Delete() {
+	n.Stop()
+	os.RemoveAll(n.dir)
+}
@@ -0,0 +1,262 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Delivers the messages between the members of raft groups in the
+// same process. Messages are delivered asynchronously, as they are
+// sent with the lock of the member held.
+type testRaftTransport struct {
+	mu   sync.Mutex
+	subs map[*subscription]msgHandler
+}
+
+func newTestRaftTransport() *testRaftTransport {
+	return &testRaftTransport{subs: make(map[*subscription]msgHandler)}
+}
+
+func (tr *testRaftTransport) subscribe(subject string, cb msgHandler) (*subscription, error) {
+	sub := &subscription{subject: []byte(subject)}
+	tr.mu.Lock()
+	tr.subs[sub] = cb
+	tr.mu.Unlock()
+	return sub, nil
+}
+
+func (tr *testRaftTransport) unsubscribe(sub *subscription) {
+	tr.mu.Lock()
+	delete(tr.subs, sub)
+	tr.mu.Unlock()
+}
+
+func (tr *testRaftTransport) send(subject, reply string, msg []byte) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for sub, cb := range tr.subs {
+		if string(sub.subject) == subject {
+			go cb(sub, subject, reply, nil, msg)
+		}
+	}
+}
+
+// Keeps the data of the applied entries.
+type testRaftFSM struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (fsm *testRaftFSM) applyEntries(entries []*raftEntry) {
+	fsm.mu.Lock()
+	for _, e := range entries {
+		fsm.entries = append(fsm.entries, string(e.Data))
+	}
+	fsm.mu.Unlock()
+}
+
+func (fsm *testRaftFSM) snapshot() []byte {
+	fsm.mu.Lock()
+	defer fsm.mu.Unlock()
+	b, _ := json.Marshal(fsm.entries)
+	return b
+}
+
+func (fsm *testRaftFSM) installSnapshot(_ string, data []byte) error {
+	fsm.mu.Lock()
+	defer fsm.mu.Unlock()
+	return json.Unmarshal(data, &fsm.entries)
+}
+
+func (fsm *testRaftFSM) leaderChanged(bool) {}
+
+func (fsm *testRaftFSM) applied() []string {
+	fsm.mu.Lock()
+	defer fsm.mu.Unlock()
+	return append([]string(nil), fsm.entries...)
+}
+
+func checkRaftApplied(t *testing.T, fsm *testRaftFSM, expected []string) {
+	t.Helper()
+	checkFor(t, 10*time.Second, 15*time.Millisecond, func() error {
+		applied := fsm.applied()
+		if len(applied) != len(expected) {
+			return fmt.Errorf("Expected %d entries applied, got %d", len(expected), len(applied))
+		}
+		for i, data := range applied {
+			if data != expected[i] {
+				return fmt.Errorf("Expected entry %d to be %q, got %q", i+1, expected[i], data)
+			}
+		}
+		return nil
+	})
+}
+
+func TestRaftFollowerRestartKeepsLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tr := newTestRaftTransport()
+	cfg := raftConfig{Group: "G", ID: "F", Peers: []string{"L"}, Dir: dir, Join: true}
+	n, err := newRaft(cfg, &testRaftFSM{}, tr)
+	if err != nil {
+		t.Fatalf("Error creating node: %v", err)
+	}
+	defer n.Stop()
+
+	// Play the leader.
+	rch := make(chan *appendResponse, 10)
+	tr.subscribe(fmt.Sprintf(raftAppendReplySubjT, "G", "L"), func(_ *subscription, _, _ string, _, msg []byte) {
+		var resp appendResponse
+		if err := json.Unmarshal(msg, &resp); err == nil {
+			rch <- &resp
+		}
+	})
+	sendAppend := func(n *raft, ae *appendEntry) *appendResponse {
+		t.Helper()
+		ae.Leader, ae.Term = "L", 1
+		b, _ := json.Marshal(ae)
+		n.handleAppendEntry(nil, _EMPTY_, fmt.Sprintf(raftAppendReplySubjT, "G", "L"), nil, b)
+		select {
+		case resp := <-rch:
+			return resp
+		case <-time.After(time.Second):
+			t.Fatalf("Did not get the append response")
+		}
+		return nil
+	}
+
+	expected := []string{"1", "2", "3"}
+	var entries []*raftEntry
+	for _, data := range expected {
+		entries = append(entries, &raftEntry{Term: 1, Data: json.RawMessage(data)})
+	}
+	// The entries are acknowledged, but not committed yet.
+	if resp := sendAppend(n, &appendEntry{Entries: entries}); !resp.Success || resp.Index != 3 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	n.Stop()
+
+	// Simulate a write that did not complete.
+	f, err := os.OpenFile(filepath.Join(dir, raftLogFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	f.WriteString(`{"index":4,"entry":{"term":1,"da`)
+	f.Close()
+
+	fsm := &testRaftFSM{}
+	n, err = newRaft(cfg, fsm, tr)
+	if err != nil {
+		t.Fatalf("Error restarting node: %v", err)
+	}
+	defer n.Stop()
+
+	n.mu.Lock()
+	term, last, lastTerm := n.term, n.lastIndex(), n.lastTerm()
+	n.mu.Unlock()
+	if term != 1 || last != 3 || lastTerm != 1 {
+		t.Fatalf("Expected term 1 and 3 entries of term 1, got term %d and %d entries of term %d", term, last, lastTerm)
+	}
+	// Once committed, the entries are applied.
+	if resp := sendAppend(n, &appendEntry{Commit: 3, PIndex: 3, PTerm: 1}); !resp.Success || resp.Index != 3 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	checkRaftApplied(t, fsm, expected)
+}
+
+func TestRaftGroupRestart(t *testing.T) {
+	tr := newTestRaftTransport()
+	ids := []string{"A", "B", "C"}
+	cfgs := make([]raftConfig, len(ids))
+	for i, id := range ids {
+		dir, err := ioutil.TempDir("", "raft")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		cfgs[i] = raftConfig{Group: "G", ID: id, Peers: ids, Dir: dir}
+	}
+	nodes := make([]*raft, len(ids))
+	fsms := make([]*testRaftFSM, len(ids))
+	start := func() {
+		t.Helper()
+		for i, cfg := range cfgs {
+			fsms[i] = &testRaftFSM{}
+			n, err := newRaft(cfg, fsms[i], tr)
+			if err != nil {
+				t.Fatalf("Error creating node: %v", err)
+			}
+			nodes[i] = n
+		}
+	}
+	stop := func() {
+		for _, n := range nodes {
+			n.Stop()
+		}
+	}
+	propose := func(data string) {
+		t.Helper()
+		checkFor(t, 10*time.Second, 15*time.Millisecond, func() error {
+			for _, n := range nodes {
+				if err := n.Propose(json.RawMessage(data)); err == nil {
+					return nil
+				}
+			}
+			return fmt.Errorf("No leader")
+		})
+	}
+
+	start()
+	var expected []string
+	for i := 1; i <= 10; i++ {
+		data := fmt.Sprintf("%d", i)
+		propose(data)
+		expected = append(expected, data)
+	}
+	for _, fsm := range fsms {
+		checkRaftApplied(t, fsm, expected)
+	}
+	stop()
+
+	// The state machines are restored from the applied index, and all
+	// members restart with their log.
+	start()
+	defer stop()
+	for _, n := range nodes {
+		n.mu.Lock()
+		pindex, entries := n.pindex, len(n.log)
+		n.mu.Unlock()
+		// The 10 entries and the no-op of the first leader, the log
+		// was not compacted.
+		if pindex != 0 || entries != 11 {
+			t.Fatalf("Expected node %q to have 11 entries from the start, got %d after %d", n.ID(), entries, pindex)
+		}
+	}
+	propose("11")
+	for _, fsm := range fsms {
+		checkRaftApplied(t, fsm, []string{"11"})
+	}
+}
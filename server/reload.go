@@ -17,11 +17,15 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
+
+	"github.com/nats-io/jwt"
 )
 
 // FlagSnapshot captures the server options as specified by CLI flags at
@@ -140,6 +144,58 @@ func (r *remoteSyslogOption) Apply(server *Server) {
 	server.Noticef("Reloaded: remote_syslog = %v", r.newValue)
 }
 
+// remoteSyslogTLSOption implements the option interface for the
+// `remote_syslog_tls` and `remote_syslog_buffer` settings.
+type remoteSyslogTLSOption struct {
+	loggingOption
+	name     string
+	newValue interface{}
+}
+
+// Apply is a no-op because logging will be reloaded after options are applied.
+func (r *remoteSyslogTLSOption) Apply(server *Server) {
+	server.Noticef("Reloaded: %s", r.name)
+}
+
+// logFormatOption implements the option interface for the `log_format`,
+// `logfile_format` and `syslog_format` settings.
+type logFormatOption struct {
+	loggingOption
+	name     string
+	newValue string
+}
+
+// Apply is a no-op because logging will be reloaded after options are applied.
+func (l *logFormatOption) Apply(server *Server) {
+	server.Noticef("Reloaded: %s = %v", l.name, l.newValue)
+}
+
+// syslogBackendOption implements the option interface for the
+// `syslog_backend` and `syslog_name` settings.
+type syslogBackendOption struct {
+	loggingOption
+	name     string
+	newValue string
+}
+
+// Apply is a no-op because logging will be reloaded after options are applied.
+func (l *syslogBackendOption) Apply(server *Server) {
+	server.Noticef("Reloaded: %s = %v", l.name, l.newValue)
+}
+
+// logRotateOption implements the option interface for the `logfile_size_limit`,
+// `logfile_max_age`, `logfile_max_backups` and `logfile_compress` settings.
+type logRotateOption struct {
+	loggingOption
+	name     string
+	newValue interface{}
+}
+
+// Apply is a no-op because logging will be reloaded after options are applied.
+func (l *logRotateOption) Apply(server *Server) {
+	server.Noticef("Reloaded: %s = %v", l.name, l.newValue)
+}
+
 // tlsOption implements the option interface for the `tls` setting.
 type tlsOption struct {
 	noopOption
@@ -151,6 +207,7 @@ func (t *tlsOption) Apply(server *Server) {
 	server.mu.Lock()
 	tlsRequired := t.newValue != nil
 	server.info.TLSRequired = tlsRequired
+	server.info.TLSVerify = false
 	message := "disabled"
 	if tlsRequired {
 		server.info.TLSVerify = (t.newValue.ClientAuth == tls.RequireAndVerifyClientCert)
@@ -249,11 +306,23 @@ func (u *nkeysOption) Apply(server *Server) {
 	server.Noticef("Reloaded: authorization nkey users")
 }
 
+// noAuthUserOption implements the option interface for the `no_auth_user`
+// setting.
+type noAuthUserOption struct {
+	authOption
+	newValue string
+}
+
+func (u *noAuthUserOption) Apply(server *Server) {
+	server.Noticef("Reloaded: no_auth_user = %q", u.newValue)
+}
+
 // clusterOption implements the option interface for the `cluster` setting.
 type clusterOption struct {
 	authOption
-	newValue     ClusterOpts
-	permsChanged bool
+	newValue        ClusterOpts
+	permsChanged    bool
+	noAdvertiseDiff bool
 }
 
 // Apply the cluster change.
@@ -264,6 +333,7 @@ func (c *clusterOption) Apply(server *Server) {
 	server.routeInfo.TLSRequired = tlsRequired
 	server.routeInfo.TLSVerify = tlsRequired
 	server.routeInfo.AuthRequired = c.newValue.Username != ""
+	server.routeInfo.Compression = c.newValue.Compression
 	if c.newValue.NoAdvertise {
 		server.routeInfo.ClientConnectURLs = nil
 	} else {
@@ -272,6 +342,9 @@ func (c *clusterOption) Apply(server *Server) {
 	server.setRouteInfoHostPortAndIP()
 	server.mu.Unlock()
 	server.Noticef("Reloaded: cluster")
+	if c.noAdvertiseDiff {
+		server.reloadClusterNoAdvertise(c.newValue.NoAdvertise)
+	}
 	if tlsRequired && c.newValue.TLSConfig.InsecureSkipVerify {
 		server.Warnf(clusterTLSInsecureWarning)
 	}
@@ -369,6 +442,56 @@ func (m *maxConnOption) Apply(server *Server) {
 	server.Noticef("Reloaded: max_connections = %v", m.newValue)
 }
 
+// maxConnPerLimitOption implements the option interface for the
+// `max_connections_per_ip` and `max_connections_per_user` settings.
+type maxConnPerLimitOption struct {
+	noopOption
+	name     string
+	newValue int
+}
+
+// Apply is a no-op, the limits are checked for new connections, existing
+// ones are not closed.
+func (m *maxConnPerLimitOption) Apply(server *Server) {
+	server.Noticef("Reloaded: %s = %d", m.name, m.newValue)
+}
+
+// maxClosedClientsOption implements the option interface for the
+// `max_closed_clients` setting.
+type maxClosedClientsOption struct {
+	noopOption
+	newValue int
+}
+
+// Apply the new size of the closed connections history, keeping the most
+// recent ones.
+func (m *maxClosedClientsOption) Apply(server *Server) {
+	server.mu.Lock()
+	server.closed = server.closed.resize(m.newValue)
+	server.mu.Unlock()
+	server.Noticef("Reloaded: max_closed_clients = %d", m.newValue)
+}
+
+// statszIntervalOption implements the option interface for the
+// `statsz_interval` setting.
+type statszIntervalOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply the new interval to the statsz updates.
+func (st *statszIntervalOption) Apply(server *Server) {
+	server.mu.Lock()
+	if server.sys != nil {
+		server.sys.statsz = statszInterval(st.newValue)
+		if server.sys.stmr != nil {
+			server.sys.stmr.Reset(server.sys.statsz)
+		}
+	}
+	server.mu.Unlock()
+	server.Noticef("Reloaded: statsz_interval = %v", st.newValue)
+}
+
 // pidFileOption implements the option interface for the `pid_file` setting.
 type pidFileOption struct {
 	noopOption
@@ -394,11 +517,70 @@ type portsFileDirOption struct {
 }
 
 func (p *portsFileDirOption) Apply(server *Server) {
-	server.deletePortsFile(p.oldValue)
+	server.deletePortsFile(_EMPTY_, p.oldValue)
 	server.logPorts()
 	server.Noticef("Reloaded: ports_file_dir = %v", p.newValue)
 }
 
+// portsFileOption implements the option interface for the `ports_file` setting.
+type portsFileOption struct {
+	noopOption
+	oldValue string
+	newValue string
+}
+
+func (p *portsFileOption) Apply(server *Server) {
+	server.deletePortsFile(p.oldValue, _EMPTY_)
+	server.logPorts()
+	server.Noticef("Reloaded: ports_file = %v", p.newValue)
+}
+
+// tagsOption implements the option interface for the `server_tags` setting.
+type tagsOption struct {
+	noopOption
+	newValue []string
+}
+
+// Apply the setting by updating the INFO sent to routes and gateways, and
+// the tags used for the placement of the JetStream streams.
+func (t *tagsOption) Apply(server *Server) {
+	server.mu.Lock()
+	server.routeInfo.Tags = t.newValue
+	server.generateRouteInfoJSON()
+	routes := make([]*client, 0, len(server.routes))
+	for _, route := range server.routes {
+		routes = append(routes, route)
+	}
+	infoJSON := server.routeInfoJSON
+	server.mu.Unlock()
+	for _, route := range routes {
+		route.mu.Lock()
+		route.sendInfo(infoJSON)
+		route.mu.Unlock()
+	}
+
+	if gw := server.gateway; gw.enabled {
+		gw.Lock()
+		if gw.info != nil {
+			gw.info.Tags = t.newValue
+			gw.generateInfoJSON()
+		}
+		gw.Unlock()
+	}
+
+	if js := server.getJetStream(); js != nil {
+		js.mu.RLock()
+		jsc := js.cluster
+		js.mu.RUnlock()
+		if jsc != nil {
+			jsc.mu.Lock()
+			jsc.tags = t.newValue
+			jsc.mu.Unlock()
+		}
+	}
+	server.Noticef("Reloaded: server_tags = %v", t.newValue)
+}
+
 // maxControlLineOption implements the option interface for the
 // `max_control_line` setting.
 type maxControlLineOption struct {
@@ -424,13 +606,27 @@ type maxPayloadOption struct {
 	newValue int32
 }
 
-// Apply the setting by updating the server info and each client.
+// Apply the setting by updating the server info and each client and leafnode,
+// keeping a lower account limit, then let the clients know of the new value.
 func (m *maxPayloadOption) Apply(server *Server) {
 	server.mu.Lock()
 	server.info.MaxPayload = m.newValue
+	update := func(c *client) {
+		c.mu.Lock()
+		mpay := m.newValue
+		if acc := c.acc; acc != nil && acc.mpay != jwt.NoLimit && acc.mpay < mpay {
+			mpay = acc.mpay
+		}
+		c.mu.Unlock()
+		atomic.StoreInt32(&c.mpay, mpay)
+	}
 	for _, client := range server.clients {
-		atomic.StoreInt32(&client.mpay, int32(m.newValue))
+		update(client)
+	}
+	for _, leaf := range server.leafs {
+		update(leaf)
 	}
+	server.sendAsyncInfoToClients()
 	server.mu.Unlock()
 	server.Noticef("Reloaded: max_payload = %d", m.newValue)
 }
@@ -468,12 +664,209 @@ type writeDeadlineOption struct {
 	newValue time.Duration
 }
 
-// Apply is a no-op because the write deadline will be reloaded after options
-// are applied.
+// Apply the setting by updating the snapshot of the write deadline of each
+// existing connection. New connections get it from the options.
 func (w *writeDeadlineOption) Apply(server *Server) {
+	conns := make(map[uint64]*client)
+	server.mu.Lock()
+	for i, c := range server.clients {
+		conns[i] = c
+	}
+	for i, r := range server.routes {
+		conns[i] = r
+	}
+	for i, l := range server.leafs {
+		conns[i] = l
+	}
+	server.mu.Unlock()
+	server.getAllGatewayConnections(conns)
+	for _, c := range conns {
+		c.mu.Lock()
+		c.out.wdl = w.newValue
+		c.mu.Unlock()
+	}
 	server.Noticef("Reloaded: write_deadline = %s", w.newValue)
 }
 
+// idleTimeoutOption implements the option interface for the `idle_timeout`
+// setting.
+type idleTimeoutOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply the setting by resetting the idle timer of each existing client
+// connection. New connections get it from the options.
+func (it *idleTimeoutOption) Apply(server *Server) {
+	server.mu.Lock()
+	clients := make([]*client, 0, len(server.clients))
+	for _, c := range server.clients {
+		clients = append(clients, c)
+	}
+	server.mu.Unlock()
+	for _, c := range clients {
+		c.mu.Lock()
+		if c.nc != nil {
+			c.setIdleTimer(it.newValue)
+		}
+		c.mu.Unlock()
+	}
+	server.Noticef("Reloaded: idle_timeout = %s", it.newValue)
+}
+
+// tcpOption implements the option interface for the `tcp` setting.
+type tcpOption struct {
+	noopOption
+}
+
+// Apply is a no-op, the socket options are set on accepted connections
+// from the options.
+func (t *tcpOption) Apply(server *Server) {
+	server.Noticef("Reloaded: tcp")
+}
+
+// maxTotalPendingOption implements the option interface for the
+// `max_total_pending` setting.
+type maxTotalPendingOption struct {
+	noopOption
+	newValue int64
+}
+
+// Apply the setting by updating the limit, resuming the paused publishers if
+// now below it. Without a limit before, the pending bytes are accounted from
+// now on.
+func (m *maxTotalPendingOption) Apply(server *Server) {
+	atomic.StoreInt64(&server.maxOutPending, m.newValue)
+	if total := atomic.LoadInt64(&server.outPending); m.newValue == 0 || total < m.newValue-m.newValue/4 {
+		server.releaseOutPending()
+	}
+	server.Noticef("Reloaded: max_total_pending = %d", m.newValue)
+}
+
+// outboundOption implements the option interface for the `outbound` setting.
+type outboundOption struct {
+	noopOption
+	newValue OutboundOpts
+}
+
+// Apply the setting by updating the snapshot of the outbound options of each
+// existing connection. New connections get it from the options.
+func (o *outboundOption) Apply(server *Server) {
+	conns := make(map[uint64]*client)
+	server.mu.Lock()
+	for i, c := range server.clients {
+		conns[i] = c
+	}
+	for i, r := range server.routes {
+		conns[i] = r
+	}
+	for i, l := range server.leafs {
+		conns[i] = l
+	}
+	server.mu.Unlock()
+	server.getAllGatewayConnections(conns)
+	for _, c := range conns {
+		c.mu.Lock()
+		c.out.setOutboundOpts(&o.newValue)
+		c.mu.Unlock()
+	}
+	server.Noticef("Reloaded: outbound")
+}
+
+// stallTimeoutOption implements the option interface for the `stall_timeout`
+// setting, server wide or of a connection type.
+type stallTimeoutOption struct {
+	noopOption
+}
+
+// Apply the setting by updating the snapshot of the stall timeout of each
+// existing connection. New connections get it from the options.
+func (st *stallTimeoutOption) Apply(server *Server) {
+	conns := make(map[uint64]*client)
+	server.mu.Lock()
+	for i, c := range server.clients {
+		conns[i] = c
+	}
+	for i, r := range server.routes {
+		conns[i] = r
+	}
+	for i, l := range server.leafs {
+		conns[i] = l
+	}
+	server.mu.Unlock()
+	server.getAllGatewayConnections(conns)
+	opts := server.getOpts()
+	for _, c := range conns {
+		c.mu.Lock()
+		c.out.stl = stallTimeout(c.kind, opts)
+		c.out.sst = time.Time{}
+		c.mu.Unlock()
+	}
+	server.Noticef("Reloaded: stall_timeout = %s", opts.StallTimeout)
+}
+
+// listenOption implements the option interface for the client `host` and
+// `port` settings.
+type listenOption struct {
+	noopOption
+	listener net.Listener
+}
+
+// Apply the setting by swapping the client listener, bound when the options
+// were diffed, and starting a new accept loop on it. Connected clients are
+// not affected.
+func (l *listenOption) Apply(server *Server) {
+	server.mu.Lock()
+	old := server.listener
+	if old == nil {
+		// Shutdown or in lame duck mode, not accepting clients anymore.
+		server.mu.Unlock()
+		l.listener.Close()
+		return
+	}
+	opts := server.getOpts()
+	if opts.Port == 0 {
+		opts.Port = l.listener.Addr().(*net.TCPAddr).Port
+	}
+	close(server.listenerReplaced)
+	server.listener = l.listener
+	server.listenerReplaced = make(chan struct{})
+	replaced := server.listenerReplaced
+	if err := server.setInfoHostPortAndGenerateJSON(); err != nil {
+		server.Errorf("Error setting server INFO: %v", err)
+	}
+	server.clientConnectURLs = server.getClientConnectURLs()
+	server.mu.Unlock()
+
+	old.Close()
+	go server.acceptClients(l.listener, replaced)
+	server.logPorts()
+	server.Noticef("Reloaded: listen = %s", net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port)))
+}
+
+// leafNodeTLSOption implements the option interface for the leafnode `tls`
+// setting.
+type leafNodeTLSOption struct {
+	noopOption
+	newValue *tls.Config
+}
+
+// Apply the setting by updating the INFO sent to accepted leafnodes, the new
+// TLS configuration being used for their handshake.
+func (t *leafNodeTLSOption) Apply(server *Server) {
+	server.mu.Lock()
+	tlsRequired := t.newValue != nil
+	server.leafNodeInfo.TLSRequired = tlsRequired
+	server.leafNodeInfo.TLSVerify = tlsRequired && t.newValue.ClientAuth == tls.RequireAndVerifyClientCert
+	server.generateLeafNodeInfoJSON()
+	server.mu.Unlock()
+	message := "disabled"
+	if tlsRequired {
+		message = "enabled"
+	}
+	server.Noticef("Reloaded: leafnode tls = %s", message)
+}
+
 // clientAdvertiseOption implements the option interface for the `client_advertise` setting.
 type clientAdvertiseOption struct {
 	noopOption
@@ -511,6 +904,30 @@ func (c *connectErrorReports) Apply(s *Server) {
 	s.Noticef("Reloaded: connect_error_reports = %v", c.newValue)
 }
 
+// accountErrorThresholdOption implements the option interface for the
+// `account_error_threshold` setting.
+type accountErrorThresholdOption struct {
+	noopOption
+	newValue int
+}
+
+// Apply is a no-op because the value will be reloaded after options are applied.
+func (a *accountErrorThresholdOption) Apply(s *Server) {
+	s.Noticef("Reloaded: account_error_threshold = %v", a.newValue)
+}
+
+// accountErrorWindowOption implements the option interface for the
+// `account_error_window` setting.
+type accountErrorWindowOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply is a no-op because the value will be reloaded after options are applied.
+func (a *accountErrorWindowOption) Apply(s *Server) {
+	s.Noticef("Reloaded: account_error_window = %v", a.newValue)
+}
+
 // connectErrorReports implements the option interface for the `connect_error_reports`
 // setting.
 type reconnectErrorReports struct {
@@ -527,6 +944,9 @@ func (r *reconnectErrorReports) Apply(s *Server) {
 // changes. This returns an error if the server was not started with a config
 // file or an option which doesn't support hot-swapping was changed.
 func (s *Server) Reload() error {
+	s.sdNotify(sdNotifyReloading)
+	defer s.sdNotify(sdNotifyReady)
+
 	s.mu.Lock()
 	if s.configFile == "" {
 		s.mu.Unlock()
@@ -551,6 +971,7 @@ func (s *Server) Reload() error {
 	clusterOrgPort := curOpts.Cluster.Port
 	gatewayOrgPort := curOpts.Gateway.Port
 	leafnodesOrgPort := curOpts.LeafNode.Port
+	leafnodesWSOrgPort := curOpts.LeafNode.Websocket.Port
 
 	s.mu.Unlock()
 
@@ -580,6 +1001,9 @@ func (s *Server) Reload() error {
 	if newOpts.LeafNode.Port == -1 {
 		newOpts.LeafNode.Port = leafnodesOrgPort
 	}
+	if newOpts.LeafNode.Websocket.Port == -1 {
+		newOpts.LeafNode.Websocket.Port = leafnodesWSOrgPort
+	}
 
 	if err := s.reloadOptions(curOpts, newOpts); err != nil {
 		return err
@@ -645,6 +1069,8 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 		oldConfig = reflect.ValueOf(s.getOpts()).Elem()
 		newConfig = reflect.ValueOf(newOpts).Elem()
 		diffOpts  = []option{}
+		// Set if the client listen host or port has changed.
+		listenChanged bool
 	)
 	for i := 0; i < oldConfig.NumField(); i++ {
 		field := oldConfig.Type().Field(i)
@@ -674,6 +1100,28 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 			diffOpts = append(diffOpts, &syslogOption{newValue: newValue.(bool)})
 		case "remotesyslog":
 			diffOpts = append(diffOpts, &remoteSyslogOption{newValue: newValue.(string)})
+		case "remotesyslogtlsconfig":
+			diffOpts = append(diffOpts, &remoteSyslogTLSOption{name: "remote_syslog_tls", newValue: newValue})
+		case "remotesyslogbuffer":
+			diffOpts = append(diffOpts, &remoteSyslogTLSOption{name: "remote_syslog_buffer", newValue: newValue})
+		case "logformat":
+			diffOpts = append(diffOpts, &logFormatOption{name: "log_format", newValue: newValue.(string)})
+		case "logfileformat":
+			diffOpts = append(diffOpts, &logFormatOption{name: "logfile_format", newValue: newValue.(string)})
+		case "syslogformat":
+			diffOpts = append(diffOpts, &logFormatOption{name: "syslog_format", newValue: newValue.(string)})
+		case "syslogbackend":
+			diffOpts = append(diffOpts, &syslogBackendOption{name: "syslog_backend", newValue: newValue.(string)})
+		case "syslogname":
+			diffOpts = append(diffOpts, &syslogBackendOption{name: "syslog_name", newValue: newValue.(string)})
+		case "logsizelimit":
+			diffOpts = append(diffOpts, &logRotateOption{name: "logfile_size_limit", newValue: newValue})
+		case "logmaxage":
+			diffOpts = append(diffOpts, &logRotateOption{name: "logfile_max_age", newValue: newValue})
+		case "logmaxbackups":
+			diffOpts = append(diffOpts, &logRotateOption{name: "logfile_max_backups", newValue: newValue})
+		case "logcompress":
+			diffOpts = append(diffOpts, &logRotateOption{name: "logfile_compress", newValue: newValue})
 		case "tlsconfig":
 			diffOpts = append(diffOpts, &tlsOption{newValue: newValue.(*tls.Config)})
 		case "tlstimeout":
@@ -690,6 +1138,11 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 			diffOpts = append(diffOpts, &usersOption{})
 		case "nkeys":
 			diffOpts = append(diffOpts, &nkeysOption{})
+		case "noauthuser":
+			if err := validateNoAuthUser(newOpts); err != nil {
+				return nil, err
+			}
+			diffOpts = append(diffOpts, &noAuthUserOption{newValue: newValue.(string)})
 		case "cluster":
 			newClusterOpts := newValue.(ClusterOpts)
 			oldClusterOpts := oldValue.(ClusterOpts)
@@ -697,16 +1150,43 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 				return nil, err
 			}
 			permsChanged := !reflect.DeepEqual(newClusterOpts.Permissions, oldClusterOpts.Permissions)
-			diffOpts = append(diffOpts, &clusterOption{newValue: newClusterOpts, permsChanged: permsChanged})
+			noAdvertiseDiff := newClusterOpts.NoAdvertise != oldClusterOpts.NoAdvertise
+			diffOpts = append(diffOpts, &clusterOption{newValue: newClusterOpts,
+				permsChanged: permsChanged, noAdvertiseDiff: noAdvertiseDiff})
+			if newClusterOpts.StallTimeout != oldClusterOpts.StallTimeout {
+				diffOpts = append(diffOpts, &stallTimeoutOption{})
+			}
 		case "routes":
 			add, remove := diffRoutes(oldValue.([]*url.URL), newValue.([]*url.URL))
 			diffOpts = append(diffOpts, &routesOption{add: add, remove: remove})
 		case "maxconn":
 			diffOpts = append(diffOpts, &maxConnOption{newValue: newValue.(int)})
+		case "maxconnperip":
+			diffOpts = append(diffOpts, &maxConnPerLimitOption{name: "max_connections_per_ip", newValue: newValue.(int)})
+		case "maxconnperuser":
+			diffOpts = append(diffOpts, &maxConnPerLimitOption{name: "max_connections_per_user", newValue: newValue.(int)})
+		case "maxclosedclients":
+			diffOpts = append(diffOpts, &maxClosedClientsOption{newValue: newValue.(int)})
+		case "statszinterval":
+			diffOpts = append(diffOpts, &statszIntervalOption{newValue: newValue.(time.Duration)})
 		case "pidfile":
 			diffOpts = append(diffOpts, &pidFileOption{newValue: newValue.(string)})
 		case "portsfiledir":
 			diffOpts = append(diffOpts, &portsFileDirOption{newValue: newValue.(string), oldValue: oldValue.(string)})
+		case "stalltimeout":
+			diffOpts = append(diffOpts, &stallTimeoutOption{})
+		case "idletimeout":
+			diffOpts = append(diffOpts, &idleTimeoutOption{newValue: newValue.(time.Duration)})
+		case "tcp":
+			diffOpts = append(diffOpts, &tcpOption{})
+		case "outbound":
+			diffOpts = append(diffOpts, &outboundOption{newValue: newValue.(OutboundOpts)})
+		case "maxtotalpending":
+			diffOpts = append(diffOpts, &maxTotalPendingOption{newValue: newValue.(int64)})
+		case "tags":
+			diffOpts = append(diffOpts, &tagsOption{newValue: newValue.([]string)})
+		case "portsfile":
+			diffOpts = append(diffOpts, &portsFileOption{newValue: newValue.(string), oldValue: oldValue.(string)})
 		case "maxcontrolline":
 			diffOpts = append(diffOpts, &maxControlLineOption{newValue: newValue.(int32)})
 		case "maxpayload":
@@ -745,6 +1225,10 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 			tmpNew := newValue.(GatewayOpts)
 			tmpOld.TLSConfig = nil
 			tmpNew.TLSConfig = nil
+			if tmpOld.StallTimeout != tmpNew.StallTimeout {
+				diffOpts = append(diffOpts, &stallTimeoutOption{})
+			}
+			tmpOld.StallTimeout, tmpNew.StallTimeout = 0, 0
 			// If there is really a change prevents reload.
 			if !reflect.DeepEqual(tmpOld, tmpNew) {
 				// See TODO(ik) note below about printing old/new values.
@@ -757,16 +1241,83 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 			tmpNew := newValue.(LeafNodeOpts)
 			tmpOld.TLSConfig = nil
 			tmpNew.TLSConfig = nil
+			tmpOld.Websocket.TLSConfig = nil
+			tmpNew.Websocket.TLSConfig = nil
+			// The ping settings are read when the ping timers fire.
+			tmpOld.PingInterval, tmpNew.PingInterval = 0, 0
+			tmpOld.MaxPingsOut, tmpNew.MaxPingsOut = 0, 0
+			if tmpOld.StallTimeout != tmpNew.StallTimeout {
+				diffOpts = append(diffOpts, &stallTimeoutOption{})
+			}
+			tmpOld.StallTimeout, tmpNew.StallTimeout = 0, 0
 			// If there is really a change prevents reload.
 			if !reflect.DeepEqual(tmpOld, tmpNew) {
 				// See TODO(ik) note below about printing old/new values.
 				return nil, fmt.Errorf("config reload not supported for %s: old=%v, new=%v",
 					field.Name, oldValue, newValue)
 			}
+			// The TLS configuration is used as is for new handshakes, but
+			// the INFO needs to be updated if accepting leafnodes.
+			oldTLS := oldValue.(LeafNodeOpts).TLSConfig
+			newTLS := newValue.(LeafNodeOpts).TLSConfig
+			if tmpNew.Port != 0 && !reflect.DeepEqual(oldTLS, newTLS) {
+				diffOpts = append(diffOpts, &leafNodeTLSOption{newValue: newTLS})
+			}
+		case "websocket":
+			// Similar to gateways
+			tmpOld := oldValue.(WebsocketOpts)
+			tmpNew := newValue.(WebsocketOpts)
+			tmpOld.TLSConfig = nil
+			tmpNew.TLSConfig = nil
+			// If there is really a change prevents reload.
+			if !reflect.DeepEqual(tmpOld, tmpNew) {
+				return nil, fmt.Errorf("config reload not supported for %s: old=%v, new=%v",
+					field.Name, oldValue, newValue)
+			}
+		case "mqtt":
+			// Similar to gateways
+			tmpOld := oldValue.(MQTTOpts)
+			tmpNew := newValue.(MQTTOpts)
+			tmpOld.TLSConfig = nil
+			tmpNew.TLSConfig = nil
+			// If there is really a change prevents reload.
+			if !reflect.DeepEqual(tmpOld, tmpNew) {
+				return nil, fmt.Errorf("config reload not supported for %s: old=%v, new=%v",
+					field.Name, oldValue, newValue)
+			}
+		case "stomp":
+			// Similar to gateways
+			tmpOld := oldValue.(STOMPOpts)
+			tmpNew := newValue.(STOMPOpts)
+			tmpOld.TLSConfig = nil
+			tmpNew.TLSConfig = nil
+			// If there is really a change prevents reload.
+			if !reflect.DeepEqual(tmpOld, tmpNew) {
+				return nil, fmt.Errorf("config reload not supported for %s: old=%v, new=%v",
+					field.Name, oldValue, newValue)
+			}
+		case "httpbridge":
+			// Similar to gateways
+			tmpOld := oldValue.(HTTPBridgeOpts)
+			tmpNew := newValue.(HTTPBridgeOpts)
+			tmpOld.TLSConfig = nil
+			tmpNew.TLSConfig = nil
+			// If there is really a change prevents reload.
+			if !reflect.DeepEqual(tmpOld, tmpNew) {
+				return nil, fmt.Errorf("config reload not supported for %s: old=%v, new=%v",
+					field.Name, oldValue, newValue)
+			}
 		case "connecterrorreports":
 			diffOpts = append(diffOpts, &connectErrorReports{newValue: newValue.(int)})
 		case "reconnecterrorreports":
 			diffOpts = append(diffOpts, &reconnectErrorReports{newValue: newValue.(int)})
+		case "accounterrorthreshold":
+			diffOpts = append(diffOpts, &accountErrorThresholdOption{newValue: newValue.(int)})
+		case "accounterrorwindow":
+			diffOpts = append(diffOpts, &accountErrorWindowOption{newValue: newValue.(time.Duration)})
+		case "unknownfieldsaswarnings":
+			// Only used when processing the configuration, which is done.
+			continue
 		case "nolog", "nosigs":
 			// Ignore NoLog and NoSigs options since they are not parsed and only used in
 			// testing.
@@ -777,8 +1328,9 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 				// ignore RANDOM_PORT
 				continue
 			}
-			fallthrough
-
+			listenChanged = true
+		case "host":
+			listenChanged = true
 		default:
 			// TODO(ik): Implement String() on those options to have a nice print.
 			// %v is difficult to figure what's what, %+v print private fields and
@@ -791,6 +1343,16 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 		}
 	}
 
+	// Bind the new client listener now so that a failure rejects the reload.
+	if listenChanged {
+		hp := net.JoinHostPort(newOpts.Host, strconv.Itoa(newOpts.Port))
+		l, err := listenClients(hp, newOpts.AcceptLoops)
+		if err != nil {
+			return nil, fmt.Errorf("config reload unable to listen on %s: %v", hp, err)
+		}
+		diffOpts = append(diffOpts, &listenOption{listener: l})
+	}
+
 	return diffOpts, nil
 }
 
@@ -833,6 +1395,9 @@ func (s *Server) reloadAuthorization() {
 	// This map will contain the names of accounts that have their streams
 	// import configuration changed.
 	awcsti := make(map[string]struct{})
+	// Will be set to true if an account changed its no_advertise setting,
+	// in which case clients will be sent an updated INFO.
+	sendInfo := false
 
 	s.mu.Lock()
 
@@ -876,6 +1441,9 @@ func (s *Server) reloadAuthorization() {
 				if !acc.checkStreamImportsEqual(newAcc) {
 					awcsti[newAcc.Name] = struct{}{}
 				}
+				if acc.noAdvertise != newAcc.noAdvertise {
+					sendInfo = true
+				}
 			}
 			return true
 		})
@@ -948,6 +1516,12 @@ func (s *Server) reloadAuthorization() {
 		client.processSubsOnConfigReload(awcsti)
 	}
 
+	if sendInfo {
+		s.mu.Lock()
+		s.sendAsyncInfoToClients()
+		s.mu.Unlock()
+	}
+
 	for _, route := range routes {
 		// Disconnect any unauthorized routes.
 		// Do this only for routes that were accepted, not initiated
@@ -958,6 +1532,10 @@ func (s *Server) reloadAuthorization() {
 			route.authViolation()
 		}
 	}
+
+	// Update the JetStream accounts, as accounts may have been
+	// added, removed or recreated.
+	s.configureJetStreamAccounts()
 }
 
 // Returns true if given client current account has changed (or user
@@ -1001,6 +1579,34 @@ func (s *Server) clientHasMovedToDifferentAccount(c *client) bool {
 // update INFO protocol so that remote can resend their local
 // subs if needed, and sending local subs matching cluster's
 // import subjects.
+// reloadClusterNoAdvertise updates the client connect URLs sent to clients
+// with the ones known from the routes, and sends the updated route INFO
+// so that the remote servers add or withdraw this server's URLs.
+func (s *Server) reloadClusterNoAdvertise(noAdvertise bool) {
+	s.mu.Lock()
+	var (
+		urls   []string
+		routes = make([]*client, 0, len(s.remotes))
+	)
+	for _, route := range s.remotes {
+		route.mu.Lock()
+		urls = append(urls, route.route.connectURLs...)
+		if route.opts.Protocol >= RouteProtoInfo {
+			routes = append(routes, route)
+		}
+		route.mu.Unlock()
+	}
+	infoJSON := s.routeInfoJSON
+	s.mu.Unlock()
+
+	for _, route := range routes {
+		route.mu.Lock()
+		route.sendInfo(infoJSON)
+		route.mu.Unlock()
+	}
+	s.updateServerINFOAndSendINFOToClients(urls, !noAdvertise)
+}
+
 func (s *Server) reloadClusterPermissions(oldPerms *RoutePermissions) {
 	s.mu.Lock()
 	var (
@@ -1125,6 +1731,22 @@ func validateClusterOpts(old, new ClusterOpts) error {
 		return fmt.Errorf("config reload not supported for cluster port: old=%d, new=%d",
 			old.Port, new.Port)
 	}
+	if old.Name != new.Name {
+		return fmt.Errorf("config reload not supported for cluster name: old=%s, new=%s",
+			old.Name, new.Name)
+	}
+	if old.PoolSize != new.PoolSize || !reflect.DeepEqual(old.Accounts, new.Accounts) {
+		return fmt.Errorf("config reload not supported for cluster pool size and accounts")
+	}
+	if old.Batch != new.Batch || old.BatchDelay != new.BatchDelay {
+		return fmt.Errorf("config reload not supported for cluster batching")
+	}
+	if loadHintsEnabled(&Options{Cluster: old}) != loadHintsEnabled(&Options{Cluster: new}) {
+		return fmt.Errorf("config reload not supported for enabling or disabling cluster load hints")
+	}
+	if (len(old.DNSRoutes) == 0) != (len(new.DNSRoutes) == 0) {
+		return fmt.Errorf("config reload not supported for enabling or disabling cluster DNS routes")
+	}
 	// Validate Cluster.Advertise syntax
 	if new.Advertise != "" {
 		if _, _, err := parseHostPort(new.Advertise, 0); err != nil {
@@ -172,8 +172,8 @@ func TestConfigReloadUnsupported(t *testing.T) {
 }
 
 // This checks that if we change an option that does not support hot-swapping
-// we get an error. Using `listen` for now (test may need to be updated if
-// server is changed to support change of listen spec).
+// we get an error. Using `http` for now (test may need to be updated if
+// server is changed to support change of monitoring spec).
 func TestConfigReloadUnsupportedHotSwapping(t *testing.T) {
 	server, _, config := newServerWithContent(t, []byte("listen: 127.0.0.1:-1"))
 	defer os.Remove(config)
@@ -184,9 +184,9 @@ func TestConfigReloadUnsupportedHotSwapping(t *testing.T) {
 	time.Sleep(time.Millisecond)
 
 	// Change config file with unsupported option hot-swap
-	changeCurrentConfigContentWithNewContent(t, config, []byte("listen: 127.0.0.1:9999"))
+	changeCurrentConfigContentWithNewContent(t, config, []byte("listen: 127.0.0.1:-1\nhttp: 127.0.0.1:-1"))
 
-	// This should fail because `listen` host cannot be changed.
+	// This should fail because `http` cannot be changed.
 	if err := server.Reload(); err == nil || !strings.Contains(err.Error(), "not supported") {
 		t.Fatalf("Expected Reload to return a not supported error, got %v", err)
 	}
@@ -196,6 +196,115 @@ func TestConfigReloadUnsupportedHotSwapping(t *testing.T) {
 	}
 }
 
+func TestConfigReloadListen(t *testing.T) {
+	server, _, config := runReloadServerWithContent(t, []byte("listen: 127.0.0.1:-1"))
+	defer os.Remove(config)
+	defer server.Shutdown()
+
+	oldAddr := server.Addr().String()
+	nc, err := nats.Connect("nats://"+oldAddr, nats.NoReconnect())
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	// Find a free port to move to.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error on listen: %v", err)
+	}
+	newAddr := l.Addr().String()
+	l.Close()
+
+	changeCurrentConfigContentWithNewContent(t, config, []byte("listen: "+newAddr))
+	if err := server.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	if addr := server.Addr().String(); addr != newAddr {
+		t.Fatalf("Expected listen address %q, got %q", newAddr, addr)
+	}
+	// Existing clients are not affected.
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("Error on flush: %v", err)
+	}
+	nc2, err := nats.Connect("nats://" + newAddr)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	nc2.Close()
+	if c, err := net.DialTimeout("tcp", oldAddr, 250*time.Millisecond); err == nil {
+		c.Close()
+		t.Fatal("Expected old listen address to be closed")
+	}
+
+	// A port that is already in use rejects the reload.
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error on listen: %v", err)
+	}
+	defer l.Close()
+	changeCurrentConfigContentWithNewContent(t, config, []byte("listen: "+l.Addr().String()))
+	if err := server.Reload(); err == nil || !strings.Contains(err.Error(), "unable to listen") {
+		t.Fatalf("Expected listen error, got %v", err)
+	}
+	if addr := server.Addr().String(); addr != newAddr {
+		t.Fatalf("Expected listen address %q, got %q", newAddr, addr)
+	}
+
+	// The server can still be shutdown, waiting for the new accept loop only.
+	server.Shutdown()
+}
+
+func TestConfigReloadWriteDeadline(t *testing.T) {
+	server, _, config := runReloadServerWithContent(t, []byte("listen: 127.0.0.1:-1\nwrite_deadline: \"2s\""))
+	defer os.Remove(config)
+	defer server.Shutdown()
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://%s", server.Addr()))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	changeCurrentConfigContentWithNewContent(t, config, []byte("listen: 127.0.0.1:-1\nwrite_deadline: \"5s\""))
+	if err := server.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	server.mu.Lock()
+	for _, c := range server.clients {
+		c.mu.Lock()
+		wdl := c.out.wdl
+		c.mu.Unlock()
+		if wdl != 5*time.Second {
+			t.Fatalf("Expected write deadline of 5s, got %v", wdl)
+		}
+	}
+	server.mu.Unlock()
+}
+
+func TestConfigReloadIdleTimeout(t *testing.T) {
+	server, _, config := runReloadServerWithContent(t, []byte("listen: 127.0.0.1:-1"))
+	defer os.Remove(config)
+	defer server.Shutdown()
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://%s", server.Addr()),
+		nats.NoReconnect(), nats.DisconnectErrHandler(func(*nats.Conn, error) {}))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	// Existing connections get the idle timeout enabled by a reload.
+	changeCurrentConfigContentWithNewContent(t, config, []byte("listen: 127.0.0.1:-1\nidle_timeout: \"100ms\""))
+	if err := server.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	checkClosedConns(t, server, 1, 2*time.Second)
+	if reason := server.closedClients()[0].Reason; reason != IdleTimeout.String() {
+		t.Fatalf("Unexpected closed reason: %v", reason)
+	}
+}
+
 // Ensure Reload returns an error when reloading from a bad config file.
 func TestConfigReloadInvalidConfig(t *testing.T) {
 	server, _, config := newServerWithConfig(t, "./configs/reload/test.conf")
@@ -1752,6 +1861,120 @@ func TestConfigReloadClusterNoAdvertise(t *testing.T) {
 	}
 }
 
+func TestConfigReloadClusterNoAdvertiseUpdatesClusterURLs(t *testing.T) {
+	tmpl := `
+	listen: "127.0.0.1:-1"
+	client_advertise: "s1:1"
+	cluster: {
+		listen: "127.0.0.1:-1"
+		no_advertise: %v
+	}
+	`
+	s1, _, conf := runReloadServerWithContent(t, []byte(fmt.Sprintf(tmpl, false)))
+	defer os.Remove(conf)
+	defer s1.Shutdown()
+
+	o2 := DefaultOptions()
+	o2.ClientAdvertise = "s2:2"
+	o2.Cluster.Host = "127.0.0.1"
+	o2.Cluster.Port = -1
+	o2.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", s1.ClusterAddr().Port))
+	s2 := RunServer(o2)
+	defer s2.Shutdown()
+
+	checkClusterFormed(t, s1, s2)
+
+	checkURLs := func(s *Server, url string, expected bool) {
+		t.Helper()
+		checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+			s.mu.Lock()
+			has := stringsContains(s.info.ClientConnectURLs, url)
+			s.mu.Unlock()
+			if has != expected {
+				return fmt.Errorf("Expected %q in client URLs to be %v, got %v", url, expected, has)
+			}
+			return nil
+		})
+	}
+	checkURLs(s1, "s2:2", true)
+	checkURLs(s2, "s1:1", true)
+
+	// With no_advertise, s1 should stop advertising the cluster to its
+	// clients and s2 should stop advertising s1.
+	reloadUpdateConfig(t, s1, conf, fmt.Sprintf(tmpl, true))
+	checkURLs(s1, "s2:2", false)
+	checkURLs(s2, "s1:1", false)
+
+	// And back.
+	reloadUpdateConfig(t, s1, conf, fmt.Sprintf(tmpl, false))
+	checkURLs(s1, "s2:2", true)
+	checkURLs(s2, "s1:1", true)
+}
+
+func TestConfigReloadAccountNoAdvertise(t *testing.T) {
+	tmpl := `
+	listen: "127.0.0.1:-1"
+	cluster: {
+		listen: "127.0.0.1:-1"
+	}
+	accounts: {
+		A: { users: [{user: a, password: pwd}], no_advertise: %v }
+		B: { users: [{user: b, password: pwd}] }
+	}
+	`
+	s1, _, conf := runReloadServerWithContent(t, []byte(fmt.Sprintf(tmpl, true)))
+	defer os.Remove(conf)
+	defer s1.Shutdown()
+
+	o2 := DefaultOptions()
+	o2.ClientAdvertise = "s2:2"
+	o2.Cluster.Host = "127.0.0.1"
+	o2.Cluster.Port = -1
+	o2.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", s1.ClusterAddr().Port))
+	s2 := RunServer(o2)
+	defer s2.Shutdown()
+
+	checkClusterFormed(t, s1, s2)
+
+	url := fmt.Sprintf("nats://%s:%d", s1.getOpts().Host, s1.getOpts().Port)
+	ncA, err := nats.Connect(url, nats.UserInfo("a", "pwd"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncA.Close()
+	ncB, err := nats.Connect(url, nats.UserInfo("b", "pwd"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncB.Close()
+
+	checkDiscovered := func(nc *nats.Conn, expected bool) {
+		t.Helper()
+		checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+			has := false
+			for _, u := range nc.DiscoveredServers() {
+				if strings.Contains(u, "s2:2") {
+					has = true
+				}
+			}
+			if has != expected {
+				return fmt.Errorf("Expected s2 discovered to be %v, got %v", expected, has)
+			}
+			return nil
+		})
+	}
+	checkDiscovered(ncA, false)
+	checkDiscovered(ncB, true)
+
+	reloadUpdateConfig(t, s1, conf, fmt.Sprintf(tmpl, false))
+	checkDiscovered(ncA, true)
+	checkDiscovered(ncB, true)
+
+	reloadUpdateConfig(t, s1, conf, fmt.Sprintf(tmpl, true))
+	checkDiscovered(ncA, false)
+	checkDiscovered(ncB, true)
+}
+
 func TestConfigReloadMaxSubsUnsupported(t *testing.T) {
 	s, _, conf := runReloadServerWithContent(t, []byte(`max_subs: 1`))
 	defer os.Remove(conf)
@@ -3904,3 +4127,30 @@ func TestAuthReloadDoesNotBreakRouteInterest(t *testing.T) {
 	nc2.Publish("foo", nil)
 	checkForMsg()
 }
+
+func TestConfigReloadServerTags(t *testing.T) {
+	s, _, conf := runReloadServerWithContent(t, []byte(`
+		listen: "127.0.0.1:-1"
+		server_tags: ["az:a"]
+	`))
+	defer os.Remove(conf)
+	defer s.Shutdown()
+
+	reloadUpdateConfig(t, s, conf, `
+		listen: "127.0.0.1:-1"
+		server_tags: ["az:b", "tier:edge"]
+	`)
+	v, err := s.Varz(nil)
+	if err != nil {
+		t.Fatalf("Error getting varz: %v", err)
+	}
+	if !reflect.DeepEqual(v.Tags, []string{"az:b", "tier:edge"}) {
+		t.Fatalf("Unexpected varz tags: %v", v.Tags)
+	}
+	s.mu.Lock()
+	tags := s.routeInfo.Tags
+	s.mu.Unlock()
+	if !reflect.DeepEqual(tags, []string{"az:b", "tier:edge"}) {
+		t.Fatalf("Unexpected route INFO tags: %v", tags)
+	}
+}
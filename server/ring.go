@@ -23,6 +23,8 @@ type closedClient struct {
 // Fixed sized ringbuffer for closed connections.
 type closedRingBuffer struct {
 	total uint64
+	// Closed connections not kept when the buffer was resized.
+	base  uint64
 	conns []*closedClient
 }
 
@@ -41,20 +43,36 @@ func (rb *closedRingBuffer) append(cc *closedClient) {
 }
 
 func (rb *closedRingBuffer) next() int {
-	return int(rb.total % uint64(cap(rb.conns)))
+	return int((rb.total - rb.base) % uint64(cap(rb.conns)))
 }
 
 func (rb *closedRingBuffer) len() int {
-	if rb.total > uint64(cap(rb.conns)) {
-		return cap(rb.conns)
+	if n := rb.total - rb.base; n < uint64(cap(rb.conns)) {
+		return int(n)
 	}
-	return int(rb.total)
+	return cap(rb.conns)
 }
 
 func (rb *closedRingBuffer) totalConns() uint64 {
 	return rb.total
 }
 
+// Returns a new ring buffer with at most max items, keeping the most
+// recent closed connections.
+func (rb *closedRingBuffer) resize(max int) *closedRingBuffer {
+	nrb := newClosedRingBuffer(max)
+	conns := rb.closedClients()
+	if len(conns) > max {
+		conns = conns[len(conns)-max:]
+	}
+	for _, cc := range conns {
+		nrb.append(cc)
+	}
+	nrb.base = rb.total - nrb.total
+	nrb.total = rb.total
+	return nrb
+}
+
 // This will return a sorted copy of the list which recipient can
 // modify. If the contents of the client itself need to be modified,
 // meaning swapping in any optional items, a copy should be made. We
@@ -64,7 +82,7 @@ func (rb *closedRingBuffer) totalConns() uint64 {
 func (rb *closedRingBuffer) closedClients() []*closedClient {
 	dup := make([]*closedClient, rb.len())
 	head := rb.next()
-	if rb.total <= uint64(cap(rb.conns)) || head == 0 {
+	if rb.total-rb.base <= uint64(cap(rb.conns)) || head == 0 {
 		copy(dup, rb.conns[:rb.len()])
 	} else {
 		fp := rb.conns[head:]
@@ -74,3 +74,46 @@ func TestRBclosedClients(t *testing.T) {
 		testList(i)
 	}
 }
+
+func TestRBResize(t *testing.T) {
+	rb := newClosedRingBuffer(3)
+	users := func() []string {
+		var users []string
+		for _, cc := range rb.closedClients() {
+			users = append(users, cc.user)
+		}
+		return users
+	}
+	var ui int
+	addConns := func(n int) {
+		for i := 0; i < n; i++ {
+			ui++
+			rb.append(&closedClient{user: fmt.Sprintf("%d", ui)})
+		}
+	}
+	for _, test := range []struct {
+		size  int
+		add   int
+		users []string
+	}{
+		// Grow after an overflow.
+		{5, 0, []string{"3", "4", "5"}},
+		{5, 1, []string{"3", "4", "5", "6"}},
+		{5, 2, []string{"4", "5", "6", "7", "8"}},
+		// Shrink keeping the most recent ones.
+		{2, 0, []string{"7", "8"}},
+		{2, 1, []string{"8", "9"}},
+	} {
+		if ui == 0 {
+			addConns(5)
+		}
+		rb = rb.resize(test.size)
+		addConns(test.add)
+		if got := users(); !reflect.DeepEqual(got, test.users) {
+			t.Fatalf("Expected %v, got %v", test.users, got)
+		}
+		if rbt := rb.totalConns(); rbt != uint64(ui) {
+			t.Fatalf("Expected total of %d, got %d", ui, rbt)
+		}
+	}
+}
@@ -15,15 +15,18 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
-	"math/rand"
+	"hash/fnv"
 	"net"
 	"net/url"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -73,6 +76,23 @@ type route struct {
 	replySubs    map[*subscription]*time.Timer
 	gatewayURL   string
 	leafnodeURL  string
+	compression  string
+	poolIdx      int
+	accName      string
+	poolSize     int
+	accounts     []string
+	lpoolSize    int
+	laccounts    []string
+	tags         []string
+	cw           *compressWriter
+	dstart       bool
+	dpending     []byte
+	cstats       compressionStats
+	batch        bool
+	bdelay       time.Duration
+	bsync        bool
+	bstats       routeBatchStats
+	loadHints    bool
 }
 
 type connectInfo struct {
@@ -84,6 +104,8 @@ type connectInfo struct {
 	TLS      bool   `json:"tls_required"`
 	Name     string `json:"name"`
 	Gateway  string `json:"gateway,omitempty"`
+	PoolIdx  int    `json:"route_pool_idx,omitempty"`
+	Account  string `json:"route_account,omitempty"`
 }
 
 // Route protocol constants
@@ -173,9 +195,9 @@ func (c *client) processRoutedMsgArgs(trace bool, arg []byte) error {
 	if trace {
 		c.traceInOp("RMSG", arg)
 	}
-	// Unroll splitArgs to avoid runtime/heap issues
-	a := [MAX_MSG_ARGS][]byte{}
-	args := a[:0]
+	// Unroll splitArgs to avoid runtime/heap issues. The queue names are
+	// referenced from the arguments, so those are kept in a reused slice.
+	args := c.msgArgs[:0]
 	start := -1
 	for i, b := range arg {
 		switch b {
@@ -193,6 +215,7 @@ func (c *client) processRoutedMsgArgs(trace bool, arg []byte) error {
 	if start >= 0 {
 		args = append(args, arg[start:])
 	}
+	c.msgArgs = args
 
 	c.pa.arg = arg
 	switch len(args) {
@@ -243,6 +266,14 @@ func (c *client) processRoutedMsgArgs(trace bool, arg []byte) error {
 	return nil
 }
 
+// Process an inbound HMSG specification from the remote route.
+func (c *client) processRoutedHeaderMsgArgs(trace bool, arg []byte) error {
+	if trace {
+		c.traceInOp("HMSG", arg)
+	}
+	return c.processHeaderMsgArgs(arg, func(arg []byte) error { return c.processRoutedMsgArgs(false, arg) })
+}
+
 // processInboundRouteMsg is called to process an inbound msg from a route.
 func (c *client) processInboundRoutedMsg(msg []byte) {
 	// Update statistics
@@ -332,6 +363,8 @@ func (c *client) sendRouteConnect(tlsRequired bool) {
 		Pass:     pass,
 		TLS:      tlsRequired,
 		Name:     c.srv.info.ID,
+		PoolIdx:  c.route.poolIdx,
+		Account:  c.route.accName,
 	}
 
 	b, err := json.Marshal(cinfo)
@@ -366,6 +399,21 @@ func (c *client) processRouteInfo(info *Info) {
 	s := c.srv
 	remoteID := c.route.remoteID
 
+	// The remote is signaling that it starts compressing what it sends
+	// after this INFO. The parser will hand off the rest to the readLoop.
+	if info.CompressionStart {
+		c.route.dstart = true
+		c.mu.Unlock()
+		return
+	}
+
+	// The remote is sending its load, which is all this INFO is about.
+	if info.Load != nil {
+		c.mu.Unlock()
+		s.processRouteLoad(info.ID, info.Load)
+		return
+	}
+
 	// Check if this is an INFO for gateways...
 	if info.Gateway != "" {
 		c.mu.Unlock()
@@ -395,8 +443,14 @@ func (c *client) processRouteInfo(info *Info) {
 	// in closeConnection().
 	c.route.remoteID = info.ID
 
+	// Remember which server is behind an URL discovered through DNS.
+	if c.route.didSolicit && c.route.url != nil {
+		s.dnsRoutes.setRemoteID(c.route.url.Host, info.ID)
+	}
+
 	// Get the route's proto version
 	c.opts.Protocol = info.Proto
+	c.headers = info.Headers
 
 	// Detect route to self.
 	if c.route.remoteID == s.info.ID {
@@ -409,6 +463,8 @@ func (c *client) processRouteInfo(info *Info) {
 	c.route.authRequired = info.AuthRequired
 	c.route.tlsRequired = info.TLSRequired
 	c.route.gatewayURL = info.GatewayURL
+	c.route.tags = info.Tags
+	c.route.loadHints = info.LoadHints
 	// When sent through route INFO, if the field is set, it should be of size 1.
 	if len(info.LeafNodeURLs) == 1 {
 		c.route.leafnodeURL = info.LeafNodeURLs[0]
@@ -418,7 +474,30 @@ func (c *client) processRouteInfo(info *Info) {
 	// need to possibly send local subs to the remote server.
 	if c.flags.isSet(infoReceived) {
 		c.updateRemoteRoutePerms(sl, info)
+		// The remote may have changed its cluster no_advertise setting.
+		var added, removed []string
+		if !c.route.isPooled() {
+			for _, u := range info.ClientConnectURLs {
+				if !stringsContains(c.route.connectURLs, u) {
+					added = append(added, u)
+				}
+			}
+			for _, u := range c.route.connectURLs {
+				if !stringsContains(info.ClientConnectURLs, u) {
+					removed = append(removed, u)
+				}
+			}
+			c.route.connectURLs = info.ClientConnectURLs
+		}
 		c.mu.Unlock()
+		if !s.getOpts().Cluster.NoAdvertise {
+			if len(removed) > 0 {
+				s.removeClientConnectURLsAndSendINFOToClients(removed)
+			}
+			if len(added) > 0 {
+				s.addClientConnectURLsAndSendINFOToClients(added)
+			}
+		}
 		return
 	}
 
@@ -426,6 +505,18 @@ func (c *client) processRouteInfo(info *Info) {
 	c.opts.Import = info.Import
 	c.opts.Export = info.Export
 
+	// Agree on the pooled and account dedicated route connections.
+	c.route.poolSize = c.route.lpoolSize
+	if info.RoutePoolSize < c.route.poolSize {
+		c.route.poolSize = info.RoutePoolSize
+	}
+	c.route.accounts = nil
+	for _, acc := range c.route.laccounts {
+		if stringsContains(info.RouteAccounts, acc) {
+			c.route.accounts = append(c.route.accounts, acc)
+		}
+	}
+
 	// If we do not know this route's URL, construct one on the fly
 	// from the information provided.
 	if c.route.url == nil {
@@ -445,16 +536,52 @@ func (c *client) processRouteInfo(info *Info) {
 	// to detect INFO updates.
 	c.flags.set(infoReceived)
 
+	// Start compressing what we send if both sides allow it.
+	if compressionNegotiated(c.route.compression, info.Compression) {
+		c.startRouteCompression()
+	}
+
+	// Frame what we send in batches if both sides allow it. Until all that
+	// is pending is written, the stream may not be on a protocol boundary.
+	if copts := s.getOpts().Cluster; routeBatchNegotiated(copts.Batch, info) {
+		c.route.batch, c.route.bdelay = true, copts.BatchDelay
+		c.route.bsync = c.out.pb == 0
+	}
+
 	// Check to see if we have this remote already registered.
 	// This can happen when both servers have routes to each other.
 	c.mu.Unlock()
 
+	// Make sure that the remote is part of the same cluster.
+	if !s.checkRouteClusterName(info) {
+		errTxt := fmt.Sprintf("%s: remote cluster %q, local cluster %q",
+			ErrClusterNameConflict, info.Cluster, s.ClusterName())
+		c.Errorf(errTxt)
+		c.sendErr(errTxt)
+		c.closeConnection(ClusterNameConflict)
+		return
+	}
+
 	if added, sendInfo := s.addRoute(c, info); added {
 		c.Debugf("Registering remote route %q", info.ID)
 
 		// Send our subs to the other side.
 		s.sendSubsToRoute(c)
 
+		// The rest applies to the primary connection only.
+		c.mu.Lock()
+		pooled := c.route.isPooled()
+		c.mu.Unlock()
+		if pooled {
+			return
+		}
+
+		// Announce the route, only for the primary connection.
+		s.remoteConnectEvent(c)
+
+		// Create the additional route connections to this server.
+		s.solicitPooledRoutes(c, info)
+
 		// Send info about the known gateways to this route.
 		s.sendGatewayConfigsToRoute(c)
 
@@ -545,12 +672,29 @@ func (s *Server) sendAsyncInfoToClients() {
 		if c.opts.Protocol >= ClientProtoInfo && c.flags.isSet(firstPongSent) {
 			// sendInfo takes care of checking if the connection is still
 			// valid or not, so don't duplicate tests here.
-			c.sendInfo(c.generateClientInfoJSON(s.copyInfo()))
+			c.sendInfo(c.generateClientInfoJSON(s.copyInfoForClient(c)))
 		}
 		c.mu.Unlock()
 	}
 }
 
+// Checks the cluster name of a remote route. If our name was generated,
+// we adopt the remote's name when it is configured or greater than ours,
+// so that all servers of the cluster converge to the same name.
+// Returns false if the names are configured and do not match.
+func (s *Server) checkRouteClusterName(info *Info) bool {
+	cn, dynamic := s.clusterName()
+	if info.Cluster == "" || info.Cluster == cn {
+		return true
+	}
+	if dynamic && (!info.ClusterDynamic || strings.Compare(cn, info.Cluster) < 0) {
+		s.setClusterName(info.Cluster, info.ClusterDynamic)
+		return true
+	}
+	// The remote will adopt our name.
+	return info.ClusterDynamic
+}
+
 // This will process implicit route information received from another server.
 // We will check to see if we have configured or are already connected,
 // and if so we will ignore. Otherwise we will attempt to connect.
@@ -614,7 +758,7 @@ func (s *Server) forwardNewRouteInfoToKnownServers(info *Info) {
 
 	for _, r := range s.routes {
 		r.mu.Lock()
-		if r.route.remoteID != info.ID {
+		if r.route.remoteID != info.ID && !r.route.isPooled() {
 			r.sendInfo(infoJSON)
 		}
 		r.mu.Unlock()
@@ -622,7 +766,7 @@ func (s *Server) forwardNewRouteInfoToKnownServers(info *Info) {
 }
 
 // canImport is whether or not we will send a SUB for interest to the other side.
-// This is for ROUTER connections only.
+// This is for ROUTER and LEAF connections only.
 // Lock is held on entry.
 func (c *client) canImport(subject string) bool {
 	// Use pubAllowed() since this checks Publish permissions which
@@ -631,7 +775,7 @@ func (c *client) canImport(subject string) bool {
 }
 
 // canExport is whether or not we will accept a SUB from the remote for a given subject.
-// This is for ROUTER connections only.
+// This is for ROUTER and LEAF connections only.
 // Lock is held on entry
 func (c *client) canExport(subject string) bool {
 	// Use canSubscribe() since this checks Subscribe permissions which
@@ -640,7 +784,7 @@ func (c *client) canExport(subject string) bool {
 }
 
 // Initialize or reset cluster's permissions.
-// This is for ROUTER connections only.
+// This is for ROUTER and LEAF connections only.
 // Client lock is held on entry
 func (c *client) setRoutePermissions(perms *RoutePermissions) {
 	// Reset if some were set
@@ -837,7 +981,7 @@ func (c *client) processRemoteSub(argo []byte) (err error) {
 	// Check if we have a maximum on the number of subscriptions.
 	if c.subsAtLimit() {
 		c.mu.Unlock()
-		c.maxSubsExceeded()
+		c.maxSubsExceeded(sub.subject)
 		return nil
 	}
 
@@ -1012,8 +1156,8 @@ func (c *client) sendRouteSubOrUnSubProtos(subs []*subscription, isSubProto, tra
 		if sub.client != nil && sub.client != c {
 			sub.client.mu.Lock()
 		}
-		if sub.im != nil {
-			accName = sub.im.acc.Name
+		if im := sub.streamImport(); im != nil {
+			accName = im.acc.Name
 		} else if sub.client != nil && sub.client.acc != nil {
 			accName = sub.client.acc.Name
 		} else {
@@ -1023,6 +1167,11 @@ func (c *client) sendRouteSubOrUnSubProtos(subs []*subscription, isSubProto, tra
 		if sub.client != nil && sub.client != c {
 			sub.client.mu.Unlock()
 		}
+		// Skip if the account's interest goes over another
+		// connection to the same server.
+		if !c.route.carriesAccount(accName) {
+			continue
+		}
 
 		// Check if proto is going to fit.
 		curSize := len(buf)
@@ -1089,19 +1238,21 @@ func (c *client) sendRouteSubOrUnSubProtos(subs []*subscription, isSubProto, tra
 	return closed
 }
 
-func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
+func (s *Server) createRoute(conn net.Conn, rURL *url.URL, poolIdx int, accName string) *client {
 	// Snapshot server options.
 	opts := s.getOpts()
 
 	didSolicit := rURL != nil
-	r := &route{didSolicit: didSolicit}
+	r := &route{didSolicit: didSolicit, poolIdx: poolIdx, accName: accName}
+	r.lpoolSize, r.laccounts = routePoolSize(opts), opts.Cluster.Accounts
 	for _, route := range opts.Routes {
 		if rURL != nil && (strings.EqualFold(rURL.Host, route.Host)) {
 			r.routeType = Explicit
 		}
 	}
 
-	c := &client{srv: s, nc: conn, opts: clientOpts{}, kind: ROUTER, msubs: -1, mpay: -1, route: r}
+	now := time.Now()
+	c := &client{srv: s, nc: conn, opts: clientOpts{}, kind: ROUTER, msubs: -1, mpay: -1, route: r, start: now, last: now}
 
 	// Grab server variables
 	s.mu.Lock()
@@ -1109,6 +1260,7 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 	infoJSON := s.routeInfoJSON
 	authRequired := s.routeInfo.AuthRequired
 	tlsRequired := s.routeInfo.TLSRequired
+	r.compression = s.routeInfo.Compression
 	s.mu.Unlock()
 
 	// Grab lock
@@ -1157,6 +1309,14 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 		// Reset the read deadline
 		conn.SetReadDeadline(time.Time{})
 
+		if err := checkRouteCertIdentity(conn.ConnectionState(),
+			opts.Cluster.TLSExpectedSANs, opts.Cluster.TLSExpectedOUs); err != nil {
+			c.Errorf("TLS route identity check failed: %v", err)
+			c.sendErr("Secure Connection - Identity Check Failed")
+			c.closeConnection(TLSHandshakeError)
+			return nil
+		}
+
 		// Re-Grab lock
 		c.mu.Lock()
 
@@ -1241,20 +1401,33 @@ func (s *Server) addRoute(c *client, info *Info) (bool, bool) {
 		s.mu.Unlock()
 		return false, false
 	}
+	c.mu.Lock()
+	pooled, key := c.route.isPooled(), pooledRouteKey(id, c.route.poolIdx, c.route.accName)
+	cid := c.cid
+	c.mu.Unlock()
+	if pooled {
+		_, exists := s.pooledRoutes[key]
+		if !exists {
+			s.routes[cid] = c
+			s.pooledRoutes[key] = c
+			s.removeFromTempClients(cid)
+		}
+		s.mu.Unlock()
+		return !exists, false
+	}
 	remote, exists := s.remotes[id]
 	if !exists {
-		s.routes[c.cid] = c
+		s.routes[cid] = c
 		s.remotes[id] = c
 		c.mu.Lock()
 		c.route.connectURLs = info.ClientConnectURLs
-		cid := c.cid
 		c.mu.Unlock()
 
 		// Now that we have registered the route, we can remove from the temp map.
 		s.removeFromTempClients(cid)
 
 		// we don't need to send if the only route is the one we just accepted.
-		sendInfo = len(s.routes) > 1
+		sendInfo = len(s.remotes) > 1
 
 		// If the INFO contains a Gateway URL, add it to the list for our cluster.
 		if info.GatewayURL != "" {
@@ -1446,16 +1619,24 @@ func (s *Server) routeAcceptLoop(ch chan struct{}) {
 	// Check for TLSConfig
 	tlsReq := opts.Cluster.TLSConfig != nil
 	info := Info{
-		ID:           s.info.ID,
-		Version:      s.info.Version,
-		GoVersion:    runtime.Version(),
-		AuthRequired: false,
-		TLSRequired:  tlsReq,
-		TLSVerify:    tlsReq,
-		MaxPayload:   s.info.MaxPayload,
-		Proto:        proto,
-		GatewayURL:   s.getGatewayURL(),
-	}
+		ID:            s.info.ID,
+		Version:       s.info.Version,
+		GoVersion:     runtime.Version(),
+		AuthRequired:  false,
+		TLSRequired:   tlsReq,
+		TLSVerify:     tlsReq,
+		MaxPayload:    s.info.MaxPayload,
+		Proto:         proto,
+		GatewayURL:    s.getGatewayURL(),
+		Compression:   opts.Cluster.Compression,
+		RouteBatch:    opts.Cluster.Batch,
+		LoadHints:     loadHintsEnabled(opts),
+		RoutePoolSize: routePoolSize(opts),
+		RouteAccounts: opts.Cluster.Accounts,
+		Headers:       true,
+		Tags:          opts.Tags,
+	}
+	info.Cluster, info.ClusterDynamic = s.clusterName()
 	// Set this if only if advertise is not disabled
 	if !opts.Cluster.NoAdvertise {
 		info.ClientConnectURLs = s.clientConnectURLs
@@ -1512,7 +1693,7 @@ func (s *Server) routeAcceptLoop(ch chan struct{}) {
 		}
 		tmpDelay = ACCEPT_MIN_SLEEP
 		s.startGoRoutine(func() {
-			s.createRoute(conn, nil)
+			s.createRoute(conn, nil, 0, _EMPTY_)
 			s.grWG.Done()
 		})
 	}
@@ -1556,6 +1737,16 @@ func (s *Server) StartRouting(clientListenReady chan struct{}) {
 
 	// Solicit Routes if needed.
 	s.solicitRoutes(s.getOpts().Routes)
+
+	// Discover routes through DNS if configured.
+	if len(s.getOpts().Cluster.DNSRoutes) > 0 {
+		s.startGoRoutine(func() { s.resolveDNSRoutesLoop() })
+	}
+
+	// Exchange the load of the servers if advertised or used.
+	if loadHintsEnabled(s.getOpts()) {
+		s.startGoRoutine(func() { s.loadHintsLoop() })
+	}
 }
 
 func (s *Server) reConnectToRoute(rURL *url.URL, rtype RouteType) {
@@ -1565,9 +1756,18 @@ func (s *Server) reConnectToRoute(rURL *url.URL, rtype RouteType) {
 	// registers the route on the opposite TCP connection, the
 	// two connections will end-up being closed.
 	// Add some random delay to reduce risk of repeated failures.
-	delay := time.Duration(rand.Intn(100)) * time.Millisecond
+	opts := s.getOpts()
+	jitter := opts.Cluster.ReconnectJitter
+	if jitter == 0 {
+		jitter = DEFAULT_ROUTE_RECONNECT_JITTER
+	}
+	delay := jitterDelay(jitter)
 	if tryForEver {
-		delay += DEFAULT_ROUTE_RECONNECT
+		if opts.Cluster.ReconnectInterval > 0 {
+			delay += opts.Cluster.ReconnectInterval
+		} else {
+			delay += DEFAULT_ROUTE_RECONNECT
+		}
 	}
 	select {
 	case <-time.After(delay):
@@ -1601,8 +1801,12 @@ func (s *Server) connectToRoute(rURL *url.URL, tryForEver, firstConnect bool) {
 		if tryForEver && !s.routeStillValid(rURL) {
 			return
 		}
-		s.Debugf("Trying to connect to route on %s", rURL.Host)
-		conn, err := net.DialTimeout("tcp", rURL.Host, DEFAULT_ROUTE_DIAL)
+		if proxy := opts.Cluster.Proxy; proxy != nil {
+			s.Debugf("Trying to connect to route on %s through proxy %s", rURL.Host, proxy.Host)
+		} else {
+			s.Debugf("Trying to connect to route on %s", rURL.Host)
+		}
+		conn, err := dialWithProxy(opts.Cluster.Proxy, rURL.Host, DEFAULT_ROUTE_DIAL)
 		if err != nil {
 			attempts++
 			if s.shouldReportConnectErr(firstConnect, attempts) {
@@ -1618,10 +1822,14 @@ func (s *Server) connectToRoute(rURL *url.URL, tryForEver, firstConnect bool) {
 					return
 				}
 			}
+			interval := routeConnectDelay
+			if opts.Cluster.ReconnectInterval > 0 {
+				interval = opts.Cluster.ReconnectInterval
+			}
 			select {
 			case <-s.quitCh:
 				return
-			case <-time.After(routeConnectDelay):
+			case <-time.After(backoffDelay(interval, opts.Cluster.ReconnectMaxBackoff, attempts)):
 				continue
 			}
 		}
@@ -1633,7 +1841,7 @@ func (s *Server) connectToRoute(rURL *url.URL, tryForEver, firstConnect bool) {
 
 		// We have a route connection here.
 		// Go ahead and create it and exit this func.
-		s.createRoute(conn, rURL)
+		s.createRoute(conn, rURL, 0, _EMPTY_)
 		return
 	}
 }
@@ -1644,6 +1852,12 @@ func (c *client) isSolicitedRoute() bool {
 	return c.kind == ROUTER && c.route != nil && c.route.didSolicit
 }
 
+func (c *client) isSolicitedPooledRoute() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.kind == ROUTER && c.route != nil && c.route.didSolicit && c.route.isPooled()
+}
+
 func (s *Server) solicitRoutes(routes []*url.URL) {
 	for _, r := range routes {
 		route := r
@@ -1680,6 +1894,8 @@ func (c *client) processRouteConnect(srv *Server, arg []byte, lang string) error
 	// Grab connection name of remote route.
 	c.mu.Lock()
 	c.route.remoteID = c.opts.Name
+	c.route.poolIdx = proto.PoolIdx
+	c.route.accName = proto.Account
 	c.setRoutePermissions(perms)
 	c.mu.Unlock()
 	return nil
@@ -1688,21 +1904,37 @@ func (c *client) processRouteConnect(srv *Server, arg []byte, lang string) error
 func (s *Server) removeRoute(c *client) {
 	var rID string
 	var lnURL string
+	var pooled bool
+	var key string
+	var closePooled []*client
 	c.mu.Lock()
 	cid := c.cid
 	r := c.route
 	if r != nil {
 		rID = r.remoteID
 		lnURL = r.leafnodeURL
+		pooled = r.isPooled()
+		key = pooledRouteKey(rID, r.poolIdx, r.accName)
 	}
 	c.mu.Unlock()
 	s.mu.Lock()
 	delete(s.routes, cid)
-	if r != nil {
+	if r != nil && pooled {
+		if pc, ok := s.pooledRoutes[key]; ok && c == pc {
+			delete(s.pooledRoutes, key)
+		}
+	} else if r != nil {
 		rc, ok := s.remotes[rID]
 		// Only delete it if it is us..
 		if ok && c == rc {
 			delete(s.remotes, rID)
+			// The additional connections to this server go with it.
+			prefix := rID + " "
+			for k, pc := range s.pooledRoutes {
+				if strings.HasPrefix(k, prefix) {
+					closePooled = append(closePooled, pc)
+				}
+			}
 		}
 		s.removeGatewayURL(r.gatewayURL)
 		// Remove the remote's leafNode URL from
@@ -1713,4 +1945,361 @@ func (s *Server) removeRoute(c *client) {
 	}
 	s.removeFromTempClients(cid)
 	s.mu.Unlock()
+
+	for _, pc := range closePooled {
+		pc.closeConnection(RouteRemoved)
+	}
+}
+
+// Returns the number of route connections to create to each server,
+// not counting the ones dedicated to accounts.
+func routePoolSize(opts *Options) int {
+	if opts.Cluster.PoolSize < 1 {
+		return 1
+	}
+	return opts.Cluster.PoolSize
+}
+
+// Checks that the accounts with dedicated route connections are known.
+func validateRoutePool(o *Options) error {
+	if o.Cluster.PoolSize < 0 {
+		return fmt.Errorf("cluster pool size can not be negative, got %v", o.Cluster.PoolSize)
+	}
+	for _, accName := range o.Cluster.Accounts {
+		found := accName == globalAccountName || accName == o.SystemAccount
+		for i := 0; !found && i < len(o.Accounts); i++ {
+			found = o.Accounts[i].Name == accName
+		}
+		if !found {
+			return fmt.Errorf("cluster account %q is not defined", accName)
+		}
+	}
+	return nil
+}
+
+// Returns the index of the pooled route connection that carries
+// the given account for a pool of the given size.
+func routePoolIdx(accName string, poolSize int) int {
+	if poolSize <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(accName))
+	return int(h.Sum32() % uint32(poolSize))
+}
+
+// Returns the key under which a pooled or account dedicated
+// route connection is registered.
+func pooledRouteKey(remoteID string, poolIdx int, accName string) string {
+	return fmt.Sprintf("%s %d %s", remoteID, poolIdx, accName)
+}
+
+// Returns true if this is not the primary connection to the remote server.
+func (r *route) isPooled() bool {
+	return r.poolIdx > 0 || r.accName != _EMPTY_
+}
+
+// Returns true if the interest, and therefore messages, for the given
+// account go over this route connection.
+func (r *route) carriesAccount(accName string) bool {
+	if r.accName != _EMPTY_ {
+		return r.accName == accName
+	}
+	if stringsContains(r.accounts, accName) {
+		return false
+	}
+	return routePoolIdx(accName, r.poolSize) == r.poolIdx
+}
+
+// Creates the additional pooled and account dedicated route connections
+// to the server of this primary route connection. To avoid both servers
+// doing so, only the one with the lowest server ID solicits them.
+func (s *Server) solicitPooledRoutes(c *client, info *Info) {
+	c.mu.Lock()
+	poolSize, accounts := c.route.poolSize, c.route.accounts
+	var rURL *url.URL
+	if c.route.url != nil {
+		u := *c.route.url
+		rURL = &u
+	}
+	c.mu.Unlock()
+
+	if (poolSize <= 1 && len(accounts) == 0) || rURL == nil || s.info.ID > info.ID {
+		return
+	}
+	if rURL.User == nil && info.AuthRequired {
+		opts := s.getOpts()
+		rURL.User = url.UserPassword(opts.Cluster.Username, opts.Cluster.Password)
+	}
+	for i := 1; i < poolSize; i++ {
+		idx := i
+		s.startGoRoutine(func() { s.connectToPooledRoute(rURL, info.ID, idx, _EMPTY_, 0) })
+	}
+	for _, acc := range accounts {
+		accName := acc
+		s.startGoRoutine(func() { s.connectToPooledRoute(rURL, info.ID, 0, accName, 0) })
+	}
+}
+
+// Connects a pooled or account dedicated route connection to the given
+// server. Gives up when the primary connection to that server is gone.
+func (s *Server) connectToPooledRoute(rURL *url.URL, remoteID string, poolIdx int, accName string, delay time.Duration) {
+	defer s.grWG.Done()
+
+	for attempts := 1; ; attempts++ {
+		if delay > 0 {
+			select {
+			case <-s.quitCh:
+				return
+			case <-time.After(delay):
+			}
+		}
+		s.mu.Lock()
+		_, exists := s.remotes[remoteID]
+		running := s.running
+		s.mu.Unlock()
+		if !running || !exists {
+			return
+		}
+		conn, err := dialWithProxy(s.getOpts().Cluster.Proxy, rURL.Host, DEFAULT_ROUTE_DIAL)
+		if err != nil {
+			s.Debugf("Error trying to connect to pooled route (attempt %v): %v", attempts, err)
+			delay = routeConnectDelay
+			continue
+		}
+		s.createRoute(conn, rURL, poolIdx, accName)
+		return
+	}
+}
+
+// Resolves the DNS names of cluster routes. Can be replaced in tests.
+type routeResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+var (
+	routeDNSResolver      routeResolver = net.DefaultResolver
+	routeDNSLookupTimeout               = 5 * time.Second
+)
+
+// routeDNS keeps track of the route URLs resolved from the DNS routes
+// and of the ID of the server found behind each of them.
+type routeDNS struct {
+	sync.Mutex
+	resolved map[string]*url.URL
+	ids      map[string]string
+}
+
+// Records the ID of the server behind the given host:port if it
+// was resolved from the DNS routes.
+func (d *routeDNS) setRemoteID(hostPort, id string) {
+	d.Lock()
+	if _, ok := d.resolved[hostPort]; ok {
+		if d.ids == nil {
+			d.ids = make(map[string]string)
+		}
+		d.ids[hostPort] = id
+	}
+	d.Unlock()
+}
+
+// Checks that the certificate identity checks of routes can be enforced.
+// They require TLS with a pinned CA, and are meaningless if the solicited
+// routes do not verify the certificate of the remote.
+func validateRouteTLSIdentity(o *Options) error {
+	if len(o.Cluster.TLSExpectedSANs) == 0 && len(o.Cluster.TLSExpectedOUs) == 0 {
+		return nil
+	}
+	tc := o.Cluster.TLSConfig
+	if tc == nil {
+		return fmt.Errorf("cluster certificate identity checks require TLS")
+	}
+	if tc.ClientCAs == nil || tc.RootCAs == nil {
+		return fmt.Errorf("cluster certificate identity checks require a CA file")
+	}
+	if tc.InsecureSkipVerify {
+		return fmt.Errorf("cluster certificate identity checks can not be used with insecure TLS")
+	}
+	return nil
+}
+
+// Checks that the certificate of the remote of a route has one of the
+// expected SANs and one of the expected organizational units.
+func checkRouteCertIdentity(cs tls.ConnectionState, sans, ous []string) error {
+	if len(sans) == 0 && len(ous) == 0 {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("no certificate presented")
+	}
+	cert := cs.PeerCertificates[0]
+	if len(sans) > 0 && !certHasSAN(cert, sans) {
+		return fmt.Errorf("certificate SANs do not match any of %q", sans)
+	}
+	if len(ous) > 0 {
+		found := false
+		for _, ou := range cert.Subject.OrganizationalUnit {
+			if stringsContains(ous, ou) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("certificate organizational units %q do not match any of %q",
+				cert.Subject.OrganizationalUnit, ous)
+		}
+	}
+	return nil
+}
+
+// Returns true if one of the subject alternative names of the
+// certificate is in the given list.
+func certHasSAN(cert *x509.Certificate, sans []string) bool {
+	for _, san := range sans {
+		for _, dns := range cert.DNSNames {
+			if strings.EqualFold(dns, san) {
+				return true
+			}
+		}
+		for _, ip := range cert.IPAddresses {
+			if ip.String() == san {
+				return true
+			}
+		}
+		for _, u := range cert.URIs {
+			if u.String() == san {
+				return true
+			}
+		}
+		if stringsContains(cert.EmailAddresses, san) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks that the DNS routes can be resolved into route URLs.
+func validateDNSRoutes(o *Options) error {
+	for _, u := range o.Cluster.DNSRoutes {
+		if strings.EqualFold(u.Scheme, "srv") {
+			continue
+		}
+		if u.Port() == _EMPTY_ {
+			return fmt.Errorf("cluster DNS route %q requires a port", u.Redacted())
+		}
+	}
+	return nil
+}
+
+// Resolves the DNS routes into route URLs keyed by host:port. The
+// returned boolean is false if any of the lookups failed.
+func (s *Server) resolveDNSRoutes(dnsRoutes []*url.URL) (map[string]*url.URL, bool) {
+	resolved := make(map[string]*url.URL)
+	complete := true
+	add := func(u *url.URL, host, port string) {
+		ru := &url.URL{Scheme: "nats-route", Host: net.JoinHostPort(host, port), User: u.User}
+		resolved[ru.Host] = ru
+	}
+	for _, u := range dnsRoutes {
+		ctx, cancel := context.WithTimeout(context.Background(), routeDNSLookupTimeout)
+		if strings.EqualFold(u.Scheme, "srv") {
+			_, srvs, err := routeDNSResolver.LookupSRV(ctx, _EMPTY_, _EMPTY_, u.Hostname())
+			if err != nil {
+				s.Warnf("Error resolving SRV records for route %q: %v", u.Hostname(), err)
+				complete = false
+			}
+			for _, srv := range srvs {
+				add(u, strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+			}
+		} else {
+			addrs, err := routeDNSResolver.LookupHost(ctx, u.Hostname())
+			if err != nil {
+				s.Warnf("Error resolving route %q: %v", u.Hostname(), err)
+				complete = false
+			}
+			for _, addr := range addrs {
+				add(u, addr, u.Port())
+			}
+		}
+		cancel()
+	}
+	return resolved, complete
+}
+
+// Periodically resolves the DNS routes, connecting to new servers and
+// removing the routes to servers that are no longer resolved.
+func (s *Server) resolveDNSRoutesLoop() {
+	defer s.grWG.Done()
+
+	for s.isRunning() {
+		opts := s.getOpts()
+		s.refreshDNSRoutes(opts.Cluster.DNSRoutes)
+
+		refresh := opts.Cluster.DNSRefresh
+		if refresh <= 0 {
+			refresh = DEFAULT_ROUTE_DNS_REFRESH
+		}
+		select {
+		case <-s.quitCh:
+			return
+		case <-time.After(refresh):
+		}
+	}
+}
+
+func (s *Server) refreshDNSRoutes(dnsRoutes []*url.URL) {
+	resolved, complete := s.resolveDNSRoutes(dnsRoutes)
+
+	var (
+		connect []*url.URL
+		remove  []*client
+	)
+	s.mu.Lock()
+	d := &s.dnsRoutes
+	d.Lock()
+	for hp, u := range resolved {
+		if id, ok := d.ids[hp]; ok && (id == s.info.ID || s.remotes[id] != nil) {
+			continue
+		}
+		connect = append(connect, u)
+	}
+	// Do not remove anything if some names could not be resolved.
+	if complete {
+		for hp := range d.resolved {
+			if _, ok := resolved[hp]; ok {
+				continue
+			}
+			if r := s.remotes[d.ids[hp]]; r != nil {
+				r.mu.Lock()
+				explicit := r.route.routeType == Explicit
+				r.mu.Unlock()
+				if !explicit {
+					remove = append(remove, r)
+				}
+			}
+			delete(d.ids, hp)
+		}
+		d.resolved = resolved
+	} else {
+		if d.resolved == nil {
+			d.resolved = make(map[string]*url.URL)
+		}
+		for hp, u := range resolved {
+			d.resolved[hp] = u
+		}
+	}
+	d.Unlock()
+	s.mu.Unlock()
+
+	for _, u := range connect {
+		rURL := u
+		s.Debugf("Connecting to route %s resolved through DNS", rURL.Host)
+		s.startGoRoutine(func() { s.connectToRoute(rURL, false, true) })
+	}
+	for _, r := range remove {
+		r.Noticef("Removing route no longer resolved through DNS")
+		r.setNoReconnect()
+		r.closeConnection(RouteRemoved)
+	}
 }
@@ -0,0 +1,83 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+)
+
+// Route batches.
+//
+// When both sides of a route advertise it in their INFO, each write to the
+// route is framed as a batch with a "RB <size>\r\n" header, where size is
+// the number of bytes of complete protocols that follow. The receiver
+// delivers the messages of a batch that spans several reads with a single
+// flush to its clients once the whole batch is read. The sender may also
+// wait up to the batch delay for more messages before writing.
+
+// Header of a route batch.
+const rBatchProto = "RB "
+
+// routeBatchStats holds the number of batches sent and received on a
+// route. Access is atomic.
+type routeBatchStats struct {
+	in  int64
+	out int64
+}
+
+// Returns true if both the local and remote servers batch route messages.
+func routeBatchNegotiated(local bool, info *Info) bool {
+	return local && info.RouteBatch
+}
+
+// frameRouteBatch places the header of a batch of attempted bytes in front
+// of the buffers about to be written, returning the buffers and the bytes
+// to write. A batch only starts where a previous write ended on a protocol
+// boundary, and not while the first bytes that follow the start of the
+// compression need to be written uncompressed.
+// Lock should be held.
+func (c *client) frameRouteBatch(nb net.Buffers, attempted int32) (net.Buffers, int32) {
+	if !c.route.bsync || (c.route.cw != nil && c.route.cw.plain > 0) {
+		return nb, attempted
+	}
+	hdr := make([]byte, 0, len(rBatchProto)+12)
+	hdr = append(hdr, rBatchProto...)
+	hdr = strconv.AppendInt(hdr, int64(attempted), 10)
+	hdr = append(hdr, _CRLF_...)
+	hl := int32(len(hdr))
+	c.out.pb += hl
+	c.accountPending(hl)
+	atomic.AddInt64(&c.route.bstats.out, 1)
+	return append(net.Buffers{hdr}, nb...), attempted + hl
+}
+
+// processRouteBatch is invoked by the parser for the header of a batch,
+// with the number of bytes of the read buffer that follow the header.
+// The bytes of the batch still to be read are kept so that the readLoop
+// defers the flush to the clients until the end of the batch.
+func (c *client) processRouteBatch(arg []byte, rem int) error {
+	size := parseSize(arg)
+	if size < 0 {
+		return fmt.Errorf("processRouteBatch Bad or Missing Size: '%s'", arg)
+	}
+	c.in.rbl = 0
+	if size > rem {
+		c.in.rbl = size - rem
+	}
+	atomic.AddInt64(&c.route.bstats.in, 1)
+	return nil
+}
@@ -14,9 +14,14 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/url"
+	"os"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -562,6 +567,104 @@ func TestRouteTLSHandshakeError(t *testing.T) {
 	checkNumRoutes(t, srv, 0)
 }
 
+func TestRouteTLSCertIdentity(t *testing.T) {
+	tmpl := `
+	listen: "127.0.0.1:-1"
+	cluster {
+		listen: "127.0.0.1:-1"
+		tls {
+			ca_file: "../test/configs/certs/routeid/ca.pem"
+			cert_file: "../test/configs/certs/routeid/%s.pem"
+			key_file: "../test/configs/certs/routeid/%s-key.pem"
+			%s
+		}
+		%s
+	}
+	`
+	identity := `expected_san: "localhost", expected_ou: ["NATS.io Routes"]`
+	conf1 := createConfFile(t, []byte(fmt.Sprintf(tmpl, "server", "server", identity, "")))
+	defer os.Remove(conf1)
+	s1, o1 := RunServerWithConfig(conf1)
+	defer s1.Shutdown()
+
+	if !reflect.DeepEqual(o1.Cluster.TLSExpectedSANs, []string{"localhost"}) ||
+		!reflect.DeepEqual(o1.Cluster.TLSExpectedOUs, []string{"NATS.io Routes"}) {
+		t.Fatalf("Unexpected identity checks: %q %q", o1.Cluster.TLSExpectedSANs, o1.Cluster.TLSExpectedOUs)
+	}
+
+	routes := fmt.Sprintf("routes: [\"nats://localhost:%d\"]", o1.Cluster.Port)
+
+	// This server's certificate has the expected identity.
+	conf2 := createConfFile(t, []byte(fmt.Sprintf(tmpl, "server", "server", identity, routes)))
+	defer os.Remove(conf2)
+	s2, _ := RunServerWithConfig(conf2)
+	defer s2.Shutdown()
+	checkClusterFormed(t, s1, s2)
+
+	// This one does not have the expected organizational unit and
+	// should be rejected by s1.
+	conf3 := createConfFile(t, []byte(fmt.Sprintf(tmpl, "server-no-ou", "server-no-ou", "", routes)))
+	defer os.Remove(conf3)
+	s3, _ := RunServerWithConfig(conf3)
+	defer s3.Shutdown()
+	time.Sleep(250 * time.Millisecond)
+	checkNumRoutes(t, s3, 0)
+	checkNumRoutes(t, s1, 1)
+}
+
+func TestRouteTLSCertIdentityValidation(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		tls  string
+		err  string
+	}{
+		{"no ca", `
+			cert_file: "../test/configs/certs/routeid/server.pem"
+			key_file: "../test/configs/certs/routeid/server-key.pem"
+			expected_ou: "NATS.io Routes"`,
+			"require a CA file"},
+		{"insecure", `
+			ca_file: "../test/configs/certs/routeid/ca.pem"
+			cert_file: "../test/configs/certs/routeid/server.pem"
+			key_file: "../test/configs/certs/routeid/server-key.pem"
+			insecure: true
+			expected_san: "localhost"`,
+			"can not be used with insecure"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(fmt.Sprintf(`
+				cluster {
+					listen: "127.0.0.1:-1"
+					tls {
+						%s
+					}
+				}
+			`, test.tls)))
+			defer os.Remove(conf)
+			o, err := ProcessConfigFile(conf)
+			if err != nil {
+				t.Fatalf("Error processing config: %v", err)
+			}
+			if err := validateOptions(o); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected error about %q, got %v", test.err, err)
+			}
+		})
+	}
+
+	// Identity checks are not supported in the client TLS block.
+	conf := createConfFile(t, []byte(`
+		tls {
+			cert_file: "../test/configs/certs/routeid/server.pem"
+			key_file: "../test/configs/certs/routeid/server-key.pem"
+			expected_san: "localhost"
+		}
+	`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "only supported for cluster") {
+		t.Fatalf("Expected error, got %v", err)
+	}
+}
+
 func TestBlockedShutdownOnRouteAcceptLoopFailure(t *testing.T) {
 	opts := DefaultOptions()
 	opts.Cluster.Host = "x.x.x.x"
@@ -1078,3 +1181,669 @@ func TestRouteNoCrashOnAddingSubToRoute(t *testing.T) {
 
 	waitCh(t, ch, "Did not get all messages")
 }
+
+func TestRouteClusterName(t *testing.T) {
+	newOpts := func(name string, seed *Options) *Options {
+		o := DefaultOptions()
+		o.Cluster.Name = name
+		o.Cluster.Host = "127.0.0.1"
+		o.Cluster.Port = -1
+		if seed != nil {
+			o.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", seed.Cluster.Port))
+		}
+		return o
+	}
+
+	t.Run("generated", func(t *testing.T) {
+		o1 := newOpts("", nil)
+		s1 := RunServer(o1)
+		defer s1.Shutdown()
+		s2 := RunServer(newOpts("", o1))
+		defer s2.Shutdown()
+		s3 := RunServer(newOpts("", o1))
+		defer s3.Shutdown()
+		checkClusterFormed(t, s1, s2, s3)
+
+		checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+			cn := s1.ClusterName()
+			if cn == "" {
+				return fmt.Errorf("Expected a cluster name to be generated")
+			}
+			for _, s := range []*Server{s2, s3} {
+				if scn := s.ClusterName(); scn != cn {
+					return fmt.Errorf("Expected cluster name %q, got %q", cn, scn)
+				}
+			}
+			return nil
+		})
+	})
+
+	t.Run("configured", func(t *testing.T) {
+		conf := createConfFile(t, []byte(`
+			listen: "127.0.0.1:-1"
+			cluster {
+				name: "A"
+				listen: "127.0.0.1:-1"
+			}
+		`))
+		defer os.Remove(conf)
+		s1, o1 := RunServerWithConfig(conf)
+		defer s1.Shutdown()
+		if cn := s1.ClusterName(); cn != "A" {
+			t.Fatalf("Expected cluster name %q, got %q", "A", cn)
+		}
+		s2 := RunServer(newOpts("", o1))
+		defer s2.Shutdown()
+		checkClusterFormed(t, s1, s2)
+
+		checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+			if cn := s2.ClusterName(); cn != "A" {
+				return fmt.Errorf("Expected cluster name %q, got %q", "A", cn)
+			}
+			return nil
+		})
+		rz, _ := s2.Routez(nil)
+		if rz.ClusterName != "A" {
+			t.Fatalf("Expected routez cluster name %q, got %q", "A", rz.ClusterName)
+		}
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		o1 := newOpts("A", nil)
+		s1 := RunServer(o1)
+		defer s1.Shutdown()
+		s2 := RunServer(newOpts("B", o1))
+		defer s2.Shutdown()
+
+		time.Sleep(100 * time.Millisecond)
+		if n1, n2 := s1.NumRoutes(), s2.NumRoutes(); n1 != 0 || n2 != 0 {
+			t.Fatalf("Expected no route, got %d and %d", n1, n2)
+		}
+		if s1.ClusterName() != "A" || s2.ClusterName() != "B" {
+			t.Fatalf("Cluster names should not have changed, got %q and %q", s1.ClusterName(), s2.ClusterName())
+		}
+	})
+}
+
+func TestRouteCompression(t *testing.T) {
+	newOpts := func(mode string, seed *Options) *Options {
+		o := DefaultOptions()
+		o.Cluster.Host = "127.0.0.1"
+		o.Cluster.Port = -1
+		o.Cluster.Compression = mode
+		if seed != nil {
+			o.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", seed.Cluster.Port))
+		}
+		return o
+	}
+
+	for _, test := range []struct {
+		name       string
+		mode1      string
+		mode2      string
+		compressed bool
+	}{
+		{"fast", CompressionFast, CompressionFast, true},
+		{"best", CompressionBest, CompressionFast, true},
+		{"off on one side", CompressionFast, CompressionOff, false},
+		{"off", _EMPTY_, _EMPTY_, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			o1 := newOpts(test.mode1, nil)
+			s1 := RunServer(o1)
+			defer s1.Shutdown()
+			o2 := newOpts(test.mode2, o1)
+			s2 := RunServer(o2)
+			defer s2.Shutdown()
+			checkClusterFormed(t, s1, s2)
+
+			nc1 := natsConnect(t, fmt.Sprintf("nats://%s:%d", o1.Host, o1.Port))
+			defer nc1.Close()
+			sub := natsSubSync(t, nc1, "foo")
+			natsFlush(t, nc1)
+			checkExpectedSubs(t, 1, s2)
+
+			nc2 := natsConnect(t, fmt.Sprintf("nats://%s:%d", o2.Host, o2.Port))
+			defer nc2.Close()
+			payload := bytes.Repeat([]byte("compress me "), 1000)
+			for i := 0; i < 10; i++ {
+				natsPub(t, nc2, "foo", payload)
+			}
+			for i := 0; i < 10; i++ {
+				if msg := natsNexMsg(t, sub, time.Second); !bytes.Equal(msg.Data, payload) {
+					t.Fatalf("Unexpected payload: %q", msg.Data)
+				}
+			}
+
+			rz, _ := s2.Routez(nil)
+			if len(rz.Routes) != 1 {
+				t.Fatalf("Expected 1 route, got %v", len(rz.Routes))
+			}
+			ri := rz.Routes[0]
+			if !test.compressed {
+				if ri.Compression != _EMPTY_ || ri.CompStats != nil {
+					t.Fatalf("Expected no compression, got %q - %+v", ri.Compression, ri.CompStats)
+				}
+				return
+			}
+			if ri.Compression != test.mode2 {
+				t.Fatalf("Expected compression %q, got %q", test.mode2, ri.Compression)
+			}
+			cs := ri.CompStats
+			if cs == nil || cs.OutRawBytes < int64(10*len(payload)) || cs.OutBytes >= cs.OutRawBytes/10 {
+				t.Fatalf("Unexpected compression stats: %+v", cs)
+			}
+			rz, _ = s1.Routez(nil)
+			if cs := rz.Routes[0].CompStats; cs == nil || cs.InRawBytes < int64(10*len(payload)) || cs.InBytes >= cs.InRawBytes/10 {
+				t.Fatalf("Unexpected compression stats: %+v", cs)
+			}
+		})
+	}
+}
+
+func TestRouteBatching(t *testing.T) {
+	newOpts := func(batch bool, compression string, seed *Options) *Options {
+		o := DefaultOptions()
+		o.Cluster.Host = "127.0.0.1"
+		o.Cluster.Port = -1
+		o.Cluster.Batch = batch
+		o.Cluster.BatchDelay = time.Millisecond
+		o.Cluster.Compression = compression
+		if seed != nil {
+			o.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", seed.Cluster.Port))
+		}
+		return o
+	}
+
+	for _, test := range []struct {
+		name        string
+		batch1      bool
+		batch2      bool
+		compression string
+		batched     bool
+	}{
+		{"on", true, true, _EMPTY_, true},
+		{"on with compression", true, true, CompressionFast, true},
+		{"off on one side", true, false, _EMPTY_, false},
+		{"off", false, false, _EMPTY_, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			o1 := newOpts(test.batch1, test.compression, nil)
+			s1 := RunServer(o1)
+			defer s1.Shutdown()
+			o2 := newOpts(test.batch2, test.compression, o1)
+			s2 := RunServer(o2)
+			defer s2.Shutdown()
+			checkClusterFormed(t, s1, s2)
+
+			nc1 := natsConnect(t, fmt.Sprintf("nats://%s:%d", o1.Host, o1.Port))
+			defer nc1.Close()
+			sub := natsSubSync(t, nc1, "foo")
+			natsFlush(t, nc1)
+			checkExpectedSubs(t, 1, s2)
+
+			nc2 := natsConnect(t, fmt.Sprintf("nats://%s:%d", o2.Host, o2.Port))
+			defer nc2.Close()
+			const total = 5000
+			for i := 0; i < total; i++ {
+				natsPub(t, nc2, "foo", []byte(strconv.Itoa(i)))
+			}
+			for i := 0; i < total; i++ {
+				if msg := natsNexMsg(t, sub, time.Second); string(msg.Data) != strconv.Itoa(i) {
+					t.Fatalf("Expected message %d, got %q", i, msg.Data)
+				}
+			}
+
+			rz, _ := s2.Routez(nil)
+			if len(rz.Routes) != 1 {
+				t.Fatalf("Expected 1 route, got %v", len(rz.Routes))
+			}
+			ri := rz.Routes[0]
+			if !test.batched {
+				if ri.Batching || ri.BatchStats != nil {
+					t.Fatalf("Expected no batching, got %v - %+v", ri.Batching, ri.BatchStats)
+				}
+				return
+			}
+			if !ri.Batching || ri.BatchStats == nil || ri.BatchStats.OutBatches == 0 {
+				t.Fatalf("Unexpected batching: %v - %+v", ri.Batching, ri.BatchStats)
+			}
+			rz, _ = s1.Routez(nil)
+			if bs := rz.Routes[0].BatchStats; bs == nil || bs.InBatches == 0 {
+				t.Fatalf("Unexpected batch stats: %+v", bs)
+			}
+		})
+	}
+}
+
+func TestRouteLoadHints(t *testing.T) {
+	newOpts := func(seed *Options) *Options {
+		o := DefaultOptions()
+		o.Cluster.Host = "127.0.0.1"
+		o.Cluster.Port = -1
+		o.Cluster.LoadHints = true
+		o.Cluster.LoadHintsInterval = 50 * time.Millisecond
+		if seed != nil {
+			o.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", seed.Cluster.Port))
+		}
+		return o
+	}
+	o1 := newOpts(nil)
+	s1 := RunServer(o1)
+	defer s1.Shutdown()
+	o2 := newOpts(o1)
+	s2 := RunServer(o2)
+	defer s2.Shutdown()
+	checkClusterFormed(t, s1, s2)
+
+	for i := 0; i < 3; i++ {
+		nc := natsConnect(t, fmt.Sprintf("nats://%s:%d", o2.Host, o2.Port))
+		defer nc.Close()
+	}
+
+	url1 := s1.clientConnectURLs[0]
+	url2 := s2.clientConnectURLs[0]
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		c, _, l := newClientForServer(s1)
+		defer c.closeConnection(ClientClosed)
+		var info Info
+		if err := json.Unmarshal([]byte(l[5:]), &info); err != nil {
+			return err
+		}
+		l1, l2 := info.ConnectURLsLoad[url1], info.ConnectURLsLoad[url2]
+		if l1 == nil || l2 == nil || l2.Connections != 3 {
+			return fmt.Errorf("Unexpected load hints: %v - %+v", info.ClientConnectURLs, info.ConnectURLsLoad)
+		}
+		return nil
+	})
+
+	// Clients of accounts that do not advertise the cluster only get the
+	// load of this server.
+	s1.mu.Lock()
+	s1.info.ConnectURLsLoad = map[string]*ServerLoad{url1: {}, url2: {Connections: 3}}
+	info := s1.copyInfoForClient(&client{acc: &Account{noAdvertise: true}})
+	s1.mu.Unlock()
+	if len(info.ConnectURLsLoad) != 1 || info.ConnectURLsLoad[url1] == nil {
+		t.Fatalf("Unexpected load hints: %+v", info.ConnectURLsLoad)
+	}
+}
+
+func TestOrderConnectURLs(t *testing.T) {
+	urls := []string{"a:4222", "b:4222", "c:4222"}
+	loads := map[string]*ServerLoad{
+		"a:4222": {Connections: 1000},
+		"b:4222": {Connections: 10, CPU: 50},
+		"c:4222": {Connections: 1000, CPU: 400},
+	}
+	first := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		u := append([]string(nil), urls...)
+		orderConnectURLs(u, ConnectURLsOrderWeighted, loads)
+		if len(u) != 3 || u[0] == u[1] || u[1] == u[2] || u[0] == u[2] {
+			t.Fatalf("Unexpected URLs: %v", u)
+		}
+		first[u[0]]++
+	}
+	// The least loaded server is first most of the time.
+	if first["b:4222"] < 900 {
+		t.Fatalf("Unexpected distribution: %v", first)
+	}
+	// With as many connections, the CPU usage makes the difference.
+	first = make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		u := []string{"a:4222", "c:4222"}
+		orderConnectURLs(u, ConnectURLsOrderWeighted, loads)
+		first[u[0]]++
+	}
+	if first["a:4222"] < 700 {
+		t.Fatalf("Unexpected distribution: %v", first)
+	}
+
+	first = make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		u := append([]string(nil), urls...)
+		orderConnectURLs(u, ConnectURLsOrderShuffle, loads)
+		first[u[0]]++
+	}
+	for _, u := range urls {
+		if first[u] < 200 {
+			t.Fatalf("Unexpected distribution: %v", first)
+		}
+	}
+
+	u := append([]string(nil), urls...)
+	orderConnectURLs(u, ConnectURLsOrderNone, loads)
+	if !reflect.DeepEqual(u, urls) {
+		t.Fatalf("Expected URLs in order, got %v", u)
+	}
+	if _, err := validateConnectURLsOrder("random"); err == nil {
+		t.Fatal("Expected an error for an invalid order")
+	}
+}
+
+func TestRoutePoolAndPinnedAccounts(t *testing.T) {
+	tmpl := `
+		listen: "127.0.0.1:-1"
+		accounts {
+			A { users: [{user: a, password: pwd}] }
+			B { users: [{user: b, password: pwd}] }
+			C { users: [{user: c, password: pwd}] }
+		}
+		cluster {
+			listen: "127.0.0.1:-1"
+			pool_size: 3
+			accounts: ["A"]
+			%s
+		}
+	`
+	conf1 := createConfFile(t, []byte(fmt.Sprintf(tmpl, "")))
+	defer os.Remove(conf1)
+	s1, o1 := RunServerWithConfig(conf1)
+	defer s1.Shutdown()
+
+	routes := fmt.Sprintf("routes: [\"nats://127.0.0.1:%d\"]", o1.Cluster.Port)
+	conf2 := createConfFile(t, []byte(fmt.Sprintf(tmpl, routes)))
+	defer os.Remove(conf2)
+	s2, o2 := RunServerWithConfig(conf2)
+	defer s2.Shutdown()
+
+	// 3 pooled connections plus the one dedicated to account A.
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		for _, s := range []*Server{s1, s2} {
+			if nr, nrm := s.NumRoutes(), s.NumRemotes(); nr != 4 || nrm != 1 {
+				return fmt.Errorf("Expected 4 routes to 1 remote, got %v to %v", nr, nrm)
+			}
+		}
+		return nil
+	})
+
+	for _, user := range []string{"a", "b", "c"} {
+		nc1 := natsConnect(t, fmt.Sprintf("nats://%s:pwd@%s:%d", user, o1.Host, o1.Port))
+		defer nc1.Close()
+		sub := natsSubSync(t, nc1, "foo")
+		natsFlush(t, nc1)
+
+		nc2 := natsConnect(t, fmt.Sprintf("nats://%s:pwd@%s:%d", user, o2.Host, o2.Port))
+		defer nc2.Close()
+		checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+			natsPub(t, nc2, "foo", []byte(user))
+			if _, err := sub.NextMsg(50 * time.Millisecond); err != nil {
+				return err
+			}
+			return nil
+		})
+	}
+
+	// The interest of account A went only over its dedicated connection.
+	rz, _ := s2.Routez(&RoutezOptions{Subscriptions: true})
+	var dedicated bool
+	for _, ri := range rz.Routes {
+		if ri.Account == "A" {
+			dedicated = true
+			if ri.NumSubs != 1 {
+				t.Fatalf("Expected 1 sub on route dedicated to account A, got %v", ri.NumSubs)
+			}
+		} else if ri.PoolIdx < 0 || ri.PoolIdx > 2 {
+			t.Fatalf("Unexpected pool index: %v", ri.PoolIdx)
+		}
+	}
+	if !dedicated {
+		t.Fatalf("Did not find route dedicated to account A: %+v", rz.Routes)
+	}
+
+	// A pooled connection that goes away is reconnected.
+	s2.mu.Lock()
+	var pc *client
+	for _, r := range s2.pooledRoutes {
+		pc = r
+		break
+	}
+	s2.mu.Unlock()
+	pc.closeConnection(ClientClosed)
+	checkFor(t, 3*time.Second, 15*time.Millisecond, func() error {
+		for _, s := range []*Server{s1, s2} {
+			if nr := s.NumRoutes(); nr != 4 {
+				return fmt.Errorf("Expected 4 routes, got %v", nr)
+			}
+		}
+		return nil
+	})
+
+	// When the server goes away, all connections to it are removed.
+	s2.Shutdown()
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if nr := s1.NumRoutes(); nr != 0 {
+			return fmt.Errorf("Expected no route, got %v", nr)
+		}
+		return nil
+	})
+}
+
+type testRouteResolver struct {
+	sync.Mutex
+	ports []int
+}
+
+func (r *testRouteResolver) setPorts(ports ...int) {
+	r.Lock()
+	r.ports = ports
+	r.Unlock()
+}
+
+func (r *testRouteResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return []string{"127.0.0.1"}, nil
+}
+
+func (r *testRouteResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.Lock()
+	defer r.Unlock()
+	if name != "nats.cluster.local" {
+		return _EMPTY_, nil, fmt.Errorf("no such host %q", name)
+	}
+	var srvs []*net.SRV
+	for _, port := range r.ports {
+		srvs = append(srvs, &net.SRV{Target: "127.0.0.1.", Port: uint16(port)})
+	}
+	return name, srvs, nil
+}
+
+func TestRouteDNSDiscovery(t *testing.T) {
+	resolver := &testRouteResolver{}
+	orgResolver := routeDNSResolver
+	routeDNSResolver = resolver
+	defer func() { routeDNSResolver = orgResolver }()
+
+	newOpts := func(dns bool) *Options {
+		o := DefaultOptions()
+		o.Cluster.Host = "127.0.0.1"
+		o.Cluster.Port = -1
+		if dns {
+			o.Cluster.DNSRoutes = RoutesFromStr("srv://nats.cluster.local")
+			o.Cluster.DNSRefresh = 50 * time.Millisecond
+		}
+		return o
+	}
+	checkRoutes := func(t *testing.T, expected int, servers ...*Server) {
+		t.Helper()
+		checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+			for _, s := range servers {
+				if nr := s.NumRoutes(); nr != expected {
+					return fmt.Errorf("Expected %v routes, got %v", expected, nr)
+				}
+			}
+			return nil
+		})
+	}
+
+	o1 := newOpts(true)
+	s1 := RunServer(o1)
+	defer s1.Shutdown()
+	o2 := newOpts(true)
+	s2 := RunServer(o2)
+	defer s2.Shutdown()
+	// This one does not discover routes itself.
+	o3 := newOpts(false)
+	s3 := RunServer(o3)
+	defer s3.Shutdown()
+
+	resolver.setPorts(o1.Cluster.Port, o2.Cluster.Port)
+	checkClusterFormed(t, s1, s2)
+
+	// New servers are found when resolving again.
+	resolver.setPorts(o1.Cluster.Port, o2.Cluster.Port, o3.Cluster.Port)
+	checkClusterFormed(t, s1, s2, s3)
+
+	// And the routes to the ones that are no longer resolved are removed.
+	// Note that s3 may reconnect on its own, so check that the connections
+	// that existed are closed.
+	var routes []*client
+	for _, s := range []*Server{s1, s2} {
+		s.mu.Lock()
+		routes = append(routes, s.remotes[s3.ID()])
+		s.mu.Unlock()
+	}
+	resolver.setPorts(o1.Cluster.Port, o2.Cluster.Port)
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		for _, r := range routes {
+			r.mu.Lock()
+			closed := r.nc == nil
+			r.mu.Unlock()
+			if !closed {
+				return fmt.Errorf("Route to server no longer resolved still opened")
+			}
+		}
+		return nil
+	})
+	s3.Shutdown()
+	checkRoutes(t, 1, s1, s2)
+
+	// Failing lookups do not remove anything.
+	o4 := newOpts(false)
+	o4.Cluster.DNSRoutes = RoutesFromStr("srv://nats.cluster.local, srv://unknown.cluster.local")
+	if err := validateDNSRoutes(o4); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, complete := s1.resolveDNSRoutes(o4.Cluster.DNSRoutes); complete {
+		t.Fatal("Expected resolution to be incomplete")
+	}
+	o4.Cluster.DNSRoutes = RoutesFromStr("nats-route://nats.cluster.local")
+	if err := validateDNSRoutes(o4); err == nil {
+		t.Fatal("Expected error for DNS route without port")
+	}
+}
+
+func TestRouteTags(t *testing.T) {
+	optsA := DefaultOptions()
+	optsA.Cluster.Port = -1
+	optsA.Tags = []string{"az:a"}
+	srvA := RunServer(optsA)
+	defer srvA.Shutdown()
+
+	optsB := DefaultOptions()
+	optsB.Cluster.Port = -1
+	optsB.Tags = []string{"az:b"}
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", optsA.Cluster.Port))
+	srvB := RunServer(optsB)
+	defer srvB.Shutdown()
+
+	checkClusterFormed(t, srvA, srvB)
+
+	for _, test := range []struct {
+		s    *Server
+		tags []string
+	}{
+		{srvA, optsB.Tags},
+		{srvB, optsA.Tags},
+	} {
+		rz, err := test.s.Routez(nil)
+		if err != nil {
+			t.Fatalf("Error getting routez: %v", err)
+		}
+		if len(rz.Routes) != 1 || !reflect.DeepEqual(rz.Routes[0].Tags, test.tags) {
+			t.Fatalf("Expected route with tags %v, got %+v", test.tags, rz.Routes)
+		}
+	}
+}
+
+func TestRouteQueueLocalPreference(t *testing.T) {
+	tmpl := `
+		listen: "127.0.0.1:-1"
+		accounts {
+			A { users: [{user: a, password: pwd}], queue_local_preference: true }
+			B { users: [{user: b, password: pwd}] }
+		}
+		cluster {
+			listen: "127.0.0.1:-1"
+			%s
+		}
+	`
+	conf1 := createConfFile(t, []byte(fmt.Sprintf(tmpl, "")))
+	defer os.Remove(conf1)
+	s1, o1 := RunServerWithConfig(conf1)
+	defer s1.Shutdown()
+
+	routes := fmt.Sprintf("routes: [\"nats://127.0.0.1:%d\"]", o1.Cluster.Port)
+	conf2 := createConfFile(t, []byte(fmt.Sprintf(tmpl, routes)))
+	defer os.Remove(conf2)
+	s2, o2 := RunServerWithConfig(conf2)
+	defer s2.Shutdown()
+	checkClusterFormed(t, s1, s2)
+
+	for _, test := range []struct {
+		user        string
+		account     string
+		preferLocal bool
+	}{
+		{"a", "A", true},
+		{"b", "B", false},
+	} {
+		t.Run(test.user, func(t *testing.T) {
+			nc1 := natsConnect(t, fmt.Sprintf("nats://%s:pwd@%s:%d", test.user, o1.Host, o1.Port))
+			defer nc1.Close()
+			local := natsQueueSubSync(t, nc1, "foo", "bar")
+			natsFlush(t, nc1)
+
+			nc2 := natsConnect(t, fmt.Sprintf("nats://%s:pwd@%s:%d", test.user, o2.Host, o2.Port))
+			defer nc2.Close()
+			remote := natsQueueSubSync(t, nc2, "foo", "bar")
+			natsFlush(t, nc2)
+			checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+				acc, _ := s1.LookupAccount(test.account)
+				if n := acc.sl.Count(); n != 2 {
+					return fmt.Errorf("Expected 2 subscriptions, got %d", n)
+				}
+				return nil
+			})
+
+			for i := 0; i < 100; i++ {
+				natsPub(t, nc1, "foo", []byte("ok"))
+			}
+			natsFlush(t, nc1)
+			checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+				nl, _, _ := local.Pending()
+				nr, _, _ := remote.Pending()
+				if nl+nr != 100 {
+					return fmt.Errorf("Expected 100 messages, got %d", nl+nr)
+				}
+				return nil
+			})
+			nr, _, _ := remote.Pending()
+			if test.preferLocal && nr != 0 {
+				t.Fatalf("Expected no message to the remote member, got %d", nr)
+			} else if !test.preferLocal && nr == 0 {
+				t.Fatalf("Expected messages to the remote member")
+			}
+
+			// Without a local member, the remote one gets the messages.
+			natsUnsub(t, local)
+			natsPub(t, nc1, "foo", []byte("ok"))
+			natsFlush(t, nc1)
+			checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+				if n, _, _ := remote.Pending(); n != nr+1 {
+					return fmt.Errorf("Expected %d messages to the remote member, got %d", nr+1, n)
+				}
+				return nil
+			})
+		})
+	}
+}
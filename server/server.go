@@ -34,11 +34,12 @@ import (
 	"time"
 
 	// Allow dynamic profiling.
-	_ "net/http/pprof"
+	"net/http/pprof"
 
 	"github.com/nats-io/jwt"
 	"github.com/nats-io/nats-server/v2/logger"
 	"github.com/nats-io/nkeys"
+	"github.com/nats-io/nuid"
 )
 
 // Time to wait before starting closing clients when in LD mode.
@@ -65,11 +66,28 @@ type Info struct {
 	CID               uint64   `json:"client_id,omitempty"`
 	Nonce             string   `json:"nonce,omitempty"`
 	Cluster           string   `json:"cluster,omitempty"`
-	ClientConnectURLs []string `json:"connect_urls,omitempty"` // Contains URLs a client can connect to.
+	ClusterDynamic    bool     `json:"cluster_dynamic,omitempty"`
+	ClientConnectURLs []string `json:"connect_urls,omitempty"`    // Contains URLs a client can connect to.
+	Headers           bool     `json:"headers"`                   // Supports message headers (HPUB/HMSG).
+	Drain             bool     `json:"drain,omitempty"`           // Supports the DRAIN protocol.
+	SubRateLimits     bool     `json:"sub_rate_limits,omitempty"` // Supports rate options on SUB.
+	QueueWeights      bool     `json:"queue_weights,omitempty"`   // Supports the weight option on queue SUB.
+	LameDuckMode      bool     `json:"ldm,omitempty"`             // The client should reconnect to another server.
+
+	// Load of the servers behind the connect URLs, when advertised.
+	ConnectURLsLoad map[string]*ServerLoad `json:"connect_urls_load,omitempty"`
 
 	// Route Specific
-	Import *SubjectPermission `json:"import,omitempty"`
-	Export *SubjectPermission `json:"export,omitempty"`
+	Import           *SubjectPermission `json:"import,omitempty"`
+	Export           *SubjectPermission `json:"export,omitempty"`
+	Compression      string             `json:"compression,omitempty"`       // Compression mode the route accepts
+	CompressionStart bool               `json:"compression_start,omitempty"` // What follows this INFO is compressed
+	RouteBatch       bool               `json:"route_batch,omitempty"`       // Supports batches of route protocols
+	LoadHints        bool               `json:"load_hints,omitempty"`        // Exchanges the load of the servers
+	Load             *ServerLoad        `json:"load,omitempty"`              // Load of the server, the only content of the INFO
+	RoutePoolSize    int                `json:"route_pool_size,omitempty"`   // Number of pooled route connections
+	RouteAccounts    []string           `json:"route_accounts,omitempty"`    // Accounts with dedicated route connections
+	Tags             []string           `json:"tags,omitempty"`              // Tags of the server (sent by route's and gateway's INFO)
 
 	// Gateways Specific
 	Gateway           string   `json:"gateway,omitempty"`             // Name of the origin Gateway (sent by gateway's INFO)
@@ -86,42 +104,60 @@ type Info struct {
 type Server struct {
 	gcid uint64
 	stats
-	mu               sync.Mutex
-	kp               nkeys.KeyPair
-	prand            *rand.Rand
-	info             Info
-	configFile       string
-	optsMu           sync.RWMutex
-	opts             *Options
-	running          bool
-	shutdown         bool
-	listener         net.Listener
-	gacc             *Account
-	sys              *internal
-	accounts         sync.Map
-	activeAccounts   int32
-	accResolver      AccountResolver
-	clients          map[uint64]*client
-	routes           map[uint64]*client
-	remotes          map[string]*client
-	leafs            map[uint64]*client
-	users            map[string]*User
-	nkeys            map[string]*NkeyUser
-	totalClients     uint64
-	closed           *closedRingBuffer
-	done             chan bool
-	start            time.Time
-	http             net.Listener
-	httpHandler      http.Handler
-	profiler         net.Listener
-	httpReqStats     map[string]uint64
-	routeListener    net.Listener
-	routeInfo        Info
-	routeInfoJSON    []byte
-	leafNodeListener net.Listener
-	leafNodeInfo     Info
-	leafNodeInfoJSON []byte
-	leafNodeOpts     struct {
+	mu                 sync.Mutex
+	kp                 nkeys.KeyPair
+	prand              *rand.Rand
+	info               Info
+	configFile         string
+	optsMu             sync.RWMutex
+	opts               *Options
+	cnMu               sync.RWMutex
+	cn                 string
+	cnDynamic          bool
+	running            bool
+	shutdown           bool
+	listener           net.Listener
+	listenerReplaced   chan struct{} // closed when listener is replaced on reload
+	gacc               *Account
+	sys                *internal
+	js                 *jetStream
+	accounts           sync.Map
+	activeAccounts     int32
+	accResolver        AccountResolver
+	clients            map[uint64]*client
+	ipConns            map[string]int // Client connections per remote IP.
+	userConns          map[string]int // Client connections per user.
+	routes             map[uint64]*client
+	remotes            map[string]*client
+	pooledRoutes       map[string]*client
+	dnsRoutes          routeDNS
+	leafs              map[uint64]*client
+	users              map[string]*User
+	nkeys              map[string]*NkeyUser
+	totalClients       uint64
+	closed             *closedRingBuffer
+	done               chan bool
+	start              time.Time
+	http               net.Listener
+	httpHandler        http.Handler
+	profiler           net.Listener
+	httpReqStats       map[string]uint64
+	routeListener      net.Listener
+	routeInfo          Info
+	routeInfoJSON      []byte
+	leafNodeListener   net.Listener
+	leafNodeWSListener net.Listener
+	wsListener         net.Listener
+	mqttListener       net.Listener
+	mqtt               srvMQTT
+	stompListener      net.Listener
+	httpBridgeListener net.Listener
+	httpBridge         srvHTTPBridge
+	otel               *otelExporter
+	mtrace             *msgTracer
+	leafNodeInfo       Info
+	leafNodeInfoJSON   []byte
+	leafNodeOpts       struct {
 		resolver    netResolver
 		dialTimeout time.Duration
 	}
@@ -149,6 +185,14 @@ type Server struct {
 	// Used internally for quick look-ups.
 	clientConnectURLsMap map[string]struct{}
 
+	// Drives the reads of the client connections when enabled.
+	poller *poller
+
+	// Load of the remote servers by server ID, and of the servers behind
+	// the client connect URLs, when the cluster exchanges load hints.
+	routeLoads map[string]*ServerLoad
+	urlsLoad   map[string]*ServerLoad
+
 	lastCURLsUpdate int64
 
 	// For Gateways
@@ -171,10 +215,18 @@ type Server struct {
 	// endpoint /varz (when it comes from http).
 	varzMu sync.Mutex
 	varz   *Varz
+	// Counters at the last computation of the /varz rates.
+	varzRates varzRateSample
 	// This is set during a config reload if we detect that we have
 	// added/removed routes. The monitoring code then check that
 	// to know if it should update the cluster's URLs array.
 	varzUpdateRouteURLs bool
+
+	// Gate the publishers wait on while the pending bytes of all
+	// connections are above the limit.
+	pendMu     sync.Mutex
+	pendGate   chan struct{}
+	pendPaused int32
 }
 
 // Make sure all are 64bits for atomic use
@@ -184,8 +236,19 @@ type stats struct {
 	inBytes       int64
 	outBytes      int64
 	slowConsumers int64
+	flushes       int64
+	flushBytes    int64
+	flushVectors  int64
+	flushSizes    [len(flushSizeBounds) + 1]int64
+	outPending    int64
+	maxOutPending int64
+	pendPauses    int64
 }
 
+// Upper bounds of the buckets of the histogram of the flush sizes, the last
+// bucket counting the larger flushes.
+var flushSizeBounds = [...]int64{512, 4 * 1024, 32 * 1024, 256 * 1024, 2 * 1024 * 1024}
+
 // New will setup a new server struct after parsing the options.
 // DEPRECATED: Use NewServer(opts)
 func New(opts *Options) *Server {
@@ -215,17 +278,21 @@ func NewServer(opts *Options) (*Server, error) {
 	}
 
 	info := Info{
-		ID:           pub,
-		Version:      VERSION,
-		Proto:        PROTO,
-		GitCommit:    gitCommit,
-		GoVersion:    runtime.Version(),
-		Host:         opts.Host,
-		Port:         opts.Port,
-		AuthRequired: false,
-		TLSRequired:  tlsReq,
-		TLSVerify:    verify,
-		MaxPayload:   opts.MaxPayload,
+		ID:            pub,
+		Version:       VERSION,
+		Proto:         PROTO,
+		GitCommit:     gitCommit,
+		GoVersion:     runtime.Version(),
+		Host:          opts.Host,
+		Port:          opts.Port,
+		AuthRequired:  false,
+		TLSRequired:   tlsReq,
+		TLSVerify:     verify,
+		MaxPayload:    opts.MaxPayload,
+		Headers:       true,
+		Drain:         true,
+		SubRateLimits: true,
+		QueueWeights:  true,
 	}
 
 	now := time.Now()
@@ -239,6 +306,7 @@ func NewServer(opts *Options) (*Server, error) {
 		start:      now,
 		configTime: now,
 	}
+	s.maxOutPending = opts.MaxTotalPending
 
 	// Trusted root operator keys.
 	if !s.processTrustedKeys() {
@@ -253,6 +321,7 @@ func NewServer(opts *Options) (*Server, error) {
 
 	// Used internally for quick look-ups.
 	s.clientConnectURLsMap = make(map[string]struct{})
+	s.routeLoads = make(map[string]*ServerLoad)
 
 	// Call this even if there is no gateway defined. It will
 	// initialize the structure so we don't have to check for
@@ -263,9 +332,19 @@ func NewServer(opts *Options) (*Server, error) {
 	}
 	s.gateway = gws
 
-	if s.gateway.enabled {
-		s.info.Cluster = s.getGatewayName()
+	// The cluster name is the gateway name if gateways are enabled. If
+	// no name is configured, one is generated and may be replaced by the
+	// name of the servers we connect to so that all converge to the same.
+	switch {
+	case s.gateway.enabled:
+		s.cn = s.getGatewayName()
+	case opts.Cluster.Name != "":
+		s.cn = opts.Cluster.Name
+	case opts.Cluster.Port != 0 || len(opts.Routes) > 0:
+		s.cn = nuid.Next()
+		s.cnDynamic = true
 	}
+	s.info.Cluster = s.cn
 
 	// This is normally done in the AcceptLoop, once the
 	// listener has been created (possibly with random port),
@@ -275,6 +354,8 @@ func NewServer(opts *Options) (*Server, error) {
 
 	// For tracking clients
 	s.clients = make(map[uint64]*client)
+	s.ipConns = make(map[string]int)
+	s.userConns = make(map[string]int)
 
 	// For tracking closed clients.
 	s.closed = newClosedRingBuffer(opts.MaxClosedClients)
@@ -286,6 +367,7 @@ func NewServer(opts *Options) (*Server, error) {
 	// For tracking routes and their remote ids
 	s.routes = make(map[uint64]*client)
 	s.remotes = make(map[string]*client)
+	s.pooledRoutes = make(map[string]*client)
 
 	// For tracking leaf nodes.
 	s.leafs = make(map[uint64]*client)
@@ -294,6 +376,14 @@ func NewServer(opts *Options) (*Server, error) {
 	// to shutdown.
 	s.quitCh = make(chan struct{})
 
+	// For exporting the spans of traced messages.
+	if opts.OTel.Endpoint != _EMPTY_ {
+		s.otel = newOTelExporter(s, &opts.OTel)
+	}
+
+	// For sending the events of traced messages.
+	s.mtrace = newMsgTracer(s)
+
 	// For tracking accounts
 	if err := s.configureAccounts(); err != nil {
 		return nil, err
@@ -318,16 +408,143 @@ func validateOptions(o *Options) error {
 	if err := validateTrustedOperators(o); err != nil {
 		return err
 	}
+	// Check that the account template is trusted.
+	if err := validateAccountTemplate(o); err != nil {
+		return err
+	}
+	// Check that the no auth user refers to a configured user.
+	if err := validateNoAuthUser(o); err != nil {
+		return err
+	}
 	// Check on leaf nodes which will require a system
 	// account when gateways are also configured.
 	if err := validateLeafNode(o); err != nil {
 		return err
 	}
+	// Check the proxies of the solicited connections.
+	if err := validateProxies(o); err != nil {
+		return err
+	}
+	// Check the client websocket listener.
+	if err := validateWebsocketOptions(o); err != nil {
+		return err
+	}
+	// Check the MQTT listener.
+	if err := validateMQTTOptions(o); err != nil {
+		return err
+	}
+	// Check the HTTP bridge.
+	if err := validateHTTPBridgeOptions(o); err != nil {
+		return err
+	}
+	// Check the formats of the log outputs.
+	if err := validateLogFormats(o); err != nil {
+		return err
+	}
+	// Check the remote syslog.
+	if err := validateRemoteSyslog(o); err != nil {
+		return err
+	}
+	// Check the span exporter.
+	if err := validateOTelOptions(o); err != nil {
+		return err
+	}
+	// Check that the route compression mode is known.
+	if _, err := validateCompressionMode(o.Cluster.Compression); err != nil {
+		return err
+	}
+	// Check the route batch delay.
+	if o.Cluster.BatchDelay < 0 {
+		return fmt.Errorf("cluster batch_delay can not be negative")
+	}
+	// Check the load hints interval and the order of the connect URLs.
+	if o.Cluster.LoadHintsInterval < 0 {
+		return fmt.Errorf("cluster load_hints_interval can not be negative")
+	}
+	if _, err := validateConnectURLsOrder(o.Cluster.ConnectURLsOrder); err != nil {
+		return err
+	}
+	// Check the route pool size and accounts with dedicated routes.
+	if err := validateRoutePool(o); err != nil {
+		return err
+	}
+	// Check that the route certificate identity checks can be enforced.
+	if err := validateRouteTLSIdentity(o); err != nil {
+		return err
+	}
+	// Check the routes to discover through DNS.
+	if err := validateDNSRoutes(o); err != nil {
+		return err
+	}
+	// Check the accept loops and socket options of the client listener.
+	if err := validateTCPOptions(o); err != nil {
+		return err
+	}
+	// Check the tuning of the writes to the connections.
+	if err := validateOutboundOptions(o); err != nil {
+		return err
+	}
+	// Check GOMAXPROCS and the CPU affinity.
+	if err := validateProcsOptions(o); err != nil {
+		return err
+	}
+	if o.MaxTotalPending < 0 {
+		return fmt.Errorf("max_total_pending can not be negative")
+	}
+	// The closed connections are kept in a fixed size ring buffer.
+	if o.MaxClosedClients < 0 {
+		return fmt.Errorf("max_closed_clients can not be negative")
+	}
+	if o.StatszInterval < 0 {
+		return fmt.Errorf("statsz_interval can not be negative")
+	}
+	// Streams are replicated through the system account.
+	if o.JetStream && (o.Cluster.Port != 0 || len(o.Routes) > 0) && o.SystemAccount == _EMPTY_ {
+		return fmt.Errorf("jetstream in clustered mode requires a system account")
+	}
+	// The cluster and gateway names, when both set, need to match.
+	if o.Cluster.Name != "" && o.Gateway.Name != "" && o.Cluster.Name != o.Gateway.Name {
+		return fmt.Errorf("cluster name %q does not match gateway name %q", o.Cluster.Name, o.Gateway.Name)
+	}
 	// Check that gateway is properly configured. Returns no error
 	// if there is no gateway defined.
 	return validateGatewayOptions(o)
 }
 
+// ClusterName returns the name of the cluster this server belongs to.
+func (s *Server) ClusterName() string {
+	s.cnMu.RLock()
+	cn := s.cn
+	s.cnMu.RUnlock()
+	return cn
+}
+
+// Returns the cluster name and if it was generated, in which
+// case it can be replaced by the one of a remote server.
+func (s *Server) clusterName() (string, bool) {
+	s.cnMu.RLock()
+	defer s.cnMu.RUnlock()
+	return s.cn, s.cnDynamic
+}
+
+// Sets the cluster name and regenerates the INFO protocols
+// that carry it. Server lock should not be held.
+func (s *Server) setClusterName(name string, dynamic bool) {
+	s.mu.Lock()
+	s.cnMu.Lock()
+	s.cn = name
+	s.cnDynamic = dynamic
+	s.cnMu.Unlock()
+	s.info.Cluster = name
+	s.routeInfo.Cluster = name
+	s.routeInfo.ClusterDynamic = dynamic
+	s.generateRouteInfoJSON()
+	s.leafNodeInfo.Cluster = name
+	s.generateLeafNodeInfoJSON()
+	s.mu.Unlock()
+	s.Noticef("Cluster name is now %q", name)
+}
+
 func (s *Server) getOpts() *Options {
 	s.optsMu.RLock()
 	opts := s.opts
@@ -557,7 +774,21 @@ func (s *Server) isRunning() bool {
 
 func (s *Server) logPid() error {
 	pidStr := strconv.Itoa(os.Getpid())
-	return ioutil.WriteFile(s.getOpts().PidFile, []byte(pidStr), 0660)
+	return writeFileAtomic(s.getOpts().PidFile, []byte(pidStr), 0660)
+}
+
+// Delete the given pid file, unless it has since been written by another process.
+func (s *Server) deletePidFile(pidFile string) {
+	if pidFile == _EMPTY_ {
+		return
+	}
+	b, err := ioutil.ReadFile(pidFile)
+	if err != nil || string(b) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	if err := os.Remove(pidFile); err != nil {
+		s.Errorf("Error cleaning up pid file %s: %v", pidFile, err)
+	}
 }
 
 // NewAccountsAllowed returns whether or not new accounts can be created on the fly.
@@ -613,19 +844,230 @@ func (s *Server) LookupOrRegisterAccount(name string) (account *Account, isNew b
 	return acc, true
 }
 
+// AccountOptions are used to define or update an account at runtime.
+// Limits that are zero or negative mean no limit.
+type AccountOptions struct {
+	MaxConnections   int
+	MaxLeafNodes     int
+	MaxSubscriptions int
+	MaxPayload       int
+	Users            []*User
+	Nkeys            []*NkeyUser
+}
+
 // RegisterAccount will register an account. The account must be new
-// or this call will fail.
-func (s *Server) RegisterAccount(name string) (*Account, error) {
+// or this call will fail. Optional account options can be passed to set
+// limits and users of the account. Options can not be used in operator mode.
+// Accounts registered this way are not part of the configuration and
+// will be replaced on a configuration reload.
+func (s *Server) RegisterAccount(name string, opts ...*AccountOptions) (*Account, error) {
+	var ao *AccountOptions
+	if len(opts) > 0 {
+		ao = opts[0]
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if _, ok := s.accounts.Load(name); ok {
 		return nil, ErrAccountExists
 	}
-	s.mu.Lock()
 	acc := NewAccount(name)
+	if ao != nil {
+		if len(s.trustedKeys) > 0 {
+			return nil, ErrAccountManagedByOperator
+		}
+		if err := s.checkAccountUsers(acc, ao); err != nil {
+			return nil, err
+		}
+		s.setAccountOptions(acc, ao)
+	}
 	s.registerAccount(acc)
-	s.mu.Unlock()
 	return acc, nil
 }
 
+// UpdateAccount will update the limits and users of an existing account.
+// Users of the account that are no longer present or whose password changed
+// are disconnected, as are the most recent connections if the account is
+// over its new connection limit. This can not be used in operator mode.
+func (s *Server) UpdateAccount(name string, opts *AccountOptions) error {
+	if opts == nil {
+		return ErrBadAccount
+	}
+	s.mu.Lock()
+	if len(s.trustedKeys) > 0 {
+		s.mu.Unlock()
+		return ErrAccountManagedByOperator
+	}
+	v, ok := s.accounts.Load(name)
+	if !ok {
+		s.mu.Unlock()
+		return ErrMissingAccount
+	}
+	acc := v.(*Account)
+	if err := s.checkAccountUsers(acc, opts); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	pwds := s.accountUserPasswords(acc)
+	s.setAccountOptions(acc, opts)
+
+	acc.mu.RLock()
+	all := make([]*client, 0, len(acc.clients))
+	for _, c := range acc.clients {
+		all = append(all, c)
+	}
+	acc.mu.RUnlock()
+
+	var clients, removed []*client
+	for _, c := range all {
+		if c.kind == CLIENT && (s.clientHasMovedToDifferentAccount(c) || s.clientPasswordChanged(c, pwds)) {
+			removed = append(removed, c)
+		} else {
+			clients = append(clients, c)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, c := range removed {
+		c.authViolation()
+	}
+	acc.enforceLimits(clients)
+	return nil
+}
+
+// DeleteAccount will remove an account and its users from the server.
+// All connections bound to the account are closed. The global and
+// system accounts can not be deleted, nor can accounts in operator mode.
+func (s *Server) DeleteAccount(name string) error {
+	s.mu.Lock()
+	if len(s.trustedKeys) > 0 {
+		s.mu.Unlock()
+		return ErrAccountManagedByOperator
+	}
+	v, ok := s.accounts.Load(name)
+	if !ok {
+		s.mu.Unlock()
+		return ErrMissingAccount
+	}
+	acc := v.(*Account)
+	if acc == s.gacc || (s.sys != nil && acc == s.sys.account) {
+		s.mu.Unlock()
+		return ErrReservedAccount
+	}
+	s.removeAccountUsers(acc)
+	s.accounts.Delete(name)
+	s.mu.Unlock()
+
+	acc.mu.Lock()
+	acc.clearExpirationTimer()
+	clients := make([]*client, 0, len(acc.clients))
+	for _, c := range acc.clients {
+		if c.kind == CLIENT || c.kind == LEAF {
+			clients = append(clients, c)
+		}
+	}
+	acc.mu.Unlock()
+
+	for _, c := range clients {
+		c.sendErrAndErr(ErrMissingAccount.Error())
+		c.closeConnection(AccountDeleted)
+	}
+	s.Noticef("Deleted account %q", name)
+	return nil
+}
+
+// Check that users and nkeys for the account are not already
+// defined for a different account.
+// Lock should be held.
+func (s *Server) checkAccountUsers(acc *Account, opts *AccountOptions) error {
+	for _, u := range opts.Users {
+		if eu, ok := s.users[u.Username]; ok && eu.Account != acc {
+			return fmt.Errorf("user %q already exists", u.Username)
+		}
+	}
+	for _, u := range opts.Nkeys {
+		if eu, ok := s.nkeys[u.Nkey]; ok && eu.Account != acc {
+			return fmt.Errorf("nkey %q already exists", u.Nkey)
+		}
+	}
+	return nil
+}
+
+// Remove all users and nkeys bound to the account.
+// Lock should be held.
+func (s *Server) removeAccountUsers(acc *Account) {
+	for name, u := range s.users {
+		if u.Account == acc {
+			delete(s.users, name)
+		}
+	}
+	for nkey, u := range s.nkeys {
+		if u.Account == acc {
+			delete(s.nkeys, nkey)
+		}
+	}
+}
+
+// Returns the passwords of the users bound to the account.
+// Lock should be held.
+func (s *Server) accountUserPasswords(acc *Account) map[string]string {
+	pwds := make(map[string]string)
+	for name, u := range s.users {
+		if u.Account == acc {
+			pwds[name] = u.Password
+		}
+	}
+	return pwds
+}
+
+// Returns true if the client authenticated as a user whose password is no
+// longer the one in the given passwords.
+// Lock should be held.
+func (s *Server) clientPasswordChanged(c *client, pwds map[string]string) bool {
+	if c.opts.Nkey != "" || c.opts.Username == "" {
+		return false
+	}
+	u := s.users[c.opts.Username]
+	return u != nil && u.Password != pwds[c.opts.Username]
+}
+
+// Apply the account options, replacing any existing users of the account.
+// Lock should be held.
+func (s *Server) setAccountOptions(acc *Account, opts *AccountOptions) {
+	limit := func(v int) int32 {
+		if v <= 0 {
+			return jwt.NoLimit
+		}
+		return int32(v)
+	}
+	acc.mu.Lock()
+	acc.mconns = limit(opts.MaxConnections)
+	acc.mleafs = limit(opts.MaxLeafNodes)
+	acc.msubs = limit(opts.MaxSubscriptions)
+	acc.mpay = limit(opts.MaxPayload)
+	acc.mu.Unlock()
+
+	s.removeAccountUsers(acc)
+	if len(opts.Users) > 0 && s.users == nil {
+		s.users = make(map[string]*User)
+	}
+	for _, u := range opts.Users {
+		copy := u.clone()
+		copy.Account = acc
+		s.users[u.Username] = copy
+	}
+	if len(opts.Nkeys) > 0 && s.nkeys == nil {
+		s.nkeys = make(map[string]*NkeyUser)
+	}
+	for _, u := range opts.Nkeys {
+		copy := u.clone()
+		copy.Account = acc
+		s.nkeys[u.Nkey] = copy
+	}
+	if s.users != nil || s.nkeys != nil {
+		s.info.AuthRequired = true
+	}
+}
+
 // SetSystemAccount will set the internal system account.
 // If root operators are present it will also check validity.
 func (s *Server) SetSystemAccount(accName string) error {
@@ -691,7 +1133,7 @@ func (s *Server) setSystemAccount(acc *Account) error {
 		servers: make(map[string]*serverUpdate),
 		subs:    make(map[string]msgHandler),
 		sendq:   make(chan *pubMsg, 128),
-		statsz:  eventsHBInterval,
+		statsz:  statszInterval(s.getOpts().StatszInterval),
 		orphMax: 5 * eventsHBInterval,
 		chkOrph: 3 * eventsHBInterval,
 	}
@@ -912,9 +1354,32 @@ func (s *Server) fetchAccount(name string) (*Account, error) {
 		s.registerAccount(acc)
 		return acc, nil
 	}
+	// Unknown accounts can be created from the account template.
+	if err == ErrMissingAccount {
+		if acc := s.accountFromTemplate(name); acc != nil {
+			return acc, nil
+		}
+	}
 	return nil, err
 }
 
+// accountFromTemplate will create and register a new account from the
+// account template if one is configured.
+// Lock should be held upon entry.
+func (s *Server) accountFromTemplate(name string) *Account {
+	tmpl := s.getOpts().AccountTemplate
+	if tmpl == nil || !nkeys.IsValidPublicAccountKey(name) {
+		return nil
+	}
+	// The account inherits limits, exports and imports from the template.
+	ac := *tmpl
+	ac.Subject = name
+	acc := s.buildInternalAccount(&ac)
+	s.registerAccount(acc)
+	s.Noticef("Created account %q from account template", name)
+	return acc
+}
+
 // Start up the server, this will block.
 // Start via a Go routine if needed.
 func (s *Server) Start() {
@@ -925,6 +1390,11 @@ func (s *Server) Start() {
 		gc = "not set"
 	}
 	s.Noticef("Git commit [%s]", gc)
+	if s.getOpts().Debug {
+		if cfg, err := s.EffectiveConfig(); err == nil {
+			s.Debugf("Effective configuration:\n%s", cfg)
+		}
+	}
 
 	// Check for insecure configurations.op
 	s.checkAuthforWarnings()
@@ -941,6 +1411,9 @@ func (s *Server) Start() {
 	// Snapshot server options.
 	opts := s.getOpts()
 
+	// Set the CPU affinity and GOMAXPROCS before starting the loops.
+	s.configureProcs(opts)
+
 	hasOperators := len(opts.TrustedOperators) > 0
 	if hasOperators {
 		s.Noticef("Trusted Operators")
@@ -976,6 +1449,24 @@ func (s *Server) Start() {
 		}
 	}
 
+	// Start JetStream if enabled. This is done after the system account
+	// is set so that it is not enabled for it.
+	if opts.JetStream {
+		cfg := &JetStreamConfig{
+			MaxMemory: opts.JetStreamMaxMemory,
+			MaxStore:  opts.JetStreamMaxStore,
+			StoreDir:  opts.StoreDir,
+			Cipher:    opts.JetStreamCipher,
+			Key:       opts.JetStreamKey,
+			PrevKey:   opts.JetStreamPrevKey,
+			Tier:      opts.JetStreamTier,
+		}
+		if err := s.EnableJetStream(cfg); err != nil {
+			s.Fatalf("Can't start JetStream: %v", err)
+			return
+		}
+	}
+
 	// Start up gateway if needed. Do this before starting the routes, because
 	// we want to resolve the gateway host:port so that this information can
 	// be sent to other routes.
@@ -991,7 +1482,47 @@ func (s *Server) Start() {
 		// This ensure that we have resolved or assigned the advertise
 		// address for the leafnode listener. We need that in StartRouting().
 		<-ch
+		if opts.LeafNode.Websocket.Port != 0 {
+			ch = make(chan struct{})
+			go s.leafNodeWebsocketAcceptLoop(ch)
+			<-ch
+		}
+	}
+
+	// Start up the websocket listener for clients if needed.
+	if opts.Websocket.Port != 0 {
+		ch := make(chan struct{})
+		go s.websocketAcceptLoop(ch)
+		<-ch
+	}
+
+	// Start up the MQTT listener if needed.
+	if opts.MQTT.Port != 0 {
+		ch := make(chan struct{})
+		go s.mqttAcceptLoop(ch)
+		<-ch
+	}
+
+	// Start up the STOMP listener if needed.
+	if opts.STOMP.Port != 0 {
+		ch := make(chan struct{})
+		go s.stompAcceptLoop(ch)
+		<-ch
+	}
+
+	// Start up the HTTP bridge if needed.
+	if opts.HTTPBridge.Port != 0 {
+		if err := s.startHTTPBridge(); err != nil {
+			s.Fatalf("Can't start HTTP bridge: %v", err)
+			return
+		}
+	}
+
+	// Start exporting the spans of traced messages if needed.
+	if s.otel != nil {
+		s.startGoRoutine(s.otel.run)
 	}
+	s.startGoRoutine(s.mtrace.run)
 
 	// Solicit remote servers for leaf node connections.
 	if len(opts.LeafNode.Remotes) > 0 {
@@ -1014,7 +1545,7 @@ func (s *Server) Start() {
 		s.StartProfiler()
 	}
 
-	if opts.PortsFileDir != _EMPTY_ {
+	if opts.PortsFile != _EMPTY_ || opts.PortsFileDir != _EMPTY_ {
 		s.logPorts()
 	}
 
@@ -1025,12 +1556,17 @@ func (s *Server) Start() {
 // Shutdown will shutdown the server instance by kicking out the AcceptLoop
 // and closing all associated clients.
 func (s *Server) Shutdown() {
+	s.sdNotify(sdNotifyStopping)
+
 	// Shutdown the eventing system as needed.
 	// This is done first to send out any messages for
 	// account status. We will also clean up any
 	// eventing items associated with accounts.
 	s.shutdownEventing()
 
+	// Stop JetStream, the data of the streams is kept.
+	s.shutdownJetStream()
+
 	s.mu.Lock()
 	// Prevent issues with multiple calls.
 	if s.shutdown {
@@ -1088,6 +1624,39 @@ func (s *Server) Shutdown() {
 		s.leafNodeListener.Close()
 		s.leafNodeListener = nil
 	}
+	if s.leafNodeWSListener != nil {
+		doneExpected++
+		s.leafNodeWSListener.Close()
+		s.leafNodeWSListener = nil
+	}
+
+	// Kick websocket AcceptLoop()
+	if s.wsListener != nil {
+		doneExpected++
+		s.wsListener.Close()
+		s.wsListener = nil
+	}
+
+	// Kick MQTT AcceptLoop()
+	if s.mqttListener != nil {
+		doneExpected++
+		s.mqttListener.Close()
+		s.mqttListener = nil
+	}
+
+	// Kick STOMP AcceptLoop()
+	if s.stompListener != nil {
+		doneExpected++
+		s.stompListener.Close()
+		s.stompListener = nil
+	}
+
+	// Kick HTTP bridge
+	if s.httpBridgeListener != nil {
+		doneExpected++
+		s.httpBridgeListener.Close()
+		s.httpBridgeListener = nil
+	}
 
 	// Kick route AcceptLoop()
 	if s.routeListener != nil {
@@ -1116,11 +1685,17 @@ func (s *Server) Shutdown() {
 		s.profiler.Close()
 	}
 
+	poller := s.poller
 	s.mu.Unlock()
 
 	// Release go routines that wait on that channel
 	close(s.quitCh)
 
+	// Kick the poller waiting for ready sockets.
+	if poller != nil {
+		poller.stop()
+	}
+
 	// Close client and route connections
 	for _, c := range conns {
 		c.setNoReconnect()
@@ -1136,9 +1711,10 @@ func (s *Server) Shutdown() {
 	// Wait for go routines to be done.
 	s.grWG.Wait()
 
-	if opts.PortsFileDir != _EMPTY_ {
-		s.deletePortsFile(opts.PortsFileDir)
+	if opts.PortsFile != _EMPTY_ || opts.PortsFileDir != _EMPTY_ {
+		s.deletePortsFile(opts.PortsFile, opts.PortsFileDir)
 	}
+	s.deletePidFile(opts.PidFile)
 
 	// Close logger if applicable. It allows tests on Windows
 	// to be able to do proper cleanup (delete log file).
@@ -1166,13 +1742,19 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 	opts := s.getOpts()
 
 	hp := net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port))
-	l, e := net.Listen("tcp", hp)
+	l, e := listenClients(hp, opts.AcceptLoops)
 	if e != nil {
 		s.Fatalf("Error listening on port: %s, %q", hp, e)
 		return
 	}
 	s.Noticef("Listening for client connections on %s",
 		net.JoinHostPort(opts.Host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
+	if opts.AcceptLoops > 1 {
+		s.Noticef("Accepting client connections with %d loops", opts.AcceptLoops)
+	}
+	if opts.Poller {
+		s.startPoller(opts)
+	}
 
 	// Alert of TLS enabled.
 	if opts.TLSConfig != nil {
@@ -1181,10 +1763,13 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 
 	s.Noticef("Server id is %s", s.info.ID)
 	s.Noticef("Server is ready")
+	s.sdNotifyReadyAndStartWatchdog()
 
 	// Setup state that can enable shutdown
 	s.mu.Lock()
 	s.listener = l
+	s.listenerReplaced = make(chan struct{})
+	replaced := s.listenerReplaced
 
 	// If server was started with RANDOM_PORT (-1), opts.Port would be equal
 	// to 0 at the beginning this function. So we need to get the actual port
@@ -1209,16 +1794,154 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 	close(clr)
 	clr = nil
 
+	s.acceptClients(l, replaced)
+}
+
+// Validates the accept loops and the socket options of client connections.
+func validateTCPOptions(o *Options) error {
+	if o.AcceptLoops < 0 {
+		return fmt.Errorf("accept_loops can not be negative")
+	}
+	if o.PollerWorkers < 0 {
+		return fmt.Errorf("poller_workers can not be negative")
+	}
+	to := &o.TCP
+	if to.ReadBuffer < 0 || to.WriteBuffer < 0 {
+		return fmt.Errorf("tcp buffer sizes can not be negative")
+	}
+	if to.KeepAliveInterval < 0 || to.KeepAliveCount < 0 {
+		return fmt.Errorf("tcp keepalive probes settings can not be negative")
+	}
+	if (to.KeepAliveInterval > 0 || to.KeepAliveCount > 0) && !keepAliveProbesSupported {
+		return fmt.Errorf("tcp keepalive probes settings are not supported on this platform")
+	}
+	return nil
+}
+
+// Validates the tuning of the writes to the connections.
+func validateOutboundOptions(o *Options) error {
+	oo := &o.Outbound
+	if oo.MaxVectors < 0 || oo.CoalesceDelay < 0 {
+		return fmt.Errorf("outbound max_vectors and coalesce_delay can not be negative")
+	}
+	for _, sz := range []int{oo.MinBufferSize, oo.MaxBufferSize} {
+		if sz < 0 || sz&(sz-1) != 0 || sz > 1<<30 {
+			return fmt.Errorf("outbound buffer sizes must be powers of 2 up to 1GB, got %d", sz)
+		}
+	}
+	min, max := oo.MinBufferSize, oo.MaxBufferSize
+	if min == 0 {
+		min = minBufSize
+	}
+	if max == 0 {
+		max = maxBufSize
+	}
+	if min > max {
+		return fmt.Errorf("outbound min_buffer_size %d is greater than max_buffer_size %d", min, max)
+	}
+	_, err := parseBufGrowth(oo.BufferGrowth)
+	return err
+}
+
+// listenClients binds the client listener. With more than one accept loop,
+// and when supported, a listener is bound with SO_REUSEPORT for each loop,
+// the first one resolving the port if random. Note that other processes of
+// the same user can then bind the port too.
+func listenClients(hp string, loops int) (net.Listener, error) {
+	if loops <= 1 || !reusePortSupported {
+		return net.Listen("tcp", hp)
+	}
+	lc := net.ListenConfig{Control: reusePort}
+	first, err := lc.Listen(context.Background(), "tcp", hp)
+	if err != nil {
+		return nil, err
+	}
+	rl := &reusePortListener{Listener: first, listeners: []net.Listener{first}}
+	host, _, _ := net.SplitHostPort(hp)
+	hp = net.JoinHostPort(host, strconv.Itoa(first.Addr().(*net.TCPAddr).Port))
+	for i := 1; i < loops; i++ {
+		l, err := lc.Listen(context.Background(), "tcp", hp)
+		if err != nil {
+			rl.Close()
+			return nil, err
+		}
+		rl.listeners = append(rl.listeners, l)
+	}
+	return rl, nil
+}
+
+// reusePortListener is the client listener made of the listeners bound to
+// the same port, one for each accept loop. It is closed as a whole.
+type reusePortListener struct {
+	// The first listener, accepting on it or getting the address.
+	net.Listener
+	listeners []net.Listener
+}
+
+// Close closes all the listeners.
+func (rl *reusePortListener) Close() error {
+	var err error
+	for _, l := range rl.listeners {
+		if cerr := l.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Accepts client connections on the given listener until the server is
+// shutdown, enters lame duck mode, or the listener is replaced on reload,
+// in which case the replaced channel is closed before the listener.
+// The connections are accepted by the configured number of accept loops.
+func (s *Server) acceptClients(l net.Listener, replaced chan struct{}) {
+	listeners := []net.Listener{l}
+	if rl, ok := l.(*reusePortListener); ok {
+		listeners = rl.listeners
+	}
+	// Without a listener for each of them, the accept loops share it.
+	loops := s.getOpts().AcceptLoops
+	if loops < len(listeners) {
+		loops = len(listeners)
+	}
+	var wg sync.WaitGroup
+	wg.Add(loops)
+	for i := 0; i < loops; i++ {
+		go func(l net.Listener) {
+			s.acceptClientConns(l, replaced)
+			wg.Done()
+		}(listeners[i%len(listeners)])
+	}
+	wg.Wait()
+
+	select {
+	case <-replaced:
+		// The accept loop of the new listener takes over.
+		return
+	default:
+	}
+	if s.isLameDuckMode() {
+		// Signal that we are not accepting new clients
+		s.ldmCh <- true
+		// Now wait for the Shutdown...
+		<-s.quitCh
+		return
+	}
+	s.done <- true
+}
+
+// Accept loop of acceptClients, returns once the listener is closed.
+func (s *Server) acceptClientConns(l net.Listener, replaced chan struct{}) {
 	tmpDelay := ACCEPT_MIN_SLEEP
 
 	for s.isRunning() {
 		conn, err := l.Accept()
 		if err != nil {
+			select {
+			case <-replaced:
+				return
+			default:
+			}
 			if s.isLameDuckMode() {
-				// Signal that we are not accepting new clients
-				s.ldmCh <- true
-				// Now wait for the Shutdown...
-				<-s.quitCh
 				return
 			}
 			tmpDelay = s.acceptError("Client", err, tmpDelay)
@@ -1226,11 +1949,44 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 		}
 		tmpDelay = ACCEPT_MIN_SLEEP
 		s.startGoRoutine(func() {
+			s.setClientConnOptions(conn)
 			s.createClient(conn)
 			s.grWG.Done()
 		})
 	}
-	s.done <- true
+}
+
+// setClientConnOptions sets the configured socket options of an accepted
+// client connection. Errors are only reported, the connection being usable.
+func (s *Server) setClientConnOptions(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	to := s.getOpts().TCP
+	var err error
+	if to.Nagle {
+		err = tc.SetNoDelay(false)
+	}
+	if err == nil && to.ReadBuffer > 0 {
+		err = tc.SetReadBuffer(to.ReadBuffer)
+	}
+	if err == nil && to.WriteBuffer > 0 {
+		err = tc.SetWriteBuffer(to.WriteBuffer)
+	}
+	if err == nil && to.KeepAlive < 0 {
+		err = tc.SetKeepAlive(false)
+	} else if err == nil {
+		if to.KeepAlive > 0 {
+			err = tc.SetKeepAlivePeriod(to.KeepAlive)
+		}
+		if err == nil && keepAliveProbesSupported {
+			err = setKeepAliveProbes(tc, to.KeepAliveInterval, to.KeepAliveCount)
+		}
+	}
+	if err != nil {
+		s.Warnf("Error setting socket options of client connection: %v", err)
+	}
 }
 
 // This function sets the server's info Host/Port based on server Options.
@@ -1279,7 +2035,7 @@ func (s *Server) StartProfiler() {
 
 	srv := &http.Server{
 		Addr:           hp,
-		Handler:        http.DefaultServeMux,
+		Handler:        s.profAuth(http.DefaultServeMux),
 		MaxHeaderBytes: 1 << 20,
 	}
 
@@ -1348,6 +2104,12 @@ const (
 	GatewayzPath = "/gatewayz"
 	SubszPath    = "/subsz"
 	StackszPath  = "/stacksz"
+	AccountzPath = "/accountz"
+	LeafzPath    = "/leafz"
+	MetricsPath  = "/metrics"
+	HealthzPath  = "/healthz"
+	JszPath      = "/jsz"
+	ProfPath     = "/debug/pprof/"
 )
 
 // Start the monitoring server
@@ -1363,6 +2125,11 @@ func (s *Server) startMonitoring(secure bool) error {
 		RoutezPath:   0,
 		GatewayzPath: 0,
 		SubszPath:    0,
+		AccountzPath: 0,
+		LeafzPath:    0,
+		MetricsPath:  0,
+		HealthzPath:  0,
+		JszPath:      0,
 	}
 
 	var (
@@ -1419,6 +2186,25 @@ func (s *Server) startMonitoring(secure bool) error {
 	mux.HandleFunc("/subscriptionsz", s.HandleSubsz)
 	// Stacksz
 	mux.HandleFunc(StackszPath, s.HandleStacksz)
+	// Accountz
+	mux.HandleFunc(AccountzPath, s.HandleAccountz)
+	// Leafz
+	mux.HandleFunc(LeafzPath, s.HandleLeafz)
+	// Metrics
+	mux.HandleFunc(MetricsPath, s.HandleMetrics)
+	// Healthz
+	mux.HandleFunc(HealthzPath, s.HandleHealthz)
+	// Jsz
+	mux.HandleFunc(JszPath, s.HandleJsz)
+	// Profiling, only when explicitly enabled.
+	if opts.Prof.Enabled {
+		mux.Handle(ProfPath, s.profAuth(http.HandlerFunc(pprof.Index)))
+		mux.Handle(ProfPath+"cmdline", s.profAuth(http.HandlerFunc(pprof.Cmdline)))
+		mux.Handle(ProfPath+"profile", s.profAuth(http.HandlerFunc(pprof.Profile)))
+		mux.Handle(ProfPath+"symbol", s.profAuth(http.HandlerFunc(pprof.Symbol)))
+		mux.Handle(ProfPath+"trace", s.profAuth(http.HandlerFunc(pprof.Trace)))
+		runtime.SetBlockProfileRate(1)
+	}
 
 	// Do not set a WriteTimeout because it could cause cURL/browser
 	// to return empty response or unable to display page if the
@@ -1463,6 +2249,9 @@ func (s *Server) copyInfo() Info {
 	if info.ClientConnectURLs != nil {
 		info.ClientConnectURLs = make([]string, len(s.info.ClientConnectURLs))
 		copy(info.ClientConnectURLs, s.info.ClientConnectURLs)
+		if len(info.ClientConnectURLs) > 1 {
+			orderConnectURLs(info.ClientConnectURLs, s.getOpts().Cluster.ConnectURLsOrder, s.urlsLoad)
+		}
 	}
 	if s.nonceRequired() {
 		// Nonce handling
@@ -1474,6 +2263,34 @@ func (s *Server) copyInfo() Info {
 	return info
 }
 
+// Returns a copy of the server's INFO for the given client. If the client's
+// account does not want the cluster to be advertised, only this server's
+// client connect URLs are included.
+// Server and client locks are held on entry.
+func (s *Server) copyInfoForClient(c *client) Info {
+	info := s.copyInfo()
+	if c.acc != nil && c.acc.noAdvertise {
+		// Only this server's URLs, unless it is going away.
+		info.ClientConnectURLs = nil
+		if !s.ldm {
+			info.ClientConnectURLs = append([]string(nil), s.clientConnectURLs...)
+		}
+		if info.ConnectURLsLoad != nil {
+			loads := make(map[string]*ServerLoad, len(info.ClientConnectURLs))
+			for _, u := range info.ClientConnectURLs {
+				if l := info.ConnectURLsLoad[u]; l != nil {
+					loads[u] = l
+				}
+			}
+			info.ConnectURLsLoad = loads
+		}
+	}
+	if isWebsocketConn(c.nc) {
+		wsClientInfo(&info)
+	}
+	return info
+}
+
 func (s *Server) createClient(conn net.Conn) *client {
 	// Snapshot server options.
 	opts := s.getOpts()
@@ -1497,6 +2314,10 @@ func (s *Server) createClient(conn net.Conn) *client {
 	s.totalClients++
 	s.mu.Unlock()
 
+	if isWebsocketConn(conn) {
+		wsClientInfo(&info)
+	}
+
 	// Grab lock
 	c.mu.Lock()
 
@@ -1529,7 +2350,16 @@ func (s *Server) createClient(conn net.Conn) *client {
 		c.maxConnExceeded()
 		return nil
 	}
+	// Same for the connections from the client's IP.
+	if opts.MaxConnPerIP > 0 && c.host != _EMPTY_ && s.ipConns[c.host] >= opts.MaxConnPerIP {
+		s.mu.Unlock()
+		c.maxIPConnExceeded()
+		return nil
+	}
 	s.clients[c.cid] = c
+	if c.host != _EMPTY_ {
+		s.ipConns[c.host]++
+	}
 	s.mu.Unlock()
 
 	// Re-Grab lock
@@ -1581,8 +2411,13 @@ func (s *Server) createClient(conn net.Conn) *client {
 	// Set the Ping timer
 	c.setPingTimer()
 
-	// Spin up the read loop.
-	s.startGoRoutine(func() { c.readLoop() })
+	// Set the idle timer, if enabled.
+	c.setIdleTimer(opts.IdleTimeout)
+
+	// Spin up the read loop, unless the reads are driven by the poller.
+	if !s.pollClient(c) {
+		s.startGoRoutine(func() { c.readLoop() })
+	}
 
 	// Spin up the write loop.
 	s.startGoRoutine(func() { c.writeLoop() })
@@ -1673,8 +2508,10 @@ func (s *Server) updateServerINFOAndSendINFOToClients(urls []string, add bool) {
 	if wasUpdated {
 		// Recreate the info.ClientConnectURL array from the map
 		s.info.ClientConnectURLs = s.info.ClientConnectURLs[:0]
-		// Add this server client connect ULRs first...
-		s.info.ClientConnectURLs = append(s.info.ClientConnectURLs, s.clientConnectURLs...)
+		// Add this server client connect ULRs first, unless it is going away...
+		if !s.ldm {
+			s.info.ClientConnectURLs = append(s.info.ClientConnectURLs, s.clientConnectURLs...)
+		}
 		for url := range s.clientConnectURLsMap {
 			s.info.ClientConnectURLs = append(s.info.ClientConnectURLs, url)
 		}
@@ -1735,10 +2572,18 @@ func (s *Server) removeClient(c *client) {
 		if c.kind == CLIENT && c.opts.Protocol >= ClientProtoInfo {
 			updateProtoInfoCount = true
 		}
+		ukey := c.ukey
 		c.mu.Unlock()
 
 		s.mu.Lock()
+		// Connections rejected when registering were not counted.
+		if _, ok := s.clients[cid]; ok && c.host != _EMPTY_ {
+			decrementConnCount(s.ipConns, c.host)
+		}
 		delete(s.clients, cid)
+		if ukey != _EMPTY_ {
+			decrementConnCount(s.userConns, ukey)
+		}
 		if updateProtoInfoCount {
 			s.cproto--
 		}
@@ -1752,6 +2597,45 @@ func (s *Server) removeClient(c *client) {
 	}
 }
 
+// registerUserConn counts the connection for its authenticated user, and
+// returns false if the user already has its maximum number of connections.
+func (s *Server) registerUserConn(c *client) bool {
+	c.mu.Lock()
+	key := nameForClient(c)
+	limit := c.umc
+	counted := c.ukey != _EMPTY_
+	c.mu.Unlock()
+	if counted || key == "N/A" {
+		return true
+	}
+	if limit == 0 {
+		limit = s.getOpts().MaxConnPerUser
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if limit > 0 && s.userConns[key] >= limit {
+		return false
+	}
+	if s.userConns == nil {
+		s.userConns = make(map[string]int)
+	}
+	s.userConns[key]++
+	c.mu.Lock()
+	c.ukey = key
+	c.mu.Unlock()
+	return true
+}
+
+// Decrements the connection count of the key, removing it once at zero.
+// Server lock should be held.
+func decrementConnCount(counts map[string]int, key string) {
+	if n := counts[key]; n > 1 {
+		counts[key] = n - 1
+	} else {
+		delete(counts, key)
+	}
+}
+
 func (s *Server) removeFromTempClients(cid uint64) {
 	s.grMu.Lock()
 	delete(s.grTmpClients, cid)
@@ -1842,6 +2726,78 @@ func (s *Server) numSubscriptions() uint32 {
 	return uint32(subs)
 }
 
+// recordFlush updates the flush statistics with a write of n bytes from
+// the given number of buffers.
+func (s *Server) recordFlush(n int64, vecs int) {
+	atomic.AddInt64(&s.flushes, 1)
+	atomic.AddInt64(&s.flushBytes, n)
+	atomic.AddInt64(&s.flushVectors, int64(vecs))
+	i := 0
+	for i < len(flushSizeBounds) && n > flushSizeBounds[i] {
+		i++
+	}
+	atomic.AddInt64(&s.flushSizes[i], 1)
+}
+
+// addOutPending adds n, which can be negative, to the pending bytes of all
+// connections. The publishers are paused once above the limit, and resumed
+// once below three quarters of it.
+func (s *Server) addOutPending(n int64) {
+	total := atomic.AddInt64(&s.outPending, n)
+	max := atomic.LoadInt64(&s.maxOutPending)
+	if n > 0 && max > 0 && total > max {
+		s.pendMu.Lock()
+		if s.pendGate == nil {
+			s.pendGate = make(chan struct{})
+			atomic.StoreInt32(&s.pendPaused, 1)
+			atomic.AddInt64(&s.pendPauses, 1)
+			s.Warnf("Pending bytes of all connections above %d, pausing the publishers", max)
+		}
+		s.pendMu.Unlock()
+	} else if n < 0 && atomic.LoadInt32(&s.pendPaused) == 1 && total < max-max/4 {
+		s.releaseOutPending()
+	}
+}
+
+// releaseOutPending resumes the paused publishers, if any.
+func (s *Server) releaseOutPending() {
+	s.pendMu.Lock()
+	if s.pendGate != nil {
+		close(s.pendGate)
+		s.pendGate = nil
+		atomic.StoreInt32(&s.pendPaused, 0)
+		s.Noticef("Pending bytes of all connections back to %d, resuming the publishers",
+			atomic.LoadInt64(&s.outPending))
+	}
+	s.pendMu.Unlock()
+}
+
+// waitOutPending pauses a publisher while the pending bytes of all
+// connections are above the limit, up to maxPendingPause so that its
+// connection is still checked for PONGs.
+func (s *Server) waitOutPending(c *client) {
+	gate := s.outPendingGate()
+	if gate == nil {
+		return
+	}
+	select {
+	case <-gate:
+	case <-time.After(maxPendingPause):
+		c.Debugf("Timed out of the pause on the pending bytes of all connections")
+	}
+}
+
+// Returns the channel closed once the paused publishers are resumed, or
+// nil if they are not paused.
+func (s *Server) outPendingGate() chan struct{} {
+	if atomic.LoadInt32(&s.pendPaused) == 0 {
+		return nil
+	}
+	s.pendMu.Lock()
+	defer s.pendMu.Unlock()
+	return s.pendGate
+}
+
 // NumSlowConsumers will report the number of slow consumers.
 func (s *Server) NumSlowConsumers() int64 {
 	return atomic.LoadInt64(&s.slowConsumers)
@@ -2074,6 +3030,8 @@ type Ports struct {
 	Monitoring []string `json:"monitoring,omitempty"`
 	Cluster    []string `json:"cluster,omitempty"`
 	Profile    []string `json:"profile,omitempty"`
+	Gateway    []string `json:"gateway,omitempty"`
+	LeafNodes  []string `json:"leafnodes,omitempty"`
 }
 
 // PortsInfo attempts to resolve all the ports. If after maxWait the ports are not
@@ -2089,6 +3047,8 @@ func (s *Server) PortsInfo(maxWait time.Duration) *Ports {
 		httpListener := s.http
 		clusterListener := s.routeListener
 		profileListener := s.profiler
+		gatewayListener := s.gatewayListener
+		leafNodeListener := s.leafNodeListener
 		s.mu.Unlock()
 
 		ports := Ports{}
@@ -2121,18 +3081,33 @@ func (s *Server) PortsInfo(maxWait time.Duration) *Ports {
 			ports.Profile = formatURL("http", profileListener)
 		}
 
+		if gatewayListener != nil {
+			gatewayProto := "nats"
+			if opts.Gateway.TLSConfig != nil {
+				gatewayProto = "tls"
+			}
+			ports.Gateway = formatURL(gatewayProto, gatewayListener)
+		}
+
+		if leafNodeListener != nil {
+			leafProto := "nats"
+			if opts.LeafNode.TLSConfig != nil {
+				leafProto = "tls"
+			}
+			ports.LeafNodes = formatURL(leafProto, leafNodeListener)
+		}
+
 		return &ports
 	}
 
 	return nil
 }
 
-// Returns the portsFile. If a non-empty dirHint is provided, the dirHint
-// path is used instead of the server option value
-func (s *Server) portFile(dirHint string) string {
-	dirname := s.getOpts().PortsFileDir
-	if dirHint != "" {
-		dirname = dirHint
+// Returns the ports file, which is the given file if not empty, or the
+// `exename_pid.ports` file in the given directory.
+func portFile(file, dirname string) string {
+	if file != _EMPTY_ {
+		return file
 	}
 	if dirname == _EMPTY_ {
 		return _EMPTY_
@@ -2140,23 +3115,23 @@ func (s *Server) portFile(dirHint string) string {
 	return filepath.Join(dirname, fmt.Sprintf("%s_%d.ports", filepath.Base(os.Args[0]), os.Getpid()))
 }
 
-// Delete the ports file. If a non-empty dirHint is provided, the dirHint
-// path is used instead of the server option value
-func (s *Server) deletePortsFile(hintDir string) {
-	portsFile := s.portFile(hintDir)
+// Delete the ports file, see portFile for how it is named.
+func (s *Server) deletePortsFile(file, dirname string) {
+	portsFile := portFile(file, dirname)
 	if portsFile != "" {
-		if err := os.Remove(portsFile); err != nil {
+		if err := os.Remove(portsFile); err != nil && !os.IsNotExist(err) {
 			s.Errorf("Error cleaning up ports file %s: %v", portsFile, err)
 		}
 	}
 }
 
-// Writes a file with a serialized Ports to the specified ports_file_dir.
-// The name of the file is `exename_pid.ports`, typically nats-server_pid.ports.
+// Writes a file with a serialized Ports to the specified ports_file, or
+// to the specified ports_file_dir. The name of the file in the directory
+// is `exename_pid.ports`, typically nats-server_pid.ports.
 // if ports file is not set, this function has no effect
 func (s *Server) logPorts() {
 	opts := s.getOpts()
-	portsFile := s.portFile(opts.PortsFileDir)
+	portsFile := portFile(opts.PortsFile, opts.PortsFileDir)
 	if portsFile != _EMPTY_ {
 		go func() {
 			info := s.PortsInfo(5 * time.Second)
@@ -2169,7 +3144,7 @@ func (s *Server) logPorts() {
 				s.Errorf("Error marshaling ports file: %v", err)
 				return
 			}
-			if err := ioutil.WriteFile(portsFile, data, 0666); err != nil {
+			if err := writeFileAtomic(portsFile, data, 0666); err != nil {
 				s.Errorf("Error writing ports file (%s): %v", portsFile, err)
 				return
 			}
@@ -2224,6 +3199,12 @@ func (s *Server) serviceListeners() []net.Listener {
 	if opts.ProfPort != 0 {
 		listeners = append(listeners, s.profiler)
 	}
+	if opts.Gateway.Port != 0 {
+		listeners = append(listeners, s.gatewayListener)
+	}
+	if opts.LeafNode.Port != 0 {
+		listeners = append(listeners, s.leafNodeListener)
+	}
 	return listeners
 }
 
@@ -2234,25 +3215,39 @@ func (s *Server) isLameDuckMode() bool {
 	return s.ldm
 }
 
+// LameDuckMode makes the server stop accepting new clients and close the
+// existing ones over the given duration, or the LameDuckDuration option if
+// zero, before shutting down. It returns once the mode is entered.
+func (s *Server) LameDuckMode(dur time.Duration) error {
+	s.mu.Lock()
+	shutdown, ldm, listener := s.shutdown, s.ldm, s.listener
+	s.mu.Unlock()
+	if shutdown {
+		return ErrServerNotRunning
+	}
+	if ldm {
+		return ErrLameDuckMode
+	}
+	if listener == nil {
+		return ErrServerNotRunning
+	}
+	// Not tracked, since it ends with the shutdown of the server.
+	go s.lameDuckModeFor(dur)
+	return nil
+}
+
 // This function will close the client listener then close the clients
 // at some interval to avoid a reconnecting storm.
 func (s *Server) lameDuckMode() {
-	s.mu.Lock()
-	// Check if there is actually anything to do
-	if s.shutdown || s.ldm || s.listener == nil {
-		s.mu.Unlock()
+	s.lameDuckModeFor(0)
+}
+
+// Enters lame duck mode, closing the clients over the given duration, or
+// the LameDuckDuration option if zero.
+func (s *Server) lameDuckModeFor(ldd time.Duration) {
+	if !s.enterLameDuckMode() {
 		return
 	}
-	s.Noticef("Entering lame duck mode, stop accepting new clients")
-	s.ldm = true
-	s.ldmCh = make(chan bool, 1)
-	s.listener.Close()
-	s.listener = nil
-	s.mu.Unlock()
-
-	// Wait for accept loop to be done to make sure that no new
-	// client can connect
-	<-s.ldmCh
 
 	s.mu.Lock()
 	// Need to recheck few things
@@ -2264,27 +3259,14 @@ func (s *Server) lameDuckMode() {
 		s.Shutdown()
 		return
 	}
-	dur := int64(s.getOpts().LameDuckDuration)
+	if ldd == 0 {
+		ldd = s.getOpts().LameDuckDuration
+	}
+	dur := int64(ldd)
 	dur -= atomic.LoadInt64(&lameDuckModeInitialDelay)
 	if dur <= 0 {
 		dur = int64(time.Second)
 	}
-	numClients := int64(len(s.clients))
-	batch := 1
-	// Sleep interval between each client connection close.
-	si := dur / numClients
-	if si < 1 {
-		// Should not happen (except in test with very small LD duration), but
-		// if there are too many clients, batch the number of close and
-		// use a tiny sleep interval that will result in yield likely.
-		si = 1
-		batch = int(numClients / dur)
-	} else if si > int64(time.Second) {
-		// Conversely, there is no need to sleep too long between clients
-		// and spread say 10 clients for the 2min duration. Sleeping no
-		// more than 1sec.
-		si = int64(time.Second)
-	}
 
 	// Now capture all clients
 	clients := make([]*client, 0, len(s.clients))
@@ -2303,8 +3285,266 @@ func (s *Server) lameDuckMode() {
 	case <-s.quitCh:
 		return
 	}
+	if !s.closeClientsSpread(clients, dur, ServerShutdown) {
+		return
+	}
+	s.Shutdown()
+}
+
+// Closes the client listener and advertises the removal of this server to
+// its clients and routes, then waits for the accept loop to be done so that
+// no new client can connect. Returns false if the server is not running or
+// already in lame duck mode.
+func (s *Server) enterLameDuckMode() bool {
+	s.mu.Lock()
+	// Check if there is actually anything to do
+	if s.shutdown || s.ldm || s.listener == nil {
+		s.mu.Unlock()
+		return false
+	}
+	s.Noticef("Entering lame duck mode, stop accepting new clients")
+	s.ldm = true
+	s.ldmCh = make(chan bool, 1)
+	s.listener.Close()
+	s.listener = nil
+	// Let the clients and the other servers of the cluster know that
+	// this server is going away.
+	s.sendLDMToRoutes()
+	s.sendLDMToClients()
+	s.mu.Unlock()
+
+	// Wait for accept loop to be done to make sure that no new
+	// client can connect
+	<-s.ldmCh
+	return true
+}
+
+// DrainStage identifies a stage of a server drain.
+type DrainStage int
+
+const (
+	// DrainLeafNodes is the stage where the leafnode connections are closed.
+	DrainLeafNodes DrainStage = iota
+	// DrainClients is the stage where the client connections are closed.
+	DrainClients
+	// DrainRoutes is the stage where the route connections are closed.
+	DrainRoutes
+)
+
+// String returns the name of the drain stage.
+func (ds DrainStage) String() string {
+	switch ds {
+	case DrainLeafNodes:
+		return "leafnodes"
+	case DrainClients:
+		return "clients"
+	case DrainRoutes:
+		return "routes"
+	default:
+		return "unknown"
+	}
+}
+
+// DrainProgress is reported to the callback given to Server.Drain
+// after each connection closed during a stage.
+type DrainProgress struct {
+	Stage  DrainStage
+	Closed int
+	Total  int
+}
+
+// Drain stops accepting new clients, as in lame duck mode, then closes the
+// leafnode connections, the client connections, flushing any pending data
+// first, and the route connections, before shutting down the server. If
+// not nil, progress is called after each connection closed. If the context
+// is done before the drain completes, the server is shutdown right away and
+// the context error is returned.
+func (s *Server) Drain(ctx context.Context, progress func(DrainProgress)) error {
+	s.mu.Lock()
+	shutdown, ldm := s.shutdown, s.ldm
+	s.mu.Unlock()
+	if shutdown {
+		return ErrServerNotRunning
+	}
+	if ldm {
+		return ErrLameDuckMode
+	}
+	if !s.enterLameDuckMode() {
+		return ErrServerNotRunning
+	}
+	defer s.Shutdown()
+
+	s.Noticef("Draining server")
+	for _, stage := range []DrainStage{DrainLeafNodes, DrainClients, DrainRoutes} {
+		conns := s.drainConns(stage)
+		for i, c := range conns {
+			select {
+			case <-ctx.Done():
+				s.Warnf("Draining of %s interrupted: %v", stage, ctx.Err())
+				return ctx.Err()
+			default:
+			}
+			// Leafnodes and routes would otherwise be reconnected.
+			if c.kind != CLIENT {
+				c.setNoReconnect()
+			}
+			c.closeConnection(ServerShutdown)
+			if progress != nil {
+				progress(DrainProgress{Stage: stage, Closed: i + 1, Total: len(conns)})
+			}
+		}
+	}
+	s.Noticef("Server drained")
+	return nil
+}
+
+// Returns the connections to close in the given drain stage.
+func (s *Server) drainConns(stage DrainStage) []*client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var conns []*client
+	switch stage {
+	case DrainLeafNodes:
+		for _, c := range s.leafs {
+			conns = append(conns, c)
+		}
+	case DrainClients:
+		for _, c := range s.clients {
+			conns = append(conns, c)
+		}
+	case DrainRoutes:
+		for _, r := range s.routes {
+			conns = append(conns, r)
+		}
+	}
+	return conns
+}
+
+// Sends an INFO without the client URLs of this server to the routes, so
+// that the other servers stop advertising them to their clients.
+// Server lock is held on entry.
+func (s *Server) sendLDMToRoutes() {
+	s.routeInfo.LameDuckMode = true
+	s.routeInfo.ClientConnectURLs = nil
+	s.generateRouteInfoJSON()
+	for _, r := range s.routes {
+		r.mu.Lock()
+		if r.opts.Protocol >= RouteProtoInfo {
+			r.sendInfo(s.routeInfoJSON)
+		}
+		r.mu.Unlock()
+	}
+}
+
+// Sends an INFO with the lame duck mode flag, and without the client URLs
+// of this server, to the clients that support async INFO protocols, so
+// that they reconnect to other servers before being closed.
+// Server lock is held on entry.
+func (s *Server) sendLDMToClients() {
+	s.info.LameDuckMode = true
+	s.info.ClientConnectURLs = s.info.ClientConnectURLs[:0]
+	for url := range s.clientConnectURLsMap {
+		s.info.ClientConnectURLs = append(s.info.ClientConnectURLs, url)
+	}
+	// Clients that did not complete their connection yet get it then.
+	s.lastCURLsUpdate = time.Now().UnixNano()
+	s.sendAsyncInfoToClients()
+}
+
+// Sends an INFO with the lame duck mode flag, and without the client URLs
+// of this server, to the given clients of a drained account that support
+// async INFO protocols. The other clients are not affected.
+func (s *Server) sendLDMToAccountClients(clients []*client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdown {
+		return
+	}
+	urls := make([]string, 0, len(s.clientConnectURLsMap))
+	for url := range s.clientConnectURLsMap {
+		urls = append(urls, url)
+	}
+	for _, c := range clients {
+		c.mu.Lock()
+		if c.opts.Protocol >= ClientProtoInfo && c.flags.isSet(firstPongSent) {
+			info := s.copyInfoForClient(c)
+			info.LameDuckMode = true
+			// Only the clients that may know of the cluster get its URLs.
+			if c.acc.noAdvertise || isWebsocketConn(c.nc) {
+				info.ClientConnectURLs = nil
+			} else {
+				info.ClientConnectURLs = urls
+			}
+			c.sendInfo(c.generateClientInfoJSON(info))
+		}
+		c.mu.Unlock()
+	}
+}
+
+// DisconnectClientByID closes the connection of the client with the given
+// connection ID. The reason, if not empty, is sent to the client as an -ERR.
+func (s *Server) DisconnectClientByID(id uint64, reason string) error {
+	c := s.getClient(id)
+	if c == nil {
+		return ErrClientNotFound
+	}
+	if reason != _EMPTY_ {
+		c.Noticef("Disconnecting client: %s", reason)
+		c.sendErr(reason)
+	} else {
+		c.Noticef("Disconnecting client")
+	}
+	c.closeConnection(Kicked)
+	return nil
+}
+
+// LDMClientByID sends an INFO protocol with the lame duck mode flag to the
+// client with the given connection ID, so that it reconnects to another
+// server while this one keeps running.
+func (s *Server) LDMClientByID(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.clients[id]
+	if c == nil {
+		return ErrClientNotFound
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.opts.Protocol < ClientProtoInfo || !c.flags.isSet(firstPongSent) {
+		return fmt.Errorf("client %d does not support async INFO", id)
+	}
+	info := s.copyInfoForClient(c)
+	info.LameDuckMode = true
+	c.sendInfo(c.generateClientInfoJSON(info))
+	return nil
+}
+
+// closeClientsSpread closes the given clients, spreading the closes over
+// the given duration (in nanoseconds). Returns false if the server was
+// shutdown before all clients were closed.
+func (s *Server) closeClientsSpread(clients []*client, dur int64, reason ClosedState) bool {
+	numClients := int64(len(clients))
+	if numClients == 0 {
+		return true
+	}
+	batch := 1
+	// Sleep interval between each client connection close.
+	si := dur / numClients
+	if si < 1 {
+		// Should not happen (except in test with very small LD duration), but
+		// if there are too many clients, batch the number of close and
+		// use a tiny sleep interval that will result in yield likely.
+		si = 1
+		batch = int(numClients / dur)
+	} else if si > int64(time.Second) {
+		// Conversely, there is no need to sleep too long between clients
+		// and spread say 10 clients for the 2min duration. Sleeping no
+		// more than 1sec.
+		si = int64(time.Second)
+	}
+	var t *time.Timer
 	for i, client := range clients {
-		client.closeConnection(ServerShutdown)
+		client.closeConnection(reason)
 		if i == len(clients)-1 {
 			break
 		}
@@ -2314,17 +3554,68 @@ func (s *Server) lameDuckMode() {
 			if v < si/2 {
 				v = si / 2
 			}
-			t.Reset(time.Duration(v))
+			if t == nil {
+				t = time.NewTimer(time.Duration(v))
+			} else {
+				t.Reset(time.Duration(v))
+			}
 			// Sleep for given interval or bail out if kicked by Shutdown().
 			select {
 			case <-t.C:
 			case <-s.quitCh:
 				t.Stop()
-				return
+				return false
 			}
 		}
 	}
-	s.Shutdown()
+	return true
+}
+
+// DrainAccount will close the connections of all clients of the given account,
+// spread over the lame duck duration, so that they can reconnect to other
+// servers. The clients are first sent an INFO in lame duck mode. New clients
+// of the account are refused from then on, the account stays drained on this
+// server.
+func (s *Server) DrainAccount(name string) error {
+	acc, err := s.LookupAccount(name)
+	if err != nil {
+		return err
+	}
+	_, err = s.drainAccount(acc, s.getOpts().LameDuckDuration)
+	return err
+}
+
+// drainAccount starts draining the local clients of the account in
+// the background and returns the number of clients being drained. The
+// account is marked as draining before its clients are listed, so that
+// no new client is missed.
+func (s *Server) drainAccount(acc *Account, dur time.Duration) (int, error) {
+	if dur <= 0 {
+		dur = time.Second
+	}
+	acc.mu.Lock()
+	if acc.draining {
+		acc.mu.Unlock()
+		return 0, ErrAccountDraining
+	}
+	acc.draining = true
+	clients := make([]*client, 0, len(acc.clients))
+	for c := range acc.clients {
+		if c.kind == CLIENT {
+			clients = append(clients, c)
+		}
+	}
+	acc.mu.Unlock()
+
+	s.Noticef("Draining %d client(s) of account %q", len(clients), acc.Name)
+	s.sendLDMToAccountClients(clients)
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		if s.closeClientsSpread(clients, int64(dur), AccountDrained) {
+			s.Noticef("Account %q drained", acc.Name)
+		}
+	})
+	return len(clients), nil
 }
 
 // If given error is a net.Error and is temporary, sleeps for the given
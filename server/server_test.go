@@ -14,14 +14,19 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -391,6 +396,278 @@ func TestMaxConnections(t *testing.T) {
 	}
 }
 
+func TestMaxConnectionsPerIP(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxConnPerIP = 2
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	addr := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	for i := 0; i < 2; i++ {
+		nc, err := nats.Connect(addr)
+		if err != nil {
+			t.Fatalf("Error creating client: %v\n", err)
+		}
+		defer nc.Close()
+	}
+	// The error is sent before the INFO, so the library may not report it.
+	if nc, err := nats.Connect(addr); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection to fail")
+	}
+	checkClosedConns(t, s, 1, time.Second)
+	if reason := s.closedClients()[0].Reason; reason != MaxIPConnectionsExceeded.String() {
+		t.Fatalf("Unexpected closed reason: %v", reason)
+	}
+}
+
+func TestMaxConnectionsPerUser(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxConnPerUser = 1
+	opts.Users = []*User{
+		{Username: "default", Password: "pwd"},
+		{Username: "pool", Password: "pwd", MaxConnections: 2},
+		{Username: "unlimited", Password: "pwd", MaxConnections: -1},
+	}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	for _, test := range []struct {
+		user string
+		max  int
+	}{
+		{"default", 1},
+		{"pool", 2},
+		{"unlimited", 5},
+	} {
+		t.Run(test.user, func(t *testing.T) {
+			addr := fmt.Sprintf("nats://%s:pwd@%s:%d", test.user, opts.Host, opts.Port)
+			var conns []*nats.Conn
+			defer func() {
+				for _, nc := range conns {
+					nc.Close()
+				}
+			}()
+			for i := 0; i < test.max; i++ {
+				nc, err := nats.Connect(addr)
+				if err != nil {
+					t.Fatalf("Error creating client: %v\n", err)
+				}
+				conns = append(conns, nc)
+			}
+			if test.user == "unlimited" {
+				return
+			}
+			if nc, err := nats.Connect(addr); err == nil {
+				nc.Close()
+				t.Fatal("Expected connection to fail")
+			} else if !strings.Contains(err.Error(), ErrTooManyUserConnections.Error()) {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			// Once a connection is closed, the user can connect again.
+			conns[0].Close()
+			checkFor(t, time.Second, 15*time.Millisecond, func() error {
+				nc, err := nats.Connect(addr)
+				if err != nil {
+					return err
+				}
+				conns[0] = nc
+				return nil
+			})
+		})
+	}
+}
+
+func TestAcceptLoopsAndTCPOptions(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accept_loops: 4
+		tcp {
+			no_delay: false
+			read_buffer: 64KB
+			write_buffer: 128KB
+			keep_alive: "30s"
+		}
+	`))
+	defer os.Remove(conf)
+	s, o := RunServerWithConfig(conf)
+	defer s.Shutdown()
+	url := fmt.Sprintf("nats://%s:%d", o.Host, o.Port)
+
+	expected := TCPOpts{Nagle: true, ReadBuffer: 64 * 1024, WriteBuffer: 128 * 1024, KeepAlive: 30 * time.Second}
+	if o.AcceptLoops != 4 || o.TCP != expected {
+		t.Fatalf("Unexpected options: %v %+v", o.AcceptLoops, o.TCP)
+	}
+	s.mu.Lock()
+	rl, ok := s.listener.(*reusePortListener)
+	s.mu.Unlock()
+	if reusePortSupported && (!ok || len(rl.listeners) != 4) {
+		t.Fatalf("Expected 4 listeners bound to the client port, got %T", s.listener)
+	} else if !reusePortSupported && ok {
+		t.Fatalf("Expected the accept loops to share the listener")
+	}
+
+	// Connections are accepted by all the loops.
+	var wg sync.WaitGroup
+	errCh := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nc, err := nats.Connect(url)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			defer nc.Close()
+			errCh <- nc.Flush()
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+	}
+
+	// The loops are done once in lame duck mode.
+	if err := s.LameDuckMode(time.Second); err != nil {
+		t.Fatalf("Error entering lame duck mode: %v", err)
+	}
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if !s.isLameDuckMode() {
+			return fmt.Errorf("Not in lame duck mode")
+		}
+		return nil
+	})
+	if nc, err := nats.Connect(url); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection to fail in lame duck mode")
+	}
+
+	o = DefaultOptions()
+	o.TCP.KeepAliveCount = -1
+	if err := validateOptions(o); err == nil {
+		t.Fatal("Expected an error for a negative keepalive count")
+	}
+}
+
+func TestMaxProcsAndCPUQuota(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	t.Setenv("GOMAXPROCS", "")
+
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		http: "127.0.0.1:-1"
+		max_procs: 3
+	`))
+	defer os.Remove(conf)
+	s, o := RunServerWithConfig(conf)
+	defer s.Shutdown()
+	if o.MaxProcs != 3 {
+		t.Fatalf("Unexpected max_procs: %v", o.MaxProcs)
+	}
+	if n := runtime.GOMAXPROCS(0); n != 3 {
+		t.Fatalf("Expected GOMAXPROCS to be 3, got %v", n)
+	}
+	v, err := s.Varz(nil)
+	if err != nil {
+		t.Fatalf("Error getting varz: %v", err)
+	}
+	if v.MaxProcs != 3 {
+		t.Fatalf("Expected varz gomaxprocs to be 3, got %v", v.MaxProcs)
+	}
+
+	conf = createConfFile(t, []byte(`
+		auto_max_procs: false
+		cpu_affinity: "0-2, 5"
+	`))
+	defer os.Remove(conf)
+	o, err = ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if !o.NoAutoMaxProcs || !reflect.DeepEqual(o.CPUAffinity, []int{0, 1, 2, 5}) {
+		t.Fatalf("Unexpected options: %v %v", o.NoAutoMaxProcs, o.CPUAffinity)
+	}
+	for _, list := range []string{`"1-"`, `"3-1"`, `"a"`, `"0-100000"`} {
+		conf := createConfFile(t, []byte("cpu_affinity: "+list))
+		defer os.Remove(conf)
+		if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "cpu_affinity") {
+			t.Fatalf("Expected an error for %s, got %v", list, err)
+		}
+	}
+
+	// The CPU quota of cgroup v2 and v1.
+	defer func(root string) { cgroupRoot = root }(cgroupRoot)
+	cgroupRoot = t.TempDir()
+	writeFile := func(name, content string) {
+		t.Helper()
+		path := filepath.Join(cgroupRoot, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Error writing %s: %v", name, err)
+		}
+	}
+	if q := cgroupCPUQuota(); q != 0 {
+		t.Fatalf("Expected no quota, got %v", q)
+	}
+	writeFile("cpu/cpu.cfs_quota_us", "-1\n")
+	writeFile("cpu/cpu.cfs_period_us", "100000\n")
+	if q := cgroupCPUQuota(); q != 0 {
+		t.Fatalf("Expected no quota, got %v", q)
+	}
+	writeFile("cpu/cpu.cfs_quota_us", "250000\n")
+	if q := cgroupCPUQuota(); q != 2.5 {
+		t.Fatalf("Expected a quota of 2.5, got %v", q)
+	}
+	writeFile("cpu.max", "max 100000\n")
+	if q := cgroupCPUQuota(); q != 0 {
+		t.Fatalf("Expected no quota, got %v", q)
+	}
+	writeFile("cpu.max", "150000 100000\n")
+	if q := cgroupCPUQuota(); q != 1.5 {
+		t.Fatalf("Expected a quota of 1.5, got %v", q)
+	}
+
+	for _, test := range []struct {
+		name     string
+		opts     Options
+		env      string
+		cpus     int
+		quota    float64
+		expected int
+	}{
+		{"no quota", Options{}, "", 8, 0, 0},
+		{"quota", Options{}, "", 8, 1.5, 2},
+		{"quota above cpus", Options{}, "", 8, 16, 0},
+		{"affinity", Options{CPUAffinity: []int{1, 2, 3}}, "", 8, 0, 3},
+		{"affinity and quota", Options{CPUAffinity: []int{1, 2, 3}}, "", 8, 1, 1},
+		{"no auto", Options{NoAutoMaxProcs: true}, "", 8, 1, 0},
+		{"env", Options{}, "4", 8, 1, 0},
+		{"configured", Options{MaxProcs: 6}, "4", 8, 1, 6},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("GOMAXPROCS", test.env)
+			if n, _ := maxProcs(&test.opts, test.cpus, test.quota); n != test.expected {
+				t.Fatalf("Expected %v, got %v", test.expected, n)
+			}
+		})
+	}
+
+	o = DefaultOptions()
+	o.MaxProcs = -1
+	if err := validateOptions(o); err == nil {
+		t.Fatal("Expected an error for a negative max_procs")
+	}
+	o = DefaultOptions()
+	o.CPUAffinity = []int{-1}
+	if err := validateOptions(o); err == nil {
+		t.Fatal("Expected an error for an invalid CPU")
+	}
+}
+
 func TestMaxSubscriptions(t *testing.T) {
 	opts := DefaultOptions()
 	opts.MaxSubs = 10
@@ -855,6 +1132,271 @@ func TestLameDuckMode(t *testing.T) {
 	})
 }
 
+func TestLameDuckModeInfo(t *testing.T) {
+	atomic.StoreInt64(&lameDuckModeInitialDelay, int64(time.Second))
+	defer atomic.StoreInt64(&lameDuckModeInitialDelay, lameDuckModeDefaultInitialDelay)
+
+	optsA := DefaultOptions()
+	optsA.Cluster.Host = "127.0.0.1"
+	srvA := RunServer(optsA)
+	defer srvA.Shutdown()
+
+	optsB := DefaultOptions()
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", srvA.ClusterAddr().Port))
+	srvB := RunServer(optsB)
+	defer srvB.Shutdown()
+
+	checkClusterFormed(t, srvA, srvB)
+
+	connect := func(o *Options) *bufio.Reader {
+		t.Helper()
+		conn, err := net.Dial("tcp", net.JoinHostPort(o.Host, fmt.Sprintf("%d", o.Port)))
+		if err != nil {
+			t.Fatalf("Error on dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		br := bufio.NewReader(conn)
+		if _, err := br.ReadString('\n'); err != nil {
+			t.Fatalf("Error reading INFO: %v", err)
+		}
+		conn.Write([]byte("CONNECT {\"protocol\":1,\"verbose\":false}\r\nPING\r\n"))
+		if l, err := br.ReadString('\n'); err != nil || l != "PONG\r\n" {
+			t.Fatalf("Expected PONG, got %q - %v", l, err)
+		}
+		return br
+	}
+	readInfo := func(br *bufio.Reader) Info {
+		t.Helper()
+		l, err := br.ReadString('\n')
+		if err != nil || !strings.HasPrefix(l, "INFO ") {
+			t.Fatalf("Expected INFO, got %q - %v", l, err)
+		}
+		var info Info
+		if err := json.Unmarshal([]byte(l[5:]), &info); err != nil {
+			t.Fatalf("Error unmarshalling INFO: %v", err)
+		}
+		return info
+	}
+	bra := connect(optsA)
+	brb := connect(optsB)
+
+	if err := srvA.LameDuckMode(0); err != nil {
+		t.Fatalf("Error entering lame duck mode: %v", err)
+	}
+	urlB := fmt.Sprintf("127.0.0.1:%d", optsB.Port)
+
+	// Clients of the server in lame duck mode are told to go to the others.
+	info := readInfo(bra)
+	if !info.LameDuckMode || len(info.ClientConnectURLs) != 1 || info.ClientConnectURLs[0] != urlB {
+		t.Fatalf("Unexpected INFO: %+v", info)
+	}
+	// And the other servers stop advertising it.
+	info = readInfo(brb)
+	if info.LameDuckMode || len(info.ClientConnectURLs) != 1 || info.ClientConnectURLs[0] != urlB {
+		t.Fatalf("Unexpected INFO: %+v", info)
+	}
+
+	if err := srvA.LameDuckMode(0); err != ErrLameDuckMode {
+		t.Fatalf("Expected %v, got %v", ErrLameDuckMode, err)
+	}
+	// The server shuts down once its clients are closed.
+	checkFor(t, 3*time.Second, 15*time.Millisecond, func() error {
+		if srvA.isRunning() {
+			return fmt.Errorf("Server still running")
+		}
+		return nil
+	})
+	if err := srvA.LameDuckMode(0); err != ErrServerNotRunning {
+		t.Fatalf("Expected %v, got %v", ErrServerNotRunning, err)
+	}
+}
+
+func TestDrainServer(t *testing.T) {
+	optsA := DefaultOptions()
+	optsA.Cluster.Host = "127.0.0.1"
+	srvA := RunServer(optsA)
+	defer srvA.Shutdown()
+
+	optsB := DefaultOptions()
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", srvA.ClusterAddr().Port))
+	srvB := RunServer(optsB)
+	defer srvB.Shutdown()
+
+	checkClusterFormed(t, srvA, srvB)
+
+	urlA := fmt.Sprintf("nats://%s:%d", optsA.Host, optsA.Port)
+	for i := 0; i < 3; i++ {
+		nc, err := nats.Connect(urlA, nats.NoReconnect())
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		defer nc.Close()
+	}
+
+	var reports []DrainProgress
+	if err := srvA.Drain(context.Background(), func(p DrainProgress) {
+		reports = append(reports, p)
+	}); err != nil {
+		t.Fatalf("Error draining server: %v", err)
+	}
+	expected := []DrainProgress{
+		{DrainClients, 1, 3}, {DrainClients, 2, 3}, {DrainClients, 3, 3},
+		{DrainRoutes, 1, 1},
+	}
+	if !reflect.DeepEqual(reports, expected) {
+		t.Fatalf("Expected progress %+v, got %+v", expected, reports)
+	}
+	if srvA.isRunning() {
+		t.Fatal("Server should have been shutdown")
+	}
+	if err := srvA.Drain(context.Background(), nil); err != ErrServerNotRunning {
+		t.Fatalf("Expected %v, got %v", ErrServerNotRunning, err)
+	}
+	// The route is not reconnected by the other server.
+	time.Sleep(100 * time.Millisecond)
+	if n := srvB.NumRoutes(); n != 0 {
+		t.Fatalf("Expected no route, got %d", n)
+	}
+}
+
+func TestDrainServerContextDone(t *testing.T) {
+	opts := DefaultOptions()
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port), nats.NoReconnect())
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Drain(ctx, nil); err != context.Canceled {
+		t.Fatalf("Expected %v, got %v", context.Canceled, err)
+	}
+	if s.isRunning() {
+		t.Fatal("Server should have been shutdown")
+	}
+}
+
+func TestDrainAccount(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			FOO { users [{user: foo, password: pwd}] }
+			BAR { users [{user: bar, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+
+	o := LoadConfig(conf)
+	o.LameDuckDuration = 100 * time.Millisecond
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	fooURL := fmt.Sprintf("nats://foo:pwd@%s:%d", o.Host, o.Port)
+	barURL := fmt.Sprintf("nats://bar:pwd@%s:%d", o.Host, o.Port)
+
+	total := 5
+	for i := 0; i < total; i++ {
+		nc, err := nats.Connect(fooURL, nats.NoReconnect())
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		defer nc.Close()
+	}
+	ncBar, err := nats.Connect(barURL)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncBar.Close()
+	// Clients supporting async INFO protocols, to check the lame duck mode.
+	connect := func(user string) (net.Conn, *bufio.Reader) {
+		t.Helper()
+		conn, err := net.Dial("tcp", net.JoinHostPort(o.Host, fmt.Sprintf("%d", o.Port)))
+		if err != nil {
+			t.Fatalf("Error on dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		br := bufio.NewReader(conn)
+		if _, err := br.ReadString('\n'); err != nil {
+			t.Fatalf("Error reading INFO: %v", err)
+		}
+		conn.Write([]byte(fmt.Sprintf("CONNECT {\"protocol\":1,\"verbose\":false,\"user\":%q,\"pass\":\"pwd\"}\r\nPING\r\n", user)))
+		if l, err := br.ReadString('\n'); err != nil || l != "PONG\r\n" {
+			t.Fatalf("Expected PONG, got %q - %v", l, err)
+		}
+		return conn, br
+	}
+	_, brFoo := connect("foo")
+	cBar, brBar := connect("bar")
+	total++
+
+	if err := s.DrainAccount("BAZ"); err == nil {
+		t.Fatal("Expected error draining unknown account")
+	}
+	if err := s.DrainAccount("FOO"); err != nil {
+		t.Fatalf("Error draining account: %v", err)
+	}
+	if err := s.DrainAccount("FOO"); err != ErrAccountDraining {
+		t.Fatalf("Expected error %v, got %v", ErrAccountDraining, err)
+	}
+
+	// The clients of the account are told to go to other servers first.
+	l, err := brFoo.ReadString('\n')
+	var info Info
+	if err != nil || !strings.HasPrefix(l, "INFO ") || json.Unmarshal([]byte(l[5:]), &info) != nil || !info.LameDuckMode {
+		t.Fatalf("Expected INFO in lame duck mode, got %q - %v", l, err)
+	}
+	// Not the clients of other accounts.
+	cBar.Write([]byte("PING\r\n"))
+	if l, err := brBar.ReadString('\n'); err != nil || l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q - %v", l, err)
+	}
+	// New clients of the account are refused.
+	if nc, err := nats.Connect(fooURL); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection to be refused while draining")
+	}
+
+	acc, _ := s.LookupAccount("FOO")
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if n := acc.NumLocalConnections(); n != 0 {
+			return fmt.Errorf("Still %d connections", n)
+		}
+		return nil
+	})
+	if !ncBar.IsConnected() {
+		t.Fatal("Client of other account should not have been disconnected")
+	}
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		conns, _ := s.Connz(&ConnzOptions{State: ConnClosed})
+		drained := 0
+		for _, ci := range conns.Conns {
+			if ci.Reason == AccountDrained.String() {
+				drained++
+			}
+		}
+		// With the client refused while draining.
+		if drained != total+1 {
+			return fmt.Errorf("Expected %d connections closed by drain, got %d", total+1, drained)
+		}
+		return nil
+	})
+
+	// Once drained, the account still refuses new clients.
+	if !acc.IsDraining() {
+		t.Fatal("Expected account to remain drained")
+	}
+	if nc, err := nats.Connect(fooURL); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection to be refused once drained")
+	}
+}
+
 func TestServerValidateGatewaysOptions(t *testing.T) {
 	baseOpt := testDefaultOptionsForGateway("A")
 	u, _ := url.Parse("host:5222")
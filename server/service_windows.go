@@ -26,6 +26,8 @@ const (
 	reopenLogCmd    = svc.Cmd(reopenLogCode)
 	ldmCode         = 129
 	ldmCmd          = svc.Cmd(ldmCode)
+	rotateLogCode   = 130
+	rotateLogCmd    = svc.Cmd(rotateLogCode)
 	acceptReopenLog = svc.Accepted(reopenLogCode)
 )
 
@@ -89,6 +91,9 @@ loop:
 		case reopenLogCmd:
 			// File log re-open for rotating file logs.
 			w.server.ReOpenLogFile()
+		case rotateLogCmd:
+			// File log rotation by the server.
+			w.server.RotateLogFile()
 		case ldmCmd:
 			go w.server.lameDuckMode()
 		case svc.ParamChange:
@@ -28,6 +28,10 @@ import (
 
 var processName = "nats-server"
 
+// The signal to rotate the log file. SIGIO is not sent by terminals, unlike
+// SIGWINCH, and is ignored by the processes that do not handle it.
+const rotateLogSignal = syscall.SIGIO
+
 // SetProcessName allows to change the expected name of the process.
 func SetProcessName(name string) {
 	processName = name
@@ -40,7 +44,7 @@ func (s *Server) handleSignals() {
 	}
 	c := make(chan os.Signal, 1)
 
-	signal.Notify(c, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP, rotateLogSignal)
 
 	go func() {
 		for {
@@ -51,9 +55,17 @@ func (s *Server) handleSignals() {
 				case syscall.SIGINT:
 					s.Noticef("Server Exiting..")
 					os.Exit(0)
+				case syscall.SIGTERM:
+					// Graceful shutdown.
+					s.Noticef("Server Exiting..")
+					s.Shutdown()
+					os.Exit(0)
 				case syscall.SIGUSR1:
 					// File log re-open for rotating file logs.
 					s.ReOpenLogFile()
+				case rotateLogSignal:
+					// File log rotation by the server.
+					s.RotateLogFile()
 				case syscall.SIGUSR2:
 					go s.lameDuckMode()
 				case syscall.SIGHUP:
@@ -109,10 +121,14 @@ func ProcessSignal(command Command, pidStr string) error {
 		err = kill(pid, syscall.SIGINT)
 	case CommandReopen:
 		err = kill(pid, syscall.SIGUSR1)
+	case CommandRotate:
+		err = kill(pid, rotateLogSignal)
 	case CommandReload:
 		err = kill(pid, syscall.SIGHUP)
-	case commandLDMode:
+	case CommandLDMode:
 		err = kill(pid, syscall.SIGUSR2)
+	case CommandTerm:
+		err = kill(pid, syscall.SIGTERM)
 	default:
 		err = fmt.Errorf("unknown signal %q", command)
 	}
@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"testing"
@@ -75,6 +76,47 @@ func TestSignalToReOpenLogFile(t *testing.T) {
 	}
 }
 
+func TestSignalToRotateLogFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "_nats-server")
+	if err != nil {
+		t.Fatalf("Could not create tmp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	logFile := filepath.Join(tmpDir, "test.log")
+	opts := &Options{
+		Host:    "127.0.0.1",
+		Port:    -1,
+		NoSigs:  false,
+		LogFile: logFile,
+	}
+	s := RunServer(opts)
+	defer s.SetLogger(nil, false, false)
+	defer s.Shutdown()
+
+	s.SetLogger(s.newFileLogger(opts), false, false)
+	s.Noticef("before rotation")
+
+	// This should cause the file to be rotated.
+	syscall.Kill(syscall.Getpid(), rotateLogSignal)
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		backups, err := filepath.Glob(logFile + ".*")
+		if err != nil {
+			return err
+		}
+		if len(backups) != 1 {
+			return fmt.Errorf("Expected 1 backup, got %q", backups)
+		}
+		return nil
+	})
+	buf, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	if !strings.Contains(string(buf), "File log rotated") || strings.Contains(string(buf), "before rotation") {
+		t.Fatalf("Unexpected content: %q", buf)
+	}
+}
+
 func TestSignalToReloadConfig(t *testing.T) {
 	opts, err := ProcessConfigFile("./configs/reload/basic.conf")
 	if err != nil {
@@ -287,6 +329,32 @@ func TestProcessSignalReopenProcess(t *testing.T) {
 	}
 }
 
+func TestProcessSignalRotateProcess(t *testing.T) {
+	killBefore := kill
+	called := false
+	kill = func(pid int, signal syscall.Signal) error {
+		called = true
+		if pid != 123 {
+			t.Fatalf("pid is incorrect.\nexpected: 123\ngot: %d", pid)
+		}
+		if signal != rotateLogSignal {
+			t.Fatalf("signal is incorrect.\nexpected: %v\ngot: %v", rotateLogSignal, signal)
+		}
+		return nil
+	}
+	defer func() {
+		kill = killBefore
+	}()
+
+	if err := ProcessSignal(CommandRotate, "123"); err != nil {
+		t.Fatalf("ProcessSignal failed: %v", err)
+	}
+
+	if !called {
+		t.Fatal("Expected kill to be called")
+	}
+}
+
 func TestProcessSignalReloadProcess(t *testing.T) {
 	killBefore := kill
 	called := false
@@ -330,7 +398,33 @@ func TestProcessSignalLameDuckMode(t *testing.T) {
 		kill = killBefore
 	}()
 
-	if err := ProcessSignal(commandLDMode, "123"); err != nil {
+	if err := ProcessSignal(CommandLDMode, "123"); err != nil {
+		t.Fatalf("ProcessSignal failed: %v", err)
+	}
+
+	if !called {
+		t.Fatal("Expected kill to be called")
+	}
+}
+
+func TestProcessSignalTermProcess(t *testing.T) {
+	killBefore := kill
+	called := false
+	kill = func(pid int, signal syscall.Signal) error {
+		called = true
+		if pid != 123 {
+			t.Fatalf("pid is incorrect.\nexpected: 123\ngot: %d", pid)
+		}
+		if signal != syscall.SIGTERM {
+			t.Fatalf("signal is incorrect.\nexpected: sigterm\ngot: %v", signal)
+		}
+		return nil
+	}
+	defer func() {
+		kill = killBefore
+	}()
+
+	if err := ProcessSignal(CommandTerm, "123"); err != nil {
 		t.Fatalf("ProcessSignal failed: %v", err)
 	}
 
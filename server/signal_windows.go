@@ -17,6 +17,9 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/sys/windows/svc"
@@ -30,24 +33,38 @@ func (s *Server) handleSignals() {
 	}
 	c := make(chan os.Signal, 1)
 
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
 		for sig := range c {
 			s.Debugf("Trapped %q signal", sig)
 			s.Noticef("Server Exiting..")
+			if sig == syscall.SIGTERM {
+				s.Shutdown()
+			}
 			os.Exit(0)
 		}
 	}()
+
+	// Windows has no equivalent to SIGHUP, SIGUSR1 and SIGUSR2, the commands
+	// are delivered through a named pipe instead.
+	if err := s.startControlPipe(); err != nil {
+		s.Warnf("Unable to create the control pipe: %v", err)
+	}
 }
 
 // ProcessSignal sends the given signal command to the running nats-server service.
-// If service is empty, this signals the "nats-server" service. This returns an
-// error is the given service is not running or the command is invalid.
+// If service is empty, this signals the "nats-server" service. If service is a
+// process ID, the command is sent through the control pipe of that process.
+// This returns an error is the given service is not running or the command
+// is invalid.
 func ProcessSignal(command Command, service string) error {
 	if service == "" {
 		service = serviceName
 	}
+	if pid, err := strconv.Atoi(strings.TrimSpace(service)); err == nil {
+		return sendControlCommand(command, pid)
+	}
 
 	m, err := mgr.Connect()
 	if err != nil {
@@ -67,16 +84,19 @@ func ProcessSignal(command Command, service string) error {
 	)
 
 	switch command {
-	case CommandStop, CommandQuit:
+	case CommandStop, CommandQuit, CommandTerm:
 		cmd = svc.Stop
 		to = svc.Stopped
 	case CommandReopen:
 		cmd = reopenLogCmd
 		to = svc.Running
+	case CommandRotate:
+		cmd = rotateLogCmd
+		to = svc.Running
 	case CommandReload:
 		cmd = svc.ParamChange
 		to = svc.Running
-	case commandLDMode:
+	case CommandLDMode:
 		cmd = ldmCmd
 		to = svc.Running
 	default:
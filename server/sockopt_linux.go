@@ -0,0 +1,68 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package server
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// The syscall package does not define SO_REUSEPORT on all architectures,
+// this is its value on those this file is built for.
+const soReusePort = 0xf
+
+// Multiple listeners can be bound to the client port.
+const reusePortSupported = true
+
+// The interval and number of the keepalive probes can be set.
+const keepAliveProbesSupported = true
+
+// reusePort is the control function of the client listeners, setting
+// SO_REUSEPORT so that the kernel spreads connections between them.
+func reusePort(network, address string, c syscall.RawConn) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// setKeepAliveProbes sets the interval and the number of the keepalive
+// probes of the connection, when not zero.
+func setKeepAliveProbes(conn *net.TCPConn, interval time.Duration, count int) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		if interval > 0 {
+			// The interval is in seconds, round up.
+			secs := int((interval + time.Second - 1) / time.Second)
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, secs)
+		}
+		if serr == nil && count > 0 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, count)
+		}
+	}); err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,37 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux || mips || mipsle || mips64 || mips64le
+// +build !linux mips mipsle mips64 mips64le
+
+package server
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// The client port is bound once, the accept loops share its listener.
+const reusePortSupported = false
+
+// The interval and number of the keepalive probes can not be set.
+const keepAliveProbesSupported = false
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+func setKeepAliveProbes(conn *net.TCPConn, interval time.Duration, count int) error {
+	return nil
+}
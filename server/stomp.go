@@ -0,0 +1,717 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// STOMP frame commands.
+const (
+	stompCmdConnect     = "CONNECT"
+	stompCmdStomp       = "STOMP"
+	stompCmdConnected   = "CONNECTED"
+	stompCmdSend        = "SEND"
+	stompCmdSubscribe   = "SUBSCRIBE"
+	stompCmdUnsubscribe = "UNSUBSCRIBE"
+	stompCmdAck         = "ACK"
+	stompCmdNack        = "NACK"
+	stompCmdBegin       = "BEGIN"
+	stompCmdCommit      = "COMMIT"
+	stompCmdAbort       = "ABORT"
+	stompCmdDisconnect  = "DISCONNECT"
+	stompCmdMessage     = "MESSAGE"
+	stompCmdReceipt     = "RECEIPT"
+	stompCmdError       = "ERROR"
+)
+
+const (
+	// Prefixes of the destinations mapped to subjects, the queues being
+	// consumed by queue groups.
+	stompTopicPrefix = "/topic/"
+	stompQueuePrefix = "/queue/"
+
+	// Versions of the protocol, by order of preference.
+	stompVersions = "1.2,1.1,1.0"
+)
+
+var errSTOMPPermissionViolation = errors.New("STOMP permissions violation")
+
+// STOMP state of a client connection.
+type stomp struct {
+	// Bytes of a frame not received entirely yet.
+	buf       []byte
+	version   string
+	connected bool
+	// Subscriptions by sid of their NATS subscription.
+	subs map[string]*stompSub
+	// Sids of the subscriptions by STOMP subscription id.
+	ids   map[string]string
+	sid   int
+	msgID uint64
+	// Interval of the heart-beats of the client.
+	heartBeat time.Duration
+	// Set when the client sent DISCONNECT.
+	disconnected bool
+}
+
+type stompSub struct {
+	id     string
+	prefix string
+	ack    string
+}
+
+type stompFrame struct {
+	command string
+	headers map[string]string
+	body    []byte
+}
+
+// This is the STOMP accept loop. This runs as a go-routine.
+func (s *Server) stompAcceptLoop(ch chan struct{}) {
+	defer func() {
+		if ch != nil {
+			close(ch)
+		}
+	}()
+
+	// Snapshot server options.
+	opts := s.getOpts()
+	so := &opts.STOMP
+
+	port := so.Port
+	if port == -1 {
+		port = 0
+	}
+	hp := net.JoinHostPort(so.Host, strconv.Itoa(port))
+	l, e := net.Listen("tcp", hp)
+	if e != nil {
+		s.Fatalf("Error listening on STOMP port: %d - %v", so.Port, e)
+		return
+	}
+	s.Noticef("Listening for STOMP clients on %s",
+		net.JoinHostPort(so.Host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
+
+	s.mu.Lock()
+	// If we have selected a random port...
+	if port == 0 {
+		// Write resolved port back to options.
+		so.Port = l.Addr().(*net.TCPAddr).Port
+	}
+	s.stompListener = l
+	s.mu.Unlock()
+
+	// Let them know we are up
+	close(ch)
+	ch = nil
+
+	tmpDelay := ACCEPT_MIN_SLEEP
+
+	for s.isRunning() {
+		conn, err := l.Accept()
+		if err != nil {
+			tmpDelay = s.acceptError("STOMP", err, tmpDelay)
+			continue
+		}
+		tmpDelay = ACCEPT_MIN_SLEEP
+		s.startGoRoutine(func() {
+			s.createSTOMPClient(conn)
+			s.grWG.Done()
+		})
+	}
+	s.Debugf("STOMP accept loop exiting..")
+	s.done <- true
+}
+
+// Creates the client of an accepted STOMP connection. The client is
+// authenticated and bound to its account when the CONNECT frame is
+// received.
+func (s *Server) createSTOMPClient(conn net.Conn) *client {
+	// Snapshot server options.
+	opts := s.getOpts()
+
+	tlsConfig := opts.STOMP.TLSConfig
+	if tlsConfig != nil {
+		tc := tls.Server(conn, tlsConfig)
+		tc.SetDeadline(time.Now().Add(secondsToDuration(opts.STOMP.TLSTimeout)))
+		if err := tc.Handshake(); err != nil {
+			s.Debugf("STOMP TLS handshake error from %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return nil
+		}
+		tc.SetDeadline(time.Time{})
+		conn = tc
+	}
+
+	maxPay := int32(opts.MaxPayload)
+	maxSubs := int32(opts.MaxSubs)
+	// For system, maxSubs of 0 means unlimited, so re-adjust here.
+	if maxSubs == 0 {
+		maxSubs = -1
+	}
+	now := time.Now()
+
+	st := &stomp{subs: make(map[string]*stompSub), ids: make(map[string]string)}
+	c := &client{srv: s, nc: conn, opts: clientOpts{Echo: true}, mpay: maxPay, msubs: maxSubs, start: now, last: now, stomp: st}
+
+	c.registerWithAccount(s.globalAccount())
+
+	s.mu.Lock()
+	s.totalClients++
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.initClient()
+	c.echo = true
+	if tlsConfig != nil {
+		c.flags.set(handshakeComplete)
+	}
+	c.Debugf("STOMP client connection created")
+	c.mu.Unlock()
+
+	// Register with the server.
+	s.mu.Lock()
+	if !s.running || s.ldm {
+		s.mu.Unlock()
+		return c
+	}
+	if opts.MaxConn > 0 && len(s.clients) >= opts.MaxConn {
+		s.mu.Unlock()
+		c.maxConnExceeded()
+		return nil
+	}
+	s.clients[c.cid] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	// The connection may have been closed
+	if c.nc == nil {
+		c.mu.Unlock()
+		return c
+	}
+	// The CONNECT frame has to be received in time.
+	c.setAuthTimer(secondsToDuration(opts.AuthTimeout))
+
+	// Spin up the read loop.
+	s.startGoRoutine(func() { c.readLoop() })
+
+	// Spin up the write loop.
+	s.startGoRoutine(func() { c.writeLoop() })
+
+	c.mu.Unlock()
+
+	return c
+}
+
+// Processes the STOMP frames received by the client. The bytes of an
+// incomplete frame are kept for the next read.
+func (c *client) stompParse(buf []byte) error {
+	st := c.stomp
+	if len(st.buf) > 0 {
+		buf = append(st.buf, buf...)
+		st.buf = nil
+	}
+	max := int(c.mpay)
+	if max > 0 {
+		// Room for the headers.
+		max += 64 * 1024
+	}
+	for {
+		// Heart-beats are end of lines between the frames.
+		for len(buf) > 0 && (buf[0] == '\n' || buf[0] == '\r') {
+			buf = buf[1:]
+		}
+		if len(buf) == 0 {
+			break
+		}
+		f, n, err := stompReadFrame(buf, st.version != "1.0" && st.connected)
+		if err != nil {
+			c.stompError(err.Error())
+			return err
+		}
+		if f == nil {
+			if max > 0 && len(buf) > max {
+				c.stompError("frame too large")
+				return ErrMaxPayload
+			}
+			break
+		}
+		buf = buf[n:]
+		if err := c.stompProcessFrame(f); err != nil {
+			return err
+		}
+		if st.disconnected {
+			return nil
+		}
+	}
+	if len(buf) > 0 {
+		// The read buffer is reused, keep a copy.
+		st.buf = append([]byte(nil), buf...)
+	}
+	// The connection is closed if the client misses its heart-beats.
+	if hb := st.heartBeat; hb > 0 {
+		c.mu.Lock()
+		if c.nc != nil {
+			c.nc.SetReadDeadline(time.Now().Add(2 * hb))
+		}
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// Reads a frame. Returns a nil frame if more bytes are needed, and the
+// number of bytes of the frame.
+func stompReadFrame(b []byte, unescape bool) (*stompFrame, int, error) {
+	f := &stompFrame{headers: make(map[string]string)}
+	pos := 0
+	for {
+		i := bytes.IndexByte(b[pos:], '\n')
+		if i < 0 {
+			return nil, 0, nil
+		}
+		line := b[pos : pos+i]
+		pos += i + 1
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+		if f.command == _EMPTY_ {
+			f.command = string(line)
+			continue
+		}
+		if len(line) == 0 {
+			break
+		}
+		sep := bytes.IndexByte(line, ':')
+		if sep < 0 {
+			return nil, 0, fmt.Errorf("invalid header %q", line)
+		}
+		k, v := string(line[:sep]), string(line[sep+1:])
+		// The connection frames are not escaped.
+		if unescape && f.command != stompCmdConnect && f.command != stompCmdStomp {
+			var err error
+			if k, err = stompUnescape(k); err != nil {
+				return nil, 0, err
+			}
+			if v, err = stompUnescape(v); err != nil {
+				return nil, 0, err
+			}
+		}
+		// The first of repeated headers is used.
+		if _, ok := f.headers[k]; !ok {
+			f.headers[k] = v
+		}
+	}
+	if cl, ok := f.headers["content-length"]; ok {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 {
+			return nil, 0, fmt.Errorf("invalid content-length %q", cl)
+		}
+		if len(b) < pos+n+1 {
+			return nil, 0, nil
+		}
+		if b[pos+n] != 0 {
+			return nil, 0, fmt.Errorf("frame body longer than its content-length")
+		}
+		f.body = b[pos : pos+n]
+		return f, pos + n + 1, nil
+	}
+	i := bytes.IndexByte(b[pos:], 0)
+	if i < 0 {
+		return nil, 0, nil
+	}
+	f.body = b[pos : pos+i]
+	return f, pos + i + 1, nil
+}
+
+func (c *client) stompProcessFrame(f *stompFrame) error {
+	st := c.stomp
+	if f.command == stompCmdConnect || f.command == stompCmdStomp {
+		if st.connected {
+			c.stompError("already connected")
+			return fmt.Errorf("STOMP second CONNECT frame")
+		}
+		return c.stompProcessConnect(f)
+	}
+	if !st.connected {
+		c.stompError("not connected")
+		return fmt.Errorf("STOMP %s frame received before CONNECT", f.command)
+	}
+	var err error
+	switch f.command {
+	case stompCmdSend:
+		err = c.stompProcessSend(f)
+	case stompCmdSubscribe:
+		err = c.stompProcessSubscribe(f)
+	case stompCmdUnsubscribe:
+		err = c.stompProcessUnsubscribe(f)
+	case stompCmdAck, stompCmdNack:
+		// Messages are acknowledged when delivered, NATS delivering
+		// them at most once.
+	case stompCmdBegin, stompCmdCommit, stompCmdAbort:
+		c.stompError("transactions are not supported")
+		return fmt.Errorf("STOMP transactions not supported")
+	case stompCmdDisconnect:
+		c.stompReceipt(f)
+		c.mu.Lock()
+		st.disconnected = true
+		c.mu.Unlock()
+		c.closeConnection(ClientClosed)
+		return nil
+	default:
+		c.stompError(fmt.Sprintf("unknown command %q", f.command))
+		return fmt.Errorf("unknown STOMP command %q", f.command)
+	}
+	if err != nil {
+		return err
+	}
+	c.stompReceipt(f)
+	return nil
+}
+
+func (c *client) stompProcessConnect(f *stompFrame) error {
+	st := c.stomp
+	version := "1.0"
+	if av, ok := f.headers["accept-version"]; ok {
+		version = _EMPTY_
+		for _, v := range strings.Split(stompVersions, ",") {
+			if stompHasToken(av, v) {
+				version = v
+				break
+			}
+		}
+		if version == _EMPTY_ {
+			c.stompError(fmt.Sprintf("supported protocol versions are %s", stompVersions))
+			return fmt.Errorf("unsupported STOMP versions %q", av)
+		}
+	}
+	var hb time.Duration
+	if v, ok := f.headers["heart-beat"]; ok {
+		var cx, cy int
+		if n, _ := fmt.Sscanf(v, "%d,%d", &cx, &cy); n != 2 || cx < 0 || cy < 0 {
+			c.stompError(fmt.Sprintf("invalid heart-beat %q", v))
+			return fmt.Errorf("invalid STOMP heart-beat %q", v)
+		}
+		hb = time.Duration(cx) * time.Millisecond
+	}
+
+	srv := c.srv
+	c.mu.Lock()
+	c.opts.Username, c.opts.Password = f.headers["login"], f.headers["passcode"]
+	c.mu.Unlock()
+	if !srv.checkAuthentication(c) {
+		c.stompError("authentication failed")
+		c.authViolation()
+		return ErrAuthentication
+	}
+
+	c.mu.Lock()
+	if c.acc == nil {
+		c.mu.Unlock()
+		c.registerWithAccount(srv.gacc)
+		c.mu.Lock()
+	}
+	c.clearAuthTimer()
+	c.flags.set(connectReceived)
+	st.connected = true
+	st.version = version
+	st.heartBeat = hb
+	// The server does not send heart-beats, it expects those of the
+	// client at the interval it offers.
+	c.stompEnqueue(stompCmdConnected, []string{
+		"version", version,
+		"server", "nats-server/" + VERSION,
+		"session", strconv.FormatUint(c.cid, 10),
+		"heart-beat", fmt.Sprintf("0,%d", hb/time.Millisecond),
+	}, nil)
+	c.mu.Unlock()
+
+	srv.accountConnectEvent(c)
+	return nil
+}
+
+func (c *client) stompProcessSend(f *stompFrame) error {
+	subject, _, err := stompDestination(f.headers["destination"])
+	if err == nil && !IsValidLiteralSubject(subject) {
+		err = fmt.Errorf("destination %q is not a valid subject", f.headers["destination"])
+	}
+	if err != nil {
+		c.stompError(err.Error())
+		return err
+	}
+	reply := f.headers["reply-to"]
+	if reply != _EMPTY_ {
+		if reply, _, err = stompDestination(reply); err != nil || !IsValidLiteralSubject(reply) {
+			err = fmt.Errorf("invalid reply-to %q", f.headers["reply-to"])
+			c.stompError(err.Error())
+			return err
+		}
+	}
+	if c.mpay > 0 && len(f.body) > int(c.mpay) {
+		c.stompError(ErrMaxPayload.Error())
+		c.maxPayloadViolation(len(f.body), c.mpay)
+		return ErrMaxPayload
+	}
+	c.mu.Lock()
+	allowed := c.perms == nil || c.pubAllowed(subject)
+	c.mu.Unlock()
+	if !allowed {
+		c.Errorf("Publish Violation - %s, Subject %q", c.getAuthUser(), subject)
+		c.stompError(fmt.Sprintf("permissions violation for publish to %q", subject))
+		c.closeConnection(ProtocolViolation)
+		return errSTOMPPermissionViolation
+	}
+
+	// Flushed by the read loop of the connection.
+	c.processPublish(subject, _EMPTY_, reply, nil, f.body)
+	return nil
+}
+
+func (c *client) stompProcessSubscribe(f *stompFrame) error {
+	st := c.stomp
+	dest := f.headers["destination"]
+	subject, queue, err := stompDestination(dest)
+	if err == nil && !IsValidSubject(subject) {
+		err = fmt.Errorf("destination %q is not a valid subject", dest)
+	}
+	if err != nil {
+		c.stompError(err.Error())
+		return err
+	}
+	id, ok := f.headers["id"]
+	if !ok {
+		if st.version != "1.0" {
+			c.stompError("subscription id required")
+			return fmt.Errorf("STOMP subscription id missing")
+		}
+		id = dest
+	}
+	ack := f.headers["ack"]
+	switch ack {
+	case _EMPTY_:
+		ack = "auto"
+	case "auto", "client", "client-individual":
+	default:
+		c.stompError(fmt.Sprintf("invalid ack mode %q", ack))
+		return fmt.Errorf("invalid STOMP ack mode %q", ack)
+	}
+
+	c.mu.Lock()
+	_, dup := st.ids[id]
+	allowed := c.canSubscribe(subject)
+	st.sid++
+	sid := strconv.Itoa(st.sid)
+	if !dup && allowed {
+		prefix := stompTopicPrefix
+		if queue != _EMPTY_ {
+			prefix = stompQueuePrefix
+		} else if !strings.HasPrefix(dest, stompTopicPrefix) {
+			prefix = _EMPTY_
+		}
+		st.ids[id] = sid
+		st.subs[sid] = &stompSub{id: id, prefix: prefix, ack: ack}
+	}
+	c.mu.Unlock()
+	if dup {
+		c.stompError(fmt.Sprintf("subscription id %q already in use", id))
+		return fmt.Errorf("STOMP subscription id %q already in use", id)
+	}
+	if !allowed {
+		c.Errorf("Subscription Violation - %s, Subject %q", c.getAuthUser(), subject)
+		c.stompError(fmt.Sprintf("permissions violation for subscription to %q", subject))
+		c.closeConnection(ProtocolViolation)
+		return errSTOMPPermissionViolation
+	}
+
+	arg := subject + " " + sid
+	if queue != _EMPTY_ {
+		arg = subject + " " + queue + " " + sid
+	}
+	if err := c.processSub([]byte(arg)); err != nil {
+		c.stompError(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (c *client) stompProcessUnsubscribe(f *stompFrame) error {
+	st := c.stomp
+	id, ok := f.headers["id"]
+	if !ok && st.version == "1.0" {
+		id, ok = f.headers["destination"]
+	}
+	c.mu.Lock()
+	sid, found := st.ids[id]
+	if found {
+		delete(st.ids, id)
+		delete(st.subs, sid)
+	}
+	c.mu.Unlock()
+	if !ok || !found {
+		c.stompError(fmt.Sprintf("unknown subscription id %q", id))
+		return fmt.Errorf("unknown STOMP subscription id %q", id)
+	}
+	return c.processUnsub([]byte(sid))
+}
+
+// Queues the MESSAGE frame of a message delivered to a subscription of
+// the client. Lock should be held.
+func (c *client) stompQueueMessage(sub *subscription, subject, reply, msg []byte) {
+	st := c.stomp
+	ss := st.subs[string(sub.sid)]
+	if ss == nil {
+		return
+	}
+	st.msgID++
+	msgID := strconv.FormatUint(st.msgID, 10)
+	hdrs := []string{
+		"subscription", ss.id,
+		"message-id", msgID,
+		"destination", ss.prefix + string(subject),
+		"content-length", strconv.Itoa(len(msg)),
+	}
+	if ss.ack != "auto" && st.version == "1.2" {
+		hdrs = append(hdrs, "ack", msgID)
+	}
+	if len(reply) > 0 {
+		hdrs = append(hdrs, "reply-to", string(reply))
+	}
+	c.queueOutbound(stompFrameHeader(st.version, stompCmdMessage, hdrs))
+	c.queueOutbound(msg)
+	c.queueOutbound([]byte{0})
+}
+
+// Sends a RECEIPT frame if the frame asks for one.
+func (c *client) stompReceipt(f *stompFrame) {
+	if r, ok := f.headers["receipt"]; ok {
+		c.mu.Lock()
+		c.stompEnqueue(stompCmdReceipt, []string{"receipt-id", r}, nil)
+		c.mu.Unlock()
+	}
+}
+
+// Sends an ERROR frame, the connection is then closed.
+func (c *client) stompError(msg string) {
+	c.mu.Lock()
+	c.stompEnqueue(stompCmdError, []string{"message", msg, "content-type", "text/plain", "content-length", strconv.Itoa(len(msg))}, []byte(msg))
+	c.mu.Unlock()
+}
+
+// Queues a frame for the client. Lock should be held.
+func (c *client) stompEnqueue(command string, hdrs []string, body []byte) {
+	if c.nc == nil {
+		return
+	}
+	c.queueOutbound(stompFrameHeader(c.stomp.version, command, hdrs))
+	if len(body) > 0 {
+		c.queueOutbound(body)
+	}
+	c.queueOutbound([]byte{0})
+	c.flushSignal()
+}
+
+// Returns the command and headers of a frame, the headers being given
+// as key value pairs.
+func stompFrameHeader(version, command string, hdrs []string) []byte {
+	var b bytes.Buffer
+	b.WriteString(command)
+	b.WriteByte('\n')
+	for i := 0; i+1 < len(hdrs); i += 2 {
+		k, v := hdrs[i], hdrs[i+1]
+		if version != "1.0" && command != stompCmdConnected {
+			k, v = stompEscape(k), stompEscape(v)
+		}
+		b.WriteString(k)
+		b.WriteByte(':')
+		b.WriteString(v)
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+var stompEscaper = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n", ":", "\\c")
+
+func stompEscape(s string) string {
+	return stompEscaper.Replace(s)
+}
+
+func stompUnescape(s string) (string, error) {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i++; i == len(s) {
+			return _EMPTY_, fmt.Errorf("invalid escape sequence in %q", s)
+		}
+		switch s[i] {
+		case '\\':
+			b.WriteByte('\\')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		case 'c':
+			b.WriteByte(':')
+		default:
+			return _EMPTY_, fmt.Errorf("invalid escape sequence in %q", s)
+		}
+	}
+	return b.String(), nil
+}
+
+// Returns the subject of a destination and, for the queues, the queue
+// group consuming it. The destinations without prefix are subjects, with
+// '/' accepted as the token separator.
+func stompDestination(dest string) (string, string, error) {
+	var queue bool
+	switch {
+	case strings.HasPrefix(dest, stompTopicPrefix):
+		dest = dest[len(stompTopicPrefix):]
+	case strings.HasPrefix(dest, stompQueuePrefix):
+		dest = dest[len(stompQueuePrefix):]
+		queue = true
+	default:
+		dest = strings.TrimPrefix(dest, "/")
+	}
+	if dest == _EMPTY_ {
+		return _EMPTY_, _EMPTY_, fmt.Errorf("destination required")
+	}
+	subject := strings.Replace(dest, "/", tsep, -1)
+	if queue {
+		return subject, subject, nil
+	}
+	return subject, _EMPTY_, nil
+}
+
+// Returns whether the comma separated list has the token.
+func stompHasToken(list, token string) bool {
+	for _, t := range strings.Split(list, ",") {
+		if strings.TrimSpace(t) == token {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,327 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func testSTOMPOptions() *Options {
+	o := DefaultOptions()
+	o.STOMP.Host = "127.0.0.1"
+	o.STOMP.Port = -1
+	return o
+}
+
+type testSTOMPConn struct {
+	t  *testing.T
+	nc net.Conn
+	br *bufio.Reader
+}
+
+func testSTOMPDial(t *testing.T, o *Options) *testSTOMPConn {
+	t.Helper()
+	nc, err := net.Dial("tcp", net.JoinHostPort(o.STOMP.Host, strconv.Itoa(o.STOMP.Port)))
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	return &testSTOMPConn{t: t, nc: nc, br: bufio.NewReader(nc)}
+}
+
+// Connects with the headers and expects the CONNECTED frame.
+func testSTOMPConnect(t *testing.T, o *Options, hdrs ...string) *testSTOMPConn {
+	t.Helper()
+	sc := testSTOMPDial(t, o)
+	sc.send(stompCmdConnect, append([]string{"accept-version", "1.2", "host", "localhost"}, hdrs...), _EMPTY_)
+	if f := sc.read(); f.command != stompCmdConnected || f.headers["version"] != "1.2" {
+		t.Fatalf("Expected CONNECTED, got %+v", f)
+	}
+	return sc
+}
+
+func (sc *testSTOMPConn) send(command string, hdrs []string, body string) {
+	sc.t.Helper()
+	frame := string(stompFrameHeader("1.2", command, hdrs)) + body + "\x00"
+	if _, err := sc.nc.Write([]byte(frame)); err != nil {
+		sc.t.Fatalf("Error on write: %v", err)
+	}
+}
+
+func (sc *testSTOMPConn) read() *stompFrame {
+	sc.t.Helper()
+	sc.nc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var buf []byte
+	for {
+		b, err := sc.br.ReadBytes(0)
+		if err != nil {
+			sc.t.Fatalf("Error on read: %v", err)
+		}
+		buf = append(buf, b...)
+		buf = []byte(strings.TrimLeft(string(buf), "\r\n"))
+		f, n, err := stompReadFrame(buf, true)
+		if err != nil {
+			sc.t.Fatalf("Error reading frame: %v", err)
+		}
+		if f != nil {
+			if n != len(buf) {
+				sc.t.Fatalf("Unexpected bytes after frame %q", buf[n:])
+			}
+			return f
+		}
+	}
+}
+
+func (sc *testSTOMPConn) expectNothing() {
+	sc.t.Helper()
+	sc.nc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if b, err := sc.br.ReadByte(); err == nil {
+		sc.t.Fatalf("Expected nothing, got %q", b)
+	}
+}
+
+func (sc *testSTOMPConn) expectMsg(sub, dest, body string) *stompFrame {
+	sc.t.Helper()
+	f := sc.read()
+	if f.command != stompCmdMessage || f.headers["subscription"] != sub ||
+		f.headers["destination"] != dest || string(f.body) != body {
+		sc.t.Fatalf("Expected message %q on %q for %q, got %+v", body, dest, sub, f)
+	}
+	return f
+}
+
+func (sc *testSTOMPConn) close() {
+	sc.nc.Close()
+}
+
+func TestSTOMPConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		stomp {
+			listen: "127.0.0.1:-1"
+		}
+	`))
+	defer os.Remove(conf)
+	o, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if o.STOMP.Host != "127.0.0.1" || o.STOMP.Port != -1 {
+		t.Fatalf("Unexpected STOMP options: %+v", o.STOMP)
+	}
+}
+
+func TestSTOMPFrames(t *testing.T) {
+	for _, test := range []struct {
+		in      string
+		command string
+		body    string
+		n       int
+	}{
+		{"SEND\ndestination:a\n\nhello\x00rest", "SEND", "hello", 26},
+		{"SEND\r\ndestination:a\r\ncontent-length:3\r\n\r\na\x00b\x00", "SEND", "a\x00b", 45},
+		{"SEND\ndestination:a\n\nhel", "", "", 0},
+		{"SEND\ndestination:a\ncontent-length:5\n\nhel\x00", "", "", 0},
+	} {
+		f, n, err := stompReadFrame([]byte(test.in), true)
+		if err != nil {
+			t.Fatalf("Error reading %q: %v", test.in, err)
+		}
+		if test.command == _EMPTY_ {
+			if f != nil {
+				t.Fatalf("Expected an incomplete frame for %q", test.in)
+			}
+			continue
+		}
+		if f == nil || f.command != test.command || string(f.body) != test.body || n != test.n ||
+			f.headers["destination"] != "a" {
+			t.Fatalf("Unexpected frame for %q: %+v %d", test.in, f, n)
+		}
+	}
+	if v, _ := stompUnescape(stompEscape("a:b\\c\nd")); v != "a:b\\c\nd" {
+		t.Fatalf("Unexpected unescaped value %q", v)
+	}
+	if _, err := stompUnescape("a\\tb"); err == nil {
+		t.Fatal("Expected an error for an invalid escape sequence")
+	}
+	for _, test := range []struct {
+		dest, subject, queue string
+	}{
+		{"/topic/foo.bar", "foo.bar", ""},
+		{"/topic/foo/bar", "foo.bar", ""},
+		{"/queue/jobs", "jobs", "jobs"},
+		{"foo.*", "foo.*", ""},
+		{"/foo/bar", "foo.bar", ""},
+	} {
+		subject, queue, err := stompDestination(test.dest)
+		if err != nil || subject != test.subject || queue != test.queue {
+			t.Fatalf("Unexpected mapping of %q: %q %q %v", test.dest, subject, queue, err)
+		}
+	}
+}
+
+func TestSTOMPPubSub(t *testing.T) {
+	o := testSTOMPOptions()
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	sc := testSTOMPConnect(t, o)
+	defer sc.close()
+	sc.send(stompCmdSubscribe, []string{"id", "0", "destination", "/topic/orders.*", "receipt", "r1"}, _EMPTY_)
+	if f := sc.read(); f.command != stompCmdReceipt || f.headers["receipt-id"] != "r1" {
+		t.Fatalf("Expected RECEIPT, got %+v", f)
+	}
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://%s:%d", o.Host, o.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	nc.Publish("orders.new", []byte("order 1"))
+	nc.Flush()
+	sc.expectMsg("0", "/topic/orders.new", "order 1")
+
+	// Messages of STOMP clients reach NATS subscribers.
+	sub, _ := nc.SubscribeSync("audit.>")
+	nc.Flush()
+	sc.send(stompCmdSend, []string{"destination", "/topic/audit/login", "content-length", "5"}, "alice")
+	if m, err := sub.NextMsg(time.Second); err != nil || m.Subject != "audit.login" || string(m.Data) != "alice" {
+		t.Fatalf("Unexpected message %+v: %v", m, err)
+	}
+
+	// Requests from NATS clients can be answered with reply-to.
+	nc.Subscribe("svc", func(m *nats.Msg) { m.Respond([]byte("pong")) })
+	nc.Flush()
+	sc.send(stompCmdSubscribe, []string{"id", "1", "destination", "/topic/replies"}, _EMPTY_)
+	sc.send(stompCmdSend, []string{"destination", "/topic/svc", "reply-to", "/topic/replies", "receipt", "r2"}, "ping")
+	if f := sc.read(); f.command != stompCmdReceipt {
+		t.Fatalf("Expected RECEIPT, got %+v", f)
+	}
+	sc.expectMsg("1", "/topic/replies", "pong")
+
+	sc.send(stompCmdUnsubscribe, []string{"id", "0"}, _EMPTY_)
+	sc.send(stompCmdDisconnect, []string{"receipt", "bye"}, _EMPTY_)
+	if f := sc.read(); f.command != stompCmdReceipt || f.headers["receipt-id"] != "bye" {
+		t.Fatalf("Expected RECEIPT, got %+v", f)
+	}
+	nc.Publish("orders.new", []byte("order 2"))
+	nc.Flush()
+	sc.expectNothing()
+}
+
+func TestSTOMPQueue(t *testing.T) {
+	o := testSTOMPOptions()
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	var conns []*testSTOMPConn
+	for i := 0; i < 2; i++ {
+		sc := testSTOMPConnect(t, o)
+		defer sc.close()
+		sc.send(stompCmdSubscribe, []string{"id", "w", "destination", "/queue/jobs", "ack", "client-individual", "receipt", "r"}, _EMPTY_)
+		sc.read()
+		conns = append(conns, sc)
+	}
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://%s:%d", o.Host, o.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	for i := 0; i < 10; i++ {
+		nc.Publish("jobs", []byte("job"))
+	}
+	nc.Flush()
+
+	// Each job is received by a single worker.
+	total := 0
+	for _, sc := range conns {
+		for {
+			sc.nc.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+			if _, err := sc.br.Peek(1); err != nil {
+				break
+			}
+			f := sc.expectMsg("w", "/queue/jobs", "job")
+			if f.headers["ack"] != f.headers["message-id"] {
+				t.Fatalf("Expected the ack header, got %+v", f.headers)
+			}
+			sc.send(stompCmdAck, []string{"id", f.headers["ack"]}, _EMPTY_)
+			total++
+		}
+	}
+	if total != 10 {
+		t.Fatalf("Expected 10 jobs, got %d", total)
+	}
+}
+
+func TestSTOMPErrors(t *testing.T) {
+	o := testSTOMPOptions()
+	o.Users = []*User{
+		{Username: "app", Password: "pwd", Permissions: &Permissions{
+			Publish:   &SubjectPermission{Allow: []string{"app.>"}},
+			Subscribe: &SubjectPermission{Allow: []string{"app.>"}},
+		}},
+	}
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	expectError := func(sc *testSTOMPConn, msg string) {
+		t.Helper()
+		defer sc.close()
+		f := sc.read()
+		if f.command != stompCmdError || !strings.Contains(f.headers["message"], msg) {
+			t.Fatalf("Expected error %q, got %+v", msg, f)
+		}
+		sc.nc.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := sc.br.ReadByte(); err == nil {
+			t.Fatal("Expected the connection to be closed")
+		}
+	}
+
+	sc := testSTOMPDial(t, o)
+	sc.send(stompCmdConnect, []string{"accept-version", "1.2", "login", "app", "passcode", "bad"}, _EMPTY_)
+	expectError(sc, "authentication")
+
+	sc = testSTOMPDial(t, o)
+	sc.send(stompCmdConnect, []string{"accept-version", "2.0"}, _EMPTY_)
+	expectError(sc, "versions")
+
+	sc = testSTOMPDial(t, o)
+	sc.send(stompCmdSend, []string{"destination", "app.x"}, _EMPTY_)
+	expectError(sc, "not connected")
+
+	sc = testSTOMPConnect(t, o, "login", "app", "passcode", "pwd")
+	sc.send(stompCmdSend, []string{"destination", "other"}, "x")
+	expectError(sc, "permissions violation")
+
+	sc = testSTOMPConnect(t, o, "login", "app", "passcode", "pwd")
+	sc.send(stompCmdSubscribe, []string{"id", "0", "destination", "other"}, _EMPTY_)
+	expectError(sc, "permissions violation")
+
+	sc = testSTOMPConnect(t, o, "login", "app", "passcode", "pwd")
+	sc.send(stompCmdBegin, []string{"transaction", "tx1"}, _EMPTY_)
+	expectError(sc, "transactions")
+
+	sc = testSTOMPConnect(t, o, "login", "app", "passcode", "pwd")
+	sc.send(stompCmdSend, []string{"destination", "/topic/app.*"}, "x")
+	expectError(sc, "not a valid subject")
+}
@@ -0,0 +1,448 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StorageType determines how messages of a stream are stored.
+type StorageType int
+
+const (
+	// MemoryStorage specifies in memory only.
+	MemoryStorage StorageType = iota
+	// FileStorage specifies on disk.
+	FileStorage
+)
+
+// StoreCipher is the cipher encrypting the file based stores.
+type StoreCipher int
+
+const (
+	// NoCipher stores data unencrypted.
+	NoCipher StoreCipher = iota
+	// AES encrypts data with AES-256-GCM.
+	AES
+	// ChaCha encrypts data with ChaCha20-Poly1305.
+	ChaCha
+)
+
+// RetentionPolicy determines how messages of a stream are retained.
+type RetentionPolicy int
+
+const (
+	// LimitsPolicy (default) means that messages are retained until any
+	// given limit is reached. This could be one of max messages, bytes or age.
+	LimitsPolicy RetentionPolicy = iota
+	// InterestPolicy specifies that when all known consumers have
+	// acknowledged a message it can be removed.
+	InterestPolicy
+	// WorkQueuePolicy specifies that when the first consumer acknowledges
+	// a message it can be removed.
+	WorkQueuePolicy
+)
+
+// DiscardPolicy determines how new messages are handled when the
+// limits of a stream are reached.
+type DiscardPolicy int
+
+const (
+	// DiscardOld will remove older messages to make room for new ones.
+	DiscardOld DiscardPolicy = iota
+	// DiscardNew will reject new messages.
+	DiscardNew
+)
+
+var (
+	// ErrStoreClosed is returned when the store has been closed.
+	ErrStoreClosed = errors.New("store is closed")
+	// ErrStoreMsgNotFound is returned when a message was not found.
+	ErrStoreMsgNotFound = errors.New("no message found")
+	// ErrStoreEOF is returned when a sequence is past the last one stored.
+	ErrStoreEOF = errors.New("stream EOF")
+	// ErrMaxMsgs is returned when the maximum number of messages is reached.
+	ErrMaxMsgs = errors.New("maximum messages exceeded")
+	// ErrMaxBytes is returned when the maximum number of bytes is reached.
+	ErrMaxBytes = errors.New("maximum bytes exceeded")
+	// ErrStoreCorrupt is returned when stored data fails validation.
+	ErrStoreCorrupt = errors.New("store data is corrupt")
+	// ErrStoreSeqOutOfOrder is returned when storing a message with a
+	// sequence that is not after the last one.
+	ErrStoreSeqOutOfOrder = errors.New("sequence is not after the last one")
+	// ErrStoreEncrypted is returned when opening an encrypted store
+	// without a key.
+	ErrStoreEncrypted = errors.New("store is encrypted")
+	// ErrStoreKeyMismatch is returned when the key can not decrypt the store.
+	ErrStoreKeyMismatch = errors.New("store encryption key does not match")
+)
+
+// StreamStore is the interface implemented by the message stores
+// of streams.
+type StreamStore interface {
+	// StoreMsg stores the message, with its header block if any, and
+	// returns its sequence and timestamp.
+	StoreMsg(subj string, hdr, msg []byte) (uint64, int64, error)
+	// StoreRawMsg stores the message with the sequence and timestamp
+	// assigned by the leader of a replicated stream. The sequence must be
+	// after the last one, the sequences in between are skipped.
+	StoreRawMsg(subj string, hdr, msg []byte, seq uint64, ts int64) error
+	// SkipMsg uses the sequence without storing a message.
+	SkipMsg(seq uint64) error
+	// LoadMsg returns the message with the given sequence.
+	LoadMsg(seq uint64) (*StoredMsg, error)
+	// LoadLastMsg returns the last message stored on the given subject.
+	LoadLastMsg(subj string) (*StoredMsg, error)
+	// SubjectSeqs returns the sequences of the messages stored on the
+	// literal subject, in order.
+	SubjectSeqs(subj string) []uint64
+	// LastSeqs returns the sequence of the last message of each subject
+	// matching the filter, in order.
+	LastSeqs(filter string) []uint64
+	// RemoveMsg removes the message with the given sequence.
+	RemoveMsg(seq uint64) (bool, error)
+	// Purge removes all messages, the sequence is preserved.
+	Purge() (uint64, error)
+	// Compact removes the messages below the sequence and returns the
+	// number removed. The next message stored has at least this sequence.
+	Compact(seq uint64) (uint64, error)
+	// GetSeqFromTime returns the first sequence stored at or after
+	// the given time.
+	GetSeqFromTime(t time.Time) uint64
+	// NumPending returns the number of messages at or after the given
+	// sequence matching the filter, and the sequence of the last one.
+	NumPending(sseq uint64, filter string) (num uint64, last uint64)
+	// State returns the current state of the store.
+	State() StreamState
+	// RegisterStorageUpdates registers a callback invoked with the
+	// change of number of messages and bytes.
+	RegisterStorageUpdates(cb func(md, bd int64))
+	// UpdateConfig applies the new limits of the stream.
+	UpdateConfig(cfg *StreamConfig) error
+	// ConsumerStore returns the store for the state of the named consumer.
+	ConsumerStore(name string) (ConsumerStore, error)
+	// Delete stops the store and removes all its data.
+	Delete() error
+	// Stop stops the store, the data is kept.
+	Stop() error
+}
+
+// Sequences of the messages stored on each subject, in order. Used to
+// limit the number of messages per subject.
+type subjIndex map[string][]uint64
+
+func (si subjIndex) add(subj string, seq uint64) {
+	si[subj] = append(si[subj], seq)
+}
+
+func (si subjIndex) remove(subj string, seq uint64) {
+	seqs := si[subj]
+	i := sort.Search(len(seqs), func(i int) bool { return seqs[i] >= seq })
+	switch {
+	case i == len(seqs) || seqs[i] != seq:
+	case len(seqs) == 1:
+		delete(si, subj)
+	case i == 0:
+		// Most often the oldest one, the space is reclaimed on append.
+		si[subj] = seqs[1:]
+	default:
+		si[subj] = append(seqs[:i], seqs[i+1:]...)
+	}
+}
+
+// Returns a copy of the sequences of the subject.
+func (si subjIndex) seqs(subj string) []uint64 {
+	return append([]uint64(nil), si[subj]...)
+}
+
+// Returns the last sequence of each subject matching the filter, sorted.
+func (si subjIndex) lastSeqs(filter string) []uint64 {
+	var last []uint64
+	for subj, seqs := range si {
+		if filter == _EMPTY_ || matchLiteral(subj, filter) {
+			last = append(last, seqs[len(seqs)-1])
+		}
+	}
+	sort.Slice(last, func(i, j int) bool { return last[i] < last[j] })
+	return last
+}
+
+// ConsumerStore stores the state of a consumer.
+type ConsumerStore interface {
+	// Update records the new state.
+	Update(state *ConsumerState) error
+	// State returns the last recorded state.
+	State() (*ConsumerState, error)
+	// Stop stops the store, the state is kept.
+	Stop() error
+	// Delete stops the store and removes the state.
+	Delete() error
+}
+
+// SequencePair has both the consumer and the stream sequence.
+type SequencePair struct {
+	Consumer uint64 `json:"consumer_seq"`
+	Stream   uint64 `json:"stream_seq"`
+}
+
+// Pending is a message delivered and waiting for an acknowledgement.
+type Pending struct {
+	Sequence  uint64 `json:"sequence"`
+	Timestamp int64  `json:"ts"`
+}
+
+// ConsumerState is the delivery and acknowledgement state of a consumer.
+type ConsumerState struct {
+	// Delivered is the last delivered sequence pair.
+	Delivered SequencePair `json:"delivered"`
+	// AckFloor is the sequence pair below which all messages are acked.
+	AckFloor SequencePair `json:"ack_floor"`
+	// Pending is keyed by stream sequence.
+	Pending map[uint64]*Pending `json:"pending,omitempty"`
+	// Redelivered is the delivery count keyed by stream sequence, for
+	// the messages delivered more than once.
+	Redelivered map[uint64]uint64 `json:"redelivered,omitempty"`
+}
+
+// Returns a deep copy of the state.
+func (state *ConsumerState) copy() *ConsumerState {
+	cs := &ConsumerState{Delivered: state.Delivered, AckFloor: state.AckFloor}
+	if len(state.Pending) > 0 {
+		cs.Pending = make(map[uint64]*Pending, len(state.Pending))
+		for seq, p := range state.Pending {
+			pc := *p
+			cs.Pending[seq] = &pc
+		}
+	}
+	if len(state.Redelivered) > 0 {
+		cs.Redelivered = make(map[uint64]uint64, len(state.Redelivered))
+		for seq, dc := range state.Redelivered {
+			cs.Redelivered[seq] = dc
+		}
+	}
+	return cs
+}
+
+// StoredMsg is a message retrieved from a stream.
+type StoredMsg struct {
+	Subject  string    `json:"subject"`
+	Sequence uint64    `json:"seq"`
+	Header   []byte    `json:"hdrs,omitempty"`
+	Data     []byte    `json:"data,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// StreamState is the state of the messages of a stream.
+type StreamState struct {
+	Msgs      uint64    `json:"messages"`
+	Bytes     uint64    `json:"bytes"`
+	FirstSeq  uint64    `json:"first_seq"`
+	FirstTime time.Time `json:"first_ts"`
+	LastSeq   uint64    `json:"last_seq"`
+	LastTime  time.Time `json:"last_ts"`
+	Consumers int       `json:"consumer_count"`
+}
+
+// Size accounted for a stored message. The overhead covers the
+// sequence, timestamp and framing.
+func storedMsgSize(subj string, hdr, msg []byte) uint64 {
+	return uint64(len(subj) + len(hdr) + len(msg) + 16)
+}
+
+const (
+	memoryStorageString = "memory"
+	fileStorageString   = "file"
+)
+
+func (st StorageType) String() string {
+	switch st {
+	case MemoryStorage:
+		return strings.Title(memoryStorageString)
+	case FileStorage:
+		return strings.Title(fileStorageString)
+	default:
+		return "Unknown Storage Type"
+	}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (st StorageType) MarshalJSON() ([]byte, error) {
+	switch st {
+	case MemoryStorage:
+		return json.Marshal(memoryStorageString)
+	case FileStorage:
+		return json.Marshal(fileStorageString)
+	default:
+		return nil, fmt.Errorf("can not marshal %v", st)
+	}
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (st *StorageType) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case jsonString(memoryStorageString):
+		*st = MemoryStorage
+	case jsonString(fileStorageString):
+		*st = FileStorage
+	default:
+		return fmt.Errorf("can not unmarshal %q", data)
+	}
+	return nil
+}
+
+const (
+	noCipherString     = "none"
+	aesCipherString    = "aes"
+	chaChaCipherString = "chacha"
+)
+
+func (sc StoreCipher) String() string {
+	switch sc {
+	case NoCipher:
+		return noCipherString
+	case AES:
+		return "AES-256-GCM"
+	case ChaCha:
+		return "ChaCha20-Poly1305"
+	default:
+		return "Unknown Cipher"
+	}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (sc StoreCipher) MarshalJSON() ([]byte, error) {
+	switch sc {
+	case NoCipher:
+		return json.Marshal(noCipherString)
+	case AES:
+		return json.Marshal(aesCipherString)
+	case ChaCha:
+		return json.Marshal(chaChaCipherString)
+	default:
+		return nil, fmt.Errorf("can not marshal %v", sc)
+	}
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (sc *StoreCipher) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case jsonString(noCipherString):
+		*sc = NoCipher
+	case jsonString(aesCipherString):
+		*sc = AES
+	case jsonString(chaChaCipherString):
+		*sc = ChaCha
+	default:
+		return fmt.Errorf("can not unmarshal %q", data)
+	}
+	return nil
+}
+
+const (
+	limitsPolicyString    = "limits"
+	interestPolicyString  = "interest"
+	workQueuePolicyString = "workqueue"
+)
+
+func (rp RetentionPolicy) String() string {
+	switch rp {
+	case LimitsPolicy:
+		return "Limits"
+	case InterestPolicy:
+		return "Interest"
+	case WorkQueuePolicy:
+		return "WorkQueue"
+	default:
+		return "Unknown Retention Policy"
+	}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (rp RetentionPolicy) MarshalJSON() ([]byte, error) {
+	switch rp {
+	case LimitsPolicy:
+		return json.Marshal(limitsPolicyString)
+	case InterestPolicy:
+		return json.Marshal(interestPolicyString)
+	case WorkQueuePolicy:
+		return json.Marshal(workQueuePolicyString)
+	default:
+		return nil, fmt.Errorf("can not marshal %v", rp)
+	}
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (rp *RetentionPolicy) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case jsonString(limitsPolicyString):
+		*rp = LimitsPolicy
+	case jsonString(interestPolicyString):
+		*rp = InterestPolicy
+	case jsonString(workQueuePolicyString):
+		*rp = WorkQueuePolicy
+	default:
+		return fmt.Errorf("can not unmarshal %q", data)
+	}
+	return nil
+}
+
+const (
+	discardOldString = "old"
+	discardNewString = "new"
+)
+
+func (dp DiscardPolicy) String() string {
+	switch dp {
+	case DiscardOld:
+		return "DiscardOld"
+	case DiscardNew:
+		return "DiscardNew"
+	default:
+		return "Unknown Discard Policy"
+	}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (dp DiscardPolicy) MarshalJSON() ([]byte, error) {
+	switch dp {
+	case DiscardOld:
+		return json.Marshal(discardOldString)
+	case DiscardNew:
+		return json.Marshal(discardNewString)
+	default:
+		return nil, fmt.Errorf("can not marshal %v", dp)
+	}
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (dp *DiscardPolicy) UnmarshalJSON(data []byte) error {
+	switch strings.ToLower(string(data)) {
+	case jsonString(discardOldString):
+		*dp = DiscardOld
+	case jsonString(discardNewString):
+		*dp = DiscardNew
+	default:
+		return fmt.Errorf("can not unmarshal %q", data)
+	}
+	return nil
+}
+
+func jsonString(s string) string {
+	return "\"" + s + "\""
+}
@@ -0,0 +1,1461 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StreamConfig will determine the name, subjects and retention policy
+// for a given stream. If subjects is empty the name will be used.
+type StreamConfig struct {
+	Name         string          `json:"name"`
+	Subjects     []string        `json:"subjects,omitempty"`
+	Retention    RetentionPolicy `json:"retention"`
+	MaxConsumers int             `json:"max_consumers"`
+	MaxMsgs      int64           `json:"max_msgs"`
+	MaxMsgsPer   int64           `json:"max_msgs_per_subject,omitempty"`
+	MaxBytes     int64           `json:"max_bytes"`
+	Discard      DiscardPolicy   `json:"discard"`
+	MaxAge       time.Duration   `json:"max_age"`
+	MaxMsgSize   int32           `json:"max_msg_size,omitempty"`
+	Storage      StorageType     `json:"storage"`
+	Replicas     int             `json:"num_replicas"`
+	NoAck        bool            `json:"no_ack,omitempty"`
+	Duplicates   time.Duration   `json:"duplicate_window,omitempty"`
+	AllowMsgTTL  bool            `json:"allow_msg_ttl,omitempty"`
+	Placement    *Placement      `json:"placement,omitempty"`
+	Mirror       *StreamSource   `json:"mirror,omitempty"`
+	Sources      []*StreamSource `json:"sources,omitempty"`
+	TierAfter    time.Duration   `json:"tier_after,omitempty"`
+	// DeliveryDelay delays the delivery of the messages to consumers.
+	DeliveryDelay time.Duration `json:"delivery_delay,omitempty"`
+	RePublish     *RePublish    `json:"republish,omitempty"`
+	// Only the messages with a subject matching one of the filters are
+	// stored, the others are rejected.
+	IngestFilters    []string                `json:"ingest_filters,omitempty"`
+	SubjectTransform *SubjectTransformConfig `json:"subject_transform,omitempty"`
+}
+
+// SubjectTransformConfig rewrites the subject of the messages matching
+// the source before they are stored.
+type SubjectTransformConfig struct {
+	Source      string `json:"src,omitempty"`
+	Destination string `json:"dest"`
+}
+
+// RePublish publishes the messages stored by a stream to core NATS. The
+// stored messages matching the source are sent to the destination, which
+// may reference the source wildcards as with subject mappings.
+type RePublish struct {
+	Source      string `json:"src,omitempty"`
+	Destination string `json:"dest"`
+	// Only the headers are republished, with the size of the message.
+	HeadersOnly bool `json:"headers_only,omitempty"`
+}
+
+// Placement selects the servers of a replicated stream, they must have
+// all the tags.
+type Placement struct {
+	Tags []string `json:"tags,omitempty"`
+}
+
+// StreamInfo shows config and current state for this stream.
+type StreamInfo struct {
+	Config  StreamConfig        `json:"config"`
+	Created time.Time           `json:"created"`
+	State   StreamState         `json:"state"`
+	Cluster *ClusterInfo        `json:"cluster,omitempty"`
+	Mirror  *StreamSourceInfo   `json:"mirror,omitempty"`
+	Sources []*StreamSourceInfo `json:"sources,omitempty"`
+}
+
+// PubAck is the acknowledgement sent to the publisher of a message
+// stored in a stream.
+type PubAck struct {
+	Stream    string `json:"stream"`
+	Seq       uint64 `json:"seq"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
+// Stored in the stream directory for file based streams.
+type streamMeta struct {
+	Config  StreamConfig `json:"config"`
+	Created time.Time    `json:"created"`
+}
+
+var (
+	// ErrJetStreamNotEnabled is returned when JetStream is not enabled.
+	ErrJetStreamNotEnabled = errors.New("jetstream not enabled")
+	// ErrJetStreamStreamNotFound is returned when a stream does not exist.
+	ErrJetStreamStreamNotFound = errors.New("stream not found")
+	// ErrJetStreamStreamExists is returned when creating a stream with a
+	// name already in use.
+	ErrJetStreamStreamExists = errors.New("stream name already in use")
+	// ErrJetStreamResourcesExceeded is returned when the server limits
+	// for the storage type are reached.
+	ErrJetStreamResourcesExceeded = errors.New("insufficient resources")
+	// ErrJetStreamMsgTooLarge is returned when a message exceeds the
+	// maximum message size of the stream.
+	ErrJetStreamMsgTooLarge = errors.New("message size exceeds maximum allowed")
+	// ErrJetStreamMsgFiltered is returned when the subject of a message
+	// does not match the ingest filters of the stream.
+	ErrJetStreamMsgFiltered = errors.New("message subject filtered by the stream")
+)
+
+// Prefix of the subjects reserved for JetStream.
+const jsReservedPrefix = "$JS."
+
+// StreamMaxReplicas is the maximum number of replicas of a stream.
+const StreamMaxReplicas = 5
+
+// StreamDefaultDuplicatesWindow is the default window during which
+// messages with the same id are stored only once.
+const StreamDefaultDuplicatesWindow = 2 * time.Minute
+
+// JSMsgId is the header of a published message that identifies it
+// within the duplicate window of the stream.
+const JSMsgId = "Nats-Msg-Id"
+
+// JSMsgTTL is the header of a published message with the duration after
+// which it is removed, for streams that allow it.
+const JSMsgTTL = "Nats-TTL"
+
+// JSMsgDelay is the header of a published message with the duration,
+// from when it is stored, before it is delivered to consumers.
+const JSMsgDelay = "Nats-Delay"
+
+// JSMsgDeliverAt is the header of a published message with the time, in
+// RFC 3339 format, before which it is not delivered to consumers.
+const JSMsgDeliverAt = "Nats-Deliver-At"
+
+// JSDeadLetter is the header of the messages moved to a dead letter
+// stream, with the stream, the consumer and the sequence of the message
+// in its stream.
+const JSDeadLetter = "Nats-Dead-Letter"
+
+// Headers of the republished messages.
+const (
+	JSStream    = "Nats-Stream"
+	JSSequence  = "Nats-Sequence"
+	JSTimeStamp = "Nats-Time-Stamp"
+	JSSubject   = "Nats-Subject"
+	JSMsgSize   = "Nats-Msg-Size"
+)
+
+// Interval at which the followers of a replicated stream check for
+// expired messages, which are removed by the leader.
+const msgTTLFollowerInterval = time.Second
+
+// Stream is a set of subjects whose messages are stored.
+type Stream struct {
+	// Delivery delay of the stream in nanoseconds, read atomically by
+	// the consumers. Here first for the alignment of atomics.
+	ddelay int64
+
+	mu        sync.RWMutex
+	jsa       *jsAccount
+	config    StreamConfig
+	rpub      *subjectTransform
+	sxform    *subjectTransform
+	created   time.Time
+	store     StreamStore
+	subs      []*subscription
+	consumers map[string]*Consumer
+	closed    bool
+
+	// Replicated streams. Only the leader of the group processes the
+	// published messages, which are stored once applied.
+	node   *raft
+	group  *raftGroup
+	leader bool
+	cusub  *subscription
+	// Closed when leadership is lost.
+	lqch chan struct{}
+	// Protects the last sequence proposed, so that messages are
+	// proposed in order.
+	clMu  sync.Mutex
+	clseq uint64
+
+	// Ids of the messages stored within the duplicate window, oldest
+	// first. Also serializes the checks of messages with an id.
+	ddMu    sync.Mutex
+	ddmap   map[string]*ddentry
+	ddarr   []*ddentry
+	ddindex int
+	ddtmr   *time.Timer
+
+	// Expiration of the messages with a TTL, soonest first.
+	ttlMu  sync.Mutex
+	ttls   []msgTTL
+	ttltmr *time.Timer
+
+	// Mirror or sources running on the leader, by source.
+	srcMu   sync.Mutex
+	sources map[string]*sourceInfo
+}
+
+// Tracks the expiration of a stored message.
+type msgTTL struct {
+	seq     uint64
+	expires int64
+}
+
+// Tracks the id of a stored message.
+type ddentry struct {
+	id  string
+	seq uint64
+	ts  int64
+}
+
+// Checks the configuration and fills in the defaults.
+func checkStreamCfg(config *StreamConfig) (StreamConfig, error) {
+	if config == nil {
+		return StreamConfig{}, fmt.Errorf("stream configuration invalid")
+	}
+	if !isValidName(config.Name) {
+		return StreamConfig{}, fmt.Errorf("stream name is required and can not contain '.', '*', '>'")
+	}
+	cfg := *config
+	if cfg.MaxMsgs == 0 {
+		cfg.MaxMsgs = -1
+	}
+	if cfg.MaxBytes == 0 {
+		cfg.MaxBytes = -1
+	}
+	if cfg.MaxMsgSize == 0 {
+		cfg.MaxMsgSize = -1
+	}
+	if cfg.MaxConsumers == 0 {
+		cfg.MaxConsumers = -1
+	}
+	if cfg.MaxAge < 0 {
+		return StreamConfig{}, fmt.Errorf("max age can not be negative")
+	}
+	if cfg.MaxMsgsPer < 0 {
+		return StreamConfig{}, fmt.Errorf("max messages per subject can not be negative")
+	}
+	if cfg.Duplicates < 0 {
+		return StreamConfig{}, fmt.Errorf("duplicates window can not be negative")
+	}
+	if cfg.Duplicates == 0 {
+		cfg.Duplicates = StreamDefaultDuplicatesWindow
+		if cfg.MaxAge > 0 && cfg.MaxAge < cfg.Duplicates {
+			cfg.Duplicates = cfg.MaxAge
+		}
+	}
+	if cfg.MaxAge > 0 && cfg.Duplicates > cfg.MaxAge {
+		return StreamConfig{}, fmt.Errorf("duplicates window can not be larger than max age")
+	}
+	if cfg.Replicas == 0 {
+		cfg.Replicas = 1
+	}
+	if cfg.Replicas < 0 || cfg.Replicas > StreamMaxReplicas {
+		return StreamConfig{}, fmt.Errorf("replicas must be between 1 and %d", StreamMaxReplicas)
+	}
+	if cfg.DeliveryDelay < 0 {
+		return StreamConfig{}, fmt.Errorf("delivery delay can not be negative")
+	}
+	if cfg.TierAfter < 0 {
+		return StreamConfig{}, fmt.Errorf("tier after can not be negative")
+	}
+	if cfg.TierAfter > 0 && cfg.Storage != FileStorage {
+		return StreamConfig{}, fmt.Errorf("tiered storage requires file storage")
+	}
+	if err := checkStreamSources(&cfg); err != nil {
+		return StreamConfig{}, err
+	}
+	if len(cfg.Subjects) == 0 && cfg.Mirror == nil && len(cfg.Sources) == 0 {
+		cfg.Subjects = []string{cfg.Name}
+	}
+	for i, subj := range cfg.Subjects {
+		if !IsValidSubject(subj) {
+			return StreamConfig{}, fmt.Errorf("invalid subject %q", subj)
+		}
+		if strings.HasPrefix(subj, jsReservedPrefix) {
+			return StreamConfig{}, fmt.Errorf("subject %q is reserved", subj)
+		}
+		for _, other := range cfg.Subjects[:i] {
+			if subjectsCollide(subj, other) {
+				return StreamConfig{}, fmt.Errorf("subjects %q and %q overlap", other, subj)
+			}
+		}
+	}
+	for _, filter := range cfg.IngestFilters {
+		if !IsValidSubject(filter) {
+			return StreamConfig{}, fmt.Errorf("invalid ingest filter %q", filter)
+		}
+	}
+	if st := cfg.SubjectTransform; st != nil {
+		if _, err := newSubjectTransform(st.Source, st.Destination); err != nil {
+			return StreamConfig{}, fmt.Errorf("subject transform %v", err)
+		}
+		if strings.HasPrefix(st.Destination, jsReservedPrefix) {
+			return StreamConfig{}, fmt.Errorf("subject transform destination %q is reserved", st.Destination)
+		}
+	}
+	if cfg.Mirror != nil && (len(cfg.IngestFilters) > 0 || cfg.SubjectTransform != nil) {
+		return StreamConfig{}, fmt.Errorf("stream mirrors can not have ingest filters or a subject transform")
+	}
+	if rp := cfg.RePublish; rp != nil {
+		if _, err := newSubjectTransform(rp.Source, rp.Destination); err != nil {
+			return StreamConfig{}, fmt.Errorf("republish %v", err)
+		}
+		for _, subj := range cfg.Subjects {
+			if subjectsCollide(rp.Destination, subj) {
+				return StreamConfig{}, fmt.Errorf("republish destination forms a cycle")
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// Returns true if the name can be used for a stream.
+func isValidName(name string) bool {
+	return name != _EMPTY_ && !strings.ContainsAny(name, ".*> \t\r\n")
+}
+
+// Returns true if some subject can match both subjects.
+func subjectsCollide(subj1, subj2 string) bool {
+	t1 := strings.Split(subj1, tsep)
+	t2 := strings.Split(subj2, tsep)
+	for i := 0; i < len(t1) && i < len(t2); i++ {
+		if t1[i] == ">" || t2[i] == ">" {
+			return true
+		}
+		if t1[i] != t2[i] && t1[i] != "*" && t2[i] != "*" {
+			return false
+		}
+	}
+	return len(t1) == len(t2)
+}
+
+// Adds a stream to the account. The stream is recreated from its
+// directory if it is file based and has data stored.
+func (jsa *jsAccount) addStream(config *StreamConfig, created time.Time) (*Stream, error) {
+	return jsa.addStreamWithGroup(config, created, nil)
+}
+
+// Adds a stream, replicated by the raft group if not nil.
+func (jsa *jsAccount) addStreamWithGroup(config *StreamConfig, created time.Time, rg *raftGroup) (*Stream, error) {
+	cfg, err := checkStreamCfg(config)
+	if err != nil {
+		return nil, err
+	}
+	if rg == nil && cfg.Replicas > 1 {
+		return nil, fmt.Errorf("replicas > 1 not supported in non-clustered mode")
+	}
+	if cfg.TierAfter > 0 && jsa.js.tier == nil {
+		return nil, errTierNotConfigured
+	}
+	jsa.mu.Lock()
+	if jsa.streams == nil {
+		jsa.mu.Unlock()
+		return nil, ErrJetStreamNotEnabled
+	}
+	if _, ok := jsa.streams[cfg.Name]; ok {
+		jsa.mu.Unlock()
+		return nil, ErrJetStreamStreamExists
+	}
+	for _, mset := range jsa.streams {
+		for _, subj := range cfg.Subjects {
+			for _, other := range mset.config.Subjects {
+				if subjectsCollide(subj, other) {
+					jsa.mu.Unlock()
+					return nil, fmt.Errorf("subjects overlap with stream %q", mset.config.Name)
+				}
+			}
+		}
+	}
+	mset := &Stream{jsa: jsa, config: cfg, created: created, consumers: make(map[string]*Consumer)}
+	mset.ddelay = int64(cfg.DeliveryDelay)
+	mset.rpub = newRePublish(cfg.RePublish)
+	mset.sxform = newIngestTransform(cfg.SubjectTransform)
+	// Reserve the name while the store is being set up.
+	jsa.streams[cfg.Name] = mset
+	jsa.mu.Unlock()
+
+	if err := mset.setupStore(); err != nil {
+		jsa.mu.Lock()
+		delete(jsa.streams, cfg.Name)
+		jsa.mu.Unlock()
+		return nil, err
+	}
+	mset.rebuildDedupe()
+	mset.rebuildMsgTTLs()
+	if rg != nil {
+		if err := mset.startGroup(rg); err != nil {
+			mset.stop(false)
+			jsa.mu.Lock()
+			delete(jsa.streams, cfg.Name)
+			jsa.mu.Unlock()
+			return nil, err
+		}
+	}
+	if err := mset.subscribeToStream(); err != nil {
+		mset.stop(false)
+		jsa.mu.Lock()
+		delete(jsa.streams, cfg.Name)
+		jsa.mu.Unlock()
+		return nil, err
+	}
+	// Replicated streams start the sources when elected leader.
+	if rg == nil {
+		mset.mu.Lock()
+		mset.lqch = make(chan struct{})
+		lqch := mset.lqch
+		mset.mu.Unlock()
+		mset.startSources(lqch)
+	}
+	return mset, nil
+}
+
+// Returns the directory of the stream.
+func (mset *Stream) storeDir() string {
+	return filepath.Join(mset.jsa.storeDir, streamsDir, mset.config.Name)
+}
+
+// Creates the message store of the stream.
+func (mset *Stream) setupStore() error {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+
+	switch mset.config.Storage {
+	case MemoryStorage:
+		ms, err := newMemStore(&mset.config)
+		if err != nil {
+			return err
+		}
+		mset.store = ms
+	case FileStorage:
+		jcfg := mset.jsa.js.config
+		fcfg := FileStoreConfig{StoreDir: mset.storeDir(), Cipher: jcfg.Cipher, Key: jcfg.Key, PrevKey: jcfg.PrevKey}
+		if js := mset.jsa.js; js.tier != nil {
+			fcfg.Tier, fcfg.TierPrefix = js.tier, path.Join(mset.jsa.account.Name, mset.config.Name)
+		}
+		fs, err := newFileStore(fcfg, mset.config)
+		if err != nil {
+			return err
+		}
+		mset.store = fs
+		if err := mset.writeMeta(); err != nil {
+			fs.Stop()
+			mset.store = nil
+			return err
+		}
+		// Account for the messages recovered from disk.
+		if state := fs.State(); state.Bytes > 0 {
+			mset.jsa.updateUsage(FileStorage, int64(state.Bytes))
+		}
+	default:
+		return fmt.Errorf("unknown storage type %v", mset.config.Storage)
+	}
+	st, jsa := mset.config.Storage, mset.jsa
+	mset.store.RegisterStorageUpdates(func(md, bd int64) { jsa.updateUsage(st, bd) })
+	return nil
+}
+
+// Writes the configuration of a file based stream. Lock should be held.
+func (mset *Stream) writeMeta() error {
+	b, err := json.MarshalIndent(&streamMeta{Config: mset.config, Created: mset.created}, _EMPTY_, "  ")
+	if err != nil {
+		return err
+	}
+	sdir := mset.storeDir()
+	tmp := filepath.Join(sdir, streamMetaFile+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(sdir, streamMetaFile))
+}
+
+// Subscribes the internal client to the subjects of the stream.
+func (mset *Stream) subscribeToStream() error {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+	jsa := mset.jsa
+	for _, subj := range mset.config.Subjects {
+		jsa.mu.Lock()
+		sid := jsa.nextSid()
+		c := jsa.client
+		jsa.mu.Unlock()
+		sub, err := c.subscribeInternal(subj, sid, mset.processInboundMsg)
+		if err != nil {
+			return err
+		}
+		mset.subs = append(mset.subs, sub)
+	}
+	return nil
+}
+
+// Unsubscribes the internal client. Lock should be held.
+func (mset *Stream) unsubscribe() {
+	c := mset.jsa.client
+	for _, sub := range mset.subs {
+		c.unsubscribe(c.acc, sub, true)
+	}
+	mset.subs = nil
+}
+
+// Name returns the name of the stream.
+func (mset *Stream) Name() string {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return mset.config.Name
+}
+
+// Config returns the configuration of the stream.
+func (mset *Stream) Config() StreamConfig {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return mset.config
+}
+
+// Created returns the creation time of the stream.
+func (mset *Stream) Created() time.Time {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return mset.created
+}
+
+// State returns the state of the messages of the stream.
+func (mset *Stream) State() StreamState {
+	mset.mu.RLock()
+	store, nc := mset.store, mset.numConsumers()
+	mset.mu.RUnlock()
+	if store == nil {
+		return StreamState{}
+	}
+	state := store.State()
+	state.Consumers = nc
+	return state
+}
+
+// Info returns the configuration and state of the stream.
+func (mset *Stream) Info() *StreamInfo {
+	info := &StreamInfo{Config: mset.Config(), Created: mset.Created(), State: mset.State(), Cluster: mset.clusterInfo()}
+	info.Mirror, info.Sources = mset.sourcesInfo()
+	return info
+}
+
+// Update changes the limits of the stream. The name, storage type and
+// retention policy can not be changed.
+func (mset *Stream) Update(config *StreamConfig) error {
+	cfg, err := checkStreamCfg(config)
+	if err != nil {
+		return err
+	}
+	// Changed sources are restarted on the leader once unlocked.
+	var restart chan struct{}
+	defer func() {
+		if restart != nil {
+			mset.stopSources()
+			mset.startSources(restart)
+		}
+	}()
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+	if mset.closed {
+		return ErrStoreClosed
+	}
+	old := mset.config
+	if cfg.Name != old.Name {
+		return fmt.Errorf("stream configuration name must match original")
+	}
+	if cfg.Storage != old.Storage {
+		return fmt.Errorf("stream configuration update can not change storage type")
+	}
+	if cfg.TierAfter > 0 && mset.jsa.js.tier == nil {
+		return errTierNotConfigured
+	}
+	if err := checkStreamMaxBytes(&cfg, mset.jsa.limits()); err != nil {
+		return err
+	}
+	if cfg.Retention != old.Retention {
+		return fmt.Errorf("stream configuration update can not change retention policy")
+	}
+	if cfg.Replicas != old.Replicas {
+		return fmt.Errorf("stream configuration update can not change replicas")
+	}
+	if (cfg.Mirror == nil) != (old.Mirror == nil) || (cfg.Mirror != nil && sourceKey(cfg.Mirror) != sourceKey(old.Mirror)) {
+		return fmt.Errorf("stream configuration update can not change mirror")
+	}
+	if !sameSubjects(cfg.Subjects, old.Subjects) {
+		jsa := mset.jsa
+		jsa.mu.RLock()
+		for _, other := range jsa.streams {
+			if other == mset {
+				continue
+			}
+			for _, subj := range cfg.Subjects {
+				for _, osubj := range other.config.Subjects {
+					if subjectsCollide(subj, osubj) {
+						jsa.mu.RUnlock()
+						return fmt.Errorf("subjects overlap with stream %q", other.config.Name)
+					}
+				}
+			}
+		}
+		jsa.mu.RUnlock()
+		mset.unsubscribe()
+		mset.config.Subjects = cfg.Subjects
+		c := jsa.client
+		for _, subj := range cfg.Subjects {
+			jsa.mu.Lock()
+			sid := jsa.nextSid()
+			jsa.mu.Unlock()
+			sub, err := c.subscribeInternal(subj, sid, mset.processInboundMsg)
+			if err != nil {
+				return err
+			}
+			mset.subs = append(mset.subs, sub)
+		}
+	}
+	mset.config = cfg
+	atomic.StoreInt64(&mset.ddelay, int64(cfg.DeliveryDelay))
+	mset.rpub = newRePublish(cfg.RePublish)
+	mset.sxform = newIngestTransform(cfg.SubjectTransform)
+	if !sameSources(&cfg, &old) {
+		restart = mset.lqch
+	}
+	if err := mset.store.UpdateConfig(&cfg); err != nil {
+		return err
+	}
+	if cfg.Storage == FileStorage {
+		return mset.writeMeta()
+	}
+	return nil
+}
+
+func sameSubjects(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	m := make(map[string]struct{}, len(a))
+	for _, s := range a {
+		m[s] = struct{}{}
+	}
+	for _, s := range b {
+		if _, ok := m[s]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Purge removes all messages from the stream.
+func (mset *Stream) Purge() (uint64, error) {
+	mset.mu.RLock()
+	store := mset.store
+	consumers := mset.getConsumers()
+	mset.mu.RUnlock()
+	if store == nil {
+		return 0, ErrStoreClosed
+	}
+	purged, err := store.Purge()
+	if err != nil {
+		return purged, err
+	}
+	firstSeq := store.State().FirstSeq
+	for _, o := range consumers {
+		o.purge(firstSeq)
+	}
+	return purged, nil
+}
+
+// GetMsg returns the message with the given sequence.
+func (mset *Stream) GetMsg(seq uint64) (*StoredMsg, error) {
+	mset.mu.RLock()
+	store := mset.store
+	mset.mu.RUnlock()
+	if store == nil {
+		return nil, ErrStoreClosed
+	}
+	return store.LoadMsg(seq)
+}
+
+// RemoveMsg removes the message with the given sequence.
+func (mset *Stream) RemoveMsg(seq uint64) (bool, error) {
+	mset.mu.RLock()
+	store := mset.store
+	mset.mu.RUnlock()
+	if store == nil {
+		return false, ErrStoreClosed
+	}
+	return store.RemoveMsg(seq)
+}
+
+// Delete deletes the stream and all its messages.
+func (mset *Stream) Delete() error {
+	jsa := mset.jsa
+	jsa.mu.Lock()
+	if jsa.streams != nil {
+		delete(jsa.streams, mset.Name())
+	}
+	jsa.mu.Unlock()
+	return mset.stop(true)
+}
+
+// Stops the stream, removing its data if requested.
+func (mset *Stream) stop(deleteData bool) error {
+	mset.mu.Lock()
+	if mset.closed {
+		mset.mu.Unlock()
+		return nil
+	}
+	mset.closed = true
+	mset.unsubscribe()
+	store := mset.store
+	consumers := mset.getConsumers()
+	mset.consumers = nil
+	node, cusub := mset.node, mset.cusub
+	mset.cusub = nil
+	if mset.lqch != nil {
+		close(mset.lqch)
+		mset.lqch = nil
+	}
+	mset.mu.Unlock()
+
+	mset.ddMu.Lock()
+	if mset.ddtmr != nil {
+		mset.ddtmr.Stop()
+		mset.ddtmr = nil
+	}
+	mset.ddmap, mset.ddarr, mset.ddindex = nil, nil, 0
+	mset.ddMu.Unlock()
+
+	mset.ttlMu.Lock()
+	if mset.ttltmr != nil {
+		mset.ttltmr.Stop()
+		mset.ttltmr = nil
+	}
+	mset.ttls = nil
+	mset.ttlMu.Unlock()
+
+	mset.stopSources()
+
+	if node != nil {
+		if deleteData {
+			node.Delete()
+		} else {
+			node.Stop()
+		}
+	}
+	if cusub != nil {
+		mset.jsa.js.cluster.unsubscribe(cusub)
+	}
+	for _, o := range consumers {
+		o.stop(deleteData)
+	}
+	if store == nil {
+		return nil
+	}
+	// Release the usage of the stream, the store is no longer tracked.
+	store.RegisterStorageUpdates(nil)
+	if state := store.State(); state.Bytes > 0 {
+		mset.jsa.updateUsage(mset.config.Storage, -int64(state.Bytes))
+	}
+	if !deleteData {
+		return store.Stop()
+	}
+	if err := store.Delete(); err != nil {
+		return err
+	}
+	if mset.config.Storage == FileStorage {
+		return os.RemoveAll(mset.storeDir())
+	}
+	return nil
+}
+
+// Returns the number of consumers of the stream.
+// Lock should be held.
+func (mset *Stream) numConsumers() int {
+	return len(mset.consumers)
+}
+
+// Returns the consumers of the stream. Lock should be held.
+func (mset *Stream) getConsumers() []*Consumer {
+	consumers := make([]*Consumer, 0, len(mset.consumers))
+	for _, o := range mset.consumers {
+		consumers = append(consumers, o)
+	}
+	return consumers
+}
+
+// LookupConsumer returns the consumer with the given name.
+func (mset *Stream) LookupConsumer(name string) *Consumer {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return mset.consumers[name]
+}
+
+// NumConsumers returns the number of consumers of the stream.
+func (mset *Stream) NumConsumers() int {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return len(mset.consumers)
+}
+
+// Consumers returns the consumers of the stream sorted by name.
+func (mset *Stream) Consumers() []*Consumer {
+	mset.mu.RLock()
+	consumers := mset.getConsumers()
+	mset.mu.RUnlock()
+	sort.Slice(consumers, func(i, j int) bool { return consumers[i].name < consumers[j].name })
+	return consumers
+}
+
+// Returns true if a consumer of the stream would receive a message
+// on the given subject. Lock should be held.
+func (mset *Stream) checkInterest(subj string) bool {
+	for _, o := range mset.consumers {
+		if o.cfg.FilterSubject == _EMPTY_ || matchLiteral(subj, o.cfg.FilterSubject) {
+			return true
+		}
+	}
+	return false
+}
+
+// Invoked when a consumer acks a message. Depending on the retention
+// policy the message may be removed from the stream.
+func (mset *Stream) ackMsg(o *Consumer, seq uint64) {
+	mset.mu.RLock()
+	cfg, store := mset.config, mset.store
+	var others []*Consumer
+	if cfg.Retention == InterestPolicy {
+		for _, oc := range mset.consumers {
+			if oc != o {
+				others = append(others, oc)
+			}
+		}
+	}
+	mset.mu.RUnlock()
+
+	switch cfg.Retention {
+	case WorkQueuePolicy:
+		mset.removeStoredMsg(store, seq)
+	case InterestPolicy:
+		sm, err := store.LoadMsg(seq)
+		if err != nil {
+			return
+		}
+		for _, oc := range others {
+			if oc.needAck(seq, sm.Subject) {
+				return
+			}
+		}
+		mset.removeStoredMsg(store, seq)
+	}
+}
+
+// Removes a message no longer needed. Replicated streams remove it on
+// all members.
+func (mset *Stream) removeStoredMsg(store StreamStore, seq uint64) {
+	if mset.isClustered() {
+		mset.propose(&streamOp{Op: deleteMsgOp, Seq: seq})
+		return
+	}
+	store.RemoveMsg(seq)
+}
+
+// Invoked for messages published on the subjects of the stream.
+func (mset *Stream) processInboundMsg(_ *subscription, subject, reply string, hdr, msg []byte) {
+	mset.mu.RLock()
+	// Followers store the messages once replicated by the leader.
+	if mset.closed || (mset.node != nil && !mset.leader) {
+		mset.mu.RUnlock()
+		return
+	}
+	jsa, store, cfg, clustered, rpub := mset.jsa, mset.store, mset.config, mset.node != nil, mset.rpub
+	ingest := mset.ingests(subject)
+	if dest, ok := mset.sxform.transform(subject); ok {
+		subject = dest
+	}
+	interest := cfg.Retention != InterestPolicy || mset.checkInterest(subject)
+	consumers := mset.getConsumers()
+	mset.mu.RUnlock()
+
+	sendAck := func(ack *JSPubAckResponse) {
+		if reply != _EMPTY_ && !cfg.NoAck {
+			b, _ := json.Marshal(ack)
+			jsa.outq.send(&jsPubMsg{subj: reply, msg: b})
+		}
+	}
+	sendErr := func(code int, err error) {
+		sendAck(&JSPubAckResponse{Error: &ApiError{Code: code, Description: err.Error()}})
+	}
+
+	if !ingest {
+		sendErr(400, ErrJetStreamMsgFiltered)
+		return
+	}
+	ttl, err := getMsgTTL(hdr)
+	if err == nil && ttl > 0 && !cfg.AllowMsgTTL {
+		err = fmt.Errorf("message TTL not allowed by the stream")
+	}
+	if err == nil {
+		_, err = getMsgDeliverAt(hdr, time.Time{}, 0)
+	}
+	if err != nil {
+		sendErr(400, err)
+		return
+	}
+
+	// Messages with an id already stored are acknowledged again.
+	msgId := getMsgId(hdr)
+	if msgId != _EMPTY_ {
+		mset.ddMu.Lock()
+		defer mset.ddMu.Unlock()
+		if dde := mset.checkMsgId(msgId); dde != nil {
+			sendAck(&JSPubAckResponse{PubAck: &PubAck{Stream: cfg.Name, Seq: dde.seq, Duplicate: true}})
+			return
+		}
+	}
+
+	if cfg.MaxMsgSize >= 0 && len(hdr)+len(msg) > int(cfg.MaxMsgSize) {
+		sendErr(400, ErrJetStreamMsgTooLarge)
+		return
+	}
+	if cfg.Discard == DiscardNew {
+		state := store.State()
+		if cfg.MaxMsgs > 0 && state.Msgs >= uint64(cfg.MaxMsgs) {
+			sendErr(503, ErrMaxMsgs)
+			return
+		}
+		if cfg.MaxBytes > 0 && state.Bytes+storedMsgSize(subject, hdr, msg) > uint64(cfg.MaxBytes) {
+			sendErr(503, ErrMaxBytes)
+			return
+		}
+	}
+	if jsa.limitsExceeded(cfg.Storage) {
+		sendErr(503, ErrJetStreamResourcesExceeded)
+		return
+	}
+	if clustered {
+		// The id is tracked once the message is applied, by every replica,
+		// which also catches the duplicates proposed in the meantime.
+		if _, err := mset.proposeMsg(subject, reply, hdr, msg); err != nil {
+			sendErr(503, err)
+		}
+		return
+	}
+	seq, ts, err := store.StoreMsg(subject, hdr, msg)
+	if err != nil {
+		if err != ErrStoreClosed {
+			jsa.js.srv.Warnf("JetStream failed to store a msg on account %q stream %q: %v",
+				jsa.account.Name, cfg.Name, err)
+		}
+		sendErr(503, err)
+		return
+	}
+	if msgId != _EMPTY_ {
+		mset.storeMsgId(&ddentry{msgId, seq, ts})
+	}
+	// With the interest policy, messages without consumers are not kept.
+	if !interest {
+		store.RemoveMsg(seq)
+	} else if ttl > 0 {
+		mset.trackMsgTTL(seq, ts+int64(ttl))
+	}
+	jsa.republish(rpub, &cfg, subject, hdr, msg, seq, ts)
+	for _, o := range consumers {
+		o.signal()
+	}
+	sendAck(&JSPubAckResponse{PubAck: &PubAck{Stream: cfg.Name, Seq: seq}})
+}
+
+// Returns the transform of the subjects of the stored messages, nil if
+// the stream stores them as published. The configuration is already
+// checked.
+func newIngestTransform(st *SubjectTransformConfig) *subjectTransform {
+	if st == nil {
+		return nil
+	}
+	tr, _ := newSubjectTransform(st.Source, st.Destination)
+	return tr
+}
+
+// Returns true if the messages published on the subject are stored.
+// Lock should be held.
+func (mset *Stream) ingests(subject string) bool {
+	if len(mset.config.IngestFilters) == 0 {
+		return true
+	}
+	for _, filter := range mset.config.IngestFilters {
+		if subjectIsSubsetMatch(subject, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the transform of the republished messages, nil if the stream
+// does not republish. The configuration is already checked.
+func newRePublish(rp *RePublish) *subjectTransform {
+	if rp == nil {
+		return nil
+	}
+	tr, _ := newSubjectTransform(rp.Source, rp.Destination)
+	return tr
+}
+
+// Republishes the stored message if its subject matches the source of
+// the transform.
+func (jsa *jsAccount) republish(rpub *subjectTransform, cfg *StreamConfig, subject string, hdr, msg []byte, seq uint64, ts int64) {
+	if rpub == nil {
+		return
+	}
+	dest, ok := rpub.transform(subject)
+	if !ok {
+		return
+	}
+	lines := fmt.Sprintf("%s: %s\r\n%s: %d\r\n%s: %s\r\n%s: %s\r\n",
+		JSStream, cfg.Name, JSSequence, seq, JSTimeStamp, time.Unix(0, ts).UTC().Format(time.RFC3339Nano), JSSubject, subject)
+	if cfg.RePublish.HeadersOnly {
+		lines += fmt.Sprintf("%s: %d\r\n", JSMsgSize, len(msg))
+		msg = nil
+	}
+	jsa.outq.send(&jsPubMsg{subj: dest, hdr: addHeaders(hdr, lines), msg: msg})
+}
+
+// The status line starting a header block.
+const hdrLine = "NATS/1.0\r\n"
+
+// Returns the value of the header in the header block of a message, or
+// nil if the block has not that header. Names are case insensitive, the
+// value is a slice of the block.
+func getHeader(key string, hdr []byte) []byte {
+	// Headers follow the status line, which may carry a status.
+	i := bytes.Index(hdr, []byte(_CRLF_))
+	if i < 0 {
+		return nil
+	}
+	for _, line := range bytes.Split(hdr[i+2:], []byte(_CRLF_)) {
+		i := bytes.IndexByte(line, ':')
+		if i > 0 && bytes.EqualFold(bytes.TrimSpace(line[:i]), []byte(key)) {
+			return bytes.TrimSpace(line[i+1:])
+		}
+	}
+	return nil
+}
+
+// Adds the header to the header block, creating the block if empty.
+func setHeader(hdr []byte, key, value string) []byte {
+	return addHeaders(hdr, fmt.Sprintf("%s: %s\r\n", key, value))
+}
+
+// Adds the header lines to the header block. A new block is created if
+// there is none or it is not terminated.
+func addHeaders(hdr []byte, lines string) []byte {
+	if bytes.HasSuffix(hdr, []byte("\r\n\r\n")) {
+		nhdr := make([]byte, 0, len(hdr)+len(lines))
+		nhdr = append(nhdr, hdr[:len(hdr)-2]...)
+		nhdr = append(nhdr, lines...)
+		return append(nhdr, _CRLF_...)
+	}
+	nhdr := make([]byte, 0, len(hdrLine)+len(lines)+2)
+	nhdr = append(nhdr, hdrLine...)
+	nhdr = append(nhdr, lines...)
+	return append(nhdr, _CRLF_...)
+}
+
+// Returns the id of the message, if any.
+func getMsgId(hdr []byte) string {
+	return string(getHeader(JSMsgId, hdr))
+}
+
+// Returns the TTL of the message, or 0 if it has none.
+func getMsgTTL(hdr []byte) (time.Duration, error) {
+	v := getHeader(JSMsgTTL, hdr)
+	if v == nil {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(string(v))
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid message TTL %q", v)
+	}
+	return ttl, nil
+}
+
+// Returns the time, in unix nanoseconds, before which the message stored
+// at the given time is not delivered, or 0 if it is not delayed. The
+// headers of the message take precedence over the delay of the stream.
+func getMsgDeliverAt(hdr []byte, stored time.Time, delay time.Duration) (int64, error) {
+	if v := getHeader(JSMsgDeliverAt, hdr); v != nil {
+		t, err := time.Parse(time.RFC3339Nano, string(v))
+		if err != nil {
+			return 0, fmt.Errorf("invalid message delivery time %q", v)
+		}
+		return t.UnixNano(), nil
+	}
+	if v := getHeader(JSMsgDelay, hdr); v != nil {
+		d, err := time.ParseDuration(string(v))
+		if err != nil || d < 0 {
+			return 0, fmt.Errorf("invalid message delay %q", v)
+		}
+		delay = d
+	}
+	if delay <= 0 {
+		return 0, nil
+	}
+	return stored.Add(delay).UnixNano(), nil
+}
+
+// Removes the message once it expires.
+func (mset *Stream) trackMsgTTL(seq uint64, expires int64) {
+	mset.ttlMu.Lock()
+	defer mset.ttlMu.Unlock()
+	i := sort.Search(len(mset.ttls), func(i int) bool { return mset.ttls[i].expires > expires })
+	mset.ttls = append(mset.ttls, msgTTL{})
+	copy(mset.ttls[i+1:], mset.ttls[i:])
+	mset.ttls[i] = msgTTL{seq, expires}
+	if i != 0 {
+		return
+	}
+	next := time.Duration(expires - time.Now().UnixNano())
+	if mset.ttltmr == nil {
+		mset.ttltmr = time.AfterFunc(next, mset.expireMsgTTLs)
+	} else {
+		mset.ttltmr.Reset(next)
+	}
+}
+
+// Removes the expired messages. The leader of a replicated stream
+// removes them on all members.
+func (mset *Stream) expireMsgTTLs() {
+	mset.mu.RLock()
+	store, closed, isLeader := mset.store, mset.closed, mset.node == nil || mset.leader
+	mset.mu.RUnlock()
+	if closed {
+		return
+	}
+
+	mset.ttlMu.Lock()
+	if mset.ttltmr == nil {
+		mset.ttlMu.Unlock()
+		return
+	}
+	if !isLeader {
+		// Kept in case this server becomes the leader.
+		mset.ttltmr.Reset(msgTTLFollowerInterval)
+		mset.ttlMu.Unlock()
+		return
+	}
+	now := time.Now().UnixNano()
+	var expired []uint64
+	for len(mset.ttls) > 0 && mset.ttls[0].expires <= now {
+		expired = append(expired, mset.ttls[0].seq)
+		mset.ttls = mset.ttls[1:]
+	}
+	if len(mset.ttls) > 0 {
+		mset.ttltmr.Reset(time.Duration(mset.ttls[0].expires - now))
+	} else {
+		mset.ttltmr = nil
+	}
+	mset.ttlMu.Unlock()
+
+	for _, seq := range expired {
+		mset.removeStoredMsg(store, seq)
+	}
+}
+
+// Tracks the expiration of the stored messages with a TTL, after the
+// stream is recovered.
+func (mset *Stream) rebuildMsgTTLs() {
+	mset.mu.RLock()
+	store, allow := mset.store, mset.config.AllowMsgTTL
+	mset.mu.RUnlock()
+	if !allow {
+		return
+	}
+	state := store.State()
+	for seq := state.FirstSeq; seq <= state.LastSeq && state.Msgs > 0; seq++ {
+		sm, err := store.LoadMsg(seq)
+		if err != nil {
+			continue
+		}
+		if ttl, _ := getMsgTTL(sm.Header); ttl > 0 {
+			mset.trackMsgTTL(seq, sm.Time.UnixNano()+int64(ttl))
+		}
+	}
+}
+
+// Returns the entry of the message id if it is within the duplicate
+// window. Lock ddMu should be held.
+func (mset *Stream) checkMsgId(id string) *ddentry {
+	dde := mset.ddmap[id]
+	if dde == nil {
+		return nil
+	}
+	mset.mu.RLock()
+	window := int64(mset.config.Duplicates)
+	mset.mu.RUnlock()
+	if time.Now().UnixNano()-dde.ts > window {
+		return nil
+	}
+	return dde
+}
+
+// Tracks the id of a stored message until the duplicate window expires.
+// Lock ddMu should be held.
+func (mset *Stream) storeMsgId(dde *ddentry) {
+	if mset.ddmap == nil {
+		mset.ddmap = make(map[string]*ddentry)
+	}
+	mset.ddmap[dde.id] = dde
+	mset.ddarr = append(mset.ddarr, dde)
+	if mset.ddtmr == nil {
+		mset.mu.RLock()
+		window := mset.config.Duplicates
+		mset.mu.RUnlock()
+		mset.ddtmr = time.AfterFunc(window, mset.purgeMsgIds)
+	}
+}
+
+// Removes the ids whose duplicate window expired.
+func (mset *Stream) purgeMsgIds() {
+	mset.mu.RLock()
+	window := int64(mset.config.Duplicates)
+	mset.mu.RUnlock()
+
+	mset.ddMu.Lock()
+	defer mset.ddMu.Unlock()
+	if mset.ddtmr == nil {
+		return
+	}
+	now := time.Now().UnixNano()
+	for ; mset.ddindex < len(mset.ddarr); mset.ddindex++ {
+		dde := mset.ddarr[mset.ddindex]
+		if now-dde.ts < window {
+			break
+		}
+		// The id may have been stored again since.
+		if mset.ddmap[dde.id] == dde {
+			delete(mset.ddmap, dde.id)
+		}
+		mset.ddarr[mset.ddindex] = nil
+	}
+	// Release the space of the removed entries.
+	if mset.ddindex > len(mset.ddarr)/2 {
+		mset.ddarr = append([]*ddentry(nil), mset.ddarr[mset.ddindex:]...)
+		mset.ddindex = 0
+	}
+	if mset.ddindex < len(mset.ddarr) {
+		next := mset.ddarr[mset.ddindex].ts + window - now
+		mset.ddtmr.Reset(time.Duration(next))
+	} else {
+		mset.ddtmr = nil
+	}
+}
+
+// Tracks the ids of the stored messages still within the duplicate
+// window, after the stream is recovered.
+func (mset *Stream) rebuildDedupe() {
+	mset.mu.RLock()
+	store, window := mset.store, int64(mset.config.Duplicates)
+	mset.mu.RUnlock()
+
+	state := store.State()
+	if state.Msgs == 0 {
+		return
+	}
+	cutoff := time.Now().UnixNano() - window
+	var ddarr []*ddentry
+	for seq := state.LastSeq; seq >= state.FirstSeq && seq > 0; seq-- {
+		sm, err := store.LoadMsg(seq)
+		if err == ErrStoreMsgNotFound {
+			continue
+		}
+		if err != nil || sm.Time.UnixNano() < cutoff {
+			break
+		}
+		if id := getMsgId(sm.Header); id != _EMPTY_ {
+			ddarr = append(ddarr, &ddentry{id, seq, sm.Time.UnixNano()})
+		}
+	}
+	mset.ddMu.Lock()
+	defer mset.ddMu.Unlock()
+	for i := len(ddarr) - 1; i >= 0; i-- {
+		mset.storeMsgId(ddarr[i])
+	}
+}
+
+// ReplayPolicy determines how messages are replayed.
+type ReplayPolicy int
+
+const (
+	// ReplayInstant will replay messages as fast as possible.
+	ReplayInstant ReplayPolicy = iota
+	// ReplayOriginal will maintain the same timing as the messages
+	// were received.
+	ReplayOriginal
+)
+
+const (
+	replayInstantString  = "instant"
+	replayOriginalString = "original"
+)
+
+func (rp ReplayPolicy) String() string {
+	switch rp {
+	case ReplayInstant:
+		return "Instant"
+	case ReplayOriginal:
+		return "Original"
+	default:
+		return "Unknown Replay Policy"
+	}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (rp ReplayPolicy) MarshalJSON() ([]byte, error) {
+	switch rp {
+	case ReplayInstant:
+		return json.Marshal(replayInstantString)
+	case ReplayOriginal:
+		return json.Marshal(replayOriginalString)
+	default:
+		return nil, fmt.Errorf("can not marshal %v", rp)
+	}
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (rp *ReplayPolicy) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case jsonString(replayInstantString):
+		*rp = ReplayInstant
+	case jsonString(replayOriginalString):
+		*rp = ReplayOriginal
+	default:
+		return fmt.Errorf("can not unmarshal %q", data)
+	}
+	return nil
+}
+
+// Maximum number of replayed messages queued for delivery before
+// the replay waits.
+const maxReplayPending = 4096
+
+// GetLastMsg returns the last message stored on the given subject.
+func (mset *Stream) GetLastMsg(subj string) (*StoredMsg, error) {
+	mset.mu.RLock()
+	store := mset.store
+	mset.mu.RUnlock()
+	if store == nil {
+		return nil, ErrStoreClosed
+	}
+	return store.LoadLastMsg(subj)
+}
+
+func (mset *Stream) isClosed() bool {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return mset.closed
+}
+
+// Validates the replay request and returns the starting sequence, the
+// number of messages to deliver and the sequence of the last one.
+func (mset *Stream) replayRange(req *JSApiStreamReplayRequest) (sseq, num, last uint64, err error) {
+	if req.DeliverSubject == _EMPTY_ || !IsValidLiteralSubject(req.DeliverSubject) {
+		return 0, 0, 0, fmt.Errorf("replay requires a valid deliver subject")
+	}
+	if req.StartSeq > 0 && req.StartTime != nil {
+		return 0, 0, 0, fmt.Errorf("replay can not have both a start sequence and time")
+	}
+	if req.FilterSubject != _EMPTY_ && !IsValidSubject(req.FilterSubject) {
+		return 0, 0, 0, fmt.Errorf("invalid filter subject %q", req.FilterSubject)
+	}
+	mset.mu.RLock()
+	store, closed := mset.store, mset.closed
+	mset.mu.RUnlock()
+	if closed || store == nil {
+		return 0, 0, 0, ErrStoreClosed
+	}
+	switch {
+	case req.StartTime != nil:
+		sseq = store.GetSeqFromTime(*req.StartTime)
+	case req.StartSeq > 0:
+		sseq = req.StartSeq
+	default:
+		sseq = store.State().FirstSeq
+	}
+	num, last = store.NumPending(sseq, req.FilterSubject)
+	return sseq, num, last, nil
+}
+
+// Starts delivering the messages from sseq to last to the deliver
+// subject of the request.
+func (mset *Stream) startReplay(req *JSApiStreamReplayRequest, sseq, last uint64) {
+	s := mset.jsa.js.srv
+	dsubj, filter, rp := req.DeliverSubject, req.FilterSubject, req.ReplayPolicy
+	s.startGoRoutine(func() { mset.replay(dsubj, filter, rp, sseq, last) })
+}
+
+func (mset *Stream) replay(dsubj, filter string, rp ReplayPolicy, sseq, last uint64) {
+	s := mset.jsa.js.srv
+	defer s.grWG.Done()
+
+	q, name := mset.jsa.outq, mset.Name()
+	wait := func(d time.Duration) bool {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			return true
+		case <-q.quit:
+		case <-s.quitCh:
+		}
+		return false
+	}
+	var lts int64
+	for seq := sseq; seq <= last; seq++ {
+		if mset.isClosed() {
+			return
+		}
+		sm, err := mset.GetMsg(seq)
+		if err == ErrStoreMsgNotFound {
+			continue
+		} else if err != nil {
+			return
+		}
+		if filter != _EMPTY_ && !matchLiteral(sm.Subject, filter) {
+			continue
+		}
+		ts := sm.Time.UnixNano()
+		if rp == ReplayOriginal && lts > 0 && ts > lts {
+			if !wait(time.Duration(ts - lts)) {
+				return
+			}
+		}
+		lts = ts
+		for q.len() > maxReplayPending {
+			if !wait(time.Millisecond) {
+				return
+			}
+		}
+		q.send(&jsPubMsg{subj: dsubj, dsubj: sm.Subject, reply: fmt.Sprintf(jsReplayReplyT, name, seq, ts), hdr: sm.Header, msg: sm.Data})
+	}
+}
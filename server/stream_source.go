@@ -0,0 +1,532 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+// StreamSource is a stream whose messages are mirrored or sourced into
+// another stream.
+type StreamSource struct {
+	Name          string          `json:"name"`
+	OptStartSeq   uint64          `json:"opt_start_seq,omitempty"`
+	OptStartTime  *time.Time      `json:"opt_start_time,omitempty"`
+	FilterSubject string          `json:"filter_subject,omitempty"`
+	External      *ExternalStream `json:"external,omitempty"`
+}
+
+// ExternalStream is a stream of another account or domain, reached through
+// the prefixes its API and the deliveries are imported with.
+type ExternalStream struct {
+	ApiPrefix     string `json:"api"`
+	DeliverPrefix string `json:"deliver"`
+}
+
+// StreamSourceInfo shows the progress of a mirror or source.
+type StreamSourceInfo struct {
+	Name     string          `json:"name"`
+	External *ExternalStream `json:"external,omitempty"`
+	// Last sequence of the origin stream stored.
+	Seq uint64 `json:"seq"`
+	// Time since the last message was received, -1 if none was.
+	Active time.Duration `json:"active"`
+}
+
+// JSStreamSource is the header of the messages stored from a source, with
+// the source and the sequence of the message in the origin stream.
+const JSStreamSource = "Nats-Stream-Source"
+
+const (
+	// Prefix of the deliver subjects of the consumers of local sources.
+	jsSourceDeliverPrefix = "$JS.S"
+	// Prefix of the inboxes of the requests to the origin streams.
+	jsSourceReplyPrefix = "$JS.SR"
+)
+
+var (
+	// How long to wait for the origin stream to answer a request.
+	sourceRequestTimeout = 2 * time.Second
+	// Interval at which idle sources check their consumer and retry
+	// after failures.
+	sourceHealthInterval = 5 * time.Second
+)
+
+// A running mirror or source of a stream.
+type sourceInfo struct {
+	key    string
+	cfg    StreamSource
+	mirror bool
+	qch    chan struct{}
+
+	// Protected by the source lock of the stream.
+	sub   *subscription
+	rsub  *subscription
+	rch   chan []byte
+	dsubj string
+	gen   uint64
+	cname string
+	sseq  uint64
+	last  time.Time
+}
+
+// Checks the mirror and sources of the configuration.
+func checkStreamSources(cfg *StreamConfig) error {
+	if cfg.Mirror != nil && len(cfg.Sources) > 0 {
+		return fmt.Errorf("stream mirror and sources are mutually exclusive")
+	}
+	if cfg.Mirror != nil && len(cfg.Subjects) > 0 {
+		return fmt.Errorf("stream mirror can not have subjects")
+	}
+	keys := make(map[string]struct{})
+	for _, ss := range append(cfg.Sources, cfg.Mirror) {
+		if ss == nil {
+			continue
+		}
+		if !isValidName(ss.Name) {
+			return fmt.Errorf("stream source name %q is invalid", ss.Name)
+		}
+		if ss.External == nil && ss.Name == cfg.Name {
+			return fmt.Errorf("stream can not source itself")
+		}
+		if ss.FilterSubject != _EMPTY_ && !IsValidSubject(ss.FilterSubject) {
+			return fmt.Errorf("stream source filter subject %q is invalid", ss.FilterSubject)
+		}
+		if ext := ss.External; ext != nil {
+			if ext.ApiPrefix != _EMPTY_ && !IsValidLiteralSubject(ext.ApiPrefix) {
+				return fmt.Errorf("stream source api prefix %q is invalid", ext.ApiPrefix)
+			}
+			if ext.DeliverPrefix != _EMPTY_ && !IsValidLiteralSubject(ext.DeliverPrefix) {
+				return fmt.Errorf("stream source deliver prefix %q is invalid", ext.DeliverPrefix)
+			}
+		}
+		key := sourceKey(ss)
+		if _, ok := keys[key]; ok {
+			return fmt.Errorf("duplicate stream source %q", key)
+		}
+		keys[key] = struct{}{}
+	}
+	return nil
+}
+
+// Identifies the source in the headers of the sourced messages.
+func sourceKey(ss *StreamSource) string {
+	if ss.External == nil || ss.External.ApiPrefix == _EMPTY_ {
+		return ss.Name
+	}
+	return ss.Name + ":" + ss.External.ApiPrefix
+}
+
+// Returns true if both have the same mirror and sources.
+func sameSources(a, b *StreamConfig) bool {
+	ab, _ := json.Marshal([]interface{}{a.Mirror, a.Sources})
+	bb, _ := json.Marshal([]interface{}{b.Mirror, b.Sources})
+	return bytes.Equal(ab, bb)
+}
+
+// Starts the mirror and sources of the stream, on the leader only. They
+// stop when the leadership is lost.
+func (mset *Stream) startSources(lqch chan struct{}) {
+	mset.mu.RLock()
+	cfg := mset.config
+	mset.mu.RUnlock()
+	if cfg.Mirror == nil && len(cfg.Sources) == 0 {
+		return
+	}
+
+	var sources []*sourceInfo
+	if cfg.Mirror != nil {
+		sources = append(sources, &sourceInfo{key: sourceKey(cfg.Mirror), cfg: *cfg.Mirror, mirror: true})
+	} else {
+		for _, ss := range cfg.Sources {
+			sources = append(sources, &sourceInfo{key: sourceKey(ss), cfg: *ss})
+		}
+	}
+	last := mset.sourcedSeqs(cfg.Mirror != nil)
+
+	s := mset.jsa.js.srv
+	mset.srcMu.Lock()
+	mset.sources = make(map[string]*sourceInfo, len(sources))
+	for _, si := range sources {
+		si.qch = make(chan struct{})
+		si.sseq = last[si.key]
+		mset.sources[si.key] = si
+		si := si
+		s.startGoRoutine(func() { mset.runSource(si, lqch) })
+	}
+	mset.srcMu.Unlock()
+}
+
+// Stops the mirror and sources of the stream, removing their consumers.
+func (mset *Stream) stopSources() {
+	mset.srcMu.Lock()
+	sources := mset.sources
+	mset.sources = nil
+	mset.srcMu.Unlock()
+	for _, si := range sources {
+		close(si.qch)
+		mset.releaseSource(si)
+	}
+}
+
+// Returns the last sequence of each origin stream that was stored.
+func (mset *Stream) sourcedSeqs(mirror bool) map[string]uint64 {
+	mset.mu.RLock()
+	store, cfg := mset.store, mset.config
+	mset.mu.RUnlock()
+
+	state := store.State()
+	last := make(map[string]uint64)
+	// Mirrors keep the sequences of the origin stream.
+	if mirror {
+		last[sourceKey(cfg.Mirror)] = state.LastSeq
+		return last
+	}
+	for seq := state.LastSeq; seq >= state.FirstSeq && seq > 0 && len(last) < len(cfg.Sources); seq-- {
+		sm, err := store.LoadMsg(seq)
+		if err != nil {
+			continue
+		}
+		key, sseq := getSourceHeader(sm.Header)
+		if _, ok := last[key]; !ok && key != _EMPTY_ {
+			last[key] = sseq
+		}
+	}
+	return last
+}
+
+// Returns the source and the origin sequence from the headers of a
+// sourced message.
+func getSourceHeader(hdr []byte) (string, uint64) {
+	v := getHeader(JSStreamSource, hdr)
+	i := bytes.LastIndexByte(v, ' ')
+	if i <= 0 {
+		return _EMPTY_, 0
+	}
+	sseq, err := strconv.ParseUint(string(v[i+1:]), 10, 64)
+	if err != nil {
+		return _EMPTY_, 0
+	}
+	return string(v[:i]), sseq
+}
+
+// Adds the source header to the headers of the message.
+func setSourceHeader(hdr []byte, key string, sseq uint64) []byte {
+	return setHeader(hdr, JSStreamSource, fmt.Sprintf("%s %d", key, sseq))
+}
+
+// Returns the stream sequence and the timestamp from the reply subject of
+// a message delivered by a consumer.
+func sourcedMsgInfo(reply string) (uint64, int64) {
+	if !strings.HasPrefix(reply, jsAckPre) {
+		return 0, 0
+	}
+	sseq, _, _ := ackReplyInfo(reply)
+	ts, _ := strconv.ParseInt(reply[strings.LastIndexByte(reply, btsep)+1:], 10, 64)
+	return sseq, ts
+}
+
+// Returns the internal client of the mirrors and sources of the account
+// and its queue, created on first use.
+func (jsa *jsAccount) sourceClient() (*client, *jsOutQ) {
+	jsa.mu.Lock()
+	defer jsa.mu.Unlock()
+	if jsa.sclient == nil {
+		s := jsa.js.srv
+		c, q := s.createInternalJetStreamClient(jsa.account), newJSOutQ()
+		jsa.sclient, jsa.soutq = c, q
+		s.startGoRoutine(func() { s.jsInternalSendLoop(c, q) })
+	}
+	return jsa.sclient, jsa.soutq
+}
+
+// Subscribes the internal client of the mirrors and sources. Subscribing
+// is serialized since the sources run concurrently.
+func (jsa *jsAccount) subscribeSource(subject string, cb msgHandler) (*subscription, error) {
+	c, _ := jsa.sourceClient()
+	jsa.mu.Lock()
+	defer jsa.mu.Unlock()
+	return c.subscribeInternal(subject, jsa.nextSid(), cb)
+}
+
+// Keeps a consumer on the origin stream delivering to the stream,
+// recreating it when it is gone.
+func (mset *Stream) runSource(si *sourceInfo, lqch chan struct{}) {
+	s := mset.jsa.js.srv
+	defer s.grWG.Done()
+
+	t := time.NewTicker(sourceHealthInterval)
+	defer t.Stop()
+	active := mset.setupSource(si)
+	for {
+		select {
+		case <-t.C:
+			mset.srcMu.Lock()
+			idle := time.Since(si.last) > sourceHealthInterval
+			mset.srcMu.Unlock()
+			if !active || (idle && !mset.checkSource(si)) {
+				active = mset.setupSource(si)
+			}
+		case <-si.qch:
+			return
+		case <-lqch:
+			mset.srcMu.Lock()
+			if mset.sources[si.key] == si {
+				delete(mset.sources, si.key)
+			}
+			mset.srcMu.Unlock()
+			mset.releaseSource(si)
+			return
+		case <-s.quitCh:
+			return
+		}
+	}
+}
+
+// Returns the API prefix of the origin stream.
+func (si *sourceInfo) apiPrefix() string {
+	if si.cfg.External != nil && si.cfg.External.ApiPrefix != _EMPTY_ {
+		return si.cfg.External.ApiPrefix
+	}
+	return JSApiPrefix
+}
+
+// Sends a request to the API of the origin stream and waits for the
+// response, nil if none arrived in time.
+func (mset *Stream) sourceRequest(si *sourceInfo, subj string, req []byte) []byte {
+	jsa := mset.jsa
+	_, q := jsa.sourceClient()
+	mset.srcMu.Lock()
+	if si.rsub == nil {
+		rch := make(chan []byte, 1)
+		rsub, err := jsa.subscribeSource(jsSourceReplyPrefix+"."+nuid.Next(), func(_ *subscription, _, _ string, _, msg []byte) {
+			select {
+			case rch <- append([]byte(nil), msg...):
+			default:
+			}
+		})
+		if err != nil {
+			mset.srcMu.Unlock()
+			return nil
+		}
+		si.rsub, si.rch = rsub, rch
+	}
+	reply, rch := string(si.rsub.subject), si.rch
+	mset.srcMu.Unlock()
+
+	// Drop a late response to a previous request.
+	select {
+	case <-rch:
+	default:
+	}
+	q.send(&jsPubMsg{subj: subj, reply: reply, msg: req})
+	select {
+	case resp := <-rch:
+		return resp
+	case <-time.After(sourceRequestTimeout):
+		return nil
+	case <-si.qch:
+		return nil
+	}
+}
+
+// Creates the consumer on the origin stream, starting after the last
+// message stored. Returns false if it failed.
+func (mset *Stream) setupSource(si *sourceInfo) bool {
+	jsa := mset.jsa
+	mset.cancelSource(si)
+
+	mset.srcMu.Lock()
+	dprefix := jsSourceDeliverPrefix
+	if ext := si.cfg.External; ext != nil && ext.DeliverPrefix != _EMPTY_ {
+		dprefix = ext.DeliverPrefix
+	}
+	si.dsubj = dprefix + "." + nuid.Next()
+	si.gen++
+	gen := si.gen
+	sub, err := jsa.subscribeSource(si.dsubj, func(_ *subscription, subject, reply string, hdr, msg []byte) {
+		mset.processSourceMsg(si, gen, subject, reply, hdr, msg)
+	})
+	if err != nil {
+		mset.srcMu.Unlock()
+		return false
+	}
+	si.sub = sub
+	cfg := ConsumerConfig{DeliverSubject: si.dsubj, AckPolicy: AckNone, FilterSubject: si.cfg.FilterSubject}
+	switch {
+	case si.sseq > 0:
+		cfg.DeliverPolicy, cfg.OptStartSeq = DeliverByStartSequence, si.sseq+1
+	case si.cfg.OptStartSeq > 0:
+		cfg.DeliverPolicy, cfg.OptStartSeq = DeliverByStartSequence, si.cfg.OptStartSeq
+	case si.cfg.OptStartTime != nil:
+		cfg.DeliverPolicy, cfg.OptStartTime = DeliverByStartTime, si.cfg.OptStartTime
+	}
+	mset.srcMu.Unlock()
+
+	req, _ := json.Marshal(&CreateConsumerRequest{Stream: si.cfg.Name, Config: cfg})
+	subj := fmt.Sprintf("%s.CONSUMER.CREATE.%s", si.apiPrefix(), si.cfg.Name)
+	b := mset.sourceRequest(si, subj, req)
+	var resp JSApiConsumerCreateResponse
+	if b == nil || json.Unmarshal(b, &resp) != nil || resp.Error != nil || resp.ConsumerInfo == nil {
+		if resp.Error != nil {
+			jsa.js.srv.Debugf("JetStream stream %q failed to create consumer on source %q: %s",
+				mset.Name(), si.key, resp.Error.Description)
+		}
+		mset.cancelSource(si)
+		return false
+	}
+	mset.srcMu.Lock()
+	si.cname = resp.Name
+	mset.srcMu.Unlock()
+	return true
+}
+
+// Returns true if the consumer on the origin stream still exists.
+func (mset *Stream) checkSource(si *sourceInfo) bool {
+	mset.srcMu.Lock()
+	cname := si.cname
+	mset.srcMu.Unlock()
+	if cname == _EMPTY_ {
+		return false
+	}
+	subj := fmt.Sprintf("%s.CONSUMER.INFO.%s.%s", si.apiPrefix(), si.cfg.Name, cname)
+	b := mset.sourceRequest(si, subj, nil)
+	var resp JSApiConsumerInfoResponse
+	return b != nil && json.Unmarshal(b, &resp) == nil && resp.Error == nil
+}
+
+// Removes the subscription and the consumer on the origin stream.
+func (mset *Stream) cancelSource(si *sourceInfo) {
+	mset.srcMu.Lock()
+	sub, cname := si.sub, si.cname
+	si.sub, si.cname = nil, _EMPTY_
+	mset.srcMu.Unlock()
+	c, q := mset.jsa.sourceClient()
+	if sub != nil {
+		c.unsubscribe(c.acc, sub, true)
+	}
+	if cname != _EMPTY_ {
+		subj := fmt.Sprintf("%s.CONSUMER.DELETE.%s.%s", si.apiPrefix(), si.cfg.Name, cname)
+		q.send(&jsPubMsg{subj: subj})
+	}
+}
+
+// Cancels the source and removes the inbox of its requests.
+func (mset *Stream) releaseSource(si *sourceInfo) {
+	mset.cancelSource(si)
+	mset.srcMu.Lock()
+	rsub := si.rsub
+	si.rsub = nil
+	mset.srcMu.Unlock()
+	if rsub != nil {
+		c, _ := mset.jsa.sourceClient()
+		c.unsubscribe(c.acc, rsub, true)
+	}
+}
+
+// Stores a message delivered from the origin stream. Messages already
+// stored are skipped, they are delivered again when the consumer is
+// recreated.
+func (mset *Stream) processSourceMsg(si *sourceInfo, gen uint64, subject, reply string, hdr, msg []byte) {
+	sseq, ts := sourcedMsgInfo(reply)
+	if sseq == 0 {
+		return
+	}
+	mset.srcMu.Lock()
+	defer mset.srcMu.Unlock()
+	// Late deliveries of a previous consumer are dropped.
+	if si.sub == nil || si.gen != gen || sseq <= si.sseq {
+		return
+	}
+	if si.mirror {
+		if err := mset.storeMirrorMsg(subject, hdr, msg, sseq, ts); err != nil {
+			return
+		}
+	} else {
+		mset.processInboundMsg(nil, subject, _EMPTY_, setSourceHeader(hdr, si.key, sseq), msg)
+	}
+	si.sseq, si.last = sseq, time.Now()
+}
+
+// Stores a mirrored message with its sequence in the origin stream.
+func (mset *Stream) storeMirrorMsg(subject string, hdr, msg []byte, seq uint64, ts int64) error {
+	mset.mu.RLock()
+	if mset.closed {
+		mset.mu.RUnlock()
+		return ErrStoreClosed
+	}
+	jsa, store, cfg, clustered, rpub := mset.jsa, mset.store, mset.config, mset.node != nil, mset.rpub
+	consumers := mset.getConsumers()
+	mset.mu.RUnlock()
+
+	if jsa.limitsExceeded(cfg.Storage) {
+		return ErrJetStreamResourcesExceeded
+	}
+	if clustered {
+		mset.clMu.Lock()
+		defer mset.clMu.Unlock()
+		if seq <= mset.clseq {
+			return ErrStoreSeqOutOfOrder
+		}
+		if err := mset.propose(&streamOp{Op: streamMsgOp, Subject: subject, Hdr: hdr, Data: msg, Seq: seq, Time: ts}); err != nil {
+			return err
+		}
+		mset.clseq = seq
+		return nil
+	}
+	if err := store.StoreRawMsg(subject, hdr, msg, seq, ts); err != nil {
+		if err != ErrStoreClosed && err != ErrStoreSeqOutOfOrder {
+			jsa.js.srv.Warnf("JetStream failed to store a mirrored msg on account %q stream %q: %v",
+				jsa.account.Name, cfg.Name, err)
+		}
+		return err
+	}
+	if ttl, _ := getMsgTTL(hdr); ttl > 0 {
+		mset.trackMsgTTL(seq, ts+int64(ttl))
+	}
+	jsa.republish(rpub, &cfg, subject, hdr, msg, seq, ts)
+	for _, o := range consumers {
+		o.signal()
+	}
+	return nil
+}
+
+// Returns the progress of the mirror and sources, on the leader.
+func (mset *Stream) sourcesInfo() (*StreamSourceInfo, []*StreamSourceInfo) {
+	mset.srcMu.Lock()
+	defer mset.srcMu.Unlock()
+	var mirror *StreamSourceInfo
+	var sources []*StreamSourceInfo
+	for _, si := range mset.sources {
+		ssi := &StreamSourceInfo{Name: si.cfg.Name, External: si.cfg.External, Seq: si.sseq, Active: -1}
+		if !si.last.IsZero() {
+			ssi.Active = time.Since(si.last)
+		}
+		if si.mirror {
+			mirror = ssi
+		} else {
+			sources = append(sources, ssi)
+		}
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Name < sources[j].Name })
+	return mirror, sources
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Maps the subjects matching a source to a destination. The destination
+// references the partial wildcards of the source by position, starting
+// at 1, with $1 or {{wildcard(1)}}, and ends with '>' to take the tokens
+// matched by the full wildcard of the source.
+type subjectTransform struct {
+	src string
+	// Position of the partial wildcards in the source.
+	pwcs []int
+	// Destination tokens, with the source token they take for the
+	// wildcard references, -1 for literals.
+	dtoks []string
+	drefs []int
+	fwc   bool
+}
+
+func newSubjectTransform(src, dest string) (*subjectTransform, error) {
+	if src == _EMPTY_ {
+		src = string(fwc)
+	}
+	if !IsValidSubject(src) {
+		return nil, fmt.Errorf("invalid transform source %q", src)
+	}
+	if !IsValidSubject(dest) {
+		return nil, fmt.Errorf("invalid transform destination %q", dest)
+	}
+	tr := &subjectTransform{src: src}
+	stoks := strings.Split(src, tsep)
+	for i, tok := range stoks {
+		if len(tok) == 1 && tok[0] == pwc {
+			tr.pwcs = append(tr.pwcs, i)
+		}
+	}
+	sfwc := stoks[len(stoks)-1] == string(fwc)
+
+	dtoks := strings.Split(dest, tsep)
+	for i, tok := range dtoks {
+		ref := -1
+		switch {
+		case tok == string(fwc):
+			if !sfwc || i != len(dtoks)-1 {
+				return nil, fmt.Errorf("transform destination %q can only end with the full wildcard of the source", dest)
+			}
+			tr.fwc = true
+			continue
+		case tok == string(pwc):
+			return nil, fmt.Errorf("transform destination %q can not contain partial wildcards", dest)
+		case len(tok) > 1 && tok[0] == '$' && isDigits(tok[1:]):
+			ref, _ = strconv.Atoi(tok[1:])
+		case strings.HasPrefix(tok, "{{wildcard(") && strings.HasSuffix(tok, ")}}"):
+			ref, _ = strconv.Atoi(tok[len("{{wildcard(") : len(tok)-len(")}}")])
+		default:
+			tr.dtoks = append(tr.dtoks, tok)
+			tr.drefs = append(tr.drefs, -1)
+			continue
+		}
+		if ref < 1 || ref > len(tr.pwcs) {
+			return nil, fmt.Errorf("transform destination %q references wildcard %q not in the source", dest, dtoks[i])
+		}
+		tr.dtoks = append(tr.dtoks, _EMPTY_)
+		tr.drefs = append(tr.drefs, tr.pwcs[ref-1])
+	}
+	return tr, nil
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the destination of the subject, false if the subject does not
+// match the source or the transform is nil.
+func (tr *subjectTransform) transform(subject string) (string, bool) {
+	if tr == nil || !matchLiteral(subject, tr.src) {
+		return _EMPTY_, false
+	}
+	stoks := strings.Split(subject, tsep)
+	var b strings.Builder
+	for i, tok := range tr.dtoks {
+		if i > 0 {
+			b.WriteByte(btsep)
+		}
+		if ref := tr.drefs[i]; ref >= 0 {
+			tok = stoks[ref]
+		}
+		b.WriteString(tok)
+	}
+	if tr.fwc {
+		// The full wildcard is the last token of the source.
+		n := strings.Count(tr.src, tsep)
+		if b.Len() > 0 {
+			b.WriteByte(btsep)
+		}
+		b.WriteString(strings.Join(stoks[n:], tsep))
+	}
+	return b.String(), true
+}
+
+// Returns the subject matching all the destinations of the transform.
+func (tr *subjectTransform) pattern() string {
+	toks := make([]string, 0, len(tr.dtoks)+1)
+	for i, tok := range tr.dtoks {
+		if tr.drefs[i] >= 0 {
+			tok = string(pwc)
+		}
+		toks = append(toks, tok)
+	}
+	if tr.fwc {
+		toks = append(toks, string(fwc))
+	}
+	return strings.Join(toks, tsep)
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+)
+
+func TestSubjectTransform(t *testing.T) {
+	for _, test := range []struct {
+		src, dest, subject, expected string
+	}{
+		{"", "repub", "foo.bar", "repub"},
+		{"", "repub.>", "foo.bar", "repub.foo.bar"},
+		{"orders.*.*", "new.$2.$1", "orders.1.eu", "new.eu.1"},
+		{"orders.*.*", "new.{{wildcard(2)}}.{{wildcard(1)}}", "orders.1.eu", "new.eu.1"},
+		{"orders.*.>", "all.$1.>", "orders.1.eu.west", "all.1.eu.west"},
+		{"orders.*", "$KV.$1", "orders.1", "$KV.1"},
+		{"orders.*", "other", "invoices.1", _EMPTY_},
+	} {
+		tr, err := newSubjectTransform(test.src, test.dest)
+		if err != nil {
+			t.Fatalf("Unexpected error for %q -> %q: %v", test.src, test.dest, err)
+		}
+		dest, ok := tr.transform(test.subject)
+		if ok != (test.expected != _EMPTY_) || dest != test.expected {
+			t.Fatalf("Expected %q to map to %q, got %q", test.subject, test.expected, dest)
+		}
+	}
+
+	for _, test := range []struct {
+		src, dest string
+	}{
+		{"orders..x", "foo"},
+		{"orders.*", "foo.*"},
+		{"orders.*", "foo.$2"},
+		{"orders.*", "foo.{{wildcard(0)}}"},
+		{"orders.*", "foo.>"},
+		{"orders.>", "foo.>.bar"},
+	} {
+		if _, err := newSubjectTransform(test.src, test.dest); err == nil {
+			t.Fatalf("Expected an error for %q -> %q", test.src, test.dest)
+		}
+	}
+
+	tr, _ := newSubjectTransform("orders.*.>", "new.$1.x.>")
+	if p := tr.pattern(); p != "new.*.x.>" {
+		t.Fatalf("Unexpected pattern %q", p)
+	}
+}
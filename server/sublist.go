@@ -49,6 +49,9 @@ const (
 	slCacheSweep = 512
 	// plistMin is our lower bounds to create a fast plist for Match.
 	plistMin = 256
+	// slShards is the number of shards of the subscriptions on subjects
+	// with a literal first token.
+	slShards = 16
 )
 
 // SublistResult is a result structure better optimized for queue subs.
@@ -58,25 +61,42 @@ type SublistResult struct {
 }
 
 // A Sublist stores and efficiently retrieves subscriptions.
+// Subscriptions are sharded by the first token of their subject, each shard
+// having its own lock, so that inserts and removes only block the matches
+// of subjects of the same shard. Subscriptions on subjects starting with a
+// wildcard are in their own shard, which is part of all matches.
 type Sublist struct {
-	sync.RWMutex
 	genid     uint64
 	matches   uint64
 	cacheHits uint64
+	evicts    uint64
 	inserts   uint64
 	removes   uint64
-	root      *level
 	cache     *sync.Map
 	cacheNum  int32
 	ccSweep   int32
 	count     uint32
+	// Serializes the updates of the cache entries by the shards.
+	cmu    sync.Mutex
+	shards [slShards]slShard
+	wc     slShard
 }
 
-// A node contains subscriptions and a pointer to the next level.
+// A slShard is the part of the trie for some first tokens.
+type slShard struct {
+	sync.RWMutex
+	root *level
+}
+
+// A node contains subscriptions and a pointer to the next level. To save
+// memory with many subjects, a single plain subscription is kept in psub,
+// the maps are only created when needed, and the last node of a subject
+// has no next level.
 type node struct {
 	next  *level
-	psubs map[*subscription]*subscription
-	qsubs map[string](map[*subscription]*subscription)
+	psub  *subscription
+	psubs map[*subscription]struct{}
+	qsubs map[string](map[*subscription]struct{})
 	plist []*subscription
 }
 
@@ -89,7 +109,60 @@ type level struct {
 
 // Create a new default node.
 func newNode() *node {
-	return &node{psubs: make(map[*subscription]*subscription)}
+	return &node{}
+}
+
+// numPsubs returns the number of plain subscriptions of the node.
+func (n *node) numPsubs() int {
+	if n.psub != nil {
+		return 1
+	}
+	return len(n.psubs)
+}
+
+// addPsub adds a plain subscription to the node, returning the number of
+// plain subscriptions.
+func (n *node) addPsub(sub *subscription) int {
+	if n.psubs == nil {
+		if n.psub == nil || n.psub == sub {
+			n.psub = sub
+			return 1
+		}
+		n.psubs = map[*subscription]struct{}{n.psub: {}}
+		n.psub = nil
+	}
+	n.psubs[sub] = struct{}{}
+	return len(n.psubs)
+}
+
+// removePsub removes a plain subscription from the node, returning whether
+// it was found.
+func (n *node) removePsub(sub *subscription) bool {
+	if n.psub != nil {
+		if n.psub != sub {
+			return false
+		}
+		n.psub = nil
+		return true
+	}
+	if _, found := n.psubs[sub]; !found {
+		return false
+	}
+	delete(n.psubs, sub)
+	if len(n.psubs) == 0 {
+		n.psubs = nil
+	}
+	return true
+}
+
+// psubsDo calls f for each plain subscription of the node.
+func (n *node) psubsDo(f func(sub *subscription)) {
+	if n.psub != nil {
+		f(n.psub)
+	}
+	for sub := range n.psubs {
+		f(sub)
+	}
 }
 
 // Create a new default level.
@@ -99,12 +172,48 @@ func newLevel() *level {
 
 // NewSublist will create a default sublist
 func NewSublist() *Sublist {
-	return &Sublist{root: newLevel(), cache: &sync.Map{}}
+	return &Sublist{cache: &sync.Map{}}
 }
 
 // NewSublistNoCache will create a default sublist without caching enabled.
 func NewSublistNoCache() *Sublist {
-	return &Sublist{root: newLevel(), cacheNum: slNoCache}
+	return &Sublist{cacheNum: slNoCache}
+}
+
+// shard returns the shard of the subscriptions on subjects with the given
+// first token.
+func (s *Sublist) shard(t string) *slShard {
+	if len(t) == 1 && (t[0] == pwc || t[0] == fwc) {
+		return &s.wc
+	}
+	// FNV-1a, inlined to not allocate.
+	h := uint32(2166136261)
+	for i := 0; i < len(t); i++ {
+		h ^= uint32(t[i])
+		h *= 16777619
+	}
+	return &s.shards[h%slShards]
+}
+
+// shardsDo calls f with each shard that has subscriptions, holding its
+// read lock or its write lock if exclusive is true.
+func (s *Sublist) shardsDo(exclusive bool, f func(sh *slShard)) {
+	do := func(sh *slShard) {
+		if exclusive {
+			sh.Lock()
+			defer sh.Unlock()
+		} else {
+			sh.RLock()
+			defer sh.RUnlock()
+		}
+		if sh.root != nil {
+			f(sh)
+		}
+	}
+	for i := range s.shards {
+		do(&s.shards[i])
+	}
+	do(&s.wc)
 }
 
 // CacheEnabled returns whether or not caching is enabled for this sublist.
@@ -112,6 +221,12 @@ func (s *Sublist) CacheEnabled() bool {
 	return atomic.LoadInt32(&s.cacheNum) != slNoCache
 }
 
+// copyString returns a copy of a token of a subject, so that the key of a
+// node does not hold on to the whole subject.
+func copyString(s string) string {
+	return string([]byte(s))
+}
+
 // Insert adds a subscription into the sublist
 func (s *Sublist) Insert(sub *subscription) error {
 	// copy the subject since we hold this and this might be part of a large byte slice.
@@ -127,18 +242,28 @@ func (s *Sublist) Insert(sub *subscription) error {
 	}
 	tokens = append(tokens, subject[start:])
 
-	s.Lock()
+	sh := s.shard(tokens[0])
+	sh.Lock()
+	if sh.root == nil {
+		sh.root = newLevel()
+	}
 
 	sfwc := false
-	l := s.root
+	l := sh.root
 	var n *node
 
-	for _, t := range tokens {
+	for i, t := range tokens {
 		lt := len(t)
 		if lt == 0 || sfwc {
-			s.Unlock()
+			sh.Unlock()
 			return ErrInvalidSubject
 		}
+		if i > 0 {
+			if n.next == nil {
+				n.next = newLevel()
+			}
+			l = n.next
+		}
 
 		if lt > 1 {
 			n = l.nodes[t]
@@ -156,7 +281,7 @@ func (s *Sublist) Insert(sub *subscription) error {
 		if n == nil {
 			n = newNode()
 			if lt > 1 {
-				l.nodes[t] = n
+				l.nodes[copyString(t)] = n
 			} else {
 				switch t[0] {
 				case pwc:
@@ -164,47 +289,43 @@ func (s *Sublist) Insert(sub *subscription) error {
 				case fwc:
 					l.fwc = n
 				default:
-					l.nodes[t] = n
+					l.nodes[copyString(t)] = n
 				}
 			}
 		}
-		if n.next == nil {
-			n.next = newLevel()
-		}
-		l = n.next
 	}
 	if sub.queue == nil {
-		n.psubs[sub] = sub
+		np := n.addPsub(sub)
 		if n.plist != nil {
 			n.plist = append(n.plist, sub)
-		} else if len(n.psubs) > plistMin {
-			n.plist = make([]*subscription, 0, len(n.psubs))
+		} else if np > plistMin {
+			n.plist = make([]*subscription, 0, np)
 			// Populate
-			for _, psub := range n.psubs {
+			for psub := range n.psubs {
 				n.plist = append(n.plist, psub)
 			}
 		}
 	} else {
 		if n.qsubs == nil {
-			n.qsubs = make(map[string]map[*subscription]*subscription)
+			n.qsubs = make(map[string]map[*subscription]struct{})
 		}
 		qname := string(sub.queue)
 		// This is a queue subscription
 		subs, ok := n.qsubs[qname]
 		if !ok {
-			subs = make(map[*subscription]*subscription)
+			subs = make(map[*subscription]struct{})
 			n.qsubs[qname] = subs
 		}
-		subs[sub] = sub
+		subs[sub] = struct{}{}
 	}
 
-	s.count++
-	s.inserts++
+	atomic.AddUint32(&s.count, 1)
+	atomic.AddUint64(&s.inserts, 1)
 
 	s.addToCache(subject, sub)
 	atomic.AddUint64(&s.genid, 1)
 
-	s.Unlock()
+	sh.Unlock()
 	return nil
 }
 
@@ -236,11 +357,13 @@ func (r *SublistResult) addSubToResult(sub *subscription) *SublistResult {
 }
 
 // addToCache will add the new entry to the existing cache
-// entries if needed. Assumes write lock is held.
+// entries if needed. Assumes write lock of the subject's shard is held.
 func (s *Sublist) addToCache(subject string, sub *subscription) {
 	if s.cache == nil {
 		return
 	}
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
 	// If literal we can direct match.
 	if subjectIsLiteral(subject) {
 		if v, ok := s.cache.Load(subject); ok {
@@ -260,17 +383,20 @@ func (s *Sublist) addToCache(subject string, sub *subscription) {
 }
 
 // removeFromCache will remove the sub from any active cache entries.
-// Assumes write lock is held.
+// Assumes write lock of the subject's shard is held.
 func (s *Sublist) removeFromCache(subject string, sub *subscription) {
 	if s.cache == nil {
 		return
 	}
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
 	// If literal we can direct match.
 	if subjectIsLiteral(subject) {
 		// Load for accounting
 		if _, ok := s.cache.Load(subject); ok {
 			s.cache.Delete(subject)
 			atomic.AddInt32(&s.cacheNum, -1)
+			atomic.AddUint64(&s.evicts, 1)
 		}
 		return
 	}
@@ -281,6 +407,7 @@ func (s *Sublist) removeFromCache(subject string, sub *subscription) {
 			// safely, just let it re-populate.
 			s.cache.Delete(key)
 			atomic.AddInt32(&s.cacheNum, -1)
+			atomic.AddUint64(&s.evicts, 1)
 		}
 		return true
 	})
@@ -317,11 +444,15 @@ func (s *Sublist) Match(subject string) *SublistResult {
 	result := &SublistResult{}
 
 	// Get result from the main structure and place into the shared cache.
-	// Hold the read lock to avoid race between match and store.
+	// Hold the read locks of the shards of the subject to avoid race
+	// between match and store.
 	var n int32
 
-	s.RLock()
-	matchLevel(s.root, tokens, result)
+	sh := s.rlockShards(tokens[0])
+	matchLevel(s.wc.root, tokens, result)
+	if sh != &s.wc {
+		matchLevel(sh.root, tokens, result)
+	}
 	// Check for empty result.
 	if len(result.psubs) == 0 && len(result.qsubs) == 0 {
 		result = emptyResult
@@ -330,7 +461,7 @@ func (s *Sublist) Match(subject string) *SublistResult {
 		s.cache.Store(subject, result)
 		n = atomic.AddInt32(&s.cacheNum, 1)
 	}
-	s.RUnlock()
+	s.runlockShards(sh)
 
 	// Reduce the cache count if we have exceeded our set maximum.
 	if n > slCacheMax && atomic.CompareAndSwapInt32(&s.ccSweep, 0, 1) {
@@ -340,18 +471,147 @@ func (s *Sublist) Match(subject string) *SublistResult {
 	return result
 }
 
+// matchReply is like Match, but also returns whether the result is the same
+// for any last token of the subject, that is if no literal subscription can
+// match that token.
+func (s *Sublist) matchReply(subject string) (*SublistResult, bool) {
+	result := s.Match(subject)
+
+	tsa := [32]string{}
+	tokens := tsa[:0]
+	start := 0
+	for i := 0; i < len(subject); i++ {
+		if subject[i] == btsep {
+			tokens = append(tokens, subject[start:i])
+			start = i + 1
+		}
+	}
+	tokens = append(tokens, subject[start:])
+
+	sh := s.rlockShards(tokens[0])
+	shared := !hasLiteralsAtLastLevel(s.wc.root, tokens) && !hasLiteralsAtLastLevel(sh.root, tokens)
+	s.runlockShards(sh)
+	return result, shared
+}
+
+// rlockShards read locks the shard of the subjects with the given first
+// token, then the one of the wildcard subscriptions, returning the former.
+func (s *Sublist) rlockShards(t string) *slShard {
+	sh := s.shard(t)
+	sh.RLock()
+	if sh != &s.wc {
+		s.wc.RLock()
+	}
+	return sh
+}
+
+// runlockShards releases the read locks taken by rlockShards.
+func (s *Sublist) runlockShards(sh *slShard) {
+	if sh != &s.wc {
+		s.wc.RUnlock()
+	}
+	sh.RUnlock()
+}
+
+// hasLiteralsAtLastLevel returns whether any of the levels reached for the
+// last token has literal nodes with subscriptions, following the same paths
+// as matchLevel.
+func hasLiteralsAtLastLevel(l *level, toks []string) bool {
+	last := len(toks) - 1
+	for i, t := range toks {
+		if l == nil {
+			return false
+		}
+		if i == last {
+			for _, n := range l.nodes {
+				if n.numPsubs() > 0 || len(n.qsubs) > 0 {
+					return true
+				}
+			}
+			return false
+		}
+		if l.pwc != nil && hasLiteralsAtLastLevel(l.pwc.next, toks[i+1:]) {
+			return true
+		}
+		n := l.nodes[t]
+		if n == nil {
+			return false
+		}
+		l = n.next
+	}
+	return false
+}
+
+// sharedSubject returns the subject of a subscription on the given subject,
+// if any, so that subscriptions share it instead of holding copies.
+func (s *Sublist) sharedSubject(subject []byte) []byte {
+	first := subject
+	if i := bytes.IndexByte(subject, btsep); i >= 0 {
+		first = subject[:i]
+	}
+	sh := s.shard(string(first))
+	sh.RLock()
+	defer sh.RUnlock()
+
+	l := sh.root
+	var n *node
+	for rest := subject; l != nil; l = n.next {
+		t := rest
+		if i := bytes.IndexByte(rest, btsep); i >= 0 {
+			t, rest = rest[:i], rest[i+1:]
+		} else {
+			rest = nil
+		}
+		switch {
+		case len(t) == 1 && t[0] == pwc:
+			n = l.pwc
+		case len(t) == 1 && t[0] == fwc:
+			n = l.fwc
+		default:
+			n = l.nodes[string(t)]
+		}
+		if n == nil {
+			return nil
+		}
+		if rest == nil {
+			var sub *subscription
+			if sub = n.psub; sub == nil {
+				for psub := range n.psubs {
+					sub = psub
+					break
+				}
+			}
+			for _, qr := range n.qsubs {
+				if sub != nil {
+					break
+				}
+				for qsub := range qr {
+					sub = qsub
+					break
+				}
+			}
+			if sub == nil || !bytes.Equal(sub.subject, subject) {
+				return nil
+			}
+			return sub.subject[:len(sub.subject):len(sub.subject)]
+		}
+	}
+	return nil
+}
+
 // Remove entries in the cache until we are under the maximum.
 // TODO(dlc) this could be smarter now that its not inline.
 func (s *Sublist) reduceCacheCount() {
 	defer atomic.StoreInt32(&s.ccSweep, 0)
 	// If we are over the cache limit randomly drop until under the limit.
-	s.Lock()
+	s.cmu.Lock()
 	s.cache.Range(func(k, v interface{}) bool {
 		s.cache.Delete(k.(string))
 		n := atomic.AddInt32(&s.cacheNum, -1)
+		atomic.AddUint64(&s.evicts, 1)
 		return n >= slCacheSweep
 	})
-	s.Unlock()
+	s.cmu.Unlock()
 }
 
 // Helper function for auto-expanding remote qsubs.
@@ -365,10 +625,16 @@ func (s *Sublist) UpdateRemoteQSub(sub *subscription) {
 	// We could search to make sure we find it, but probably not worth
 	// it unless we are thrashing the cache. Just remove from our L2 and update
 	// the genid so L1 will be flushed.
-	s.Lock()
-	s.removeFromCache(string(sub.subject), sub)
+	subject := string(sub.subject)
+	t := subject
+	if i := strings.IndexByte(subject, btsep); i >= 0 {
+		t = subject[:i]
+	}
+	sh := s.shard(t)
+	sh.Lock()
+	s.removeFromCache(subject, sub)
 	atomic.AddUint64(&s.genid, 1)
-	s.Unlock()
+	sh.Unlock()
 }
 
 // This will add in a node's results to the total results.
@@ -376,8 +642,10 @@ func addNodeToResults(n *node, results *SublistResult) {
 	// Normal subscriptions
 	if n.plist != nil {
 		results.psubs = append(results.psubs, n.plist...)
+	} else if n.psub != nil {
+		results.psubs = append(results.psubs, n.psub)
 	} else {
-		for _, psub := range n.psubs {
+		for psub := range n.psubs {
 			results.psubs = append(results.psubs, psub)
 		}
 	}
@@ -393,13 +661,18 @@ func addNodeToResults(n *node, results *SublistResult) {
 			nqsub := make([]*subscription, 0, len(qr))
 			results.qsubs = append(results.qsubs, nqsub)
 		}
-		for _, sub := range qr {
+		for sub := range qr {
 			if isRemoteQSub(sub) {
 				ns := atomic.LoadInt32(&sub.qw)
 				// Shadow these subscriptions
 				for n := 0; n < int(ns); n++ {
 					results.qsubs[i] = append(results.qsubs[i], sub)
 				}
+			} else if sub.qw > 1 && sub.client != nil && sub.client.kind == CLIENT {
+				// Client subscriptions with a weight are shadowed the same way.
+				for n := 0; n < int(sub.qw); n++ {
+					results.qsubs[i] = append(results.qsubs[i], sub)
+				}
 			} else {
 				results.qsubs[i] = append(results.qsubs[i], sub)
 			}
@@ -458,8 +731,8 @@ type lnt struct {
 	t string
 }
 
-// Raw low level remove, can do batches with lock held outside.
-func (s *Sublist) remove(sub *subscription, shouldLock bool) error {
+// Raw low level remove.
+func (s *Sublist) remove(sub *subscription) error {
 	subject := string(sub.subject)
 	tsa := [32]string{}
 	tokens := tsa[:0]
@@ -472,13 +745,12 @@ func (s *Sublist) remove(sub *subscription, shouldLock bool) error {
 	}
 	tokens = append(tokens, subject[start:])
 
-	if shouldLock {
-		s.Lock()
-		defer s.Unlock()
-	}
+	sh := s.shard(tokens[0])
+	sh.Lock()
+	defer sh.Unlock()
 
 	sfwc := false
-	l := s.root
+	l := sh.root
 	var n *node
 
 	// Track levels for pruning
@@ -517,8 +789,8 @@ func (s *Sublist) remove(sub *subscription, shouldLock bool) error {
 		return ErrNotFound
 	}
 
-	s.count--
-	s.removes++
+	atomic.AddUint32(&s.count, ^uint32(0))
+	atomic.AddUint64(&s.removes, 1)
 
 	for i := len(levels) - 1; i >= 0; i-- {
 		l, n, t := levels[i].l, levels[i].n, levels[i].t
@@ -534,16 +806,14 @@ func (s *Sublist) remove(sub *subscription, shouldLock bool) error {
 
 // Remove will remove a subscription.
 func (s *Sublist) Remove(sub *subscription) error {
-	return s.remove(sub, true)
+	return s.remove(sub)
 }
 
-// RemoveBatch will remove a list of subscriptions.
+// RemoveBatch will remove a list of subscriptions. Each one is removed
+// with the lock of its shard, so matches are not blocked for the batch.
 func (s *Sublist) RemoveBatch(subs []*subscription) error {
-	s.Lock()
-	defer s.Unlock()
-
 	for _, sub := range subs {
-		if err := s.remove(sub, false); err != nil {
+		if err := s.remove(sub); err != nil {
 			return err
 		}
 	}
@@ -552,17 +822,17 @@ func (s *Sublist) RemoveBatch(subs []*subscription) error {
 
 func (s *Sublist) checkNodeForClientSubs(n *node, c *client) {
 	var removed uint32
-	for _, sub := range n.psubs {
+	n.psubsDo(func(sub *subscription) {
 		if sub.client == c {
 			if s.removeFromNode(n, sub) {
 				s.removeFromCache(string(sub.subject), sub)
 				removed++
 			}
 		}
-	}
+	})
 	// Queue subscriptions
 	for _, qr := range n.qsubs {
-		for _, sub := range qr {
+		for sub := range qr {
 			if sub.client == c {
 				if s.removeFromNode(n, sub) {
 					s.removeFromCache(string(sub.subject), sub)
@@ -571,11 +841,16 @@ func (s *Sublist) checkNodeForClientSubs(n *node, c *client) {
 			}
 		}
 	}
-	s.count -= removed
-	s.removes += uint64(removed)
+	if removed > 0 {
+		atomic.AddUint32(&s.count, ^uint32(removed-1))
+		atomic.AddUint64(&s.removes, uint64(removed))
+	}
 }
 
 func (s *Sublist) removeClientSubs(l *level, c *client) {
+	if l == nil {
+		return
+	}
 	for _, n := range l.nodes {
 		s.checkNodeForClientSubs(n, c)
 		s.removeClientSubs(n.next, c)
@@ -592,13 +867,13 @@ func (s *Sublist) removeClientSubs(l *level, c *client) {
 
 // RemoveAllForClient will remove all subscriptions for a given client.
 func (s *Sublist) RemoveAllForClient(c *client) {
-	s.Lock()
-	removes := s.removes
-	s.removeClientSubs(s.root, c)
-	if s.removes != removes {
-		atomic.AddUint64(&s.genid, 1)
-	}
-	s.Unlock()
+	s.shardsDo(true, func(sh *slShard) {
+		removes := atomic.LoadUint64(&s.removes)
+		s.removeClientSubs(sh.root, c)
+		if atomic.LoadUint64(&s.removes) != removes {
+			atomic.AddUint64(&s.genid, 1)
+		}
+	})
 }
 
 // pruneNode is used to prune an empty node from the tree.
@@ -618,7 +893,7 @@ func (l *level) pruneNode(n *node, t string) {
 // isEmpty will test if the node has any entries. Used
 // in pruning.
 func (n *node) isEmpty() bool {
-	if len(n.psubs) == 0 && len(n.qsubs) == 0 {
+	if n.numPsubs() == 0 && len(n.qsubs) == 0 {
 		if n.next == nil || n.next.numNodes() == 0 {
 			return true
 		}
@@ -644,8 +919,7 @@ func (s *Sublist) removeFromNode(n *node, sub *subscription) (found bool) {
 		return false
 	}
 	if sub.queue == nil {
-		_, found = n.psubs[sub]
-		delete(n.psubs, sub)
+		found = n.removePsub(sub)
 		if found && n.plist != nil {
 			// This will brute force remove the plist to perform
 			// correct behavior. Will get re-populated on a call
@@ -667,9 +941,7 @@ func (s *Sublist) removeFromNode(n *node, sub *subscription) (found bool) {
 
 // Count returns the number of subscriptions.
 func (s *Sublist) Count() uint32 {
-	s.RLock()
-	defer s.RUnlock()
-	return s.count
+	return atomic.LoadUint32(&s.count)
 }
 
 // CacheCount returns the number of result sets in the cache.
@@ -687,36 +959,45 @@ type SublistStats struct {
 	CacheHitRate float64 `json:"cache_hit_rate"`
 	MaxFanout    uint32  `json:"max_fanout"`
 	AvgFanout    float64 `json:"avg_fanout"`
+	NumEvicts    uint64  `json:"num_cache_evicts"`
+	NumLevels    int     `json:"num_levels"`
+	NumWildcards uint32  `json:"num_wildcard_subscriptions"`
+	NumLiterals  uint32  `json:"num_literal_subscriptions"`
 }
 
 // Stats will return a stats structure for the current state.
 func (s *Sublist) Stats() *SublistStats {
-	s.Lock()
-	defer s.Unlock()
-
 	st := &SublistStats{}
-	st.NumSubs = s.count
+	st.NumSubs = atomic.LoadUint32(&s.count)
 	st.NumCache = uint32(atomic.LoadInt32(&s.cacheNum))
-	st.NumInserts = s.inserts
-	st.NumRemoves = s.removes
+	st.NumInserts = atomic.LoadUint64(&s.inserts)
+	st.NumRemoves = atomic.LoadUint64(&s.removes)
 	st.NumMatches = atomic.LoadUint64(&s.matches)
 	if st.NumMatches > 0 {
 		st.CacheHitRate = float64(atomic.LoadUint64(&s.cacheHits)) / float64(st.NumMatches)
 	}
+	st.NumEvicts = atomic.LoadUint64(&s.evicts)
+	st.NumLevels = s.numLevels()
+	s.shardsDo(false, func(sh *slShard) {
+		st.NumWildcards += numWildcardSubs(sh.root)
+	})
+	st.NumLiterals = st.NumSubs - st.NumWildcards
 
 	// whip through cache for fanout stats, this can be off if cache is full and doing evictions.
 	tot, max := 0, 0
 	clen := 0
-	s.cache.Range(func(k, v interface{}) bool {
-		clen++
-		r := v.(*SublistResult)
-		l := len(r.psubs) + len(r.qsubs)
-		tot += l
-		if l > max {
-			max = l
-		}
-		return true
-	})
+	if s.cache != nil {
+		s.cache.Range(func(k, v interface{}) bool {
+			clen++
+			r := v.(*SublistResult)
+			l := len(r.psubs) + len(r.qsubs)
+			tot += l
+			if l > max {
+				max = l
+			}
+			return true
+		})
+	}
 	st.MaxFanout = uint32(max)
 	if tot > 0 {
 		st.AvgFanout = float64(tot) / float64(clen)
@@ -724,10 +1005,49 @@ func (s *Sublist) Stats() *SublistStats {
 	return st
 }
 
+// numWildcardSubs returns the number of subscriptions on subjects with
+// wildcards below this level.
+func numWildcardSubs(l *level) uint32 {
+	if l == nil {
+		return 0
+	}
+	var n uint32
+	for _, ln := range l.nodes {
+		n += numWildcardSubs(ln.next)
+	}
+	// All the subscriptions below a wildcard node have wildcard subjects.
+	return n + numNodeSubs(l.pwc) + numNodeSubs(l.fwc)
+}
+
+// numNodeSubs returns the number of subscriptions on this node and
+// the ones below it.
+func numNodeSubs(n *node) uint32 {
+	if n == nil {
+		return 0
+	}
+	num := uint32(n.numPsubs())
+	for _, qr := range n.qsubs {
+		num += uint32(len(qr))
+	}
+	if l := n.next; l != nil {
+		for _, ln := range l.nodes {
+			num += numNodeSubs(ln)
+		}
+		num += numNodeSubs(l.pwc) + numNodeSubs(l.fwc)
+	}
+	return num
+}
+
 // numLevels will return the maximum number of levels
 // contained in the Sublist tree.
 func (s *Sublist) numLevels() int {
-	return visitLevel(s.root, 0)
+	var max int
+	s.shardsDo(false, func(sh *slShard) {
+		if n := visitLevel(sh.root, 0); n > max {
+			max = n
+		}
+	})
+	return max
 }
 
 // visitLevel is used to descend the Sublist tree structure
@@ -955,7 +1275,7 @@ func matchLiteral(literal, subject string) bool {
 }
 
 func addLocalSub(sub *subscription, subs *[]*subscription) {
-	if sub != nil && sub.client != nil && sub.client.kind == CLIENT && sub.im == nil {
+	if sub != nil && sub.client != nil && sub.client.kind == CLIENT && sub.streamImport() == nil {
 		*subs = append(*subs, sub)
 	}
 }
@@ -967,19 +1287,22 @@ func (s *Sublist) addNodeToSubs(n *node, subs *[]*subscription) {
 			addLocalSub(sub, subs)
 		}
 	} else {
-		for _, sub := range n.psubs {
+		n.psubsDo(func(sub *subscription) {
 			addLocalSub(sub, subs)
-		}
+		})
 	}
 	// Queue subscriptions
 	for _, qr := range n.qsubs {
-		for _, sub := range qr {
+		for sub := range qr {
 			addLocalSub(sub, subs)
 		}
 	}
 }
 
 func (s *Sublist) collectLocalSubs(l *level, subs *[]*subscription) {
+	if l == nil {
+		return
+	}
 	for _, n := range l.nodes {
 		s.addNodeToSubs(n, subs)
 		s.collectLocalSubs(n.next, subs)
@@ -996,46 +1319,51 @@ func (s *Sublist) collectLocalSubs(l *level, subs *[]*subscription) {
 
 // Return all local client subscriptions. Use the supplied slice.
 func (s *Sublist) localSubs(subs *[]*subscription) {
-	s.RLock()
-	s.collectLocalSubs(s.root, subs)
-	s.RUnlock()
+	s.shardsDo(false, func(sh *slShard) {
+		s.collectLocalSubs(sh.root, subs)
+	})
 }
 
 // All is used to collect all subscriptions.
 func (s *Sublist) All(subs *[]*subscription) {
-	s.RLock()
-	s.collectAllSubs(s.root, subs)
-	s.RUnlock()
+	s.shardsDo(false, func(sh *slShard) {
+		s.collectAllSubs(sh.root, subs)
+	})
 }
 
 func (s *Sublist) addAllNodeToSubs(n *node, subs *[]*subscription) {
 	// Normal subscriptions
 	if n.plist != nil {
 		*subs = append(*subs, n.plist...)
+	} else if n.psub != nil {
+		*subs = append(*subs, n.psub)
 	} else {
-		for _, sub := range n.psubs {
+		for sub := range n.psubs {
 			*subs = append(*subs, sub)
 		}
 	}
 	// Queue subscriptions
 	for _, qr := range n.qsubs {
-		for _, sub := range qr {
+		for sub := range qr {
 			*subs = append(*subs, sub)
 		}
 	}
 }
 
 func (s *Sublist) collectAllSubs(l *level, subs *[]*subscription) {
+	if l == nil {
+		return
+	}
 	for _, n := range l.nodes {
 		s.addAllNodeToSubs(n, subs)
-		s.collectLocalSubs(n.next, subs)
+		s.collectAllSubs(n.next, subs)
 	}
 	if l.pwc != nil {
 		s.addAllNodeToSubs(l.pwc, subs)
-		s.collectLocalSubs(l.pwc.next, subs)
+		s.collectAllSubs(l.pwc.next, subs)
 	}
 	if l.fwc != nil {
 		s.addAllNodeToSubs(l.fwc, subs)
-		s.collectLocalSubs(l.fwc.next, subs)
+		s.collectAllSubs(l.fwc.next, subs)
 	}
 }
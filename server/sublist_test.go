@@ -225,6 +225,41 @@ func testSublistFullWildcard(t *testing.T, s *Sublist) {
 	verifyMember(r.psubs, fsub, t)
 }
 
+func TestSublistMatchReply(t *testing.T) {
+	s := NewSublist()
+	psub := newSub("_INBOX.abc.*")
+	s.Insert(psub)
+	s.Insert(newSub("_INBOX.*.def.*"))
+	s.Insert(newSub("foo.bar"))
+	r, shared := s.matchReply("_INBOX.abc.1")
+	verifyLen(r.psubs, 1, t)
+	verifyMember(r.psubs, psub, t)
+	if !shared {
+		t.Fatalf("Expected the result to be shared")
+	}
+	if _, shared := s.matchReply("_INBOX.xyz"); !shared {
+		t.Fatalf("Expected the result to be shared")
+	}
+
+	// A literal subscription on the last token, on any of the matching
+	// paths, makes the result depend on it.
+	s.Insert(newSub("_INBOX.*.lit"))
+	if _, shared := s.matchReply("_INBOX.abc.1"); shared {
+		t.Fatalf("Expected the result not to be shared")
+	}
+	if _, shared := s.matchReply("_INBOX.abc.def.1"); !shared {
+		t.Fatalf("Expected the result to be shared")
+	}
+	lsub := newSub("_INBOX.abc.def.2")
+	s.Insert(lsub)
+	r, shared = s.matchReply("_INBOX.abc.def.2")
+	verifyLen(r.psubs, 2, t)
+	verifyMember(r.psubs, lsub, t)
+	if shared {
+		t.Fatalf("Expected the result not to be shared")
+	}
+}
+
 func TestSublistRemove(t *testing.T) {
 	testSublistRemove(t, NewSublist())
 }
@@ -469,6 +504,44 @@ func TestSublistCache(t *testing.T) {
 	verifyLen(r.psubs, 3, t)
 }
 
+func TestSublistStatsWildcardsAndEvicts(t *testing.T) {
+	s := NewSublist()
+	for _, subj := range []string{"a.b.c", "a.b", "a.*.c", "a.*.c.>", "a.>", "*", "d"} {
+		s.Insert(newSub(subj))
+	}
+	s.Insert(newQSub("a.*", "q"))
+	s.Insert(newQSub("a.b.c", "q"))
+
+	st := s.Stats()
+	if st.NumLevels != 4 {
+		t.Fatalf("Expected 4 levels, got %d", st.NumLevels)
+	}
+	if st.NumWildcards != 5 || st.NumLiterals != 4 {
+		t.Fatalf("Expected 5 wildcard and 4 literal subscriptions, got %d and %d", st.NumWildcards, st.NumLiterals)
+	}
+
+	s.Match("a.b.c")
+	s.Match("a.x.c")
+	s.Match("d")
+	if st = s.Stats(); st.NumEvicts != 0 {
+		t.Fatalf("Expected no evicts, got %d", st.NumEvicts)
+	}
+	// Removing a literal subscription evicts its subject, a wildcard one
+	// all the matching subjects.
+	sub := newSub("d")
+	s.Insert(sub)
+	s.Remove(sub)
+	if st = s.Stats(); st.NumEvicts != 1 {
+		t.Fatalf("Expected 1 evict, got %d", st.NumEvicts)
+	}
+	sub = newSub("a.*.c")
+	s.Insert(sub)
+	s.Remove(sub)
+	if st = s.Stats(); st.NumEvicts != 3 {
+		t.Fatalf("Expected 3 evicts, got %d", st.NumEvicts)
+	}
+}
+
 func TestSublistBasicQueueResults(t *testing.T) {
 	testSublistBasicQueueResults(t, NewSublist())
 }
@@ -1007,6 +1080,167 @@ func TestSublistSharedEmptyResult(t *testing.T) {
 	}
 }
 
+func TestSublistAllSubs(t *testing.T) {
+	s := NewSublist()
+	leaf := &client{kind: LEAF}
+	for _, sub := range []*subscription{
+		newSub("foo"),
+		newSub("foo.bar"),
+		{client: leaf, subject: []byte("bar")},
+		{client: leaf, subject: []byte("bar.baz")},
+		{client: leaf, subject: []byte("bar.*.baz")},
+		{client: leaf, subject: []byte("bar.>")},
+		newRemoteQSub("baz.bat", "queue", 2),
+	} {
+		if err := s.Insert(sub); err != nil {
+			t.Fatalf("Error inserting %q: %v", sub.subject, err)
+		}
+	}
+	// All subscriptions are returned, not only the local ones.
+	var subs []*subscription
+	s.All(&subs)
+	verifyLen(subs, 7, t)
+}
+
+func TestSublistCompactNodes(t *testing.T) {
+	s := NewSublist()
+	node := func(subject string) *node {
+		t.Helper()
+		toks := strings.Split(subject, tsep)
+		sh := s.shard(toks[0])
+		l, n := sh.root, (*node)(nil)
+		for _, tok := range toks {
+			if l == nil {
+				t.Fatalf("No level for %q", tok)
+			}
+			n = l.nodes[tok]
+			l = n.next
+		}
+		return n
+	}
+
+	// A single subscription is kept in the node, without maps, and the last
+	// node of the subject has no next level.
+	sub1 := newSub("foo.bar")
+	s.Insert(sub1)
+	n := node("foo.bar")
+	if n.psub != sub1 || n.psubs != nil || n.qsubs != nil || n.next != nil {
+		t.Fatalf("Unexpected node: %+v", n)
+	}
+	if n := node("foo"); n.psub != nil || n.psubs != nil {
+		t.Fatalf("Unexpected intermediate node: %+v", n)
+	}
+
+	// The map is used with more.
+	sub2, sub3 := newSub("foo.bar"), newSub("foo.bar")
+	s.Insert(sub2)
+	s.Insert(sub3)
+	if n.psub != nil || len(n.psubs) != 3 || n.numPsubs() != 3 {
+		t.Fatalf("Unexpected node: %+v", n)
+	}
+	s.Insert(newSub("foo.bar.baz"))
+	r := s.Match("foo.bar")
+	verifyLen(r.psubs, 3, t)
+	verifyMember(r.psubs, sub1, t)
+
+	for _, sub := range []*subscription{sub1, sub2, sub3} {
+		if err := s.Remove(sub); err != nil {
+			t.Fatalf("Error removing: %v", err)
+		}
+	}
+	if n.numPsubs() != 0 || n.psubs != nil {
+		t.Fatalf("Unexpected node: %+v", n)
+	}
+	if err := s.Remove(sub1); err != ErrNotFound {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+	verifyLen(s.Match("foo.bar").psubs, 0, t)
+	verifyLen(s.Match("foo.bar.baz").psubs, 1, t)
+	verifyCount(s, 1, t)
+
+	// The subject of a subscription is shared.
+	qsub := newQSub("foo.*.baz", "bar")
+	s.Insert(qsub)
+	for _, subject := range []string{"foo.bar", "foo.*", "bar.baz", "foo.*.baz.>"} {
+		if shared := s.sharedSubject([]byte(subject)); shared != nil {
+			t.Fatalf("Expected no shared subject for %q, got %q", subject, shared)
+		}
+	}
+	for _, sub := range []*subscription{qsub, s.Match("foo.bar.baz").psubs[0]} {
+		shared := s.sharedSubject(sub.subject)
+		if &shared[0] != &sub.subject[0] || cap(shared) != len(shared) {
+			t.Fatalf("Expected the subject of the subscription to be shared")
+		}
+	}
+}
+
+func TestSublistShardsChurn(t *testing.T) {
+	testSublistShardsChurn(t, NewSublist())
+}
+
+func TestSublistShardsChurnNoCache(t *testing.T) {
+	testSublistShardsChurn(t, NewSublistNoCache())
+}
+
+func testSublistShardsChurn(t *testing.T, s *Sublist) {
+	// Subscriptions that stay for the whole test, in the wildcard shard
+	// and in the shard of "foo".
+	fwc := newSub(">")
+	pwc := newSub("*.bar")
+	lit := newSub("foo.bar")
+	for _, sub := range []*subscription{fwc, pwc, lit} {
+		if err := s.Insert(sub); err != nil {
+			t.Fatalf("Error inserting %q: %v", sub.subject, err)
+		}
+	}
+
+	// Churn subscriptions on many first tokens, including "foo", while
+	// matching "foo.bar".
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				subs := make([]*subscription, 0, 64)
+				for j := 0; j < 64; j++ {
+					subs = append(subs, newSub(fmt.Sprintf("churn%d.%d.baz", (i*64+j)%100, n)))
+				}
+				subs = append(subs, newSub(fmt.Sprintf("foo.%d", n)))
+				for _, sub := range subs {
+					s.Insert(sub)
+				}
+				s.Match(fmt.Sprintf("churn%d.%d.baz", i, n))
+				s.RemoveBatch(subs)
+			}
+		}(i)
+	}
+	for i := 0; i < 1000; i++ {
+		r := s.Match("foo.bar")
+		verifyLen(r.psubs, 3, t)
+		verifyMember(r.psubs, fwc, t)
+		verifyMember(r.psubs, pwc, t)
+		verifyMember(r.psubs, lit, t)
+	}
+	close(done)
+	wg.Wait()
+
+	verifyCount(s, 3, t)
+	if st := s.Stats(); st.NumWildcards != 2 {
+		t.Fatalf("Expected 2 wildcard subscriptions, got %d", st.NumWildcards)
+	}
+	r := s.Match("churn1.0.baz")
+	verifyLen(r.psubs, 1, t)
+	verifyMember(r.psubs, fwc, t)
+	verifyNumLevels(s, 2, t)
+}
+
 // -- Benchmarks Setup --
 
 var benchSublistSubs []*subscription
@@ -1419,6 +1653,46 @@ func Benchmark_SublistCacheContention10kM10kA10kR(b *testing.B) {
 	cacheContentionTest(b, 10*1024, 10*1024, 10*1024)
 }
 
+// Matches while other goroutines churn subscriptions on other first tokens.
+func Benchmark__________SublistMatchWhileChurning(b *testing.B) {
+	s := NewSublistNoCache()
+	for i := 0; i < 100; i++ {
+		s.Insert(newSub(fmt.Sprintf("acct%d.events.>", i)))
+	}
+	var wg sync.WaitGroup
+	quitCh := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			subs := make([]*subscription, 0, 1024)
+			for j := 0; j < 1024; j++ {
+				subs = append(subs, newSub(fmt.Sprintf("churn%d.%d", i*1024+j, j)))
+			}
+			for {
+				select {
+				case <-quitCh:
+					return
+				default:
+				}
+				for _, sub := range subs {
+					s.Insert(sub)
+				}
+				s.RemoveBatch(subs)
+			}
+		}(i)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.Match("acct1.events.foo")
+		}
+	})
+	b.StopTimer()
+	close(quitCh)
+	wg.Wait()
+}
+
 func Benchmark______________IsValidLiteralSubject(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		IsValidLiteralSubject("foo.bar.baz.22")
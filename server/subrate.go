@@ -0,0 +1,266 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Options of the SUB protocol, after the sid, requesting a maximum delivery
+// rate for the subscription, e.g. SUB foo 1 msgs_per_sec=100, or the weight
+// of a queue subscription in its group, e.g. SUB foo bar 1 weight=3.
+const (
+	subRateMsgsOpt  = "msgs_per_sec="
+	subRateBytesOpt = "bytes_per_sec="
+	subWeightOpt    = "weight="
+)
+
+// Maximum weight of a queue subscription.
+const maxQueueSubWeight = 100
+
+// subRateLimit paces the delivery of messages to a subscription. Messages
+// above the rate are held, up to a second worth of them, and delivered as
+// the rate allows. Messages that do not fit are dropped, or delivered to
+// another member of the queue group.
+// Client lock should be held.
+type subRateLimit struct {
+	msgs    float64 // Messages per second, 0 if not limited.
+	bytes   float64 // Bytes per second, 0 if not limited.
+	mtokens float64
+	btokens float64
+	last    time.Time
+	pending []pacedMsg
+	pbytes  int
+	timer   *time.Timer
+	dropped uint64
+}
+
+// A message held until the rate allows its delivery.
+type pacedMsg struct {
+	mh  []byte
+	msg []byte
+}
+
+func newSubRateLimit(msgs, nbytes int64) *subRateLimit {
+	return &subRateLimit{
+		msgs:    float64(msgs),
+		bytes:   float64(nbytes),
+		mtokens: float64(msgs),
+		btokens: float64(nbytes),
+		last:    time.Now(),
+	}
+}
+
+// parseSubOptions removes the options from the end of the SUB arguments and
+// returns the remaining arguments with the requested rate limit, or nil if
+// none was requested, and the requested weight, 0 if none.
+func parseSubOptions(args [][]byte) ([][]byte, *subRateLimit, int32, error) {
+	var msgs, bytesRate, weight int64
+	for len(args) > 2 {
+		arg := args[len(args)-1]
+		var v *int64
+		var opt string
+		switch {
+		case bytes.HasPrefix(arg, []byte(subRateMsgsOpt)):
+			v, opt = &msgs, subRateMsgsOpt
+		case bytes.HasPrefix(arg, []byte(subRateBytesOpt)):
+			v, opt = &bytesRate, subRateBytesOpt
+		case bytes.HasPrefix(arg, []byte(subWeightOpt)):
+			v, opt = &weight, subWeightOpt
+		default:
+			return args, newSubRateLimitIfSet(msgs, bytesRate), int32(weight), nil
+		}
+		n, err := strconv.ParseInt(string(arg[len(opt):]), 10, 64)
+		if err != nil || n <= 0 || (v == &weight && n > maxQueueSubWeight) {
+			return nil, nil, 0, fmt.Errorf("invalid subscription option %q", arg)
+		}
+		*v = n
+		args = args[:len(args)-1]
+	}
+	return args, newSubRateLimitIfSet(msgs, bytesRate), int32(weight), nil
+}
+
+func newSubRateLimitIfSet(msgs, nbytes int64) *subRateLimit {
+	if msgs == 0 && nbytes == 0 {
+		return nil
+	}
+	return newSubRateLimit(msgs, nbytes)
+}
+
+// Adds the tokens accumulated since the last refill, up to a second worth.
+func (rl *subRateLimit) refill(now time.Time) {
+	elapsed := now.Sub(rl.last).Seconds()
+	rl.last = now
+	if rl.msgs > 0 {
+		if rl.mtokens += elapsed * rl.msgs; rl.mtokens > rl.msgs {
+			rl.mtokens = rl.msgs
+		}
+	}
+	if rl.bytes > 0 {
+		if rl.btokens += elapsed * rl.bytes; rl.btokens > rl.bytes {
+			rl.btokens = rl.bytes
+		}
+	}
+}
+
+// Returns the number of bytes that needs to be available for a message of
+// the given size. Messages larger than a second worth of bytes are let
+// through once the bucket is full so that they are not held forever.
+func (rl *subRateLimit) needed(size int) float64 {
+	return minFloat(float64(size), rl.bytes)
+}
+
+// Returns whether a message of the given size can be delivered now, and
+// takes its tokens if so.
+func (rl *subRateLimit) allow(now time.Time, size int) bool {
+	rl.refill(now)
+	if (rl.msgs > 0 && rl.mtokens < 1) || (rl.bytes > 0 && rl.btokens < rl.needed(size)) {
+		return false
+	}
+	if rl.msgs > 0 {
+		rl.mtokens--
+	}
+	if rl.bytes > 0 {
+		rl.btokens -= float64(size)
+	}
+	return true
+}
+
+// Returns how long to wait for a message of the given size to be allowed.
+func (rl *subRateLimit) wait(size int) time.Duration {
+	var secs float64
+	if rl.msgs > 0 && rl.mtokens < 1 {
+		secs = (1 - rl.mtokens) / rl.msgs
+	}
+	if rl.bytes > 0 {
+		if need := rl.needed(size); rl.btokens < need {
+			secs = maxFloat(secs, (need-rl.btokens)/rl.bytes)
+		}
+	}
+	return time.Duration(secs * float64(time.Second))
+}
+
+// Returns whether a message of the given size can be held, which is the case
+// as long as there is less than a second worth of messages pending.
+func (rl *subRateLimit) canHold(size int) bool {
+	if len(rl.pending) == 0 {
+		return true
+	}
+	if rl.msgs > 0 && float64(len(rl.pending)+1) > rl.msgs {
+		return false
+	}
+	if rl.bytes > 0 && float64(rl.pbytes+size) > rl.bytes {
+		return false
+	}
+	return true
+}
+
+// paceMsg checks the message against the rate limit of the subscription.
+// It returns deliver true if the message can be delivered now, otherwise
+// held is true if the message is held to be delivered later, and false if
+// it was dropped.
+// Client lock should be held.
+func (c *client) paceMsg(sub *subscription, mh, msg []byte) (deliver, held bool) {
+	rl := sub.ext.rl
+	size := len(msg) - LEN_CR_LF
+	now := time.Now()
+	// Keep the order of the messages already held.
+	if len(rl.pending) == 0 && rl.allow(now, size) {
+		return true, false
+	}
+	if !rl.canHold(size) {
+		rl.dropped++
+		if rl.dropped == 1 || rl.dropped%1000 == 0 {
+			c.Debugf("Dropped %d messages above the rate of subscription %q on %q",
+				rl.dropped, sub.sid, sub.subject)
+		}
+		return false, false
+	}
+	// The header and message are in buffers that are going to be reused.
+	pm := pacedMsg{mh: append([]byte(nil), mh...), msg: append([]byte(nil), msg...)}
+	rl.pending = append(rl.pending, pm)
+	rl.pbytes += size
+	if rl.timer == nil {
+		rl.timer = time.AfterFunc(rl.wait(len(rl.pending[0].msg)-LEN_CR_LF), func() {
+			c.deliverPaced(sub)
+		})
+	}
+	return false, true
+}
+
+// deliverPaced delivers the messages held for the subscription that the
+// rate now allows.
+func (c *client) deliverPaced(sub *subscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rl := sub.ext.rl
+	rl.timer = nil
+	// Discard the messages if the subscription or connection is gone.
+	if c.flags.isSet(clearConnection) || c.subs[string(sub.sid)] != sub {
+		rl.pending, rl.pbytes = nil, 0
+		return
+	}
+	srv := c.srv
+	now := time.Now()
+	for len(rl.pending) > 0 {
+		pm := rl.pending[0]
+		size := len(pm.msg) - LEN_CR_LF
+		if !rl.allow(now, size) {
+			break
+		}
+		rl.pending[0] = pacedMsg{}
+		rl.pending = rl.pending[1:]
+		rl.pbytes -= size
+
+		c.outMsgs++
+		c.outBytes += int64(size)
+		atomic.AddInt64(&srv.outMsgs, 1)
+		atomic.AddInt64(&srv.outBytes, int64(size))
+		if acc := c.acc; acc != nil {
+			atomic.AddInt64(&acc.outMsgs, 1)
+			atomic.AddInt64(&acc.outBytes, int64(size))
+		}
+		c.queueOutbound(pm.mh)
+		c.queueOutbound(pm.msg)
+		c.out.pm++
+		if c.trace {
+			c.traceOutOp(string(pm.mh[:len(pm.mh)-LEN_CR_LF]), nil)
+		}
+	}
+	c.flushSignal()
+	if len(rl.pending) > 0 {
+		rl.timer = time.AfterFunc(rl.wait(len(rl.pending[0].msg)-LEN_CR_LF), func() {
+			c.deliverPaced(sub)
+		})
+	}
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestParseSubOptions(t *testing.T) {
+	for _, test := range []struct {
+		arg    string
+		args   int
+		msgs   float64
+		bytes  float64
+		weight int32
+		err    bool
+	}{
+		{"foo 1", 2, 0, 0, 0, false},
+		{"foo bar 1", 3, 0, 0, 0, false},
+		{"foo 1 msgs_per_sec=10", 2, 10, 0, 0, false},
+		{"foo bar 1 bytes_per_sec=1024", 3, 0, 1024, 0, false},
+		{"foo bar 1 msgs_per_sec=10 bytes_per_sec=1024", 3, 10, 1024, 0, false},
+		{"foo bar 1 weight=3", 3, 0, 0, 3, false},
+		{"foo bar 1 weight=3 msgs_per_sec=10", 3, 10, 0, 3, false},
+		{"foo 1 msgs_per_sec=0", 0, 0, 0, 0, true},
+		{"foo 1 msgs_per_sec=abc", 0, 0, 0, 0, true},
+		{"foo bar 1 weight=101", 0, 0, 0, 0, true},
+	} {
+		t.Run(test.arg, func(t *testing.T) {
+			args, rl, weight, err := parseSubOptions(splitArg([]byte(test.arg)))
+			if test.err {
+				if err == nil {
+					t.Fatalf("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(args) != test.args {
+				t.Fatalf("Expected %d args, got %d", test.args, len(args))
+			}
+			if weight != test.weight {
+				t.Fatalf("Expected weight %d, got %d", test.weight, weight)
+			}
+			if test.msgs == 0 && test.bytes == 0 {
+				if rl != nil {
+					t.Fatalf("Expected no rate limit, got %+v", rl)
+				}
+				return
+			}
+			if rl == nil || rl.msgs != test.msgs || rl.bytes != test.bytes {
+				t.Fatalf("Unexpected rate limit: %+v", rl)
+			}
+		})
+	}
+}
+
+func TestSubRateLimitPacing(t *testing.T) {
+	opts := DefaultOptions()
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	c, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer c.Close()
+	cr := bufio.NewReader(c)
+	if _, err := cr.ReadString('\n'); err != nil {
+		t.Fatalf("Error reading INFO: %v", err)
+	}
+	c.Write([]byte("CONNECT {\"verbose\":false}\r\nSUB foo 1 msgs_per_sec=10\r\nPING\r\n"))
+	if l, err := cr.ReadString('\n'); err != nil || l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q: %v", l, err)
+	}
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	// A second worth of messages is delivered right away, the next second
+	// worth is held and paced, and the rest is dropped.
+	start := time.Now()
+	for i := 0; i < 30; i++ {
+		nc.Publish("foo", []byte("ok"))
+	}
+	nc.Flush()
+
+	received := 0
+	var last time.Time
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		l, err := cr.ReadString('\n')
+		if err != nil {
+			break
+		}
+		if strings.HasPrefix(l, "MSG ") {
+			received++
+			last = time.Now()
+		}
+	}
+	if received != 20 {
+		t.Fatalf("Expected 20 messages, got %d", received)
+	}
+	if elapsed := last.Sub(start); elapsed < 800*time.Millisecond {
+		t.Fatalf("Expected the messages to be paced, got them all in %v", elapsed)
+	}
+
+	// Invalid rates are rejected.
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	c.Write([]byte("SUB bar 2 msgs_per_sec=-1\r\n"))
+	if l, err := cr.ReadString('\n'); err != nil || !strings.HasPrefix(l, "-ERR") {
+		t.Fatalf("Expected an error, got %q: %v", l, err)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Service state notifications, see sd_notify(3).
+const (
+	sdNotifyReady     = "READY=1"
+	sdNotifyReloading = "RELOADING=1"
+	sdNotifyStopping  = "STOPPING=1"
+	sdNotifyWatchdog  = "WATCHDOG=1"
+)
+
+// sdNotify sends the state to the service manager when the server is
+// started by systemd with Type=notify, otherwise this is a no-op.
+func (s *Server) sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == _EMPTY_ {
+		return
+	}
+	// Abstract namespace socket.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		s.Debugf("Unable to connect to the systemd notify socket: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		s.Debugf("Unable to notify systemd of %q: %v", state, err)
+	}
+}
+
+// sdWatchdogInterval returns the interval at which the service manager
+// expects keepalives, or 0 if the watchdog is not enabled for this process.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != _EMPTY_ && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// sdNotifyReadyAndStartWatchdog notifies that the server is ready and, when
+// the watchdog is enabled, sends keepalives for as long as the server is healthy.
+func (s *Server) sdNotifyReadyAndStartWatchdog() {
+	if os.Getenv("NOTIFY_SOCKET") == _EMPTY_ {
+		return
+	}
+	s.sdNotify(fmt.Sprintf("%s\nMAINPID=%d", sdNotifyReady, os.Getpid()))
+
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	s.Debugf("Sending systemd watchdog keepalives every %v", interval/2)
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		// Keepalives are sent at half the interval, as recommended, which
+		// also leaves that much time for the health check itself.
+		t := time.NewTicker(interval / 2)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if s.isHealthy(interval / 2) {
+					s.sdNotify(sdNotifyWatchdog)
+				} else {
+					s.Warnf("Server is not responsive, skipping systemd watchdog keepalive")
+				}
+			case <-s.quitCh:
+				return
+			}
+		}
+	})
+}
+
+// isHealthy returns false if the server lock can not be acquired within the
+// given timeout, or if the internal send loop is not draining its queue,
+// that is if the server looks hung.
+func (s *Server) isHealthy(timeout time.Duration) bool {
+	done := make(chan bool, 1)
+	go func() {
+		s.mu.Lock()
+		healthy := s.sys == nil || s.sys.sendq == nil || len(s.sys.sendq) < cap(s.sys.sendq)
+		s.mu.Unlock()
+		done <- healthy
+	}()
+	select {
+	case healthy := <-done:
+		return healthy
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,427 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+// TierConfig is the S3 compatible object storage, such as AWS S3, GCS
+// or MinIO, the aged blocks of the file based streams are offloaded to.
+type TierConfig struct {
+	Endpoint string `json:"endpoint"`
+	Bucket   string `json:"bucket"`
+	Region   string `json:"region,omitempty"`
+	Prefix   string `json:"prefix,omitempty"`
+	// The credentials default to the AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY environment variables. They are never exposed.
+	AccessKey string `json:"-"`
+	SecretKey string `json:"-"`
+}
+
+// Region used to sign the requests when none is configured.
+const defaultTierRegion = "us-east-1"
+
+// Interval at which the file stores look for blocks to offload.
+var tierCheckInterval = time.Minute
+
+// errTierNotFound is returned when the object does not exist.
+var errTierNotFound = errors.New("tiered object not found")
+
+// errTierNotConfigured is returned when reading an offloaded block
+// while tiered storage is not configured.
+var errTierNotConfigured = errors.New("tiered storage not configured")
+
+// tierStore holds the offloaded blocks as objects.
+type tierStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+// s3Store is a tierStore using the S3 REST API, with path style
+// addressing and requests signed with AWS signature version 4.
+type s3Store struct {
+	url       *url.URL
+	bucket    string
+	region    string
+	prefix    string
+	accessKey string
+	secretKey string
+	hc        *http.Client
+}
+
+func newS3Store(cfg *TierConfig) (*s3Store, error) {
+	if cfg.Endpoint == _EMPTY_ || cfg.Bucket == _EMPTY_ {
+		return nil, fmt.Errorf("tiered storage requires an endpoint and a bucket")
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == _EMPTY_ {
+		return nil, fmt.Errorf("invalid tiered storage endpoint %q", cfg.Endpoint)
+	}
+	s := &s3Store{
+		url:       u,
+		bucket:    cfg.Bucket,
+		region:    cfg.Region,
+		prefix:    strings.Trim(cfg.Prefix, "/"),
+		accessKey: cfg.AccessKey,
+		secretKey: cfg.SecretKey,
+		hc:        &http.Client{Timeout: 30 * time.Second},
+	}
+	if s.region == _EMPTY_ {
+		s.region = defaultTierRegion
+	}
+	if s.accessKey == _EMPTY_ {
+		s.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if s.secretKey == _EMPTY_ {
+		s.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	return s, nil
+}
+
+// Put stores the object.
+func (s *s3Store) Put(key string, data []byte) error {
+	_, err := s.do(http.MethodPut, key, data)
+	return err
+}
+
+// Get returns the content of the object.
+func (s *s3Store) Get(key string) ([]byte, error) {
+	return s.do(http.MethodGet, key, nil)
+}
+
+// Delete removes the object, it is not an error if it does not exist.
+func (s *s3Store) Delete(key string) error {
+	if _, err := s.do(http.MethodDelete, key, nil); err != nil && err != errTierNotFound {
+		return err
+	}
+	return nil
+}
+
+// Sends the signed request for the object and returns the body of
+// the response.
+func (s *s3Store) do(method, key string, body []byte) ([]byte, error) {
+	u := *s.url
+	u.Path = path.Join("/", s.url.Path, s.bucket, s.prefix, key)
+	u.RawPath = s3EscapePath(u.Path)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(sum[:]))
+	signV4(req, s.accessKey, s.secretKey, s.region, time.Now())
+
+	resp, err := s.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, errTierNotFound
+	case resp.StatusCode/100 != 2:
+		return nil, fmt.Errorf("tiered storage %s %q failed: %s", method, key, resp.Status)
+	}
+	return data, nil
+}
+
+// Signs the request with AWS signature version 4. The headers present
+// are signed, x-amz-content-sha256 must be set to the hash of the body.
+func signV4(req *http.Request, accessKey, secretKey, region string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+
+	host := req.Host
+	if host == _EMPTY_ {
+		host = req.URL.Host
+	}
+	hdrs := map[string]string{"host": host}
+	for k, v := range req.Header {
+		hdrs[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(hdrs))
+	for k := range hdrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var ch strings.Builder
+	for _, k := range names {
+		ch.WriteString(k + ":" + hdrs[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	creq := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		ch.String(),
+		signed,
+		req.Header.Get("x-amz-content-sha256"),
+	}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	h := sha256.Sum256([]byte(creq))
+	sts := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, sts))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signed, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Escapes each segment of the path as S3 expects.
+func s3EscapePath(p string) string {
+	if p == _EMPTY_ {
+		return "/"
+	}
+	segs := strings.Split(p, "/")
+	for i, seg := range segs {
+		segs[i] = s3Escape(seg)
+	}
+	return strings.Join(segs, "/")
+}
+
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := q[k]
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Percent encodes all but the unreserved characters.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Lock should be held.
+func (fs *fileStore) startTierChk() {
+	fs.tierChk = time.AfterFunc(tierCheckInterval, fs.tierBlocks)
+}
+
+// Offloads the blocks whose messages are all older than the tier
+// threshold. The last block is never offloaded.
+func (fs *fileStore) tierBlocks() {
+	for {
+		fs.mu.Lock()
+		if fs.closed || fs.tierChk == nil {
+			fs.mu.Unlock()
+			return
+		}
+		cutoff := time.Now().UnixNano() - int64(fs.cfg.TierAfter)
+		var mb *msgBlock
+		for _, b := range fs.blks {
+			if b == fs.lmb || b.tkey != _EMPTY_ || len(b.msgs) == 0 {
+				continue
+			}
+			if b.lastTs() > cutoff {
+				break
+			}
+			mb = b
+			break
+		}
+		if mb == nil {
+			fs.tierChk.Reset(tierCheckInterval)
+			fs.mu.Unlock()
+			return
+		}
+		buf := make([]byte, mb.size)
+		_, err := mb.f.ReadAt(buf, 0)
+		tier, key := fs.fcfg.Tier, path.Join(fs.fcfg.TierPrefix, nuid.Next()+blkSuffix)
+		fs.mu.Unlock()
+
+		if err == nil {
+			err = tier.Put(key, buf)
+		}
+		if err == nil {
+			err = fs.tierMsgBlock(mb, key)
+		}
+		if err != nil {
+			// Retried at the next check.
+			fs.mu.Lock()
+			if fs.tierChk != nil {
+				fs.tierChk.Reset(tierCheckInterval)
+			}
+			fs.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Replaces the block file with a stub referencing the object its
+// content was uploaded to, and holding the index of its messages.
+func (fs *fileStore) tierMsgBlock(mb *msgBlock, key string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var found bool
+	for _, b := range fs.blks {
+		found = found || b == mb
+	}
+	if fs.closed || !found {
+		go fs.fcfg.Tier.Delete(key)
+		return nil
+	}
+	seqs := make([]uint64, 0, len(mb.msgs))
+	for seq := range mb.msgs {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	stub := encodeRecord(recTierRef, 0, 0, _EMPTY_, []byte(key))
+	for _, seq := range seqs {
+		fm := mb.msgs[seq]
+		rec, err := fs.encodeMsgRecord(recTiered, seq, fm.ts, fm.subj, nil, encodeTierLoc(fm))
+		if err != nil {
+			go fs.fcfg.Tier.Delete(key)
+			return err
+		}
+		stub = append(stub, rec...)
+	}
+	tmp := mb.fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, stub, 0644); err != nil {
+		os.Remove(tmp)
+		go fs.fcfg.Tier.Delete(key)
+		return err
+	}
+	if err := os.Rename(tmp, mb.fn); err != nil {
+		os.Remove(tmp)
+		go fs.fcfg.Tier.Delete(key)
+		return err
+	}
+	mb.f.Close()
+	f, err := os.OpenFile(mb.fn, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	mb.f, mb.size, mb.tkey = f, int64(len(stub)), key
+	return nil
+}
+
+// Returns the timestamp of the newest message of the block.
+func (mb *msgBlock) lastTs() int64 {
+	var ts int64
+	for _, fm := range mb.msgs {
+		if fm.ts > ts {
+			ts = fm.ts
+		}
+	}
+	return ts
+}
+
+// Location of the message in the object of an offloaded block.
+func encodeTierLoc(fm *fileMsg) []byte {
+	buf := make([]byte, 20)
+	binary.LittleEndian.PutUint64(buf[0:], uint64(fm.off))
+	binary.LittleEndian.PutUint32(buf[8:], fm.rl)
+	binary.LittleEndian.PutUint64(buf[12:], fm.sz)
+	return buf
+}
+
+func decodeTierLoc(buf []byte, subj string, ts int64) (*fileMsg, error) {
+	if len(buf) != 20 {
+		return nil, ErrStoreCorrupt
+	}
+	return &fileMsg{
+		off:  int64(binary.LittleEndian.Uint64(buf[0:])),
+		rl:   binary.LittleEndian.Uint32(buf[8:]),
+		sz:   binary.LittleEndian.Uint64(buf[12:]),
+		subj: subj,
+		ts:   ts,
+	}, nil
+}
+
+// Returns the content of the offloaded block, the last one fetched
+// is kept in memory since consumers read sequentially.
+func (fs *fileStore) fetchTiered(key string) ([]byte, error) {
+	fs.tmu.Lock()
+	defer fs.tmu.Unlock()
+	if fs.tkey == key {
+		return fs.tbuf, nil
+	}
+	if fs.fcfg.Tier == nil {
+		return nil, errTierNotConfigured
+	}
+	buf, err := fs.fcfg.Tier.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	fs.tkey, fs.tbuf = key, buf
+	return buf, nil
+}
+
+// Reads the message of an offloaded block.
+func (fs *fileStore) readTieredMsg(seq uint64, key string, off int64, rl uint32) (*StoredMsg, error) {
+	buf, err := fs.fetchTiered(key)
+	if err == errTierNotFound {
+		return nil, ErrStoreMsgNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if off < 0 || off+int64(rl) > int64(len(buf)) {
+		return nil, ErrStoreCorrupt
+	}
+	return fs.decodeMsg(seq, buf[off:off+int64(rl)])
+}
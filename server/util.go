@@ -16,8 +16,12 @@ package server
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
@@ -110,3 +114,71 @@ func parseHostPort(hostPort string, defaultPort int) (host string, port int, err
 func urlsAreEqual(u1, u2 *url.URL) bool {
 	return reflect.DeepEqual(u1, u2)
 }
+
+// Returns true if the string s is in the array a.
+func stringsContains(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the delay to wait after the given number of failed connect
+// attempts. When maxBackoff is set, the interval is doubled after each
+// failed attempt without going over maxBackoff.
+func backoffDelay(interval, maxBackoff time.Duration, attempts int) time.Duration {
+	d := interval
+	for i := 1; maxBackoff > 0 && i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if maxBackoff > 0 && d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// Returns a random duration in the range [0, jitter).
+func jitterDelay(jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(jitter)))
+}
+
+// Writes the data to a temporary file in the directory of the named file,
+// which is then renamed, so that readers never see a partially written file.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, name)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
+
+// Returns true if the arrays a and b have a string in common.
+func stringsIntersect(a, b []string) bool {
+	for _, v := range a {
+		if stringsContains(b, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -113,6 +113,35 @@ func TestURLsAreEqual(t *testing.T) {
 	check(t, "nats://host1:4222", "nats://host2:4222", false)
 }
 
+func TestBackoffDelay(t *testing.T) {
+	for _, test := range []struct {
+		interval   time.Duration
+		maxBackoff time.Duration
+		attempts   int
+		expected   time.Duration
+	}{
+		{time.Second, 0, 1, time.Second},
+		{time.Second, 0, 10, time.Second},
+		{time.Second, 10 * time.Second, 1, time.Second},
+		{time.Second, 10 * time.Second, 2, 2 * time.Second},
+		{time.Second, 10 * time.Second, 4, 8 * time.Second},
+		{time.Second, 10 * time.Second, 5, 10 * time.Second},
+		{time.Second, 10 * time.Second, 100, 10 * time.Second},
+	} {
+		if d := backoffDelay(test.interval, test.maxBackoff, test.attempts); d != test.expected {
+			t.Fatalf("Expected delay of %v after %v attempts, got %v", test.expected, test.attempts, d)
+		}
+	}
+	if d := jitterDelay(0); d != 0 {
+		t.Fatalf("Expected no jitter, got %v", d)
+	}
+	for i := 0; i < 100; i++ {
+		if d := jitterDelay(time.Millisecond); d < 0 || d >= time.Millisecond {
+			t.Fatalf("Unexpected jitter: %v", d)
+		}
+	}
+}
+
 func BenchmarkParseInt(b *testing.B) {
 	b.SetBytes(1)
 	n := "12345678"
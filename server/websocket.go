@@ -0,0 +1,744 @@
+// Copyright 2019 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Websocket frame opcodes (RFC 6455).
+	wsContinuationFrame = 0
+	wsTextFrame         = 1
+	wsBinaryFrame       = 2
+	wsCloseFrame        = 8
+	wsPingFrame         = 9
+	wsPongFrame         = 10
+
+	wsFinalBit = 1 << 7
+	wsRsv1Bit  = 1 << 6
+	wsMaskBit  = 1 << 7
+
+	// Maximum size of a control frame payload.
+	wsMaxControlPayloadSize = 125
+	// Maximum size of a single (possibly fragmented) websocket message.
+	wsMaxMessageSize = 64 * 1024 * 1024
+
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// Extension used to negotiate compression. We never keep the
+	// compression context between messages.
+	wsPMCExtension     = "permessage-deflate"
+	wsPMCNoContextExts = wsPMCExtension + "; server_no_context_takeover; client_no_context_takeover"
+)
+
+// Default time allowed for the TLS and websocket handshakes of clients.
+const wsDefaultHandshakeTimeout = 2 * time.Second
+
+// Added to a compressed payload before decompression, the first 4 bytes
+// restore the trailer removed by the sender (RFC 7692), the rest is an
+// empty final block so that the flate reader does not report an unexpected EOF.
+var wsCompressedTrailer = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// wsConn wraps a net.Conn on which the websocket handshake has been
+// completed. Reads and writes are converted from/to binary websocket
+// frames so that the rest of the server sees a plain byte stream.
+type wsConn struct {
+	net.Conn
+	br *bufio.Reader
+	// Set when we initiated the connection, in which case
+	// frames we send need to be masked.
+	client   bool
+	compress bool
+	// User JWT found in the cookie of a client upgrade request.
+	cookieJWT string
+
+	// Read side, only accessed from the read loop.
+	pending []byte
+	frag    []byte
+	fragCmp bool
+	closed  bool
+
+	// Write side.
+	mu sync.Mutex
+	fw *flate.Writer
+	cb bytes.Buffer
+}
+
+// Returns true if the URL uses one of the websocket schemes.
+func isWebsocketURL(u *url.URL) bool {
+	if u == nil {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	return scheme == "ws" || scheme == "wss"
+}
+
+// Returns true if this connection is carried over websocket.
+func isWebsocketConn(nc net.Conn) bool {
+	_, ok := nc.(*wsConn)
+	return ok
+}
+
+// Returns the host:port of a websocket (or http) URL, adding
+// the default port for the scheme if none is specified.
+func wsHostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if scheme := strings.ToLower(u.Scheme); scheme == "wss" || scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// Computes the value of the Sec-WebSocket-Accept header for the given key.
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Returns true if the comma separated header values contain the token.
+func wsHeaderContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns true if the extensions header requests or accepts permessage-deflate.
+func wsPMCRequested(h http.Header) bool {
+	for _, v := range h[http.CanonicalHeaderKey("Sec-WebSocket-Extensions")] {
+		for _, ext := range strings.Split(v, ",") {
+			params := strings.Split(ext, ";")
+			if strings.EqualFold(strings.TrimSpace(params[0]), wsPMCExtension) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Performs the client side of the websocket handshake on the given connection.
+// If compress is true, permessage-deflate is requested and will be used if the
+// server accepts it.
+func wsClientHandshake(conn net.Conn, u *url.URL, compress bool) (*wsConn, error) {
+	var kb [16]byte
+	if _, err := io.ReadFull(rand.Reader, kb[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(kb[:])
+
+	path := u.RequestURI()
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "GET %s HTTP/1.1\r\nHost: %s\r\n", path, u.Host)
+	req.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	fmt.Fprintf(&req, "Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n", key)
+	if compress {
+		fmt.Fprintf(&req, "Sec-WebSocket-Extensions: %s\r\n", wsPMCNoContextExts)
+	}
+	req.WriteString("\r\n")
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket handshake failed: %s", resp.Status)
+	}
+	if !wsHeaderContains(resp.Header, "Upgrade", "websocket") ||
+		!wsHeaderContains(resp.Header, "Connection", "upgrade") {
+		return nil, fmt.Errorf("websocket handshake failed: invalid upgrade response")
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		return nil, fmt.Errorf("websocket handshake failed: invalid accept key")
+	}
+	return newWSConn(conn, br, true, compress && wsPMCRequested(resp.Header)), nil
+}
+
+// Performs the server side of the websocket handshake on the given connection.
+// If compress is true, permessage-deflate is accepted when requested by the client.
+// The request is refused if check, when not nil, returns an error.
+func wsServerHandshake(conn net.Conn, compress bool, check func(*http.Request) error) (*wsConn, error) {
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, err
+	}
+	req.Body.Close()
+
+	fail := func(status int, reason string) (*wsConn, error) {
+		fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+			status, http.StatusText(status))
+		return nil, fmt.Errorf("websocket handshake failed: %s", reason)
+	}
+	if req.Method != http.MethodGet {
+		return fail(http.StatusMethodNotAllowed, "request method must be GET")
+	}
+	if !wsHeaderContains(req.Header, "Upgrade", "websocket") {
+		return fail(http.StatusBadRequest, "invalid value for header 'Upgrade'")
+	}
+	if !wsHeaderContains(req.Header, "Connection", "upgrade") {
+		return fail(http.StatusBadRequest, "invalid value for header 'Connection'")
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		return fail(http.StatusBadRequest, "unsupported websocket version")
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return fail(http.StatusBadRequest, "key missing")
+	}
+	if check != nil {
+		if err := check(req); err != nil {
+			return fail(http.StatusForbidden, err.Error())
+		}
+	}
+	compress = compress && wsPMCRequested(req.Header)
+
+	var resp bytes.Buffer
+	resp.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	fmt.Fprintf(&resp, "Sec-WebSocket-Accept: %s\r\n", wsAcceptKey(key))
+	if compress {
+		fmt.Fprintf(&resp, "Sec-WebSocket-Extensions: %s\r\n", wsPMCNoContextExts)
+	}
+	resp.WriteString("\r\n")
+	if _, err := conn.Write(resp.Bytes()); err != nil {
+		return nil, err
+	}
+	return newWSConn(conn, br, false, compress), nil
+}
+
+func newWSConn(conn net.Conn, br *bufio.Reader, client, compress bool) *wsConn {
+	return &wsConn{Conn: conn, br: br, client: client, compress: compress}
+}
+
+// Read returns the payload of data frames received from the remote.
+// Control frames are handled internally.
+func (ws *wsConn) Read(p []byte) (int, error) {
+	for len(ws.pending) == 0 {
+		if ws.closed {
+			return 0, io.EOF
+		}
+		if err := ws.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, ws.pending)
+	ws.pending = ws.pending[n:]
+	return n, nil
+}
+
+// Reads a single frame and, if it completes a data message,
+// makes its payload available as pending.
+func (ws *wsConn) readFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(ws.br, hdr[:]); err != nil {
+		return err
+	}
+	final := hdr[0]&wsFinalBit != 0
+	compressed := hdr[0]&wsRsv1Bit != 0
+	opcode := int(hdr[0] & 0xf)
+	masked := hdr[1]&wsMaskBit != 0
+
+	size := uint64(hdr[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+			return err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+			return err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	// Frames sent by a client must be masked, and the ones sent by a server must not.
+	if masked == ws.client {
+		return ws.protocolError("invalid frame masking")
+	}
+	if size+uint64(len(ws.frag)) > wsMaxMessageSize {
+		return ws.protocolError("message too big")
+	}
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(ws.br, key[:]); err != nil {
+			return err
+		}
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(ws.br, payload); err != nil {
+		return err
+	}
+	if masked {
+		wsMask(key, payload)
+	}
+
+	switch opcode {
+	case wsPingFrame:
+		if !final || size > wsMaxControlPayloadSize {
+			return ws.protocolError("invalid control frame")
+		}
+		return ws.writeFrame(wsPongFrame, payload, false)
+	case wsPongFrame:
+		return nil
+	case wsCloseFrame:
+		// Echo the status code back and report EOF to the reader.
+		var status []byte
+		if len(payload) >= 2 {
+			status = payload[:2]
+		}
+		ws.writeFrame(wsCloseFrame, status, false)
+		ws.closed = true
+		return nil
+	case wsTextFrame, wsBinaryFrame:
+		if ws.frag != nil {
+			return ws.protocolError("new message started before the end of the previous one")
+		}
+		if compressed && !ws.compress {
+			return ws.protocolError("unexpected compressed frame")
+		}
+		ws.fragCmp = compressed
+	case wsContinuationFrame:
+		if ws.frag == nil {
+			return ws.protocolError("unexpected continuation frame")
+		}
+	default:
+		return ws.protocolError(fmt.Sprintf("unknown opcode %d", opcode))
+	}
+
+	if !final {
+		if ws.frag == nil {
+			ws.frag = payload
+		} else {
+			ws.frag = append(ws.frag, payload...)
+		}
+		return nil
+	}
+	if ws.frag != nil {
+		payload = append(ws.frag, payload...)
+		ws.frag = nil
+	}
+	if ws.fragCmp {
+		var err error
+		if payload, err = wsDecompress(payload); err != nil {
+			return err
+		}
+	}
+	ws.pending = payload
+	return nil
+}
+
+// Sends a close frame with the protocol error status code and returns an error.
+func (ws *wsConn) protocolError(reason string) error {
+	var status [2]byte
+	binary.BigEndian.PutUint16(status[:], 1002)
+	ws.writeFrame(wsCloseFrame, status[:], false)
+	return fmt.Errorf("websocket protocol error: %s", reason)
+}
+
+// Write sends p as a single binary frame, compressed if negotiated.
+func (ws *wsConn) Write(p []byte) (int, error) {
+	if err := ws.writeFrame(wsBinaryFrame, p, ws.compress); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (ws *wsConn) writeFrame(opcode int, payload []byte, compress bool) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	first := byte(wsFinalBit | opcode)
+	if compress && len(payload) > 0 {
+		ws.cb.Reset()
+		if ws.fw == nil {
+			ws.fw, _ = flate.NewWriter(&ws.cb, flate.BestSpeed)
+		} else {
+			ws.fw.Reset(&ws.cb)
+		}
+		ws.fw.Write(payload)
+		ws.fw.Flush()
+		// Remove the 0x00 0x00 0xff 0xff trailer (RFC 7692).
+		payload = ws.cb.Bytes()
+		payload = payload[:len(payload)-4]
+		first |= wsRsv1Bit
+	}
+
+	var hdr [14]byte
+	hdr[0] = first
+	n := 2
+	switch l := len(payload); {
+	case l <= 125:
+		hdr[1] = byte(l)
+	case l <= 0xffff:
+		hdr[1] = 126
+		binary.BigEndian.PutUint16(hdr[2:], uint16(l))
+		n += 2
+	default:
+		hdr[1] = 127
+		binary.BigEndian.PutUint64(hdr[2:], uint64(l))
+		n += 8
+	}
+	if ws.client {
+		var key [4]byte
+		if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+			return err
+		}
+		hdr[1] |= wsMaskBit
+		copy(hdr[n:], key[:])
+		n += 4
+		// Do not modify the caller's buffer.
+		masked := make([]byte, len(payload))
+		copy(masked, payload)
+		wsMask(key, masked)
+		payload = masked
+	}
+	bufs := net.Buffers{hdr[:n], payload}
+	_, err := bufs.WriteTo(ws.Conn)
+	return err
+}
+
+func wsMask(key [4]byte, buf []byte) {
+	for i := range buf {
+		buf[i] ^= key[i&3]
+	}
+}
+
+func wsDecompress(payload []byte) ([]byte, error) {
+	r := flate.NewReader(io.MultiReader(bytes.NewReader(payload), bytes.NewReader(wsCompressedTrailer)))
+	defer r.Close()
+	buf, err := ioutil.ReadAll(io.LimitReader(r, wsMaxMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("websocket decompression error: %v", err)
+	}
+	if len(buf) > wsMaxMessageSize {
+		return nil, fmt.Errorf("websocket decompressed message too big")
+	}
+	return buf, nil
+}
+
+// Performs the TLS (for wss://) and websocket handshakes for
+// a solicited leafnode connection. The connection is closed on error.
+func (s *Server) wsSolicitLeafNode(conn net.Conn, remote *leafNodeCfg, u *url.URL) (net.Conn, error) {
+	wait := TLS_TIMEOUT
+	if remote.TLSTimeout != 0 {
+		wait = secondsToDuration(remote.TLSTimeout)
+	}
+	conn.SetDeadline(time.Now().Add(wait))
+
+	if strings.ToLower(u.Scheme) == "wss" {
+		var tlsConfig *tls.Config
+		if remote.TLSConfig != nil {
+			tlsConfig = remote.TLSConfig.Clone()
+		} else {
+			tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = u.Hostname()
+		}
+		tc := tls.Client(conn, tlsConfig)
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake error: %v", err)
+		}
+		conn = tc
+	}
+	ws, err := wsClientHandshake(conn, u, remote.Compression)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ws, nil
+}
+
+// This is the leafnode websocket accept loop. This runs as a go-routine.
+// Connections accepted here go through the TLS and websocket handshakes
+// before being handled as regular leafnode connections.
+func (s *Server) leafNodeWebsocketAcceptLoop(ch chan struct{}) {
+	defer func() {
+		if ch != nil {
+			close(ch)
+		}
+	}()
+
+	// Snapshot server options.
+	opts := s.getOpts()
+	wo := &opts.LeafNode.Websocket
+
+	port := wo.Port
+	if port == -1 {
+		port = 0
+	}
+	hp := net.JoinHostPort(wo.Host, strconv.Itoa(port))
+	l, e := net.Listen("tcp", hp)
+	if e != nil {
+		s.Fatalf("Error listening on leafnode websocket port: %d - %v", wo.Port, e)
+		return
+	}
+	scheme := "ws"
+	if wo.TLSConfig != nil {
+		scheme = "wss"
+	}
+	s.Noticef("Listening for leafnode websocket connections on %s://%s", scheme,
+		net.JoinHostPort(wo.Host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
+
+	s.mu.Lock()
+	// If we have selected a random port...
+	if port == 0 {
+		// Write resolved port back to options.
+		wo.Port = l.Addr().(*net.TCPAddr).Port
+	}
+	s.leafNodeWSListener = l
+	s.mu.Unlock()
+
+	// Let them know we are up
+	close(ch)
+	ch = nil
+
+	tmpDelay := ACCEPT_MIN_SLEEP
+
+	for s.isRunning() {
+		conn, err := l.Accept()
+		if err != nil {
+			tmpDelay = s.acceptError("LeafNode websocket", err, tmpDelay)
+			continue
+		}
+		tmpDelay = ACCEPT_MIN_SLEEP
+		s.startGoRoutine(func() {
+			s.createWebsocketLeafNode(conn)
+			s.grWG.Done()
+		})
+	}
+	s.Debugf("Leafnode websocket accept loop exiting..")
+	s.done <- true
+}
+
+// Completes the TLS and websocket handshakes for an accepted
+// connection and creates the leafnode connection.
+func (s *Server) createWebsocketLeafNode(conn net.Conn) {
+	opts := s.getOpts()
+	wo := &opts.LeafNode.Websocket
+
+	ws, err := wsAccept(conn, wo.TLSConfig, secondsToDuration(wo.TLSTimeout), wo.Compression, nil)
+	if err != nil {
+		s.Debugf("Leafnode websocket handshake error from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	s.createLeafNode(ws, nil)
+}
+
+// Performs the TLS, if tlsConfig is not nil, and websocket handshakes
+// for an accepted connection. The connection is closed on error.
+func wsAccept(conn net.Conn, tlsConfig *tls.Config, timeout time.Duration, compress bool, check func(*http.Request) error) (*wsConn, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	if tlsConfig != nil {
+		tc := tls.Server(conn, tlsConfig)
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake error: %v", err)
+		}
+		conn = tc
+	}
+	ws, err := wsServerHandshake(conn, compress, check)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ws, nil
+}
+
+// Validates the options of the client websocket listener.
+func validateWebsocketOptions(o *Options) error {
+	wo := &o.Websocket
+	if wo.Port == 0 {
+		return nil
+	}
+	if wo.TLSConfig == nil && !wo.NoTLS {
+		return fmt.Errorf("websocket requires TLS configuration, or no_tls set to true")
+	}
+	for _, origin := range wo.AllowedOrigins {
+		u, err := url.ParseRequestURI(origin)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid websocket allowed origin %q", origin)
+		}
+	}
+	return nil
+}
+
+// Checks the origin of a client upgrade request. Requests without
+// origin do not come from browsers and are accepted.
+func wsCheckOrigin(wo *WebsocketOpts, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" || (!wo.SameOrigin && len(wo.AllowedOrigins) == 0) {
+		return nil
+	}
+	ou, err := url.ParseRequestURI(origin)
+	if err != nil || ou.Host == "" {
+		return fmt.Errorf("invalid origin %q", origin)
+	}
+	sameOrigin := func(u *url.URL) bool {
+		return strings.EqualFold(ou.Scheme, u.Scheme) && strings.EqualFold(wsHostPort(ou), wsHostPort(u))
+	}
+	if wo.SameOrigin {
+		scheme := "http"
+		if wo.TLSConfig != nil {
+			scheme = "https"
+		}
+		if !sameOrigin(&url.URL{Scheme: scheme, Host: r.Host}) {
+			return fmt.Errorf("origin %q not allowed", origin)
+		}
+	}
+	if len(wo.AllowedOrigins) > 0 {
+		for _, allowed := range wo.AllowedOrigins {
+			if u, err := url.ParseRequestURI(allowed); err == nil && sameOrigin(u) {
+				return nil
+			}
+		}
+		return fmt.Errorf("origin %q not allowed", origin)
+	}
+	return nil
+}
+
+// This is the client websocket accept loop. This runs as a go-routine.
+// Connections accepted here go through the TLS and websocket handshakes
+// before being handled as regular client connections.
+func (s *Server) websocketAcceptLoop(ch chan struct{}) {
+	defer func() {
+		if ch != nil {
+			close(ch)
+		}
+	}()
+
+	// Snapshot server options.
+	opts := s.getOpts()
+	wo := &opts.Websocket
+
+	port := wo.Port
+	if port == -1 {
+		port = 0
+	}
+	hp := net.JoinHostPort(wo.Host, strconv.Itoa(port))
+	l, e := net.Listen("tcp", hp)
+	if e != nil {
+		s.Fatalf("Error listening on websocket port: %d - %v", wo.Port, e)
+		return
+	}
+	scheme := "ws"
+	if wo.TLSConfig != nil {
+		scheme = "wss"
+	}
+	s.Noticef("Listening for websocket clients on %s://%s", scheme,
+		net.JoinHostPort(wo.Host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
+	if wo.TLSConfig == nil {
+		s.Warnf("Websocket not configured with TLS. DO NOT USE IN PRODUCTION!")
+	}
+
+	s.mu.Lock()
+	// If we have selected a random port...
+	if port == 0 {
+		// Write resolved port back to options.
+		wo.Port = l.Addr().(*net.TCPAddr).Port
+	}
+	s.wsListener = l
+	s.mu.Unlock()
+
+	// Let them know we are up
+	close(ch)
+	ch = nil
+
+	tmpDelay := ACCEPT_MIN_SLEEP
+
+	for s.isRunning() {
+		conn, err := l.Accept()
+		if err != nil {
+			tmpDelay = s.acceptError("Websocket", err, tmpDelay)
+			continue
+		}
+		tmpDelay = ACCEPT_MIN_SLEEP
+		s.startGoRoutine(func() {
+			s.createWebsocketClient(conn)
+			s.grWG.Done()
+		})
+	}
+	s.Debugf("Websocket accept loop exiting..")
+	s.done <- true
+}
+
+// Completes the TLS and websocket handshakes for an accepted
+// connection and creates the client connection.
+func (s *Server) createWebsocketClient(conn net.Conn) {
+	opts := s.getOpts()
+	wo := &opts.Websocket
+
+	var cookieJWT string
+	check := func(r *http.Request) error {
+		if err := wsCheckOrigin(wo, r); err != nil {
+			return err
+		}
+		if wo.JWTCookie != "" {
+			if c, err := r.Cookie(wo.JWTCookie); err == nil {
+				cookieJWT = c.Value
+			}
+		}
+		return nil
+	}
+	ws, err := wsAccept(conn, wo.TLSConfig, wo.HandshakeTimeout, wo.Compression, check)
+	if err != nil {
+		s.Debugf("Websocket handshake error from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	ws.cookieJWT = cookieJWT
+	s.createClient(ws)
+}
+
+// Adjusts the INFO sent to websocket clients: TLS is handled by the
+// websocket transport, and the connect URLs are the ones of the NATS port.
+func wsClientInfo(info *Info) {
+	info.TLSRequired = false
+	info.ClientConnectURLs = nil
+}
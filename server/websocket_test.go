@@ -0,0 +1,276 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+func testWSOptions() *Options {
+	o := DefaultOptions()
+	o.Websocket.Host = "127.0.0.1"
+	o.Websocket.Port = -1
+	o.Websocket.NoTLS = true
+	return o
+}
+
+// Performs the websocket handshake with the extra request headers and
+// returns the response status, and the connection if upgraded.
+func testWSHandshake(t *testing.T, o *Options, hdrs string) (int, *wsConn) {
+	t.Helper()
+	addr := net.JoinHostPort(o.Websocket.Host, strconv.Itoa(o.Websocket.Port))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	var kb [16]byte
+	io.ReadFull(rand.Reader, kb[:])
+	key := base64.StdEncoding.EncodeToString(kb[:])
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n%s\r\n", addr, key, hdrs)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		conn.Close()
+		t.Fatalf("Error reading handshake response: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, newWSConn(conn, br, true, false)
+}
+
+func TestWebsocketClient(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		compress bool
+	}{
+		{"plain", false},
+		{"compression", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(fmt.Sprintf(`
+				listen: "127.0.0.1:-1"
+				websocket {
+					listen: "127.0.0.1:-1"
+					no_tls: true
+					compression: %v
+				}
+			`, test.compress)))
+			defer os.Remove(conf)
+			s, o := RunServerWithConfig(conf)
+			defer s.Shutdown()
+
+			u := &url.URL{Scheme: "ws", Host: fmt.Sprintf("127.0.0.1:%d", o.Websocket.Port)}
+			conn, err := net.Dial("tcp", u.Host)
+			if err != nil {
+				t.Fatalf("Error on dial: %v", err)
+			}
+			ws, err := wsClientHandshake(conn, u, test.compress)
+			if err != nil {
+				t.Fatalf("Error on handshake: %v", err)
+			}
+			defer ws.Close()
+			if ws.compress != test.compress {
+				t.Fatalf("Expected compression to be %v", test.compress)
+			}
+			ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+			br := bufio.NewReader(ws)
+
+			l, err := br.ReadString('\n')
+			if err != nil || !strings.HasPrefix(l, "INFO ") {
+				t.Fatalf("Expected INFO, got %q: %v", l, err)
+			}
+			var info Info
+			if err := json.Unmarshal([]byte(l[5:]), &info); err != nil {
+				t.Fatalf("Error unmarshalling INFO: %v", err)
+			}
+			if info.TLSRequired || len(info.ClientConnectURLs) > 0 {
+				t.Fatalf("Unexpected INFO for a websocket client: %+v", info)
+			}
+
+			ws.Write([]byte("CONNECT {\"verbose\":false,\"protocol\":1}\r\nSUB foo 1\r\nPING\r\n"))
+			if l, _ := br.ReadString('\n'); l != "PONG\r\n" {
+				t.Fatalf("Expected PONG, got %q", l)
+			}
+
+			// Messages from regular clients go through the same path.
+			nc, err := nats.Connect(fmt.Sprintf("nats://%s:%d", o.Host, o.Port))
+			if err != nil {
+				t.Fatalf("Error on connect: %v", err)
+			}
+			defer nc.Close()
+			big := bytes.Repeat([]byte("x"), 100*1024)
+			nc.Publish("foo", big)
+			nc.Flush()
+
+			expected := fmt.Sprintf("MSG foo 1 %d\r\n", len(big))
+			if l, _ := br.ReadString('\n'); l != expected {
+				t.Fatalf("Expected %q, got %q", expected, l)
+			}
+			buf := make([]byte, len(big)+2)
+			if _, err := io.ReadFull(br, buf); err != nil || !bytes.Equal(buf[:len(big)], big) {
+				t.Fatalf("Did not get the expected payload: %v", err)
+			}
+
+			sub, _ := nc.SubscribeSync("bar")
+			nc.Flush()
+			ws.Write([]byte("PUB bar 5\r\nhello\r\n"))
+			if m, err := sub.NextMsg(time.Second); err != nil || string(m.Data) != "hello" {
+				t.Fatalf("Did not get the message of the websocket client: %v", err)
+			}
+		})
+	}
+}
+
+func TestWebsocketOrigin(t *testing.T) {
+	o := testWSOptions()
+	o.Websocket.SameOrigin = true
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	host := fmt.Sprintf("127.0.0.1:%d", o.Websocket.Port)
+	for _, test := range []struct {
+		origin string
+		status int
+	}{
+		{"", http.StatusSwitchingProtocols},
+		{"http://" + host, http.StatusSwitchingProtocols},
+		{"https://" + host, http.StatusForbidden},
+		{"http://example.com", http.StatusForbidden},
+		{"http://other.com", http.StatusForbidden},
+	} {
+		var hdr string
+		if test.origin != "" {
+			hdr = fmt.Sprintf("Origin: %s\r\n", test.origin)
+		}
+		status, ws := testWSHandshake(t, o, hdr)
+		if ws != nil {
+			ws.Close()
+		}
+		if status != test.status {
+			t.Fatalf("Expected status %d for origin %q, got %d", test.status, test.origin, status)
+		}
+	}
+
+	// Without same origin, only the allowed origins are checked.
+	s.Shutdown()
+	o = testWSOptions()
+	o.Websocket.AllowedOrigins = []string{"https://example.com"}
+	s = RunServer(o)
+	defer s.Shutdown()
+
+	for _, test := range []struct {
+		origin string
+		status int
+	}{
+		{"https://example.com", http.StatusSwitchingProtocols},
+		{"https://example.com:443", http.StatusSwitchingProtocols},
+		{"http://example.com", http.StatusForbidden},
+		{"https://example.com:8443", http.StatusForbidden},
+	} {
+		status, ws := testWSHandshake(t, o, fmt.Sprintf("Origin: %s\r\n", test.origin))
+		if ws != nil {
+			ws.Close()
+		}
+		if status != test.status {
+			t.Fatalf("Expected status %d for origin %q, got %d", test.status, test.origin, status)
+		}
+	}
+}
+
+func TestWebsocketJWTCookie(t *testing.T) {
+	okp, _ := nkeys.FromSeed(oSeed)
+	opub, _ := okp.PublicKey()
+
+	o := testWSOptions()
+	o.TrustedKeys = []string{opub}
+	o.Websocket.JWTCookie = "jwt"
+	s := RunServer(o)
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	addAccountToMemResolver(s, apub, ajwt)
+
+	nkp, _ := nkeys.CreateUser()
+	upub, _ := nkp.PublicKey()
+	ujwt, err := jwt.NewUserClaims(upub).Encode(akp)
+	if err != nil {
+		t.Fatalf("Error generating user JWT: %v", err)
+	}
+
+	connect := func(hdr string) string {
+		t.Helper()
+		_, ws := testWSHandshake(t, o, hdr)
+		if ws == nil {
+			t.Fatalf("Websocket handshake failed")
+		}
+		defer ws.Close()
+		ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+		br := bufio.NewReader(ws)
+		l, _ := br.ReadString('\n')
+		var info nonceInfo
+		json.Unmarshal([]byte(l[5:]), &info)
+		sigraw, _ := nkp.Sign([]byte(info.Nonce))
+		sig := base64.RawURLEncoding.EncodeToString(sigraw)
+		ws.Write([]byte(fmt.Sprintf("CONNECT {\"verbose\":false,\"sig\":%q}\r\nPING\r\n", sig)))
+		l, _ = br.ReadString('\n')
+		return l
+	}
+	if l := connect(_EMPTY_); !strings.HasPrefix(l, "-ERR") {
+		t.Fatalf("Expected an error without the cookie, got %q", l)
+	}
+	if l := connect(fmt.Sprintf("Cookie: jwt=%s\r\n", ujwt)); l != "PONG\r\n" {
+		t.Fatalf("Expected PONG with the cookie, got %q", l)
+	}
+}
+
+func TestWebsocketValidateOptions(t *testing.T) {
+	o := testWSOptions()
+	o.Websocket.NoTLS = false
+	if err := validateOptions(o); err == nil || !strings.Contains(err.Error(), "requires TLS") {
+		t.Fatalf("Expected an error about TLS, got %v", err)
+	}
+	o = testWSOptions()
+	o.Websocket.AllowedOrigins = []string{"example.com"}
+	if err := validateOptions(o); err == nil || !strings.Contains(err.Error(), "allowed origin") {
+		t.Fatalf("Expected an error about the allowed origin, got %v", err)
+	}
+}
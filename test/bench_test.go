@@ -25,6 +25,7 @@ import (
 	"math/rand"
 	"net"
 	"net/url"
+	"runtime"
 	"testing"
 	"time"
 
@@ -537,6 +538,67 @@ func Benchmark_DenyMsgYesWCPubSub(b *testing.B) {
 	b.StopTimer()
 }
 
+// The subscription memory benchmarks create b.N subscriptions, over 10
+// connections, and report the heap retained per subscription, as B/sub, to
+// track the memory needed for massive subscription counts. Run with a fixed
+// count, for instance:
+//
+//	go test -run=XXX -bench=SubMemory -benchtime=1000000x ./test
+func benchSubMemory(b *testing.B, subject func(i int) string, queue string) {
+	b.StopTimer()
+	s := runBenchServer()
+	defer s.Shutdown()
+
+	conns := make([]net.Conn, 10)
+	for i := range conns {
+		conns[i] = createClientConn(b, "127.0.0.1", PERF_PORT)
+		defer conns[i].Close()
+		doDefaultConnect(b, conns[i])
+	}
+	heap := func() uint64 {
+		var m runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc
+	}
+	before := heap()
+
+	b.StartTimer()
+	for i, c := range conns {
+		bw := bufio.NewWriterSize(c, defaultSendBufSize)
+		for j := i; j < b.N; j += len(conns) {
+			fmt.Fprintf(bw, "SUB %s %s %d\r\n", subject(j), queue, j)
+		}
+		if err := bw.Flush(); err != nil {
+			b.Fatalf("Received error on SUB write: %v\n", err)
+		}
+	}
+	for _, c := range conns {
+		flushConnection(b, c)
+	}
+	b.StopTimer()
+
+	if n := s.NumSubscriptions(); n != uint32(b.N) {
+		b.Fatalf("Expected %d subscriptions, got %d", b.N, n)
+	}
+	b.ReportMetric(float64(heap()-before)/float64(b.N), "B/sub")
+}
+
+// Subscriptions on distinct subjects, as for replies.
+func Benchmark_____SubMemoryUnique(b *testing.B) {
+	benchSubMemory(b, func(i int) string { return fmt.Sprintf("_INBOX.reply.%d", i) }, "")
+}
+
+// Subscriptions on 1000 subjects, as for services.
+func Benchmark_____SubMemoryShared(b *testing.B) {
+	benchSubMemory(b, func(i int) string { return fmt.Sprintf("svc.%d.req", i%1000) }, "")
+}
+
+// Queue subscriptions on 1000 subjects, with the same queue name.
+func Benchmark______SubMemoryQueue(b *testing.B) {
+	benchSubMemory(b, func(i int) string { return fmt.Sprintf("svc.%d.req", i%1000) }, "workers")
+}
+
 func routePubSub(b *testing.B, size int) {
 	b.StopTimer()
 
@@ -815,6 +877,21 @@ func Benchmark__FanOut_1kx100x100(b *testing.B) {
 	doFanout(b, 1, 100, 100, sub, sizedString(1024))
 }
 
+// Large fan-outs of larger payloads, to one subscription per connection,
+// where the payload is shared by the connections.
+
+func Benchmark___FanOut_1kx500x1(b *testing.B) {
+	doFanout(b, 1, 500, 1, sub, sizedString(1024))
+}
+
+func Benchmark___FanOut_4kx500x1(b *testing.B) {
+	doFanout(b, 1, 500, 1, sub, sizedString(4096))
+}
+
+func Benchmark__FanOut_16kx100x10(b *testing.B) {
+	doFanout(b, 1, 100, 10, sub, sizedString(16384))
+}
+
 func Benchmark_____RFanOut_8x1x10(b *testing.B) {
 	doFanout(b, 2, 1, 10, sub, payload)
 }
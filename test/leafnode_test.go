@@ -1115,9 +1115,9 @@ func TestLeafNodeMultipleAccounts(t *testing.T) {
 
 	lsub, _ := ncl.SubscribeSync("foo.test")
 
-	// Wait for the sub to propagate.
+	// Wait for the sub to propagate, along with the loop detection one.
 	checkFor(t, time.Second, 10*time.Millisecond, func() error {
-		if subs := s.NumSubscriptions(); subs < 1 {
+		if subs := s.NumSubscriptions(); subs < 2 {
 			return fmt.Errorf("Number of subs is %d", subs)
 		}
 		return nil
@@ -1223,9 +1223,9 @@ func TestLeafNodeExportsImports(t *testing.T) {
 	// So everything should be setup here. So let's test streams first.
 	lsub, _ := ncl.SubscribeSync("import.foo.stream")
 
-	// Wait for the sub to propagate.
+	// Wait for the sub to propagate, along with the loop detection one.
 	checkFor(t, time.Second, 10*time.Millisecond, func() error {
-		if subs := s.NumSubscriptions(); subs < 1 {
+		if subs := s.NumSubscriptions(); subs < 2 {
 			return fmt.Errorf("Number of subs is %d", subs)
 		}
 		return nil
@@ -1385,9 +1385,9 @@ func TestLeadNodeExportImportComplexSetup(t *testing.T) {
 	// So everything should be setup here. So let's test streams first.
 	lsub, _ := ncl.SubscribeSync("import.foo.stream")
 
-	// Wait for the sub to propagate to s2.
+	// Wait for the sub to propagate to s2, along with the loop detection one.
 	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
-		if acc1.RoutedSubs() == 0 {
+		if acc1.RoutedSubs() < 2 {
 			return fmt.Errorf("Still no routed subscription")
 		}
 		return nil
@@ -37,7 +37,7 @@ func TestPidFile(t *testing.T) {
 	opts.PidFile = file.Name()
 
 	s := RunServer(&opts)
-	s.Shutdown()
+	defer s.Shutdown()
 
 	buf, err := ioutil.ReadFile(opts.PidFile)
 	if err != nil {
@@ -52,4 +52,10 @@ func TestPidFile(t *testing.T) {
 	if pid != os.Getpid() {
 		t.Fatalf("Expected pid to be %d, got %d\n", os.Getpid(), pid)
 	}
+
+	// The pid_file is removed on shutdown.
+	s.Shutdown()
+	if _, err := os.Stat(opts.PidFile); !os.IsNotExist(err) {
+		t.Fatalf("Expected the pid_file to be removed, got %v", err)
+	}
 }
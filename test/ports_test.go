@@ -201,3 +201,57 @@ func TestPortsFileReload(t *testing.T) {
 		t.Fatalf("the port file %s was not deleted", portsFileInA)
 	}
 }
+
+func TestPortsFileAndPidFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Error creating temp director (%s): %v", tempDir, err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	opts := DefaultTestOptions
+	opts.PortsFile = filepath.Join(tempDir, "nats.ports")
+	opts.PidFile = filepath.Join(tempDir, "nats.pid")
+	opts.Port = -1
+	opts.Cluster.Port = -1
+	opts.LeafNode.Port = -1
+
+	s := RunServer(&opts)
+	defer s.Shutdown()
+
+	buf, err := waitForFile(opts.PortsFile, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Could not read ports file: %v", err)
+	}
+	readPorts := server.Ports{}
+	if err := json.Unmarshal(buf, &readPorts); err != nil {
+		t.Fatalf("Error decoding ports file: %v", err)
+	}
+	if len(readPorts.Nats) == 0 || !strings.HasPrefix(readPorts.Nats[0], "nats://") {
+		t.Fatal("Expected at least one nats url")
+	}
+	if len(readPorts.Cluster) == 0 || !strings.HasPrefix(readPorts.Cluster[0], "nats://") {
+		t.Fatal("Expected at least one cluster listen url")
+	}
+	if len(readPorts.LeafNodes) == 0 || !strings.HasPrefix(readPorts.LeafNodes[0], "nats://") {
+		t.Fatal("Expected at least one leafnode listen url")
+	}
+
+	pid, err := ioutil.ReadFile(opts.PidFile)
+	if err != nil {
+		t.Fatalf("Could not read pid file: %v", err)
+	}
+	if string(pid) != fmt.Sprintf("%d", os.Getpid()) {
+		t.Fatalf("Unexpected pid file content: %q", pid)
+	}
+
+	s.Shutdown()
+	// Both files are removed, and no temporary file is left behind.
+	files, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		t.Fatalf("Error reading directory: %v", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("Expected the directory to be empty, got %v", files[0].Name())
+	}
+}
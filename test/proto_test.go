@@ -128,6 +128,87 @@ func TestQueueSub(t *testing.T) {
 	}
 }
 
+func TestProtoDrain(t *testing.T) {
+	s := runProtoServer()
+	defer s.Shutdown()
+
+	c1 := createClientConn(t, "127.0.0.1", PROTO_TEST_PORT)
+	defer c1.Close()
+	if info := checkInfoMsg(t, c1); !info.Drain {
+		t.Fatalf("Expected the server to advertise drain support")
+	}
+	sendProto(t, c1, "CONNECT {\"verbose\":false,\"pedantic\":false,\"tls_required\":false}\r\n")
+	send1, expect1 := sendCommand(t, c1), expectCommand(t, c1)
+
+	c2 := createClientConn(t, "127.0.0.1", PROTO_TEST_PORT)
+	defer c2.Close()
+	send2, expect2 := setupConn(t, c2)
+	expectMsgs2 := expectMsgsCommand(t, expect2)
+
+	send1("SUB foo workers 1\r\nPING\r\n")
+	expect1(pongRe)
+	send2("SUB foo workers 2\r\nPING\r\n")
+	expect2(pongRe)
+
+	// Once drained, all the messages go to the remaining queue member.
+	send1("DRAIN\r\n")
+	expect1(drainedRe)
+
+	sent := 20
+	for i := 0; i < sent; i++ {
+		send2("PUB foo 2\r\nok\r\n")
+	}
+	matches := expectMsgs2(sent)
+	for _, m := range matches {
+		if sid := string(m[sidIndex]); sid != "2" {
+			t.Fatalf("Expected messages for sid 2, got %q", sid)
+		}
+	}
+	expectNothing(t, c1)
+
+	// New subscriptions are rejected.
+	send1("SUB bar 3\r\n")
+	expect1(errRe)
+	send2("PUB bar 2\r\nok\r\n")
+	expectNothing(t, c1)
+}
+
+func TestProtoNoEcho(t *testing.T) {
+	s := runProtoServer()
+	defer s.Shutdown()
+
+	c1 := createClientConn(t, "127.0.0.1", PROTO_TEST_PORT)
+	defer c1.Close()
+	checkInfoMsg(t, c1)
+	sendProto(t, c1, "CONNECT {\"verbose\":false,\"pedantic\":false,\"echo\":false,\"protocol\":1}\r\n")
+	send1, expect1 := sendCommand(t, c1), expectCommand(t, c1)
+
+	c2 := createClientConn(t, "127.0.0.1", PROTO_TEST_PORT)
+	defer c2.Close()
+	send2, expect2 := setupConn(t, c2)
+	expectMsgs2 := expectMsgsCommand(t, expect2)
+
+	send1("SUB foo 1\r\nSUB bar workers 2\r\nPING\r\n")
+	expect1(pongRe)
+	send2("SUB foo 1\r\nSUB bar workers 2\r\nPING\r\n")
+	expect2(pongRe)
+
+	// Messages published by c1 are not delivered back to c1, and the other
+	// queue member gets all of them.
+	sent := 10
+	for i := 0; i < sent; i++ {
+		send1("PUB foo 2\r\nok\r\nPUB bar 2\r\nok\r\n")
+	}
+	send1("PING\r\n")
+	expect1(pongRe)
+	expectMsgs2(2 * sent)
+
+	// Messages from others are still delivered to c1.
+	send2("PUB foo 2\r\nok\r\n")
+	matches := expectMsgsCommand(t, expect1)(1)
+	checkMsg(t, matches[0], "foo", "1", "", "2", "ok")
+}
+
 func TestMultipleQueueSub(t *testing.T) {
 	s := runProtoServer()
 	defer s.Shutdown()
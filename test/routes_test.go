@@ -19,6 +19,7 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"regexp"
 	"runtime"
 	"strconv"
 	"sync"
@@ -244,6 +245,38 @@ func TestRouteForwardsMsgToClients(t *testing.T) {
 	checkMsg(t, matches[0], "foo", "1", "", "2", "ok")
 }
 
+func TestRouteHeaderMsgs(t *testing.T) {
+	s, opts := runRouteServer(t)
+	defer s.Shutdown()
+
+	client := createClientConn(t, opts.Host, opts.Port)
+	defer client.Close()
+
+	checkInfoMsg(t, client)
+	sendProto(t, client, "CONNECT {\"verbose\":false,\"pedantic\":false,\"headers\":true}\r\n")
+	clientSend, clientExpect := sendCommand(t, client), expectCommand(t, client)
+
+	route := createRouteConn(t, opts.Cluster.Host, opts.Cluster.Port)
+	defer route.Close()
+	expectAuthRequired(t, route)
+	routeSend, routeExpect := setupRouteEx(t, route, opts, "ROUTER:xyz")
+	routeSend("INFO {\"server_id\":\"ROUTER:xyz\",\"headers\":true}\r\n")
+
+	routeSend("RS+ $G foo\r\nPING\r\n")
+	routeExpect(pongRe)
+
+	// The header block is sent apart on the route.
+	clientSend("HPUB foo 18 23\r\nNATS/1.0\r\nA: B\r\n\r\nhello\r\nPING\r\n")
+	clientExpect(pongRe)
+	routeExpect(regexp.MustCompile(`HMSG \$G foo 18 23\r\nNATS/1\.0\r\nA: B\r\n\r\nhello\r\n`))
+
+	// And delivered to the clients from the route.
+	clientSend("SUB bar 1\r\nPING\r\n")
+	clientExpect(pongRe)
+	routeSend("HMSG $G bar 18 23\r\nNATS/1.0\r\nA: B\r\n\r\nhello\r\n")
+	clientExpect(regexp.MustCompile(`HMSG bar 1 18 23\r\nNATS/1\.0\r\nA: B\r\n\r\nhello\r\n`))
+}
+
 func TestRouteOneHopSemantics(t *testing.T) {
 	s, opts := runRouteServer(t)
 	defer s.Shutdown()